@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// Serve requests from the host over AF_VSOCK and a virtio-serial port, to
+// run commands, copy files and stream logs without networking.
+
+const (
+	defaultPort   = 0xf3a6
+	defaultSerial = "/dev/virtio-ports/org.linuxkit.agent"
+	logDir        = "/var/log"
+)
+
+func main() {
+	port := flag.Int("port", defaultPort, "AF_VSOCK port to listen on, 0 disables vsock")
+	serial := flag.String("serial", defaultSerial, "virtio-serial port to serve, empty disables it")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: run commands, copy files and stream logs for 'linuxkit exec',\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "'linuxkit cp' and 'linuxkit logs'.\n\n")
+		fmt.Fprintf(os.Stderr, "Arguments:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	serving := false
+	if *serial != "" {
+		if _, err := os.Stat(*serial); err == nil {
+			go serveSerial(*serial)
+			log.Printf("Serving %s", *serial)
+			serving = true
+		}
+	}
+	if *port != 0 {
+		l, err := vsock.Listen(vsock.CIDAny, uint32(*port))
+		if err == nil {
+			log.Printf("Listening on vsock port %x", *port)
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					log.Fatalf("Error accepting connection: %s", err)
+				}
+				go func() {
+					serve(conn)
+					conn.Close()
+				}()
+			}
+		}
+		log.Printf("Failed to bind to vsock port %x: %s", *port, err)
+	}
+	if !serving {
+		log.Fatalf("Neither vsock nor %s are available", *serial)
+	}
+	select {}
+}
+
+// serveSerial serves one session after the other on a virtio-serial port
+func serveSerial(path string) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		served := serve(f)
+		// closing the port ends what is left of the session
+		f.Close()
+		if !served {
+			// the port returns EOF while no client is connected
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// serve handles the request of a session, and returns whether there was one
+func serve(conn io.ReadWriter) bool {
+	kind, b, err := readFrame(conn)
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Failed to read request: %v", err)
+		}
+		return false
+	}
+	w := &frameWriter{w: conn}
+	var req request
+	if kind != frameRequest {
+		err = fmt.Errorf("Expected a request")
+	} else {
+		err = json.Unmarshal(b, &req)
+	}
+	status := 0
+	if err == nil {
+		switch req.Op {
+		case "exec":
+			status, err = execCommand(req, conn, w)
+		case "get":
+			err = getFile(req, w)
+		case "put":
+			err = putFile(req, conn)
+		case "logs":
+			err = streamLog(req, conn, w)
+		default:
+			err = fmt.Errorf("Unknown request %q", req.Op)
+		}
+	}
+	if err != nil {
+		log.Printf("%s failed: %v", req.Op, err)
+		w.write(frameError, []byte(err.Error()))
+		return true
+	}
+	w.write(frameExit, []byte(strconv.Itoa(status)))
+	return true
+}
+
+// execCommand runs a command with the input sent by the host, and returns
+// its exit status. The command is killed if the host goes away.
+func execCommand(req request, conn io.Reader, w *frameWriter) (int, error) {
+	if len(req.Args) == 0 {
+		return 0, fmt.Errorf("No command given")
+	}
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	cmd.Stdout = streamWriter{w, frameStdout}
+	cmd.Stderr = streamWriter{w, frameStderr}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go func() {
+		for {
+			kind, b, err := readFrame(conn)
+			if err != nil {
+				stdin.Close()
+				cmd.Process.Kill()
+				return
+			}
+			if kind != frameStdin {
+				continue
+			}
+			if len(b) == 0 {
+				stdin.Close()
+				continue
+			}
+			stdin.Write(b)
+		}
+	}()
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// getFile sends the mode and contents of a file
+func getFile(req request, w *frameWriter) error {
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file, only files can be copied", req.Path)
+	}
+	if err := w.write(frameMode, []byte(strconv.FormatUint(uint64(fi.Mode().Perm()), 8))); err != nil {
+		return err
+	}
+	_, err = io.Copy(streamWriter{w, frameStdout}, f)
+	return err
+}
+
+// putFile writes the contents sent by the host to a file, or to a file
+// with the name of the request if the path is a directory
+func putFile(req request, conn io.Reader) error {
+	path := req.Path
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, req.Name)
+	}
+	mode := os.FileMode(req.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	for {
+		kind, b, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		if kind != frameStdin {
+			continue
+		}
+		if len(b) == 0 {
+			return f.Close()
+		}
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// logPath returns the file logwrite writes the log of a service to, or the
+// path itself if it is absolute
+func logPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(logDir, name+".log")
+}
+
+// streamLog sends a log, and if it is followed what is added to it until the
+// host goes away. Logs which are rotated are followed to the new file.
+func streamLog(req request, conn io.Reader, w *frameWriter) error {
+	path := logPath(req.Path)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	out := streamWriter{w, frameStdout}
+	if !req.Follow {
+		_, err := io.Copy(out, f)
+		return err
+	}
+
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := readFrame(conn); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+	for {
+		if _, err := io.Copy(out, f); err != nil {
+			return err
+		}
+		select {
+		case <-gone:
+			return nil
+		case <-time.After(time.Second):
+		}
+		current, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if latest, err := os.Stat(path); err == nil && !os.SameFile(current, latest) {
+			// what is left of the old file is sent before the new one
+			if _, err := io.Copy(out, f); err != nil {
+				return err
+			}
+			f.Close()
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The protocol must be kept in sync with src/cmd/linuxkit/agent.go. Every
+// message is a frame made of a one byte type, the length of the payload as a
+// big endian uint32 and the payload.
+const (
+	// frameRequest is the JSON request, the first frame sent by the host
+	frameRequest = 'r'
+	// frameStdin is input of a command or the contents of a file which is
+	// put, an empty frame is the end of the input
+	frameStdin = 'i'
+	// frameStdout is output of a command, a log or the contents of a file
+	// which is got
+	frameStdout = 'o'
+	// frameStderr is the error output of a command
+	frameStderr = 'e'
+	// frameMode is the octal mode of a file which is got, sent before its
+	// contents
+	frameMode = 'm'
+	// frameExit is the exit status of a request, it ends the session
+	frameExit = 'x'
+	// frameError is the reason a request failed, it ends the session
+	frameError = 'f'
+
+	maxFrame = 1 << 20
+)
+
+// request is what the host asks the agent to do
+type request struct {
+	// Op is exec, get, put or logs
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+	Path string   `json:"path,omitempty"`
+	// Name is the name of a file which is put into a directory
+	Name   string `json:"name,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Follow bool   `json:"follow,omitempty"`
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("Frame of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return header[0], b, nil
+}
+
+// frameWriter writes frames, from several goroutines
+type frameWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (f *frameWriter) write(kind byte, b []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b)))
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(b)
+	return err
+}
+
+// streamWriter sends everything written to it as frames of one type
+type streamWriter struct {
+	f    *frameWriter
+	kind byte
+}
+
+func (s streamWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		if err := s.f.write(s.kind, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
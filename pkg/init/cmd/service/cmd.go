@@ -11,6 +11,8 @@ import (
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/plugin"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	log "github.com/sirupsen/logrus"
 )
@@ -193,7 +195,13 @@ func start(ctx context.Context, service, sock, basePath, dumpSpec string) (strin
 		ctx = namespaces.WithNamespace(ctx, runtimeConfig.Namespace)
 	}
 
-	ctr, err := client.NewContainer(ctx, service, containerd.WithSpec(spec))
+	opts := []containerd.NewContainerOpts{containerd.WithSpec(spec)}
+	if runtimeConfig.OCIRuntime != "" {
+		// the runc shim runs any runtime with the command line of runc
+		opts = append(opts, containerd.WithRuntime(plugin.RuntimeRuncV2, &options.Options{BinaryName: runtimeConfig.OCIRuntime}))
+	}
+
+	ctr, err := client.NewContainer(ctx, service, opts...)
 	if err != nil {
 		return "", 0, "failed to create container", err
 	}
@@ -76,7 +76,11 @@ func runcInit(rootPath, serviceType string) int {
 			continue
 		}
 		pidfile := filepath.Join(tmpdir, name)
-		cmd := exec.Command(runcBinary, "create", "--bundle", path, "--pid-file", pidfile, name)
+		binary := runcBinary
+		if runtimeConfig.OCIRuntime != "" {
+			binary = runtimeConfig.OCIRuntime
+		}
+		cmd := exec.Command(binary, "create", "--bundle", path, "--pid-file", pidfile, name)
 
 		stdoutLog := serviceType + "." + name + ".out"
 		stdout, err := logger.Open(stdoutLog)
@@ -135,7 +139,7 @@ func runcInit(rootPath, serviceType string) int {
 			waitFor <- state
 		}()
 
-		cmd = exec.Command(runcBinary, "start", name)
+		cmd = exec.Command(binary, "start", name)
 		cmd.Stdout = stdout
 		cmd.Stderr = stderr
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
@@ -78,7 +79,10 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	providers := []string{"aws", "gcp", "hetzner", "openstack", "scaleway", "vultr", "digitalocean", "packet", "cdrom"}
+	// the channels and nocloud are only found when the host passes metadata
+	// on them, and hetzner is probed before aws, as it also serves
+	// AWS-compatible metadata
+	providers := []string{"virtio-serial", "vsock", "nocloud", "hetzner", "aws", "gcp", "oracle", "openstack", "scaleway", "vultr", "digitalocean", "packet", "cdrom"}
 	args := flag.Args()
 	if len(args) > 0 {
 		providers = args
@@ -91,6 +95,8 @@ func main() {
 			netProviders = append(netProviders, NewGCP())
 		case p == "hetzner":
 			netProviders = append(netProviders, NewHetzner())
+		case p == "oracle":
+			netProviders = append(netProviders, NewOracle())
 		case p == "openstack":
 			netProviders = append(netProviders, NewOpenstack())
 		case p == "packet":
@@ -99,6 +105,12 @@ func main() {
 			netProviders = append(netProviders, NewScaleway())
 		case p == "vultr":
 			netProviders = append(netProviders, NewVultr())
+		case p == "virtio-serial":
+			netProviders = append(netProviders, NewVirtioSerial())
+		case p == "vsock":
+			netProviders = append(netProviders, NewVsock())
+		case p == "nocloud":
+			netProviders = append(netProviders, NewNoCloud())
 		case p == "digitalocean":
 			netProviders = append(netProviders, NewDigitalOcean())
 		case p == "cdrom":
@@ -192,6 +204,21 @@ func main() {
 //        }
 // }
 // Will create foobar/foo with mode 0644 and content "hello"
+//
+// A "users" list creates a directory for each user under users, e.g.
+// {
+//    "users" : [
+//        {
+//            "name": "alice",
+//            "shell": "/bin/ash",
+//            "ssh_authorized_keys": ["ssh-ed25519 AAAA..."]
+//        }
+//    ]
+// }
+// Will create users/alice/shell and users/alice/authorized_keys
+//
+// Multipart MIME userdata, as used with cloud-init, is split into files
+// by the content type of the parts, see processMultipart.
 func processUserData(basePath string, data []byte) error {
 	// Always write the raw data to a file
 	err := ioutil.WriteFile(path.Join(basePath, "userdata"), data, 0644)
@@ -200,18 +227,46 @@ func processUserData(basePath string, data []byte) error {
 		return err
 	}
 
-	var root ConfigFile
+	if isMultipart(data) {
+		if err := processMultipart(basePath, data); err != nil {
+			log.Printf("Could not split multipart userdata: %s", err)
+		}
+		// This is not an error
+		return nil
+	}
+
+	processJSON(basePath, data)
+	return nil
+}
+
+// processJSON creates the directory/file hierarchy of JSON userdata
+func processJSON(basePath string, data []byte) {
+	var root map[string]json.RawMessage
 	if err := json.Unmarshal(data, &root); err != nil {
 		// Userdata is no JSON, presumably...
 		log.Printf("Could not unmarshall userdata: %s", err)
-		// This is not an error
-		return nil
+		return
 	}
 
-	for dir, entry := range root {
+	for dir, raw := range root {
+		if dir == Users && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var users []User
+			if err := json.Unmarshal(raw, &users); err != nil {
+				log.Printf("Could not unmarshall users: %s", err)
+				continue
+			}
+			if err := writeUsers(basePath, users); err != nil {
+				log.Printf("Could not write users: %s", err)
+			}
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			log.Printf("Could not unmarshall %s: %s", dir, err)
+			continue
+		}
 		writeConfigFiles(path.Join(basePath, dir), entry)
 	}
-	return nil
 }
 
 func writeConfigFiles(target string, current Entry) {
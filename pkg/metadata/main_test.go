@@ -186,6 +186,85 @@ func TestDeepTree(t *testing.T) {
 	assertContent(t, path.Join(basePath, "level1", "level2", "file2"), "depth2")
 }
 
+func TestUsers(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	process(t, basePath, `{
+	  "users": [
+		{
+		  "name": "alice",
+		  "shell": "/bin/ash",
+		  "groups": ["wheel", "docker"],
+		  "ssh_authorized_keys": ["ssh-ed25519 AAAA1 alice@a", "ssh-ed25519 AAAA2 alice@b"]
+		},
+		{
+		  "name": "bob",
+		  "ssh_authorized_keys": ["ssh-rsa BBBB bob"]
+		}
+	  ],
+	  "foo": {
+		"entries": {
+		  "bar": {
+			"content": "foobar"
+		  }
+		}
+	  }
+	}`)
+
+	keys := path.Join(basePath, "users", "alice", "authorized_keys")
+	assertContent(t, keys, "ssh-ed25519 AAAA1 alice@a\nssh-ed25519 AAAA2 alice@b\n")
+	assertPermission(t, keys, 0600)
+	assertContent(t, path.Join(basePath, "users", "alice", "shell"), "/bin/ash")
+	assertContent(t, path.Join(basePath, "users", "alice", "groups"), "wheel\ndocker\n")
+	assertContent(t, path.Join(basePath, "users", "bob", "authorized_keys"), "ssh-rsa BBBB bob\n")
+	assertContent(t, path.Join(basePath, "foo", "bar"), "foobar")
+
+	if err := writeUsers(basePath, []User{{Name: "../root"}}); err == nil {
+		t.Fatalf("expected an error for an invalid user name")
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	process(t, basePath, "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/x-shellscript\r\n"+
+		"Content-Disposition: attachment; filename=\"setup.sh\"\r\n"+
+		"\r\n"+
+		"#!/bin/sh\necho hello\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/cloud-config\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"I2Nsb3VkLWNvbmZpZwpob3N0bmFtZTogZm9v\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: application/json\r\n"+
+		"\r\n"+
+		`{"foo": {"entries": {"bar": {"content": "foobar"}}}}`+"\r\n"+
+		"--BOUNDARY\r\n"+
+		"\r\n"+
+		"plain\r\n"+
+		"--BOUNDARY--\r\n")
+
+	script := path.Join(basePath, "scripts", "setup.sh")
+	assertContent(t, script, "#!/bin/sh\necho hello")
+	assertPermission(t, script, 0755)
+	assertContent(t, path.Join(basePath, "cloud-config", "part-001"), "#cloud-config\nhostname: foo")
+	assertContent(t, path.Join(basePath, "foo", "bar"), "foobar")
+	assertContent(t, path.Join(basePath, "parts", "part-003"), "plain")
+}
+
 func str(input string) *string {
 	return &input
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// multipartDirs are the directories under the base path the parts of
+// multipart userdata are written to by content type, with their mode.
+// Parts of other types are written to "parts".
+var multipartDirs = map[string]struct {
+	dir  string
+	mode os.FileMode
+}{
+	"text/x-shellscript":  {"scripts", 0755},
+	"text/cloud-boothook": {"boothooks", 0755},
+	"text/cloud-config":   {"cloud-config", 0644},
+	"text/x-include-url":  {"include-urls", 0644},
+}
+
+// isMultipart returns whether data is a MIME multipart message, as
+// cloud-init userdata may be
+func isMultipart(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte("Content-Type:")) && !bytes.HasPrefix(data, []byte("MIME-Version:")) {
+		return false
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// processMultipart writes the parts of multipart userdata to files under
+// basePath, by their content type. The files are named after the filename
+// of the part, or numbered in the order of the parts. JSON parts are
+// processed like JSON userdata.
+func processMultipart(basePath string, data []byte) error {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	index := 0
+	return processParts(basePath, header, r.R, &index)
+}
+
+func processParts(basePath string, header textproto.MIMEHeader, body io.Reader, index *int) error {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if params["boundary"] == "" {
+		return fmt.Errorf("No boundary in multipart userdata")
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			// parts without a content type are plain text
+			mediaType = "text/plain"
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			if err := processParts(basePath, part.Header, part, index); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var content io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			content = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		b, err := ioutil.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("Failed to read part %d: %s", *index, err)
+		}
+		name := path.Base(part.FileName())
+		if name == "." || name == "/" {
+			name = fmt.Sprintf("part-%03d", *index)
+		}
+		*index++
+
+		if mediaType == "application/json" {
+			processJSON(basePath, b)
+			continue
+		}
+		target, ok := multipartDirs[mediaType]
+		if !ok {
+			target.dir = "parts"
+			target.mode = 0644
+		}
+		dir := path.Join(basePath, target.dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create %s: %s", dir, err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), b, target.mode); err != nil {
+			return fmt.Errorf("Failed to write %s: %s", name, err)
+		}
+		log.Printf("Wrote %s part %s to %s", mediaType, name, target.dir)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Network is the path where the network configuration rendered from
+	// the metadata of the provider is stored
+	Network = "net"
+)
+
+// netConfig is the network configuration of an instance, as given by the
+// network data of a provider
+type netConfig struct {
+	Interfaces  []netInterface
+	Nameservers []string
+}
+
+// netInterface is the configuration of an interface. Interfaces are found
+// by their MAC address, as the names of the provider need not match ours.
+type netInterface struct {
+	MAC string
+	MTU int
+	// DHCP is set for interfaces which are configured with DHCP, for
+	// which only the MTU is set
+	DHCP bool
+	// Addresses are in CIDR notation
+	Addresses []string
+	Routes    []netRoute
+}
+
+// netRoute is a route of an interface, with the destination in CIDR
+// notation or "default"
+type netRoute struct {
+	Destination string
+	Gateway     string
+}
+
+// prefixFromNetmask returns the CIDR notation of address with the netmask
+// given as a prefix length or in dotted notation
+func prefixFromNetmask(address, netmask string) (string, error) {
+	if netmask == "" {
+		return address, nil
+	}
+	if !strings.Contains(netmask, ".") && !strings.Contains(netmask, ":") {
+		return address + "/" + netmask, nil
+	}
+	ip := net.ParseIP(netmask)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid netmask %s", netmask)
+	}
+	mask := net.IPMask(ip.To4())
+	if ip.To4() == nil {
+		mask = net.IPMask(ip)
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return "", fmt.Errorf("Invalid netmask %s", netmask)
+	}
+	return fmt.Sprintf("%s/%d", address, ones), nil
+}
+
+// interfaceNames returns the names of the interfaces of the instance by
+// their MAC address
+func interfaceNames() (map[string]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) != 0 {
+			names[strings.ToLower(iface.HardwareAddr.String())] = iface.Name
+		}
+	}
+	return names, nil
+}
+
+// writeNetworkConfig writes the network configuration to ConfigPath/net,
+// as a batch file for the ip package in "ip", a configuration for the
+// dhcpcd package in "dhcpcd.conf", and the nameservers in "resolv.conf"
+func writeNetworkConfig(config netConfig) error {
+	names, err := interfaceNames()
+	if err != nil {
+		return err
+	}
+
+	var ip, dhcpcd strings.Builder
+	dhcpcd.WriteString(dhcpcdBaseConfig)
+	for _, iface := range config.Interfaces {
+		name, ok := names[strings.ToLower(iface.MAC)]
+		if !ok {
+			log.Printf("No interface with the MAC address %s, skipping its configuration", iface.MAC)
+			continue
+		}
+		if iface.MTU != 0 {
+			fmt.Fprintf(&ip, "link set dev %s mtu %d\n", name, iface.MTU)
+		}
+		if iface.DHCP {
+			continue
+		}
+
+		fmt.Fprintf(&dhcpcd, "\ninterface %s\n", name)
+		for _, a := range iface.Addresses {
+			fmt.Fprintf(&ip, "address add %s dev %s\n", a, name)
+			fmt.Fprintf(&dhcpcd, "static ip_address=%s\n", a)
+		}
+		fmt.Fprintf(&ip, "link set %s up\n", name)
+		var routers []string
+		for _, r := range iface.Routes {
+			if r.Gateway == "" {
+				fmt.Fprintf(&ip, "route add %s dev %s\n", r.Destination, name)
+				continue
+			}
+			fmt.Fprintf(&ip, "route add %s via %s dev %s\n", r.Destination, r.Gateway, name)
+			if r.Destination == "default" {
+				routers = append(routers, r.Gateway)
+			}
+		}
+		if len(routers) > 0 {
+			fmt.Fprintf(&dhcpcd, "static routers=%s\n", strings.Join(routers, " "))
+		}
+		if len(config.Nameservers) > 0 {
+			fmt.Fprintf(&dhcpcd, "static domain_name_servers=%s\n", strings.Join(config.Nameservers, " "))
+		}
+		if iface.MTU != 0 {
+			fmt.Fprintf(&dhcpcd, "static interface_mtu=%d\n", iface.MTU)
+		}
+	}
+
+	if err := os.MkdirAll(path.Join(ConfigPath, Network), 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", Network, err)
+	}
+	if err := ioutil.WriteFile(path.Join(ConfigPath, Network, "ip"), []byte(ip.String()), 0644); err != nil {
+		return fmt.Errorf("Failed to write ip configuration: %s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(ConfigPath, Network, "dhcpcd.conf"), []byte(dhcpcd.String()), 0644); err != nil {
+		return fmt.Errorf("Failed to write dhcpcd configuration: %s", err)
+	}
+	if len(config.Nameservers) > 0 {
+		var resolv strings.Builder
+		for _, n := range config.Nameservers {
+			fmt.Fprintf(&resolv, "nameserver %s\n", n)
+		}
+		if err := ioutil.WriteFile(path.Join(ConfigPath, Network, "resolv.conf"), []byte(resolv.String()), 0644); err != nil {
+			return fmt.Errorf("Failed to write resolv.conf: %s", err)
+		}
+	}
+	return nil
+}
+
+// dhcpcdBaseConfig is the start of the dhcpcd configuration, as in the
+// dhcpcd package, to which the static interfaces are added
+const dhcpcdBaseConfig = `# Generated by metadata from the network data of the provider
+allowinterfaces eth*
+hostname
+clientid
+persistent
+option rapid_commit
+option domain_name_servers, domain_name, domain_search, host_name
+option classless_static_routes
+option ntp_servers
+option interface_mtu
+require dhcp_server_identifier
+slaac private
+nodelay
+noarp
+`
@@ -4,12 +4,27 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 )
 
+const (
+	// awsTokenURL is where IMDSv2 session tokens are requested
+	awsTokenURL = "http://169.254.169.254/latest/api/token"
+	// awsTokenTTL is the lifetime of the session tokens in seconds
+	awsTokenTTL = "21600"
+	// awsRetries is the number of times transient failures are retried
+	awsRetries = 4
+)
+
+// awsToken is the IMDSv2 session token sent with the requests, or "" if
+// the metadata service only offers IMDSv1
+var awsToken string
+
 // ProviderAWS is the type implementing the Provider interface for AWS
 type ProviderAWS struct {
 }
@@ -25,8 +40,10 @@ func (p *ProviderAWS) String() string {
 
 // Probe checks if we are running on AWS
 func (p *ProviderAWS) Probe() bool {
-	// Getting the hostname should always work...
-	_, err := awsGet(metaDataURL + "hostname")
+	awsToken = awsGetToken()
+	// Getting the hostname should always work... It is not retried,
+	// so that probing is quick elsewhere.
+	_, _, err := awsRequest(metaDataURL + "hostname")
 	return (err == nil)
 }
 
@@ -65,6 +82,11 @@ func (p *ProviderAWS) Extract() ([]byte, error) {
 		log.Printf("AWS: Failed to get ssh data: %s", err)
 	}
 
+	// network
+	if err := p.handleNetwork(); err != nil {
+		log.Printf("AWS: Failed to get network data: %s", err)
+	}
+
 	// Generic userdata
 	userData, err := awsGet(userDataURL)
 	if err != nil {
@@ -90,29 +112,95 @@ func awsMetaGet(lookupName string, fileName string, fileMode os.FileMode) {
 	}
 }
 
-// awsGet requests and extracts the requested URL
+// awsGetToken returns an IMDSv2 session token, or "" to fall back to
+// IMDSv1. The response to the token request is dropped when the metadata
+// service is reached through more hops than the hop limit of the
+// instance, e.g. from a container which is not in the host network
+// namespace with the default hop limit of 1.
+func awsGetToken() string {
+	var client = &http.Client{
+		Timeout: time.Second * 2,
+	}
+
+	req, err := http.NewRequest(http.MethodPut, awsTokenURL, nil)
+	if err != nil {
+		log.Printf("AWS: http.NewRequest failed: %s", err)
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsTokenTTL)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("AWS: Could not get an IMDSv2 token, using IMDSv1. If IMDSv2 is required, the hop limit of the instance may be too low: %s", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("AWS: Could not get an IMDSv2 token, using IMDSv1: Status not ok: %d", resp.StatusCode)
+		return ""
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("AWS: Failed to read the IMDSv2 token, using IMDSv1: %s", err)
+		return ""
+	}
+	return string(token)
+}
+
+// awsGet requests and extracts the requested URL, retrying transient
+// failures with a backoff, and refreshing the session token if it expired
 func awsGet(url string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= awsRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(250<<uint(attempt-1)) * time.Millisecond)
+		}
+		var body []byte
+		var status int
+		body, status, err = awsRequest(url)
+		switch {
+		case err == nil:
+			return body, nil
+		case status == http.StatusUnauthorized:
+			// the token expired, or IMDSv2 is required now
+			awsToken = awsGetToken()
+		case status == 0, status == http.StatusTooManyRequests, status >= 500:
+			// transient
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// awsRequest requests and extracts the requested URL once, and returns
+// the status of the response, or 0 if there is none
+func awsRequest(url string) ([]byte, int, error) {
 	var client = &http.Client{
 		Timeout: time.Second * 2,
 	}
 
 	req, err := http.NewRequest("", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("AWS: http.NewRequest failed: %s", err)
+		return nil, 0, fmt.Errorf("AWS: http.NewRequest failed: %s", err)
+	}
+	if awsToken != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", awsToken)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("AWS: Could not contact metadata service: %s", err)
+		return nil, 0, fmt.Errorf("AWS: Could not contact metadata service: %s", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("AWS: Status not ok: %d", resp.StatusCode)
+		return nil, resp.StatusCode, fmt.Errorf("AWS: Status not ok: %d", resp.StatusCode)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("AWS: Failed to read http response: %s", err)
+		return nil, resp.StatusCode, fmt.Errorf("AWS: Failed to read http response: %s", err)
 	}
-	return body, nil
+	return body, resp.StatusCode, nil
 }
 
 // SSH keys:
@@ -132,3 +220,45 @@ func (p *ProviderAWS) handleSSH() error {
 	}
 	return nil
 }
+
+// Network configuration:
+// The addresses of each interface are in the subnet of the interface, and
+// the router of a subnet is its first host. Only the primary interface,
+// with device number 0, gets the default route.
+func (p *ProviderAWS) handleNetwork() error {
+	macs, err := awsGet(metaDataURL + "network/interfaces/macs/")
+	if err != nil {
+		return err
+	}
+	var config netConfig
+	for _, mac := range strings.Fields(string(macs)) {
+		mac = strings.TrimSuffix(mac, "/")
+		base := metaDataURL + "network/interfaces/macs/" + mac + "/"
+		iface := netInterface{MAC: mac}
+
+		subnet, err := awsGet(base + "subnet-ipv4-cidr-block")
+		if err != nil {
+			return err
+		}
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(string(subnet)))
+		if err != nil {
+			return err
+		}
+		prefix, _ := ipnet.Mask.Size()
+		addresses, err := awsGet(base + "local-ipv4s")
+		if err != nil {
+			return err
+		}
+		for _, a := range strings.Fields(string(addresses)) {
+			iface.Addresses = append(iface.Addresses, fmt.Sprintf("%s/%d", a, prefix))
+		}
+
+		if device, err := awsGet(base + "device-number"); err == nil && strings.TrimSpace(string(device)) == "0" {
+			router := ipnet.IP.To4()
+			router[3]++
+			iface.Routes = append(iface.Routes, netRoute{Destination: "default", Gateway: router.String()})
+		}
+		config.Interfaces = append(config.Interfaces, iface)
+	}
+	return writeNetworkConfig(config)
+}
@@ -22,6 +22,8 @@ const (
 
 var (
 	userdataFiles = []string{userdataFile, userdataFallback}
+	// cidata disks may be ISOs or FAT filesystems
+	cdromFilesystems = []string{"iso9660", "vfat"}
 )
 
 // ProviderCDROM is the type implementing the Provider interface for CDROMs
@@ -140,13 +142,24 @@ func (p *ProviderCDROM) Probe() bool {
 
 // Extract gets both the CDROM specific and generic userdata
 func (p *ProviderCDROM) Extract() ([]byte, error) {
+	if len(p.metadata) != 0 {
+		if err := handleNoCloudMetadata(p.metadata); err != nil {
+			log.Printf("%s: Failed to handle meta-data: %s", p, err)
+		}
+	}
 	return p.userdata, p.err
 }
 
-// mount mounts a CDROM/DVD device under mountPoint
+// mount mounts a CDROM/DVD device, or a FAT filesystem, under mountPoint
 func (p *ProviderCDROM) mount() error {
 	// We may need to poll a little for device ready
-	return syscall.Mount(p.device, p.mountPoint, "iso9660", syscall.MS_RDONLY, "")
+	var err error
+	for _, fstype := range cdromFilesystems {
+		if err = syscall.Mount(p.device, p.mountPoint, fstype, syscall.MS_RDONLY, ""); err == nil {
+			return nil
+		}
+	}
+	return err
 }
 
 // unmount removes the mount
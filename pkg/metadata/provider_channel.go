@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// virtioSerialPort is the virtio-serial port 'linuxkit run qemu
+	// -data-channel' passes the metadata on
+	virtioSerialPort = "/dev/virtio-ports/org.linuxkit.metadata"
+	// vsockMetadataPort is the vsock port of the host 'linuxkit metadata
+	// serve' passes the metadata on
+	vsockMetadataPort = 0xf3a7
+	// channelMagic starts the frame of the metadata on a channel, which is
+	// followed by the length of the metadata as a big endian uint32
+	channelMagic = "LKMD"
+	// channelMaxSize is the largest metadata read from a channel
+	channelMaxSize = 16 << 20
+	// channelTimeout is how long to wait for the metadata on a channel
+	channelTimeout = 5 * time.Second
+)
+
+// ProviderChannel is the type implementing the Provider interface for
+// metadata passed by the host on a virtio-serial port or over vsock. A
+// virtio-serial port is never closed, so the metadata is framed.
+type ProviderChannel struct {
+	name     string
+	open     func() (io.ReadCloser, error)
+	userdata []byte
+}
+
+// NewVirtioSerial returns a new ProviderChannel reading the virtio-serial port
+func NewVirtioSerial() *ProviderChannel {
+	return &ProviderChannel{
+		name: "virtio-serial " + virtioSerialPort,
+		open: func() (io.ReadCloser, error) {
+			return os.Open(virtioSerialPort)
+		},
+	}
+}
+
+// NewVsock returns a new ProviderChannel connecting to the metadata port of the host
+func NewVsock() *ProviderChannel {
+	return &ProviderChannel{
+		name: fmt.Sprintf("vsock %d:%d", unix.VMADDR_CID_HOST, vsockMetadataPort),
+		open: dialVsockHost,
+	}
+}
+
+func (p *ProviderChannel) String() string {
+	return p.name
+}
+
+// Probe checks if the host passes metadata on the channel, and reads it
+func (p *ProviderChannel) Probe() bool {
+	c, err := p.open()
+	if err != nil {
+		log.Debugf("%s: %s", p, err)
+		return false
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := readChannelFrame(c)
+		done <- result{data, err}
+	}()
+	select {
+	case r := <-done:
+		c.Close()
+		if r.err != nil {
+			log.Printf("%s: Failed to read metadata: %s", p, r.err)
+			return false
+		}
+		p.userdata = r.data
+		return true
+	case <-time.After(channelTimeout):
+		// the read of a virtio-serial port may not return on close,
+		// so the goroutine is left behind
+		c.Close()
+		log.Printf("%s: No metadata after %s", p, channelTimeout)
+		return false
+	}
+}
+
+// Extract returns the metadata read from the channel
+func (p *ProviderChannel) Extract() ([]byte, error) {
+	return p.userdata, nil
+}
+
+// readChannelFrame reads the framed metadata of a channel
+func readChannelFrame(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], []byte(channelMagic)) {
+		return nil, fmt.Errorf("Invalid frame")
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > channelMaxSize {
+		return nil, fmt.Errorf("Metadata of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// dialVsockHost connects to the metadata port of the host over vsock
+func dialVsockHost() (io.ReadCloser, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: vsockMetadataPort}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "vsock"), nil
+}
@@ -29,8 +29,8 @@ func (p *ProviderDigitalOcean) String() string {
 
 // Probe checks if we are running on DigitalOcean
 func (p *ProviderDigitalOcean) Probe() bool {
-	// Getting the index should always work...
-	_, err := digitalOceanGet(digitalOceanMetaDataURL)
+	// Getting the droplet ID should always work...
+	_, err := digitalOceanGet(digitalOceanMetaDataURL + "id")
 	return (err == nil)
 }
 
@@ -49,7 +49,10 @@ func (p *ProviderDigitalOcean) Extract() ([]byte, error) {
 	// public ipv4
 	digitalOceanMetaGet("interfaces/public/0/ipv4/address", "public_ipv4", 0644)
 
-	// private ipv4
+	// public ipv6, if enabled on the droplet
+	digitalOceanMetaGet("interfaces/public/0/ipv6/address", "public_ipv6", 0644)
+
+	// private ipv4, with the VPC of the droplet
 	digitalOceanMetaGet("interfaces/private/0/ipv4/address", "private_ipv4", 0644)
 
 	// region
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -12,8 +14,16 @@ import (
 )
 
 const (
-	project  = "http://metadata.google.internal/computeMetadata/v1/project/"
-	instance = "http://metadata.google.internal/computeMetadata/v1/instance/"
+	gcpMetadataHost = "metadata.google.internal"
+	// gcpMetadataAddress is the address of the metadata service, which is
+	// used when its name cannot be resolved, e.g. by the metadata emulator
+	// of 'linuxkit run qemu'
+	gcpMetadataAddress = "169.254.169.254"
+)
+
+var (
+	project  = "http://" + gcpMetadataHost + "/computeMetadata/v1/project/"
+	instance = "http://" + gcpMetadataHost + "/computeMetadata/v1/instance/"
 )
 
 // ProviderGCP is the type implementing the Provider interface for GCP
@@ -31,6 +41,10 @@ func (p *ProviderGCP) String() string {
 
 // Probe checks if we are running on GCP
 func (p *ProviderGCP) Probe() bool {
+	if _, err := net.LookupHost(gcpMetadataHost); err != nil {
+		project = strings.Replace(project, gcpMetadataHost, gcpMetadataAddress, 1)
+		instance = strings.Replace(instance, gcpMetadataHost, gcpMetadataAddress, 1)
+	}
 	// Getting the hostname should always work...
 	_, err := gcpGet(instance + "hostname")
 	return (err == nil)
@@ -52,6 +66,10 @@ func (p *ProviderGCP) Extract() ([]byte, error) {
 		log.Printf("GCP: Failed to get ssh data: %s", err)
 	}
 
+	if err := p.handleNetwork(); err != nil {
+		log.Printf("GCP: Failed to get network data: %s", err)
+	}
+
 	// Generic userdata
 	userData, err := gcpGet(instance + "attributes/user-data")
 	if err != nil {
@@ -92,10 +110,8 @@ func gcpGet(url string) ([]byte, error) {
 // TODO also retrieve the instance keys and respect block
 //      project keys see:
 //      https://cloud.google.com/compute/docs/instances/ssh-keys
-// The keys have usernames attached, but as a simplification
-// we are going to add them all to one root file
-// TODO split them into individual user files and make the ssh
-//      container construct those users
+// The keys have usernames attached. They are all added to one root
+// file, and to the authorized_keys of each user under Users.
 func (p *ProviderGCP) handleSSH() error {
 	sshKeys, err := gcpGet(project + "attributes/ssh-keys")
 	if err != nil {
@@ -109,16 +125,49 @@ func (p *ProviderGCP) handleSSH() error {
 	}
 
 	rootKeys := ""
+	var users []User
 	for _, line := range strings.Split(string(sshKeys), "\n") {
 		parts := strings.SplitN(line, ":", 2)
-		// ignoring username for now
 		if len(parts) == 2 {
 			rootKeys = rootKeys + parts[1] + "\n"
+			users = append(users, User{Name: parts[0], SSHAuthorizedKeys: []string{parts[1]}})
 		}
 	}
 	err = ioutil.WriteFile(path.Join(ConfigPath, SSH, "authorized_keys"), []byte(rootKeys), 0600)
 	if err != nil {
 		return fmt.Errorf("Failed to write ssh keys: %s", err)
 	}
-	return nil
+	return writeUsers(ConfigPath, users)
+}
+
+// Network configuration:
+// Only the first interface gets the default route, as on the images of GCP
+func (p *ProviderGCP) handleNetwork() error {
+	interfacesJSON, err := gcpGet(instance + "network-interfaces/?recursive=true")
+	if err != nil {
+		return err
+	}
+	var interfaces []struct {
+		IP         string `json:"ip"`
+		MAC        string `json:"mac"`
+		MTU        int    `json:"mtu"`
+		Subnetmask string `json:"subnetmask"`
+		Gateway    string `json:"gateway"`
+	}
+	if err := json.Unmarshal(interfacesJSON, &interfaces); err != nil {
+		return err
+	}
+	var config netConfig
+	for i, n := range interfaces {
+		address, err := prefixFromNetmask(n.IP, n.Subnetmask)
+		if err != nil {
+			return err
+		}
+		iface := netInterface{MAC: n.MAC, MTU: n.MTU, Addresses: []string{address}}
+		if i == 0 && n.Gateway != "" {
+			iface.Routes = append(iface.Routes, netRoute{Destination: "default", Gateway: n.Gateway})
+		}
+		config.Interfaces = append(config.Interfaces, iface)
+	}
+	return writeNetworkConfig(config)
 }
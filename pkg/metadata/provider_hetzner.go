@@ -8,9 +8,17 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 )
 
+const (
+	// Hetzner also serves AWS-compatible metadata, these are its own
+	// endpoints, so that it is not mistaken for AWS
+	hetznerMetaDataURL = "http://169.254.169.254/hetzner/v1/metadata/"
+	hetznerUserDataURL = "http://169.254.169.254/hetzner/v1/userdata"
+)
+
 // ProviderHetzner is the type implementing the Provider interface for Hetzner
 type ProviderHetzner struct {
 }
@@ -27,14 +35,14 @@ func (p *ProviderHetzner) String() string {
 // Probe checks if we are running on Hetzner
 func (p *ProviderHetzner) Probe() bool {
 	// Getting the hostname should always work...
-	_, err := hetznerGet(metaDataURL + "hostname")
+	_, err := hetznerGet(hetznerMetaDataURL + "hostname")
 	return (err == nil)
 }
 
 // Extract gets both the Hetzner specific and generic userdata
 func (p *ProviderHetzner) Extract() ([]byte, error) {
 	// Get host name. This must not fail
-	hostname, err := hetznerGet(metaDataURL + "hostname")
+	hostname, err := hetznerGet(hetznerMetaDataURL + "hostname")
 	if err != nil {
 		return nil, err
 	}
@@ -46,14 +54,19 @@ func (p *ProviderHetzner) Extract() ([]byte, error) {
 	// public ipv4
 	hetznerMetaGet("public-ipv4", "public_ipv4", 0644)
 
-	// private ipv4
-	hetznerMetaGet("local-ipv4", "local_ipv4", 0644)
-
 	// instance-id
 	hetznerMetaGet("instance-id", "instance_id", 0644)
 
-	// // local-hostname
-	// hetznerMetaGet("local-hostname", "local_hostname", 0644)
+	// region, e.g. eu-central
+	hetznerMetaGet("region", "region", 0644)
+
+	// availability zone, e.g. fsn1-dc14
+	hetznerMetaGet("availability-zone", "availability_zone", 0644)
+
+	// private ipv4, from the first private network
+	if err := p.handlePrivateNetworks(); err != nil {
+		log.Printf("Hetzner: Failed to get private networks: %s", err)
+	}
 
 	// ssh
 	if err := p.handleSSH(); err != nil {
@@ -61,7 +74,7 @@ func (p *ProviderHetzner) Extract() ([]byte, error) {
 	}
 
 	// Generic userdata
-	userData, err := hetznerGet(userDataURL)
+	userData, err := hetznerGet(hetznerUserDataURL)
 	if err != nil {
 		log.Printf("Hetzner: Failed to get user-data: %s", err)
 		// This is not an error
@@ -72,7 +85,7 @@ func (p *ProviderHetzner) Extract() ([]byte, error) {
 
 // lookup a value (lookupName) in hetzner metaservice and store in given fileName
 func hetznerMetaGet(lookupName string, fileName string, fileMode os.FileMode) {
-	if lookupValue, err := hetznerGet(metaDataURL + lookupName); err == nil {
+	if lookupValue, err := hetznerGet(hetznerMetaDataURL + lookupName); err == nil {
 		// we got a value from the metadata server, now save to filesystem
 		err = ioutil.WriteFile(path.Join(ConfigPath, fileName), lookupValue, fileMode)
 		if err != nil {
@@ -110,9 +123,26 @@ func hetznerGet(url string) ([]byte, error) {
 	return body, nil
 }
 
+// handlePrivateNetworks writes the address of the server in its first
+// private network. The networks are a YAML list, of which only the
+// addresses are read.
+func (p *ProviderHetzner) handlePrivateNetworks() error {
+	networks, err := hetznerGet(hetznerMetaDataURL + "private-networks")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(networks), "\n") {
+		if ip := strings.TrimPrefix(strings.TrimSpace(line), "- ip:"); ip != strings.TrimSpace(line) {
+			return ioutil.WriteFile(path.Join(ConfigPath, "local_ipv4"), []byte(strings.TrimSpace(ip)), 0644)
+		}
+	}
+	// the server is not in a private network
+	return nil
+}
+
 // SSH keys:
 func (p *ProviderHetzner) handleSSH() error {
-	sshKeysJSON, err := hetznerGet(metaDataURL + "public-keys")
+	sshKeysJSON, err := hetznerGet(hetznerMetaDataURL + "public-keys")
 	if err != nil {
 		return fmt.Errorf("Failed to get sshKeys: %s", err)
 	}
@@ -127,7 +157,10 @@ func (p *ProviderHetzner) handleSSH() error {
 		return fmt.Errorf("Failed to create %s: %s", SSH, err)
 	}
 
-	fileHandle, _ := os.OpenFile(path.Join(ConfigPath, SSH, "authorized_keys"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	fileHandle, err := os.OpenFile(path.Join(ConfigPath, SSH, "authorized_keys"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create authorized_keys: %s", err)
+	}
 	defer fileHandle.Close()
 
 	for _, sshKey := range sshKeys {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cmdlinePath = "/proc/cmdline"
+)
+
+// ProviderNoCloud is the type implementing the Provider interface for the
+// cloud-init NoCloud datasource with a seed given on the kernel command
+// line, e.g. ds=nocloud;s=http://10.0.0.1/seed/. Seeds on a disk labelled
+// cidata are handled by ProviderCDROM.
+type ProviderNoCloud struct {
+	seed string
+}
+
+// NewNoCloud returns a new ProviderNoCloud
+func NewNoCloud() *ProviderNoCloud {
+	cmdline, err := ioutil.ReadFile(cmdlinePath)
+	if err != nil {
+		log.Debugf("NoCloud: Failed to read %s: %s", cmdlinePath, err)
+		return &ProviderNoCloud{}
+	}
+	return &ProviderNoCloud{seed: noCloudSeed(string(cmdline))}
+}
+
+func (p *ProviderNoCloud) String() string {
+	return "NoCloud " + p.seed
+}
+
+// noCloudSeed returns the seed URL of a ds=nocloud or ds=nocloud-net
+// argument in cmdline, or "" if there is none
+func noCloudSeed(cmdline string) string {
+	for _, arg := range strings.Fields(cmdline) {
+		// the argument may be quoted, as ; separates commands in grub
+		arg = strings.Trim(arg, `"'`)
+		if !strings.HasPrefix(arg, "ds=") {
+			continue
+		}
+		options := strings.Split(strings.TrimPrefix(arg, "ds="), ";")
+		if options[0] != "nocloud" && options[0] != "nocloud-net" {
+			continue
+		}
+		for _, o := range options[1:] {
+			kv := strings.SplitN(o, "=", 2)
+			if len(kv) == 2 && (kv[0] == "s" || kv[0] == "seedfrom") {
+				if !strings.HasSuffix(kv[1], "/") {
+					return kv[1] + "/"
+				}
+				return kv[1]
+			}
+		}
+	}
+	return ""
+}
+
+// Probe checks if a seed is given on the kernel command line and has user data
+func (p *ProviderNoCloud) Probe() bool {
+	if p.seed == "" {
+		return false
+	}
+	_, err := noCloudGet(p.seed + userdataFile)
+	return (err == nil)
+}
+
+// Extract gets both the NoCloud meta-data and the generic userdata
+func (p *ProviderNoCloud) Extract() ([]byte, error) {
+	metadata, err := noCloudGet(p.seed + metadataFile)
+	if err != nil {
+		// NoCloud seeds should have meta-data, but it is not needed
+		log.Printf("NoCloud: Failed to get meta-data: %s", err)
+	} else if err := handleNoCloudMetadata(metadata); err != nil {
+		log.Printf("NoCloud: Failed to handle meta-data: %s", err)
+	}
+
+	return noCloudGet(p.seed + userdataFile)
+}
+
+// noCloudGet requests and extracts the requested URL. file:// URLs
+// are read from the filesystem.
+func noCloudGet(url string) ([]byte, error) {
+	if strings.HasPrefix(url, "file://") {
+		return ioutil.ReadFile(strings.TrimPrefix(url, "file://"))
+	}
+
+	var client = &http.Client{
+		Timeout: time.Second * 5,
+	}
+
+	req, err := http.NewRequest("", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NoCloud: http.NewRequest failed: %s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("NoCloud: Could not contact seed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("NoCloud: Status not ok: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("NoCloud: Failed to read http response: %s", err)
+	}
+	return body, nil
+}
+
+// handleNoCloudMetadata writes the hostname, instance ID and SSH keys of a
+// NoCloud meta-data file. meta-data is YAML, but only top level strings
+// and the list of public-keys are used, so it is parsed line by line.
+func handleNoCloudMetadata(metadata []byte) error {
+	var keys []string
+	inKeys := false
+	for _, line := range strings.Split(string(metadata), "\n") {
+		if inKeys {
+			item := strings.TrimSpace(line)
+			if strings.HasPrefix(item, "- ") {
+				keys = append(keys, strings.Trim(strings.TrimSpace(item[2:]), `"'`))
+				continue
+			}
+			if strings.HasPrefix(line, " ") || item == "" {
+				continue
+			}
+			inKeys = false
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.HasPrefix(line, " ") {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		var err error
+		switch strings.TrimSpace(kv[0]) {
+		case "local-hostname", "hostname":
+			err = ioutil.WriteFile(path.Join(ConfigPath, Hostname), []byte(value), 0644)
+		case "instance-id":
+			err = ioutil.WriteFile(path.Join(ConfigPath, "instance_id"), []byte(value), 0644)
+		case "public-keys":
+			inKeys = true
+			if value != "" {
+				keys = append(keys, value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(path.Join(ConfigPath, SSH), 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", SSH, err)
+	}
+	err := ioutil.WriteFile(path.Join(ConfigPath, SSH, "authorized_keys"), []byte(strings.Join(keys, "\n")+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write ssh keys: %s", err)
+	}
+	return nil
+}
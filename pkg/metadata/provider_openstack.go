@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,6 +11,10 @@ import (
 	"time"
 )
 
+const (
+	openstackNetworkDataURL = "http://169.254.169.254/openstack/latest/network_data.json"
+)
+
 // ProviderOpenstack is the type implementing the Provider interface for OpenStack
 type ProviderOpenstack struct {
 }
@@ -65,6 +70,11 @@ func (p *ProviderOpenstack) Extract() ([]byte, error) {
 		log.Printf("OpenStack: Failed to get ssh data: %s", err)
 	}
 
+	// network
+	if err := p.handleNetwork(); err != nil {
+		log.Printf("OpenStack: Failed to get network data: %s", err)
+	}
+
 	// Generic userdata
 	userData, err := openstackGet(userDataURL)
 	if err != nil {
@@ -132,3 +142,93 @@ func (p *ProviderOpenstack) handleSSH() error {
 	}
 	return nil
 }
+
+// openstackNetworkData is the network_data.json of an instance
+type openstackNetworkData struct {
+	Links []struct {
+		ID  string `json:"id"`
+		MAC string `json:"ethernet_mac_address"`
+		MTU int    `json:"mtu"`
+	} `json:"links"`
+	Networks []struct {
+		Type      string `json:"type"`
+		Link      string `json:"link"`
+		IPAddress string `json:"ip_address"`
+		Netmask   string `json:"netmask"`
+		Routes    []struct {
+			Network string `json:"network"`
+			Netmask string `json:"netmask"`
+			Gateway string `json:"gateway"`
+		} `json:"routes"`
+		DNSNameservers []string `json:"dns_nameservers"`
+	} `json:"networks"`
+	Services []struct {
+		Type    string `json:"type"`
+		Address string `json:"address"`
+	} `json:"services"`
+}
+
+// Network configuration:
+func (p *ProviderOpenstack) handleNetwork() error {
+	networkData, err := openstackGet(openstackNetworkDataURL)
+	if err != nil {
+		return err
+	}
+	config, err := parseOpenstackNetworkData(networkData)
+	if err != nil {
+		return err
+	}
+	return writeNetworkConfig(config)
+}
+
+// parseOpenstackNetworkData returns the network configuration of
+// network_data.json. Networks of a type other than ipv4 and ipv6 are
+// configured with DHCP or SLAAC.
+func parseOpenstackNetworkData(networkData []byte) (netConfig, error) {
+	var data openstackNetworkData
+	if err := json.Unmarshal(networkData, &data); err != nil {
+		return netConfig{}, err
+	}
+
+	var config netConfig
+	links := map[string]int{}
+	for _, l := range data.Links {
+		links[l.ID] = len(config.Interfaces)
+		config.Interfaces = append(config.Interfaces, netInterface{MAC: l.MAC, MTU: l.MTU, DHCP: true})
+	}
+	for _, n := range data.Networks {
+		i, ok := links[n.Link]
+		if !ok {
+			return netConfig{}, fmt.Errorf("Network on unknown link %s", n.Link)
+		}
+		iface := &config.Interfaces[i]
+		if n.Type != "ipv4" && n.Type != "ipv6" {
+			continue
+		}
+		iface.DHCP = false
+		address, err := prefixFromNetmask(n.IPAddress, n.Netmask)
+		if err != nil {
+			return netConfig{}, err
+		}
+		iface.Addresses = append(iface.Addresses, address)
+		for _, r := range n.Routes {
+			destination, err := prefixFromNetmask(r.Network, r.Netmask)
+			if err != nil {
+				return netConfig{}, err
+			}
+			// the default route of IPv6 is kept as ::/0, so that ip
+			// does not take it for IPv4
+			if destination == "0.0.0.0/0" {
+				destination = "default"
+			}
+			iface.Routes = append(iface.Routes, netRoute{Destination: destination, Gateway: r.Gateway})
+		}
+		config.Nameservers = append(config.Nameservers, n.DNSNameservers...)
+	}
+	for _, s := range data.Services {
+		if s.Type == "dns" {
+			config.Nameservers = append(config.Nameservers, s.Address)
+		}
+	}
+	return config, nil
+}
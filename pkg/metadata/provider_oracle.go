@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	oracleMetaDataURL = "http://169.254.169.254/opc/v2/"
+)
+
+// ProviderOracle is the type implementing the Provider interface for Oracle Cloud Infrastructure
+type ProviderOracle struct {
+}
+
+// NewOracle returns a new ProviderOracle
+func NewOracle() *ProviderOracle {
+	return &ProviderOracle{}
+}
+
+func (p *ProviderOracle) String() string {
+	return "Oracle"
+}
+
+// Probe checks if we are running on Oracle Cloud Infrastructure
+func (p *ProviderOracle) Probe() bool {
+	// Getting the instance ID should always work...
+	_, err := oracleGet(oracleMetaDataURL + "instance/id")
+	return (err == nil)
+}
+
+// Extract gets both the Oracle specific and generic userdata
+func (p *ProviderOracle) Extract() ([]byte, error) {
+	// Get host name. This must not fail
+	hostname, err := oracleGet(oracleMetaDataURL + "instance/hostname")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path.Join(ConfigPath, Hostname), hostname, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Oracle: Failed to write hostname: %s", err)
+	}
+
+	// instance id, the OCID of the instance
+	oracleMetaGet("instance/id", "instance_id", 0644)
+
+	// shape
+	oracleMetaGet("instance/shape", "instance_type", 0644)
+
+	// region, e.g. eu-frankfurt-1
+	oracleMetaGet("instance/canonicalRegionName", "region", 0644)
+
+	// availability domain
+	oracleMetaGet("instance/availabilityDomain", "availability_zone", 0644)
+
+	// private ipv4, of the primary VNIC
+	if err := p.handleVNICs(); err != nil {
+		log.Printf("Oracle: Failed to get VNICs: %s", err)
+	}
+
+	// ssh
+	if err := p.handleSSH(); err != nil {
+		log.Printf("Oracle: Failed to get ssh data: %s", err)
+	}
+
+	// Generic userdata, which is base64 encoded in the instance metadata
+	userData, err := oracleGet(oracleMetaDataURL + "instance/metadata/user_data")
+	if err != nil {
+		log.Printf("Oracle: Failed to get user-data: %s", err)
+		// This is not an error
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(userData))
+	if err != nil {
+		return nil, fmt.Errorf("Oracle: Failed to decode user-data: %s", err)
+	}
+	return decoded, nil
+}
+
+// lookup a value (lookupName) in Oracle metaservice and store in given fileName
+func oracleMetaGet(lookupName string, fileName string, fileMode os.FileMode) {
+	if lookupValue, err := oracleGet(oracleMetaDataURL + lookupName); err == nil {
+		// we got a value from the metadata server, now save to filesystem
+		err = ioutil.WriteFile(path.Join(ConfigPath, fileName), lookupValue, fileMode)
+		if err != nil {
+			// we couldn't save the file for some reason
+			log.Printf("Oracle: Failed to write %s:%s %s", fileName, lookupValue, err)
+		}
+	} else {
+		// we did not get a value back from the metadata server
+		log.Printf("Oracle: Failed to get %s: %s", lookupName, err)
+	}
+}
+
+// oracleGet requests and extracts the requested URL. Version 2 of the
+// metadata service requires the authorization header.
+func oracleGet(url string) ([]byte, error) {
+	var client = &http.Client{
+		Timeout: time.Second * 2,
+	}
+
+	req, err := http.NewRequest("", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Oracle: http.NewRequest failed: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer Oracle")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Oracle: Could not contact metadata service: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Oracle: Status not ok: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Oracle: Failed to read http response: %s", err)
+	}
+	return body, nil
+}
+
+// handleVNICs writes the private address of the primary VNIC, which is
+// the first one
+func (p *ProviderOracle) handleVNICs() error {
+	vnicsJSON, err := oracleGet(oracleMetaDataURL + "vnics/")
+	if err != nil {
+		return err
+	}
+	var vnics []struct {
+		PrivateIP string `json:"privateIp"`
+	}
+	if err := json.Unmarshal(vnicsJSON, &vnics); err != nil {
+		return err
+	}
+	if len(vnics) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(ConfigPath, "local_ipv4"), []byte(vnics[0].PrivateIP), 0644)
+}
+
+// SSH keys:
+func (p *ProviderOracle) handleSSH() error {
+	sshKeys, err := oracleGet(oracleMetaDataURL + "instance/metadata/ssh_authorized_keys")
+	if err != nil {
+		return fmt.Errorf("Failed to get sshKeys: %s", err)
+	}
+
+	if err := os.Mkdir(path.Join(ConfigPath, SSH), 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", SSH, err)
+	}
+
+	err = ioutil.WriteFile(path.Join(ConfigPath, SSH, "authorized_keys"), sshKeys, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write ssh keys: %s", err)
+	}
+	return nil
+}
@@ -22,7 +22,14 @@ const (
 	instanceIDFile       = "instance_id"
 	instanceLocationFile = "instance_location"
 	publicIPFile         = "public_ip"
+	publicIPv6File       = "public_ipv6"
 	privateIPFile        = "private_ip"
+	instanceTypeFile     = "instance_type"
+	tagsFile             = "tags"
+
+	// scalewayAuthorizedKeyTag is the prefix of tags holding an SSH key,
+	// with the spaces of the key replaced by underscores
+	scalewayAuthorizedKeyTag = "AUTHORIZED_KEY="
 )
 
 // ProviderScaleway is the type implementing the Provider interface for Scaleway
@@ -43,7 +50,7 @@ func (p *ProviderScaleway) Probe() bool {
 	// Getting the conf should always work...
 	_, err := scalewayGet(scalewayMetadataURL + "conf")
 	if err != nil {
-		log.Printf(err.Error())
+		log.Printf("%s", err)
 		return false
 	}
 
@@ -77,7 +84,11 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		return nil, fmt.Errorf("Scaleway: Failed to write instance_id: %s", err)
 	}
 
-	instanceLocation, err := p.extractInformation(metadata, "location_zone_id")
+	instanceLocation, err := p.extractInformation(metadata, "zone")
+	if err != nil {
+		// older servers only have the ID of the zone
+		instanceLocation, err = p.extractInformation(metadata, "location_zone_id")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to get instanceLocation: %s", err)
 	}
@@ -99,17 +110,51 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 
 	}
 
+	publicIPv6, err := p.extractInformation(metadata, "ipv6_address")
+	if err != nil {
+		// not an error
+		log.Printf("Scaleway: Failed to get publicIPv6: %s", err)
+	} else {
+		err = ioutil.WriteFile(path.Join(ConfigPath, publicIPv6File), publicIPv6, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Scaleway: Failed to write public_ipv6: %s", err)
+		}
+	}
+
 	privateIP, err := p.extractInformation(metadata, "private_ip")
 	if err != nil {
-		return nil, fmt.Errorf("Scaleway: Failed to get privateIP: %s", err)
+		// not an error, servers with routed IPs have no private IP
+		log.Printf("Scaleway: Failed to get privateIP: %s", err)
+	} else {
+		err = ioutil.WriteFile(path.Join(ConfigPath, privateIPFile), privateIP, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Scaleway: Failed to write private_ip: %s", err)
+		}
+	}
+
+	instanceType, err := p.extractInformation(metadata, "commercial_type")
+	if err != nil {
+		// not an error
+		log.Printf("Scaleway: Failed to get instanceType: %s", err)
+	} else {
+		err = ioutil.WriteFile(path.Join(ConfigPath, instanceTypeFile), instanceType, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Scaleway: Failed to write instance_type: %s", err)
+		}
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, privateIPFile), privateIP, 0644)
+	tags, err := p.extractList(metadata, "tags")
 	if err != nil {
-		return nil, fmt.Errorf("Scaleway: Failed to write private_ip: %s", err)
+		log.Printf("Scaleway: Failed to get tags: %s", err)
+	}
+	if len(tags) > 0 {
+		err = ioutil.WriteFile(path.Join(ConfigPath, tagsFile), []byte(strings.Join(tags, "\n")+"\n"), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Scaleway: Failed to write tags: %s", err)
+		}
 	}
 
-	if err := p.handleSSH(metadata); err != nil {
+	if err := p.handleSSH(metadata, tags); err != nil {
 		log.Printf("Scaleway: Failed to get ssh data: %s", err)
 	}
 
@@ -134,6 +179,28 @@ func (p *ProviderScaleway) extractInformation(metadata []byte, information strin
 	return []byte(""), fmt.Errorf("No %s found", information)
 }
 
+// extractList returns the values of a list in the metadata, which is
+// given as the number of values and a line for each of them
+func (p *ProviderScaleway) extractList(metadata []byte, information string) ([]string, error) {
+	numberString, err := p.extractInformation(metadata, information)
+	if err != nil {
+		return nil, err
+	}
+	number, err := strconv.Atoi(string(numberString))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert the number of %s to int: %s", information, err)
+	}
+	var values []string
+	for i := 0; i < number; i++ {
+		value, err := p.extractInformation(metadata, information+"_"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(bytes.Trim(value, "'")))
+	}
+	return values, nil
+}
+
 // scalewayGet requests and extracts the requested URL
 func scalewayGet(url string) ([]byte, error) {
 	var client = &http.Client{
@@ -200,25 +267,35 @@ func scalewayGetUserdata() ([]byte, error) {
 	return body, nil
 }
 
-func (p *ProviderScaleway) handleSSH(metadata []byte) error {
-	sshKeysNumberString, err := p.extractInformation(metadata, "ssh_public_keys")
-	if err != nil {
-		return fmt.Errorf("Failed to get sshKeys: %s", err)
-	}
-	sshKeysNumber, err := strconv.Atoi(string(sshKeysNumberString))
-	if err != nil {
-		return fmt.Errorf("Failed to convert sshKeysNumber to int: %s", err)
-	}
-
+// handleSSH writes the SSH keys of the project, and the keys set on the
+// server with AUTHORIZED_KEY tags
+func (p *ProviderScaleway) handleSSH(metadata []byte, tags []string) error {
 	rootKeys := ""
-	for i := 0; i < sshKeysNumber; i++ {
-		sshKey, err := p.extractInformation(metadata, "ssh_public_keys_"+strconv.Itoa(i)+"_key")
+	sshKeysNumberString, err := p.extractInformation(metadata, "ssh_public_keys")
+	if err == nil {
+		sshKeysNumber, err := strconv.Atoi(string(sshKeysNumberString))
 		if err != nil {
-			return fmt.Errorf("Failed to get ssh_key %d: %s", i, err)
+			return fmt.Errorf("Failed to convert sshKeysNumber to int: %s", err)
 		}
 
-		line := string(bytes.Trim(sshKey, "'"))
-		rootKeys = rootKeys + line + "\n"
+		for i := 0; i < sshKeysNumber; i++ {
+			sshKey, err := p.extractInformation(metadata, "ssh_public_keys_"+strconv.Itoa(i)+"_key")
+			if err != nil {
+				return fmt.Errorf("Failed to get ssh_key %d: %s", i, err)
+			}
+
+			line := string(bytes.Trim(sshKey, "'"))
+			rootKeys = rootKeys + line + "\n"
+		}
+	}
+
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, scalewayAuthorizedKeyTag) {
+			rootKeys = rootKeys + strings.Replace(strings.TrimPrefix(tag, scalewayAuthorizedKeyTag), "_", " ", -1) + "\n"
+		}
+	}
+	if rootKeys == "" {
+		return errors.New("No ssh keys found")
 	}
 
 	if err := os.Mkdir(path.Join(ConfigPath, SSH), 0755); err != nil {
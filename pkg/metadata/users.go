@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Users is the path where the users from the provider are stored,
+	// with a directory for each user
+	Users = "users"
+)
+
+// validUserName matches the user names which are created, as the names
+// are used as paths
+var validUserName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+// User is a user given in the metadata or userdata, which is written
+// to Users/<name>/ as the files authorized_keys, shell and groups
+type User struct {
+	Name              string   `json:"name"`
+	Shell             string   `json:"shell,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+}
+
+// writeUsers writes users under basePath. The keys of users given more
+// than once are merged.
+func writeUsers(basePath string, users []User) error {
+	for _, u := range users {
+		if !validUserName.MatchString(u.Name) {
+			return fmt.Errorf("Invalid user name %q", u.Name)
+		}
+		dir := path.Join(basePath, Users, u.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create %s: %s", dir, err)
+		}
+		if len(u.SSHAuthorizedKeys) > 0 {
+			f, err := os.OpenFile(path.Join(dir, "authorized_keys"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return fmt.Errorf("Failed to create authorized_keys of %s: %s", u.Name, err)
+			}
+			_, err = f.WriteString(strings.Join(u.SSHAuthorizedKeys, "\n") + "\n")
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("Failed to write ssh keys of %s: %s", u.Name, err)
+			}
+		}
+		if u.Shell != "" {
+			if err := ioutil.WriteFile(path.Join(dir, "shell"), []byte(u.Shell), 0644); err != nil {
+				return fmt.Errorf("Failed to write shell of %s: %s", u.Name, err)
+			}
+		}
+		if len(u.Groups) > 0 {
+			if err := ioutil.WriteFile(path.Join(dir, "groups"), []byte(strings.Join(u.Groups, "\n")+"\n"), 0644); err != nil {
+				return fmt.Errorf("Failed to write groups of %s: %s", u.Name, err)
+			}
+		}
+	}
+	return nil
+}
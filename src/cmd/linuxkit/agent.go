@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// The protocol of the linuxkit/agent package, it must be kept in sync with
+// pkg/agent/protocol.go. Every message is a frame made of a one byte type,
+// the length of the payload as a big endian uint32 and the payload.
+const (
+	agentFrameRequest = 'r'
+	agentFrameStdin   = 'i'
+	agentFrameStdout  = 'o'
+	agentFrameStderr  = 'e'
+	agentFrameMode    = 'm'
+	agentFrameExit    = 'x'
+	agentFrameError   = 'f'
+	agentMaxFrame     = 1 << 20
+
+	// agentPort is the vsock port the agent listens on
+	agentPort = 0xf3a6
+	// agentSocket is the socket in the state directory qemu serves the
+	// virtio-serial port of the agent on
+	agentSocket = "agent.sock"
+	// hyperkitGuestCID is the vsock context ID of hyperkit VMs
+	hyperkitGuestCID = 3
+)
+
+// agentRequest is what the agent is asked to do
+type agentRequest struct {
+	// Op is exec, get, put or logs
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+	Path string   `json:"path,omitempty"`
+	// Name is the name of a file which is put into a directory
+	Name   string `json:"name,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Follow bool   `json:"follow,omitempty"`
+}
+
+// agentFlags are the flags used to connect to the agent of a VM
+type agentFlags struct {
+	cid  *uint
+	port *uint
+}
+
+func agentConnectFlags(flags *flag.FlagSet) agentFlags {
+	return agentFlags{
+		cid:  flags.Uint("cid", 0, "Connect to the vsock device with this context ID, as with 'run qemu -vsock-cid', instead of finding the agent in the state directory. Linux only"),
+		port: flags.Uint("port", agentPort, "vsock port the agent listens on"),
+	}
+}
+
+// agentConn is a session with the agent of a VM
+type agentConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// dialAgent connects to the agent of a VM given its state directory, or the
+// name it was run with. The agent is reached over the virtio-serial port of
+// 'run qemu -agent', the vsock socket of 'run vfkit -vsock-ports' or the
+// vsock device of hyperkit, over a Hyper-V socket for 'run hyperv -agent',
+// or over vsock with the given context ID.
+func dialAgent(name string, f agentFlags) (*agentConn, error) {
+	port := uint32(*f.port)
+	if *f.cid != 0 {
+		c, err := vsock.Dial(uint32(*f.cid), port)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to vsock %d:%x: %v", *f.cid, port, err)
+		}
+		return &agentConn{conn: c}, nil
+	}
+	state := vmStateDir(name)
+	sockets := []string{agentSocket, fmt.Sprintf("vsock-%d.sock", port), "connect"}
+	for _, sock := range sockets {
+		path := filepath.Join(state, sock)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to the agent on %s: %v", path, err)
+		}
+		// the vsock socket of hyperkit is told which port to connect to
+		if sock == "connect" {
+			if _, err := fmt.Fprintf(c, "%08x.%08x\n", hyperkitGuestCID, port); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return &agentConn{conn: c}, nil
+	}
+	// the agent of a Hyper-V VM is reached over a Hyper-V socket given
+	// its name
+	if runtime.GOOS == "windows" {
+		c, err := hypervDialVsock(name, port)
+		if err != nil {
+			return nil, err
+		}
+		return &agentConn{conn: c}, nil
+	}
+	return nil, fmt.Errorf("No agent found for %s, run it with 'run qemu -agent' or give the vsock context ID with -cid", name)
+}
+
+func (a *agentConn) Close() error {
+	return a.conn.Close()
+}
+
+func (a *agentConn) write(kind byte, b []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b)))
+	if _, err := a.conn.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := a.conn.Write(b)
+	return err
+}
+
+// request starts the session
+func (a *agentConn) request(req agentRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return a.write(agentFrameRequest, b)
+}
+
+// sendInput sends r as the input of the request, followed by its end
+func (a *agentConn) sendInput(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := a.write(agentFrameStdin, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return a.write(agentFrameStdin, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wait passes the frames sent by the agent to output until the request is
+// done, and returns its exit status
+func (a *agentConn) wait(output func(kind byte, b []byte) error) (int, error) {
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(a.conn, header[:]); err != nil {
+			if err == io.EOF {
+				return 0, fmt.Errorf("The agent closed the connection")
+			}
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(header[1:])
+		if n > agentMaxFrame {
+			return 0, fmt.Errorf("Frame of %d bytes from the agent is too large", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(a.conn, b); err != nil {
+			return 0, err
+		}
+		switch header[0] {
+		case agentFrameExit:
+			return strconv.Atoi(string(b))
+		case agentFrameError:
+			return 0, fmt.Errorf("%s", b)
+		default:
+			if err := output(header[0], b); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	alibabaAccessKeyIDVar     = "ALIBABA_CLOUD_ACCESS_KEY_ID"
+	alibabaAccessKeySecretVar = "ALIBABA_CLOUD_ACCESS_KEY_SECRET"
+	alibabaRegionVar          = "ALIBABA_CLOUD_REGION_ID"
+	alibabaBucketVar          = "ALIBABA_CLOUD_OSS_BUCKET" // non-standard
+	alibabaDefaultRegion      = "cn-hangzhou"
+
+	alibabaECSVersion = "2014-05-26"
+	alibabaTimeout    = 60 * time.Minute
+)
+
+// AlibabaClient is a client for Alibaba Cloud OSS and the ECS API,
+// authenticated with an AccessKey
+type AlibabaClient struct {
+	region string
+	id     string
+	secret string
+	client *http.Client
+}
+
+// NewAlibabaClient creates a client for a region
+func NewAlibabaClient(id, secret, region string) (*AlibabaClient, error) {
+	if id == "" || secret == "" {
+		return nil, fmt.Errorf("An AccessKey ID and secret must be set with %s and %s", alibabaAccessKeyIDVar, alibabaAccessKeySecretVar)
+	}
+	return &AlibabaClient{region: region, id: id, secret: secret, client: &http.Client{}}, nil
+}
+
+func (c *AlibabaClient) hmac(key, s string) string {
+	h := hmac.New(sha1.New, []byte(key))
+	h.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// alibabaEscape is the percent encoding used to sign ECS requests
+func alibabaEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.Replace(s, "+", "%20", -1)
+	s = strings.Replace(s, "*", "%2A", -1)
+	return strings.Replace(s, "%7E", "~", -1)
+}
+
+// ecs calls an action of the ECS RPC API and decodes the response into out, see
+// https://www.alibabacloud.com/help/en/ecs/developer-reference/request-signatures
+func (c *AlibabaClient) ecs(action string, params map[string]string, out interface{}) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	query := map[string]string{
+		"Action":           action,
+		"Format":           "JSON",
+		"Version":          alibabaECSVersion,
+		"AccessKeyId":      c.id,
+		"SignatureMethod":  "HMAC-SHA1",
+		"SignatureVersion": "1.0",
+		"SignatureNonce":   hex.EncodeToString(nonce),
+		"Timestamp":        time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		"RegionId":         c.region,
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, alibabaEscape(k)+"="+alibabaEscape(query[k]))
+	}
+	canonical := strings.Join(pairs, "&")
+	signature := c.hmac(c.secret+"&", "GET&%2F&"+alibabaEscape(canonical))
+	u := "https://ecs.aliyuncs.com/?" + canonical + "&Signature=" + alibabaEscape(signature)
+
+	log.Debugf("Alibaba Cloud: %s", action)
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		}
+		_ = json.Unmarshal(body, &e)
+		return fmt.Errorf("%s failed: %s: %s %s", action, resp.Status, e.Code, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// alibabaTagParams adds tags to the parameters of an ECS action
+func alibabaTagParams(params map[string]string, tags Tags) {
+	for i, tag := range tags {
+		params[fmt.Sprintf("Tag.%d.Key", i+1)] = tag.Key
+		params[fmt.Sprintf("Tag.%d.Value", i+1)] = tag.Value
+	}
+}
+
+// ossSubResource returns the part of a query which is signed, which only
+// has the sub-resources, sorted and unescaped
+func ossSubResource(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	var sub []string
+	for _, k := range []string{"partNumber", "uploadId", "uploads"} {
+		if _, ok := values[k]; !ok {
+			continue
+		}
+		if v := values.Get(k); v != "" {
+			sub = append(sub, k+"="+v)
+		} else {
+			sub = append(sub, k)
+		}
+	}
+	return strings.Join(sub, "&")
+}
+
+// UploadFile uploads a file to an OSS bucket in the region, in parts
+// uploaded in parallel if it is large, see multipartUpload
+func (c *AlibabaClient) UploadFile(path, bucket, object string, tags Tags, opts uploadOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	u := fmt.Sprintf("https://%s.oss-%s.aliyuncs.com/%s", bucket, c.region, url.PathEscape(object))
+	var tagging string
+	if len(tags) > 0 {
+		values := url.Values{}
+		for _, tag := range tags {
+			values.Set(tag.Key, tag.Value)
+		}
+		tagging = values.Encode()
+	}
+	send := func(method, query string, body io.Reader, length int64) (*http.Response, error) {
+		target, resource := u, "/"+bucket+"/"+object
+		if query != "" {
+			target += "?" + query
+			if sub := ossSubResource(query); sub != "" {
+				resource += "?" + sub
+			}
+		}
+		req, err := http.NewRequest(method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = length
+		var contentType string
+		if query == "" || query == "uploads" {
+			contentType = "application/octet-stream"
+			req.Header.Set("Content-Type", contentType)
+		}
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+		signed := []string{method, "", contentType, date}
+		// the tags are set when the object is created
+		if tagging != "" && (query == "" || query == "uploads") {
+			// x-oss- headers are part of the signature
+			req.Header.Set("x-oss-tagging", tagging)
+			signed = append(signed, "x-oss-tagging:"+tagging)
+		}
+		stringToSign := strings.Join(append(signed, resource), "\n")
+		req.Header.Set("Authorization", "OSS "+c.id+":"+c.hmac(c.secret, stringToSign))
+
+		log.Debugf("Alibaba Cloud: %s %s", method, target)
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			defer resp.Body.Close()
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return nil, fmt.Errorf("upload of %s failed: %s: %s", object, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return resp, nil
+	}
+
+	progress := newUploadProgress(object, size)
+	defer progress.Finish()
+	if size <= multipartPartSize {
+		resp, err := send(http.MethodPut, "", progress.Reader(f), size)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return multipartUpload(f, u, size, opts, progress, send)
+}
+
+// ImportImage imports an image from OSS and waits for it to be available
+func (c *AlibabaClient) ImportImage(name, bucket, object, format, arch, bootMode string, tags Tags) (string, error) {
+	var image struct {
+		ImageID string `json:"ImageId"`
+	}
+	params := map[string]string{
+		"ImageName":                     name,
+		"OSType":                        "linux",
+		"Platform":                      "Others Linux",
+		"Architecture":                  arch,
+		"BootMode":                      bootMode,
+		"DiskDeviceMapping.1.OSSBucket": bucket,
+		"DiskDeviceMapping.1.OSSObject": object,
+		"DiskDeviceMapping.1.Format":    format,
+	}
+	alibabaTagParams(params, tags)
+	if err := c.ecs("ImportImage", params, &image); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(alibabaTimeout)
+	for time.Now().Before(deadline) {
+		var images struct {
+			Images struct {
+				Image []struct {
+					Status string `json:"Status"`
+				} `json:"Image"`
+			} `json:"Images"`
+		}
+		// images which are still being imported are only listed with their status
+		err := c.ecs("DescribeImages", map[string]string{
+			"ImageId": image.ImageID,
+			"Status":  "Creating,Waiting,Available,UnAvailable,CreateFailed",
+		}, &images)
+		if err != nil {
+			return "", err
+		}
+		if len(images.Images.Image) > 0 {
+			status := images.Images.Image[0].Status
+			log.Debugf("Alibaba Cloud: image %s is %s", image.ImageID, status)
+			switch status {
+			case "Available":
+				return image.ImageID, nil
+			case "CreateFailed", "UnAvailable":
+				return "", fmt.Errorf("import of image %s failed: %s", image.ImageID, status)
+			}
+		}
+		time.Sleep(15 * time.Second)
+	}
+	return "", fmt.Errorf("timed out waiting for image %s", image.ImageID)
+}
+
+// FindImage returns the ID of the custom image with the given name
+func (c *AlibabaClient) FindImage(name string) (string, error) {
+	var images struct {
+		Images struct {
+			Image []struct {
+				ImageID string `json:"ImageId"`
+			} `json:"Image"`
+		} `json:"Images"`
+	}
+	if err := c.ecs("DescribeImages", map[string]string{"ImageName": name, "ImageOwnerAlias": "self"}, &images); err != nil {
+		return "", err
+	}
+	if len(images.Images.Image) == 0 {
+		return "", fmt.Errorf("Unable to find image with name %s", name)
+	}
+	return images.Images.Image[0].ImageID, nil
+}
+
+// AlibabaInstanceConfig is the configuration of an instance to launch
+type AlibabaInstanceConfig struct {
+	Name            string
+	InstanceType    string
+	ImageID         string
+	SecurityGroupID string
+	VSwitchID       string
+	// Bandwidth is the maximum outbound public bandwidth in Mbit/s, a public IP is only assigned if it is not 0
+	Bandwidth int
+	UserData  string
+	// Tags are applied to the instance and its disks
+	Tags Tags
+}
+
+// RunInstance launches a pay as you go instance and waits for it to be
+// running. It returns the ID and the public IP address of the instance.
+// The instance is deleted if the run fails or is interrupted before
+// keepResources is called.
+func (c *AlibabaClient) RunInstance(config AlibabaInstanceConfig) (string, string, error) {
+	params := map[string]string{
+		"ImageId":                 config.ImageID,
+		"InstanceType":            config.InstanceType,
+		"InstanceName":            config.Name,
+		"SecurityGroupId":         config.SecurityGroupID,
+		"VSwitchId":               config.VSwitchID,
+		"InstanceChargeType":      "PostPaid",
+		"InternetMaxBandwidthOut": fmt.Sprint(config.Bandwidth),
+		"Amount":                  "1",
+	}
+	alibabaTagParams(params, config.Tags)
+	if config.UserData != "" {
+		params["UserData"] = base64.StdEncoding.EncodeToString([]byte(config.UserData))
+	}
+	var run struct {
+		InstanceIDSets struct {
+			InstanceIDSet []string `json:"InstanceIdSet"`
+		} `json:"InstanceIdSets"`
+	}
+	if err := c.ecs("RunInstances", params, &run); err != nil {
+		return "", "", err
+	}
+	if len(run.InstanceIDSets.InstanceIDSet) == 0 {
+		return "", "", fmt.Errorf("no instance was created")
+	}
+	id := run.InstanceIDSets.InstanceIDSet[0]
+	onCleanup("instance "+id, func() error { return c.DeleteInstance(id) })
+
+	deadline := time.Now().Add(alibabaTimeout)
+	for time.Now().Before(deadline) {
+		var instances struct {
+			Instances struct {
+				Instance []struct {
+					Status          string `json:"Status"`
+					PublicIPAddress struct {
+						IPAddress []string `json:"IpAddress"`
+					} `json:"PublicIpAddress"`
+				} `json:"Instance"`
+			} `json:"Instances"`
+		}
+		if err := c.ecs("DescribeInstances", map[string]string{"InstanceIds": fmt.Sprintf("[%q]", id)}, &instances); err != nil {
+			return id, "", err
+		}
+		if len(instances.Instances.Instance) > 0 {
+			i := instances.Instances.Instance[0]
+			log.Debugf("Alibaba Cloud: instance %s is %s", id, i.Status)
+			if i.Status == "Running" {
+				var ip string
+				if len(i.PublicIPAddress.IPAddress) > 0 {
+					ip = i.PublicIPAddress.IPAddress[0]
+				}
+				return id, ip, nil
+			}
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return id, "", fmt.Errorf("timed out waiting for instance %s", id)
+}
+
+// ConsoleOutput returns the most recent serial console output of an instance
+func (c *AlibabaClient) ConsoleOutput(instanceID string) (string, error) {
+	var out struct {
+		ConsoleOutput string `json:"ConsoleOutput"`
+	}
+	if err := c.ecs("GetInstanceConsoleOutput", map[string]string{"InstanceId": instanceID}, &out); err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(out.ConsoleOutput)
+	return string(b), err
+}
+
+// DeleteInstance stops and releases an instance
+func (c *AlibabaClient) DeleteInstance(instanceID string) error {
+	return c.ecs("DeleteInstance", map[string]string{"InstanceId": instanceID, "Force": "true"}, nil)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// consoleSocket is the unix socket in the state directory the console
+	// of a detached qemu VM is served on
+	consoleSocket = "console.sock"
+	// consoleLogFile is the file in the state directory the console output
+	// of a detached qemu VM is written to as well
+	consoleLogFile = "console.log"
+	// consoleTTY is the pty in the state directory hyperkit connects the
+	// console to
+	consoleTTY = "tty"
+	// attachEscape is Ctrl-], which detaches from the console
+	attachEscape = 0x1d
+)
+
+// vmStateDir returns the state directory of a VM given the directory, the
+// name it was run with if the default state directory was used, or the
+// name given with -name
+func vmStateDir(name string) string {
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		return name
+	}
+	if fi, err := os.Stat(name + "-state"); err == nil && fi.IsDir() {
+		return name + "-state"
+	}
+	if named, err := namedVMStateDir(name); err == nil {
+		if fi, err := os.Stat(named); err == nil && fi.IsDir() {
+			return named
+		}
+	}
+	return name + "-state"
+}
+
+// openConsole opens the console of a VM given its state directory, or the
+// name it was run with
+func openConsole(name string) (io.ReadWriteCloser, error) {
+	state := vmStateDir(name)
+	if _, err := os.Stat(filepath.Join(state, consoleSocket)); err == nil {
+		return net.Dial("unix", filepath.Join(state, consoleSocket))
+	}
+	if _, err := os.Stat(filepath.Join(state, consoleTTY)); err == nil {
+		return os.OpenFile(filepath.Join(state, consoleTTY), os.O_RDWR, 0)
+	}
+	// the console of a Hyper-V VM is a named pipe given its name
+	if runtime.GOOS == "windows" {
+		return hypervDialConsole(name)
+	}
+	return nil, fmt.Errorf("No console found for %s, it must be run with -detached", name)
+}
+
+// attach connects the terminal to the console of a detached VM
+func attach(args []string) {
+	flags := newFlagSet("attach")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s attach [options] name\n\n", invoked)
+		fmt.Printf("'name' is the state directory of a VM started with 'run qemu -detached'\n")
+		fmt.Printf("or 'run hyperkit -detached', or the name of the image it was started\n")
+		fmt.Printf("from if the default state directory was used, or the name of a VM\n")
+		fmt.Printf("started with 'run hyperv'.\n")
+		fmt.Printf("Press Ctrl-] to detach from the console again.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	consoleLog := consoleLogFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 1 {
+		fmt.Printf("Please specify the VM to attach to\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	console, err := openConsole(remArgs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer console.Close()
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		oldState, err := terminal.MakeRaw(fd)
+		if err != nil {
+			log.Fatalf("Unable to set the terminal to raw mode: %v", err)
+		}
+		defer terminal.Restore(fd, oldState)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stdout, console)
+		done <- struct{}{}
+	}()
+	// the end of stdin does not detach, so the console can be followed
+	// from scripts
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], attachEscape); i != -1 {
+				console.Write(buf[:i])
+				done <- struct{}{}
+				return
+			}
+			if n > 0 {
+				if _, err := console.Write(buf[:n]); err != nil {
+					done <- struct{}{}
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/2017-03-09/storage/mgmt/storage"
@@ -25,14 +27,19 @@ import (
 	"github.com/radu-matei/azure-vhd-utils/vhdcore/common"
 	"github.com/radu-matei/azure-vhd-utils/vhdcore/diskstream"
 	"github.com/radu-matei/azure-vhd-utils/vhdcore/validator"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	defaultStorageContainerName = "linuxkitcontainer"
 	defaultStorageBlobName      = "linuxkitimage.vhd"
 
-	defaultVMStorageContainerName = "data"
-	defaultVMStorageBlobName      = "data.vhd"
+	defaultVMSize = "Standard_DS1"
+
+	// The vendored compute API predates Gen2 images, Spot VMs and Shared
+	// Image Galleries, so these are created with a newer API version which
+	// supports hyperVGeneration, the VM priority and gallery images
+	computeAPIVersion = "2020-06-01"
 
 	defaultVirtualNetworkAddressPrefix = "10.0.0.0/16"
 	defaultSubnetAddressPrefix         = "10.0.0.0/24"
@@ -55,11 +62,26 @@ var (
 	publicIPAddressesClient network.PublicIPAddressesClient
 	interfacesClient        network.InterfacesClient
 	virtualMachinesClient   compute.VirtualMachinesClient
+	imagesClient            compute.ImagesClient
 
 	defaultActiveDirectoryEndpoint = azure.PublicCloud.ActiveDirectoryEndpoint
 	defaultResourceManagerEndpoint = azure.PublicCloud.ResourceManagerEndpoint
+
+	// azureTags are the tags of the created resources, given with -tag
+	azureTags map[string]*string
 )
 
+// setAzureTags sets the tags of the resources which are created
+func setAzureTags(tags Tags) {
+	if len(tags) == 0 {
+		return
+	}
+	azureTags = map[string]*string{}
+	for _, tag := range tags {
+		azureTags[tag.Key] = to.StringPtr(tag.Value)
+	}
+}
+
 func initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret string) {
 	oAuthConfig, err := adal.NewOAuthConfig(defaultActiveDirectoryEndpoint, tenantID)
 	if err != nil {
@@ -92,6 +114,8 @@ func initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret str
 	virtualMachinesClient = compute.NewVirtualMachinesClient(subscriptionID)
 	virtualMachinesClient.Authorizer = autorest.NewBearerAuthorizer(token)
 
+	imagesClient = compute.NewImagesClient(subscriptionID)
+	imagesClient.Authorizer = autorest.NewBearerAuthorizer(token)
 }
 
 func createResourceGroup(resourceGroupName, location string) *resources.Group {
@@ -99,6 +123,7 @@ func createResourceGroup(resourceGroupName, location string) *resources.Group {
 
 	resourceGroupParameters := resources.Group{
 		Location: &location,
+		Tags:     azureTags,
 	}
 	group, err := groupsClient.CreateOrUpdate(context.Background(), resourceGroupName, resourceGroupParameters)
 	if err != nil {
@@ -116,6 +141,7 @@ func createStorageAccount(accountName, location string, resourceGroup resources.
 			Name: storage.StandardLRS,
 		},
 		Location:                          &location,
+		Tags:                              azureTags,
 		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{},
 	}
 
@@ -185,6 +211,10 @@ func uploadVMImage(resourceGroupName string, accountName string, imagePath strin
 	}
 
 	m, _ := localMetaData.ToMap()
+	// blobs have no tags, so these are set as metadata
+	for k, v := range azureTags {
+		m[k] = *v
+	}
 	err = blobServiceClient.SetBlobMetadata(defaultStorageContainerName, defaultStorageBlobName, m, make(map[string]string))
 	if err != nil {
 		log.Fatalf("Unable to set blob metatada: %v", err)
@@ -222,11 +252,89 @@ func uploadVMImage(resourceGroupName string, accountName string, imagePath strin
 
 }
 
+// createManagedImage creates a managed image of the given Hyper-V
+// generation from the uploaded VHD and returns its ID
+func createManagedImage(resourceGroup resources.Group, storageAccountName, imageName, location string, generation int) string {
+	fmt.Printf("Creating Gen%d managed image %s in resource group %s\n", generation, imageName, *resourceGroup.Name)
+
+	pathParameters := map[string]interface{}{
+		"imageName":         autorest.Encode("path", imageName),
+		"resourceGroupName": autorest.Encode("path", *resourceGroup.Name),
+		"subscriptionId":    autorest.Encode("path", imagesClient.SubscriptionID),
+	}
+	imageParameters := map[string]interface{}{
+		"location": location,
+		"tags":     azureTags,
+		"properties": map[string]interface{}{
+			"hyperVGeneration": fmt.Sprintf("V%d", generation),
+			"storageProfile": map[string]interface{}{
+				"osDisk": map[string]interface{}{
+					"osType":  "Linux",
+					"osState": "Generalized",
+					"blobUri": fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", storageAccountName, defaultStorageContainerName, defaultStorageBlobName),
+				},
+			},
+		},
+	}
+	path := "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/images/{imageName}"
+	if err := putComputeResource(imagesClient.Client, imagesClient.BaseURI, path, pathParameters, imageParameters); err != nil {
+		log.Fatalf("Unable to create image: %v", err)
+	}
+
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/images/%s", imagesClient.SubscriptionID, *resourceGroup.Name, imageName)
+}
+
+// putComputeResource creates a compute resource with computeAPIVersion and
+// waits for the deployment to finish
+func putComputeResource(client autorest.Client, baseURI, path string, pathParameters, body map[string]interface{}) error {
+	_, err := sendComputeRequest(client, http.MethodPut, baseURI, path, computeAPIVersion, pathParameters, body)
+	return err
+}
+
+// sendComputeRequest sends a request for a compute resource with the given
+// API version, waits for the operation to finish and returns it. body may
+// be nil.
+func sendComputeRequest(client autorest.Client, method, baseURI, path, apiVersion string, pathParameters, body map[string]interface{}) (azure.Future, error) {
+	ctx := context.Background()
+	decorators := []autorest.PrepareDecorator{
+		autorest.AsContentType("application/json; charset=utf-8"),
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(baseURI),
+		autorest.WithPathParameters(path, pathParameters),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": apiVersion}),
+	}
+	if body != nil {
+		decorators = append(decorators, autorest.WithJSON(body))
+	}
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return azure.Future{}, err
+	}
+	resp, err := client.Send(req, azure.DoRetryWithRegistration(client))
+	if err != nil {
+		return azure.Future{}, err
+	}
+	future, err := azure.NewFutureFromResponse(resp)
+	if err != nil {
+		return future, err
+	}
+	return future, future.WaitForCompletionRef(ctx, client)
+}
+
+// waitForDeletion waits for the deletion of a resource to finish
+func waitForDeletion(future azure.FutureAPI, err error, client autorest.Client) error {
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletionRef(context.Background(), client)
+}
+
 func createVirtualNetwork(resourceGroup resources.Group, virtualNetworkName string, location string) *network.VirtualNetwork {
 	fmt.Printf("Creating virtual network in resource group %s, in %s", *resourceGroup.Name, location)
 
 	virtualNetworkParameters := network.VirtualNetwork{
 		Location: &location,
+		Tags:     azureTags,
 		VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
 			AddressSpace: &network.AddressSpace{
 				AddressPrefixes: &[]string{defaultVirtualNetworkAddressPrefix},
@@ -280,17 +388,24 @@ func createSubnet(resourceGroup resources.Group, virtualNetworkName, subnetName
 	return &subnet
 }
 
-func createPublicIPAddress(resourceGroup resources.Group, ipName, location string) *network.PublicIPAddress {
+func createPublicIPAddress(resourceGroup resources.Group, ipName, location, zone string) *network.PublicIPAddress {
 	fmt.Printf("Creating public IP Address in resource group %s, with name %s\n", *resourceGroup.Name, ipName)
 
 	ipParameters := network.PublicIPAddress{
 		Location: &location,
+		Tags:     azureTags,
 		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
 			DNSSettings: &network.PublicIPAddressDNSSettings{
 				DomainNameLabel: to.StringPtr(ipName),
 			},
 		},
 	}
+	if zone != "" {
+		// Zonal VMs need a zonal Standard SKU address, which must be static
+		ipParameters.Sku = &network.PublicIPAddressSku{Name: network.PublicIPAddressSkuNameStandard}
+		ipParameters.Zones = &[]string{zone}
+		ipParameters.PublicIPAllocationMethod = network.Static
+	}
 	ctx := context.Background()
 	future, err := publicIPAddressesClient.CreateOrUpdate(ctx, *resourceGroup.Name, ipName, ipParameters)
 	if err != nil {
@@ -309,6 +424,7 @@ func createNetworkInterface(resourceGroup resources.Group, networkInterfaceName
 
 	networkInterfaceParameters := network.Interface{
 		Location: &location,
+		Tags:     azureTags,
 		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
 			IPConfigurations: &[]network.InterfaceIPConfiguration{
 				{
@@ -336,12 +452,13 @@ func createNetworkInterface(resourceGroup resources.Group, networkInterfaceName
 	return &networkInterface
 }
 
-func setVirtualMachineParameters(storageAccountName string, networkInterfaceID, location string) compute.VirtualMachine {
-	return compute.VirtualMachine{
+func setVirtualMachineParameters(storageAccountName, imageID, networkInterfaceID, location, size, zone string) compute.VirtualMachine {
+	vm := compute.VirtualMachine{
 		Location: &location,
+		Tags:     azureTags,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
 			HardwareProfile: &compute.HardwareProfile{
-				VMSize: compute.StandardDS1,
+				VMSize: compute.VirtualMachineSizeTypes(size),
 			},
 			// This is only for deployment validation.
 			// The values here will not be usable by anyone
@@ -352,16 +469,15 @@ func setVirtualMachineParameters(storageAccountName string, networkInterfaceID,
 				AdminPassword: to.StringPtr(unusedPassword),
 			},
 			StorageProfile: &compute.StorageProfile{
+				ImageReference: &compute.ImageReference{
+					ID: &imageID,
+				},
 				OsDisk: &compute.OSDisk{
-					Name:         to.StringPtr("osDisk"),
 					OsType:       compute.Linux,
 					Caching:      compute.CachingTypesReadWrite,
 					CreateOption: compute.DiskCreateOptionTypesFromImage,
-					Image: &compute.VirtualHardDisk{
-						URI: to.StringPtr(fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", storageAccountName, defaultStorageContainerName, defaultStorageBlobName)),
-					},
-					Vhd: &compute.VirtualHardDisk{
-						URI: to.StringPtr(fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", storageAccountName, defaultVMStorageContainerName, defaultVMStorageBlobName)),
+					ManagedDisk: &compute.ManagedDiskParameters{
+						StorageAccountType: compute.StandardLRS,
 					},
 				},
 			},
@@ -383,12 +499,29 @@ func setVirtualMachineParameters(storageAccountName string, networkInterfaceID,
 			},
 		},
 	}
+	if zone != "" {
+		vm.Zones = &[]string{zone}
+	}
+	return vm
+}
+
+// azureSpotConfig are the options of a Spot VM
+type azureSpotConfig struct {
+	// MaxPrice is the maximum price per hour in US dollars, or -1 to pay
+	// up to the on-demand price
+	MaxPrice float64
+	// EvictionPolicy is Deallocate or Delete
+	EvictionPolicy string
 }
 
-func createVirtualMachine(resourceGroup resources.Group, storageAccountName string, virtualMachineName string, networkInterface network.Interface, publicIPAddress network.PublicIPAddress, location string) {
-	fmt.Printf("Creating virtual machine in resource group %s, with name %s, in location %s\n", *resourceGroup.Name, virtualMachineName, location)
+func createVirtualMachine(resourceGroup resources.Group, storageAccountName, imageID, virtualMachineName string, networkInterface network.Interface, location, size, zone string, spot *azureSpotConfig) {
+	fmt.Printf("Creating %s virtual machine in resource group %s, with name %s, in location %s\n", size, *resourceGroup.Name, virtualMachineName, location)
 
-	virtualMachineParameters := setVirtualMachineParameters(storageAccountName, *networkInterface.ID, location)
+	virtualMachineParameters := setVirtualMachineParameters(storageAccountName, imageID, *networkInterface.ID, location, size, zone)
+	if spot != nil || strings.Contains(imageID, "/providers/Microsoft.Compute/galleries/") {
+		createComputeVirtualMachine(resourceGroup, virtualMachineName, virtualMachineParameters, spot)
+		return
+	}
 	ctx := context.Background()
 	future, err := virtualMachinesClient.CreateOrUpdate(ctx, *resourceGroup.Name, virtualMachineName, virtualMachineParameters)
 	if err != nil {
@@ -402,6 +535,36 @@ func createVirtualMachine(resourceGroup resources.Group, storageAccountName stri
 
 }
 
+// createComputeVirtualMachine creates a VM with computeAPIVersion, for Spot
+// VMs and VMs booting from a gallery image, which the vendored compute API
+// does not support. spot may be nil.
+func createComputeVirtualMachine(resourceGroup resources.Group, virtualMachineName string, virtualMachineParameters compute.VirtualMachine, spot *azureSpotConfig) {
+	b, err := json.Marshal(virtualMachineParameters)
+	if err != nil {
+		log.Fatalf("Unable to encode virtual machine: %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		log.Fatalf("Unable to encode virtual machine: %v", err)
+	}
+	if spot != nil {
+		properties := body["properties"].(map[string]interface{})
+		properties["priority"] = "Spot"
+		properties["evictionPolicy"] = spot.EvictionPolicy
+		properties["billingProfile"] = map[string]float64{"maxPrice": spot.MaxPrice}
+	}
+
+	pathParameters := map[string]interface{}{
+		"vmName":            autorest.Encode("path", virtualMachineName),
+		"resourceGroupName": autorest.Encode("path", *resourceGroup.Name),
+		"subscriptionId":    autorest.Encode("path", virtualMachinesClient.SubscriptionID),
+	}
+	path := "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachines/{vmName}"
+	if err := putComputeResource(virtualMachinesClient.Client, virtualMachinesClient.BaseURI, path, pathParameters, body); err != nil {
+		log.Fatalf("error creating virtual machine: %v", err)
+	}
+}
+
 func getEnvVarOrExit(varName string) string {
 	value := os.Getenv(varName)
 	if value == "" {
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/resources/mgmt/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// diskAPIVersion is the first version of the disks API which supports
+	// both direct uploads and the Hyper-V generation of a disk
+	diskAPIVersion = "2020-06-30"
+	// galleryAPIVersion is the version of the Shared Image Gallery API
+	galleryAPIVersion = "2020-09-30"
+
+	// diskPageSize is the largest range of a disk written in one request
+	diskPageSize = 4 * 1024 * 1024
+	// diskAccessDuration is how long the upload URL of a disk is valid for,
+	// in seconds
+	diskAccessDuration = 24 * 60 * 60
+)
+
+// galleryImage is where an image is published in a Shared Image Gallery
+type galleryImage struct {
+	Gallery    string
+	Definition string
+	Version    string
+	// Regions the version is replicated to, besides the location of the
+	// source image
+	Regions  []string
+	Replicas int
+}
+
+// diskPath is the path of a managed disk in the compute API
+func diskPath(resourceGroup resources.Group, diskName string) (string, map[string]interface{}) {
+	return "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/disks/{diskName}",
+		map[string]interface{}{
+			"diskName":          autorest.Encode("path", diskName),
+			"resourceGroupName": autorest.Encode("path", *resourceGroup.Name),
+			"subscriptionId":    autorest.Encode("path", imagesClient.SubscriptionID),
+		}
+}
+
+// createUploadDisk creates an empty managed disk of the size of a fixed VHD
+// which it is uploaded to directly, without a storage account, and returns
+// its ID
+func createUploadDisk(resourceGroup resources.Group, diskName, location string, size int64, generation int) string {
+	fmt.Printf("Creating managed disk %s in resource group %s\n", diskName, *resourceGroup.Name)
+
+	path, pathParameters := diskPath(resourceGroup, diskName)
+	diskParameters := map[string]interface{}{
+		"location": location,
+		"tags":     azureTags,
+		"sku":      map[string]interface{}{"name": "Standard_LRS"},
+		"properties": map[string]interface{}{
+			"osType":           "Linux",
+			"hyperVGeneration": fmt.Sprintf("V%d", generation),
+			"creationData": map[string]interface{}{
+				"createOption":    "Upload",
+				"uploadSizeBytes": size,
+			},
+		},
+	}
+	if _, err := sendComputeRequest(imagesClient.Client, http.MethodPut, imagesClient.BaseURI, path, diskAPIVersion, pathParameters, diskParameters); err != nil {
+		log.Fatalf("Unable to create disk: %v", err)
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/disks/%s", imagesClient.SubscriptionID, *resourceGroup.Name, diskName)
+}
+
+// deleteDisk deletes a managed disk
+func deleteDisk(resourceGroup resources.Group, diskName string) error {
+	path, pathParameters := diskPath(resourceGroup, diskName)
+	_, err := sendComputeRequest(imagesClient.Client, http.MethodDelete, imagesClient.BaseURI, path, diskAPIVersion, pathParameters, nil)
+	return err
+}
+
+// uploadToDisk writes a fixed VHD to a managed disk created for uploads
+func uploadToDisk(resourceGroup resources.Group, diskName, imagePath string, parallel int) {
+	path, pathParameters := diskPath(resourceGroup, diskName)
+	future, err := sendComputeRequest(imagesClient.Client, http.MethodPost, imagesClient.BaseURI, path+"/beginGetAccess", diskAPIVersion, pathParameters,
+		map[string]interface{}{"access": "Write", "durationInSeconds": diskAccessDuration})
+	if err != nil {
+		log.Fatalf("Unable to get write access to disk %s: %v", diskName, err)
+	}
+	resp, err := future.GetResult(imagesClient.Client)
+	if err != nil {
+		log.Fatalf("Unable to get write access to disk %s: %v", diskName, err)
+	}
+	defer resp.Body.Close()
+	var access struct {
+		AccessSAS string `json:"accessSAS"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&access); err != nil {
+		log.Fatalf("Unable to decode the access to disk %s: %v", diskName, err)
+	}
+	if access.AccessSAS == "" {
+		log.Fatalf("No upload URL was returned for disk %s", diskName)
+	}
+
+	fmt.Printf("Uploading %s to disk %s\n", imagePath, diskName)
+	uploadErr := uploadPages(access.AccessSAS, imagePath, parallel)
+	// the disk can only be used once its access is revoked, which also
+	// has to be done to delete it
+	if _, err := sendComputeRequest(imagesClient.Client, http.MethodPost, imagesClient.BaseURI, path+"/endAccess", diskAPIVersion, pathParameters, nil); err != nil {
+		log.Fatalf("Unable to revoke access to disk %s: %v", diskName, err)
+	}
+	if uploadErr != nil {
+		log.Fatalf("Unable to upload VHD: %v", uploadErr)
+	}
+}
+
+// uploadPages writes a file to a page blob given its SAS URL, with up to
+// parallel pages at the same time. The ranges of the file which only
+// contain zeroes are skipped, as the blob is empty.
+func uploadPages(sasURL, path string, parallel int) (err error) {
+	start := time.Now()
+	span := trace.Start("upload", "file", path)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		metrics.Upload("azure", start, err)
+	}()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	// buffers are reused, as there are as many as pages of the file
+	bufs := sync.Pool{New: func() interface{} { return make([]byte, diskPageSize) }}
+	progress := newUploadProgress(filepath.Base(path), size)
+	err = uploadParts(size, diskPageSize, parallel, progress, func(_ int, offset, length int64) error {
+		buf := bufs.Get().([]byte)
+		defer bufs.Put(buf)
+		return uploadPage(sasURL, f, buf[:length], offset)
+	})
+	progress.Finish()
+	return err
+}
+
+func uploadPage(sasURL string, f *os.File, b []byte, offset int64) error {
+	n := int64(len(b))
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return err
+	}
+	empty := true
+	for _, c := range b {
+		if c != 0 {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPut, sasURL+"&comp=page", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-version", "2019-12-12")
+	req.Header.Set("x-ms-page-write", "update")
+	req.Header.Set("x-ms-range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Writing bytes %d-%d failed with %s: %s", offset, offset+n-1, resp.Status, msg)
+	}
+	return nil
+}
+
+// createManagedImageFromDisk creates a managed image from a managed disk
+// and returns its ID
+func createManagedImageFromDisk(resourceGroup resources.Group, diskID, imageName, location string, generation int) string {
+	fmt.Printf("Creating Gen%d managed image %s in resource group %s\n", generation, imageName, *resourceGroup.Name)
+
+	pathParameters := map[string]interface{}{
+		"imageName":         autorest.Encode("path", imageName),
+		"resourceGroupName": autorest.Encode("path", *resourceGroup.Name),
+		"subscriptionId":    autorest.Encode("path", imagesClient.SubscriptionID),
+	}
+	imageParameters := map[string]interface{}{
+		"location": location,
+		"tags":     azureTags,
+		"properties": map[string]interface{}{
+			"hyperVGeneration": fmt.Sprintf("V%d", generation),
+			"storageProfile": map[string]interface{}{
+				"osDisk": map[string]interface{}{
+					"osType":      "Linux",
+					"osState":     "Generalized",
+					"managedDisk": map[string]interface{}{"id": diskID},
+				},
+			},
+		},
+	}
+	path := "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/images/{imageName}"
+	if err := putComputeResource(imagesClient.Client, imagesClient.BaseURI, path, pathParameters, imageParameters); err != nil {
+		log.Fatalf("Unable to create image: %v", err)
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/images/%s", imagesClient.SubscriptionID, *resourceGroup.Name, imageName)
+}
+
+// publishGalleryImage publishes a managed image as a version of an image
+// definition in a Shared Image Gallery, creating the gallery and the image
+// definition if they do not exist, and returns the ID of the version
+func publishGalleryImage(resourceGroup resources.Group, imageID, location string, generation int, g galleryImage) string {
+	pathParameters := map[string]interface{}{
+		"galleryName":             autorest.Encode("path", g.Gallery),
+		"galleryImageName":        autorest.Encode("path", g.Definition),
+		"galleryImageVersionName": autorest.Encode("path", g.Version),
+		"resourceGroupName":       autorest.Encode("path", *resourceGroup.Name),
+		"subscriptionId":          autorest.Encode("path", imagesClient.SubscriptionID),
+	}
+	galleryPath := "/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/galleries/{galleryName}"
+	definitionPath := galleryPath + "/images/{galleryImageName}"
+	versionPath := definitionPath + "/versions/{galleryImageVersionName}"
+
+	// the gallery and the image definition are only created if they do not
+	// exist, so the settings of existing ones are left alone
+	exists := func(path string) bool {
+		req, err := autorest.Prepare(&http.Request{},
+			autorest.AsGet(),
+			autorest.WithBaseURL(imagesClient.BaseURI),
+			autorest.WithPathParameters(path, pathParameters),
+			autorest.WithQueryParameters(map[string]interface{}{"api-version": galleryAPIVersion}))
+		if err != nil {
+			log.Fatalf("Unable to look up %s: %v", path, err)
+		}
+		resp, err := imagesClient.Send(req, autorest.DoRetryForStatusCodes(imagesClient.RetryAttempts, imagesClient.RetryDuration, autorest.StatusCodesForRetry...))
+		if err != nil {
+			log.Fatalf("Unable to look up %s: %v", path, err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true
+		case http.StatusNotFound:
+			return false
+		}
+		log.Fatalf("Unable to look up %s: %s", path, resp.Status)
+		return false
+	}
+	if !exists(galleryPath) {
+		fmt.Printf("Creating Shared Image Gallery %s in resource group %s\n", g.Gallery, *resourceGroup.Name)
+		body := map[string]interface{}{"location": location, "tags": azureTags}
+		if _, err := sendComputeRequest(imagesClient.Client, http.MethodPut, imagesClient.BaseURI, galleryPath, galleryAPIVersion, pathParameters, body); err != nil {
+			log.Fatalf("Unable to create gallery: %v", err)
+		}
+	}
+	if !exists(definitionPath) {
+		fmt.Printf("Creating image definition %s in gallery %s\n", g.Definition, g.Gallery)
+		body := map[string]interface{}{
+			"location": location,
+			"tags":     azureTags,
+			"properties": map[string]interface{}{
+				"osType":           "Linux",
+				"osState":          "Generalized",
+				"hyperVGeneration": fmt.Sprintf("V%d", generation),
+				"identifier": map[string]interface{}{
+					"publisher": "LinuxKit",
+					"offer":     g.Definition,
+					"sku":       g.Definition,
+				},
+			},
+		}
+		if _, err := sendComputeRequest(imagesClient.Client, http.MethodPut, imagesClient.BaseURI, definitionPath, galleryAPIVersion, pathParameters, body); err != nil {
+			log.Fatalf("Unable to create image definition: %v", err)
+		}
+	}
+
+	regions := []map[string]interface{}{{"name": location, "regionalReplicaCount": g.Replicas}}
+	for _, region := range g.Regions {
+		if region != location {
+			regions = append(regions, map[string]interface{}{"name": region, "regionalReplicaCount": g.Replicas})
+		}
+	}
+	fmt.Printf("Publishing version %s of %s in gallery %s to %d regions, this may take a while\n", g.Version, g.Definition, g.Gallery, len(regions))
+	body := map[string]interface{}{
+		"location": location,
+		"tags":     azureTags,
+		"properties": map[string]interface{}{
+			"publishingProfile": map[string]interface{}{
+				"targetRegions": regions,
+			},
+			"storageProfile": map[string]interface{}{
+				"source": map[string]interface{}{"id": imageID},
+			},
+		},
+	}
+	if _, err := sendComputeRequest(imagesClient.Client, http.MethodPut, imagesClient.BaseURI, versionPath, galleryAPIVersion, pathParameters, body); err != nil {
+		log.Fatalf("Unable to publish image version: %v", err)
+	}
+	return galleryImageID(*resourceGroup.Name, g)
+}
+
+// galleryImageID is the ID of the version of an image in a Shared Image
+// Gallery, or of its image definition when no version is given, which VMs
+// boot from the latest version of
+func galleryImageID(resourceGroupName string, g galleryImage) string {
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/galleries/%s/images/%s", imagesClient.SubscriptionID, resourceGroupName, g.Gallery, g.Definition)
+	if g.Version != "" {
+		id += "/versions/" + g.Version
+	}
+	return id
+}
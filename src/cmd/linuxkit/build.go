@@ -2,16 +2,17 @@ package main
 
 import (
 	"bytes"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,28 +39,50 @@ func build(args []string) {
 
 	outputTypes := moby.OutputTypes()
 
-	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
+	buildCmd := newFlagSet("build")
 	buildCmd.Usage = func() {
-		fmt.Printf("USAGE: %s build [options] <file>[.yml] | -\n\n", os.Args[0])
+		fmt.Printf("USAGE: %s build [options] <file>[.yml] | -\n", os.Args[0])
+		fmt.Printf("       %s build [options] -bake <file> [target...]\n\n", os.Args[0])
 		fmt.Printf("Options:\n")
 		buildCmd.PrintDefaults()
 	}
-	buildName := buildCmd.String("name", "", "Name to use for output files")
+	buildName := buildCmd.String("name", "", "Name to use for output files, or a template of it such as {{.Name}}-{{.Arch}}-{{.GitTag}}")
 	buildDir := buildCmd.String("dir", "", "Directory for output files, default current directory")
+	buildCmd.StringVar(buildDir, "output-dir", "", "Directory for output files, same as -dir")
 	buildOutputFile := buildCmd.String("o", "", "File to use for a single output, or '-' for stdout")
 	buildSize := buildCmd.String("size", "1024M", "Size for output image, if supported and fixed size")
 	buildPull := buildCmd.Bool("pull", false, "Always pull images")
 	buildDocker := buildCmd.Bool("docker", false, "Check for images in docker before linuxkit cache")
+	buildIgnoreBuilt := buildCmd.Bool("ignore-built", false, "Take images from the linuxkit cache or the registry even if pkg build built them in docker and they were not pushed")
 	buildDisableTrust := buildCmd.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
 	buildDecompressKernel := buildCmd.Bool("decompress-kernel", false, "Decompress the Linux kernel (default false)")
 	buildCacheDir := buildCmd.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
 	buildCmd.Var(&buildFormats, "format", "Formats to create [ "+strings.Join(outputTypes, " ")+" ]")
 	buildArch := buildCmd.String("arch", runtime.GOARCH, "target architecture for which to build")
+	buildForce := buildCmd.Bool("force", false, "Regenerate all outputs, even if their inputs did not change")
+	buildBake := buildCmd.String("bake", "", "Build the targets of a bake `file`, or the targets given instead of configuration files")
+	buildInsecure := buildCmd.Bool("insecure", false, "Allow pulling a configuration from a registry without TLS")
+	buildSparse := buildCmd.Bool("sparse", false, "Write the raw disk outputs, raw-bios, raw-efi and aws, sparsely, leaving holes for zero regions")
+	buildChecksums := buildCmd.Bool("checksums", false, "Write the sha256 of the outputs to "+checksumsFile+" in the output directory")
+	buildSign := buildCmd.Bool("sign", false, "Sign "+checksumsFile+" with a detached signature, implies -checksums")
+	buildSignMethod := buildCmd.String("sign-method", signMethod(), "Signing method of -sign, cosign or gpg")
+	buildSignKey := buildCmd.String("sign-key", Config.Sign.Key, "cosign private key or KMS URI, or gpg key ID of -sign, default is keyless cosign or the default gpg key")
+	buildLocked := buildCmd.Bool("locked", false, "Build the images pinned to their digests in the lockfile written by lock")
+	buildLockfile := buildCmd.String("lockfile", "", "Lockfile of -locked, default <file>.lock of the last configuration file")
+	buildPublish := publishFlagSet(buildCmd)
 
 	if err := buildCmd.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
 	remArgs := buildCmd.Args()
+	moby.PreferBuiltImages = !*buildIgnoreBuilt
+	if *buildBake != "" {
+		if *buildPublish.target != "" {
+			log.Fatal("The -publish option cannot be specified with -bake")
+		}
+		bake(buildCmd, *buildBake, remArgs)
+		return
+	}
 
 	if len(remArgs) == 0 {
 		fmt.Println("Please specify a configuration file")
@@ -67,16 +90,57 @@ func build(args []string) {
 		os.Exit(1)
 	}
 
-	name := *buildName
-	if name == "" {
-		conf := remArgs[len(remArgs)-1]
-		if conf == "-" {
-			name = defaultNameForStdin
-		} else {
-			name = strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+	conf := remArgs[len(remArgs)-1]
+	nameData := buildNameData{Name: defaultNameForStdin, Arch: *buildArch, dir: "."}
+	switch {
+	case conf == "-":
+	case configReference(conf):
+		// the name of a configuration in a registry is its repository
+		if ref, err := name.ParseReference(conf); err == nil {
+			nameData.Name = path.Base(ref.Context().RepositoryStr())
+		}
+	case isURL(conf):
+		nameData.Name = strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+	default:
+		nameData.Name = strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+		nameData.dir = filepath.Dir(conf)
+	}
+	name := nameData.Name
+	if *buildName != "" {
+		var err error
+		if name, err = expandBuildName(*buildName, nameData); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *buildDir != "" {
+		if err := os.MkdirAll(*buildDir, 0755); err != nil {
+			log.Fatalf("Cannot create the output directory: %v", err)
 		}
 	}
 
+	// the format of the target is built if it is not selected already, and
+	// is the only one built if no format is selected
+	publish := func() {}
+	if *buildPublish.target != "" {
+		if *buildOutputFile != "" {
+			log.Fatal("The -publish option cannot be specified with -o")
+		}
+		format, err := buildPublish.check()
+		if err != nil {
+			log.Fatal(err)
+		}
+		found := false
+		for _, f := range buildFormats {
+			found = found || f == format
+		}
+		if !found {
+			buildFormats = append(buildFormats, format)
+		}
+		// the image is published from the output directory
+		publish = func() { buildPublish.publish(filepath.Join(*buildDir, name), *buildArch) }
+	}
+
 	// There are two types of output, they will probably be split into "build" and "package" later
 	// the basic outputs are tarballs, while the packaged ones are the LinuxKit out formats that
 	// cannot be streamed but we do allow multiple ones to be built.
@@ -143,6 +207,19 @@ func build(args []string) {
 		}
 	}
 
+	// the signer is checked before the build, which may take long
+	var s *signer
+	if *buildSign {
+		*buildChecksums = true
+		s = &signer{method: *buildSignMethod, key: *buildSignKey}
+		if err := s.check(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *buildChecksums && outputFile == os.Stdout {
+		log.Fatal("The -checksums and -sign options cannot be specified with '-o -'")
+	}
+
 	size, err := getDiskSizeMB(*buildSize)
 	if err != nil {
 		log.Fatalf("Unable to parse disk size: %v", err)
@@ -150,37 +227,31 @@ func build(args []string) {
 
 	var m moby.Moby
 	for _, arg := range remArgs {
-		var config []byte
-		if conf := arg; conf == "-" {
-			var err error
-			config, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				log.Fatalf("Cannot read stdin: %v", err)
-			}
-		} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
-			buffer := new(bytes.Buffer)
-			response, err := http.Get(arg)
-			if err != nil {
-				log.Fatalf("Cannot fetch remote yaml file: %v", err)
-			}
-			defer response.Body.Close()
-			_, err = io.Copy(buffer, response.Body)
-			if err != nil {
-				log.Fatalf("Error reading http body: %v", err)
-			}
-			config = buffer.Bytes()
-		} else {
-			var err error
-			config, err = ioutil.ReadFile(conf)
-			if err != nil {
-				log.Fatalf("Cannot open config file: %v", err)
-			}
+		config, err := readBuildConfig(arg, *buildInsecure)
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		c, err := moby.NewConfig(config)
+		if errs, ok := err.(moby.ConfigErrors); ok {
+			for _, e := range errs {
+				fields := log.Fields{"file": arg}
+				if e.Line != 0 {
+					fields["line"], fields["col"] = e.Line, e.Column
+				}
+				log.WithFields(fields).Errorf("The configuration file is invalid: %s", e.Message)
+			}
+			log.Fatal("Invalid config")
+		}
 		if err != nil {
 			log.Fatalf("Invalid config: %v", err)
 		}
+		if isURL(arg) || configReference(arg) {
+			// a remote configuration can change the images it refers to
+			for _, image := range unpinnedImages(c) {
+				log.Warnf("Image %s of %s is not pinned to a digest", image, arg)
+			}
+		}
 		c.Architecture = *buildArch
 		m, err = moby.AppendConfig(m, c)
 		if err != nil {
@@ -188,22 +259,47 @@ func build(args []string) {
 		}
 	}
 
+	if *buildLocked {
+		lockfile := *buildLockfile
+		if lockfile == "" {
+			if lockfile = defaultLockfile(conf); lockfile == "" {
+				log.Fatal("Please specify the lockfile of the configuration with -lockfile")
+			}
+		}
+		l, err := moby.ReadLock(lockfile)
+		if err != nil {
+			log.Fatalf("Cannot read the lockfile: %v", err)
+		}
+		if err := l.Apply(&m); err != nil {
+			log.Fatalf("Cannot build the locked images: %v", err)
+		}
+	}
+
 	if *buildDisableTrust {
 		log.Debugf("Disabling content trust checks for this build")
 		m.Trust = moby.TrustConfig{}
 	}
 
-	var tf *os.File
-	var w io.Writer
-	if outputFile != nil {
-		w = outputFile
-	} else {
-		if tf, err = ioutil.TempFile("", ""); err != nil {
-			log.Fatalf("Error creating tempfile: %v", err)
+	// Outputs which were generated from the same inputs before do not need to be
+	// regenerated. The inputs can only be hashed if all images are already in the
+	// linuxkit cache and are not going to be pulled again.
+	var inputHash string
+	base := filepath.Join(*buildDir, name)
+	// the checksums cover all outputs, including the ones which are up to date
+	checksums := func() {}
+	if *buildChecksums {
+		files := moby.OutputFiles(base, buildFormats)
+		sumsPath := filepath.Join(*buildDir, checksumsFile)
+		if outputFile != nil {
+			files = []string{outputFile.Name()}
+			sumsPath = filepath.Join(filepath.Dir(outputFile.Name()), checksumsFile)
 		}
-		defer os.Remove(tf.Name())
-		w = tf
+		checksums = func() { writeBuildChecksums(sumsPath, files, s) }
 	}
+	// An interrupted build resumes from the image in its checkpoint in the
+	// cache, so only the outputs which were not generated yet are.
+	resumable := outputFile == nil && !*buildForce && !*buildPull && !*buildDocker
+	checkpoint := newBuildCheckpoint(cacheDir)
 
 	// this is a weird interface, but currently only streamable types can have additional files
 	// need to split up the base tarball outputs from the secondary stages
@@ -211,21 +307,218 @@ func build(args []string) {
 	if moby.Streamable(buildFormats[0]) {
 		tp = buildFormats[0]
 	}
-	err = moby.Build(m, w, *buildPull, tp, *buildDecompressKernel, cacheDir, *buildDocker)
-	if err != nil {
-		log.Fatalf("%v", err)
+
+	if resumable {
+		h, err := moby.InputHash(m, cacheDir, *buildDecompressKernel)
+		if err != nil {
+			log.Debugf("Cannot hash build inputs, regenerating all outputs: %v", err)
+		} else {
+			inputHash = h
+			buildFormats = moby.OutdatedFormats(base, buildFormats, inputHash, size, *buildSparse)
+			if len(buildFormats) == 0 {
+				log.Infof("All outputs are up to date")
+				checkpoint.remove(checkpoint.image(inputHash, tp))
+				checksums()
+				publish()
+				return
+			}
+		}
 	}
 
-	if outputFile == nil {
-		image := tf.Name()
-		if err := tf.Close(); err != nil {
-			log.Fatalf("Error closing tempfile: %v", err)
+	var image string
+	if resumable && inputHash != "" {
+		if i, ok := checkpoint.resume(inputHash, tp); ok {
+			log.Infof("Resuming the build from %s", i)
+			image = i
+		}
+	}
+	// saved is whether the image is a checkpoint the build can resume from
+	saved := image != ""
+	if outputFile != nil || image == "" {
+		var tf *os.File
+		var w io.Writer
+		switch {
+		case outputFile != nil:
+			w = outputFile
+		case resumable:
+			if tf, err = checkpoint.create(); err != nil {
+				log.Fatalf("Error creating the checkpoint: %v", err)
+			}
+			w = tf
+		default:
+			if tf, err = ioutil.TempFile("", ""); err != nil {
+				log.Fatalf("Error creating tempfile: %v", err)
+			}
+			w = tf
+		}
+		err = moby.Build(m, w, *buildPull, tp, *buildDecompressKernel, cacheDir, *buildDocker)
+		if tf != nil {
+			image = tf.Name()
+			if cerr := tf.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("Error closing tempfile: %v", cerr)
+			}
+			if err != nil {
+				os.Remove(image)
+			}
+		}
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
+		if resumable {
+			// the images the build pulled are in the cache now
+			if inputHash == "" {
+				if h, err := moby.InputHash(m, cacheDir, *buildDecompressKernel); err == nil {
+					inputHash = h
+				}
+			}
+			if inputHash != "" {
+				if i, err := checkpoint.save(image, inputHash, tp); err != nil {
+					log.Warnf("Unable to save the checkpoint of the build: %v", err)
+				} else {
+					image, saved = i, true
+				}
+			}
+		}
+	}
 
+	if outputFile == nil {
 		log.Infof("Create outputs:")
-		err = moby.Formats(filepath.Join(*buildDir, name), image, buildFormats, size, !*buildDisableTrust, cacheDir)
+		// each output is recorded once it is written, so that an
+		// interrupted build does not generate it again
+		for _, f := range buildFormats {
+			err = moby.Formats(base, image, []string{f}, size, !*buildDisableTrust, *buildSparse, cacheDir)
+			if err != nil {
+				if !saved {
+					os.Remove(image)
+				}
+				log.Fatalf("Error writing outputs: %v", err)
+			}
+			if inputHash != "" {
+				if err := moby.RecordFormats(base, []string{f}, inputHash, size, *buildSparse); err != nil {
+					log.Warnf("Unable to record output hashes: %v", err)
+				}
+			}
+		}
+		checkpoint.remove(image)
+	}
+	if outputFile != nil {
+		if err := outputFile.Sync(); err != nil {
+			log.Fatalf("Error writing output file: %v", err)
+		}
+	}
+	checksums()
+	pruneCache(cacheDir)
+	publish()
+}
+
+// writeBuildChecksums writes the checksums of the files of the outputs to
+// path, and signs it with s if it is set
+func writeBuildChecksums(path string, files []string, s *signer) {
+	log.Infof("Write checksums:")
+	if err := writeChecksums(path, files); err != nil {
+		log.Fatalf("Unable to write the checksums of the outputs: %v", err)
+	}
+	log.Infof("  %s", path)
+	if s == nil {
+		return
+	}
+	if err := s.sign(path); err != nil {
+		log.Fatalf("Unable to sign %s: %v", path, err)
+	}
+	log.Infof("  %s", s.signature(path))
+}
+
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// readBuildConfig reads the configuration arg given to build, which is a
+// file, a URL, the reference of a configuration pushed to a registry or -
+// for stdin
+func readBuildConfig(arg string, insecure bool) ([]byte, error) {
+	switch {
+	case arg == "-":
+		config, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read stdin: %v", err)
+		}
+		return config, nil
+	case configReference(arg):
+		config, err := pullConfig(arg, insecure)
 		if err != nil {
-			log.Fatalf("Error writing outputs: %v", err)
+			return nil, fmt.Errorf("Cannot pull the configuration: %v", err)
+		}
+		return config, nil
+	case isURL(arg):
+		response, err := http.Get(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot fetch remote yaml file: %v", err)
+		}
+		defer response.Body.Close()
+		buffer := new(bytes.Buffer)
+		if _, err := io.Copy(buffer, response.Body); err != nil {
+			return nil, fmt.Errorf("Error reading http body: %v", err)
+		}
+		return buffer.Bytes(), nil
+	}
+	config, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open config file: %v", err)
+	}
+	return config, nil
+}
+
+// configReference returns whether the configuration arg given to build is
+// the reference of a configuration pushed to a registry, which it is if it
+// is not a file and does not look like the path of one, so that a missing
+// file is reported as such rather than pulled
+func configReference(arg string) bool {
+	if arg == "-" || isURL(arg) || isYAMLFile(arg) {
+		return false
+	}
+	if _, err := os.Stat(arg); !os.IsNotExist(err) {
+		return false
+	}
+	if configPath(arg) {
+		return false
+	}
+	_, err := name.ParseReference(arg)
+	return err == nil
+}
+
+// configPath returns whether arg, which does not exist, is the path of a
+// file: it is absolute or relative to the current or home directory, has a
+// separator which is not in references, or is in a directory which exists
+func configPath(arg string) bool {
+	if filepath.IsAbs(arg) || strings.HasPrefix(arg, "~") || strings.ContainsRune(arg, '\\') {
+		return true
+	}
+	for _, prefix := range []string{"./", "../"} {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	if dir := filepath.Dir(arg); dir != "." {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// unpinnedImages returns the images of m which are not pinned to a digest
+func unpinnedImages(m moby.Moby) []string {
+	images := append([]string{m.Kernel.Image}, m.Init...)
+	for _, section := range [][]*moby.Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, i := range section {
+			images = append(images, i.Image)
+		}
+	}
+	var unpinned []string
+	for _, i := range images {
+		if i != "" && !strings.Contains(i, "@sha256:") {
+			unpinned = append(unpinned, i)
 		}
 	}
+	return unpinned
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// bakeFile is the file given to 'build -bake', which describes many images
+// to build at once
+type bakeFile struct {
+	// Dir is the directory of the outputs of the targets which do not
+	// set one, relative to the bake file
+	Dir     string       `yaml:"dir"`
+	Targets []bakeTarget `yaml:"targets"`
+}
+
+// bakeTarget is an image built for each of its architectures in all of
+// its formats
+type bakeTarget struct {
+	Name string `yaml:"name"`
+	// Configs are merged, as the configurations given to build are
+	Configs []string `yaml:"configs"`
+	Formats []string `yaml:"formats"`
+	Arch    []string `yaml:"arch"`
+	Dir     string   `yaml:"dir"`
+	// Output is the name of the outputs, or a template of it as for
+	// -name, the default is the name of the target with the arch if the
+	// target is built for more than one
+	Output string `yaml:"output"`
+	Size   string `yaml:"size"`
+}
+
+// bakeBuild is a build of a target for an architecture
+type bakeBuild struct {
+	target   string
+	arch     string
+	formats  []string
+	args     []string
+	err      error
+	duration time.Duration
+}
+
+// bakeFlags are the options of build which are set by the bake file for
+// each build, and so cannot be given with -bake
+var bakeFlags = map[string]bool{
+	"bake": true, "arch": true, "dir": true, "output-dir": true, "format": true, "name": true, "o": true, "size": true,
+}
+
+// readBakeFile reads the bake file at path, and returns the builds of the
+// targets given, or of all of its targets
+func readBakeFile(path string, targets []string) ([]*bakeBuild, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the bake file: %v", err)
+	}
+	var bake bakeFile
+	if err := yaml.UnmarshalStrict(b, &bake); err != nil {
+		return nil, fmt.Errorf("Invalid bake file %s: %v", path, err)
+	}
+	base := filepath.Dir(path)
+	relative := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+	config := func(c string) string {
+		if c == "-" || isURL(c) {
+			return c
+		}
+		if _, err := os.Stat(relative(c)); os.IsNotExist(err) && configReference(c) {
+			return c
+		}
+		return relative(c)
+	}
+
+	selected := map[string]bool{}
+	for _, t := range targets {
+		selected[t] = true
+	}
+	names := map[string]bool{}
+	var builds []*bakeBuild
+	for i, t := range bake.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("Target %d of %s has no name", i, path)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("Target %s of %s is not unique", t.Name, path)
+		}
+		names[t.Name] = true
+		if len(selected) > 0 && !selected[t.Name] {
+			continue
+		}
+		if len(t.Configs) == 0 {
+			return nil, fmt.Errorf("Target %s of %s has no configs", t.Name, path)
+		}
+		delete(selected, t.Name)
+		if len(t.Formats) == 0 {
+			t.Formats = []string{"kernel+initrd"}
+		}
+		if len(t.Arch) == 0 {
+			t.Arch = []string{runtime.GOARCH}
+		}
+		dir := t.Dir
+		if dir == "" {
+			dir = bake.Dir
+		}
+		for _, arch := range t.Arch {
+			output := t.Output
+			if output == "" {
+				output = t.Name
+				if len(t.Arch) > 1 {
+					output += "-" + arch
+				}
+			}
+			output, err := expandBuildName(output, buildNameData{Name: t.Name, Arch: arch, dir: base})
+			if err != nil {
+				return nil, fmt.Errorf("Target %s of %s: %v", t.Name, path, err)
+			}
+			args := []string{"-arch", arch, "-name", output, "-format", strings.Join(t.Formats, ",")}
+			if dir != "" {
+				args = append(args, "-dir", relative(dir))
+			}
+			if t.Size != "" {
+				args = append(args, "-size", t.Size)
+			}
+			for _, c := range t.Configs {
+				args = append(args, config(c))
+			}
+			builds = append(builds, &bakeBuild{target: t.Name, arch: arch, formats: t.Formats, args: args})
+		}
+	}
+	for t := range selected {
+		return nil, fmt.Errorf("There is no target %s in %s", t, path)
+	}
+	return builds, nil
+}
+
+// bake runs the builds of the bake file path with the options of flags which
+// were set, and prints a summary of them. The builds share the cache, so
+// each image is only pulled once.
+func bake(flags *flag.FlagSet, path string, targets []string) {
+	// the global flags may be given before build
+	common := globalArgs()
+	var invalid []string
+	flags.Visit(func(f *flag.Flag) {
+		if bakeFlags[f.Name] {
+			if f.Name != "bake" {
+				invalid = append(invalid, "-"+f.Name)
+			}
+			return
+		}
+		common = append(common, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	if len(invalid) > 0 {
+		log.Fatalf("Options %s are set by the bake file and cannot be given with -bake", strings.Join(invalid, " "))
+	}
+	builds, err := readBakeFile(path, targets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for i, b := range builds {
+		log.Infof("Building %s for %s (%d/%d)", b.target, b.arch, i+1, len(builds))
+		cmd := exec.Command(self, append(append([]string{"build"}, common...), b.args...)...)
+		log.Debugf("Executing: %v", cmd.Args)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		start := time.Now()
+		b.err = cmd.Run()
+		b.duration = time.Since(start)
+		if b.err != nil {
+			failed++
+			log.Errorf("Failed to build %s for %s: %v", b.target, b.arch, b.err)
+		}
+	}
+
+	fmt.Printf("\n%-30s %-8s %-40s %-6s %s\n", "TARGET", "ARCH", "FORMATS", "RESULT", "TIME")
+	for _, b := range builds {
+		result := "OK"
+		if b.err != nil {
+			result = "FAILED"
+		}
+		fmt.Printf("%-30s %-8s %-40s %-6s %.1fs\n", b.target, b.arch, strings.Join(b.formats, ","), result, b.duration.Seconds())
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d builds failed", failed, len(builds))
+	}
+}
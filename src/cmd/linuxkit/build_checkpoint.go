@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// buildCheckpoint is the image of a build whose outputs are being
+// generated, kept in the cache so that an interrupted build resumes from it
+// rather than assembling the image again. The outputs which were generated
+// are recorded as they are written, so they are not generated again either.
+type buildCheckpoint struct {
+	dir string
+}
+
+func newBuildCheckpoint(cacheDir string) buildCheckpoint {
+	return buildCheckpoint{dir: filepath.Join(cacheDir, "checkpoints")}
+}
+
+// image is the image of the checkpoint of the inputs with inputHash
+// assembled for the type tp, which may add to it
+func (c buildCheckpoint) image(inputHash, tp string) string {
+	name := inputHash
+	if tp != "" {
+		name += "-" + tp
+	}
+	return filepath.Join(c.dir, name+".tar")
+}
+
+// resume returns the image of the checkpoint if there is one of the inputs
+// with inputHash for the type tp
+func (c buildCheckpoint) resume(inputHash, tp string) (string, bool) {
+	image := c.image(inputHash, tp)
+	if _, err := os.Stat(image); err != nil {
+		return "", false
+	}
+	return image, true
+}
+
+// create returns a temporary file the image is written to, which only
+// becomes the checkpoint once it is saved
+func (c buildCheckpoint) create() (*os.File, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(c.dir, "build-")
+}
+
+// save makes the complete image tmp the checkpoint of the inputs with
+// inputHash for the type tp, and returns its path
+func (c buildCheckpoint) save(tmp, inputHash, tp string) (string, error) {
+	image := c.image(inputHash, tp)
+	if err := os.Rename(tmp, image); err != nil {
+		return "", err
+	}
+	return image, nil
+}
+
+// remove removes the image of a checkpoint once the build is done, or a
+// temporary one which cannot be resumed from
+func (c buildCheckpoint) remove(image string) {
+	if err := os.Remove(image); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Unable to remove the checkpoint %s: %v", image, err)
+	}
+}
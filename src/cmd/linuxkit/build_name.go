@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// buildNameData are the fields of a template given to 'build -name', e.g.
+// {{.Name}}-{{.Arch}}-{{.GitTag}}
+type buildNameData struct {
+	// Name is the base name of the last configuration file
+	Name string
+	// Arch is the architecture the image is built for
+	Arch string
+	// Date is the date of the build, as YYYYMMDD
+	Date string
+
+	// dir is the directory of the configuration, whose git repository
+	// the git fields are taken from
+	dir string
+}
+
+// GitTag is the tag of the commit of the configuration, or a description of
+// the commit relative to the last tag if it is not tagged
+func (d buildNameData) GitTag() (string, error) {
+	if tag, err := d.git("describe", "--tags", "--exact-match"); err == nil {
+		return tag, nil
+	}
+	return d.git("describe", "--tags", "--always", "--dirty")
+}
+
+// GitCommit is the short hash of the commit of the configuration
+func (d buildNameData) GitCommit() (string, error) {
+	return d.git("rev-parse", "--short", "HEAD")
+}
+
+func (d buildNameData) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = d.dir
+	log.Debugf("Executing: %v", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed in %s: %v", strings.Join(args, " "), d.dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// expandBuildName returns the name of the outputs given by the template
+// name, or name if it is not a template
+func expandBuildName(name string, data buildNameData) (string, error) {
+	if !strings.Contains(name, "{{") {
+		return name, nil
+	}
+	t, err := template.New("name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %v", err)
+	}
+	if data.Date == "" {
+		data.Date = time.Now().UTC().Format("20060102")
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid name template: %v", err)
+	}
+	expanded := buf.String()
+	if expanded == "" || strings.ContainsAny(expanded, "/\\") {
+		return "", fmt.Errorf("the name template gives the invalid name %q", expanded)
+	}
+	return expanded, nil
+}
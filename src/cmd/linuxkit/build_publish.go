@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// publishTarget is where 'build -publish' publishes an image, given the
+// format it is built in and the push backend it is published with
+type publishTarget struct {
+	format string
+	push   func(args []string)
+}
+
+var publishTargets = map[string]publishTarget{
+	"aws-ami":   {format: "aws", push: pushAWS},
+	"azure-sig": {format: "vhd", push: pushAzure},
+	"gcp-image": {format: "gcp", push: pushGcp},
+}
+
+// publishTargetNames returns the names of the targets of -publish
+func publishTargetNames() []string {
+	names := make([]string, 0, len(publishTargets))
+	for name := range publishTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// publishFlags are the options of 'build -publish', which are passed to
+// the push backend of the target they apply to
+type publishFlags struct {
+	target        *string
+	name          *string
+	bucket        *string
+	project       *string
+	family        *string
+	resourceGroup *string
+	location      *string
+	gallery       *string
+	version       *string
+	replicate     *string
+	tags          Tags
+}
+
+func publishFlagSet(flags *flag.FlagSet) *publishFlags {
+	p := &publishFlags{
+		target:        flags.String("publish", "", "Publish the image to a cloud once it is built, one of "+strings.Join(publishTargetNames(), ", ")+". The format the target needs is built"),
+		name:          flags.String("publish-name", "", "Name of the published image. Defaults to the name of the output files"),
+		bucket:        flags.String("publish-bucket", "", "Bucket the image is uploaded to for aws-ami and gcp-image"),
+		project:       flags.String("publish-project", "", "GCP project of gcp-image"),
+		family:        flags.String("publish-family", "", "GCP image family of gcp-image"),
+		resourceGroup: flags.String("publish-resource-group", "", "Azure resource group of azure-sig. *Required* with azure-sig"),
+		location:      flags.String("publish-location", "", "Azure location of azure-sig"),
+		gallery:       flags.String("publish-gallery", "", "Shared Image Gallery of azure-sig. *Required* with azure-sig"),
+		version:       flags.String("publish-version", "", "Version of the image in the gallery of azure-sig, as major.minor.patch. *Required* with azure-sig"),
+		replicate:     flags.String("publish-replicate", "", "Comma separated list of regions to replicate the image of azure-sig to"),
+	}
+	flags.Var(&p.tags, "publish-tag", "Tag to apply to the published image and the other cloud resources created, as key=value, may be repeated")
+	return p
+}
+
+// check checks the options of the target before the image is built, and
+// returns the format it needs
+func (p *publishFlags) check() (string, error) {
+	t, ok := publishTargets[*p.target]
+	if !ok {
+		return "", fmt.Errorf("Unknown -publish target %s, must be one of %s", *p.target, strings.Join(publishTargetNames(), ", "))
+	}
+	if *p.target == "azure-sig" && (*p.resourceGroup == "" || *p.gallery == "" || *p.version == "") {
+		return "", fmt.Errorf("Publishing to azure-sig requires -publish-resource-group, -publish-gallery and -publish-version")
+	}
+	return t.format, nil
+}
+
+// args returns the arguments of the push backend the image built in base
+// for arch is published with
+func (p *publishFlags) args(base, arch string) []string {
+	var args []string
+	add := func(flag, value string) {
+		if value != "" {
+			args = append(args, "-"+flag, value)
+		}
+	}
+	add("img-name", *p.name)
+	switch *p.target {
+	case "aws-ami":
+		add("bucket", *p.bucket)
+		add("arch", arch)
+	case "gcp-image":
+		add("bucket", *p.bucket)
+		add("arch", arch)
+		add("project", *p.project)
+		add("family", *p.family)
+	case "azure-sig":
+		add("resource-group", *p.resourceGroup)
+		add("location", *p.location)
+		add("gallery", *p.gallery)
+		add("gallery-version", *p.version)
+		add("replicate", *p.replicate)
+	}
+	for _, tag := range p.tags.Strings() {
+		add("tag", tag)
+	}
+	return append(args, moby.OutputFiles(base, []string{publishTargets[*p.target].format})[0])
+}
+
+// publish publishes the image built in base for arch with the push backend
+// of the target
+func (p *publishFlags) publish(base, arch string) {
+	args := p.args(base, arch)
+	log.Infof("Publishing %s to %s", args[len(args)-1], *p.target)
+	publishTargets[*p.target].push(args)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	log "github.com/sirupsen/logrus"
+)
+
+// buildersCommand is 'linuxkit builders'
+func buildersCommand() *command {
+	return &command{
+		name:  "builders",
+		short: "Manage the builders packages are built on",
+		args:  "command [options]",
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "check", short: "Check that the builders are healthy", run: buildersCheck},
+			{name: "create", short: "Create a buildx builder in a local container or on an ssh host", run: buildersCreate},
+			{name: "ls", short: "List the builders", run: buildersList},
+			{name: "rm", short: "Remove builders", run: buildersRemove},
+		},
+	}
+}
+
+// builderType describes a builder of the config
+func builderType(builder string) string {
+	if pkglib.IsDockerHost(builder) {
+		return "docker host"
+	}
+	return "buildx"
+}
+
+// builderArchs returns the archs of the builders of the config, sorted
+func builderArchs() []string {
+	var archs []string
+	for arch := range Config.Builders {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// dockerOutput runs docker on the Docker host, or the default one if host
+// is empty, and returns its output
+func dockerOutput(host string, args ...string) (string, error) {
+	cmd := exec.Command("docker", args...)
+	cmd.Env = os.Environ()
+	if host != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_HOST="+host)
+	}
+	log.Debugf("Executing: %v", cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if isExecErrNotFound(err) {
+			return "", fmt.Errorf("linuxkit builders requires docker to be installed")
+		}
+		return string(out), fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func isExecErrNotFound(err error) bool {
+	eerr, ok := err.(*exec.Error)
+	return ok && eerr.Err == exec.ErrNotFound
+}
+
+// checkBuilder checks that a builder of the config can build, starting a
+// buildx builder if it is not running
+func checkBuilder(builder string) error {
+	if pkglib.IsDockerHost(builder) {
+		_, err := dockerOutput(builder, "version", "--format", "{{.Server.Version}}")
+		return err
+	}
+	_, err := dockerOutput("", "buildx", "inspect", "--bootstrap", builder)
+	return err
+}
+
+// saveBuilders writes the builders to the config file, unless they were
+// set by the environment
+func saveBuilders() error {
+	if _, ok := os.LookupEnv(builderEnv); ok {
+		return fmt.Errorf("The builders are set by $%s and cannot be changed", builderEnv)
+	}
+	return saveConfigSetting("builders", Config.Builders)
+}
+
+func buildersCreate(args []string) {
+	flags := newFlagSet("create")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s builders create [options]\n\n", os.Args[0])
+		fmt.Printf("Create a buildx builder for an architecture and add it to the builders\n")
+		fmt.Printf("of the config, which 'pkg build' and 'pkg push' build on.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	arch := flags.String("arch", runtime.GOARCH, "Architecture the builder builds for")
+	name := flags.String("name", "", "Name of the buildx builder (default linuxkit-<arch>)")
+	host := flags.String("host", "", "Docker host the builder runs on, e.g. ssh://user@builder-arm64, instead of a local container")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	switch *arch {
+	case "amd64", "arm64", "s390x", "riscv64":
+	default:
+		log.Fatalf("Unknown arch %q", *arch)
+	}
+	if *name == "" {
+		*name = "linuxkit-" + *arch
+	}
+	if pkglib.IsDockerHost(*name) {
+		log.Fatalf("Invalid builder name %q", *name)
+	}
+	if b := Config.Builders[*arch]; b != "" {
+		log.Fatalf("There is already the builder %s for %s, remove it first", b, *arch)
+	}
+
+	log.Infof("Creating the buildx builder %s for %s", *name, *arch)
+	create := []string{"buildx", "create", "--name", *name, "--driver", "docker-container", "--platform", "linux/" + *arch}
+	// the builder pulls through the mirrors of the config when it is created
+	if config := buildkitdConfig(cachepkg.Mirrors()); config != "" {
+		f, err := ioutil.TempFile("", "buildkitd-*.toml")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(config); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		create = append(create, "--config", f.Name())
+	}
+	if *host != "" {
+		create = append(create, *host)
+	}
+	if _, err := dockerOutput("", create...); err != nil {
+		log.Fatalf("Unable to create the builder %s: %v", *name, err)
+	}
+	if err := checkBuilder(*name); err != nil {
+		if _, err := dockerOutput("", "buildx", "rm", *name); err != nil {
+			log.Warnf("Unable to remove the builder %s: %v", *name, err)
+		}
+		log.Fatalf("Unable to start the builder %s: %v", *name, err)
+	}
+
+	if Config.Builders == nil {
+		Config.Builders = map[string]string{}
+	}
+	Config.Builders[*arch] = *name
+	if err := saveBuilders(); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Packages for %s are built with %s", *arch, *name)
+}
+
+// buildkitdConfig returns the buildkitd config of the mirrors, by registry
+// such as index.docker.io, or nothing if there are none
+func buildkitdConfig(mirrors map[string][]string) string {
+	registries := []string{}
+	for r := range mirrors {
+		registries = append(registries, r)
+	}
+	sort.Strings(registries)
+	var config strings.Builder
+	for _, r := range registries {
+		quoted := []string{}
+		for _, m := range mirrors[r] {
+			quoted = append(quoted, fmt.Sprintf("%q", m))
+		}
+		// buildkit names Docker Hub docker.io
+		if r == "index.docker.io" {
+			r = "docker.io"
+		}
+		fmt.Fprintf(&config, "[registry.%q]\n  mirrors = [%s]\n", r, strings.Join(quoted, ", "))
+	}
+	return config.String()
+}
+
+func buildersList(args []string) {
+	flags := newFlagSet("ls")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	fmt.Printf("%-10s %-40s %s\n", "ARCH", "BUILDER", "TYPE")
+	for _, arch := range builderArchs() {
+		fmt.Printf("%-10s %-40s %s\n", arch, Config.Builders[arch], builderType(Config.Builders[arch]))
+	}
+}
+
+func buildersCheck(args []string) {
+	flags := newFlagSet("check")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s builders check [arch...]\n\n", os.Args[0])
+		fmt.Printf("Check that the builders of the archs, or all of them, can build,\n")
+		fmt.Printf("starting the buildx builders which are not running.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	archs := flags.Args()
+	if len(archs) == 0 {
+		archs = builderArchs()
+	}
+	failed := false
+	for _, arch := range archs {
+		builder := Config.Builders[arch]
+		if builder == "" {
+			log.Errorf("There is no builder for %s", arch)
+			failed = true
+			continue
+		}
+		if err := checkBuilder(builder); err != nil {
+			log.Errorf("%s: %s is unhealthy: %v", arch, builder, err)
+			failed = true
+			continue
+		}
+		log.Infof("%s: %s is healthy", arch, builder)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func buildersRemove(args []string) {
+	flags := newFlagSet("rm")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s builders rm [options] arch|builder...\n\n", os.Args[0])
+		fmt.Printf("Remove builders from the config, given their arch or name. The\n")
+		fmt.Printf("buildx builders are removed as well.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	keep := flags.Bool("keep", false, "Keep the buildx builders, only remove them from the config")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	for _, b := range flags.Args() {
+		var arch string
+		for _, a := range builderArchs() {
+			if a == b || Config.Builders[a] == b {
+				arch = a
+				break
+			}
+		}
+		if arch == "" {
+			log.Fatalf("There is no builder %s", b)
+		}
+		builder := Config.Builders[arch]
+		if !*keep && !pkglib.IsDockerHost(builder) {
+			if _, err := dockerOutput("", "buildx", "rm", builder); err != nil {
+				log.Warnf("Unable to remove the buildx builder %s: %v", builder, err)
+			}
+		}
+		delete(Config.Builders, arch)
+		log.Infof("Removed the builder %s for %s", builder, arch)
+	}
+	if err := saveBuilders(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// bundleManifestFile is the file of a bundle which describes it
+const bundleManifestFile = "bundle.json"
+
+// bundleManifest describes what a bundle contains. The configurations are
+// in configs/, the files they add from the host in files/, relative to the
+// directory they are built from, or in home/ if they are in the home
+// directory, and the images in the OCI image layout images/.
+type bundleManifest struct {
+	Arch    string   `json:"arch"`
+	Configs []string `json:"configs"`
+	Images  []string `json:"images"`
+	// Docker are the images of the images/ layout which generate the
+	// output formats with docker
+	Docker []string `json:"docker,omitempty"`
+	Files  []string `json:"files,omitempty"`
+}
+
+// bundleCommand is 'linuxkit bundle'
+func bundleCommand() *command {
+	return &command{
+		name:  "bundle",
+		short: "Export and import everything builds need, to build offline",
+		args:  "command [options]",
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "export", short: "Write the images and files the build of YAML files needs to a bundle", run: bundleExport},
+			{name: "import", short: "Add the images of a bundle to the cache and write its YAML files and files", run: bundleImport},
+		},
+	}
+}
+
+// bundleConfigName returns the name of the configuration arg in a bundle
+func bundleConfigName(arg string) string {
+	switch {
+	case arg == "-":
+		return defaultNameForStdin + ".yml"
+	case configReference(arg):
+		if ref, err := name.ParseReference(arg); err == nil {
+			return path.Base(ref.Context().RepositoryStr()) + ".yml"
+		}
+	}
+	return path.Base(filepath.ToSlash(arg))
+}
+
+// bundleRelativePath cleans a path of a bundle, and returns false if it is
+// absolute or not below the directory it is relative to
+func bundleRelativePath(p string) (string, bool) {
+	if filepath.IsAbs(p) {
+		return "", false
+	}
+	clean := path.Clean(filepath.ToSlash(p))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+// bundleFileEntry returns the entry of the bundle of the source of a file,
+// which must be relative to the current or home directory
+func bundleFileEntry(source string) (string, error) {
+	dir := "files"
+	if strings.HasPrefix(source, "~/") {
+		dir = "home"
+		source = source[2:]
+	}
+	clean, ok := bundleRelativePath(source)
+	if !ok {
+		return "", fmt.Errorf("the file %s is not in the current or home directory", source)
+	}
+	return path.Join(dir, clean), nil
+}
+
+func bundleExport(args []string) {
+	var formats formatList
+	flags := newFlagSet("export")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s bundle export [options] <file>[.yml] ...\n\n", os.Args[0])
+		fmt.Printf("Write the YAML files, the images they use, the images which generate\n")
+		fmt.Printf("the formats and the files they add from the host to a bundle, which\n")
+		fmt.Printf("'bundle import' seeds the cache of a disconnected host with. The images\n")
+		fmt.Printf("are pulled into the cache if they are not in it.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "File to write the bundle to, default <name>-bundle.tar")
+	arch := flags.String("arch", runtime.GOARCH, "target architecture of the builds")
+	flags.Var(&formats, "format", "Formats the builds create, whose images are added to the bundle [ "+strings.Join(moby.OutputTypes(), " ")+" ]")
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	pull := flags.Bool("pull", false, "Always pull images")
+	disableTrust := flags.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
+	insecure := flags.Bool("insecure", false, "Allow pulling a configuration from a registry without TLS")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify a configuration file")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if len(formats) == 0 {
+		formats = formatList{"kernel+initrd"}
+	}
+	if err := moby.ValidateFormats(formats, *cacheDir); err != nil {
+		log.Fatalf("Error parsing formats: %v", err)
+	}
+
+	manifest := bundleManifest{Arch: *arch}
+	configs := map[string][]byte{}
+	var m moby.Moby
+	for _, arg := range flags.Args() {
+		config, err := readBuildConfig(arg, *insecure)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := moby.NewConfig(config)
+		if err != nil {
+			log.Fatalf("Invalid config %s: %v", arg, err)
+		}
+		c.Architecture = *arch
+		if m, err = moby.AppendConfig(m, c); err != nil {
+			log.Fatalf("Cannot append config files: %v", err)
+		}
+		configName := bundleConfigName(arg)
+		if _, ok := configs[configName]; ok {
+			log.Fatalf("There are several configuration files named %s", configName)
+		}
+		configs[configName] = config
+		manifest.Configs = append(manifest.Configs, configName)
+	}
+	if *disableTrust {
+		m.Trust = moby.TrustConfig{}
+	}
+
+	log.Infof("Pulling the images the builds need into %s", *cacheDir)
+	if err := moby.PullImages(m, *pull, *cacheDir); err != nil {
+		log.Fatal(err)
+	}
+	manifest.Images = moby.Images(m)
+	dockerImages, formatConfigs, err := moby.FormatImages(formats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range formatConfigs {
+		if err := moby.PullImages(c, *pull, *cacheDir); err != nil {
+			log.Fatal(err)
+		}
+		manifest.Images = append(manifest.Images, moby.Images(c)...)
+	}
+	for _, image := range dockerImages {
+		// the images of all platforms are kept, for the host which imports them
+		if err := moby.PullImage(image, *pull, !*disableTrust, *cacheDir, runtime.GOARCH); err != nil {
+			log.Fatal(err)
+		}
+		manifest.Docker = append(manifest.Docker, moby.ReferenceExpand(image))
+	}
+	manifest.Images = uniqueStrings(append(manifest.Images, manifest.Docker...))
+
+	files := map[string]string{}
+	for _, f := range m.Files {
+		if f.Source == "" {
+			continue
+		}
+		// the file is written without the digest it is pinned to
+		file, _, err := moby.FileSourceDigest(f.Source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		source := file
+		if strings.HasPrefix(source, "~/") {
+			source = util.HomeDir() + source[1:]
+		}
+		if _, err := os.Stat(source); err != nil && f.Optional {
+			continue
+		}
+		entry, err := bundleFileEntry(file)
+		if err != nil {
+			log.Fatalf("Cannot add the file %s to the bundle: %v", f.Path, err)
+		}
+		if _, ok := files[entry]; !ok {
+			files[entry] = source
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(manifest.Configs[0], filepath.Ext(manifest.Configs[0])) + "-bundle.tar"
+	}
+	log.Infof("Writing %d images and %d files to %s", len(manifest.Images), len(files), *output)
+	if err := writeBundle(*output, manifest, configs, files, *cacheDir); err != nil {
+		os.Remove(*output)
+		log.Fatalf("Unable to write the bundle %s: %v", *output, err)
+	}
+}
+
+func writeBundle(output string, manifest bundleManifest, configs map[string][]byte, files map[string]string, cacheDir string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarWriteFile(tw, bundleManifestFile, b, 0644); err != nil {
+		return err
+	}
+	for _, c := range manifest.Configs {
+		if err := tarWriteFile(tw, path.Join("configs", c), configs[c], 0644); err != nil {
+			return err
+		}
+	}
+	for _, source := range manifest.Files {
+		entry, _ := bundleFileEntry(source)
+		contents, err := ioutil.ReadFile(files[entry])
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(files[entry])
+		if err != nil {
+			return err
+		}
+		if err := tarWriteFile(tw, entry, contents, int64(fi.Mode().Perm())); err != nil {
+			return err
+		}
+	}
+	if err := cachepkg.ExportImages(tw, "images", cacheDir, manifest.Images); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func tarWriteFile(tw *tar.Writer, name string, contents []byte, mode int64) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(contents))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+func uniqueStrings(s []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func bundleImport(args []string) {
+	flags := newFlagSet("import")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s bundle import [options] <bundle>\n\n", os.Args[0])
+		fmt.Printf("Add the images of a bundle written by 'bundle export' to the cache and\n")
+		fmt.Printf("load those which generate the output formats into docker. Its YAML files\n")
+		fmt.Printf("and the files they add are written to the directory, which they are\n")
+		fmt.Printf("then built from. The files from the home directory are written to\n")
+		fmt.Printf("home/ in the directory, or with -home to the home directory, unless\n")
+		fmt.Printf("it has them already.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	dir := flags.String("dir", ".", "Directory to write the YAML files and their files to")
+	loadDocker := flags.Bool("docker", true, "Load the images which generate the output formats into docker")
+	home := flags.Bool("home", false, "Write the files from the home directory to the home directory instead of home/ in -dir")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Please specify a bundle")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	tmp, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := untarBundle(flags.Arg(0), tmp); err != nil {
+		log.Fatalf("Unable to read the bundle %s: %v", flags.Arg(0), err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, bundleManifestFile))
+	if err != nil {
+		log.Fatalf("%s is not a bundle: %v", flags.Arg(0), err)
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		log.Fatalf("Invalid %s in %s: %v", bundleManifestFile, flags.Arg(0), err)
+	}
+	// the bundle may only write below -dir
+	for i, c := range manifest.Configs {
+		clean, ok := bundleRelativePath(c)
+		if !ok {
+			log.Fatalf("Invalid configuration %s in %s", c, flags.Arg(0))
+		}
+		manifest.Configs[i] = filepath.FromSlash(clean)
+	}
+	for _, source := range manifest.Files {
+		if _, err := bundleFileEntry(source); err != nil {
+			log.Fatalf("Invalid file in %s: %v", flags.Arg(0), err)
+		}
+	}
+
+	names, err := cachepkg.ImportImages(*cacheDir, filepath.Join(tmp, "images"))
+	if err != nil {
+		log.Fatalf("Unable to add the images to the cache %s: %v", *cacheDir, err)
+	}
+	log.Infof("Added %d images to %s", len(names), *cacheDir)
+	if *loadDocker {
+		for _, image := range manifest.Docker {
+			if err := dockerLoad(*cacheDir, image); err != nil {
+				log.Fatalf("Unable to load %s into docker: %v", image, err)
+			}
+		}
+	}
+
+	var written []string
+	for _, c := range manifest.Configs {
+		if err := copyBundleFile(filepath.Join(tmp, "configs", c), filepath.Join(*dir, c), true); err != nil {
+			log.Fatal(err)
+		}
+		written = append(written, filepath.Join(*dir, c))
+	}
+	var staged []string
+	for _, source := range manifest.Files {
+		entry, err := bundleFileEntry(source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dst := filepath.Join(*dir, filepath.FromSlash(strings.TrimPrefix(entry, "files/")))
+		overwrite := true
+		if strings.HasPrefix(entry, "home/") {
+			// the files of the home directory are only written there
+			// when asked to, so the bundle cannot add e.g. SSH keys
+			if *home {
+				dst = filepath.Join(util.HomeDir(), filepath.FromSlash(strings.TrimPrefix(entry, "home/")))
+			} else {
+				dst = filepath.Join(*dir, filepath.FromSlash(entry))
+				staged = append(staged, source)
+			}
+			overwrite = false
+		}
+		if err := copyBundleFile(filepath.Join(tmp, filepath.FromSlash(entry)), dst, overwrite); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(staged) != 0 {
+		log.Warnf("Wrote %s to %s instead of the home directory, move them there or import with -home before building", strings.Join(staged, ", "), filepath.Join(*dir, "home"))
+	}
+	log.Infof("Wrote %s, build them from %s for %s", strings.Join(written, ", "), *dir, manifest.Arch)
+}
+
+// untarBundle extracts the bundle into dir
+func untarBundle(bundle, dir string) error {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		clean, ok := bundleRelativePath(hdr.Name)
+		if !ok {
+			return fmt.Errorf("invalid entry %s", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyBundleFile copies a file of an extracted bundle to dst, which is kept
+// if it exists unless overwrite is set
+func copyBundleFile(src, dst string, overwrite bool) error {
+	if _, err := os.Stat(dst); err == nil && !overwrite {
+		log.Warnf("Keeping %s, which already exists", dst)
+		return nil
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, contents, fi.Mode().Perm())
+}
+
+// dockerLoad loads the image of the cache for the architecture of the host
+// into docker
+func dockerLoad(cacheDir, image string) error {
+	ref, err := name.NewTag(image)
+	if err != nil {
+		return err
+	}
+	img, err := cachepkg.FindImage(cacheDir, image, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	log.Infof("Loading %s into docker", image)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarball.Write(ref, img, pw))
+	}()
+	defer pr.Close()
+	cmd := exec.Command("docker", "image", "load")
+	cmd.Stdin = pr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if isExecErrNotFound(err) {
+			return fmt.Errorf("docker is not installed, use -docker=false to skip the images of the formats")
+		}
+		return err
+	}
+	return nil
+}
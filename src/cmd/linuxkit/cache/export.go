@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ExportImages writes the images of the cache dir with the names, and the
+// blobs they refer to which are in the cache, as an OCI image layout in the
+// directory prefix of tw
+func ExportImages(tw *tar.Writer, prefix, dir string, names []string) error {
+	p, err := Get(dir)
+	if err != nil {
+		return err
+	}
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	blobs := map[string]bool{}
+	for _, name := range names {
+		desc, err := FindDescriptor(dir, name)
+		if err != nil {
+			return fmt.Errorf("image %s is not in the cache: %v", name, err)
+		}
+		d := *desc
+		d.Annotations = map[string]string{imagespec.AnnotationRefName: name}
+		index.Manifests = append(index.Manifests, d)
+		imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+	}
+
+	layoutBytes, err := json.Marshal(imagespec.ImageLayout{Version: imagespec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{{imagespec.ImageLayoutFile, layoutBytes}, {"index.json", indexBytes}} {
+		hdr := &tar.Header{Name: path.Join(prefix, f.name), Mode: 0644, Size: int64(len(f.contents))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			return err
+		}
+	}
+
+	sorted := make([]string, 0, len(blobs))
+	for blob := range blobs {
+		sorted = append(sorted, blob)
+	}
+	sort.Strings(sorted)
+	for _, blob := range sorted {
+		f, err := os.Open(blobPath(p, blob))
+		if os.IsNotExist(err) {
+			// the blobs of the other platforms of an index may not be cached
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		hdr := &tar.Header{Name: path.Join(prefix, "blobs", filepath.ToSlash(blob)), Mode: 0644, Size: fi.Size()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportImages adds the images of the OCI image layout src, and the blobs
+// they refer to, to the cache dir, replacing the images of the same names,
+// and returns their names
+func ImportImages(dir, src string) ([]string, error) {
+	sp, err := layout.FromPath(src)
+	if err != nil {
+		return nil, err
+	}
+	ii, err := sp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	p, err := Get(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	imported := map[string]bool{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imagespec.AnnotationRefName]
+		if name == "" {
+			continue
+		}
+		blobs := map[string]bool{}
+		imageBlobs(sp, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+		for blob := range blobs {
+			imported[blob] = true
+			if err := importBlob(blobPath(sp, blob), blobPath(p, blob)); err != nil {
+				return names, fmt.Errorf("unable to import the blob %s of %s: %v", blob, name, err)
+			}
+		}
+		if err := p.RemoveDescriptors(match.Name(name)); err != nil {
+			return names, err
+		}
+		if err := p.AppendDescriptor(desc); err != nil {
+			return names, err
+		}
+		markUsed(p, name)
+		names = append(names, name)
+	}
+	if err := linkBlobs(p, imported); err != nil {
+		return names, fmt.Errorf("unable to share the blobs of the cache %s with the store: %v", dir, err)
+	}
+	return names, nil
+}
+
+// importBlob copies the blob src to dst unless it is already there,
+// checking that its content matches its sha256 digest
+func importBlob(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		// the blobs of the other platforms of an index may not be exported
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if filepath.Base(filepath.Dir(dst)) == "sha256" && fmt.Sprintf("%x", h.Sum(nil)) != filepath.Base(dst) {
+		return fmt.Errorf("the content does not match its digest")
+	}
+	return os.Rename(tmp.Name(), dst)
+}
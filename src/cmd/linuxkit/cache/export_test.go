@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// untar extracts the tar archive r into dir
+func untar(t *testing.T, r io.Reader, dir string) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportImportImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := testLayer(t, "alpine")
+	src := filepath.Join(dir, "src")
+	testCache(t, src, base, "pkg/init:a", "pkg/runc:a", "pkg/other:a")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := ExportImages(tw, "images", src, []string{"pkg/init:a", "pkg/runc:a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportImages(tar.NewWriter(ioutil.Discard), "images", src, []string{"pkg/missing:a"}); err == nil {
+		t.Error("Expected exporting an image which is not in the cache to fail")
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	untar(t, &buf, bundle)
+	dst := filepath.Join(dir, "dst")
+	names, err := ImportImages(dst, filepath.Join(bundle, "images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("Expected 2 images to be imported, got %v", names)
+	}
+	for _, name := range []string{"pkg/init:a", "pkg/runc:a"} {
+		want, err := FindDescriptor(src, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FindDescriptor(dst, name)
+		if err != nil {
+			t.Fatalf("Expected %s to be imported: %v", name, err)
+		}
+		if got.Digest != want.Digest {
+			t.Errorf("Expected %s to be %s, got %s", name, want.Digest, got.Digest)
+		}
+		if _, err := FindImage(dst, name, ""); err != nil {
+			t.Errorf("Expected the blobs of %s to be imported: %v", name, err)
+		}
+	}
+	if _, err := FindDescriptor(dst, "pkg/other:a"); err == nil {
+		t.Error("Expected the images which were not exported not to be imported")
+	}
+
+	// a blob whose content does not match its digest is not imported
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "images", "blobs", digest.Algorithm, digest.Hex), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportImages(filepath.Join(dir, "corrupt"), filepath.Join(bundle, "images")); err == nil {
+		t.Error("Expected a corrupt blob not to be imported")
+	}
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrors are the mirrors of each registry, by the name of the registry
+// images are pulled from, e.g. index.docker.io
+var mirrors map[string][]string
+
+// SetMirrors sets the mirrors images are pulled from before their registry,
+// by registry such as docker.io. A mirror is a registry with an optional
+// path the repositories are under, such as the harbor.example.com/dockerhub
+// proxy project of Harbor.
+func SetMirrors(m map[string][]string) error {
+	mirrors = map[string][]string{}
+	for registry, ms := range m {
+		r, err := name.NewRegistry(registry)
+		if err != nil {
+			return fmt.Errorf("invalid registry %q: %v", registry, err)
+		}
+		for _, mirror := range ms {
+			mirror = strings.TrimSuffix(mirror, "/")
+			domain := strings.SplitN(mirror, "/", 2)[0]
+			if _, err := name.NewRepository(mirror + "/image"); err != nil || !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+				return fmt.Errorf("invalid mirror %q of %s, must be a registry with an optional path", mirror, registry)
+			}
+			mirrors[r.RegistryStr()] = append(mirrors[r.RegistryStr()], mirror)
+		}
+	}
+	return nil
+}
+
+// Mirrors returns the mirrors of each registry, by the name of the registry
+// images are pulled from, e.g. index.docker.io
+func Mirrors() map[string][]string {
+	return mirrors
+}
+
+// MirrorReferences returns the references of image on the mirrors of its
+// registry, in the order they are tried
+func MirrorReferences(image string) []string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil
+	}
+	var refs []string
+	for _, mirror := range mirrors[ref.Context().RegistryStr()] {
+		r := mirror + "/" + ref.Context().RepositoryStr()
+		if d, ok := ref.(name.Digest); ok {
+			r += "@" + d.DigestStr()
+		} else {
+			r += ":" + ref.Identifier()
+		}
+		refs = append(refs, r)
+	}
+	return refs
+}
+
+// remoteGet gets the descriptor of image from the first of the mirrors of
+// its registry which has it, or else from its registry
+func remoteGet(image string, options ...remote.Option) (*remote.Descriptor, error) {
+	for _, m := range MirrorReferences(image) {
+		ref, err := name.ParseReference(m)
+		if err != nil {
+			continue
+		}
+		desc, err := remote.Get(ref, options...)
+		if err == nil {
+			log.Debugf("Pulling %s from the mirror %s", image, m)
+			return desc, nil
+		}
+		log.Debugf("Unable to get %s from the mirror %s: %v", image, m, err)
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s: %v", image, err)
+	}
+	return remote.Get(ref, options...)
+}
+
+// RemoteDigest returns the digest of the index or manifest the image resolves
+// to, as it is pulled from the mirrors of its registry or the registry
+func RemoteDigest(image string) (string, error) {
+	desc, err := remoteGet(image, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMirrorReferences(t *testing.T) {
+	defer func() { mirrors = nil }()
+	if err := SetMirrors(map[string][]string{
+		"docker.io": {"harbor.example.com/dockerhub/", "localhost:5000"},
+		"ghcr.io":   {"harbor.example.com/ghcr"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for image, refs := range map[string][]string{
+		"alpine:3.13": {
+			"harbor.example.com/dockerhub/library/alpine:3.13",
+			"localhost:5000/library/alpine:3.13",
+		},
+		"docker.io/linuxkit/init:v0.8": {
+			"harbor.example.com/dockerhub/linuxkit/init:v0.8",
+			"localhost:5000/linuxkit/init:v0.8",
+		},
+		"ghcr.io/acme/init@sha256:0000000000000000000000000000000000000000000000000000000000000000": {
+			"harbor.example.com/ghcr/acme/init@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+		"quay.io/acme/init:v1": nil,
+	} {
+		if r := MirrorReferences(image); !reflect.DeepEqual(r, refs) {
+			t.Errorf("Expected the mirror references of %s to be %v, got %v", image, refs, r)
+		}
+	}
+}
+
+func TestSetMirrorsInvalid(t *testing.T) {
+	defer func() { mirrors = nil }()
+	for _, m := range []map[string][]string{
+		{"docker.io": {"dockerhub"}},
+		{"docker.io": {"harbor.example.com/Docker Hub"}},
+		{"not a registry": {"harbor.example.com"}},
+	} {
+		if err := SetMirrors(m); err == nil {
+			t.Errorf("Expected the mirrors %v to be invalid", m)
+		}
+	}
+}
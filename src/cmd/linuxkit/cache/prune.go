@@ -0,0 +1,282 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneGrace is how long blobs which no image refers to are kept, as they
+// may be those of an image which is being pulled
+const pruneGrace = time.Hour
+
+// PrunePolicy is the policy of the images which are removed from a cache.
+// The policies which are zero are not applied.
+type PrunePolicy struct {
+	// MaxSize is the size of the cache in bytes above which the least
+	// recently used images are removed
+	MaxSize int64
+	// MaxAge is the time after which images which were not used are removed
+	MaxAge time.Duration
+	// KeepLast is the number of the most recently used tags of each image
+	// which are kept, e.g. of linuxkit/init
+	KeepLast int
+}
+
+// Enabled reports whether the policy removes any image
+func (p PrunePolicy) Enabled() bool {
+	return p.MaxSize > 0 || p.MaxAge > 0 || p.KeepLast > 0
+}
+
+// PruneResult is what a prune removed, or would remove
+type PruneResult struct {
+	// Images are the names of the images which were removed
+	Images []string
+	// Blobs is the number of blobs which were removed and Size their size
+	Blobs int
+	Size  int64
+}
+
+// cachedImage is an image of a cache, with the blobs it refers to
+type cachedImage struct {
+	name  string
+	repo  string
+	used  time.Time
+	blobs map[string]bool
+}
+
+// lastUsedAnnotation is the annotation of the descriptors of the index of
+// a cache which records when their image was last used. The blobs are not
+// touched instead, as they may be shared with other caches by the store.
+const lastUsedAnnotation = "org.mobyproject.linuxkit.last-used"
+
+// markUsed records that the image name of the cache p was used, in the
+// annotations of its descriptor in the index of the cache
+func markUsed(p layout.Path, name string) {
+	if err := setLastUsed(p, name, time.Now()); err != nil {
+		log.Debugf("Unable to record that %s was used: %v", name, err)
+	}
+}
+
+func setLastUsed(p layout.Path, name string, t time.Time) error {
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, desc := range index.Manifests {
+		if desc.Annotations[imagespec.AnnotationRefName] != name {
+			continue
+		}
+		annotations := map[string]string{}
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+		annotations[lastUsedAnnotation] = t.UTC().Format(time.RFC3339)
+		index.Manifests[i].Annotations = annotations
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no descriptor found for %s", name)
+	}
+	b, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return err
+	}
+	// the index is replaced at once, as other builds may be reading it
+	tmp, err := ioutil.TempFile(string(p), "index.json.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(p), "index.json"))
+}
+
+// lastUsed returns when the image of desc in the cache p was last used.
+// The images of caches which did not record it yet were last used when
+// their root blob was written.
+func lastUsed(p layout.Path, desc v1.Descriptor) time.Time {
+	if t, err := time.Parse(time.RFC3339, desc.Annotations[lastUsedAnnotation]); err == nil {
+		return t
+	}
+	if fi, err := os.Stat(blobPath(p, desc.Digest.Algorithm, desc.Digest.Hex)); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// imageRepo returns the repository of an image name, without its tag or
+// digest
+func imageRepo(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+func cachedImages(p layout.Path) ([]*cachedImage, error) {
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var images []*cachedImage
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imagespec.AnnotationRefName]
+		if name == "" {
+			continue
+		}
+		img := &cachedImage{name: name, repo: imageRepo(name), used: lastUsed(p, desc), blobs: map[string]bool{}}
+		imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, img.blobs)
+		images = append(images, img)
+	}
+	// the most recently used first
+	sort.SliceStable(images, func(i, j int) bool { return images[i].used.After(images[j].used) })
+	return images, nil
+}
+
+// Prune removes the images of the cache p which the policy selects, and
+// the blobs which no image refers to any more. With dryRun it only returns
+// what it would remove.
+func Prune(p layout.Path, policy PrunePolicy, dryRun bool) (PruneResult, error) {
+	var result PruneResult
+	images, err := cachedImages(p)
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	remove := map[string]bool{}
+	kept := map[string]int{}
+	for _, img := range images {
+		switch {
+		case policy.MaxAge > 0 && now.Sub(img.used) > policy.MaxAge:
+			remove[img.name] = true
+		case policy.KeepLast > 0 && kept[img.repo] >= policy.KeepLast:
+			remove[img.name] = true
+		default:
+			kept[img.repo]++
+		}
+	}
+	sizes := map[string]int64{}
+	for _, img := range images {
+		for blob := range img.blobs {
+			if fi, err := os.Stat(blobPath(p, blob)); err == nil {
+				sizes[blob] = fi.Size()
+			}
+		}
+	}
+	if policy.MaxSize > 0 {
+		// the least recently used images are removed until the blobs of
+		// the others fit
+		for i := len(images) - 1; i >= 0 && referencedSize(images, remove, sizes) > policy.MaxSize; i-- {
+			remove[images[i].name] = true
+		}
+	}
+
+	referenced := map[string]bool{}
+	for _, img := range images {
+		if remove[img.name] {
+			result.Images = append(result.Images, img.name)
+			continue
+		}
+		for blob := range img.blobs {
+			referenced[blob] = true
+		}
+	}
+	sort.Strings(result.Images)
+	if !dryRun {
+		for _, name := range result.Images {
+			if err := p.RemoveDescriptors(match.Name(name)); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	algorithms, err := ioutil.ReadDir(blobPath(p))
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	for _, a := range algorithms {
+		if !a.IsDir() {
+			continue
+		}
+		blobs, err := ioutil.ReadDir(blobPath(p, a.Name()))
+		if err != nil {
+			return result, err
+		}
+		for _, b := range blobs {
+			blob := filepath.Join(a.Name(), b.Name())
+			if referenced[blob] || !b.Mode().IsRegular() {
+				continue
+			}
+			// recent blobs which no image refers to may be those of an
+			// image which is being pulled
+			if _, ok := sizes[blob]; !ok && now.Sub(b.ModTime()) < pruneGrace {
+				continue
+			}
+			result.Blobs++
+			result.Size += b.Size()
+			if dryRun {
+				continue
+			}
+			if err := os.Remove(blobPath(p, a.Name(), b.Name())); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// referencedSize is the size of the blobs of the images which are not
+// removed
+func referencedSize(images []*cachedImage, remove map[string]bool, sizes map[string]int64) int64 {
+	blobs := map[string]bool{}
+	var size int64
+	for _, img := range images {
+		if remove[img.name] {
+			continue
+		}
+		for blob := range img.blobs {
+			if !blobs[blob] {
+				blobs[blob] = true
+				size += sizes[blob]
+			}
+		}
+	}
+	return size
+}
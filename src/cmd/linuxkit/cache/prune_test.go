@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+func TestImageRepo(t *testing.T) {
+	for name, repo := range map[string]string{
+		"linuxkit/init:v0.8":              "linuxkit/init",
+		"docker.io/linuxkit/init:v0.8":    "docker.io/linuxkit/init",
+		"localhost:5000/init":             "localhost:5000/init",
+		"localhost:5000/init:v1@sha256:1": "localhost:5000/init",
+	} {
+		if r := imageRepo(name); r != repo {
+			t.Errorf("Expected the repository of %s to be %s, got %s", name, repo, r)
+		}
+	}
+}
+
+// usedAgo sets when the images of the cache were last used
+func usedAgo(t *testing.T, p layout.Path, ages map[string]time.Duration) {
+	for name, age := range ages {
+		if err := setLastUsed(p, name, time.Now().Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMarkUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := testCache(t, dir, testLayer(t, "alpine"), "pkg/init:a")
+	desc, err := FindDescriptor(dir, "pkg/init:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blobs may be shared with other caches, so they are not touched
+	blob := blobPath(p, desc.Digest.Algorithm, desc.Digest.Hex)
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(blob, old, old); err != nil {
+		t.Fatal(err)
+	}
+	markUsed(p, "pkg/init:a")
+	if fi, err := os.Stat(blob); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("Expected the blob not to be touched, got %v", fi.ModTime())
+	}
+	desc, err = FindDescriptor(dir, "pkg/init:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := lastUsed(p, *desc); time.Since(used) > time.Minute {
+		t.Errorf("Expected the image to be used now, got %v", used)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := testLayer(t, "alpine")
+	names := []string{"pkg/init:a", "pkg/init:b", "pkg/init:c", "pkg/runc:a"}
+	p := testCache(t, dir, base, names...)
+	usedAgo(t, p, map[string]time.Duration{
+		"pkg/init:a": 72 * time.Hour,
+		"pkg/init:b": 48 * time.Hour,
+		"pkg/init:c": time.Hour,
+		"pkg/runc:a": 2 * time.Hour,
+	})
+
+	result, err := Prune(p, PrunePolicy{KeepLast: 2}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Images, []string{"pkg/init:a"}) || result.Blobs == 0 {
+		t.Errorf("Expected the oldest tag of pkg/init to be removed, got %+v", result)
+	}
+	if images, _ := ListImages(p); len(images) != len(names) {
+		t.Errorf("Expected a dry run to remove nothing, got %v", images)
+	}
+
+	result, err = Prune(p, PrunePolicy{MaxAge: 24 * time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Images, []string{"pkg/init:a", "pkg/init:b"}) {
+		t.Errorf("Expected the images not used for a day to be removed, got %+v", result)
+	}
+	images, err := ListImages(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("Expected 2 images to be left, got %v", images)
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobPath(p, digest.Algorithm, digest.Hex)); err != nil {
+		t.Errorf("Expected the base layer of the images which are left to be kept: %v", err)
+	}
+
+	// the least recently used image is removed to fit
+	usage, err := DiskUsage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Prune(p, PrunePolicy{MaxSize: usage.Size - 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Images, []string{"pkg/runc:a"}) {
+		t.Errorf("Expected the least recently used image to be removed, got %+v", result)
+	}
+	if _, err := FindDescriptor(dir, "pkg/init:c"); err != nil {
+		t.Errorf("Expected the most recently used image to be kept: %v", err)
+	}
+}
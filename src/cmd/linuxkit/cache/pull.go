@@ -5,6 +5,7 @@ import (
 
 	"github.com/containerd/containerd/reference"
 	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/validate"
 )
 
@@ -41,6 +42,7 @@ func ValidateImage(ref *reference.Spec, cacheDir, architecture string) (ImageSou
 	case imageIndex != nil:
 		// we found a local index, just make sure it is up to date and, if not, download it
 		if err := validate.Index(imageIndex); err == nil {
+			markUsed(layout.Path(cacheDir), imageName)
 			return NewSource(
 				ref,
 				cacheDir,
@@ -51,6 +53,7 @@ func ValidateImage(ref *reference.Spec, cacheDir, architecture string) (ImageSou
 	case image != nil:
 		// we found a local image, just make sure it is up to date
 		if err := validate.Image(image); err == nil {
+			markUsed(layout.Path(cacheDir), imageName)
 			return NewSource(
 				ref,
 				cacheDir,
@@ -6,8 +6,11 @@ import (
 	"io"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -67,3 +70,17 @@ func (c ImageSource) TarReader() (io.ReadCloser, error) {
 
 	return mutate.Extract(image), nil
 }
+
+// Descriptor return the descriptor of the image root, i.e. the index or manifest
+// which the name resolved to in the cache.
+func (c ImageSource) Descriptor() *v1.Descriptor {
+	index, err := c.cache.ImageIndex()
+	if err != nil {
+		return nil
+	}
+	descs, err := partial.FindManifests(index, match.Name(c.ref.String()))
+	if err != nil || len(descs) < 1 {
+		return nil
+	}
+	return &descs[0]
+}
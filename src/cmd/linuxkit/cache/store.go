@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// store is the content addressed store shared by all the caches, to which
+// their blobs are hard linked, so that the layers which packages and builds
+// have in common, such as their alpine base, are only on disk once
+var store string
+
+// SetStore sets the directory of the store shared by the caches. The caches
+// do not share their blobs if it is empty.
+func SetStore(dir string) {
+	store = dir
+}
+
+// blobPath returns the path of a blob, or of the directory of the blobs,
+// in the cache p
+func blobPath(p layout.Path, elem ...string) string {
+	return filepath.Join(append([]string{string(p), "blobs"}, elem...)...)
+}
+
+// storeBlob returns the path of the blob of a cache in the store
+func storeBlob(algorithm, hex string) string {
+	return filepath.Join(store, algorithm, hex)
+}
+
+// linkBlobs hard links the blobs, as algorithm/hex, of the cache p with the
+// store. A blob which is already in the store replaces that of the cache,
+// and the others are added to the store once their content is checked
+// against their digest. The blobs which cannot be shared are left as they
+// are in the cache.
+func linkBlobs(p layout.Path, blobs map[string]bool) error {
+	if store == "" {
+		return nil
+	}
+	var failed []string
+	var first error
+	for blob := range blobs {
+		algorithm, hex := filepath.Split(blob)
+		algorithm = filepath.Clean(algorithm)
+		err := linkBlob(blobPath(p, blob), algorithm, hex)
+		if os.IsNotExist(err) {
+			// the blobs of the other platforms of an index may not be in the cache
+			continue
+		}
+		if errors.Is(err, syscall.EXDEV) {
+			// the store is on another filesystem, which only loses the sharing
+			log.Debugf("Unable to share the blobs of %s with the store %s: %v", p, store, err)
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Unable to share the blob %s with the store %s: %v", blob, store, err)
+			failed = append(failed, blob)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to share %d of %d blobs, %s: %v", len(failed), len(blobs), failed[0], first)
+	}
+	return nil
+}
+
+// linkBlob hard links the blob path, whose digest is algorithm:hex, with
+// the store
+func linkBlob(path, algorithm, hex string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	shared := storeBlob(algorithm, hex)
+	sfi, err := os.Stat(shared)
+	switch {
+	case os.IsNotExist(err):
+		if err := verifyBlob(path, algorithm, hex); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(shared), 0755); err != nil {
+			return err
+		}
+		return os.Link(path, shared)
+	case err != nil:
+		return err
+	case os.SameFile(fi, sfi):
+		return nil
+	}
+	if err := verifyBlob(shared, algorithm, hex); err != nil {
+		// the blobs are named after their digest, so this one is broken
+		if err := verifyBlob(path, algorithm, hex); err != nil {
+			return err
+		}
+		log.Warnf("Replacing the blob %s of the store: %v", shared, err)
+		if err := os.Remove(shared); err != nil {
+			return err
+		}
+		return os.Link(path, shared)
+	}
+	tmp := path + ".link"
+	if err := os.Link(shared, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifyBlob checks that the content of the blob path matches its digest
+// algorithm:hex
+func verifyBlob(path, algorithm, hex string) error {
+	if algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != hex {
+		return fmt.Errorf("the content of %s does not match its digest", path)
+	}
+	return nil
+}
+
+// PruneStore removes the blobs of the store which are in no cache any more
+// and returns their size
+func PruneStore() (int64, error) {
+	if store == "" {
+		return 0, nil
+	}
+	var pruned int64
+	err := filepath.Walk(store, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		if linkCount(fi) != 1 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		pruned += fi.Size()
+		return nil
+	})
+	return pruned, err
+}
+
+// Usage is the disk usage of a cache
+type Usage struct {
+	// Images are the sizes of the images, as if each was stored alone
+	Images map[string]int64
+	// Referenced is the total size of the images
+	Referenced int64
+	// Blobs is the number of different blobs of the images and Size their
+	// size, which is what the cache takes on disk
+	Blobs int
+	Size  int64
+	// Shared is the size of the blobs which are hard linked with another
+	// cache through the store, and do not take space for it
+	Shared int64
+}
+
+// Saved is the space saved as the images and the caches share their blobs
+func (u Usage) Saved() int64 {
+	return u.Referenced - u.Size + u.Shared
+}
+
+// DiskUsage returns the disk usage of the images of the cache p. The blobs
+// of the other platforms of an index are usually not in the cache, and
+// are not counted.
+func DiskUsage(p layout.Path) (Usage, error) {
+	usage := Usage{Images: map[string]int64{}}
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return usage, err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return usage, err
+	}
+	seen := map[string]bool{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imagespec.AnnotationRefName]
+		if name == "" {
+			continue
+		}
+		blobs := map[string]bool{}
+		imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+		for blob := range blobs {
+			fi, err := os.Stat(blobPath(p, blob))
+			if err != nil {
+				continue
+			}
+			usage.Images[name] += fi.Size()
+			usage.Referenced += fi.Size()
+			if seen[blob] {
+				continue
+			}
+			seen[blob] = true
+			usage.Blobs++
+			usage.Size += fi.Size()
+			// the cache, the store and another cache
+			if store != "" && linkCount(fi) > 2 {
+				usage.Shared += fi.Size()
+			}
+		}
+	}
+	return usage, nil
+}
+
+// imageBlobs adds the blob of a manifest or index and those it refers to
+// which are in the cache to blobs, as algorithm/hex
+func imageBlobs(p layout.Path, algorithm, hex string, blobs map[string]bool) {
+	blob := filepath.Join(algorithm, hex)
+	if blobs[blob] {
+		return
+	}
+	b, err := ioutil.ReadFile(blobPath(p, blob))
+	if err != nil {
+		return
+	}
+	blobs[blob] = true
+	type descriptor struct {
+		Digest string `json:"digest"`
+	}
+	var m struct {
+		Manifests []descriptor `json:"manifests"`
+		Config    descriptor   `json:"config"`
+		Layers    []descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	for _, d := range m.Manifests {
+		if a, h, ok := splitDigest(d.Digest); ok {
+			imageBlobs(p, a, h, blobs)
+		}
+	}
+	for _, d := range append(m.Layers, m.Config) {
+		if a, h, ok := splitDigest(d.Digest); ok {
+			blobs[filepath.Join(a, h)] = true
+		}
+	}
+}
+
+func splitDigest(digest string) (string, string, bool) {
+	i := strings.Index(digest, ":")
+	if i <= 0 || i == len(digest)-1 {
+		return "", "", false
+	}
+	return digest[:i], digest[i+1:], true
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func testLayer(t *testing.T, name string) v1.Layer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := bytes.Repeat([]byte(name), 1024)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// testCache writes a cache with an image for each name, which all have the
+// base layer
+func testCache(t *testing.T, dir string, base v1.Layer, names ...string) layout.Path {
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		img, err := mutate.AppendLayers(empty.Image, base, testLayer(t, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{imagespec.AnnotationRefName: name})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The hard links of the store are not counted on Windows")
+	}
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetStore(filepath.Join(dir, "store"))
+	defer SetStore("")
+
+	base := testLayer(t, "alpine")
+	a := testCache(t, filepath.Join(dir, "a"), base, "pkg/one", "pkg/two")
+	b := testCache(t, filepath.Join(dir, "b"), base, "pkg/three")
+
+	usage, err := DiskUsage(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Images) != 2 || usage.Saved() <= 0 || usage.Shared != 0 {
+		t.Errorf("Expected the images to share the base layer, got %+v", usage)
+	}
+
+	for p, names := range map[layout.Path][]string{a: {"pkg/one", "pkg/two"}, b: {"pkg/three"}} {
+		blobs := map[string]bool{}
+		for _, name := range names {
+			desc, err := FindDescriptor(string(p), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+		}
+		if err := linkBlobs(p, blobs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, err := os.Stat(blobPath(a, digest.Algorithm, digest.Hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(blobPath(b, digest.Algorithm, digest.Hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fa, fb) {
+		t.Error("Expected the base layer to be on disk once")
+	}
+	shared, err := DiskUsage(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared.Shared != fa.Size() || shared.Saved() != usage.Saved()+fa.Size() {
+		t.Errorf("Expected the base layer to be shared with the other cache, got %+v", shared)
+	}
+
+	// the blobs which were only in b are pruned
+	if err := os.RemoveAll(string(b)); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := PruneStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned == 0 {
+		t.Error("Expected the blobs of the removed cache to be pruned")
+	}
+	if _, err := os.Stat(storeBlob(digest.Algorithm, digest.Hex)); err != nil {
+		t.Errorf("Expected the base layer to be kept in the store: %v", err)
+	}
+}
+
+func TestLinkBlobsVerify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The hard links of the store are not counted on Windows")
+	}
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetStore(filepath.Join(dir, "store"))
+	defer SetStore("")
+
+	base := testLayer(t, "alpine")
+	p := testCache(t, filepath.Join(dir, "a"), base, "pkg/one")
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a blob whose content does not match its digest is not shared, but the
+	// others still are
+	broken := blobPath(p, digest.Algorithm, digest.Hex)
+	if err := ioutil.WriteFile(broken, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := FindDescriptor(string(p), "pkg/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := map[string]bool{}
+	imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+	if err := linkBlobs(p, blobs); err == nil {
+		t.Error("Expected an error for the broken blob")
+	}
+	if _, err := os.Stat(storeBlob(digest.Algorithm, digest.Hex)); !os.IsNotExist(err) {
+		t.Errorf("Expected the broken blob not to be in the store: %v", err)
+	}
+	if _, err := os.Stat(storeBlob(desc.Digest.Algorithm, desc.Digest.Hex)); err != nil {
+		t.Errorf("Expected the other blobs to be in the store: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+package cache
+
+import "os"
+
+// linkCount returns 0 as the hard links of a file are not known, so the
+// blobs of the store are not pruned
+func linkCount(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -1,16 +1,20 @@
 package cache
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/match"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
 )
 
 // ImageWrite takes an image name and pulls it down, writing it locally. It should be
@@ -26,40 +30,120 @@ func ImageWrite(dir string, ref *reference.Spec, trustedRef, architecture string
 	if trustedRef != "" {
 		pullImageName = trustedRef
 	}
-	remoteRef, err := name.ParseReference(pullImageName)
-	if err != nil {
+	if _, err := name.ParseReference(pullImageName); err != nil {
 		return ImageSource{}, fmt.Errorf("invalid image name %s: %v", pullImageName, err)
 	}
 
-	desc, err := remote.Get(remoteRef, remoteOptions...)
+	// the descriptor is fetched from the mirrors of the registry first
+	desc, err := remoteGet(pullImageName, remoteOptions...)
 	if err != nil {
 		return ImageSource{}, fmt.Errorf("error getting manifest for trusted image %s: %v", pullImageName, err)
 	}
 
+	// if the root we already have matches what the registry serves, there is
+	// nothing to download; the blobs are content addressed so they are complete.
+	if local, err := FindDescriptor(dir, image); err == nil {
+		if desc.Digest == local.Digest {
+			if _, err := ValidateImage(ref, dir, architecture); err == nil {
+				return NewSource(
+					ref,
+					dir,
+					architecture,
+				), nil
+			}
+		}
+	}
+
 	// use the original image name in the annotation
 	annotations := map[string]string{
 		imagespec.AnnotationRefName: image,
 	}
 
-	// first attempt as an index
-	ii, err := desc.ImageIndex()
-	if err == nil {
-		err = p.ReplaceIndex(ii, match.Name(image), layout.WithAnnotations(annotations))
-	} else {
-		var im v1.Image
+	write := func() error {
+		// first attempt as an index
+		ii, err := desc.ImageIndex()
+		if err == nil {
+			return p.ReplaceIndex(ii, match.Name(image), layout.WithAnnotations(annotations))
+		}
 		// try an image
-		im, err = desc.Image()
+		im, err := desc.Image()
 		if err != nil {
-			return ImageSource{}, fmt.Errorf("provided image is neither an image nor an index: %s", image)
+			return fmt.Errorf("provided image is neither an image nor an index: %s", image)
 		}
-		err = p.ReplaceImage(im, match.Name(image), layout.WithAnnotations(annotations))
+		return p.ReplaceImage(im, match.Name(image), layout.WithAnnotations(annotations))
 	}
-	if err != nil {
+	if err := write(); err != nil {
 		return ImageSource{}, fmt.Errorf("unable to save image to cache: %v", err)
 	}
+	// the blobs which are in the cache are not written again, so those an
+	// interrupted pull left partially written are replaced
+	if partial := partialBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, desc.Size); len(partial) > 0 {
+		log.Warnf("Downloading %d blobs of %s again which were partially written", len(partial), image)
+		for _, blob := range partial {
+			if err := os.Remove(blobPath(p, blob)); err != nil {
+				return ImageSource{}, fmt.Errorf("unable to remove partial blob: %v", err)
+			}
+		}
+		if err := write(); err != nil {
+			return ImageSource{}, fmt.Errorf("unable to save image to cache: %v", err)
+		}
+	}
+	markUsed(p, image)
+	// only the blobs of the image which was written are shared
+	blobs := map[string]bool{}
+	imageBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, blobs)
+	if err := linkBlobs(p, blobs); err != nil {
+		log.Warnf("Unable to share the blobs of the cache %s with the store: %v", dir, err)
+	}
 	return NewSource(
 		ref,
 		dir,
 		architecture,
 	), nil
 }
+
+// partialBlobs returns the blobs, as algorithm/hex, of the image or index
+// whose root is the blob algorithm/hex of size, which are in the cache p
+// but are not of the size they are given by their descriptor
+func partialBlobs(p layout.Path, algorithm, hex string, size int64) []string {
+	var partial []string
+	blob := filepath.Join(algorithm, hex)
+	fi, err := os.Stat(blobPath(p, blob))
+	if err != nil {
+		return nil
+	}
+	if fi.Size() != size {
+		return []string{blob}
+	}
+	b, err := ioutil.ReadFile(blobPath(p, blob))
+	if err != nil {
+		return nil
+	}
+	type descriptor struct {
+		Digest string `json:"digest"`
+		Size   int64  `json:"size"`
+	}
+	var m struct {
+		Manifests []descriptor `json:"manifests"`
+		Config    descriptor   `json:"config"`
+		Layers    []descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	for _, d := range m.Manifests {
+		if a, h, ok := splitDigest(d.Digest); ok {
+			partial = append(partial, partialBlobs(p, a, h, d.Size)...)
+		}
+	}
+	for _, d := range append(m.Layers, m.Config) {
+		a, h, ok := splitDigest(d.Digest)
+		if !ok {
+			continue
+		}
+		if fi, err := os.Stat(blobPath(p, a, h)); err == nil && fi.Size() != d.Size {
+			partial = append(partial, filepath.Join(a, h))
+		}
+	}
+	return partial
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPartialBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := testCache(t, dir, testLayer(t, "alpine"), "pkg/init")
+	desc, err := FindDescriptor(dir, "pkg/init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial := partialBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, desc.Size); len(partial) != 0 {
+		t.Errorf("Expected no partial blobs, got %v", partial)
+	}
+
+	// the layer of the image whose pull was interrupted
+	img, err := FindImage(dir, "pkg/init", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(blobPath(p, digest.Algorithm, digest.Hex), 10); err != nil {
+		t.Fatal(err)
+	}
+	partial := partialBlobs(p, desc.Digest.Algorithm, desc.Digest.Hex, desc.Size)
+	if !reflect.DeepEqual(partial, []string{filepath.Join(digest.Algorithm, digest.Hex)}) {
+		t.Errorf("Expected the truncated layer to be partial, got %v", partial)
+	}
+}
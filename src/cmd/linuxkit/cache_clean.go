@@ -1,14 +1,14 @@
 package main
 
 import (
-	"flag"
 	"os"
 
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	log "github.com/sirupsen/logrus"
 )
 
 func cacheClean(args []string) {
-	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	flags := newFlagSet("clean")
 
 	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
 
@@ -20,4 +20,12 @@ func cacheClean(args []string) {
 		log.Fatalf("Unable to clean cache %s: %v", *cacheDir, err)
 	}
 	log.Infof("Cache cleaned: %s", *cacheDir)
+	// the blobs of the store which were only in the cache
+	pruned, err := cachepkg.PruneStore()
+	if err != nil {
+		log.Fatalf("Unable to prune the store: %v", err)
+	}
+	if pruned > 0 {
+		log.Infof("Removed %s from the store", humanSize(pruned))
+	}
 }
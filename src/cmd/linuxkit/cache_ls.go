@@ -1,14 +1,12 @@
 package main
 
 import (
-	"flag"
-
 	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	log "github.com/sirupsen/logrus"
 )
 
 func cacheList(args []string) {
-	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags := newFlagSet("list")
 
 	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
 
@@ -29,4 +27,16 @@ func cacheList(args []string) {
 	for name, hash := range images {
 		log.Printf("%-80s %s", name, hash)
 	}
+
+	usage, err := cachepkg.DiskUsage(p)
+	if err != nil {
+		log.Fatalf("error reading the disk usage of the cache: %v", err)
+	}
+	log.Printf("%d images of %s, in %d blobs of %s", len(usage.Images), humanSize(usage.Referenced), usage.Blobs, humanSize(usage.Size))
+	if usage.Shared > 0 {
+		log.Printf("%s of the blobs are shared with other caches", humanSize(usage.Shared))
+	}
+	if usage.Referenced > 0 {
+		log.Printf("%s saved by deduplication (%.0f%%)", humanSize(usage.Saved()), 100*float64(usage.Saved())/float64(usage.Referenced))
+	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+func cachePrune(args []string) {
+	flags := newFlagSet("prune")
+
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	maxSize := flags.String("max-size", Config.CachePrune.MaxSize, "Remove the least recently used images until the cache is smaller than this size, in G or, with an M suffix, MB")
+	maxAge := flags.String("max-age", Config.CachePrune.MaxAge, "Remove the images which were not used for this long, e.g. 30d or 12h")
+	keepLast := flags.String("keep-last", Config.CachePrune.KeepLast, "Only keep this number of the most recently used tags of each image")
+	dryRun := flags.Bool("dry-run", false, "Show what would be removed without removing it")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	policy, err := cachePrunePolicy(CachePruneConfig{MaxSize: *maxSize, MaxAge: *maxAge, KeepLast: *keepLast})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !policy.Enabled() {
+		log.Fatal("Please give -max-size, -max-age or -keep-last, or set cache-prune in the config")
+	}
+	p, err := cachepkg.Get(*cacheDir)
+	if err != nil {
+		log.Fatalf("unable to read a local cache: %v", err)
+	}
+	result, err := cachepkg.Prune(p, policy, *dryRun)
+	if err != nil {
+		log.Fatalf("Unable to prune the cache %s: %v", *cacheDir, err)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	if len(result.Images) > 0 {
+		log.Infof("%s the images:", verb)
+		for _, name := range result.Images {
+			log.Infof("  %s", name)
+		}
+	}
+	log.Infof("%s %d images and %d blobs of %s from %s", verb, len(result.Images), result.Blobs, humanSize(result.Size), *cacheDir)
+	if *dryRun {
+		return
+	}
+	if _, err := cachepkg.PruneStore(); err != nil {
+		log.Warnf("Unable to prune the store: %v", err)
+	}
+}
+
+// pruneCache applies the cache-prune policy of the config to the cache, as
+// after builds
+func pruneCache(dir string) {
+	policy, err := cachePrunePolicy(Config.CachePrune)
+	if err != nil {
+		log.Warnf("Not pruning the cache, the cache-prune config is invalid: %v", err)
+		return
+	}
+	if !policy.Enabled() {
+		return
+	}
+	p, err := cachepkg.Get(dir)
+	if err != nil {
+		log.Warnf("Unable to prune the cache: %v", err)
+		return
+	}
+	result, err := cachepkg.Prune(p, policy, false)
+	if err != nil {
+		log.Warnf("Unable to prune the cache %s: %v", dir, err)
+		return
+	}
+	if _, err := cachepkg.PruneStore(); err != nil {
+		log.Warnf("Unable to prune the store: %v", err)
+	}
+	if len(result.Images) > 0 || result.Blobs > 0 {
+		log.Infof("Pruned %d images and %s from the cache", len(result.Images), humanSize(result.Size))
+	}
+}
+
+// cachePrunePolicy parses the policy of c
+func cachePrunePolicy(c CachePruneConfig) (cachepkg.PrunePolicy, error) {
+	var policy cachepkg.PrunePolicy
+	if c.MaxSize != "" {
+		mb, err := getDiskSizeMB(c.MaxSize)
+		if err != nil || mb <= 0 {
+			return policy, fmt.Errorf("invalid max-size %q", c.MaxSize)
+		}
+		policy.MaxSize = int64(mb) << 20
+	}
+	if c.MaxAge != "" {
+		age, err := parseAge(c.MaxAge)
+		if err != nil || age <= 0 {
+			return policy, fmt.Errorf("invalid max-age %q", c.MaxAge)
+		}
+		policy.MaxAge = age
+	}
+	if c.KeepLast != "" {
+		n, err := strconv.Atoi(c.KeepLast)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid keep-last %q", c.KeepLast)
+		}
+		policy.KeepLast = n
+	}
+	return policy, nil
+}
+
+// parseAge parses a duration, which may also be in days, e.g. 30d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// teardown deletes a cloud resource created by a run backend
+type teardown struct {
+	what string
+	f    func() error
+}
+
+// cleanups are the resources which are deleted if a run fails with
+// log.Fatal or is interrupted, so aborted runs do not leak billable
+// resources. Interrupts are only caught while there are any.
+var cleanups struct {
+	sync.Mutex
+	list    []*teardown
+	signals chan os.Signal
+}
+
+var registerCleanupExit sync.Once
+
+// onCleanup registers f to delete a resource if the run fails or is
+// interrupted. The returned function unregisters it again, once the
+// resource has been deleted or is meant to outlive the run.
+func onCleanup(what string, f func() error) func() {
+	registerCleanupExit.Do(func() { log.RegisterExitHandler(runCleanup) })
+	c := &teardown{what: what, f: f}
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	cleanups.list = append(cleanups.list, c)
+	if cleanups.signals == nil {
+		cleanups.signals = make(chan os.Signal, 1)
+		signal.Notify(cleanups.signals, os.Interrupt, syscall.SIGTERM)
+		go cleanupOnSignal(cleanups.signals)
+	}
+	return func() {
+		cleanups.Lock()
+		defer cleanups.Unlock()
+		for i := range cleanups.list {
+			if cleanups.list[i] == c {
+				cleanups.list = append(cleanups.list[:i], cleanups.list[i+1:]...)
+				break
+			}
+		}
+		if len(cleanups.list) == 0 {
+			stopCleanupSignals()
+		}
+	}
+}
+
+// keepResources unregisters all the cleanups, once the VM has been handed
+// over to the user
+func keepResources() {
+	cleanups.Lock()
+	defer cleanups.Unlock()
+	cleanups.list = nil
+	stopCleanupSignals()
+}
+
+// stopCleanupSignals restores the default handling of interrupts, so a
+// second interrupt while cleaning up exits immediately. cleanups must be
+// locked.
+func stopCleanupSignals() {
+	if cleanups.signals != nil {
+		signal.Stop(cleanups.signals)
+		close(cleanups.signals)
+		cleanups.signals = nil
+	}
+}
+
+func cleanupOnSignal(signals chan os.Signal) {
+	if _, ok := <-signals; !ok {
+		return
+	}
+	log.Warn("Interrupted, deleting the cloud resources which were created. Interrupt again to leave them")
+	runCleanup()
+	os.Exit(1)
+}
+
+// runCleanup deletes the registered resources, the most recently created
+// first
+func runCleanup() {
+	cleanups.Lock()
+	list := cleanups.list
+	cleanups.list = nil
+	stopCleanupSignals()
+	cleanups.Unlock()
+	for i := len(list) - 1; i >= 0; i-- {
+		log.Infof("Deleting %s", list[i].what)
+		if err := list[i].f(); err != nil {
+			log.Errorf("Unable to delete %s, it has to be deleted manually: %v", list[i].what, err)
+		}
+	}
+}
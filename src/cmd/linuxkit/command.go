@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// command is a command of the CLI, which either runs with its arguments or
+// dispatches to its subcommands. Commands which run parse their own flags,
+// with a flag set from newFlagSet.
+type command struct {
+	name string
+	// short is the description in the list of commands of the parent
+	short string
+	// args is the synopsis of the arguments in the usage of a command with
+	// subcommands, and long is printed after the list of subcommands
+	args string
+	long string
+
+	run         func(args []string)
+	subcommands []*command
+	// fallback returns the subcommand which runs with all the arguments
+	// if the first is not a subcommand, or nil if there is none
+	fallback func() *command
+	// hidden commands are not listed or completed
+	hidden bool
+	// flags adds the options of a command with subcommands, which are
+	// given before the subcommand, and before is called with the
+	// subcommand and its arguments after they are parsed
+	flags  func(flags *flag.FlagSet)
+	before func(sub *command, args []string)
+}
+
+// logFlag is a global flag which sets up logging as it is set
+type logFlag struct {
+	value bool
+}
+
+func (f *logFlag) String() string {
+	return strconv.FormatBool(f.value)
+}
+
+func (f *logFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *logFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	f.value = v
+	setupLogging()
+	return nil
+}
+
+// logFormat is the global flag which sets the format of the log
+type logFormat struct {
+	value string
+}
+
+func (f *logFormat) String() string {
+	return f.value
+}
+
+func (f *logFormat) Set(s string) error {
+	switch s {
+	case "text", "json":
+	default:
+		return fmt.Errorf("must be text or json")
+	}
+	f.value = s
+	setupLogging()
+	return nil
+}
+
+// The global flags, which are accepted before each command and by the flag
+// set of each command
+var (
+	quietFlag     = &logFlag{}
+	verboseFlag   = &logFlag{}
+	ciFlag        = &logFlag{}
+	logFormatFlag = &logFormat{value: "text"}
+)
+
+// setupLogging sets the level and the formatter of the log from the global
+// flags
+func setupLogging() {
+	if quietFlag.value && verboseFlag.value {
+		fmt.Printf("Can't set quiet and verbose flag at the same time\n")
+		os.Exit(1)
+	}
+	switch {
+	case quietFlag.value:
+		log.SetLevel(log.ErrorLevel)
+	case verboseFlag.value:
+		log.SetLevel(log.DebugLevel)
+	default:
+		log.SetLevel(log.InfoLevel)
+	}
+	switch {
+	case logFormatFlag.value == "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case ciFlag.value:
+		log.SetFormatter(new(ciFormatter))
+	case verboseFlag.value:
+		// Switch back to the standard formatter
+		log.SetFormatter(defaultLogFormatter)
+	default:
+		log.SetFormatter(new(infoFormatter))
+	}
+}
+
+// addGlobalFlags adds the global flags to flags
+func addGlobalFlags(flags *flag.FlagSet) {
+	flags.Var(quietFlag, "q", "Quiet execution")
+	flags.Var(quietFlag, "quiet", "Quiet execution, same as -q")
+	flags.Var(verboseFlag, "v", "Verbose execution")
+	flags.Var(verboseFlag, "verbose", "Verbose execution, same as -v")
+	flags.Var(logFormatFlag, "log-format", "Log `format`, text or json")
+	flags.Var(ciFlag, "ci", "Log for CI, with groups and annotations of errors in the format of GitHub Actions")
+}
+
+// globalArgs returns the arguments which set the global flags as they are
+// set, for commands which run linuxkit again
+func globalArgs() []string {
+	args := []string{"-log-format", logFormatFlag.value}
+	for _, f := range []struct {
+		name string
+		flag *logFlag
+	}{{"q", quietFlag}, {"v", verboseFlag}, {"ci", ciFlag}} {
+		if f.flag.value {
+			args = append(args, "-"+f.name)
+		}
+	}
+	return args
+}
+
+// newFlagSet returns the flag set of a command, with the global flags
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	addGlobalFlags(flags)
+	return flags
+}
+
+// flagSet returns the flag set of the options of a command with
+// subcommands, which are the global flags and its flags
+func (c *command) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	addGlobalFlags(flags)
+	if c.flags != nil {
+		c.flags(flags)
+	}
+	return flags
+}
+
+// parseFlags parses the options of a command with subcommands at the start
+// of args, and returns the arguments after them. Other flags are left to the
+// subcommands, which may take them.
+func (c *command) parseFlags(args []string) []string {
+	global := c.flagSet()
+	for len(args) > 0 {
+		if args[0] == "--" {
+			return args[1:]
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(args[0], "-"), "-")
+		if name == args[0] {
+			return args
+		}
+		value := "true"
+		hasValue := false
+		if kv := strings.SplitN(name, "=", 2); len(kv) == 2 {
+			name, value, hasValue = kv[0], kv[1], true
+		}
+		f := global.Lookup(name)
+		if f == nil {
+			return args
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) {
+			// the value is the next argument
+			if len(args) < 2 {
+				fmt.Printf("Flag -%s needs a value\n", name)
+				os.Exit(1)
+			}
+			value = args[1]
+			args = args[1:]
+		}
+		if err := global.Set(name, value); err != nil {
+			fmt.Printf("Invalid value %q for flag -%s: %v\n", value, name, err)
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+func (c *command) lookup(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// execute runs the command, which is invoked as path, with args
+func (c *command) execute(path string, args []string) {
+	if c.run != nil {
+		span := trace.Start(path)
+		c.run(args)
+		span.End()
+		return
+	}
+	args = c.parseFlags(args)
+	if len(args) == 0 {
+		fmt.Printf("Please specify a command.\n\n")
+		c.usage(path)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "help":
+		c.help(path, args[1:])
+	case "-h", "-help", "--help":
+		c.usage(path)
+		os.Exit(0)
+	}
+	if sub := c.lookup(args[0]); sub != nil {
+		c.dispatch(path, sub, args[1:])
+		return
+	}
+	if c.fallback != nil {
+		if sub := c.fallback(); sub != nil {
+			c.dispatch(path, sub, args)
+			return
+		}
+	}
+	fmt.Printf("%q is not a valid %s command.\n\n", args[0], path)
+	c.usage(path)
+	os.Exit(1)
+}
+
+func (c *command) dispatch(path string, sub *command, args []string) {
+	if c.before != nil {
+		c.before(sub, args)
+	}
+	sub.execute(path+" "+sub.name, args)
+}
+
+// help prints the help of the subcommand of c given by names, or the usage
+// of c if there are none, and exits
+func (c *command) help(path string, names []string) {
+	for _, name := range names {
+		sub := c.lookup(name)
+		if sub == nil || sub.hidden {
+			fmt.Printf("%q is not a valid %s command.\n\n", name, path)
+			c.usage(path)
+			os.Exit(1)
+		}
+		c, path = sub, path+" "+sub.name
+		if c.run != nil {
+			// commands which run print their help as they parse -h, and
+			// the arguments after them are not commands
+			c.run([]string{"-h"})
+			os.Exit(0)
+		}
+	}
+	c.usage(path)
+	os.Exit(0)
+}
+
+// usage prints the usage of a command with subcommands
+func (c *command) usage(path string) {
+	fmt.Printf("USAGE: %s %s\n\n", path, c.args)
+	fmt.Printf("Commands:\n")
+	var def string
+	if c.fallback != nil {
+		if sub := c.fallback(); sub != nil {
+			def = sub.name
+		}
+	}
+	width := 10
+	for _, sub := range c.subcommands {
+		if len(sub.name) > width {
+			width = len(sub.name)
+		}
+	}
+	for _, sub := range c.visible() {
+		short := sub.short
+		if sub.name == def {
+			short += " (default)"
+		}
+		fmt.Printf("  %-*s  %s\n", width, sub.name, short)
+	}
+	fmt.Printf("\n")
+	if c.long != "" {
+		fmt.Printf("%s\n\n", strings.TrimSpace(c.long))
+	}
+	fmt.Printf("Run '%s COMMAND --help' for more information on the command\n\n", path)
+	fmt.Printf("Options:\n")
+	global := c.flagSet()
+	global.SetOutput(os.Stdout)
+	global.PrintDefaults()
+}
+
+// visible returns the subcommands which are listed, in order of their names
+func (c *command) visible() []*command {
+	var subs []*command
+	for _, sub := range c.subcommands {
+		if !sub.hidden {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].name < subs[j].name })
+	return subs
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completeCommand is the hidden command the completion scripts run with the
+// words of the command line to complete, the last of which is completed
+const completeCommand = "__complete"
+
+const bashCompletion = `# bash completion for %[1]s
+
+_%[2]s_complete() {
+	local IFS=$'\n'
+	COMPREPLY=($(%[1]s %[3]s "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+
+complete -o default -F _%[2]s_complete %[1]s
+`
+
+const zshCompletion = `#compdef %[1]s
+
+# zsh completion for %[1]s
+
+_%[2]s_complete() {
+	local -a completions
+	completions=(${(f)"$(%[1]s %[3]s "${(@)words[2,$CURRENT]}" 2>/dev/null)"})
+	if (( ${#completions} )); then
+		compadd -a completions
+	else
+		_files
+	fi
+}
+
+compdef _%[2]s_complete %[1]s
+`
+
+const fishCompletion = `# fish completion for %[1]s
+
+function __%[2]s_complete
+	%[1]s %[3]s (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null
+end
+
+complete -c %[1]s -a '(__%[2]s_complete)'
+`
+
+// flagDefault matches a line of the defaults of a flag set printed by a
+// command, with the name of the flag and its type if it takes a value
+var flagDefault = regexp.MustCompile(`^  -(\S+)( \S+)?(\t|$)`)
+
+func completionUsage() {
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf("USAGE: %s completion bash|zsh|fish\n\n", invoked)
+	fmt.Printf("Print the completion script of a shell, for example with:\n\n")
+	fmt.Printf("  %s completion bash > /etc/bash_completion.d/%s\n", invoked, invoked)
+	fmt.Printf("  %s completion zsh > \"${fpath[1]}/_%s\"\n", invoked, invoked)
+	fmt.Printf("  %s completion fish > ~/.config/fish/completions/%s.fish\n\n", invoked, invoked)
+	fmt.Printf("Options:\n")
+	flags := newFlagSet("completion")
+	flags.SetOutput(os.Stdout)
+	flags.PrintDefaults()
+}
+
+func completion(args []string) {
+	flags := newFlagSet("completion")
+	flags.Usage = completionUsage
+	if err := flags.Parse(args); err != nil {
+		fmt.Println("Unable to parse args")
+		os.Exit(1)
+	}
+	if len(flags.Args()) != 1 {
+		fmt.Println("Please specify the shell")
+		completionUsage()
+		os.Exit(1)
+	}
+	var script string
+	switch flags.Arg(0) {
+	case "bash":
+		script = bashCompletion
+	case "zsh":
+		script = zshCompletion
+	case "fish":
+		script = fishCompletion
+	default:
+		fmt.Printf("Unknown shell %s, must be bash, zsh or fish\n", flags.Arg(0))
+		os.Exit(1)
+	}
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf(script, invoked, strings.NewReplacer("-", "_", ".", "_").Replace(invoked), completeCommand)
+}
+
+// complete prints the completions of the last of args, one per line. Nothing
+// is printed if the shell should complete file names.
+func complete(args []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	words, current := args[:len(args)-1], args[len(args)-1]
+	c := commands()
+	path := []string{}
+	for len(words) > 0 && c.run == nil {
+		words = c.parseFlags(words)
+		if len(words) == 0 {
+			break
+		}
+		sub := c.lookup(words[0])
+		if sub != nil {
+			words = words[1:]
+		} else if c.fallback != nil {
+			sub = c.fallback()
+		}
+		if sub == nil {
+			return
+		}
+		c, path = sub, append(path, sub.name)
+	}
+
+	var completions []string
+	if c.run == nil {
+		if strings.HasPrefix(current, "-") {
+			completions = matchFlags(c.flagNames(), current)
+		} else {
+			for _, sub := range c.visible() {
+				if strings.HasPrefix(sub.name, current) {
+					completions = append(completions, sub.name)
+				}
+			}
+		}
+		if c.fallback != nil {
+			if sub := c.fallback(); sub != nil && (strings.HasPrefix(current, "-") || len(completions) == 0) {
+				completions = append(completions, completeLeaf(append(path, sub.name), nil, current)...)
+			}
+		}
+	} else {
+		completions = completeLeaf(path, words, current)
+	}
+	printed := map[string]bool{}
+	for _, completion := range completions {
+		if !printed[completion] {
+			printed[completion] = true
+			fmt.Println(completion)
+		}
+	}
+}
+
+// completeLeaf returns the completions of a command which runs, which are its
+// flags, or nothing for arguments and the values of flags
+func completeLeaf(path []string, words []string, current string) []string {
+	if len(path) == 0 {
+		return nil
+	}
+	flags := commandFlags(path)
+	if len(words) > 0 {
+		last := strings.TrimLeft(words[len(words)-1], "-")
+		if value, ok := flags[last]; ok && value && !strings.Contains(words[len(words)-1], "=") {
+			return nil
+		}
+	}
+	if !strings.HasPrefix(current, "-") {
+		return nil
+	}
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	return matchFlags(names, current)
+}
+
+// commandFlags returns the flags of the command given by path, and whether
+// each takes a value, from its help
+func commandFlags(path []string) map[string]bool {
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, self, append(path, "-h")...).CombinedOutput()
+	flags := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if m := flagDefault.FindStringSubmatch(scanner.Text()); m != nil {
+			flags[m[1]] = m[2] != ""
+		}
+	}
+	return flags
+}
+
+// flagNames returns the names of the options of a command with subcommands
+func (c *command) flagNames() []string {
+	flags := c.flagSet()
+	var names []string
+	flags.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	return names
+}
+
+// matchFlags returns the names which complete current as flags, with the
+// number of dashes of current
+func matchFlags(names []string, current string) []string {
+	dashes := "-"
+	if strings.HasPrefix(current, "--") {
+		dashes = "--"
+	}
+	prefix := strings.TrimPrefix(current, dashes)
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, dashes+name)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"gopkg.in/yaml.v2"
+)
+
+// GlobalConfig is the global tool configuration
+type GlobalConfig struct {
+	// Org is the hub org of packages whose build.yml does not set one
+	Org string `yaml:"org"`
+	// Registry is prefixed to the references of images and artifacts
+	// without a registry, e.g. ghcr.io/acme
+	Registry string `yaml:"registry"`
+	// LogFormat is the format of the log, text or json
+	LogFormat string `yaml:"log-format"`
+	// Cache is the directory of the linuxkit cache
+	Cache string `yaml:"cache"`
+	// Store is the directory of the blobs shared by the caches, instead of
+	// ~/.linuxkit/store, or none
+	Store string `yaml:"store"`
+	// CachePrune is the policy of the images removed from the cache after
+	// builds and by `cache prune`
+	CachePrune CachePruneConfig `yaml:"cache-prune"`
+	// Builders are the Docker hosts, e.g. arm64: ssh://builder-arm64, or
+	// the buildx builders packages are built on for each architecture
+	Builders map[string]string `yaml:"builders"`
+	// Mirrors are the registries images are pulled from before their
+	// registry, e.g. docker.io: [harbor.example.com/dockerhub]
+	Mirrors map[string][]string `yaml:"mirrors"`
+
+	Run  RunConfig  `yaml:"run"`
+	Sign SignConfig `yaml:"sign"`
+	Pkg  PkgConfig  `yaml:"pkg"`
+	// Formats are the output formats provided by plugins, by name
+	Formats map[string]moby.FormatPlugin `yaml:"formats"`
+}
+
+// RunConfig is the config specific to the `run` subcommand
+type RunConfig struct {
+	// Backend is run when no backend is given
+	Backend string `yaml:"backend"`
+}
+
+// SignConfig is the config specific to the `sign` and `verify` subcommands
+type SignConfig struct {
+	Method string `yaml:"method"`
+	// Key is the key to sign with, and VerifyKey the key or keyring to
+	// verify with
+	Key       string `yaml:"key"`
+	VerifyKey string `yaml:"verify-key"`
+	// CertificateIdentity and CertificateOIDCIssuer are the expected
+	// certificate of keyless cosign signatures
+	CertificateIdentity   string `yaml:"certificate-identity"`
+	CertificateOIDCIssuer string `yaml:"certificate-oidc-issuer"`
+}
+
+// CachePruneConfig is the config of the images removed from the cache, by
+// size such as 20G, by age such as 30d and by the number of tags of each
+// image which are kept
+type CachePruneConfig struct {
+	MaxSize  string `yaml:"max-size"`
+	MaxAge   string `yaml:"max-age"`
+	KeepLast string `yaml:"keep-last"`
+}
+
+// PkgConfig is the config specific to the `pkg` subcommand
+type PkgConfig struct {
+	// ContentTrustCommand is passed to `sh -c` and the stdout
+	// (including whitespace and \n) is set as the content trust
+	// passphrase. Can be used to execute a password manager.
+	ContentTrustCommand string `yaml:"content-trust-passphrase-command"`
+	// SignMethod signs pushed packages with notary, or with signatures
+	// attached with the OCI referrers API by cosign or notation, with
+	// SignKey, and VerifyKey verifies them
+	SignMethod string `yaml:"sign-method"`
+	SignKey    string `yaml:"sign-key"`
+	VerifyKey  string `yaml:"verify-key"`
+}
+
+// configEnv are the environment variables which override the settings of
+// the config file
+var configEnv = []struct {
+	name    string
+	setting func(c *GlobalConfig) *string
+}{
+	{"LINUXKIT_ORG", func(c *GlobalConfig) *string { return &c.Org }},
+	{"LINUXKIT_REGISTRY", func(c *GlobalConfig) *string { return &c.Registry }},
+	{"LINUXKIT_LOG_FORMAT", func(c *GlobalConfig) *string { return &c.LogFormat }},
+	{"LINUXKIT_CACHE", func(c *GlobalConfig) *string { return &c.Cache }},
+	{"LINUXKIT_STORE", func(c *GlobalConfig) *string { return &c.Store }},
+	{"LINUXKIT_CACHE_MAX_SIZE", func(c *GlobalConfig) *string { return &c.CachePrune.MaxSize }},
+	{"LINUXKIT_CACHE_MAX_AGE", func(c *GlobalConfig) *string { return &c.CachePrune.MaxAge }},
+	{"LINUXKIT_CACHE_KEEP_LAST", func(c *GlobalConfig) *string { return &c.CachePrune.KeepLast }},
+	{"LINUXKIT_RUN_BACKEND", func(c *GlobalConfig) *string { return &c.Run.Backend }},
+	{"LINUXKIT_SIGN_METHOD", func(c *GlobalConfig) *string { return &c.Sign.Method }},
+	{"LINUXKIT_SIGN_KEY", func(c *GlobalConfig) *string { return &c.Sign.Key }},
+	{"LINUXKIT_VERIFY_KEY", func(c *GlobalConfig) *string { return &c.Sign.VerifyKey }},
+	{"LINUXKIT_CERTIFICATE_IDENTITY", func(c *GlobalConfig) *string { return &c.Sign.CertificateIdentity }},
+	{"LINUXKIT_CERTIFICATE_OIDC_ISSUER", func(c *GlobalConfig) *string { return &c.Sign.CertificateOIDCIssuer }},
+	{"LINUXKIT_CONTENT_TRUST_PASSPHRASE_COMMAND", func(c *GlobalConfig) *string { return &c.Pkg.ContentTrustCommand }},
+	{"LINUXKIT_PKG_SIGN_METHOD", func(c *GlobalConfig) *string { return &c.Pkg.SignMethod }},
+	{"LINUXKIT_PKG_SIGN_KEY", func(c *GlobalConfig) *string { return &c.Pkg.SignKey }},
+	{"LINUXKIT_PKG_VERIFY_KEY", func(c *GlobalConfig) *string { return &c.Pkg.VerifyKey }},
+}
+
+// builderEnv overrides the builders of the config file, as a comma
+// separated list of arch=host
+const builderEnv = "LINUXKIT_BUILDERS"
+
+// mirrorEnv overrides the mirrors of the config file, as a comma separated
+// list of registry=mirror, which may repeat a registry with several mirrors
+const mirrorEnv = "LINUXKIT_MIRRORS"
+
+// configPaths returns the paths of the config file, in order of preference.
+// The config file in ~/.moby is read if there is no other.
+func configPaths() []string {
+	if p, ok := os.LookupEnv("LINUXKIT_CONFIG"); ok {
+		return []string{p}
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = filepath.Join(util.HomeDir(), ".config")
+	}
+	return []string{
+		filepath.Join(configDir, "linuxkit", "config.yml"),
+		filepath.Join(util.HomeDir(), ".moby", "linuxkit", "config.yml"),
+	}
+}
+
+// saveConfigSetting sets a top level setting of the config file, keeping its
+// other settings, and removes it if value is empty. The config file is
+// created if there is none.
+func saveConfigSetting(key string, value interface{}) error {
+	paths := configPaths()
+	cfgPath := paths[0]
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			cfgPath = p
+			break
+		}
+	}
+	var settings yaml.MapSlice
+	cfgBytes, err := ioutil.ReadFile(cfgPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(cfgBytes, &settings); err != nil {
+		return fmt.Errorf("Failed to parse %q: %v", cfgPath, err)
+	}
+	empty := value == nil || reflect.ValueOf(value).Len() == 0
+	found := false
+	for i := 0; i < len(settings); i++ {
+		if settings[i].Key != key {
+			continue
+		}
+		found = true
+		if empty {
+			settings = append(settings[:i], settings[i+1:]...)
+			break
+		}
+		settings[i].Value = value
+	}
+	if !found && !empty {
+		settings = append(settings, yaml.MapItem{Key: key, Value: value})
+	}
+	cfgBytes, err = yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfgPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfgPath, cfgBytes, 0644)
+}
+
+func readConfig() {
+	for _, cfgPath := range configPaths() {
+		cfgBytes, err := ioutil.ReadFile(cfgPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			fmt.Printf("Failed to read %q\n", cfgPath)
+			os.Exit(1)
+		}
+		if err := yaml.Unmarshal(cfgBytes, &Config); err != nil {
+			fmt.Printf("Failed to parse %q: %v\n", cfgPath, err)
+			os.Exit(1)
+		}
+		break
+	}
+
+	for _, e := range configEnv {
+		if value, ok := os.LookupEnv(e.name); ok {
+			*e.setting(&Config) = value
+		}
+	}
+	if value, ok := os.LookupEnv(builderEnv); ok {
+		Config.Builders = map[string]string{}
+		for _, b := range strings.Split(value, ",") {
+			if b == "" {
+				continue
+			}
+			kv := strings.SplitN(b, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				fmt.Printf("Invalid builder %q in $%s, must be arch=host\n", b, builderEnv)
+				os.Exit(1)
+			}
+			Config.Builders[kv[0]] = kv[1]
+		}
+	}
+	if value, ok := os.LookupEnv(mirrorEnv); ok {
+		Config.Mirrors = map[string][]string{}
+		for _, m := range strings.Split(value, ",") {
+			if m == "" {
+				continue
+			}
+			kv := strings.SplitN(m, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				fmt.Printf("Invalid mirror %q in $%s, must be registry=mirror\n", m, mirrorEnv)
+				os.Exit(1)
+			}
+			Config.Mirrors[kv[0]] = append(Config.Mirrors[kv[0]], kv[1])
+		}
+	}
+
+	if Config.LogFormat != "" {
+		if err := logFormatFlag.Set(Config.LogFormat); err != nil {
+			fmt.Printf("Invalid log format %q in the config: %v\n", Config.LogFormat, err)
+			os.Exit(1)
+		}
+	}
+	if Config.Org != "" {
+		pkglib.DefaultOrg = Config.Org
+	}
+	cachepkg.SetStore(defaultLinuxkitStore())
+	if err := cachepkg.SetMirrors(Config.Mirrors); err != nil {
+		fmt.Printf("Invalid mirrors in the config: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := cachePrunePolicy(Config.CachePrune); err != nil {
+		fmt.Printf("Invalid cache-prune in the config: %v\n", err)
+		os.Exit(1)
+	}
+	if Config.Run.Backend != "" && runCommand().lookup(Config.Run.Backend) == nil {
+		fmt.Printf("Unknown run backend %q in the config\n", Config.Run.Backend)
+		os.Exit(1)
+	}
+	for name, p := range Config.Formats {
+		if err := moby.RegisterFormatPlugin(name, p); err != nil {
+			fmt.Printf("Invalid format %q in the config: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	for arch := range Config.Builders {
+		switch arch {
+		case "amd64", "arm64", "s390x", "riscv64":
+		default:
+			fmt.Printf("Unknown arch %q of a builder in the config\n", arch)
+			os.Exit(1)
+		}
+	}
+}
+
+// registryReference returns ref with the registry of the config if it has
+// no registry
+func registryReference(ref string) string {
+	if Config.Registry == "" {
+		return ref
+	}
+	i := strings.Index(ref, "/")
+	if i >= 0 {
+		domain := ref[:i]
+		if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			return ref
+		}
+	}
+	return strings.TrimSuffix(Config.Registry, "/") + "/" + ref
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// splitVMPath splits name:path into the VM and the path in it. It is only
+// a path in a VM if the VM has a state directory, so paths on the host with
+// a colon, like Windows paths with a drive letter, return an empty name.
+func splitVMPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i < 1 {
+		return "", arg
+	}
+	if fi, err := os.Stat(vmStateDir(arg[:i])); err != nil || !fi.IsDir() {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// cp copies a file into or out of a VM with the linuxkit/agent package
+func cp(args []string) {
+	flags := newFlagSet("cp")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s cp [options] name:path path\n", invoked)
+		fmt.Printf("       %s cp [options] path name:path\n\n", invoked)
+		fmt.Printf("Copy a file out of or into a VM with the linuxkit/agent package,\n")
+		fmt.Printf("without networking. 'name' is the state directory of the VM, or the\n")
+		fmt.Printf("name of the image it was started from if the default state directory\n")
+		fmt.Printf("was used. If the destination is a directory the file is copied into\n")
+		fmt.Printf("it. Only files can be copied, and their mode is kept.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	agent := agentConnectFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 2 {
+		fmt.Printf("Please specify the source and the destination\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	srcVM, src := splitVMPath(remArgs[0])
+	dstVM, dst := splitVMPath(remArgs[1])
+	if (srcVM == "") == (dstVM == "") {
+		log.Fatalf("Exactly one of the source and the destination must be name:path in a VM with a state directory")
+	}
+
+	var err error
+	if srcVM != "" {
+		err = copyFromVM(srcVM, src, dst, agent)
+	} else {
+		err = copyToVM(src, dstVM, dst, agent)
+	}
+	if err != nil {
+		log.Fatalf("Unable to copy %s to %s: %v", remArgs[0], remArgs[1], err)
+	}
+}
+
+func copyToVM(src, name, dst string, agent agentFlags) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file, only files can be copied", src)
+	}
+
+	conn, err := dialAgent(name, agent)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := agentRequest{Op: "put", Path: dst, Name: filepath.Base(src), Mode: uint32(fi.Mode().Perm())}
+	if err := conn.request(req); err != nil {
+		return err
+	}
+	if err := conn.sendInput(f); err != nil {
+		return err
+	}
+	_, err = conn.wait(func(byte, []byte) error { return nil })
+	return err
+}
+
+func copyFromVM(name, src, dst string, agent agentFlags) error {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	conn, err := dialAgent(name, agent)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.request(agentRequest{Op: "get", Path: src}); err != nil {
+		return err
+	}
+
+	// the file is created once its mode is known, before its contents
+	var f *os.File
+	_, err = conn.wait(func(kind byte, b []byte) error {
+		switch kind {
+		case agentFrameMode:
+			mode, err := strconv.ParseUint(string(b), 8, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid mode %q", b)
+			}
+			if f, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode)); err != nil {
+				return err
+			}
+			return f.Chmod(os.FileMode(mode))
+		case agentFrameStdout:
+			if f == nil {
+				return fmt.Errorf("The agent did not send the mode of %s", src)
+			}
+			_, err := f.Write(b)
+			return err
+		}
+		return nil
+	})
+	if f == nil {
+		return err
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands which can be run as daemon jobs
+var daemonCommands = map[string]bool{
+	"build": true,
+	"pkg":   true,
+	"push":  true,
+	"run":   true,
+}
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+
+	// how long a cancelled job has to exit before it is killed
+	daemonCancelTimeout = 10 * time.Second
+	// how often finished jobs are pruned
+	daemonPruneInterval = time.Minute
+)
+
+// daemonJobRequest is the body of a request to start a job
+type daemonJobRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Dir     string   `json:"dir,omitempty"`
+}
+
+// daemonLogLine is a line of output of a job, streamed as JSON
+type daemonLogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+type daemonJob struct {
+	ID       string     `json:"id"`
+	Command  string     `json:"command"`
+	Args     []string   `json:"args"`
+	Dir      string     `json:"dir,omitempty"`
+	State    string     `json:"state"`
+	ExitCode int        `json:"exitCode"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	mu        sync.Mutex
+	logs      []daemonLogLine
+	changed   chan struct{}
+	cmd       *exec.Cmd
+	cancelled bool
+	// events is the file of the metrics events of the job
+	events string
+}
+
+type daemonServer struct {
+	executable string
+	metrics    http.Handler
+	// token is the bearer token requests must have, if it is set
+	token string
+	// keep is how long finished jobs and their logs are kept
+	keep time.Duration
+	mu   sync.Mutex
+	jobs map[string]*daemonJob
+}
+
+func daemonUsage(flags *flag.FlagSet) {
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf("USAGE: %s daemon [options]\n\n", invoked)
+	fmt.Printf("Run a local server which runs 'build', 'pkg', 'push' and 'run' commands as jobs\n")
+	fmt.Printf("over an HTTP API, with streaming logs and cancellation.\n\n")
+	fmt.Printf("Endpoints:\n")
+	fmt.Printf("  POST   /v1/jobs             Start a job, the body is {\"command\": ..., \"args\": [...], \"dir\": ...}\n")
+	fmt.Printf("  GET    /v1/jobs             List jobs\n")
+	fmt.Printf("  GET    /v1/jobs/ID          Get the state of a job\n")
+	fmt.Printf("  GET    /v1/jobs/ID/logs     Get the output of a job as JSON lines, add ?follow=true to stream it\n")
+	fmt.Printf("  DELETE /v1/jobs/ID          Cancel a job\n")
+	fmt.Printf("  GET    /metrics             Prometheus metrics of the jobs\n")
+	fmt.Printf("\n")
+	fmt.Printf("Options:\n\n")
+	flags.PrintDefaults()
+}
+
+func defaultDaemonSocket() string {
+	return filepath.Join(util.HomeDir(), ".linuxkit", "daemon.sock")
+}
+
+func defaultDaemonTokenFile() string {
+	return filepath.Join(util.HomeDir(), ".linuxkit", "daemon.token")
+}
+
+// daemonToken reads the bearer token of the daemon from path, and generates
+// it if the file does not exist
+func daemonToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(r)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Infof("Generated the token of the daemon in %s", path)
+	return token, nil
+}
+
+// daemon runs the job server
+func daemon(args []string) {
+	flags := newFlagSet("daemon")
+	flags.Usage = func() { daemonUsage(flags) }
+	listenFlag := flags.String("listen", "unix://"+defaultDaemonSocket(), "Address to listen on, either unix://<path> or tcp://<host>:<port>")
+	metricsFlag := flags.String("metrics-listen", "", "Also serve the Prometheus metrics on <host>:<port>, for scraping a daemon listening on a unix socket")
+	tokenFileFlag := flags.String("token-file", defaultDaemonTokenFile(), "File with the bearer token requests must have when listening on tcp://, which is generated if it does not exist")
+	keepFlag := flags.Duration("keep", time.Hour, "How long finished jobs and their logs are kept")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Cannot find the linuxkit executable: %v", err)
+	}
+	s := &daemonServer{executable: executable, metrics: newMetricsHandler(daemonMetrics()...), keep: *keepFlag, jobs: map[string]*daemonJob{}}
+	// anyone who can reach a TCP port could run commands, so requests
+	// must have the token
+	if strings.HasPrefix(*listenFlag, "tcp://") {
+		if s.token, err = daemonToken(*tokenFileFlag); err != nil {
+			log.Fatalf("Cannot read the token of the daemon: %v", err)
+		}
+	}
+	l, err := daemonListen(*listenFlag)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %v", *listenFlag, err)
+	}
+	if *metricsFlag != "" {
+		serveMetrics(*metricsFlag, s.metrics)
+	}
+	go s.prune()
+	log.Infof("Listening on %s", *listenFlag)
+	log.Fatal(http.Serve(l, logRequest(s)))
+}
+
+func daemonListen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		// remove a stale socket from a previous daemon
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// only the user may drive the daemon
+		return listenUnix(path)
+	case strings.HasPrefix(addr, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	default:
+		return nil, fmt.Errorf("address must start with unix:// or tcp://")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// authorized returns whether the request has the token of the daemon
+func (s *daemonServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// prune removes the jobs which finished more than keep ago, with their logs
+func (s *daemonServer) prune() {
+	for range time.Tick(daemonPruneInterval) {
+		s.mu.Lock()
+		for id, j := range s.jobs {
+			j.mu.Lock()
+			expired := j.Finished != nil && time.Since(*j.Finished) > s.keep
+			j.mu.Unlock()
+			if expired {
+				log.Debugf("Pruning job %s", id)
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *daemonServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+		return
+	}
+	if r.URL.Path == "/metrics" {
+		s.metrics.ServeHTTP(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "jobs" {
+		writeError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+		return
+	}
+
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listJobs(w)
+		case http.MethodPost:
+			s.startJob(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	job, ok := s.jobs[parts[2]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "job %s not found", parts[2])
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		job.mu.Lock()
+		writeJSON(w, http.StatusOK, job)
+		job.mu.Unlock()
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		job.cancel()
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": job.ID})
+	case len(parts) == 4 && parts[3] == "logs" && r.Method == http.MethodGet:
+		job.streamLogs(w, r, r.URL.Query().Get("follow") == "true")
+	default:
+		writeError(w, http.StatusNotFound, "%s %s not found", r.Method, r.URL.Path)
+	}
+}
+
+func (s *daemonServer) listJobs(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]*daemonJob, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Started.Before(jobs[b].Started) })
+
+	for _, j := range jobs {
+		j.mu.Lock()
+	}
+	writeJSON(w, http.StatusOK, jobs)
+	for _, j := range jobs {
+		j.mu.Unlock()
+	}
+}
+
+func (s *daemonServer) startJob(w http.ResponseWriter, r *http.Request) {
+	var req daemonJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	if !daemonCommands[req.Command] {
+		writeError(w, http.StatusBadRequest, "command %q cannot be run by the daemon", req.Command)
+		return
+	}
+
+	job := &daemonJob{
+		ID:      uuid.New().String(),
+		Command: req.Command,
+		Args:    req.Args,
+		Dir:     req.Dir,
+		State:   jobRunning,
+		Started: time.Now(),
+		changed: make(chan struct{}),
+	}
+	// The job runs in a separate process, so that a fatal error only
+	// ends the job and not the daemon
+	job.cmd = exec.Command(s.executable, append([]string{req.Command}, req.Args...)...)
+	job.cmd.Dir = req.Dir
+	// the job records its pulls and uploads for the metrics of the daemon
+	events, err := ioutil.TempFile("", "linuxkit-job-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	events.Close()
+	job.events = events.Name()
+	job.cmd.Env = append(os.Environ(), metrics.EventsEnv+"="+job.events)
+	stdout, err := job.cmd.StdoutPipe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	stderr, err := job.cmd.StderrPipe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if err := job.cmd.Start(); err != nil {
+		os.Remove(job.events)
+		writeError(w, http.StatusInternalServerError, "cannot start job: %v", err)
+		return
+	}
+	log.Infof("Started job %s: %s %s", job.ID, req.Command, strings.Join(req.Args, " "))
+	jobsStarted.WithLabelValues(job.Command).Inc()
+	jobsRunning.WithLabelValues(job.Command).Inc()
+
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go job.collect(&wg, "stdout", stdout)
+	go job.collect(&wg, "stderr", stderr)
+	go func() {
+		wg.Wait()
+		err := job.cmd.Wait()
+		job.finish(err)
+	}()
+
+	job.mu.Lock()
+	writeJSON(w, http.StatusCreated, job)
+	job.mu.Unlock()
+}
+
+// notify wakes up everyone following the logs. It must be called with the lock held.
+func (j *daemonJob) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *daemonJob) collect(wg *sync.WaitGroup, stream string, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		j.mu.Lock()
+		j.logs = append(j.logs, daemonLogLine{Time: time.Now(), Stream: stream, Line: scanner.Text()})
+		j.notify()
+		j.mu.Unlock()
+	}
+}
+
+func (j *daemonJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.ExitCode = j.cmd.ProcessState.ExitCode()
+	switch {
+	case j.cancelled:
+		j.State = jobCancelled
+	case err != nil:
+		j.State = jobFailed
+	default:
+		j.State = jobSucceeded
+	}
+	log.Infof("Job %s %s", j.ID, j.State)
+	jobsRunning.WithLabelValues(j.Command).Dec()
+	jobsFinished.WithLabelValues(j.Command, j.State).Inc()
+	jobDuration.WithLabelValues(j.Command, j.State).Observe(now.Sub(j.Started).Seconds())
+	recordJobEvents(j.events)
+	os.Remove(j.events)
+	j.notify()
+}
+
+// cancel interrupts the job, so it can clean up, and kills it if it does not exit in time
+func (j *daemonJob) cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.State != jobRunning {
+		return
+	}
+	j.cancelled = true
+	if err := j.cmd.Process.Signal(os.Interrupt); err != nil {
+		// interrupts are not supported on Windows
+		j.cmd.Process.Kill()
+		return
+	}
+	done := j.changed
+	go func() {
+		timer := time.NewTimer(daemonCancelTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				j.cmd.Process.Kill()
+				return
+			case <-done:
+				j.mu.Lock()
+				running := j.State == jobRunning
+				done = j.changed
+				j.mu.Unlock()
+				if !running {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// streamLogs writes the output of the job as JSON lines. If follow is set new
+// output is streamed until the job finishes or the client goes away.
+func (j *daemonJob) streamLogs(w http.ResponseWriter, r *http.Request, follow bool) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for {
+		j.mu.Lock()
+		lines := j.logs[sent:]
+		running := j.State == jobRunning
+		changed := j.changed
+		j.mu.Unlock()
+
+		for _, l := range lines {
+			if err := enc.Encode(l); err != nil {
+				return
+			}
+		}
+		sent += len(lines)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !follow || !running {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "net"
+
+// listenUnix listens on a unix socket, which is only accessible by the user
+// as it is created in their profile
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// The changes of images and files between two builds
+const (
+	diffAdded   = "added"
+	diffRemoved = "removed"
+	diffChanged = "changed"
+)
+
+// diffReport is what 'linuxkit diff' reports about two builds
+type diffReport struct {
+	Old     string      `json:"old"`
+	New     string      `json:"new"`
+	Kernel  *diffValue  `json:"kernel,omitempty"`
+	Cmdline *diffValue  `json:"cmdline,omitempty"`
+	Images  []diffImage `json:"images"`
+	Files   []diffFile  `json:"files"`
+	// FilesCompared is false if either build has no manifest, so that its
+	// files are not known
+	FilesCompared bool       `json:"filesCompared"`
+	Sizes         []diffSize `json:"sizes"`
+}
+
+type diffValue struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type diffImage struct {
+	Key    string              `json:"key"`
+	Change string              `json:"change"`
+	Old    *moby.ManifestImage `json:"old,omitempty"`
+	New    *moby.ManifestImage `json:"new,omitempty"`
+}
+
+type diffFile struct {
+	Path   string             `json:"path"`
+	Change string             `json:"change"`
+	Old    *moby.ManifestFile `json:"old,omitempty"`
+	New    *moby.ManifestFile `json:"new,omitempty"`
+}
+
+// diffSize is the size in bytes of a part of both builds. The parts are
+// the output files, the kernel, the root filesystem outside of the
+// bundles, and each bundle.
+type diffSize struct {
+	Name  string `json:"name"`
+	Old   int64  `json:"old"`
+	New   int64  `json:"new"`
+	Delta int64  `json:"delta"`
+}
+
+// diffBuild is a build inspected for the diff
+type diffBuild struct {
+	report *inspectReport
+	sizes  map[string]int64
+}
+
+func diff(args []string) {
+	flags := newFlagSet("diff")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s diff [options] old new\n\n", invoked)
+		fmt.Printf("Compare two builds and report the changes of the kernel, cmdline, images\n")
+		fmt.Printf("and files, and the sizes. Each build is a built output, as for 'inspect',\n")
+		fmt.Printf("or the reference of an image pushed with 'push registry'.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	formatFlag := flags.String("format", "text", "Output format, text or json")
+	exitCode := flags.Bool("exit-code", false, "Exit with status 1 if the kernel, cmdline, images or files differ")
+	insecure := flags.Bool("insecure", false, "Allow pulling images from a registry without TLS")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 2 {
+		fmt.Println("Please specify the two builds to compare")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *formatFlag != "text" && *formatFlag != "json" {
+		log.Fatalf("Unknown format %s", *formatFlag)
+	}
+
+	dir, err := ioutil.TempDir("", "linuxkit-diff")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var builds [2]*diffBuild
+	for i, arg := range remArgs {
+		b, err := openDiffBuild(arg, filepath.Join(dir, fmt.Sprint(i)), *insecure)
+		if err != nil {
+			os.RemoveAll(dir)
+			log.Fatalf("Unable to inspect %s: %v", arg, err)
+		}
+		builds[i] = b
+	}
+	report := diffBuilds(remArgs[0], remArgs[1], builds[0], builds[1])
+
+	if *formatFlag == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		report.print()
+	}
+	if *exitCode && report.differs() {
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+}
+
+// openDiffBuild inspects a built output, or pulls an image from a registry
+// to dir and inspects it
+func openDiffBuild(arg, dir string, insecure bool) (*diffBuild, error) {
+	output, ok := outputPath(arg)
+	if !ok {
+		prefix, err := pullArtifact(arg, dir, insecure)
+		if err != nil {
+			return nil, err
+		}
+		output = prefix + "-initrd.img"
+	}
+	report, err := inspectOutput(output, false)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := outputSizes(output)
+	if err != nil {
+		return nil, err
+	}
+	return &diffBuild{report: report, sizes: sizes}, nil
+}
+
+// outputSizes returns the sizes of the parts of a built output
+func outputSizes(name string) (map[string]int64, error) {
+	a, err := openArtifact(name)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{"output": 0, "kernel": int64(len(a.kernel)), "filesystem": 0}
+	for _, f := range a.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		sizes["output"] += fi.Size()
+	}
+	err = a.walk(func(name string, dir bool, r io.Reader) error {
+		if dir {
+			return nil
+		}
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return err
+		}
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		parts := strings.Split(name, "/")
+		switch {
+		case name == "boot/kernel" && a.kernel == nil:
+			sizes["kernel"] = n
+		case len(parts) >= 4 && parts[0] == "containers":
+			sizes[parts[1]+"/"+bundleName(parts[1], parts[2])] += n
+		default:
+			sizes["filesystem"] += n
+		}
+		return nil
+	})
+	return sizes, err
+}
+
+// diffBuilds compares two builds
+func diffBuilds(oldName, newName string, o, n *diffBuild) *diffReport {
+	report := &diffReport{
+		Old:           oldName,
+		New:           newName,
+		Images:        []diffImage{},
+		Files:         []diffFile{},
+		FilesCompared: o.report.Manifest && n.report.Manifest,
+		Sizes:         []diffSize{},
+	}
+	if o.report.KernelVersion != n.report.KernelVersion {
+		report.Kernel = &diffValue{Old: o.report.KernelVersion, New: n.report.KernelVersion}
+	}
+	if o.report.Cmdline != n.report.Cmdline {
+		report.Cmdline = &diffValue{Old: o.report.Cmdline, New: n.report.Cmdline}
+	}
+
+	oldImages, oldKeys := diffImageKeys(o.report.Images)
+	newImages, newKeys := diffImageKeys(n.report.Images)
+	for _, k := range oldKeys {
+		oi := oldImages[k]
+		ni, ok := newImages[k]
+		switch {
+		case !ok:
+			report.Images = append(report.Images, diffImage{Key: k, Change: diffRemoved, Old: oi})
+		case oi.Image != ni.Image || oi.Digest != ni.Digest:
+			report.Images = append(report.Images, diffImage{Key: k, Change: diffChanged, Old: oi, New: ni})
+		}
+	}
+	for _, k := range newKeys {
+		if _, ok := oldImages[k]; !ok {
+			report.Images = append(report.Images, diffImage{Key: k, Change: diffAdded, New: newImages[k]})
+		}
+	}
+
+	if report.FilesCompared {
+		oldFiles := map[string]*moby.ManifestFile{}
+		for i := range o.report.Files {
+			oldFiles[o.report.Files[i].Path] = &o.report.Files[i].ManifestFile
+		}
+		newFiles := map[string]*moby.ManifestFile{}
+		for i := range n.report.Files {
+			newFiles[n.report.Files[i].Path] = &n.report.Files[i].ManifestFile
+		}
+		var paths []string
+		for p := range oldFiles {
+			paths = append(paths, p)
+		}
+		for p := range newFiles {
+			if _, ok := oldFiles[p]; !ok {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			of, nf := oldFiles[p], newFiles[p]
+			switch {
+			case nf == nil:
+				report.Files = append(report.Files, diffFile{Path: p, Change: diffRemoved, Old: of})
+			case of == nil:
+				report.Files = append(report.Files, diffFile{Path: p, Change: diffAdded, New: nf})
+			case len(fileChanges(of, nf)) > 0:
+				report.Files = append(report.Files, diffFile{Path: p, Change: diffChanged, Old: of, New: nf})
+			}
+		}
+	}
+
+	var parts []string
+	for p := range o.sizes {
+		parts = append(parts, p)
+	}
+	for p := range n.sizes {
+		if _, ok := o.sizes[p]; !ok {
+			parts = append(parts, p)
+		}
+	}
+	// the output, kernel and filesystem come before the bundles
+	order := map[string]int{"output": 0, "kernel": 1, "filesystem": 2}
+	sort.Slice(parts, func(i, j int) bool {
+		oi, ok := order[parts[i]]
+		if !ok {
+			oi = len(order)
+		}
+		oj, ok := order[parts[j]]
+		if !ok {
+			oj = len(order)
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return parts[i] < parts[j]
+	})
+	for _, p := range parts {
+		report.Sizes = append(report.Sizes, diffSize{Name: p, Old: o.sizes[p], New: n.sizes[p], Delta: n.sizes[p] - o.sizes[p]})
+	}
+	return report
+}
+
+// diffImageKeys returns the images by a key matching them across builds,
+// and the keys in order. Images are matched by their name, or by their
+// repository for the init images, which have no names.
+func diffImageKeys(images []moby.ManifestImage) (map[string]*moby.ManifestImage, []string) {
+	byKey := map[string]*moby.ManifestImage{}
+	var keys []string
+	for i := range images {
+		name := images[i].Name
+		if name == "" {
+			name = imageRepository(images[i].Image)
+		}
+		key := images[i].Section + "/" + name
+		if images[i].Section == "kernel" {
+			key = "kernel"
+		}
+		// the same image may be used more than once in a section
+		for n := 2; byKey[key] != nil; n++ {
+			key = fmt.Sprintf("%s/%s#%d", images[i].Section, name, n)
+		}
+		byKey[key] = &images[i]
+		keys = append(keys, key)
+	}
+	return byKey, keys
+}
+
+// imageRepository returns an image reference without its tag and digest
+func imageRepository(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// fileChanges describes how an entry of the files section changed
+func fileChanges(o, n *moby.ManifestFile) []string {
+	var changes []string
+	if o.Type != n.Type {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", o.Type, n.Type))
+	}
+	if o.Mode != n.Mode {
+		changes = append(changes, fmt.Sprintf("mode %s -> %s", o.Mode, n.Mode))
+	}
+	if o.UID != n.UID || o.GID != n.GID {
+		changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", o.UID, o.GID, n.UID, n.GID))
+	}
+	if o.Linkname != n.Linkname {
+		changes = append(changes, fmt.Sprintf("link %s -> %s", o.Linkname, n.Linkname))
+	}
+	if o.Digest != n.Digest {
+		changes = append(changes, fmt.Sprintf("contents %s (%d bytes) -> %s (%d bytes)", o.Digest, o.Size, n.Digest, n.Size))
+	}
+	return changes
+}
+
+// differs returns whether the kernel, cmdline, images or files differ
+func (r *diffReport) differs() bool {
+	return r.Kernel != nil || r.Cmdline != nil || len(r.Images) > 0 || len(r.Files) > 0
+}
+
+func (r *diffReport) print() {
+	fmt.Printf("--- %s\n", r.Old)
+	fmt.Printf("+++ %s\n", r.New)
+	if r.Kernel != nil {
+		fmt.Printf("\nKernel:   %s -> %s\n", r.Kernel.Old, r.Kernel.New)
+	}
+	if r.Cmdline != nil {
+		fmt.Printf("\nCmdline:\n  - %s\n  + %s\n", r.Cmdline.Old, r.Cmdline.New)
+	}
+
+	fmt.Printf("\nImages:\n")
+	if len(r.Images) == 0 {
+		fmt.Printf("  no changes\n")
+	}
+	for _, i := range r.Images {
+		switch i.Change {
+		case diffAdded:
+			fmt.Printf("  + %-30s %s\n", i.Key, diffImageString(i.New))
+		case diffRemoved:
+			fmt.Printf("  - %-30s %s\n", i.Key, diffImageString(i.Old))
+		default:
+			fmt.Printf("  ~ %-30s %s -> %s\n", i.Key, diffImageString(i.Old), diffImageString(i.New))
+		}
+	}
+
+	fmt.Printf("\nFiles:\n")
+	switch {
+	case !r.FilesCompared:
+		fmt.Printf("  not compared, as a build has no manifest\n")
+	case len(r.Files) == 0:
+		fmt.Printf("  no changes\n")
+	}
+	for _, f := range r.Files {
+		switch f.Change {
+		case diffAdded:
+			fmt.Printf("  + %s %s\n", f.Path, diffFileString(f.New))
+		case diffRemoved:
+			fmt.Printf("  - %s %s\n", f.Path, diffFileString(f.Old))
+		default:
+			fmt.Printf("  ~ %s %s\n", f.Path, strings.Join(fileChanges(f.Old, f.New), ", "))
+		}
+	}
+
+	fmt.Printf("\nSizes:\n")
+	for _, s := range r.Sizes {
+		fmt.Printf("  %-30s %10s -> %10s %11s\n", s.Name, humanSize(s.Old), humanSize(s.New), signedSize(s.Delta))
+	}
+}
+
+func diffImageString(i *moby.ManifestImage) string {
+	s := i.Image
+	if s == "" {
+		// images of builds without a manifest are only known by their name
+		s = i.Name
+	}
+	if i.Digest != "" {
+		s += " " + i.Digest
+	}
+	return s
+}
+
+func diffFileString(f *moby.ManifestFile) string {
+	s := fmt.Sprintf("%s %s %d:%d", f.Type, f.Mode, f.UID, f.GID)
+	switch f.Type {
+	case "symlink":
+		s += " -> " + f.Linkname
+	case "file":
+		s += fmt.Sprintf(" %s (%d bytes)", f.Digest, f.Size)
+	}
+	return s
+}
+
+// humanSize formats a size in bytes with binary units
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func signedSize(n int64) string {
+	switch {
+	case n > 0:
+		return "+" + humanSize(n)
+	case n < 0:
+		return "-" + humanSize(-n)
+	}
+	return "0 B"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	digitalOceanTokenVar  = "DIGITALOCEAN_TOKEN"
+	digitalOceanRegionVar = "DIGITALOCEAN_REGION"
+	digitalOceanAPIURL    = "https://api.digitalocean.com/v2"
+	digitalOceanTimeout   = 60 * time.Minute
+
+	defaultDigitalOceanRegion = "nyc3"
+)
+
+// DigitalOceanClient is a client for the DigitalOcean API v2
+type DigitalOceanClient struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// DigitalOceanImage is the state of a custom image
+type DigitalOceanImage struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// NewDigitalOceanClient creates a client using a personal access token
+func NewDigitalOceanClient(token string) (*DigitalOceanClient, error) {
+	if token == "" {
+		return nil, fmt.Errorf("An API token must be set with -token or %s", digitalOceanTokenVar)
+	}
+	return &DigitalOceanClient{token: token, baseURL: digitalOceanAPIURL, client: &http.Client{}}, nil
+}
+
+func (c *DigitalOceanClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	log.Debugf("DigitalOcean: %s %s", method, path)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			msg = e.Message
+		}
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// CreateCustomImage creates a custom image in region from a disk image
+// which DigitalOcean downloads from url, and waits for it to be available
+func (c *DigitalOceanClient) CreateCustomImage(name, url, region, distribution, description string, tags []string) (*DigitalOceanImage, error) {
+	req := map[string]interface{}{
+		"name":         name,
+		"url":          url,
+		"region":       region,
+		"distribution": distribution,
+	}
+	if description != "" {
+		req["description"] = description
+	}
+	if len(tags) > 0 {
+		req["tags"] = tags
+	}
+	var resp struct {
+		Image DigitalOceanImage `json:"image"`
+	}
+	if err := c.do(http.MethodPost, "/images", req, &resp); err != nil {
+		return nil, err
+	}
+	id := resp.Image.ID
+	deadline := time.Now().Add(digitalOceanTimeout)
+	for time.Now().Before(deadline) {
+		var s struct {
+			Image DigitalOceanImage `json:"image"`
+		}
+		if err := c.do(http.MethodGet, fmt.Sprintf("/images/%d", id), nil, &s); err != nil {
+			return &resp.Image, err
+		}
+		log.Debugf("DigitalOcean: image %d is %s", id, s.Image.Status)
+		switch s.Image.Status {
+		case "available":
+			return &s.Image, nil
+		case "deleted", "retired":
+			return &s.Image, fmt.Errorf("image %d could not be created: %s", id, s.Image.ErrorMessage)
+		}
+		time.Sleep(15 * time.Second)
+	}
+	return &resp.Image, fmt.Errorf("timed out waiting for image %d", id)
+}
+
+// digitalOceanTags returns tags as DigitalOcean tags, which may not contain
+// '=', so they are written as key:value
+func digitalOceanTags(tags Tags) []string {
+	var s []string
+	for _, t := range tags {
+		if t.Value == "" {
+			s = append(s, t.Key)
+		} else {
+			s = append(s, t.Key+":"+t.Value)
+		}
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+// Package diskimage writes virtual disk images in the common formats
+// natively, so that creating and converting disks does not need qemu-img.
+package diskimage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const sectorSize = 512
+
+// writer writes an image of the given virtual size to f. The contents are
+// read from src, which is nil for an empty image.
+type writer func(f *os.File, src io.ReaderAt, size int64) error
+
+// The format names follow qemu, with the LinuxKit output names as aliases
+var writers = map[string]writer{
+	"raw":         writeRaw,
+	"qcow2":       writeQcow2,
+	"vhd":         writeFixedVHD,
+	"dynamic-vhd": writeDynamicVHD,
+	"vpc":         writeDynamicVHD,
+	"vhdx":        writeVHDX,
+	"vmdk":        writeVMDK,
+}
+
+// vhdAlign is the size fixed VHDs are rounded up to, as Azure only accepts
+// fixed VHDs with a virtual size of a whole number of MB
+const vhdAlign = 1024 * 1024
+
+// align returns the size of an image of the format with size bytes of data
+func align(format string, size int64) int64 {
+	if format == "vhd" {
+		return roundUp(size, vhdAlign)
+	}
+	return roundUp(size, sectorSize)
+}
+
+// Formats returns the supported image formats
+func Formats() []string {
+	var formats []string
+	for f := range writers {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Supported returns true if images of the given format can be written
+func Supported(format string) bool {
+	_, ok := writers[format]
+	return ok
+}
+
+// Create creates an empty image of size bytes at path
+func Create(path, format string, size int64) error {
+	w, ok := writers[format]
+	if !ok {
+		return fmt.Errorf("Unsupported disk format %q", format)
+	}
+	return write(path, w, nil, align(format, size))
+}
+
+// Convert converts the raw disk image src into an image of the given format at dst
+func Convert(src, dst, format string) error {
+	w, ok := writers[format]
+	if !ok {
+		return fmt.Errorf("Unsupported disk format %q", format)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return write(dst, w, f, align(format, fi.Size()))
+}
+
+func write(path string, w writer, src io.ReaderAt, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := w(f, src, size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("Error writing %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readBlock fills buf with the contents of src at off. Anything past the end
+// of src, or everything if src is nil, reads as zeros.
+func readBlock(src io.ReaderAt, buf []byte, off int64) error {
+	for i := range buf {
+		buf[i] = 0
+	}
+	if src == nil {
+		return nil
+	}
+	n, err := src.ReadAt(buf, off)
+	if err == io.EOF && n < len(buf) {
+		return nil
+	}
+	return err
+}
+
+// allocated scans src and returns which blocks of blockSize contain any data
+func allocated(src io.ReaderAt, size, blockSize int64) ([]bool, error) {
+	blocks := make([]bool, (size+blockSize-1)/blockSize)
+	if src == nil {
+		return blocks, nil
+	}
+	buf := make([]byte, blockSize)
+	for i := range blocks {
+		if err := readBlock(src, buf, int64(i)*blockSize); err != nil {
+			return nil, err
+		}
+		blocks[i] = !isZero(buf)
+	}
+	return blocks, nil
+}
+
+// copyBlock copies the block at off in src to dstOff in f
+func copyBlock(f *os.File, src io.ReaderAt, buf []byte, off, dstOff int64) error {
+	if err := readBlock(src, buf, off); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(buf, dstOff)
+	return err
+}
+
+// writeRaw copies the data blocks, leaving holes for the rest
+func writeRaw(f *os.File, src io.ReaderAt, size int64) error {
+	const blockSize = 64 * 1024
+	blocks, err := allocated(src, size, blockSize)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, blockSize)
+	for i, used := range blocks {
+		if !used {
+			continue
+		}
+		off := int64(i) * blockSize
+		if err := copyBlock(f, src, buf, off, off); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,107 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 3MB raw image with data in the first and last cluster
+	raw := make([]byte, 3*1024*1024)
+	copy(raw, "first")
+	copy(raw[len(raw)-qcow2ClusterSize:], "last")
+	src := filepath.Join(dir, "disk.raw")
+	if err := ioutil.WriteFile(src, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	magics := map[string]struct {
+		offset int64
+		magic  string
+	}{
+		"qcow2":       {0, "QFI\xfb"},
+		"vhd":         {int64(len(raw)), "conectix"},
+		"dynamic-vhd": {0, "conectix"},
+		"vhdx":        {0, "vhdxfile"},
+		"vmdk":        {0, "KDMV"},
+	}
+	for format, m := range magics {
+		dst := filepath.Join(dir, "disk."+format)
+		if err := Convert(src, dst, format); err != nil {
+			t.Fatalf("Converting to %s: %v", format, err)
+		}
+		b, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[m.offset : m.offset+int64(len(m.magic))]); got != m.magic {
+			t.Errorf("Expected %s image to have magic %q, got %q", format, m.magic, got)
+		}
+		if format == "qcow2" {
+			checkQcow2(t, b, raw)
+		}
+	}
+}
+
+// checkQcow2 reads all clusters back through the L1 and L2 tables
+func checkQcow2(t *testing.T, b, raw []byte) {
+	if size := binary.BigEndian.Uint64(b[24:]); size != uint64(len(raw)) {
+		t.Fatalf("Expected qcow2 size %d, got %d", len(raw), size)
+	}
+	l1 := binary.BigEndian.Uint64(b[40:])
+	for c := 0; c < len(raw)/qcow2ClusterSize; c++ {
+		want := raw[c*qcow2ClusterSize : (c+1)*qcow2ClusterSize]
+		l2 := binary.BigEndian.Uint64(b[l1+uint64(c/qcow2L2Entries)*8:]) &^ qcow2Copied
+		var got []byte
+		if l2 != 0 {
+			data := binary.BigEndian.Uint64(b[l2+uint64(c%qcow2L2Entries)*8:]) &^ qcow2Copied
+			if data != 0 {
+				got = b[data : data+qcow2ClusterSize]
+			}
+		}
+		if got == nil {
+			if !isZero(want) {
+				t.Fatalf("Cluster %d with data is not allocated", c)
+			}
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Cluster %d has the wrong contents", c)
+		}
+	}
+}
+
+func TestFixedVHDAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "disk.raw")
+	if err := ioutil.WriteFile(src, make([]byte, vhdAlign+sectorSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "disk.vhd")
+	if err := Convert(src, dst, "vhd"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data is followed by the 512 byte footer
+	if size := fi.Size() - sectorSize; size != 2*vhdAlign {
+		t.Errorf("Expected a fixed VHD of %d bytes, got %d", 2*vhdAlign, size)
+	}
+}
@@ -0,0 +1,130 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	qcow2Magic       = 0x514649fb
+	qcow2ClusterBits = 16
+	qcow2ClusterSize = 1 << qcow2ClusterBits
+	// Entries are 8 bytes in the L1 and L2 tables and 2 bytes in refcount blocks
+	qcow2L2Entries       = qcow2ClusterSize / 8
+	qcow2RefcountEntries = qcow2ClusterSize / 2
+	// qcow2Copied marks clusters with a refcount of exactly one
+	qcow2Copied = uint64(1) << 63
+)
+
+func clustersFor(bytes int64) int64 {
+	return (bytes + qcow2ClusterSize - 1) / qcow2ClusterSize
+}
+
+// writeQcow2 writes a version 2 qcow2 image. The image is laid out as the
+// header, the L1 table, the refcount table and blocks, the L2 tables and then
+// the data clusters, with only clusters containing data allocated.
+func writeQcow2(f *os.File, src io.ReaderAt, size int64) error {
+	clusters, err := allocated(src, size, qcow2ClusterSize)
+	if err != nil {
+		return err
+	}
+
+	l1Size := (int64(len(clusters)) + qcow2L2Entries - 1) / qcow2L2Entries
+	l2Used := make([]bool, l1Size)
+	var l2Count, dataCount int64
+	for i, used := range clusters {
+		if !used {
+			continue
+		}
+		dataCount++
+		if !l2Used[i/qcow2L2Entries] {
+			l2Used[i/qcow2L2Entries] = true
+			l2Count++
+		}
+	}
+	l1Clusters := clustersFor(l1Size * 8)
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	// The number of refcount blocks depends on the total number of
+	// clusters, which includes the refcount blocks themselves
+	var refBlocks, refTableClusters, total int64
+	for {
+		total = 1 + l1Clusters + refTableClusters + refBlocks + l2Count + dataCount
+		rb := (total + qcow2RefcountEntries - 1) / qcow2RefcountEntries
+		rt := clustersFor(rb * 8)
+		if rb == refBlocks && rt == refTableClusters {
+			break
+		}
+		refBlocks, refTableClusters = rb, rt
+	}
+
+	l1Offset := int64(qcow2ClusterSize)
+	refTableOffset := l1Offset + l1Clusters*qcow2ClusterSize
+	refBlocksOffset := refTableOffset + refTableClusters*qcow2ClusterSize
+	l2Offset := refBlocksOffset + refBlocks*qcow2ClusterSize
+	dataOffset := l2Offset + l2Count*qcow2ClusterSize
+
+	header := make([]byte, qcow2ClusterSize)
+	binary.BigEndian.PutUint32(header[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(size))
+	binary.BigEndian.PutUint32(header[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:], uint64(refTableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(refTableClusters))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	refTable := make([]byte, refTableClusters*qcow2ClusterSize)
+	for i := int64(0); i < refBlocks; i++ {
+		binary.BigEndian.PutUint64(refTable[i*8:], uint64(refBlocksOffset+i*qcow2ClusterSize))
+	}
+	if _, err := f.WriteAt(refTable, refTableOffset); err != nil {
+		return err
+	}
+	refCounts := make([]byte, refBlocks*qcow2ClusterSize)
+	for i := int64(0); i < total; i++ {
+		binary.BigEndian.PutUint16(refCounts[i*2:], 1)
+	}
+	if _, err := f.WriteAt(refCounts, refBlocksOffset); err != nil {
+		return err
+	}
+
+	l1 := make([]byte, l1Clusters*qcow2ClusterSize)
+	l2 := make([]byte, qcow2ClusterSize)
+	buf := make([]byte, qcow2ClusterSize)
+	next := dataOffset
+	for t := int64(0); t < l1Size; t++ {
+		if !l2Used[t] {
+			continue
+		}
+		for i := range l2 {
+			l2[i] = 0
+		}
+		for e := int64(0); e < qcow2L2Entries; e++ {
+			c := t*qcow2L2Entries + e
+			if c >= int64(len(clusters)) || !clusters[c] {
+				continue
+			}
+			if err := copyBlock(f, src, buf, c*qcow2ClusterSize, next); err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint64(l2[e*8:], uint64(next)|qcow2Copied)
+			next += qcow2ClusterSize
+		}
+		if _, err := f.WriteAt(l2, l2Offset); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(l1[t*8:], uint64(l2Offset)|qcow2Copied)
+		l2Offset += qcow2ClusterSize
+	}
+	if _, err := f.WriteAt(l1, l1Offset); err != nil {
+		return err
+	}
+	return f.Truncate(total * qcow2ClusterSize)
+}
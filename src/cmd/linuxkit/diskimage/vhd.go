@@ -0,0 +1,158 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vhdFooterSize     = 512
+	vhdDynHeaderSize  = 1024
+	vhdBlockSize      = 2 * 1024 * 1024
+	vhdBitmapSize     = vhdBlockSize / sectorSize / 8
+	vhdTypeFixed      = 2
+	vhdTypeDynamic    = 3
+	vhdNoOffset       = ^uint64(0)
+	vhdVersion        = 0x00010000
+	vhdCreatorHostOS  = 0x5769326b // "Wi2k"
+	vhdMaxGeomSectors = 65535 * 16 * 255
+	vhdFixedGeomLimit = 65535 * 16 * 63
+	vhdBATOffset      = vhdFooterSize + vhdDynHeaderSize
+)
+
+// vhdEpoch is the base of the VHD timestamps
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdChecksum is the one's complement of the sum of all bytes
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// vhdGeometry computes the CHS geometry as given in the VHD specification
+func vhdGeometry(size int64) (uint16, uint8, uint8) {
+	var spt, heads, cth int64
+	total := size / sectorSize
+	if total > vhdMaxGeomSectors {
+		total = vhdMaxGeomSectors
+	}
+	if total >= vhdFixedGeomLimit {
+		spt = 255
+		heads = 16
+		cth = total / spt
+	} else {
+		spt = 17
+		cth = total / spt
+		heads = (cth + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cth >= heads*1024 || heads > 16 {
+			spt = 31
+			heads = 16
+			cth = total / spt
+		}
+		if cth >= heads*1024 {
+			spt = 63
+			heads = 16
+			cth = total / spt
+		}
+	}
+	return uint16(cth / heads), uint8(heads), uint8(spt)
+}
+
+func vhdFooter(size int64, diskType uint32, dataOffset uint64) []byte {
+	b := make([]byte, vhdFooterSize)
+	copy(b[0:], "conectix")
+	binary.BigEndian.PutUint32(b[8:], 2)
+	binary.BigEndian.PutUint32(b[12:], vhdVersion)
+	binary.BigEndian.PutUint64(b[16:], dataOffset)
+	binary.BigEndian.PutUint32(b[24:], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(b[28:], "lkit")
+	binary.BigEndian.PutUint32(b[32:], vhdVersion)
+	binary.BigEndian.PutUint32(b[36:], vhdCreatorHostOS)
+	binary.BigEndian.PutUint64(b[40:], uint64(size))
+	binary.BigEndian.PutUint64(b[48:], uint64(size))
+	c, h, s := vhdGeometry(size)
+	binary.BigEndian.PutUint16(b[56:], c)
+	b[58] = h
+	b[59] = s
+	binary.BigEndian.PutUint32(b[60:], diskType)
+	id := uuid.New()
+	copy(b[68:], id[:])
+	binary.BigEndian.PutUint32(b[64:], vhdChecksum(b))
+	return b
+}
+
+// writeFixedVHD writes the raw data followed by the VHD footer
+func writeFixedVHD(f *os.File, src io.ReaderAt, size int64) error {
+	if err := writeRaw(f, src, size); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(vhdFooter(size, vhdTypeFixed, vhdNoOffset), size)
+	return err
+}
+
+// writeDynamicVHD writes a dynamic VHD, with 2MB blocks which are only
+// allocated if they contain data.
+func writeDynamicVHD(f *os.File, src io.ReaderAt, size int64) error {
+	blocks, err := allocated(src, size, vhdBlockSize)
+	if err != nil {
+		return err
+	}
+
+	batSize := roundUp(int64(len(blocks))*4, sectorSize)
+	footer := vhdFooter(size, vhdTypeDynamic, vhdFooterSize)
+	if _, err := f.WriteAt(footer, 0); err != nil {
+		return err
+	}
+
+	header := make([]byte, vhdDynHeaderSize)
+	copy(header[0:], "cxsparse")
+	binary.BigEndian.PutUint64(header[8:], vhdNoOffset)
+	binary.BigEndian.PutUint64(header[16:], vhdBATOffset)
+	binary.BigEndian.PutUint32(header[24:], vhdVersion)
+	binary.BigEndian.PutUint32(header[28:], uint32(len(blocks)))
+	binary.BigEndian.PutUint32(header[32:], vhdBlockSize)
+	binary.BigEndian.PutUint32(header[36:], vhdChecksum(header))
+	if _, err := f.WriteAt(header, vhdFooterSize); err != nil {
+		return err
+	}
+
+	// Unused entries are all ones
+	bat := make([]byte, batSize)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+	bitmap := make([]byte, roundUp(vhdBitmapSize, sectorSize))
+	for i := range bitmap {
+		bitmap[i] = 0xff
+	}
+	buf := make([]byte, vhdBlockSize)
+	next := int64(vhdBATOffset) + batSize
+	for i, used := range blocks {
+		if !used {
+			continue
+		}
+		binary.BigEndian.PutUint32(bat[i*4:], uint32(next/sectorSize))
+		if _, err := f.WriteAt(bitmap, next); err != nil {
+			return err
+		}
+		if err := copyBlock(f, src, buf, int64(i)*vhdBlockSize, next+int64(len(bitmap))); err != nil {
+			return err
+		}
+		next += int64(len(bitmap)) + vhdBlockSize
+	}
+	if _, err := f.WriteAt(bat, vhdBATOffset); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(footer, next)
+	return err
+}
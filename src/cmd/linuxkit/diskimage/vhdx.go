@@ -0,0 +1,200 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vhdxMB                = 1024 * 1024
+	vhdxBlockSize         = 2 * vhdxMB
+	vhdxPhysicalSector    = 4096
+	vhdxHeaderSize        = 4096
+	vhdxRegionTableSize   = 64 * 1024
+	vhdxLogOffset         = 1 * vhdxMB
+	vhdxLogSize           = 1 * vhdxMB
+	vhdxMetadataOffset    = 2 * vhdxMB
+	vhdxMetadataSize      = 1 * vhdxMB
+	vhdxBATOffset         = 3 * vhdxMB
+	vhdxMetadataItems     = 64 * 1024
+	vhdxBlockFullyPresent = 6
+	// Number of payload blocks described by each sector bitmap block
+	vhdxChunkRatio = (1 << 23) * sectorSize / vhdxBlockSize
+
+	vhdxMetaIsVirtualDisk = 1 << 1
+	vhdxMetaIsRequired    = 1 << 2
+)
+
+var (
+	vhdxRegionBAT      = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxRegionMetadata = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxFileParameters     = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskID      = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// vhdxGUID returns the on disk form of a GUID, where the first three fields
+// are little endian.
+func vhdxGUID(s string) []byte {
+	return guidBytes(uuid.MustParse(s))
+}
+
+func guidBytes(u uuid.UUID) []byte {
+	b := make([]byte, 16)
+	copy(b, u[:])
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// vhdxChecksum stores the CRC-32C of b at offset 4, where all the VHDX
+// structures keep theirs.
+func vhdxChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+}
+
+// writeVHDX writes a dynamic VHDX with 2MB blocks which are only allocated
+// if they contain data. The log is empty, so it is never replayed.
+func writeVHDX(f *os.File, src io.ReaderAt, size int64) error {
+	blocks, err := allocated(src, size, vhdxBlockSize)
+	if err != nil {
+		return err
+	}
+	entries := int64(len(blocks))
+	if entries > 0 {
+		entries += (entries - 1) / vhdxChunkRatio
+	}
+	batSize := roundUp(entries*8, vhdxMB)
+	if batSize == 0 {
+		batSize = vhdxMB
+	}
+
+	ident := make([]byte, 8+512)
+	copy(ident, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("linuxkit")) {
+		binary.LittleEndian.PutUint16(ident[8+i*2:], c)
+	}
+	if _, err := f.WriteAt(ident, 0); err != nil {
+		return err
+	}
+
+	fileWrite := guidBytes(uuid.New())
+	dataWrite := guidBytes(uuid.New())
+	for i := int64(0); i < 2; i++ {
+		header := make([]byte, vhdxHeaderSize)
+		copy(header[0:], "head")
+		binary.LittleEndian.PutUint64(header[8:], uint64(i))
+		copy(header[16:], fileWrite)
+		copy(header[32:], dataWrite)
+		binary.LittleEndian.PutUint16(header[66:], 1)
+		binary.LittleEndian.PutUint32(header[68:], vhdxLogSize)
+		binary.LittleEndian.PutUint64(header[72:], vhdxLogOffset)
+		vhdxChecksum(header)
+		if _, err := f.WriteAt(header, (i+1)*64*1024); err != nil {
+			return err
+		}
+	}
+
+	regions := make([]byte, vhdxRegionTableSize)
+	copy(regions[0:], "regi")
+	binary.LittleEndian.PutUint32(regions[8:], 2)
+	for i, r := range []struct {
+		guid   []byte
+		offset int64
+		length int64
+	}{
+		{vhdxRegionBAT, vhdxBATOffset, batSize},
+		{vhdxRegionMetadata, vhdxMetadataOffset, vhdxMetadataSize},
+	} {
+		e := regions[16+i*32:]
+		copy(e, r.guid)
+		binary.LittleEndian.PutUint64(e[16:], uint64(r.offset))
+		binary.LittleEndian.PutUint32(e[24:], uint32(r.length))
+		binary.LittleEndian.PutUint32(e[28:], 1)
+	}
+	vhdxChecksum(regions)
+	for _, off := range []int64{192 * 1024, 256 * 1024} {
+		if _, err := f.WriteAt(regions, off); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.WriteAt(make([]byte, vhdxLogSize), vhdxLogOffset); err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(vhdxMetadata(size), vhdxMetadataOffset); err != nil {
+		return err
+	}
+
+	bat := make([]byte, batSize)
+	buf := make([]byte, vhdxBlockSize)
+	next := int64(vhdxBATOffset) + batSize
+	for i, used := range blocks {
+		if !used {
+			continue
+		}
+		if err := copyBlock(f, src, buf, int64(i)*vhdxBlockSize, next); err != nil {
+			return err
+		}
+		entry := int64(i) + int64(i)/vhdxChunkRatio
+		binary.LittleEndian.PutUint64(bat[entry*8:], uint64(next/vhdxMB)<<20|vhdxBlockFullyPresent)
+		next += vhdxBlockSize
+	}
+	if _, err := f.WriteAt(bat, vhdxBATOffset); err != nil {
+		return err
+	}
+	return f.Truncate(next)
+}
+
+func vhdxMetadata(size int64) []byte {
+	meta := make([]byte, vhdxMetadataSize)
+	copy(meta[0:], "metadata")
+
+	diskID := guidBytes(uuid.New())
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, v)
+		return b
+	}
+	u64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return b
+	}
+	items := []struct {
+		guid  []byte
+		flags uint32
+		data  []byte
+	}{
+		{vhdxFileParameters, vhdxMetaIsRequired, append(u32(vhdxBlockSize), u32(0)...)},
+		{vhdxVirtualDiskSize, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, u64(uint64(size))},
+		{vhdxVirtualDiskID, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, diskID},
+		{vhdxLogicalSectorSize, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, u32(sectorSize)},
+		{vhdxPhysicalSectorSize, vhdxMetaIsVirtualDisk | vhdxMetaIsRequired, u32(vhdxPhysicalSector)},
+	}
+	binary.LittleEndian.PutUint16(meta[10:], uint16(len(items)))
+	offset := vhdxMetadataItems
+	for i, item := range items {
+		e := meta[32+i*32:]
+		copy(e, item.guid)
+		binary.LittleEndian.PutUint32(e[16:], uint32(offset))
+		binary.LittleEndian.PutUint32(e[20:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(e[24:], item.flags)
+		copy(meta[offset:], item.data)
+		offset += len(item.data)
+	}
+	return meta
+}
@@ -0,0 +1,111 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+const (
+	vmdkMagic          = 0x564d444b // "KDMV"
+	vmdkGrainSectors   = 128
+	vmdkGrainSize      = vmdkGrainSectors * sectorSize
+	vmdkGTEntries      = 512
+	vmdkGTSectors      = vmdkGTEntries * 4 / sectorSize
+	vmdkDescriptorSize = 20
+	// Valid newline detection and redundant grain table
+	vmdkFlags = 0x3
+)
+
+const vmdkDescriptor = `# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`
+
+// writeVMDK writes a monolithic sparse VMDK with 64kB grains. The grain
+// directory and all grain tables are preallocated after the descriptor, once
+// for the redundant copy and once for the primary one.
+func writeVMDK(f *os.File, src io.ReaderAt, size int64) error {
+	grains, err := allocated(src, size, vmdkGrainSize)
+	if err != nil {
+		return err
+	}
+	capacity := size / sectorSize
+	numGTs := (int64(len(grains)) + vmdkGTEntries - 1) / vmdkGTEntries
+	gdSectors := roundUp(numGTs*4, sectorSize) / sectorSize
+	tablesSectors := gdSectors + numGTs*vmdkGTSectors
+
+	rgdOffset := int64(1 + vmdkDescriptorSize)
+	gdOffset := rgdOffset + tablesSectors
+	overHead := roundUp(gdOffset+tablesSectors, vmdkGrainSectors)
+
+	header := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(header[0:], vmdkMagic)
+	binary.LittleEndian.PutUint32(header[4:], 1)
+	binary.LittleEndian.PutUint32(header[8:], vmdkFlags)
+	binary.LittleEndian.PutUint64(header[12:], uint64(capacity))
+	binary.LittleEndian.PutUint64(header[20:], vmdkGrainSectors)
+	binary.LittleEndian.PutUint64(header[28:], 1)
+	binary.LittleEndian.PutUint64(header[36:], vmdkDescriptorSize)
+	binary.LittleEndian.PutUint32(header[44:], vmdkGTEntries)
+	binary.LittleEndian.PutUint64(header[48:], uint64(rgdOffset))
+	binary.LittleEndian.PutUint64(header[56:], uint64(gdOffset))
+	binary.LittleEndian.PutUint64(header[64:], uint64(overHead))
+	copy(header[73:], "\n \r\n")
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	descriptor := fmt.Sprintf(vmdkDescriptor, rand.Uint32(), capacity, filepath.Base(f.Name()), capacity/(16*63))
+	if len(descriptor) > vmdkDescriptorSize*sectorSize {
+		return fmt.Errorf("VMDK descriptor too large")
+	}
+	if _, err := f.WriteAt([]byte(descriptor), sectorSize); err != nil {
+		return err
+	}
+
+	gts := make([]byte, numGTs*vmdkGTSectors*sectorSize)
+	buf := make([]byte, vmdkGrainSize)
+	next := overHead
+	for i, used := range grains {
+		if !used {
+			continue
+		}
+		if err := copyBlock(f, src, buf, int64(i)*vmdkGrainSize, next*sectorSize); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(gts[i*4:], uint32(next))
+		next += vmdkGrainSectors
+	}
+
+	for _, dir := range []int64{rgdOffset, gdOffset} {
+		gd := make([]byte, gdSectors*sectorSize)
+		for i := int64(0); i < numGTs; i++ {
+			binary.LittleEndian.PutUint32(gd[i*4:], uint32(dir+gdSectors+i*vmdkGTSectors))
+		}
+		if _, err := f.WriteAt(gd, dir*sectorSize); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(gts, (dir+gdSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(next * sectorSize)
+}
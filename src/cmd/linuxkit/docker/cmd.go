@@ -50,6 +50,34 @@ func InspectImage(cli *client.Client, ref *reference.Spec) (dockertypes.ImageIns
 	return inspect, nil
 }
 
+// ImageID return the ID of the provided ref, which changes with its contents.
+func ImageID(ref *reference.Spec) (string, error) {
+	cli, err := Client()
+	if err != nil {
+		return "", err
+	}
+	inspect, err := InspectImage(cli, ref)
+	if err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
+// RepoDigests returns the references by digest of the registry manifests the
+// image in docker was pulled or pushed as, which images built locally and
+// not pushed have none of.
+func RepoDigests(ref *reference.Spec) ([]string, error) {
+	cli, err := Client()
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := InspectImage(cli, ref)
+	if err != nil {
+		return nil, err
+	}
+	return inspect.RepoDigests, nil
+}
+
 // Create create a container from the given image in docker, returning the full hash ID
 // of the created container. Does not start the container.
 func Create(image string) (string, error) {
@@ -88,6 +116,16 @@ func Export(container string) (io.ReadCloser, error) {
 	return responseBody, err
 }
 
+// Save save the provided image from docker using `docker save`.
+func Save(image string) (io.ReadCloser, error) {
+	log.Debugf("docker save: %s", image)
+	cli, err := Client()
+	if err != nil {
+		return nil, errors.New("could not initialize Docker API client")
+	}
+	return cli.ImageSave(context.Background(), []string{image})
+}
+
 // Rm remove the given container from docker.
 func Rm(container string) error {
 	log.Debugf("docker rm: %s", container)
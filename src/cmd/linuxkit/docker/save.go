@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// SaveSource a source for an image in the docker engine which is read with
+// `docker save`, so that images which were built locally need not be pushed.
+// Implements a moby.ImageSource.
+type SaveSource struct {
+	ImageSource
+}
+
+// NewSaveSource return a SaveSource for a specific ref from docker, which must
+// be an image of the architecture.
+func NewSaveSource(ref *reference.Spec, architecture string) (SaveSource, error) {
+	cli, err := Client()
+	if err != nil {
+		return SaveSource{}, err
+	}
+	inspect, err := InspectImage(cli, ref)
+	if err != nil {
+		return SaveSource{}, fmt.Errorf("image %s is not in docker: %v", ref, err)
+	}
+	if architecture != "" && inspect.Architecture != architecture {
+		return SaveSource{}, fmt.Errorf("image %s in docker is for %s, not %s", ref, inspect.Architecture, architecture)
+	}
+	return SaveSource{ImageSource: NewSource(ref)}, nil
+}
+
+// TarReader return an io.ReadCloser to read the filesystem contents of the image,
+// with its layers applied.
+func (d SaveSource) TarReader() (io.ReadCloser, error) {
+	// the layers are read from the archive out of order, so it is spooled
+	f, err := ioutil.TempFile("", "linuxkit-docker-save-")
+	if err != nil {
+		return nil, err
+	}
+	remove := func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	saved, err := Save(d.ref.String())
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("Failed to docker save image %s: %v", d.ref, err)
+	}
+	_, err = io.Copy(f, saved)
+	saved.Close()
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("Failed to docker save image %s: %v", d.ref, err)
+	}
+	// there is only the one image in the archive
+	image, err := tarball.ImageFromPath(f.Name(), nil)
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("Failed to read docker save archive of %s: %v", d.ref, err)
+	}
+	contents := mutate.Extract(image)
+
+	return readCloser{
+		r: contents,
+		closer: func() error {
+			contents.Close()
+
+			return remove()
+		},
+	}, nil
+}
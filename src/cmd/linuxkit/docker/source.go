@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -75,3 +76,9 @@ func (d ImageSource) TarReader() (io.ReadCloser, error) {
 		},
 	}, nil
 }
+
+// Descriptor return the descriptor of the image. Images in the docker engine are
+// not tracked by their registry manifest, so there is none.
+func (d ImageSource) Descriptor() *v1.Descriptor {
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// execCmd runs a command in a VM with the linuxkit/agent package
+func execCmd(args []string) {
+	flags := newFlagSet("exec")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s exec [options] name command [args...]\n\n", invoked)
+		fmt.Printf("Run a command in a VM with the linuxkit/agent package, without\n")
+		fmt.Printf("networking. 'name' is the state directory of the VM, or the name of\n")
+		fmt.Printf("the image it was started from if the default state directory was\n")
+		fmt.Printf("used. The input and output of the command are passed through and its\n")
+		fmt.Printf("exit status is returned. The command is not run on a terminal.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	agent := agentConnectFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) < 2 {
+		fmt.Printf("Please specify the VM and the command to run\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	conn, err := dialAgent(remArgs[0], agent)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.request(agentRequest{Op: "exec", Args: remArgs[1:]}); err != nil {
+		log.Fatalf("Unable to send the command to the agent: %v", err)
+	}
+	go conn.sendInput(os.Stdin)
+	status, err := conn.wait(func(kind byte, b []byte) error {
+		var err error
+		switch kind {
+		case agentFrameStdout:
+			_, err = os.Stdout.Write(b)
+		case agentFrameStderr:
+			_, err = os.Stderr.Write(b)
+		}
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Unable to run %s: %v", remArgs[1], err)
+	}
+	conn.Close()
+	os.Exit(status)
+}
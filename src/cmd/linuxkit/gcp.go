@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/pkg/term"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
@@ -23,6 +30,15 @@ import (
 const pollingInterval = 500 * time.Millisecond
 const timeout = 300
 
+const (
+	// gcsMaxParts is the largest number of objects which can be composed
+	// into one in a single request
+	gcsMaxParts = 32
+	// gcsMinPartSize is the smallest size of the parts of a parallel
+	// upload. Smaller files are uploaded in a single request.
+	gcsMinPartSize = 64 * 1024 * 1024
+)
+
 // GCPClient contains state required for communication with GCP
 type GCPClient struct {
 	client      *http.Client
@@ -101,32 +117,159 @@ func NewGCPClient(keys, projectName string) (*GCPClient, error) {
 	return client, nil
 }
 
-// UploadFile uploads a file to Google Storage
-func (g GCPClient) UploadFile(src, dst, bucketName string, public bool) error {
+// UploadFile uploads a file to Google Storage. Objects have no labels, so
+// the labels are set as metadata. Large files are uploaded as up to
+// gcsMaxParts objects in parallel, which are then composed into one. If
+// opts.Resume is set, the parts are kept if the upload fails, and the parts
+// which are unchanged are not uploaded again by the next upload.
+func (g GCPClient) UploadFile(src, dst, bucketName string, public bool, labels map[string]string, opts uploadOptions) (err error) {
+	start := time.Now()
+	span := trace.Start("upload", "file", src, "destination", "gs://"+bucketName+"/"+dst)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		metrics.Upload("gcs", start, err)
+	}()
+
 	log.Infof("Uploading file %s to Google Storage as %s", src, dst)
 	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-
-	objectCall := g.storage.Objects.Insert(bucketName, &storage.Object{Name: dst}).Media(f)
-
-	if public {
-		objectCall.PredefinedAcl("publicRead")
-	}
-
-	_, err = objectCall.Do()
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	size := fi.Size()
+	progress := newUploadProgress(dst, size)
+
+	if size <= gcsMinPartSize || opts.Parallel < 2 {
+		objectCall := g.storage.Objects.Insert(bucketName, &storage.Object{Name: dst, Metadata: labels}).Media(progress.Reader(f))
+		if public {
+			objectCall.PredefinedAcl("publicRead")
+		}
+		_, err = objectCall.Do()
+		progress.Finish()
+		if err != nil {
+			return err
+		}
+	} else {
+		partSize := (size + gcsMaxParts - 1) / gcsMaxParts
+		if partSize < gcsMinPartSize {
+			partSize = gcsMinPartSize
+		}
+		var sources []*storage.ComposeRequestSourceObjects
+		for i := int64(0); i < size; i += partSize {
+			sources = append(sources, &storage.ComposeRequestSourceObjects{Name: fmt.Sprintf("%s.part%d", dst, len(sources)+1)})
+		}
+		err = uploadParts(size, partSize, opts.Parallel, nil, func(n int, offset, length int64) error {
+			if opts.Resume && g.partUploaded(bucketName, sources[n-1].Name, io.NewSectionReader(f, offset, length)) {
+				log.Debugf("%s is already uploaded", sources[n-1].Name)
+				progress.Add(length)
+				return nil
+			}
+			part := progress.Reader(io.NewSectionReader(f, offset, length))
+			if _, err := g.storage.Objects.Insert(bucketName, &storage.Object{Name: sources[n-1].Name}).Media(part).Do(); err != nil {
+				return fmt.Errorf("part %d: %v", n, err)
+			}
+			return nil
+		})
+		progress.Finish()
+		if err == nil {
+			composeCall := g.storage.Objects.Compose(bucketName, dst, &storage.ComposeRequest{
+				Destination:   &storage.Object{Metadata: labels, ContentType: "application/octet-stream"},
+				SourceObjects: sources,
+			})
+			if public {
+				composeCall.DestinationPredefinedAcl("publicRead")
+			}
+			_, err = composeCall.Do()
+		}
+		if err != nil && opts.Resume {
+			log.Warnf("The upload failed, push the same image again to resume it")
+			return err
+		}
+		for _, s := range sources {
+			deleteErr := g.storage.Objects.Delete(bucketName, s.Name).Do()
+			if e, ok := deleteErr.(*googleapi.Error); deleteErr != nil && (!ok || e.Code != 404) {
+				log.Warnf("Unable to delete %s: %v", s.Name, deleteErr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
 	log.Infof("Upload Complete!")
 	fmt.Println("gs://" + bucketName + "/" + dst)
 	return nil
 }
 
+// partUploaded returns whether an object with the content of part exists
+func (g GCPClient) partUploaded(bucketName, name string, part *io.SectionReader) bool {
+	obj, err := g.storage.Objects.Get(bucketName, name).Do()
+	if err != nil || int64(obj.Size) != part.Size() {
+		return false
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, part); err != nil {
+		return false
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) == obj.Md5Hash
+}
+
+// GCPSecurityConfig are the Shielded VM and Confidential VM options of an
+// instance
+type GCPSecurityConfig struct {
+	SecureBoot          bool
+	VTPM                bool
+	IntegrityMonitoring bool
+	// Confidential enables AMD SEV memory encryption
+	Confidential bool
+}
+
+// GCPIdentityConfig is the service account an instance runs as
+type GCPIdentityConfig struct {
+	// ServiceAccount is the email of the service account, "default" for
+	// the Compute Engine default service account. No service account is
+	// attached if it is empty.
+	ServiceAccount string
+	Scopes         []string
+}
+
+// gcpScopePrefix is the prefix of OAuth scopes which can be given by their
+// short name, like cloud-platform
+const gcpScopePrefix = "https://www.googleapis.com/auth/"
+
+// gcpScopes returns the full URLs of a comma separated list of OAuth scopes
+func gcpScopes(scopes string) []string {
+	var urls []string
+	for _, s := range strings.Split(scopes, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case strings.HasPrefix(s, "https://"):
+			urls = append(urls, s)
+		default:
+			urls = append(urls, gcpScopePrefix+s)
+		}
+	}
+	return urls
+}
+
+// gcpAMDMachine returns whether the machine type has AMD CPUs, which an
+// Intel minimum CPU platform cannot be set for
+func gcpAMDMachine(machineType string) bool {
+	for _, prefix := range []string{"n2d-", "c2d-", "t2d-", "c3d-"} {
+		if strings.HasPrefix(machineType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateImage creates a GCP image using the a source from Google Storage
-func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace bool) error {
+func (g GCPClient) CreateImage(name, storageURL, family, arch string, features []string, labels map[string]string, nested, replace bool) error {
 	if replace {
 		if err := g.DeleteImage(name); err != nil {
 			return err
@@ -138,18 +281,29 @@ func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace
 		RawDisk: &compute.ImageRawDisk{
 			Source: storageURL,
 		},
-		Name: name,
+		Name:   name,
+		Labels: labels,
 	}
 
 	if family != "" {
 		imgObj.Family = family
 	}
 
+	for _, f := range features {
+		imgObj.GuestOsFeatures = append(imgObj.GuestOsFeatures, &compute.GuestOsFeature{Type: f})
+	}
+
 	if nested {
 		imgObj.Licenses = []string{"projects/vm-options/global/licenses/enable-vmx"}
 	}
 
-	op, err := g.compute.Images.Insert(g.projectName, imgObj).Do()
+	var op *compute.Operation
+	var err error
+	if arch != "" {
+		op, err = g.insertImage(imgObj, arch)
+	} else {
+		op, err = g.compute.Images.Insert(g.projectName, imgObj).Do()
+	}
 	if err != nil {
 		return err
 	}
@@ -161,6 +315,38 @@ func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace
 	return nil
 }
 
+// insertImage creates an image with the given architecture, which the
+// vendored compute API predates
+func (g GCPClient) insertImage(image *compute.Image, arch string) (*compute.Operation, error) {
+	b, err := json.Marshal(image)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+	body["architecture"] = arch
+	if b, err = json.Marshal(body); err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s%s/global/images", g.compute.BasePath, g.projectName)
+	resp, err := g.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var op compute.Operation
+	if err := json.NewDecoder(resp.Body).Decode(&op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
 // DeleteImage deletes and image
 func (g GCPClient) DeleteImage(name string) error {
 	var notFound bool
@@ -184,8 +370,10 @@ func (g GCPClient) DeleteImage(name string) error {
 	return nil
 }
 
-// CreateInstance creates and starts an instance on GCP
-func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks Disks, data *string, nested, replace bool) error {
+// CreateInstance creates and starts an instance on GCP. If spotAction is
+// set, a Spot VM is created which is stopped or deleted, as given by
+// spotAction, when it is preempted.
+func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks Disks, data *string, security GCPSecurityConfig, identity GCPIdentityConfig, spotAction string, labels map[string]string, nested bool, minCPUPlatform string, replace bool) error {
 	if replace {
 		if err := g.DeleteInstance(name, zone, true); err != nil {
 			return err
@@ -210,6 +398,7 @@ func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks D
 			Boot:       true,
 			InitializeParams: &compute.AttachedDiskInitializeParams{
 				SourceImage: fmt.Sprintf("global/images/%s", image),
+				Labels:      labels,
 			},
 		},
 	}
@@ -227,7 +416,7 @@ func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks D
 		} else {
 			diskSizeGb = int64(convertMBtoGB(disk.Size))
 		}
-		diskOp, err := g.compute.Disks.Insert(g.projectName, zone, &compute.Disk{Name: diskName, SizeGb: diskSizeGb}).Do()
+		diskOp, err := g.compute.Disks.Insert(g.projectName, zone, &compute.Disk{Name: diskName, SizeGb: diskSizeGb, Labels: labels}).Do()
 		if err != nil {
 			return err
 		}
@@ -244,6 +433,7 @@ func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks D
 	instanceObj := &compute.Instance{
 		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, machineType),
 		Name:        name,
+		Labels:      labels,
 		Disks:       instanceDisks,
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
@@ -273,15 +463,47 @@ func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks D
 		},
 	}
 
-	if nested {
-		// TODO(rn): We could/should check here if the image has nested virt enabled
-		instanceObj.MinCpuPlatform = "Intel Haswell"
+	if identity.ServiceAccount != "" {
+		instanceObj.ServiceAccounts = []*compute.ServiceAccount{{Email: identity.ServiceAccount, Scopes: identity.Scopes}}
+	}
+
+	instanceObj.MinCpuPlatform = minCPUPlatform
+
+	if security.SecureBoot || security.VTPM || security.IntegrityMonitoring {
+		instanceObj.ShieldedInstanceConfig = &compute.ShieldedInstanceConfig{
+			EnableSecureBoot:          security.SecureBoot,
+			EnableVtpm:                security.VTPM,
+			EnableIntegrityMonitoring: security.IntegrityMonitoring,
+			ForceSendFields:           []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"},
+		}
 	}
 
 	// Don't wait for operation to complete!
 	// A headstart is needed as by the time we've polled for this event to be
 	// completed, the instance may have already terminated
-	_, err = g.compute.Instances.Insert(g.projectName, zone, instanceObj).Do()
+	fields := map[string]interface{}{}
+	if security.Confidential {
+		// Confidential VMs can't be live migrated
+		instanceObj.Scheduling = &compute.Scheduling{OnHostMaintenance: "TERMINATE"}
+		fields["confidentialInstanceConfig"] = map[string]bool{"enableConfidentialCompute": true}
+	}
+	if nested {
+		// the image does not need the enable-vmx license then
+		fields["advancedMachineFeatures"] = map[string]bool{"enableNestedVirtualization": true}
+	}
+	if spotAction != "" {
+		fields["scheduling"] = map[string]interface{}{
+			"provisioningModel":         "SPOT",
+			"instanceTerminationAction": spotAction,
+			"onHostMaintenance":         "TERMINATE",
+			"automaticRestart":          false,
+		}
+	}
+	if len(fields) > 0 {
+		err = g.insertInstance(zone, instanceObj, fields)
+	} else {
+		_, err = g.compute.Instances.Insert(g.projectName, zone, instanceObj).Do()
+	}
 	if err != nil {
 		return err
 	}
@@ -289,6 +511,49 @@ func (g GCPClient) CreateInstance(name, image, zone, machineType string, disks D
 	return nil
 }
 
+// insertInstance creates an instance with additional fields in the request
+// body. The vendored compute API predates confidentialInstanceConfig,
+// advancedMachineFeatures and the Spot VM scheduling options, so they are
+// added to the request directly.
+func (g GCPClient) insertInstance(zone string, instance *compute.Instance, fields map[string]interface{}) error {
+	b, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		body[k] = v
+	}
+	if b, err = json.Marshal(body); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s%s/zones/%s/instances", g.compute.BasePath, g.projectName, zone)
+	resp, err := g.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return googleapi.CheckResponse(resp)
+}
+
+// WasPreempted checks if an instance has been preempted
+func (g GCPClient) WasPreempted(instance, zone string) (bool, error) {
+	ops, err := g.compute.ZoneOperations.List(g.projectName, zone).Filter(`operationType="compute.instances.preempted"`).Do()
+	if err != nil {
+		return false, err
+	}
+	for _, op := range ops.Items {
+		if strings.HasSuffix(op.TargetLink, "/instances/"+instance) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // DeleteInstance removes an instance
 func (g GCPClient) DeleteInstance(instance, zone string, wait bool) error {
 	var notFound bool
@@ -340,8 +605,9 @@ func (g GCPClient) GetInstanceSerialOutput(instance, zone string) error {
 	return nil
 }
 
-// ConnectToInstanceSerialPort uses SSH to connect to the serial port of the instance
-func (g GCPClient) ConnectToInstanceSerialPort(instance, zone string) error {
+// ConnectToInstanceSerialPort uses SSH to connect to the serial port of the
+// instance and copies its output to out
+func (g GCPClient) ConnectToInstanceSerialPort(instance, zone string, out io.Writer) error {
 	log.Infof("Connecting to serial port of instance %s", instance)
 	gPubKeyURL := "https://cloud-certs.storage.googleapis.com/google-cloud-serialport-host-key.pub"
 	resp, err := http.Get(gPubKeyURL)
@@ -402,7 +668,7 @@ func (g GCPClient) ConnectToInstanceSerialPort(instance, zone string) error {
 	if err != nil {
 		return fmt.Errorf("Unable to setup stdout for session: %v", err)
 	}
-	go io.Copy(os.Stdout, stdout)
+	go io.Copy(out, stdout)
 
 	stderr, err := session.StderrPipe()
 	if err != nil {
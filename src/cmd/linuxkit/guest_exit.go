@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A guest reports its exit status by writing a line with
+// linuxkit-exit-status=N to the console before it powers off, e.g. with
+// 'echo linuxkit-exit-status=$? > /dev/console'. The local run backends then
+// exit with N once the hypervisor stops, so 'linuxkit run' can gate CI.
+var guestExitLine = regexp.MustCompile(`linuxkit-exit-status=([0-9]{1,3})\b`)
+
+// guestExit is the last exit status reported by the guest
+var guestExit struct {
+	mu       sync.Mutex
+	status   int
+	reported bool
+}
+
+// parseGuestExit returns the exit status reported on a line of the console
+func parseGuestExit(line []byte) (int, bool) {
+	m := guestExitLine.FindSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	status, err := strconv.Atoi(string(m[1]))
+	if err != nil || status > 255 {
+		return 0, false
+	}
+	return status, true
+}
+
+// guestExitWriter writes the console to w, and records the exit status the
+// guest reports on it
+type guestExitWriter struct {
+	w    io.Writer
+	line []byte
+}
+
+func (g *guestExitWriter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i == -1 {
+			g.line = append(g.line, rest...)
+			break
+		}
+		g.line = append(g.line, rest[:i]...)
+		g.scan()
+		rest = rest[i+1:]
+	}
+	// the marker is short, so a long line without one is dropped
+	if len(g.line) > 4096 {
+		g.line = g.line[len(g.line)-64:]
+	}
+	return g.w.Write(p)
+}
+
+func (g *guestExitWriter) scan() {
+	if status, ok := parseGuestExit(g.line); ok {
+		guestExit.mu.Lock()
+		guestExit.status, guestExit.reported = status, true
+		guestExit.mu.Unlock()
+	}
+	g.line = g.line[:0]
+}
+
+// exitGuestStatus exits with the exit status reported by the guest, if it
+// reported one. It is called by the local run backends once the hypervisor
+// has stopped.
+func exitGuestStatus() {
+	guestExit.mu.Lock()
+	status, reported := guestExit.status, guestExit.reported
+	guestExit.mu.Unlock()
+	if !reported {
+		return
+	}
+	log.Debugf("The guest exited with status %d", status)
+	os.Exit(status)
+}
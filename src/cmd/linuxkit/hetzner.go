@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	hetznerTokenVar    = "HCLOUD_TOKEN"
+	hetznerLocationVar = "HCLOUD_LOCATION"
+	hetznerAPIURL      = "https://api.hetzner.cloud/v1"
+	hetznerTimeout     = 30 * time.Minute
+
+	defaultHetznerLocation = "fsn1"
+	// the helper server boots the rescue system, the image it is created
+	// from is never booted
+	hetznerHelperImage = "debian-12"
+)
+
+// HetznerClient is a client for the Hetzner Cloud API
+type HetznerClient struct {
+	token  string
+	client *http.Client
+}
+
+// hetznerAction is an asynchronous action of the API
+type hetznerAction struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewHetznerClient creates a client using an API token
+func NewHetznerClient(token string) (*HetznerClient, error) {
+	if token == "" {
+		return nil, fmt.Errorf("An API token must be set with -token or %s", hetznerTokenVar)
+	}
+	return &HetznerClient{token: token, client: &http.Client{}}, nil
+}
+
+func (c *HetznerClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, hetznerAPIURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	log.Debugf("Hetzner: %s %s", method, path)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+			msg = e.Error.Message
+		}
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// waitAction waits for an action to finish
+func (c *HetznerClient) waitAction(a hetznerAction) error {
+	deadline := time.Now().Add(hetznerTimeout)
+	for time.Now().Before(deadline) {
+		switch a.Status {
+		case "success":
+			return nil
+		case "error":
+			if a.Error != nil {
+				return fmt.Errorf("action %d failed: %s", a.ID, a.Error.Message)
+			}
+			return fmt.Errorf("action %d failed", a.ID)
+		}
+		time.Sleep(5 * time.Second)
+		var resp struct {
+			Action hetznerAction `json:"action"`
+		}
+		if err := c.do(http.MethodGet, fmt.Sprintf("/actions/%d", a.ID), nil, &resp); err != nil {
+			return err
+		}
+		a = resp.Action
+		log.Debugf("Hetzner: action %d is %s", a.ID, a.Status)
+	}
+	return fmt.Errorf("timed out waiting for action %d", a.ID)
+}
+
+// serverAction runs an action on a server and waits for it
+func (c *HetznerClient) serverAction(id int, action string, in interface{}) error {
+	var resp struct {
+		Action hetznerAction `json:"action"`
+	}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/servers/%d/actions/%s", id, action), in, &resp); err != nil {
+		return err
+	}
+	return c.waitAction(resp.Action)
+}
+
+// CreateSSHKey uploads a public key in authorized_keys format
+func (c *HetznerClient) CreateSSHKey(name, publicKey string) (int, error) {
+	var resp struct {
+		SSHKey struct {
+			ID int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err := c.do(http.MethodPost, "/ssh_keys", map[string]string{"name": name, "public_key": publicKey}, &resp)
+	return resp.SSHKey.ID, err
+}
+
+// DeleteSSHKey deletes an ssh key
+func (c *HetznerClient) DeleteSSHKey(id int) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/ssh_keys/%d", id), nil, nil)
+}
+
+// CreateStoppedServer creates a server which is not started, and returns
+// its ID and public IPv4 address
+func (c *HetznerClient) CreateStoppedServer(name, serverType, image, location string, labels map[string]string) (int, string, error) {
+	req := map[string]interface{}{
+		"name":               name,
+		"server_type":        serverType,
+		"image":              image,
+		"location":           location,
+		"start_after_create": false,
+		"labels":             labels,
+	}
+	var resp struct {
+		Server struct {
+			ID        int `json:"id"`
+			PublicNet struct {
+				IPv4 struct {
+					IP string `json:"ip"`
+				} `json:"ipv4"`
+			} `json:"public_net"`
+		} `json:"server"`
+		Action hetznerAction `json:"action"`
+	}
+	if err := c.do(http.MethodPost, "/servers", req, &resp); err != nil {
+		return 0, "", err
+	}
+	return resp.Server.ID, resp.Server.PublicNet.IPv4.IP, c.waitAction(resp.Action)
+}
+
+// BootRescue enables the rescue system of a server with an ssh key and
+// powers it on
+func (c *HetznerClient) BootRescue(id, sshKey int) error {
+	if err := c.serverAction(id, "enable_rescue", map[string]interface{}{"type": "linux64", "ssh_keys": []int{sshKey}}); err != nil {
+		return err
+	}
+	return c.serverAction(id, "poweron", nil)
+}
+
+// PowerOff powers a server off
+func (c *HetznerClient) PowerOff(id int) error {
+	return c.serverAction(id, "poweroff", nil)
+}
+
+// CreateSnapshot creates a snapshot of the disk of a server, waits for it
+// and returns its ID
+func (c *HetznerClient) CreateSnapshot(id int, description string, labels map[string]string) (int, error) {
+	var resp struct {
+		Image struct {
+			ID int `json:"id"`
+		} `json:"image"`
+		Action hetznerAction `json:"action"`
+	}
+	req := map[string]interface{}{"type": "snapshot", "description": description, "labels": labels}
+	if err := c.do(http.MethodPost, fmt.Sprintf("/servers/%d/actions/create_image", id), req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Image.ID, c.waitAction(resp.Action)
+}
+
+// DeleteServer deletes a server
+func (c *HetznerClient) DeleteServer(id int) error {
+	var resp struct {
+		Action hetznerAction `json:"action"`
+	}
+	if err := c.do(http.MethodDelete, fmt.Sprintf("/servers/%d", id), nil, &resp); err != nil {
+		return err
+	}
+	return c.waitAction(resp.Action)
+}
+
+// newHetznerSSHKey generates a key to log in to the rescue system with, and
+// returns it with its public key in authorized_keys format
+func newHetznerSSHKey() (ssh.Signer, string, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// writeRescueDisk waits for the rescue system at ip to accept ssh
+// connections, and writes the image read from r to the disk of the server
+func writeRescueDisk(ip string, signer ssh.Signer, r io.Reader) error {
+	config := &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// the rescue system has a new host key at every boot
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	addr := net.JoinHostPort(ip, "22")
+	var client *ssh.Client
+	var err error
+	for deadline := time.Now().Add(5 * time.Minute); time.Now().Before(deadline); time.Sleep(5 * time.Second) {
+		if client, err = ssh.Dial("tcp", addr, config); err == nil {
+			break
+		}
+		log.Debugf("Hetzner: waiting for the rescue system: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to connect to the rescue system: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = r
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run("dd of=/dev/sda bs=4M conv=fsync"); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkHostResources checks that the host has the CPUs and the memory in MB
+// a local VM is run with, as hypervisors otherwise fail with errors which are
+// hard to act on or the host starts swapping. The disks which are created are
+// only warned about if they may not fit, as they are allocated as the VM
+// writes to them. Disks without a path are created in the state directory.
+func checkHostResources(cpus, memory int, disks Disks, state string) error {
+	if cpus > runtime.NumCPU() {
+		return fmt.Errorf("Cannot run a VM with %d CPUs, the host only has %d, use -cpus %d or less", cpus, runtime.NumCPU(), runtime.NumCPU())
+	}
+	total, available, err := hostMemory()
+	if err != nil {
+		log.Debugf("Cannot find the memory of the host: %v", err)
+	}
+	mb := uint64(memory)
+	switch {
+	case total != 0 && mb > total:
+		return fmt.Errorf("Cannot run a VM with %d MB of memory, the host only has %d MB, use a smaller -mem", memory, total)
+	case available != 0 && mb > available:
+		log.Warnf("The VM has %d MB of memory, but only %d MB are available on the host, which may start swapping", memory, available)
+	}
+
+	// the disks which are created, by directory
+	sizes := map[string]uint64{}
+	for _, d := range disks {
+		if d.Size == 0 {
+			continue
+		}
+		dir := state
+		if d.Path != "" {
+			if _, err := os.Stat(d.Path); err == nil {
+				continue
+			}
+			dir = filepath.Dir(d.Path)
+		}
+		sizes[dir] += uint64(d.Size)
+	}
+	dirs := make([]string, 0, len(sizes))
+	for dir := range sizes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		free, err := hostFreeDisk(dir)
+		if err != nil {
+			log.Debugf("Cannot find the free space of %s: %v", dir, err)
+			continue
+		}
+		if free != 0 && sizes[dir] > free {
+			log.Warnf("The disks created in %s have %d MB, but only %d MB are free, the VM may fail to write to them once they are full", dir, sizes[dir], free)
+		}
+	}
+	return nil
+}
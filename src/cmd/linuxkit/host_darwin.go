@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostMemory returns the total memory of the host in MB, the available
+// memory is not known
+func hostMemory() (uint64, uint64, error) {
+	total, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, 0, err
+	}
+	return total / (1024 * 1024), 0, nil
+}
+
+// hostFreeDisk returns the space in MB which is free in the directory
+func hostFreeDisk(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize) / (1024 * 1024), nil
+}
+
+// hvfAvailable checks that the Hypervisor framework can be used
+func hvfAvailable() error {
+	if supported, err := unix.SysctlUint32("kern.hv_support"); err != nil || supported != 1 {
+		return fmt.Errorf("HVF is not available, the Mac does not support the Hypervisor framework")
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "fmt"
+
+// hostMemory returns the total and the available memory of the host in MB,
+// which are not known
+func hostMemory() (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+// hostFreeDisk returns the space in MB which is free in the directory, which
+// is not known
+func hostFreeDisk(dir string) (uint64, error) {
+	return 0, nil
+}
+
+// hvfAvailable checks that the Hypervisor framework can be used
+func hvfAvailable() error {
+	return fmt.Errorf("HVF is only available on macOS")
+}
@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 package main
@@ -5,10 +6,25 @@ package main
 // Fallback implementation
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"net"
 )
 
-func hypervStartConsole(vmName string) error {
+func hypervDialConsole(vmName string) (net.Conn, error) {
+	return nil, fmt.Errorf("Hyper-V is only supported on Windows")
+}
+
+func hypervDialVsock(vmName string, port uint32) (net.Conn, error) {
+	return nil, fmt.Errorf("Hyper-V is only supported on Windows")
+}
+
+func hypervListenVsock(vmName string, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("Hyper-V is only supported on Windows")
+}
+
+func hypervStartConsole(vmName string, out io.Writer) error {
 	log.Fatalf("This function should not be called")
 	return nil
 }
@@ -6,10 +6,12 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/exec"
 	"time"
 
 	"github.com/Azure/go-ansiterm/winterm"
 	"github.com/Microsoft/go-winio"
+	"github.com/linuxkit/virtsock/pkg/hvsock"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,37 +24,44 @@ const (
 	disableNewlineAutoReturn        = 0x0008
 )
 
-func hypervStartConsole(vmName string) error {
+// hypervDialConsole connects to the named pipe of the serial port of a VM,
+// which only exists once the VM is started
+func hypervDialConsole(vmName string) (net.Conn, error) {
+	timeout := time.Second
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		c, err := winio.DialPipe(hypervConsolePipe(vmName), &timeout)
+		if err == nil {
+			return c, nil
+		}
+		// Argh, different Windows versions seem to
+		// return different errors and we can't easily
+		// catch the error. On some versions it is
+		// winio.ErrTimeout...
+		// Instead poll until the deadline and then error out
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		log.Debugf("Connect to console: %v", err)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func hypervStartConsole(vmName string, out io.Writer) error {
 	if err := hypervConfigureConsole(); err != nil {
 		log.Infof("Configure Console: %v", err)
 	}
 
-	pipeName := fmt.Sprintf(`\\.\pipe\%s-com1`, vmName)
-	var c net.Conn
-	var err error
-	for count := 1; count < 100; count++ {
-		c, err = winio.DialPipe(pipeName, nil)
-		defer c.Close()
-		if err != nil {
-			// Argh, different Windows versions seem to
-			// return different errors and we can't easily
-			// catch the error. On some versions it is
-			// winio.ErrTimeout...
-			// Instead poll 100 times and then error out
-			log.Infof("Connect to console: %v", err)
-			time.Sleep(10 * 1000 * 1000 * time.Nanosecond)
-			continue
-		}
-		break
-	}
+	c, err := hypervDialConsole(vmName)
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 
 	log.Info("Connected")
 	go io.Copy(c, os.Stdin)
 
-	_, err = io.Copy(os.Stdout, c)
+	_, err = io.Copy(out, c)
 	if err != nil {
 		return err
 	}
@@ -99,3 +108,53 @@ func hypervRestoreConsole() {
 	winterm.SetConsoleMode(os.Stdout.Fd(), hypervStdoutMode)
 	winterm.SetConsoleMode(os.Stderr.Fd(), hypervStderrMode)
 }
+
+// hypervDialVsock connects to a vsock port of a Hyper-V VM given its name
+// over a Hyper-V socket
+func hypervDialVsock(vmName string, port uint32) (net.Conn, error) {
+	if powershell == "" {
+		if powershell, _ = exec.LookPath("powershell.exe"); powershell == "" {
+			return nil, fmt.Errorf("Could not find powershell executable")
+		}
+	}
+	addr, err := hypervVsockAddr(vmName, port)
+	if err != nil {
+		return nil, err
+	}
+	c, err := hvsock.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to port %x of the Hyper-V VM %s: %v", port, vmName, err)
+	}
+	return c, nil
+}
+
+// hypervListenVsock listens for connections of a Hyper-V VM given its name to
+// a vsock port of the host
+func hypervListenVsock(vmName string, port uint32) (net.Listener, error) {
+	addr, err := hypervVsockAddr(vmName, port)
+	if err != nil {
+		return nil, err
+	}
+	l, err := hvsock.Listen(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on port %x for the Hyper-V VM %s: %v", port, vmName, err)
+	}
+	return l, nil
+}
+
+// hypervVsockAddr is the Hyper-V socket address of a vsock port of a VM
+func hypervVsockAddr(vmName string, port uint32) (hvsock.Addr, error) {
+	out, _, err := poshCmd(fmt.Sprintf("@(Get-VM -Name %s).Id.Guid", poshString(vmName)))
+	if err != nil {
+		return hvsock.Addr{}, fmt.Errorf("Could not find the Hyper-V VM %s: %v", vmName, err)
+	}
+	vmID, err := hvsock.GUIDFromString(splitLines(out)[0])
+	if err != nil {
+		return hvsock.Addr{}, fmt.Errorf("Could not find the Hyper-V VM %s: %v", vmName, err)
+	}
+	serviceID, err := hvsock.GUIDFromString(hypervVsockService(port))
+	if err != nil {
+		return hvsock.Addr{}, err
+	}
+	return hvsock.Addr{VMID: vmID, ServiceID: serviceID}, nil
+}
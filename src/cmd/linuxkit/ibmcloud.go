@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ibmcloudAPIKeyVar        = "IBMCLOUD_API_KEY"
+	ibmcloudRegionVar        = "IBMCLOUD_REGION"
+	ibmcloudBucketVar        = "IBMCLOUD_COS_BUCKET"     // non-standard
+	ibmcloudResourceGroupVar = "IBMCLOUD_RESOURCE_GROUP" // non-standard
+	ibmcloudDefaultRegion    = "us-south"
+
+	ibmcloudIAMURL     = "https://iam.cloud.ibm.com/identity/token"
+	ibmcloudTaggingURL = "https://tags.global-search-tagging.cloud.ibm.com/v3/tags/attach"
+	// The date of the VPC API version used
+	ibmcloudVPCVersion = "2024-04-30"
+	ibmcloudTimeout    = 30 * time.Minute
+)
+
+// IBMCloudClient is a client for IBM Cloud Object Storage and the VPC API,
+// authenticated with an IAM token for an API key
+type IBMCloudClient struct {
+	region string
+	token  string
+	client *http.Client
+}
+
+// NewIBMCloudClient exchanges the API key for an IAM token
+func NewIBMCloudClient(apiKey, region string) (*IBMCloudClient, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("An API key must be set with -api-key or %s", ibmcloudAPIKeyVar)
+	}
+	c := &IBMCloudClient{region: region, client: &http.Client{}}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ibm:params:oauth:grant-type:apikey")
+	form.Set("apikey", apiKey)
+	resp, err := c.client.PostForm(ibmcloudIAMURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("Cannot decode IAM response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot get IAM token: %s: %s", resp.Status, token.ErrorMessage)
+	}
+	c.token = token.AccessToken
+	return c, nil
+}
+
+func (c *IBMCloudClient) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	log.Debugf("IBM Cloud: %s %s", req.Method, req.URL)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		var e struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+			msg = e.Errors[0].Message
+		}
+		return nil, fmt.Errorf("%s %s failed: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// vpc sends a request to the VPC API and decodes the response into out
+func (c *IBMCloudClient) vpc(method, path string, query url.Values, in, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("version", ibmcloudVPCVersion)
+	query.Set("generation", "2")
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := fmt.Sprintf("https://%s.iaas.cloud.ibm.com/v1%s?%s", c.region, path, query.Encode())
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// UploadFile uploads a file to a Cloud Object Storage bucket in the region,
+// in parts uploaded in parallel if it is large, see multipartUpload
+func (c *IBMCloudClient) UploadFile(path, bucket, object string, tags Tags, opts uploadOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	u := fmt.Sprintf("https://s3.%s.cloud-object-storage.appdomain.cloud/%s/%s", c.region, bucket, url.PathEscape(object))
+	var tagging string
+	if len(tags) > 0 {
+		values := url.Values{}
+		for _, tag := range tags {
+			values.Set(tag.Key, tag.Value)
+		}
+		tagging = values.Encode()
+	}
+	send := func(method, query string, body io.Reader, length int64) (*http.Response, error) {
+		target := u
+		if query != "" {
+			target += "?" + query
+		}
+		req, err := http.NewRequest(method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = length
+		// the tags are set when the object is created
+		if tagging != "" && (query == "" || query == "uploads") {
+			req.Header.Set("x-amz-tagging", tagging)
+		}
+		if query == "" || query == "uploads" {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return c.send(req)
+	}
+
+	progress := newUploadProgress(object, size)
+	defer progress.Finish()
+	if size <= multipartPartSize {
+		resp, err := send(http.MethodPut, "", progress.Reader(f), size)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return multipartUpload(f, u, size, opts, progress, send)
+}
+
+// ibmcloudResource is the common part of VPC API resources
+type ibmcloudResource struct {
+	ID     string `json:"id"`
+	CRN    string `json:"crn"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// attachTags attaches user tags, which are key:value strings in IBM Cloud,
+// to a resource
+func (c *IBMCloudClient) attachTags(crn string, tags Tags) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var names []string
+	for _, tag := range tags {
+		if tag.Value == "" {
+			names = append(names, tag.Key)
+		} else {
+			names = append(names, tag.Key+":"+tag.Value)
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resources": []map[string]string{{"resource_id": crn}},
+		"tag_names": names,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, ibmcloudTaggingURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// wait polls a resource until it has the given status
+func (c *IBMCloudClient) wait(path, status string) error {
+	deadline := time.Now().Add(ibmcloudTimeout)
+	for time.Now().Before(deadline) {
+		var r ibmcloudResource
+		if err := c.vpc(http.MethodGet, path, nil, nil, &r); err != nil {
+			return err
+		}
+		log.Debugf("IBM Cloud: %s is %s", path, r.Status)
+		switch r.Status {
+		case status:
+			return nil
+		case "failed", "deleting":
+			return fmt.Errorf("%s %s is %s", path, r.Name, r.Status)
+		}
+		time.Sleep(10 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for %s to be %s", path, status)
+}
+
+// CreateImage creates a custom image from a qcow2 image in Cloud Object
+// Storage and waits for it to be available
+func (c *IBMCloudClient) CreateImage(name, bucket, object, osName, resourceGroup string, tags Tags) (string, error) {
+	req := map[string]interface{}{
+		"name":             name,
+		"file":             map[string]string{"href": fmt.Sprintf("cos://%s/%s/%s", c.region, bucket, object)},
+		"operating_system": map[string]string{"name": osName},
+	}
+	if resourceGroup != "" {
+		req["resource_group"] = map[string]string{"id": resourceGroup}
+	}
+	var image ibmcloudResource
+	if err := c.vpc(http.MethodPost, "/images", nil, req, &image); err != nil {
+		return "", err
+	}
+	if err := c.wait("/images/"+image.ID, "available"); err != nil {
+		return "", err
+	}
+	if err := c.attachTags(image.CRN, tags); err != nil {
+		return image.ID, fmt.Errorf("Cannot tag image %s: %v", image.ID, err)
+	}
+	return image.ID, nil
+}
+
+// FindImage returns the ID of the image with the given name
+func (c *IBMCloudClient) FindImage(name string) (string, error) {
+	var images struct {
+		Images []ibmcloudResource `json:"images"`
+	}
+	if err := c.vpc(http.MethodGet, "/images", url.Values{"name": {name}}, nil, &images); err != nil {
+		return "", err
+	}
+	if len(images.Images) == 0 {
+		return "", fmt.Errorf("Unable to find image with name %s", name)
+	}
+	return images.Images[0].ID, nil
+}
+
+// IBMCloudInstanceConfig is the configuration of an instance to create
+type IBMCloudInstanceConfig struct {
+	Name          string
+	Profile       string
+	Zone          string
+	ImageID       string
+	SubnetID      string
+	ResourceGroup string
+	Keys          []string
+	UserData      string
+	Tags          Tags
+}
+
+// CreateInstance creates an instance and waits for it to be running. It
+// returns the ID and the primary IP address of the instance, which is
+// deleted if the run fails or is interrupted before keepResources is called.
+func (c *IBMCloudClient) CreateInstance(config IBMCloudInstanceConfig) (string, string, error) {
+	req := map[string]interface{}{
+		"name":    config.Name,
+		"profile": map[string]string{"name": config.Profile},
+		"zone":    map[string]string{"name": config.Zone},
+		"image":   map[string]string{"id": config.ImageID},
+		"primary_network_interface": map[string]interface{}{
+			"subnet": map[string]string{"id": config.SubnetID},
+		},
+	}
+	if config.ResourceGroup != "" {
+		req["resource_group"] = map[string]string{"id": config.ResourceGroup}
+	}
+	if len(config.Keys) > 0 {
+		var keys []map[string]string
+		for _, k := range config.Keys {
+			keys = append(keys, map[string]string{"id": k})
+		}
+		req["keys"] = keys
+	}
+	if config.UserData != "" {
+		req["user_data"] = config.UserData
+	}
+	var instance struct {
+		ibmcloudResource
+		PrimaryNetworkInterface struct {
+			PrimaryIP struct {
+				Address string `json:"address"`
+			} `json:"primary_ip"`
+		} `json:"primary_network_interface"`
+	}
+	if err := c.vpc(http.MethodPost, "/instances", nil, req, &instance); err != nil {
+		return "", "", err
+	}
+	onCleanup("instance "+instance.ID, func() error { return c.DeleteInstance(instance.ID) })
+	if err := c.attachTags(instance.CRN, config.Tags); err != nil {
+		return instance.ID, "", fmt.Errorf("Cannot tag instance %s: %v", instance.ID, err)
+	}
+	if err := c.wait("/instances/"+instance.ID, "running"); err != nil {
+		return instance.ID, "", err
+	}
+	// the address is only assigned once the instance is running
+	if err := c.vpc(http.MethodGet, "/instances/"+instance.ID, nil, nil, &instance); err != nil {
+		return instance.ID, "", err
+	}
+	return instance.ID, instance.PrimaryNetworkInterface.PrimaryIP.Address, nil
+}
+
+// DeleteInstance deletes an instance and its boot volume
+func (c *IBMCloudClient) DeleteInstance(id string) error {
+	return c.vpc(http.MethodDelete, "/instances/"+id, nil, nil, nil)
+}
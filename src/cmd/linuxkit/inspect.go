@@ -0,0 +1,788 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/iso"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	log "github.com/sirupsen/logrus"
+	cpio "github.com/surma/gocpio"
+)
+
+// inspectMaxKernel is the largest decompressed kernel searched for its version
+const inspectMaxKernel = 256 << 20
+
+// inspectReport is what 'linuxkit inspect' reports about a built output
+type inspectReport struct {
+	Path          string               `json:"path"`
+	Format        string               `json:"format"`
+	KernelVersion string               `json:"kernelVersion,omitempty"`
+	Cmdline       string               `json:"cmdline,omitempty"`
+	BuiltBy       string               `json:"builtBy,omitempty"`
+	Architecture  string               `json:"architecture,omitempty"`
+	Images        []moby.ManifestImage `json:"images"`
+	Files         []inspectFile        `json:"files"`
+	// Manifest is false for outputs built without a manifest, for which
+	// the images are found by their bundles and have no digests
+	Manifest bool `json:"manifest"`
+}
+
+type inspectFile struct {
+	moby.ManifestFile
+	Contents *string `json:"contents,omitempty"`
+}
+
+// inspectImageReport is what 'linuxkit inspect' reports about an image in the cache
+type inspectImageReport struct {
+	Image        string            `json:"image"`
+	Digest       string            `json:"digest"`
+	Architecture string            `json:"architecture"`
+	Manifest     string            `json:"manifest"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Layers       []string          `json:"layers"`
+}
+
+// inspectWalkFunc is called for each entry of the filesystem of an output,
+// with the contents of files
+type inspectWalkFunc func(name string, dir bool, r io.Reader) error
+
+// inspectArtifact is a built output, with the kernel and cmdline found
+// outside of its filesystem
+type inspectArtifact struct {
+	format string
+	// files are the files of the output
+	files   []string
+	kernel  []byte
+	cmdline string
+	walk    func(fn inspectWalkFunc) error
+}
+
+func inspect(args []string) {
+	flags := newFlagSet("inspect")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s inspect [options] [path|image]\n\n", invoked)
+		fmt.Printf("Report the kernel version, cmdline, images and files of a built output,\n")
+		fmt.Printf("which is one of the kernel+initrd files, an initrd, tar, ISO or raw disk\n")
+		fmt.Printf("image, or the configuration and layers of an image in the cache.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	formatFlag := flags.String("format", "text", "Output format, text or json")
+	contentsFlag := flags.Bool("contents", false, "Include the contents of the files of the files section")
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	archFlag := flags.String("arch", runtime.GOARCH, "Architecture of an image in the cache")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 1 {
+		fmt.Println("Please specify a built output or an image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *formatFlag != "text" && *formatFlag != "json" {
+		log.Fatalf("Unknown format %s", *formatFlag)
+	}
+	name := remArgs[0]
+
+	var report interface{}
+	if output, ok := outputPath(name); ok {
+		name = output
+		r, err := inspectOutput(name, *contentsFlag)
+		if err != nil {
+			log.Fatalf("Unable to inspect %s: %v", name, err)
+		}
+		report = r
+	} else {
+		r, err := inspectCachedImage(name, *cacheDir, *archFlag)
+		if err != nil {
+			log.Fatalf("Unable to inspect %s: %v", name, err)
+		}
+		report = r
+	}
+
+	if *formatFlag == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	switch r := report.(type) {
+	case *inspectReport:
+		r.print()
+	case *inspectImageReport:
+		r.print()
+	}
+}
+
+// outputPath returns the path of a built output, which may be given by the
+// base name of its kernel+initrd files, and whether it exists
+func outputPath(name string) (string, bool) {
+	if _, err := os.Stat(name); err == nil {
+		return name, true
+	}
+	if _, err := os.Stat(name + "-initrd.img"); err == nil {
+		return name + "-initrd.img", true
+	}
+	return name, false
+}
+
+// bundleName returns the name of the image of a bundle in the containers
+// directory, without the order prefix of the onboot and onshutdown bundles
+func bundleName(section, dir string) string {
+	if section != "onboot" && section != "onshutdown" {
+		return dir
+	}
+	if len(dir) > 4 && dir[3] == '-' && strings.Trim(dir[:3], "0123456789") == "" {
+		return dir[4:]
+	}
+	return dir
+}
+
+// inspectOutput returns the report on the built output at name
+func inspectOutput(name string, contents bool) (*inspectReport, error) {
+	a, err := openArtifact(name)
+	if err != nil {
+		return nil, err
+	}
+	report := &inspectReport{Path: name, Format: a.format, Images: []moby.ManifestImage{}, Files: []inspectFile{}}
+
+	var manifest *moby.Manifest
+	var modules string
+	bundles := map[string]bool{}
+	err = a.walk(func(name string, dir bool, r io.Reader) error {
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		parts := strings.Split(name, "/")
+		switch {
+		case name == moby.ManifestPath && !dir:
+			manifest = &moby.Manifest{}
+			if err := json.NewDecoder(r).Decode(manifest); err != nil {
+				return fmt.Errorf("Invalid manifest: %v", err)
+			}
+		case name == "boot/kernel" && !dir && a.kernel == nil:
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			a.kernel = b
+		case name == "boot/cmdline" && !dir && a.cmdline == "":
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			a.cmdline = strings.TrimSpace(string(b))
+		case len(parts) >= 3 && parts[0] == "lib" && parts[1] == "modules" && modules == "":
+			modules = parts[2]
+		case len(parts) >= 3 && parts[0] == "containers":
+			bundles[parts[1]+"/"+parts[2]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Cmdline = a.cmdline
+	report.KernelVersion = kernelVersion(a.kernel)
+	if report.KernelVersion == "" {
+		report.KernelVersion = modules
+	}
+	if manifest == nil {
+		// outputs built before the manifest only have the names of the bundles
+		var names []string
+		for b := range bundles {
+			names = append(names, b)
+		}
+		sort.Strings(names)
+		for _, section := range []string{"onboot", "onshutdown", "services"} {
+			for _, b := range names {
+				if strings.HasPrefix(b, section+"/") {
+					report.Images = append(report.Images, moby.ManifestImage{Section: section, Name: bundleName(section, strings.TrimPrefix(b, section+"/"))})
+				}
+			}
+		}
+		return report, nil
+	}
+
+	report.Manifest = true
+	report.BuiltBy = manifest.Version
+	report.Architecture = manifest.Architecture
+	if report.Cmdline == "" {
+		report.Cmdline = manifest.Cmdline
+	}
+	if manifest.Kernel != nil {
+		report.Images = append(report.Images, *manifest.Kernel)
+	}
+	report.Images = append(report.Images, manifest.Images...)
+	for _, f := range manifest.Files {
+		report.Files = append(report.Files, inspectFile{ManifestFile: f})
+	}
+	if !contents {
+		return report, nil
+	}
+	files := map[string]*inspectFile{}
+	for i := range report.Files {
+		if report.Files[i].Type == "file" {
+			files[strings.TrimPrefix(report.Files[i].Path, "/")] = &report.Files[i]
+		}
+	}
+	// the files section may be overwritten by later entries, so the last is kept
+	err = a.walk(func(name string, dir bool, r io.Reader) error {
+		if f, ok := files[strings.TrimPrefix(path.Clean("/"+name), "/")]; ok && !dir {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			s := string(b)
+			f.Contents = &s
+		}
+		return nil
+	})
+	return report, err
+}
+
+// openArtifact finds the format of the output at name, by its suffix for
+// the kernel+initrd files and otherwise by its contents
+func openArtifact(name string) (*inspectArtifact, error) {
+	for _, suffix := range []string{"-kernel", "-initrd.img", "-cmdline"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, suffix)
+		a := &inspectArtifact{format: "kernel+initrd"}
+		for _, suffix := range []string{"-kernel", "-initrd.img", "-cmdline"} {
+			if _, err := os.Stat(base + suffix); err == nil {
+				a.files = append(a.files, base+suffix)
+			}
+		}
+		if b, err := ioutil.ReadFile(base + "-kernel"); err == nil {
+			a.kernel = b
+		}
+		if b, err := ioutil.ReadFile(base + "-cmdline"); err == nil {
+			a.cmdline = strings.TrimSpace(string(b))
+		}
+		a.walk = func(fn inspectWalkFunc) error {
+			f, err := os.Open(base + "-initrd.img")
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return walkInitrd(f, fn)
+		}
+		return a, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 16*2048+8)
+	n, err := io.ReadFull(f, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// outputs smaller than the header are recognised by what there is
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header = header[:n]
+
+	var a *inspectArtifact
+	switch {
+	case len(header) > 16*2048+6 && string(header[16*2048+1:16*2048+6]) == "CD001":
+		a, err = openISO(name)
+	case len(header) > 262 && string(header[257:262]) == "ustar":
+		a, err = openTar(name)
+	case len(header) > 6 && (bytes.HasPrefix(header, []byte{0x1f, 0x8b}) || string(header[:6]) == "070701"):
+		a = &inspectArtifact{
+			format: "initrd",
+			walk: func(fn inspectWalkFunc) error {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return walkInitrd(f, fn)
+			},
+		}
+	case len(header) > 512 && header[510] == 0x55 && header[511] == 0xaa:
+		a, err = openRaw(name)
+	default:
+		return nil, fmt.Errorf("unsupported format, only kernel+initrd, initrd, tar, ISO and raw disk images can be inspected")
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.files = []string{name}
+	return a, nil
+}
+
+// openTar opens a filesystem tarball, or a tar-kernel-initrd tarball
+func openTar(name string) (*inspectArtifact, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &inspectArtifact{format: "tar"}
+	initrd := false
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Name {
+		case "kernel":
+			if a.kernel, err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case "cmdline":
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			a.cmdline = strings.TrimSpace(string(b))
+		case "initrd.img":
+			initrd = true
+		}
+	}
+
+	if !initrd {
+		a.walk = func(fn inspectWalkFunc) error {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return walkTar(f, fn)
+		}
+		return a, nil
+	}
+	a.format = "tar-kernel-initrd"
+	a.walk = func(fn inspectWalkFunc) error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return err
+			}
+			if hdr.Name == "initrd.img" {
+				return walkInitrd(tr, fn)
+			}
+		}
+	}
+	return a, nil
+}
+
+// openISO opens an ISO image, which has the whole filesystem
+func openISO(name string) (*inspectArtifact, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := iso.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &inspectArtifact{format: "iso"}
+	for _, cfg := range []string{"isolinux/isolinux.cfg", "EFI/BOOT/grub.cfg"} {
+		if c, err := r.Open(cfg); err == nil {
+			if b, err := ioutil.ReadAll(c); err == nil {
+				a.cmdline = bootloaderCmdline(string(b))
+				break
+			}
+		}
+	}
+	a.walk = func(fn inspectWalkFunc) error {
+		return walkISO(r, "", fn)
+	}
+	return a, nil
+}
+
+func walkISO(r *iso.Reader, dir string, fn inspectWalkFunc) error {
+	entries, err := r.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name)
+		if err := fn(name, e.Dir, r.OpenEntry(e)); err != nil {
+			return err
+		}
+		if e.Dir {
+			if err := walkISO(r, name, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openRaw opens a raw disk image, with the kernel, initrd and bootloader
+// configuration on a FAT partition
+func openRaw(name string) (*inspectArtifact, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := partitionOffsets(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, offset := range offsets {
+		fat, err := iso.NewFATReader(io.NewSectionReader(f, offset, 1<<62))
+		if err != nil {
+			continue
+		}
+		var initrd string
+		for _, n := range []string{"initrd.img", "boot/initrd.img"} {
+			if _, err := fat.Open(n); err == nil {
+				initrd = n
+				break
+			}
+		}
+		if initrd == "" {
+			continue
+		}
+		a := &inspectArtifact{format: "raw"}
+		for _, n := range []string{"kernel", "boot/kernel", "vmlinuz"} {
+			if r, err := fat.Open(n); err == nil {
+				if a.kernel, err = ioutil.ReadAll(r); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if r, err := fat.Open("cmdline"); err == nil {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			a.cmdline = strings.TrimSpace(string(b))
+		}
+		for _, cfg := range []string{"syslinux.cfg", "boot/syslinux/syslinux.cfg", "EFI/BOOT/grub.cfg"} {
+			if a.cmdline != "" {
+				break
+			}
+			if r, err := fat.Open(cfg); err == nil {
+				if b, err := ioutil.ReadAll(r); err == nil {
+					a.cmdline = bootloaderCmdline(string(b))
+				}
+			}
+		}
+		a.walk = func(fn inspectWalkFunc) error {
+			r, err := fat.Open(initrd)
+			if err != nil {
+				return err
+			}
+			return walkInitrd(r, fn)
+		}
+		return a, nil
+	}
+	f.Close()
+	return nil, fmt.Errorf("no FAT partition with an initrd found")
+}
+
+// partitionOffsets returns the byte offsets of the filesystem of a disk
+// image without a partition table, and of the partitions in its MBR or GPT
+func partitionOffsets(r io.ReaderAt) ([]int64, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	offsets := []int64{0}
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i : 446+16*(i+1)]
+		if entry[4] == 0 {
+			continue
+		}
+		if entry[4] != 0xee {
+			offsets = append(offsets, int64(binary.LittleEndian.Uint32(entry[8:12]))*512)
+			continue
+		}
+		gpt := make([]byte, 512)
+		if _, err := r.ReadAt(gpt, 512); err != nil {
+			return nil, err
+		}
+		if string(gpt[:8]) != "EFI PART" {
+			continue
+		}
+		lba := int64(binary.LittleEndian.Uint64(gpt[72:80]))
+		count := int(binary.LittleEndian.Uint32(gpt[80:84]))
+		size := int(binary.LittleEndian.Uint32(gpt[84:88]))
+		if count > 256 || size < 128 || size > 4096 {
+			return nil, fmt.Errorf("invalid GUID partition table")
+		}
+		entries := make([]byte, count*size)
+		if _, err := r.ReadAt(entries, lba*512); err != nil {
+			return nil, err
+		}
+		for j := 0; j < count; j++ {
+			e := entries[j*size : (j+1)*size]
+			if first := int64(binary.LittleEndian.Uint64(e[32:40])); first != 0 {
+				offsets = append(offsets, first*512)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// bootloaderCmdline returns the kernel cmdline in a syslinux or grub configuration
+func bootloaderCmdline(cfg string) string {
+	for _, line := range strings.Split(cfg, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 1 && strings.EqualFold(fields[0], "APPEND"):
+			return strings.Join(fields[1:], " ")
+		case len(fields) > 2 && (fields[0] == "linux" || fields[0] == "linuxefi"):
+			return strings.TrimSuffix(strings.Join(fields[2:], " "), " text")
+		}
+	}
+	return ""
+}
+
+func walkTar(r io.Reader, fn inspectWalkFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr.Name, hdr.Typeflag == tar.TypeDir, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkInitrd walks the cpio archives of an initrd, which may be compressed
+// and may follow an uncompressed microcode archive
+func walkInitrd(r io.Reader, fn inspectWalkFunc) error {
+	br := bufio.NewReader(r)
+	for {
+		// archives are padded with zeros
+		b, err := br.Peek(2)
+		for err == nil && b[0] == 0 {
+			br.Discard(1)
+			b, err = br.Peek(2)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] == 0x1f && b[1] == 0x8b {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return err
+			}
+			return walkCpio(bufio.NewReader(gz), fn)
+		}
+		if err := walkCpio(br, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func walkCpio(r io.Reader, fn inspectWalkFunc) error {
+	cr := cpio.NewReader(r)
+	for {
+		hdr, err := cr.Next()
+		if err != nil {
+			return fmt.Errorf("Invalid initrd: %v", err)
+		}
+		if hdr.IsTrailer() {
+			return nil
+		}
+		if err := fn(hdr.Name, hdr.Type == cpio.TYPE_DIR, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// kernelVersion returns the version of a kernel, from the header of an
+// x86 bzImage or the banner of an uncompressed or gzipped kernel
+func kernelVersion(kernel []byte) string {
+	if len(kernel) > 0x210 && string(kernel[0x202:0x206]) == "HdrS" {
+		off := int(binary.LittleEndian.Uint16(kernel[0x20e:])) + 0x200
+		if off < len(kernel) {
+			if fields := strings.Fields(string(kernel[off:])); len(fields) > 0 {
+				return strings.SplitN(fields[0], "\x00", 2)[0]
+			}
+		}
+	}
+	if bytes.HasPrefix(kernel, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(kernel))
+		if err != nil {
+			return ""
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(gz, inspectMaxKernel))
+		if err != nil && len(b) == 0 {
+			return ""
+		}
+		kernel = b
+	}
+	banner := []byte("Linux version ")
+	if i := bytes.Index(kernel, banner); i >= 0 {
+		end := i + len(banner) + 256
+		if end > len(kernel) {
+			end = len(kernel)
+		}
+		if fields := strings.Fields(string(kernel[i+len(banner) : end])); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func (r *inspectReport) print() {
+	fmt.Printf("Path:      %s\n", r.Path)
+	fmt.Printf("Format:    %s\n", r.Format)
+	if r.KernelVersion != "" {
+		fmt.Printf("Kernel:    %s\n", r.KernelVersion)
+	}
+	if r.Cmdline != "" {
+		fmt.Printf("Cmdline:   %s\n", r.Cmdline)
+	}
+	if r.Architecture != "" {
+		fmt.Printf("Arch:      %s\n", r.Architecture)
+	}
+	if r.BuiltBy != "" {
+		fmt.Printf("Built by:  linuxkit %s\n", r.BuiltBy)
+	}
+	if !r.Manifest {
+		fmt.Printf("\nThe output has no manifest, so the images have no digests and the files are not known.\n")
+	}
+	fmt.Printf("\nImages:\n")
+	for _, i := range r.Images {
+		fmt.Printf("  %-10s %-20s %s %s\n", i.Section, i.Name, i.Image, i.Digest)
+	}
+	if !r.Manifest {
+		return
+	}
+	fmt.Printf("\nFiles:\n")
+	for _, f := range r.Files {
+		detail := f.Linkname
+		if f.Type == "file" {
+			detail = fmt.Sprintf("%d %s", f.Size, f.Digest)
+		}
+		fmt.Printf("  %-9s %s %d:%d %s %s\n", f.Type, f.Mode, f.UID, f.GID, f.Path, detail)
+		if f.Contents != nil {
+			for _, line := range strings.Split(strings.TrimSuffix(*f.Contents, "\n"), "\n") {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+}
+
+// inspectCachedImage returns the report on an image in the cache
+func inspectCachedImage(name, cacheDir, architecture string) (*inspectImageReport, error) {
+	ref, err := reference.Parse(moby.ReferenceExpand(name))
+	if err != nil {
+		return nil, fmt.Errorf("not a file or an image reference: %v", err)
+	}
+	desc, err := cachepkg.FindDescriptor(cacheDir, ref.String())
+	if err != nil {
+		return nil, fmt.Errorf("not a file or an image in the cache: %v", err)
+	}
+	img, err := cachepkg.FindImage(cacheDir, ref.String(), architecture)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	report := &inspectImageReport{
+		Image:        ref.String(),
+		Digest:       desc.Digest.String(),
+		Architecture: architecture,
+		Manifest:     manifest.String(),
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		Env:          config.Config.Env,
+		Labels:       config.Config.Labels,
+		Layers:       []string{},
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		report.Layers = append(report.Layers, d.String())
+	}
+	return report, nil
+}
+
+func (r *inspectImageReport) print() {
+	fmt.Printf("Image:         %s\n", r.Image)
+	fmt.Printf("Digest:        %s\n", r.Digest)
+	fmt.Printf("Architecture:  %s\n", r.Architecture)
+	fmt.Printf("Manifest:      %s\n", r.Manifest)
+	if len(r.Entrypoint) > 0 {
+		fmt.Printf("Entrypoint:    %s\n", strings.Join(r.Entrypoint, " "))
+	}
+	if len(r.Cmd) > 0 {
+		fmt.Printf("Cmd:           %s\n", strings.Join(r.Cmd, " "))
+	}
+	for _, e := range r.Env {
+		fmt.Printf("Env:           %s\n", e)
+	}
+	var labels []string
+	for k := range r.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		fmt.Printf("Label:         %s=%s\n", k, r.Labels[k])
+	}
+	fmt.Printf("\nLayers:\n")
+	for _, l := range r.Layers {
+		fmt.Printf("  %s\n", l)
+	}
+}
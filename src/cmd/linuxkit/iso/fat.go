@@ -0,0 +1,207 @@
+package iso
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A minimal FAT12 writer for the EFI boot image
+
+const (
+	fatSectorSize  = 512
+	fatRootEntries = 512
+	fatDirEntry    = 32
+	fatMaxClusters = 4084
+	fatEOC         = 0xfff
+	fatAttrDir     = 0x10
+	fatAttrArchive = 0x20
+	// 1980-01-01, the FAT epoch
+	fatDate = 1<<5 | 1
+)
+
+type fatNode struct {
+	name     string
+	data     []byte
+	dir      bool
+	children []*fatNode
+	cluster  uint16
+	clusters int
+}
+
+// shortName returns the 8.3 directory entry name. Only names which are
+// already valid short names are supported.
+func shortName(name string) ([]byte, error) {
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+	if base == "" || len(base) > 8 || len(ext) > 3 {
+		return nil, fmt.Errorf("%s is not a valid FAT short name", name)
+	}
+	b := []byte(fmt.Sprintf("%-8s%-3s", strings.ToUpper(base), strings.ToUpper(ext)))
+	return b, nil
+}
+
+func fatDirent(b []byte, name []byte, attr byte, cluster uint16, size uint32) {
+	copy(b[0:11], name)
+	b[11] = attr
+	binary.LittleEndian.PutUint16(b[16:], fatDate)
+	binary.LittleEndian.PutUint16(b[18:], fatDate)
+	binary.LittleEndian.PutUint16(b[24:], fatDate)
+	binary.LittleEndian.PutUint16(b[26:], cluster)
+	binary.LittleEndian.PutUint32(b[28:], size)
+}
+
+func setFAT12(fat []byte, cluster uint16, v uint16) {
+	off := int(cluster) * 3 / 2
+	if cluster%2 == 0 {
+		fat[off] = byte(v)
+		fat[off+1] = fat[off+1]&0xf0 | byte(v>>8)&0x0f
+	} else {
+		fat[off] = fat[off]&0x0f | byte(v<<4)
+		fat[off+1] = byte(v >> 4)
+	}
+}
+
+// fatImage creates a FAT12 filesystem containing the given files, sized like
+// the mkimage-iso-efi image did with mkfs.vfat, with about 512kB to spare.
+func fatImage(files map[string][]byte) ([]byte, error) {
+	root := &fatNode{dir: true}
+	var names []string
+	var total int
+	for name := range files {
+		names = append(names, name)
+		total += len(files[name])
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := root
+		parts := strings.Split(path.Clean(name), "/")
+		for _, p := range parts[:len(parts)-1] {
+			var next *fatNode
+			for _, c := range dir.children {
+				if c.name == p && c.dir {
+					next = c
+				}
+			}
+			if next == nil {
+				next = &fatNode{name: p, dir: true}
+				dir.children = append(dir.children, next)
+			}
+			dir = next
+		}
+		dir.children = append(dir.children, &fatNode{name: parts[len(parts)-1], data: files[name]})
+	}
+
+	totalSectors := (total/1024 + 511) / 32 * 32 * 2
+	rootSectors := fatRootEntries * fatDirEntry / fatSectorSize
+	var spc, fatSectors, clusters int
+	for spc = 1; spc <= 128; spc *= 2 {
+		clusters = (totalSectors - 1 - rootSectors) / spc
+		fatSectors = ((clusters+2)*3/2 + fatSectorSize - 1) / fatSectorSize
+		clusters = (totalSectors - 1 - rootSectors - 2*fatSectors) / spc
+		if clusters <= fatMaxClusters {
+			break
+		}
+	}
+	clusterSize := spc * fatSectorSize
+
+	// allocate clusters in depth first order
+	next := uint16(2)
+	var allocate func(n *fatNode) error
+	allocate = func(n *fatNode) error {
+		size := len(n.data)
+		if n.dir {
+			size = (len(n.children) + 2) * fatDirEntry
+		}
+		n.clusters = (size + clusterSize - 1) / clusterSize
+		if n.clusters > 0 {
+			n.cluster = next
+			next += uint16(n.clusters)
+		}
+		if int(next)-2 > clusters {
+			return fmt.Errorf("FAT image is too small for its contents")
+		}
+		for _, c := range n.children {
+			if err := allocate(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range root.children {
+		if err := allocate(c); err != nil {
+			return nil, err
+		}
+	}
+
+	img := make([]byte, totalSectors*fatSectorSize)
+	boot := img[:fatSectorSize]
+	copy(boot, []byte{0xeb, 0x3c, 0x90})
+	copy(boot[3:], "LINUXKIT")
+	binary.LittleEndian.PutUint16(boot[11:], fatSectorSize)
+	boot[13] = byte(spc)
+	binary.LittleEndian.PutUint16(boot[14:], 1)
+	boot[16] = 2
+	binary.LittleEndian.PutUint16(boot[17:], fatRootEntries)
+	binary.LittleEndian.PutUint16(boot[19:], uint16(totalSectors))
+	boot[21] = 0xf8
+	binary.LittleEndian.PutUint16(boot[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(boot[24:], 32)
+	binary.LittleEndian.PutUint16(boot[26:], 64)
+	boot[38] = 0x29
+	copy(boot[43:], "EFI        FAT12   ")
+	boot[510], boot[511] = 0x55, 0xaa
+
+	fat := make([]byte, fatSectors*fatSectorSize)
+	setFAT12(fat, 0, 0xff8)
+	setFAT12(fat, 1, fatEOC)
+	rootDir := img[(1+2*fatSectors)*fatSectorSize:]
+	data := (1 + 2*fatSectors + rootSectors) * fatSectorSize
+	clusterData := func(c uint16) []byte {
+		return img[data+(int(c)-2)*clusterSize:]
+	}
+
+	var write func(n *fatNode, parent uint16, dir []byte) error
+	write = func(n *fatNode, parent uint16, dir []byte) error {
+		for j, c := range n.children {
+			name, err := shortName(c.name)
+			if err != nil {
+				return err
+			}
+			for k := 0; k < c.clusters; k++ {
+				v := uint16(fatEOC)
+				if k < c.clusters-1 {
+					v = c.cluster + uint16(k) + 1
+				}
+				setFAT12(fat, c.cluster+uint16(k), v)
+			}
+			if !c.dir {
+				fatDirent(dir[j*fatDirEntry:], name, fatAttrArchive, c.cluster, uint32(len(c.data)))
+				copy(clusterData(c.cluster), c.data)
+				continue
+			}
+			fatDirent(dir[j*fatDirEntry:], name, fatAttrDir, c.cluster, 0)
+			sub := clusterData(c.cluster)
+			fatDirent(sub, []byte(".          "), fatAttrDir, c.cluster, 0)
+			fatDirent(sub[fatDirEntry:], []byte("..         "), fatAttrDir, parent, 0)
+			if err := write(c, c.cluster, sub[2*fatDirEntry:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(root.children) > fatRootEntries {
+		return nil, fmt.Errorf("too many files in the FAT root directory")
+	}
+	if err := write(root, 0, rootDir); err != nil {
+		return nil, err
+	}
+	for j := 0; j < 2; j++ {
+		copy(img[(1+j*fatSectors)*fatSectorSize:], fat)
+	}
+	return img, nil
+}
@@ -0,0 +1,244 @@
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	fatAttrVolume = 0x08
+	fatAttrLFN    = 0x0f
+	fatDeleted    = 0xe5
+)
+
+// FATReader reads a FAT12, FAT16 or FAT32 filesystem, as on the EFI system
+// partition or the boot partition of disk images, by the long names if the
+// entries have them
+type FATReader struct {
+	r       io.ReaderAt
+	bits    int
+	fat     []byte
+	cluster int64
+	data    int64
+	// root is the root directory, which is a fixed area before the data
+	// on FAT12 and FAT16
+	root Entry
+}
+
+// NewFATReader returns a FATReader for the filesystem r
+func NewFATReader(r io.ReaderAt) (*FATReader, error) {
+	bs := make([]byte, fatSectorSize)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bs[11:13]))
+	sectorsPerCluster := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:16]))
+	fats := int64(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:19]))
+	sectors := int64(binary.LittleEndian.Uint16(bs[19:21]))
+	if sectors == 0 {
+		sectors = int64(binary.LittleEndian.Uint32(bs[32:36]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(bs[22:24]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:40]))
+	}
+	if bytesPerSector < 512 || bytesPerSector&(bytesPerSector-1) != 0 || sectorsPerCluster == 0 || fats == 0 || fatSectors == 0 {
+		return nil, fmt.Errorf("not a FAT filesystem")
+	}
+
+	f := &FATReader{r: r, cluster: bytesPerSector * sectorsPerCluster}
+	rootSectors := (rootEntries*fatDirEntry + bytesPerSector - 1) / bytesPerSector
+	f.data = (reserved + fats*fatSectors + rootSectors) * bytesPerSector
+	clusters := (sectors*bytesPerSector - f.data) / f.cluster
+	switch {
+	case clusters <= fatMaxClusters:
+		f.bits = 12
+	case clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+	}
+	if f.bits == 32 {
+		f.root = Entry{Dir: true}
+		f.root.cluster = binary.LittleEndian.Uint32(bs[44:48])
+	} else {
+		f.root = Entry{Dir: true, Size: rootEntries * fatDirEntry, offset: (reserved + fats*fatSectors) * bytesPerSector}
+	}
+	f.fat = make([]byte, fatSectors*bytesPerSector)
+	if _, err := r.ReadAt(f.fat, reserved*bytesPerSector); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// next returns the cluster following c in its chain, or 0 at its end
+func (f *FATReader) next(c uint32) uint32 {
+	var v, eoc uint32
+	switch f.bits {
+	case 12:
+		off := int(c + c/2)
+		if off+2 > len(f.fat) {
+			return 0
+		}
+		v = uint32(binary.LittleEndian.Uint16(f.fat[off:]))
+		if c%2 == 1 {
+			v >>= 4
+		}
+		v &= 0xfff
+		eoc = 0xff8
+	case 16:
+		if int(c)*2+2 > len(f.fat) {
+			return 0
+		}
+		v = uint32(binary.LittleEndian.Uint16(f.fat[c*2:]))
+		eoc = 0xfff8
+	default:
+		if int(c)*4+4 > len(f.fat) {
+			return 0
+		}
+		v = binary.LittleEndian.Uint32(f.fat[c*4:]) & 0x0fffffff
+		eoc = 0x0ffffff8
+	}
+	if v < 2 || v >= eoc {
+		return 0
+	}
+	return v
+}
+
+// OpenEntry returns a reader of the contents of the file or directory e
+func (f *FATReader) OpenEntry(e Entry) io.Reader {
+	if e.cluster == 0 {
+		return io.NewSectionReader(f.r, e.offset, e.Size)
+	}
+	var readers []io.Reader
+	// the chain is bounded by the number of clusters, in case it loops
+	for c, n := e.cluster, 0; c != 0 && n < len(f.fat); c, n = f.next(c), n+1 {
+		readers = append(readers, io.NewSectionReader(f.r, f.data+int64(c-2)*f.cluster, f.cluster))
+	}
+	r := io.MultiReader(readers...)
+	if e.Dir {
+		return r
+	}
+	return io.LimitReader(r, e.Size)
+}
+
+// Open returns a reader of the contents of the file name
+func (f *FATReader) Open(name string) (io.Reader, error) {
+	e, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEntry(e), nil
+}
+
+// ReadDir returns the entries of the directory name
+func (f *FATReader) ReadDir(name string) ([]Entry, error) {
+	d, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Dir {
+		return nil, fmt.Errorf("%s is not a directory", name)
+	}
+	return f.readDir(d)
+}
+
+// lookup finds name, ignoring case as FAT does
+func (f *FATReader) lookup(name string) (Entry, error) {
+	e := f.root
+	for _, p := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if p == "" {
+			continue
+		}
+		entries, err := f.readDir(e)
+		if err != nil {
+			return Entry{}, err
+		}
+		found := false
+		for _, c := range entries {
+			if strings.EqualFold(c.Name, p) {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			return Entry{}, fmt.Errorf("%s not found", name)
+		}
+	}
+	return e, nil
+}
+
+func (f *FATReader) readDir(d Entry) ([]Entry, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f.OpenEntry(d)); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	var entries []Entry
+	var long []uint16
+	for off := 0; off+fatDirEntry <= len(data); off += fatDirEntry {
+		de := data[off : off+fatDirEntry]
+		if de[0] == 0 {
+			break
+		}
+		if de[0] == fatDeleted {
+			long = nil
+			continue
+		}
+		if de[11] == fatAttrLFN {
+			// the parts of a long name precede the entry, last part first
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					part = append(part, binary.LittleEndian.Uint16(de[i:]))
+				}
+			}
+			long = append(part, long...)
+			continue
+		}
+		if de[11]&fatAttrVolume != 0 {
+			long = nil
+			continue
+		}
+		name := strings.TrimRight(string(de[0:8]), " ")
+		if ext := strings.TrimRight(string(de[8:11]), " "); ext != "" {
+			name += "." + ext
+		}
+		name = strings.ToLower(name)
+		if long != nil {
+			for i, c := range long {
+				if c == 0 {
+					long = long[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		}
+		if name == "." || name == ".." {
+			continue
+		}
+		e := Entry{
+			Name: name,
+			Dir:  de[11]&fatAttrDir != 0,
+			Size: int64(binary.LittleEndian.Uint32(de[28:32])),
+		}
+		e.cluster = uint32(binary.LittleEndian.Uint16(de[20:22]))<<16 | uint32(binary.LittleEndian.Uint16(de[26:28]))
+		if e.cluster == 0 {
+			// an empty file
+			e.Size = 0
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
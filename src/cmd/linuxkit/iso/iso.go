@@ -0,0 +1,369 @@
+// Package iso writes ISO 9660 images with Rock Ridge extensions and El Torito
+// boot records, so that bootable ISOs can be built without genisoimage or
+// xorriso. It also reads ISO 9660 images and FAT filesystems, to inspect
+// built images.
+package iso
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sectorSize = 2048
+	// The system area, which holds the hybrid MBR, is followed by the volume descriptors
+	systemAreaSectors = 16
+	maxFileSize       = 1<<32 - 1
+)
+
+// Image is an ISO 9660 image which is assembled in memory, with the file
+// contents spooled to a temporary file, and then written out in one go.
+type Image struct {
+	// VolumeID is the volume identifier in the primary volume descriptor
+	VolumeID string
+	// ModTime is used as the volume creation time and for directories
+	// which were created implicitly
+	ModTime time.Time
+
+	root  *node
+	spool *os.File
+	size  int64
+
+	bios *node
+	mbr  []byte
+	efi  []byte
+}
+
+type node struct {
+	name     string
+	isoName  string
+	hdr      tar.Header
+	parent   *node
+	children map[string]*node
+	sorted   []*node
+
+	// contents of regular files in the spool
+	offset int64
+	size   int64
+	// hard links share the extent of their target
+	link  *node
+	nlink uint32
+
+	// layout
+	lba     uint32
+	dirSize uint32
+	number  int
+	entries []*entry
+}
+
+func (n *node) isDir() bool {
+	return n.hdr.Typeflag == tar.TypeDir
+}
+
+// target returns the node which holds the attributes and contents shared by hard links
+func (n *node) target() *node {
+	if n.link != nil {
+		return n.link
+	}
+	return n
+}
+
+// New creates an empty image
+func New(volumeID string, modTime time.Time) (*Image, error) {
+	spool, err := ioutil.TempFile("", "iso")
+	if err != nil {
+		return nil, err
+	}
+	i := &Image{
+		VolumeID: volumeID,
+		ModTime:  modTime,
+		spool:    spool,
+	}
+	i.root = i.newNode("", nil, tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime})
+	return i, nil
+}
+
+// Close removes the temporary file holding the file contents
+func (i *Image) Close() error {
+	err := i.spool.Close()
+	os.Remove(i.spool.Name())
+	return err
+}
+
+func (i *Image) newNode(name string, parent *node, hdr tar.Header) *node {
+	n := &node{name: name, parent: parent, hdr: hdr, nlink: 1}
+	if hdr.Typeflag == tar.TypeDir {
+		n.children = map[string]*node{}
+	}
+	if parent != nil {
+		parent.children[name] = n
+	}
+	return n
+}
+
+// lookup returns the node at p, creating missing parent directories if create is set
+func (i *Image) lookup(p string, create bool) (*node, error) {
+	n := i.root
+	if p == "" {
+		return n, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if !n.isDir() {
+			return nil, fmt.Errorf("%s: not a directory", p)
+		}
+		c, ok := n.children[name]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("%s: not found", p)
+			}
+			c = i.newNode(name, n, tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: i.ModTime})
+		}
+		n = c
+	}
+	return n, nil
+}
+
+func cleanPath(p string) string {
+	p = path.Clean("/" + p)
+	return strings.TrimPrefix(p, "/")
+}
+
+// add adds an entry, replacing any existing entry at the same path apart from
+// directories, which only have their attributes updated
+func (i *Image) add(hdr *tar.Header, r io.Reader) error {
+	p := cleanPath(hdr.Name)
+	if p == "" {
+		i.root.hdr = *hdr
+		i.root.hdr.Typeflag = tar.TypeDir
+		return nil
+	}
+	dir, name := path.Split(p)
+	parent, err := i.lookup(strings.TrimSuffix(dir, "/"), true)
+	if err != nil {
+		return err
+	}
+	if !parent.isDir() {
+		return fmt.Errorf("%s: parent is not a directory", p)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if n, ok := parent.children[name]; ok && n.isDir() {
+			n.hdr = *hdr
+			return nil
+		}
+		i.newNode(name, parent, *hdr)
+	case tar.TypeReg, tar.TypeRegA:
+		if hdr.Size > maxFileSize {
+			return fmt.Errorf("%s: files over 4GB are not supported", p)
+		}
+		h := *hdr
+		h.Typeflag = tar.TypeReg
+		n := i.newNode(name, parent, h)
+		n.offset = i.size
+		written, err := io.Copy(i.spool, r)
+		if err != nil {
+			return err
+		}
+		n.size = written
+		i.size += written
+	case tar.TypeLink:
+		target, err := i.lookup(cleanPath(hdr.Linkname), false)
+		if err != nil {
+			return fmt.Errorf("hard link %s: %v", p, err)
+		}
+		if target.isDir() {
+			return fmt.Errorf("hard link %s: target is a directory", p)
+		}
+		target = target.target()
+		n := i.newNode(name, parent, target.hdr)
+		n.link = target
+		target.nlink++
+	case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		i.newNode(name, parent, *hdr)
+	default:
+		return fmt.Errorf("%s: unsupported file type %q", p, hdr.Typeflag)
+	}
+	return nil
+}
+
+// AddTar adds all the entries in the tarball to the image
+func (i *Image) AddTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := i.add(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// AddFile adds a regular file with the given contents
+func (i *Image) AddFile(name string, mode int64, contents []byte) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     mode,
+		Size:     int64(len(contents)),
+		ModTime:  i.ModTime,
+	}
+	return i.add(hdr, strings.NewReader(string(contents)))
+}
+
+// ReadFile returns the contents of a regular file in the image
+func (i *Image) ReadFile(name string) ([]byte, error) {
+	n, err := i.lookup(cleanPath(name), false)
+	if err != nil {
+		return nil, err
+	}
+	n = n.target()
+	if n.hdr.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%s: not a regular file", name)
+	}
+	b := make([]byte, n.size)
+	if _, err := i.spool.ReadAt(b, n.offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Remove removes a file or directory from the image, if it exists
+func (i *Image) Remove(name string) {
+	n, err := i.lookup(cleanPath(name), false)
+	if err != nil || n == i.root {
+		return
+	}
+	delete(n.parent.children, n.name)
+}
+
+// SetBIOSBoot makes the image bootable on BIOS systems. The file at name
+// must be a no emulation boot image such as isolinux.bin, which is patched
+// with the boot info table. If mbr is not nil it is used as the boot code
+// of a hybrid MBR, as isohdpfx.bin from syslinux, so that the image can
+// also be booted from a disk.
+func (i *Image) SetBIOSBoot(name string, mbr []byte) error {
+	n, err := i.lookup(cleanPath(name), false)
+	if err != nil {
+		return err
+	}
+	if n.target().hdr.Typeflag != tar.TypeReg {
+		return fmt.Errorf("%s: boot image must be a regular file", name)
+	}
+	if len(mbr) > mbrCodeSize {
+		return fmt.Errorf("MBR boot code is larger than %d bytes", mbrCodeSize)
+	}
+	i.bios = n.target()
+	i.mbr = mbr
+	return nil
+}
+
+// SetEFIBoot makes the image bootable on EFI systems. The bootloader is
+// placed at EFI/BOOT/filename on a FAT filesystem image, which becomes the
+// El Torito EFI boot image. It is not visible in the ISO filesystem itself.
+func (i *Image) SetEFIBoot(filename string, bootloader []byte) error {
+	img, err := fatImage(map[string][]byte{"EFI/BOOT/" + filename: bootloader})
+	if err != nil {
+		return err
+	}
+	i.efi = img
+	return nil
+}
+
+// dirs returns all directories in breadth first order, with the children
+// sorted, which is the order they have in the path table
+func (i *Image) dirs() []*node {
+	dirs := []*node{i.root}
+	for j := 0; j < len(dirs); j++ {
+		d := dirs[j]
+		d.number = j + 1
+		for _, c := range d.sorted {
+			if c.isDir() {
+				dirs = append(dirs, c)
+			}
+		}
+	}
+	return dirs
+}
+
+// assignNames gives every node a unique ISO 9660 identifier, and sorts the
+// children of each directory by it
+func assignNames(d *node) {
+	var names []string
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	used := map[string]bool{}
+	d.sorted = nil
+	for _, name := range names {
+		c := d.children[name]
+		c.isoName = isoName(name, c.isDir(), used)
+		used[c.isoName] = true
+		d.sorted = append(d.sorted, c)
+		if c.isDir() {
+			assignNames(c)
+		}
+	}
+	sort.Slice(d.sorted, func(a, b int) bool { return d.sorted[a].isoName < d.sorted[b].isoName })
+}
+
+// isoName maps a name to the d-characters allowed by ISO 9660, with up to 31
+// characters as genisoimage allows with -l. The real name is kept in the Rock
+// Ridge NM entry.
+func isoName(name string, dir bool, used map[string]bool) string {
+	mangle := func(s string) string {
+		b := []byte(strings.ToUpper(s))
+		for j, c := range b {
+			if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+				b[j] = '_'
+			}
+		}
+		return string(b)
+	}
+	base, ext := name, ""
+	if !dir {
+		if dot := strings.LastIndex(name, "."); dot > 0 {
+			base, ext = name[:dot], name[dot+1:]
+		}
+	}
+	base, ext = mangle(base), mangle(ext)
+	if len(ext) > 8 {
+		ext = ext[:8]
+	}
+	max := 31
+	if !dir {
+		max = 30 - len(ext)
+	}
+	format := func(b string) string {
+		if len(b) > max {
+			b = b[:max]
+		}
+		if dir {
+			return b
+		}
+		return b + "." + ext + ";1"
+	}
+	n := format(base)
+	for j := 1; used[n]; j++ {
+		suffix := fmt.Sprintf("_%d", j)
+		b := base
+		if len(b)+len(suffix) > max {
+			b = b[:max-len(suffix)]
+		}
+		n = format(b + suffix)
+	}
+	return n
+}
@@ -0,0 +1,201 @@
+package iso
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, "linuxkit\n"},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"}, ""},
+		{tar.Header{Name: "isolinux/isolinux.bin", Typeflag: tar.TypeReg, Mode: 0644}, strings.Repeat("\x01", 100)},
+	} {
+		f.hdr.Size = int64(len(f.data))
+		if err := tw.WriteHeader(&f.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := New("LinuxKit", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.AddTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.SetBIOSBoot("isolinux/isolinux.bin", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.SetEFIBoot("BOOTX64.EFI", []byte("efi")); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := img.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	b := out.Bytes()
+
+	pvd := b[16*sectorSize:]
+	if string(pvd[1:6]) != "CD001" || strings.TrimSpace(string(pvd[40:72])) != "LinuxKit" {
+		t.Fatalf("Invalid primary volume descriptor")
+	}
+	if size := binary.LittleEndian.Uint32(pvd[80:]); int(size)*sectorSize != len(b) {
+		t.Errorf("Volume size %d does not match image size %d", size, len(b))
+	}
+
+	catalog := b[binary.LittleEndian.Uint32(b[17*sectorSize+71:])*sectorSize:]
+	var sum uint16
+	for j := 0; j < 32; j += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[j:])
+	}
+	if sum != 0 {
+		t.Errorf("Boot catalog validation entry has checksum %d", sum)
+	}
+	if catalog[32] != 0x88 || catalog[64] != 0x91 || catalog[65] != 0xef || catalog[96] != 0x88 {
+		t.Errorf("Expected bootable BIOS and EFI entries in the boot catalog")
+	}
+
+	// the boot info table is patched into the BIOS boot image
+	boot := b[binary.LittleEndian.Uint32(catalog[40:])*sectorSize:]
+	if binary.LittleEndian.Uint32(boot[8:]) != 16 || binary.LittleEndian.Uint32(boot[16:]) != 100 {
+		t.Errorf("Invalid boot info table")
+	}
+
+	for _, name := range []string{"hostname", "busybox"} {
+		if !bytes.Contains(b, []byte(name)) {
+			t.Errorf("Rock Ridge name %s not found", name)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	name := "a-long-file-name-which-needs-rock-ridge.json"
+	for _, f := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "etc/linuxkit/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "etc/linuxkit/" + name, Typeflag: tar.TypeReg, Mode: 0644}, "{}"},
+		{tar.Header{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644}, strings.Repeat("k", 5000)},
+	} {
+		f.hdr.Size = int64(len(f.data))
+		if err := tw.WriteHeader(&f.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := New("LinuxKit", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.AddTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := img.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := r.ReadDir("etc/linuxkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != name {
+		t.Fatalf("Expected %s in etc/linuxkit, got %v", name, entries)
+	}
+	for file, expected := range map[string]string{"etc/linuxkit/" + name: "{}", "/boot/kernel": strings.Repeat("k", 5000)} {
+		f, err := r.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if _, err := b.ReadFrom(f); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Errorf("Unexpected contents of %s", file)
+		}
+	}
+}
+
+func TestReadFAT(t *testing.T) {
+	b, err := fatImage(map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI": bytes.Repeat([]byte("e"), 3000),
+		"KERNEL":               []byte("kernel"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFATReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][]byte{"efi/boot/bootx64.efi": bytes.Repeat([]byte("e"), 3000), "kernel": []byte("kernel")} {
+		r, err := f.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if _, err := got.ReadFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), expected) {
+			t.Errorf("Unexpected contents of %s", name)
+		}
+	}
+	if _, err := f.Open("missing"); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestISOName(t *testing.T) {
+	used := map[string]bool{}
+	for _, c := range []struct {
+		name string
+		dir  bool
+		iso  string
+	}{
+		{"hostname", false, "HOSTNAME.;1"},
+		{"linuxkit.yml", false, "LINUXKIT.YML;1"},
+		{"linuxkit-yml", false, "LINUXKIT_YML.;1"},
+		{"LinuxKit.yml", false, "LINUXKIT_1.YML;1"},
+		{"linuxkit.YML", false, "LINUXKIT_2.YML;1"},
+		{"etc", true, "ETC"},
+	} {
+		n := isoName(c.name, c.dir, used)
+		if n != c.iso {
+			t.Errorf("Expected the ISO 9660 name of %s to be %s, got %s", c.name, c.iso, n)
+		}
+		used[n] = true
+	}
+}
@@ -0,0 +1,180 @@
+package iso
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Entry is a file or directory read from a filesystem
+type Entry struct {
+	Name string
+	Dir  bool
+	Size int64
+	// offset is the byte offset of the contents in the image, and
+	// cluster the first cluster of the contents on FAT
+	offset  int64
+	cluster uint32
+}
+
+// Reader reads an ISO 9660 image, by the Rock Ridge names if the image has
+// them. Multi-extent files are not supported.
+type Reader struct {
+	r    io.ReaderAt
+	root Entry
+}
+
+// NewReader returns a Reader for the ISO 9660 image r
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	pvd := make([]byte, sectorSize)
+	if _, err := r.ReadAt(pvd, systemAreaSectors*sectorSize); err != nil {
+		return nil, err
+	}
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		return nil, fmt.Errorf("not an ISO 9660 image")
+	}
+	root := pvd[156:190]
+	return &Reader{
+		r: r,
+		root: Entry{
+			Dir:    true,
+			Size:   int64(binary.LittleEndian.Uint32(root[10:14])),
+			offset: int64(binary.LittleEndian.Uint32(root[2:6])) * sectorSize,
+		},
+	}, nil
+}
+
+// ReadDir returns the entries of the directory name
+func (i *Reader) ReadDir(name string) ([]Entry, error) {
+	d, err := i.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Dir {
+		return nil, fmt.Errorf("%s is not a directory", name)
+	}
+	return i.readDir(d)
+}
+
+// Open returns a reader of the contents of the file name
+func (i *Reader) Open(name string) (io.Reader, error) {
+	e, err := i.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return i.OpenEntry(e), nil
+}
+
+// OpenEntry returns a reader of the contents of the file e
+func (i *Reader) OpenEntry(e Entry) io.Reader {
+	return io.NewSectionReader(i.r, e.offset, e.Size)
+}
+
+func (i *Reader) lookup(name string) (Entry, error) {
+	e := i.root
+	for _, p := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if p == "" {
+			continue
+		}
+		entries, err := i.readDir(e)
+		if err != nil {
+			return Entry{}, err
+		}
+		found := false
+		for _, c := range entries {
+			if c.Name == p {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			return Entry{}, fmt.Errorf("%s not found", name)
+		}
+	}
+	return e, nil
+}
+
+func (i *Reader) readDir(d Entry) ([]Entry, error) {
+	data := make([]byte, d.Size)
+	if _, err := i.r.ReadAt(data, d.offset); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for off := 0; off < len(data); {
+		l := int(data[off])
+		if l == 0 {
+			// records do not cross sectors, the rest of the sector is padding
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		if off+l > len(data) || l < 34 {
+			return nil, fmt.Errorf("invalid directory record")
+		}
+		rec := data[off : off+l]
+		off += l
+		n := int(rec[32])
+		if 33+n > len(rec) {
+			return nil, fmt.Errorf("invalid directory record")
+		}
+		isoName := string(rec[33 : 33+n])
+		if isoName == "\x00" || isoName == "\x01" {
+			continue
+		}
+		e := Entry{
+			Dir:    rec[25]&2 != 0,
+			Size:   int64(binary.LittleEndian.Uint32(rec[10:14])),
+			offset: int64(binary.LittleEndian.Uint32(rec[2:6])) * sectorSize,
+		}
+		su := rec[33+n:]
+		if n%2 == 0 && len(su) > 0 {
+			su = su[1:]
+		}
+		name, err := i.rockRidgeName(su)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = strings.ToLower(strings.TrimSuffix(strings.SplitN(isoName, ";", 2)[0], "."))
+		}
+		e.Name = name
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// rockRidgeName returns the name in the NM entries of the system use area
+// su, following continuation areas
+func (i *Reader) rockRidgeName(su []byte) (string, error) {
+	var name string
+	for continuations := 0; continuations < 16; continuations++ {
+		var next []byte
+		for len(su) >= 4 && int(su[2]) >= 4 && int(su[2]) <= len(su) {
+			entry := su[:su[2]]
+			su = su[su[2]:]
+			switch string(entry[:2]) {
+			case "NM":
+				if len(entry) > 5 {
+					name += string(entry[5:])
+				}
+			case "CE":
+				if len(entry) < 28 {
+					return "", fmt.Errorf("invalid continuation entry")
+				}
+				lba := binary.LittleEndian.Uint32(entry[4:8])
+				offset := binary.LittleEndian.Uint32(entry[12:16])
+				length := binary.LittleEndian.Uint32(entry[20:24])
+				next = make([]byte, length)
+				if _, err := i.r.ReadAt(next, int64(lba)*sectorSize+int64(offset)); err != nil {
+					return "", err
+				}
+			}
+		}
+		if next == nil {
+			return name, nil
+		}
+		su = next
+	}
+	return "", fmt.Errorf("too many continuation areas")
+}
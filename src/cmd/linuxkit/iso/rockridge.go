@@ -0,0 +1,146 @@
+package iso
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Rock Ridge (RRIP 1.10) and the System Use Sharing Protocol entries, which
+// carry the POSIX attributes, names and symlink targets.
+
+const (
+	rrID  = "RRIP_1991A"
+	rrDes = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rrSrc = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+
+	ceLength = 28
+	// maxSLEntry is the largest SL entry, which must also fit a component
+	maxSLEntry = 255
+
+	slContinue = 0x01
+	slCurrent  = 0x02
+	slParent   = 0x04
+	slRoot     = 0x08
+)
+
+func suEntry(sig string, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	copy(b, sig)
+	b[2] = byte(4 + len(data))
+	b[3] = 1
+	return append(b, data...)
+}
+
+func suSP() []byte {
+	return suEntry("SP", []byte{0xbe, 0xef, 0})
+}
+
+func suER() []byte {
+	b := []byte{byte(len(rrID)), byte(len(rrDes)), byte(len(rrSrc)), 1}
+	b = append(b, rrID...)
+	b = append(b, rrDes...)
+	b = append(b, rrSrc...)
+	return suEntry("ER", b)
+}
+
+func suCE(lba, offset, length uint32) []byte {
+	b := make([]byte, 24)
+	both32(b[0:], lba)
+	both32(b[8:], offset)
+	both32(b[16:], length)
+	return suEntry("CE", b)
+}
+
+func fileMode(hdr *tar.Header) uint32 {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mode |= 0040000
+	case tar.TypeSymlink:
+		mode |= 0120000
+	case tar.TypeChar:
+		mode |= 0020000
+	case tar.TypeBlock:
+		mode |= 0060000
+	case tar.TypeFifo:
+		mode |= 0010000
+	default:
+		mode |= 0100000
+	}
+	return mode
+}
+
+// suPX encodes the POSIX attributes. RRIP 1.10 has no file serial number.
+func suPX(hdr *tar.Header, nlink uint32) []byte {
+	b := make([]byte, 32)
+	both32(b[0:], fileMode(hdr))
+	both32(b[8:], nlink)
+	both32(b[16:], uint32(hdr.Uid))
+	both32(b[24:], uint32(hdr.Gid))
+	return suEntry("PX", b)
+}
+
+func suTF(t time.Time) []byte {
+	// modify, access and attribute change times
+	b := []byte{0x02 | 0x04 | 0x08}
+	for j := 0; j < 3; j++ {
+		b = append(b, recordTime(t)...)
+	}
+	return suEntry("TF", b)
+}
+
+func suPN(hdr *tar.Header) []byte {
+	b := make([]byte, 16)
+	both32(b[0:], uint32(hdr.Devmajor))
+	both32(b[8:], uint32(hdr.Devminor))
+	return suEntry("PN", b)
+}
+
+func suNM(name string) []byte {
+	return suEntry("NM", append([]byte{0}, name...))
+}
+
+// suSL encodes a symlink target, split over as many SL entries as needed
+func suSL(target string) ([]byte, error) {
+	var components [][]byte
+	if strings.HasPrefix(target, "/") {
+		components = append(components, []byte{slRoot, 0})
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "":
+			continue
+		case ".":
+			components = append(components, []byte{slCurrent, 0})
+		case "..":
+			components = append(components, []byte{slParent, 0})
+		default:
+			if len(c) > maxSLEntry-7 {
+				return nil, fmt.Errorf("symlink target component %q is too long", c)
+			}
+			components = append(components, append([]byte{0, byte(len(c))}, c...))
+		}
+	}
+
+	var entries [][]byte
+	cur := []byte{0}
+	for _, c := range components {
+		if 4+len(cur)+len(c) > maxSLEntry {
+			entries = append(entries, cur)
+			cur = []byte{0}
+		}
+		cur = append(cur, c...)
+	}
+	entries = append(entries, cur)
+
+	var b []byte
+	for j, e := range entries {
+		if j < len(entries)-1 {
+			e[0] = slContinue
+		}
+		b = append(b, suEntry("SL", e)...)
+	}
+	return b, nil
+}
@@ -0,0 +1,542 @@
+package iso
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	maxRecordSize = 255
+	// mbrCodeSize is the space for boot code in front of the hybrid MBR fields
+	mbrCodeSize = 432
+	// The hybrid MBR uses the same geometry as isohybrid, so the image is
+	// padded to a multiple of 1MB cylinders.
+	hybridHeads     = 64
+	hybridSectors   = 32
+	hybridCylinder  = hybridHeads * hybridSectors * 512
+	biosLoadSectors = 4
+)
+
+// entry is a directory record. The system use area is split into the
+// entries which always fit in the record and the ones which may have to be
+// moved to a continuation area.
+type entry struct {
+	n      *node
+	id     []byte
+	inline []byte
+	spill  []byte
+	length int
+
+	ceLBA    uint32
+	ceOffset uint32
+}
+
+func both16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func both32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+// recordTime is the seven byte date format of directory records
+func recordTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// volumeTime is the seventeen byte date format of volume descriptors
+func volumeTime(t time.Time) []byte {
+	b := []byte(t.UTC().Format("20060102150405") + "00")
+	return append(b, 0)
+}
+
+func padString(b []byte, s string) {
+	for j := range b {
+		b[j] = ' '
+	}
+	copy(b, s)
+}
+
+func newEntry(n *node, id []byte, inline, spill []byte, forceCE bool) *entry {
+	e := &entry{n: n, id: id, inline: inline}
+	base := 33 + len(id)
+	if len(id)%2 == 0 {
+		base++
+	}
+	if len(spill) > 0 {
+		if !forceCE && base+len(inline)+len(spill) <= maxRecordSize {
+			e.inline = append(e.inline, spill...)
+		} else {
+			e.spill = spill
+			e.inline = append(e.inline, make([]byte, ceLength)...)
+		}
+	}
+	e.length = base + len(e.inline)
+	if e.length%2 == 1 {
+		e.length++
+	}
+	return e
+}
+
+func nlink(n *node) uint32 {
+	if !n.isDir() {
+		return n.target().nlink
+	}
+	links := uint32(2)
+	for _, c := range n.children {
+		if c.isDir() {
+			links++
+		}
+	}
+	return links
+}
+
+func attributes(n *node) []byte {
+	t := n.target()
+	b := append(suPX(&t.hdr, nlink(n)), suTF(t.hdr.ModTime)...)
+	if t.hdr.Typeflag == tar.TypeChar || t.hdr.Typeflag == tar.TypeBlock {
+		b = append(b, suPN(&t.hdr)...)
+	}
+	return b
+}
+
+// dirEntries creates the records of directory d
+func dirEntries(d *node, root bool) ([]*entry, error) {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	var dot *entry
+	if root {
+		dot = newEntry(d, []byte{0}, append(suSP(), attributes(d)...), suER(), true)
+	} else {
+		dot = newEntry(d, []byte{0}, attributes(d), nil, false)
+	}
+	entries := []*entry{dot, newEntry(parent, []byte{1}, attributes(parent), nil, false)}
+	for _, c := range d.sorted {
+		spill := suNM(c.name)
+		if c.target().hdr.Typeflag == tar.TypeSymlink {
+			sl, err := suSL(c.target().hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			spill = append(spill, sl...)
+		}
+		if len(spill) > sectorSize {
+			return nil, fmt.Errorf("Rock Ridge attributes of %s are too long", c.name)
+		}
+		entries = append(entries, newEntry(c, []byte(c.isoName), attributes(c), spill, false))
+	}
+	return entries, nil
+}
+
+// record serialises a directory record, once the layout is known
+func (e *entry) record() []byte {
+	b := make([]byte, e.length)
+	b[0] = byte(e.length)
+	t := e.n.target()
+	switch {
+	case e.n.isDir():
+		both32(b[2:], e.n.lba)
+		both32(b[10:], e.n.dirSize)
+		b[25] = 0x02
+	case t.hdr.Typeflag == tar.TypeReg:
+		both32(b[2:], t.lba)
+		both32(b[10:], uint32(t.size))
+	}
+	copy(b[18:], recordTime(t.hdr.ModTime))
+	both16(b[28:], 1)
+	b[32] = byte(len(e.id))
+	copy(b[33:], e.id)
+	su := 33 + len(e.id)
+	if len(e.id)%2 == 0 {
+		su++
+	}
+	copy(b[su:], e.inline)
+	if len(e.spill) > 0 {
+		copy(b[su+len(e.inline)-ceLength:], suCE(e.ceLBA, e.ceOffset, uint32(len(e.spill))))
+	}
+	return b
+}
+
+// layout holds the location of everything in the image
+type layout struct {
+	dirs       []*node
+	files      []*node
+	spills     []*entry
+	catalog    uint32
+	pathTable  []byte
+	lPathTable uint32
+	mPathTable uint32
+	ce         uint32
+	ceSectors  uint32
+	efi        uint32
+	total      uint32
+}
+
+func (i *Image) layout() (*layout, error) {
+	assignNames(i.root)
+	l := &layout{dirs: i.dirs()}
+
+	// primary, boot record and terminator volume descriptors
+	next := uint32(systemAreaSectors + 2)
+	if i.bios != nil || i.efi != nil {
+		next++
+		l.catalog = next
+		next++
+	}
+
+	var pathTableSize int64
+	for _, d := range l.dirs {
+		id := len(d.isoName)
+		if id == 0 {
+			id = 1
+		}
+		pathTableSize += int64(8 + id + id%2)
+	}
+	l.lPathTable = next
+	next += sectors(pathTableSize)
+	l.mPathTable = next
+	next += sectors(pathTableSize)
+
+	var ceSize int64
+	for _, d := range l.dirs {
+		entries, err := dirEntries(d, d == i.root)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, e := range entries {
+			if size%sectorSize+int64(e.length) > sectorSize {
+				size = int64(sectors(size)) * sectorSize
+			}
+			size += int64(e.length)
+			if len(e.spill) > 0 {
+				if ceSize%sectorSize+int64(len(e.spill)) > sectorSize {
+					ceSize = int64(sectors(ceSize)) * sectorSize
+				}
+				e.ceOffset = uint32(ceSize)
+				ceSize += int64(len(e.spill))
+				l.spills = append(l.spills, e)
+			}
+		}
+		d.entries = entries
+		d.dirSize = sectors(size) * sectorSize
+		d.lba = next
+		next += sectors(size)
+	}
+
+	l.ce = next
+	l.ceSectors = sectors(ceSize)
+	next += l.ceSectors
+	for _, e := range l.spills {
+		e.ceLBA = l.ce + e.ceOffset/sectorSize
+		e.ceOffset %= sectorSize
+	}
+
+	for _, d := range l.dirs {
+		for _, c := range d.sorted {
+			if c.link != nil || c.hdr.Typeflag != tar.TypeReg || c.size == 0 {
+				continue
+			}
+			c.lba = next
+			next += sectors(c.size)
+			l.files = append(l.files, c)
+		}
+	}
+
+	if i.efi != nil {
+		l.efi = next
+		next += sectors(int64(len(i.efi)))
+	}
+
+	if i.mbr != nil {
+		perCylinder := uint32(hybridCylinder / sectorSize)
+		next = (next + perCylinder - 1) / perCylinder * perCylinder
+	}
+	l.total = next
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, d := range l.dirs {
+			id := []byte(d.isoName)
+			if len(id) == 0 {
+				id = []byte{0}
+			}
+			parent := 1
+			if d.parent != nil {
+				parent = d.parent.number
+			}
+			b := make([]byte, 8+len(id)+len(id)%2)
+			b[0] = byte(len(id))
+			byteOrder.PutUint32(b[2:], d.lba)
+			byteOrder.PutUint16(b[6:], uint16(parent))
+			copy(b[8:], id)
+			l.pathTable = append(l.pathTable, b...)
+		}
+	}
+	return l, nil
+}
+
+type sectorWriter struct {
+	w   *bufio.Writer
+	pos int64
+}
+
+func (s *sectorWriter) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	s.pos += int64(n)
+	return n, err
+}
+
+// seek pads with zeros up to the start of the sector
+func (s *sectorWriter) seek(sector uint32) error {
+	return s.seekOffset(int64(sector) * sectorSize)
+}
+
+func (s *sectorWriter) seekOffset(off int64) error {
+	if off < s.pos {
+		return fmt.Errorf("internal error: writing offset %d at %d", off, s.pos)
+	}
+	_, err := s.Write(make([]byte, off-s.pos))
+	return err
+}
+
+// Write writes the image to w
+func (i *Image) Write(w io.Writer) error {
+	l, err := i.layout()
+	if err != nil {
+		return err
+	}
+	sw := &sectorWriter{w: bufio.NewWriterSize(w, 1024*1024)}
+
+	if i.mbr != nil {
+		if _, err := sw.Write(i.hybridMBR(l)); err != nil {
+			return err
+		}
+	}
+
+	// volume descriptors
+	if err := sw.seek(systemAreaSectors); err != nil {
+		return err
+	}
+	if _, err := sw.Write(i.primaryDescriptor(l)); err != nil {
+		return err
+	}
+	if l.catalog != 0 {
+		vd := make([]byte, sectorSize)
+		copy(vd[1:], "CD001\x01EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(vd[71:], l.catalog)
+		if _, err := sw.Write(vd); err != nil {
+			return err
+		}
+	}
+	terminator := make([]byte, sectorSize)
+	copy(terminator, "\xffCD001\x01")
+	if _, err := sw.Write(terminator); err != nil {
+		return err
+	}
+	if l.catalog != 0 {
+		if _, err := sw.Write(i.bootCatalog(l)); err != nil {
+			return err
+		}
+	}
+
+	half := len(l.pathTable) / 2
+	if err := sw.seek(l.lPathTable); err != nil {
+		return err
+	}
+	if _, err := sw.Write(l.pathTable[:half]); err != nil {
+		return err
+	}
+	if err := sw.seek(l.mPathTable); err != nil {
+		return err
+	}
+	if _, err := sw.Write(l.pathTable[half:]); err != nil {
+		return err
+	}
+
+	for _, d := range l.dirs {
+		if err := sw.seek(d.lba); err != nil {
+			return err
+		}
+		var off int64
+		for _, e := range d.entries {
+			if off%sectorSize+int64(e.length) > sectorSize {
+				pad := sectorSize - off%sectorSize
+				if _, err := sw.Write(make([]byte, pad)); err != nil {
+					return err
+				}
+				off += pad
+			}
+			if _, err := sw.Write(e.record()); err != nil {
+				return err
+			}
+			off += int64(e.length)
+		}
+	}
+
+	for _, e := range l.spills {
+		if err := sw.seekOffset(int64(e.ceLBA)*sectorSize + int64(e.ceOffset)); err != nil {
+			return err
+		}
+		if _, err := sw.Write(e.spill); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range l.files {
+		if err := sw.seek(f.lba); err != nil {
+			return err
+		}
+		if f == i.bios {
+			if err := i.writeBIOSBoot(sw, f); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(sw, io.NewSectionReader(i.spool, f.offset, f.size)); err != nil {
+			return err
+		}
+	}
+
+	if i.efi != nil {
+		if err := sw.seek(l.efi); err != nil {
+			return err
+		}
+		if _, err := sw.Write(i.efi); err != nil {
+			return err
+		}
+	}
+
+	if err := sw.seek(l.total); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (i *Image) primaryDescriptor(l *layout) []byte {
+	vd := make([]byte, sectorSize)
+	copy(vd, "\x01CD001\x01")
+	padString(vd[8:40], "")
+	padString(vd[40:72], i.VolumeID)
+	both32(vd[80:], l.total)
+	both16(vd[120:], 1)
+	both16(vd[124:], 1)
+	both16(vd[128:], sectorSize)
+	both32(vd[132:], uint32(len(l.pathTable)/2))
+	binary.LittleEndian.PutUint32(vd[140:], l.lPathTable)
+	binary.BigEndian.PutUint32(vd[148:], l.mPathTable)
+	root := *i.root.entries[0]
+	root.inline, root.spill, root.length = nil, nil, 34
+	copy(vd[156:], root.record())
+	for _, f := range [][]byte{vd[190:318], vd[318:446], vd[446:574], vd[574:702], vd[702:739], vd[739:776], vd[776:813]} {
+		padString(f, "")
+	}
+	copy(vd[813:], volumeTime(i.ModTime))
+	copy(vd[830:], volumeTime(i.ModTime))
+	copy(vd[847:], "0000000000000000")
+	copy(vd[864:], "0000000000000000")
+	vd[881] = 1
+	return vd
+}
+
+// bootCatalog creates the El Torito boot catalog. A BIOS boot image is the
+// default entry, EFI is either the default entry or a section of its own.
+func (i *Image) bootCatalog(l *layout) []byte {
+	cat := make([]byte, sectorSize)
+	bootEntry := func(b []byte, lba uint32, count uint16) {
+		b[0] = 0x88
+		binary.LittleEndian.PutUint16(b[6:], count)
+		binary.LittleEndian.PutUint32(b[8:], lba)
+	}
+	efiCount := uint16(0xffff)
+	if n := len(i.efi) / 512; n < 0xffff {
+		efiCount = uint16(n)
+	}
+
+	cat[0] = 1
+	if i.bios == nil {
+		cat[1] = 0xef
+	}
+	cat[30], cat[31] = 0x55, 0xaa
+	var sum uint16
+	for j := 0; j < 32; j += 2 {
+		sum += binary.LittleEndian.Uint16(cat[j:])
+	}
+	binary.LittleEndian.PutUint16(cat[28:], -sum)
+
+	switch {
+	case i.bios == nil:
+		bootEntry(cat[32:], l.efi, efiCount)
+	case i.efi == nil:
+		bootEntry(cat[32:], i.bios.lba, biosLoadSectors)
+	default:
+		bootEntry(cat[32:], i.bios.lba, biosLoadSectors)
+		cat[64] = 0x91
+		cat[65] = 0xef
+		binary.LittleEndian.PutUint16(cat[66:], 1)
+		bootEntry(cat[96:], l.efi, efiCount)
+	}
+	return cat
+}
+
+// writeBIOSBoot writes the BIOS boot image with the boot info table, which
+// tells isolinux where it has been loaded from.
+func (i *Image) writeBIOSBoot(w io.Writer, f *node) error {
+	b := make([]byte, f.size)
+	if _, err := i.spool.ReadAt(b, f.offset); err != nil {
+		return err
+	}
+	if len(b) < 64 {
+		return fmt.Errorf("BIOS boot image is too small")
+	}
+	var sum uint32
+	for j := 64; j < len(b); j += 4 {
+		word := make([]byte, 4)
+		copy(word, b[j:])
+		sum += binary.LittleEndian.Uint32(word)
+	}
+	binary.LittleEndian.PutUint32(b[8:], systemAreaSectors)
+	binary.LittleEndian.PutUint32(b[12:], f.lba)
+	binary.LittleEndian.PutUint32(b[16:], uint32(f.size))
+	binary.LittleEndian.PutUint32(b[20:], sum)
+	_, err := w.Write(b)
+	return err
+}
+
+// hybridMBR creates an MBR like isohybrid does, with a single partition
+// covering the whole image, so it can be booted from a USB stick
+func (i *Image) hybridMBR(l *layout) []byte {
+	mbr := make([]byte, 512)
+	copy(mbr, i.mbr)
+	binary.LittleEndian.PutUint32(mbr[432:], i.bios.lba*4)
+	binary.LittleEndian.PutUint32(mbr[440:], crc32.ChecksumIEEE([]byte(i.VolumeID+i.ModTime.String())))
+
+	cylinders := int64(l.total) * sectorSize / hybridCylinder
+	c := cylinders - 1
+	if c > 1023 {
+		c = 1023
+	}
+	p := mbr[446:]
+	p[0] = 0x80
+	p[1], p[2], p[3] = 0, 1, 0
+	p[4] = 0x17
+	p[5] = hybridHeads - 1
+	p[6] = byte(hybridSectors | (c>>2)&0xc0)
+	p[7] = byte(c & 0xff)
+	binary.LittleEndian.PutUint32(p[12:], uint32(cylinders*hybridHeads*hybridSectors))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
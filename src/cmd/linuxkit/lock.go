@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultLockfile is the lockfile of the configuration arg, next to it
+func defaultLockfile(arg string) string {
+	if arg == "-" || isURL(arg) || configReference(arg) {
+		return ""
+	}
+	return strings.TrimSuffix(arg, filepath.Ext(arg)) + ".lock"
+}
+
+func lock(args []string) {
+	flags := newFlagSet("lock")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s lock [options] <file>[.yml] | -\n\n", invoked)
+		fmt.Printf("Resolve the tags of the images of the configuration files to the digests\n")
+		fmt.Printf("they refer to now and write them to a lockfile, so that 'build -locked'\n")
+		fmt.Printf("builds the same images until the configuration is locked again.\n")
+		fmt.Printf("The lockfile is <file>.lock of the last file by default.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "File to write the lockfile to, default <file>.lock of the last configuration file")
+	disableTrust := flags.Bool("disable-content-trust", false, "Resolve the digests from the registry even for the images in the trust section of config (default false)")
+	insecure := flags.Bool("insecure", false, "Allow pulling a configuration from a registry without TLS")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify a configuration file")
+		flags.Usage()
+		os.Exit(1)
+	}
+	lockfile := *output
+	if lockfile == "" {
+		if lockfile = defaultLockfile(flags.Arg(flags.NArg() - 1)); lockfile == "" {
+			log.Fatal("Please specify the lockfile of the configuration with -o")
+		}
+	}
+
+	var m moby.Moby
+	for _, arg := range flags.Args() {
+		config, err := readBuildConfig(arg, *insecure)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := moby.NewConfig(config)
+		if err != nil {
+			log.Fatalf("Invalid config %s: %v", arg, err)
+		}
+		if m, err = moby.AppendConfig(m, c); err != nil {
+			log.Fatalf("Cannot append config files: %v", err)
+		}
+	}
+	if *disableTrust {
+		m.Trust = moby.TrustConfig{}
+	}
+
+	l, err := moby.ResolveLock(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	images := make([]string, 0, len(l.Images))
+	for image := range l.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		fmt.Printf("%s@%s\n", image, l.Images[image])
+	}
+	if err := l.Write(lockfile); err != nil {
+		log.Fatalf("Cannot write the lockfile: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logs streams the log of a service in a VM with the linuxkit/agent package
+func logs(args []string) {
+	flags := newFlagSet("logs")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s logs [options] name service\n\n", invoked)
+		fmt.Printf("Show the log of a service in a VM with the linuxkit/agent package,\n")
+		fmt.Printf("without networking. 'name' is the state directory of the VM, or the\n")
+		fmt.Printf("name of the image it was started from if the default state directory\n")
+		fmt.Printf("was used. 'service' is the name of a log written to /var/log by\n")
+		fmt.Printf("logwrite, or the absolute path of a file in the VM.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	agent := agentConnectFlags(flags)
+	follow := flags.Bool("f", false, "Follow the log until interrupted")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 2 {
+		fmt.Printf("Please specify the VM and the service\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	conn, err := dialAgent(remArgs[0], agent)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.request(agentRequest{Op: "logs", Path: remArgs[1], Follow: *follow}); err != nil {
+		log.Fatalf("Unable to send the request to the agent: %v", err)
+	}
+	_, err = conn.wait(func(kind byte, b []byte) error {
+		if kind != agentFrameStdout {
+			return nil
+		}
+		_, err := os.Stdout.Write(b)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Unable to read the log of %s: %v", remArgs[1], err)
+	}
+}
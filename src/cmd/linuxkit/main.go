@@ -1,31 +1,19 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
-// GlobalConfig is the global tool configuration
-type GlobalConfig struct {
-	Pkg PkgConfig `yaml:"pkg"`
-}
-
-// PkgConfig is the config specific to the `pkg` subcommand
-type PkgConfig struct {
-	// ContentTrustCommand is passed to `sh -c` and the stdout
-	// (including whitespace and \n) is set as the content trust
-	// passphrase. Can be used to execute a password manager.
-	ContentTrustCommand string `yaml:"content-trust-passphrase-command"`
-}
-
 var (
 	defaultLogFormatter = &log.TextFormatter{}
 
@@ -34,17 +22,91 @@ var (
 )
 
 // infoFormatter overrides the default format for Info() log events to
-// provide an easier to read output
+// provide an easier to read output, with the fields of the event after the
+// message
 type infoFormatter struct {
 }
 
 func (f *infoFormatter) Format(entry *log.Entry) ([]byte, error) {
 	if entry.Level == log.InfoLevel {
-		return append([]byte(entry.Message), '\n'), nil
+		b := []byte(entry.Message)
+		keys := make([]string, 0, len(entry.Data))
+		for k := range entry.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = append(b, fmt.Sprintf(" %s=%v", k, entry.Data[k])...)
+		}
+		return append(b, '\n'), nil
 	}
 	return defaultLogFormatter.Format(entry)
 }
 
+// ciFormatter formats the log for CI, with the workflow commands of GitHub
+// Actions: the messages introducing a step of a build, which end with a
+// colon, start a group of the log, and warnings and errors are annotated,
+// on the file and line of their fields if they are set
+type ciFormatter struct {
+	mu    sync.Mutex
+	group bool
+}
+
+func (f *ciFormatter) Format(entry *log.Entry) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var b []byte
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		switch k {
+		case "file", "line", "col":
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	msg := entry.Message
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, entry.Data[k])
+	}
+
+	switch entry.Level {
+	case log.InfoLevel, log.DebugLevel, log.TraceLevel:
+		if strings.HasSuffix(entry.Message, ":") && len(keys) == 0 {
+			if f.group {
+				b = append(b, "::endgroup::\n"...)
+			}
+			f.group = true
+			return append(b, "::group::"+ciEscape(strings.TrimSuffix(entry.Message, ":"))+"\n"...), nil
+		}
+		return append([]byte(msg), '\n'), nil
+	}
+	// annotations are shown outside of the groups
+	if f.group {
+		b = append(b, "::endgroup::\n"...)
+		f.group = false
+	}
+	command := "error"
+	if entry.Level == log.WarnLevel {
+		command = "warning"
+	}
+	var props []string
+	for _, k := range []string{"file", "line", "col"} {
+		if v, ok := entry.Data[k]; ok {
+			props = append(props, fmt.Sprintf("%s=%s", k, ciEscape(fmt.Sprint(v))))
+		}
+	}
+	if len(props) > 0 {
+		command += " " + strings.Join(props, ",")
+	}
+	return append(b, "::"+command+"::"+ciEscape(msg)+"\n"...), nil
+}
+
+// ciEscape escapes s for a workflow command
+func ciEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
 func printVersion() {
 	fmt.Printf("%s version %s\n", filepath.Base(os.Args[0]), version.Version)
 	if version.GitCommit != "" {
@@ -53,92 +115,65 @@ func printVersion() {
 	os.Exit(0)
 }
 
-func readConfig() {
-	cfgPath := filepath.Join(os.Getenv("HOME"), ".moby", "linuxkit", "config.yml")
-	cfgBytes, err := ioutil.ReadFile(cfgPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return
-		}
-		fmt.Printf("Failed to read %q\n", cfgPath)
-		os.Exit(1)
-	}
-	if err := yaml.Unmarshal(cfgBytes, &Config); err != nil {
-		fmt.Printf("Failed to parse %q\n", cfgPath)
-		os.Exit(1)
+// commands returns the commands of the CLI
+func commands() *command {
+	root := &command{
+		name: filepath.Base(os.Args[0]),
+		args: "[options] COMMAND",
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "attach", short: "Attach to the console of a detached VM", run: attach},
+			{name: "build", short: "Build an image from a YAML file", run: build},
+			buildersCommand(),
+			bundleCommand(),
+			cacheCommand(),
+			{name: "completion", short: "Print the shell completion script for bash, zsh or fish", run: completion},
+			{name: "cp", short: "Copy files into or out of a VM with the agent", run: cp},
+			{name: "daemon", short: "Run a local API server to drive builds and runs", run: daemon},
+			{name: "diff", short: "Compare the kernel, images, files and sizes of two builds", run: diff},
+			{name: "exec", short: "Run a command in a VM with the agent", run: execCmd},
+			{name: "inspect", short: "Report the kernel, images and files of a built output", run: inspect},
+			{name: "lock", short: "Resolve the images of configurations to digests in a lockfile", run: lock},
+			{name: "logs", short: "Show the log of a service in a VM with the agent", run: logs},
+			metadataCommand(),
+			{name: "netboot", short: "Provision bare-metal machines over PXE", run: netboot},
+			pkgCommand(),
+			{name: "ps", short: "List the local VMs started with a name", run: ps},
+			pushCommand(),
+			{name: "rm", short: "Remove the state of local VMs", run: rm},
+			runCommand(),
+			{name: "sbom", short: "Write an SPDX SBOM of a built output or a pushed image", run: sbom},
+			{name: "self-update", short: "Update to the latest release", run: selfUpdate},
+			{name: "serve", short: "Run a local http server (for iPXE booting)", run: serve},
+			{name: "sign", short: "Sign build outputs with cosign or gpg", run: sign},
+			{name: "ssh", short: "Connect to a VM started with 'run' using ssh", run: sshCmd},
+			{name: "stop", short: "Stop detached local VMs", run: stop},
+			{name: "test", short: "Run the test cases of the rtf test suite", run: testCmd},
+			{name: "verify", short: "Verify the signatures and image digests of build outputs", run: verify},
+			{name: "version", short: "Print version information", run: versionCmd},
+			{name: completeCommand, run: complete, hidden: true},
+		},
 	}
+	root.subcommands = append(root.subcommands, &command{
+		name:  "help",
+		short: "Print this message, or the help of a command",
+		run:   func(args []string) { root.help(root.name, args) },
+	})
+	return root
 }
 
 func main() {
-	flag.Usage = func() {
-		fmt.Printf("USAGE: %s [options] COMMAND\n\n", filepath.Base(os.Args[0]))
-		fmt.Printf("Commands:\n")
-		fmt.Printf("  build       Build an image from a YAML file\n")
-		fmt.Printf("  cache       Manage the local cache\n")
-		fmt.Printf("  metadata    Metadata utilities\n")
-		fmt.Printf("  pkg         Package building\n")
-		fmt.Printf("  push        Push a VM image to a cloud or image store\n")
-		fmt.Printf("  run         Run a VM image on a local hypervisor or remote cloud\n")
-		fmt.Printf("  serve       Run a local http server (for iPXE booting)\n")
-		fmt.Printf("  version     Print version information\n")
-		fmt.Printf("  help        Print this message\n")
-		fmt.Printf("\n")
-		fmt.Printf("Run '%s COMMAND --help' for more information on the command\n", filepath.Base(os.Args[0]))
-		fmt.Printf("\n")
-		fmt.Printf("Options:\n")
-		flag.PrintDefaults()
-	}
-	flagQuiet := flag.Bool("q", false, "Quiet execution")
-	flagVerbose := flag.Bool("v", false, "Verbose execution")
-
 	readConfig()
 
 	// Set up logging
-	log.SetFormatter(new(infoFormatter))
-	log.SetLevel(log.InfoLevel)
-	flag.Parse()
-	if *flagQuiet && *flagVerbose {
-		fmt.Printf("Can't set quiet and verbose flag at the same time\n")
-		os.Exit(1)
-	}
-	if *flagQuiet {
-		log.SetLevel(log.ErrorLevel)
-	}
-	if *flagVerbose {
-		// Switch back to the standard formatter
-		log.SetFormatter(defaultLogFormatter)
-		log.SetLevel(log.DebugLevel)
-	}
+	setupLogging()
 
-	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Printf("Please specify a command.\n\n")
-		flag.Usage()
-		os.Exit(1)
+	// Export the spans of the work on exit, including after log.Fatal
+	if trace.Setup("linuxkit") {
+		log.RegisterExitHandler(trace.Flush)
 	}
 
-	switch args[0] {
-	case "build":
-		build(args[1:])
-	case "cache":
-		cache(args[1:])
-	case "metadata":
-		metadata(args[1:])
-	case "pkg":
-		pkg(args[1:])
-	case "push":
-		push(args[1:])
-	case "run":
-		run(args[1:])
-	case "serve":
-		serve(args[1:])
-	case "version":
-		printVersion()
-	case "help":
-		flag.Usage()
-	default:
-		fmt.Printf("%q is not valid command.\n\n", args[0])
-		flag.Usage()
-		os.Exit(1)
-	}
+	root := commands()
+	root.execute(root.name, os.Args[1:])
+	trace.Flush()
 }
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/linuxkit/virtsock/pkg/vsock"
 	"github.com/rn/iso9660wrap"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// metadataChannelPort is the vsock port of the host the metadata
+	// package reads the metadata from
+	metadataChannelPort = 0xf3a7
+	// metadataChannelMagic starts the frame of metadata passed on a channel
+	metadataChannelMagic = "LKMD"
+)
+
 // WriteMetadataISO writes a metadata ISO file in a format usable by pkg/metadata
 func WriteMetadataISO(path string, content []byte) error {
 	outfh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
@@ -20,6 +31,16 @@ func WriteMetadataISO(path string, content []byte) error {
 	return iso9660wrap.WriteBuffer(outfh, content, "config")
 }
 
+// metadataChannelFrame returns content framed to be passed to pkg/metadata
+// on a virtio-serial port or over vsock: a magic, the length of content as
+// a big endian uint32 and content
+func metadataChannelFrame(content []byte) []byte {
+	frame := make([]byte, 8, 8+len(content))
+	copy(frame, metadataChannelMagic)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(content)))
+	return append(frame, content...)
+}
+
 func metadataCreateUsage() {
 	invoked := filepath.Base(os.Args[0])
 	fmt.Printf("USAGE: %s metadata create [file.iso] [metadata]\n\n", invoked)
@@ -48,30 +69,73 @@ func metadataCreate(args []string) {
 	}
 }
 
-func metadataUsage() {
+func metadataServe(args []string) {
+	flags := newFlagSet("serve")
 	invoked := filepath.Base(os.Args[0])
-	fmt.Printf("USAGE: %s metadata COMMAND [options]\n\n", invoked)
-	fmt.Printf("Commands:\n")
-	fmt.Printf("  create      Create a metadata ISO\n")
-}
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s metadata serve [options] [metadata]\n\n", invoked)
+		fmt.Printf("Serve 'metadata' over vsock to VMs, e.g. started with 'run qemu -vsock-cid',\n")
+		fmt.Printf("until interrupted. It is read by the vsock provider of the linuxkit/metadata\n")
+		fmt.Printf("package. Linux only.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to serve, instead of 'metadata'")
+	port := flags.Uint("port", metadataChannelPort, "vsock port to serve the metadata on")
+	cid := flags.Uint("cid", 0, "Only serve the VM with this vsock context ID, 0 serves all VMs")
 
-func metadata(args []string) {
-	if len(args) < 1 {
-		metadataUsage()
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	var content []byte
+	switch {
+	case *dataPath != "" && len(remArgs) == 0:
+		var err error
+		if content, err = ioutil.ReadFile(*dataPath); err != nil {
+			log.Fatalf("Cannot read user data from path %s: %v", *dataPath, err)
+		}
+	case *dataPath == "" && len(remArgs) == 1:
+		content = []byte(remArgs[0])
+	default:
+		flags.Usage()
 		os.Exit(1)
 	}
-	switch args[0] {
-	case "help", "-h", "-help", "--help":
-		metadataUsage()
-		os.Exit(0)
+	frame := metadataChannelFrame(content)
+
+	l, err := vsock.Listen(vsock.CIDAny, uint32(*port))
+	if err != nil {
+		log.Fatalf("Unable to listen on vsock port %d: %v", *port, err)
+	}
+	log.Infof("Serving metadata on vsock port %d", *port)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatalf("Unable to accept a connection: %v", err)
+		}
+		if addr, ok := c.RemoteAddr().(*vsock.Addr); ok && *cid != 0 && uint(addr.CID) != *cid {
+			log.Warnf("Refusing the metadata to %s", addr)
+			c.Close()
+			continue
+		}
+		log.Infof("Serving metadata to %s", c.RemoteAddr())
+		if _, err := c.Write(frame); err != nil {
+			log.Warnf("Unable to serve the metadata to %s: %v", c.RemoteAddr(), err)
+		}
+		c.Close()
 	}
+}
 
-	switch args[0] {
-	case "create":
-		metadataCreate(args[1:])
-	default:
-		fmt.Printf("%q is not a valid metadata command.\n\n", args[0])
-		metadataUsage()
-		os.Exit(1)
+// metadataCommand is 'linuxkit metadata'
+func metadataCommand() *command {
+	return &command{
+		name:  "metadata",
+		short: "Metadata utilities",
+		args:  "COMMAND [options]",
+		subcommands: []*command{
+			{name: "create", short: "Create a metadata ISO", run: metadataCreate},
+			{name: "emulate", short: "Serve AWS and GCP style metadata to a VM", run: metadataEmulate},
+			{name: "serve", short: "Serve metadata to VMs over vsock", run: metadataServe},
+		},
 	}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// metadataEmulatorAddress is where the metadata services of AWS and
+	// GCP are reached in the guest
+	metadataEmulatorAddress = "169.254.169.254"
+	// metadataEmulatorFile is the file in the state directory of a VM with
+	// what its emulated metadata service serves
+	metadataEmulatorFile = "metadata.json"
+	// metadataEmulatorToken is the IMDSv2 session token handed out, which
+	// is not checked
+	metadataEmulatorToken = "linuxkit"
+)
+
+// metadataEmulatorConfig is what the emulated metadata service of a VM
+// serves. The network configuration is not served, so the guest keeps
+// using DHCP.
+type metadataEmulatorConfig struct {
+	Hostname   string   `json:"hostname"`
+	InstanceID string   `json:"instance_id"`
+	LocalIPv4  string   `json:"local_ipv4,omitempty"`
+	SSHKeys    []string `json:"ssh_keys,omitempty"`
+	UserData   []byte   `json:"user_data,omitempty"`
+}
+
+// writeMetadataEmulatorConfig writes the config of the metadata service of
+// a VM to its state directory and returns its path
+func writeMetadataEmulatorConfig(state string, config metadataEmulatorConfig) (string, error) {
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(state, metadataEmulatorFile)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return "", fmt.Errorf("Cannot write the metadata of the emulator: %v", err)
+	}
+	return path, nil
+}
+
+// ServeHTTP serves the parts of the AWS and GCP metadata services the
+// linuxkit/metadata package reads
+func (c metadataEmulatorConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var value string
+	var ok bool
+	switch {
+	case r.URL.Path == "/latest/api/token":
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		value, ok = metadataEmulatorToken, true
+	case strings.HasPrefix(r.URL.Path, "/latest/"):
+		value, ok = c.aws(strings.TrimPrefix(r.URL.Path, "/latest/"))
+	case strings.HasPrefix(r.URL.Path, "/computeMetadata/v1/"):
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		value, ok = c.gcp(strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/"))
+	}
+	log.Debugf("Metadata emulator: %s %s", r.Method, r.URL)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, value)
+}
+
+// aws returns the value of a path of the AWS metadata service
+func (c metadataEmulatorConfig) aws(path string) (string, bool) {
+	switch path {
+	case "user-data":
+		return string(c.UserData), c.UserData != nil
+	case "meta-data/hostname", "meta-data/local-hostname":
+		return c.Hostname, true
+	case "meta-data/instance-id":
+		return c.InstanceID, true
+	case "meta-data/local-ipv4":
+		return c.LocalIPv4, c.LocalIPv4 != ""
+	case "meta-data/public-keys/0/openssh-key":
+		return strings.Join(c.SSHKeys, "\n"), len(c.SSHKeys) != 0
+	}
+	return "", false
+}
+
+// gcp returns the value of a path of the GCP metadata service. The SSH keys
+// are the keys of root.
+func (c metadataEmulatorConfig) gcp(path string) (string, bool) {
+	switch path {
+	case "instance/attributes/user-data":
+		return string(c.UserData), c.UserData != nil
+	case "instance/hostname":
+		return c.Hostname, true
+	case "instance/id":
+		return c.InstanceID, true
+	case "project/attributes/ssh-keys":
+		keys := make([]string, len(c.SSHKeys))
+		for i, key := range c.SSHKeys {
+			keys[i] = "root:" + key
+		}
+		return strings.Join(keys, "\n"), len(keys) != 0
+	}
+	return "", false
+}
+
+// stdioConn is a connection on the standard input and output
+type stdioConn struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (c *stdioConn) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (c *stdioConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+func (c *stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioListener accepts the connection on the standard input and output
+// once, and fails once it is closed
+type stdioListener struct {
+	conn     *stdioConn
+	accepted bool
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.conn.closed
+	return nil, errors.New("the connection was closed")
+}
+func (l *stdioListener) Close() error   { return nil }
+func (l *stdioListener) Addr() net.Addr { return stdioAddr{} }
+
+func metadataEmulate(args []string) {
+	flags := newFlagSet("emulate")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s metadata emulate [options] config\n\n", invoked)
+		fmt.Printf("Serve the AWS and GCP style metadata in 'config' to a VM, on a\n")
+		fmt.Printf("connection on the standard input and output. This is run for\n")
+		fmt.Printf("each connection of a VM started with 'run qemu -metadata-emulator'.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	listen := flags.String("listen", "", "Serve the metadata on this TCP address until interrupted, e.g. 127.0.0.1:8080, instead of the standard input and output")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	b, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Cannot read the metadata: %v", err)
+	}
+	var config metadataEmulatorConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		log.Fatalf("Cannot parse the metadata: %v", err)
+	}
+
+	if *listen != "" {
+		log.Infof("Serving metadata on %s", *listen)
+		log.Fatal(http.ListenAndServe(*listen, config))
+	}
+	// the standard output is the connection, logs go to the standard error
+	l := &stdioListener{conn: &stdioConn{closed: make(chan struct{})}}
+	http.Serve(l, config)
+}
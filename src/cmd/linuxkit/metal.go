@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metalAPIURL  = "https://api.equinix.com/metal/v1"
+	metalTimeout = 30 * time.Minute
+)
+
+// MetalClient is a client for the Equinix Metal (formerly Packet) API
+type MetalClient struct {
+	apiKey string
+	client *http.Client
+}
+
+// NewMetalClient creates a client using an API key
+func NewMetalClient(apiKey string) *MetalClient {
+	return &MetalClient{apiKey: apiKey, client: &http.Client{}}
+}
+
+func (c *MetalClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, metalAPIURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	log.Debugf("Equinix Metal: %s %s", method, path)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+			msg = strings.Join(e.Errors, ", ")
+		}
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// MetalDevice is the state of a device
+type MetalDevice struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	State    string `json:"state"`
+	Facility struct {
+		Code string `json:"code"`
+	} `json:"facility"`
+	Metro struct {
+		Code string `json:"code"`
+	} `json:"metro"`
+	IPAddresses []struct {
+		Address string `json:"address"`
+		Public  bool   `json:"public"`
+	} `json:"ip_addresses"`
+	NetworkPorts []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"network_ports"`
+	SpotInstance bool `json:"spot_instance"`
+}
+
+// MetalDeviceCreateRequest is the configuration of a device to create
+type MetalDeviceCreateRequest struct {
+	Hostname     string   `json:"hostname"`
+	Plan         string   `json:"plan"`
+	Metro        string   `json:"metro,omitempty"`
+	Facility     []string `json:"facility,omitempty"`
+	OS           string   `json:"operating_system"`
+	BillingCycle string   `json:"billing_cycle"`
+	Tags         []string `json:"tags,omitempty"`
+	UserData     string   `json:"userdata,omitempty"`
+	// IPXEScriptURL is the iPXE script to boot for the custom_ipxe OS
+	IPXEScriptURL string `json:"ipxe_script_url,omitempty"`
+	AlwaysPXE     bool   `json:"always_pxe,omitempty"`
+	// HardwareReservationID is the ID of a hardware reservation to
+	// provision, or "next-available"
+	HardwareReservationID string  `json:"hardware_reservation_id,omitempty"`
+	SpotInstance          bool    `json:"spot_instance,omitempty"`
+	SpotPriceMax          float64 `json:"spot_price_max,omitempty"`
+}
+
+// MetalDeviceUpdateRequest are the fields of a device which are updated
+type MetalDeviceUpdateRequest struct {
+	Hostname      string `json:"hostname"`
+	IPXEScriptURL string `json:"ipxe_script_url,omitempty"`
+	AlwaysPXE     bool   `json:"always_pxe"`
+}
+
+const metalDeviceInclude = "?include=facility,metro,ip_addresses,network_ports"
+
+// GetDevice returns a device
+func (c *MetalClient) GetDevice(id string) (*MetalDevice, error) {
+	var dev MetalDevice
+	if err := c.do(http.MethodGet, "/devices/"+id+metalDeviceInclude, nil, &dev); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// CreateDevice creates a device in a project
+func (c *MetalClient) CreateDevice(projectID string, req MetalDeviceCreateRequest) (*MetalDevice, error) {
+	var dev MetalDevice
+	if err := c.do(http.MethodPost, "/projects/"+projectID+"/devices"+metalDeviceInclude, req, &dev); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// UpdateDevice updates a device
+func (c *MetalClient) UpdateDevice(id string, req MetalDeviceUpdateRequest) (*MetalDevice, error) {
+	var dev MetalDevice
+	if err := c.do(http.MethodPut, "/devices/"+id+metalDeviceInclude, req, &dev); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// RebootDevice reboots a device
+func (c *MetalClient) RebootDevice(id string) error {
+	return c.do(http.MethodPost, "/devices/"+id+"/actions", map[string]string{"type": "reboot"}, nil)
+}
+
+// DeleteDevice deletes a device
+func (c *MetalClient) DeleteDevice(id string) error {
+	return c.do(http.MethodDelete, "/devices/"+id, nil, nil)
+}
+
+// WaitForDevice waits for a device to be active
+func (c *MetalClient) WaitForDevice(id string) (*MetalDevice, error) {
+	deadline := time.Now().Add(metalTimeout)
+	for time.Now().Before(deadline) {
+		dev, err := c.GetDevice(id)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Equinix Metal: device %s is %s", id, dev.State)
+		switch dev.State {
+		case "active":
+			return dev, nil
+		case "failed":
+			return nil, fmt.Errorf("provisioning of device %s failed", id)
+		}
+		time.Sleep(15 * time.Second)
+	}
+	return nil, fmt.Errorf("timed out waiting for device %s", id)
+}
+
+// AssignVLAN attaches a VLAN, given by its VXLAN ID or UUID, to the bond0
+// port of a device, leaving it in hybrid bonded mode
+func (c *MetalClient) AssignVLAN(dev *MetalDevice, vlan string) error {
+	for _, p := range dev.NetworkPorts {
+		if p.Name == "bond0" {
+			return c.do(http.MethodPost, "/ports/"+p.ID+"/assign", map[string]string{"vnid": vlan}, nil)
+		}
+	}
+	return fmt.Errorf("device %s has no bond0 port", dev.ID)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// The Prometheus metrics of 'daemon' and 'serve', for monitoring shared
+// build servers. The pulls and uploads are those of the jobs of the daemon,
+// which record them as metrics events.
+var (
+	jobsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "linuxkit_daemon_jobs_started_total",
+		Help: "Jobs started by the daemon, by command.",
+	}, []string{"command"})
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "linuxkit_daemon_jobs_finished_total",
+		Help: "Jobs finished, by command and state: succeeded, failed or cancelled.",
+	}, []string{"command", "state"})
+	jobsRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "linuxkit_daemon_jobs_running",
+		Help: "Jobs running, by command.",
+	}, []string{"command"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "linuxkit_daemon_job_duration_seconds",
+		Help:    "Duration of the jobs, by command and state.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"command", "state"})
+	imagePulls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "linuxkit_image_pulls_total",
+		Help: "Images used by jobs, by source: docker or cache, which are hits of the cache, or registry.",
+	}, []string{"source"})
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "linuxkit_upload_duration_seconds",
+		Help:    "Duration of the uploads of jobs, by destination and result.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"destination", "result"})
+	serveRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "linuxkit_serve_requests_total",
+		Help: "HTTP requests served, by status code.",
+	}, []string{"code"})
+	serveBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "linuxkit_serve_bytes_total",
+		Help: "Bytes of the HTTP responses served.",
+	})
+)
+
+// daemonMetrics are the metrics of the jobs of 'daemon'
+func daemonMetrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		jobsStarted, jobsFinished, jobsRunning, jobDuration, imagePulls, uploadDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "linuxkit_image_cache_hit_ratio",
+			Help: "Ratio of the images used by jobs which were in the docker or linuxkit cache.",
+		}, cacheHitRatio),
+	}
+}
+
+// newMetricsHandler returns the handler of /metrics for collectors, with
+// the metrics of the process
+func newMetricsHandler(collectors ...prometheus.Collector) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	registry.MustRegister(collectors...)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func cacheHitRatio() float64 {
+	var hits, total float64
+	for _, source := range []string{"docker", "cache", "registry"} {
+		c, err := imagePulls.GetMetricWithLabelValues(source)
+		if err != nil {
+			continue
+		}
+		var m dto.Metric
+		if err := c.Write(&m); err != nil {
+			continue
+		}
+		n := m.GetCounter().GetValue()
+		total += n
+		if source != "registry" {
+			hits += n
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return hits / total
+}
+
+// serveMetrics serves the metrics of handler as /metrics on addr, as
+// host:port or tcp://host:port, in the background
+func serveMetrics(addr string, handler http.Handler) {
+	addr = strings.TrimPrefix(addr, "tcp://")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	log.Infof("Serving metrics on http://%s/metrics", addr)
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// recordJobEvents adds the metrics events of a job to the metrics
+func recordJobEvents(path string) {
+	events, err := metrics.Read(path)
+	if err != nil {
+		log.Warnf("Unable to read the metrics of a job: %v", err)
+	}
+	for _, e := range events {
+		switch {
+		case e.Pull != "":
+			imagePulls.WithLabelValues(e.Pull).Inc()
+		case e.Upload != "":
+			result := "succeeded"
+			if e.Failed {
+				result = "failed"
+			}
+			uploadDuration.WithLabelValues(e.Upload, result).Observe(e.Duration)
+		}
+	}
+}
+
+// countResponses counts the requests and bytes served by handler
+func countResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(cw, r)
+		serveRequests.WithLabelValues(strconv.Itoa(cw.status)).Inc()
+		serveBytes.Add(float64(cw.written))
+	})
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
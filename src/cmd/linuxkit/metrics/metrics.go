@@ -0,0 +1,85 @@
+// Package metrics records events of the work of linuxkit, such as the
+// images taken from the cache and the uploads of push, for 'linuxkit daemon'
+// which runs the commands as jobs and exports the Prometheus metrics of its
+// server. The events are appended as JSON lines to the file in EventsEnv,
+// and are not recorded if it is not set.
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventsEnv is the variable of the file the events of a job are written to
+const EventsEnv = "LINUXKIT_METRICS_EVENTS"
+
+// Event is an event of a job
+type Event struct {
+	// Pull is where an image was taken from, docker, cache or registry
+	Pull string `json:"pull,omitempty"`
+	// Upload is the destination of an upload, such as s3 or registry,
+	// which took Duration seconds
+	Upload   string  `json:"upload,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Failed   bool    `json:"failed,omitempty"`
+}
+
+var mu sync.Mutex
+
+// Record writes e to the events of the job. The metrics must not fail the
+// work, so errors are ignored.
+func Record(e Event) {
+	path := os.Getenv(EventsEnv)
+	if path == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = f.Write(append(b, '\n'))
+}
+
+// Pull records that an image was taken from source
+func Pull(source string) {
+	Record(Event{Pull: source})
+}
+
+// Upload records an upload to destination started at start, which failed if
+// err is set
+func Upload(destination string, start time.Time, err error) {
+	Record(Event{Upload: destination, Duration: time.Since(start).Seconds(), Failed: err != nil})
+}
+
+// Read returns the events written to path. A missing file has no events.
+func Read(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		// a job killed while writing leaves a partial line
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events")
+
+	// nothing is recorded without a file
+	Pull("cache")
+	os.Setenv(EventsEnv, path)
+	defer os.Unsetenv(EventsEnv)
+	if events, err := Read(path); err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events, got %v %v", events, err)
+	}
+
+	Pull("cache")
+	Pull("registry")
+	Upload("s3", time.Now(), errors.New("denied"))
+	events, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+	if !reflect.DeepEqual(events[:2], []Event{{Pull: "cache"}, {Pull: "registry"}}) {
+		t.Errorf("Unexpected pulls %v", events[:2])
+	}
+	if events[2].Upload != "s3" || !events[2].Failed {
+		t.Errorf("Unexpected upload %v", events[2])
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"strings"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"github.com/opencontainers/go-digest"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -69,7 +71,8 @@ var additions = map[string]addFun{
 	},
 }
 
-// OutputTypes returns a list of the valid output types
+// OutputTypes returns a list of the valid output types, including those of
+// the format plugins
 func OutputTypes() []string {
 	ts := []string{}
 	for k := range streamable {
@@ -78,6 +81,11 @@ func OutputTypes() []string {
 	for k := range outFuns {
 		ts = append(ts, k)
 	}
+	for _, k := range pathFormatPlugins() {
+		if outFuns[k] == nil {
+			ts = append(ts, k)
+		}
+	}
 	sort.Strings(ts)
 
 	return ts
@@ -129,8 +137,7 @@ func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
 func outputImage(image *Image, section string, prefix string, m Moby, idMap map[string]uint32, dupMap map[string]string, pull bool, iw *tar.Writer, cacheDir string, dockerCache bool) error {
 	log.Infof("  Create OCI config for %s", image.Image)
 	useTrust := enforceContentTrust(image.Image, &m.Trust)
-	imageName := referenceExpand(image.Image)
-	ref, err := reference.Parse(imageName)
+	ref, err := parseReference(image.Image)
 	if err != nil {
 		return fmt.Errorf("could not resolve references for image %s: %v", image.Image, err)
 	}
@@ -146,21 +153,37 @@ func outputImage(image *Image, section string, prefix string, m Moby, idMap map[
 	if err != nil {
 		return fmt.Errorf("Failed to create OCI spec for %s: %v", image.Image, err)
 	}
+	oci, err = patchSpec(oci, m.Runtime.Patches[image.Name])
+	if err != nil {
+		return fmt.Errorf("Failed to patch OCI spec for %s: %v", image.Image, err)
+	}
+	if (runtime.OCIRuntime == nil || *runtime.OCIRuntime == "") && m.Runtime.Default != "" {
+		runtime.OCIRuntime = &m.Runtime.Default
+	}
 	config, err := json.MarshalIndent(oci, "", "    ")
 	if err != nil {
 		return fmt.Errorf("Failed to create config for %s: %v", image.Image, err)
 	}
 	path := path.Join("containers", section, prefix+image.Name)
 	readonly := oci.Root.Readonly
+	span := trace.Start("bundle", "image", image.Image, "section", section)
+	defer span.End()
 	err = ImageBundle(path, image.ref, config, runtime, iw, useTrust, pull, readonly, dupMap, cacheDir, dockerCache, m.Architecture)
 	if err != nil {
+		span.SetError(err)
 		return fmt.Errorf("Failed to extract root filesystem for %s: %v", image.Image, err)
 	}
 	return nil
 }
 
 // Build performs the actual build process
-func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cacheDir string, dockerCache bool) error {
+func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cacheDir string, dockerCache bool) (err error) {
+	span := trace.Start("assemble", "type", tp, "arch", m.Architecture)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	if MobyDir == "" {
 		MobyDir = defaultMobyConfigDir()
 	}
@@ -190,15 +213,32 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 		idMap[image.Name] = id
 		id++
 	}
+	for name := range m.Runtime.Patches {
+		if _, ok := idMap[name]; !ok {
+			return fmt.Errorf("runtime patches for unknown container %s", name)
+		}
+	}
 
 	// deduplicate containers with the same image
 	dupMap := map[string]string{}
 
+	// the images built by pkg build which were not pushed are only in docker
+	fromDocker := func(ref *reference.Spec) bool {
+		if dockerCache || pull {
+			return dockerCache
+		}
+		if _, ok := builtImageID(ref, m.Architecture); ok {
+			log.Infof("Using %s built by pkg build from docker", ref)
+			return true
+		}
+		return false
+	}
+
 	if m.Kernel.ref != nil {
 		// get kernel and initrd tarball and ucode cpio archive from container
 		log.Infof("Extract kernel image: %s", m.Kernel.ref)
 		kf := newKernelFilter(iw, m.Kernel.Cmdline, m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode, decompressKernel)
-		err := ImageTar(m.Kernel.ref, "", kf, enforceContentTrust(m.Kernel.ref.String(), &m.Trust), pull, "", cacheDir, dockerCache, m.Architecture)
+		err := ImageTar(m.Kernel.ref, "", kf, enforceContentTrust(m.Kernel.ref.String(), &m.Trust), pull, "", cacheDir, fromDocker(m.Kernel.ref), m.Architecture)
 		if err != nil {
 			return fmt.Errorf("Failed to extract kernel image and tarball: %v", err)
 		}
@@ -212,20 +252,31 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 	if len(m.Init) != 0 {
 		log.Infof("Add init containers:")
 	}
+	var initWriter tarWriter = iw
+	var cf *containerdFilter
+	if m.Runtime.Containerd != "" {
+		cf = newContainerdFilter(iw, m.Runtime.Containerd)
+		initWriter = cf
+	}
 	for _, ii := range m.initRefs {
 		log.Infof("Process init image: %s", ii)
-		err := ImageTar(ii, "", iw, enforceContentTrust(ii.String(), &m.Trust), pull, resolvconfSymlink, cacheDir, dockerCache, m.Architecture)
+		err := ImageTar(ii, "", initWriter, enforceContentTrust(ii.String(), &m.Trust), pull, resolvconfSymlink, cacheDir, fromDocker(ii), m.Architecture)
 		if err != nil {
 			return fmt.Errorf("Failed to build init tarball from %s: %v", ii, err)
 		}
 	}
+	if cf != nil {
+		if err := cf.Close(); err != nil {
+			return err
+		}
+	}
 
 	if len(m.Onboot) != 0 {
 		log.Infof("Add onboot containers:")
 	}
 	for i, image := range m.Onboot {
 		so := fmt.Sprintf("%03d", i)
-		if err := outputImage(image, "onboot", so+"-", m, idMap, dupMap, pull, iw, cacheDir, dockerCache); err != nil {
+		if err := outputImage(image, "onboot", so+"-", m, idMap, dupMap, pull, iw, cacheDir, fromDocker(image.ref)); err != nil {
 			return err
 		}
 	}
@@ -235,7 +286,7 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 	}
 	for i, image := range m.Onshutdown {
 		so := fmt.Sprintf("%03d", i)
-		if err := outputImage(image, "onshutdown", so+"-", m, idMap, dupMap, pull, iw, cacheDir, dockerCache); err != nil {
+		if err := outputImage(image, "onshutdown", so+"-", m, idMap, dupMap, pull, iw, cacheDir, fromDocker(image.ref)); err != nil {
 			return err
 		}
 	}
@@ -244,16 +295,23 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 		log.Infof("Add service containers:")
 	}
 	for _, image := range m.Services {
-		if err := outputImage(image, "services", "", m, idMap, dupMap, pull, iw, cacheDir, dockerCache); err != nil {
+		if err := outputImage(image, "services", "", m, idMap, dupMap, pull, iw, cacheDir, fromDocker(image.ref)); err != nil {
 			return err
 		}
 	}
 
 	// add files
-	err := filesystem(m, iw, idMap)
+	manifest := newManifest(m, cacheDir)
+	if err := manifest.resolveConfig(m); err != nil {
+		return fmt.Errorf("failed to resolve the configuration: %v", err)
+	}
+	err = filesystem(m, iw, idMap, manifest)
 	if err != nil {
 		return fmt.Errorf("failed to add filesystem parts: %v", err)
 	}
+	if err := manifest.write(iw); err != nil {
+		return fmt.Errorf("failed to add the manifest: %v", err)
+	}
 
 	// add anything additional for this output type
 	if addition != nil {
@@ -271,10 +329,25 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 	return nil
 }
 
+// FileSourceDigest returns the path of the source of a file, and the digest
+// it is pinned to with @sha256:, if it is
+func FileSourceDigest(source string) (string, digest.Digest, error) {
+	i := strings.LastIndex(source, "@sha256:")
+	if i < 0 {
+		return source, "", nil
+	}
+	d := digest.Digest(source[i+1:])
+	if err := d.Validate(); err != nil {
+		return "", "", fmt.Errorf("invalid digest of the file source %s: %v", source, err)
+	}
+	return source[:i], d, nil
+}
+
 // kernelFilter is a tar.Writer that transforms a kernel image into the output we want on underlying tar writer
 type kernelFilter struct {
 	tw               *tar.Writer
 	buffer           *bytes.Buffer
+	ktar             *os.File
 	hdr              *tar.Header
 	cmdline          string
 	kernel           string
@@ -305,36 +378,40 @@ func newKernelFilter(tw *tar.Writer, cmdline string, kernel string, tar, ucode *
 }
 
 func (k *kernelFilter) finishTar() error {
-	if k.buffer == nil {
+	if k.ktar != nil {
+		// the kernel tarball is spooled to a temporary file as it may be large
+		f := k.ktar
+		k.ktar = nil
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return tarAppend(k.tw, tar.NewReader(f))
+	}
+	if k.buffer == nil || k.hdr == nil {
 		return nil
 	}
 
-	if k.hdr != nil {
-		if k.decompressKernel {
-			log.Debugf("Decompressing kernel")
-			b, err := decompressKernel(k.buffer)
-			if err != nil {
-				return err
-			}
-			k.buffer = b
-			k.hdr.Size = int64(k.buffer.Len())
-		}
-
-		if err := k.tw.WriteHeader(k.hdr); err != nil {
-			return err
-		}
-		if _, err := k.tw.Write(k.buffer.Bytes()); err != nil {
+	if k.decompressKernel {
+		log.Debugf("Decompressing kernel")
+		b, err := decompressKernel(k.buffer)
+		if err != nil {
 			return err
 		}
-		k.hdr = nil
-		k.buffer = nil
-		return nil
+		k.buffer = b
+		k.hdr.Size = int64(k.buffer.Len())
 	}
 
-	tr := tar.NewReader(k.buffer)
-	err := tarAppend(k.tw, tr)
+	if err := k.tw.WriteHeader(k.hdr); err != nil {
+		return err
+	}
+	if _, err := k.tw.Write(k.buffer.Bytes()); err != nil {
+		return err
+	}
+	k.hdr = nil
 	k.buffer = nil
-	return err
+	return nil
 }
 
 func (k *kernelFilter) Close() error {
@@ -359,6 +436,9 @@ func (k *kernelFilter) Write(b []byte) (n int, err error) {
 	if k.discard {
 		return len(b), nil
 	}
+	if k.ktar != nil {
+		return k.ktar.Write(b)
+	}
 	if k.buffer != nil {
 		return k.buffer.Write(b)
 	}
@@ -419,7 +499,11 @@ func (k *kernelFilter) WriteHeader(hdr *tar.Header) error {
 	case k.tar:
 		k.foundKTar = true
 		k.discard = false
-		k.buffer = new(bytes.Buffer)
+		f, err := ioutil.TempFile("", "kernel-tar")
+		if err != nil {
+			return err
+		}
+		k.ktar = f
 	case k.ucode:
 		k.foundUCode = true
 		k.discard = false
@@ -477,7 +561,8 @@ func tarAppend(iw *tar.Writer, tr *tar.Reader) error {
 // Attempt to decompress a Linux kernel image
 // The kernel image can be a plain gzip'ed image (e.g., the LinuxKit arm64 kernel) or a bzImage (x86)
 // or not compressed at all (e.g., s390x). This function tries to detect the image type and decompress
-// the kernel. If no supported compressed kernel is found it returns an error.
+// the kernel. A riscv64 Image, which is not compressed, is returned as is. If no supported compressed
+// kernel is found it returns an error.
 // For bzImages it performs some sanity checks on the header and currently only supports gzip'ed bzImages.
 func decompressKernel(src *bytes.Buffer) (*bytes.Buffer, error) {
 	const gzipMagic = "\037\213"
@@ -489,6 +574,15 @@ func decompressKernel(src *bytes.Buffer) (*bytes.Buffer, error) {
 		return gunzip(src)
 	}
 
+	// Check if it is a riscv64 Image
+	// See: https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/Documentation/riscv/boot-image-header.rst
+	const riscvMagicIdx = 0x38
+	const riscvMagic = "RSC\x05"
+	if len(s) > riscvMagicIdx+len(riscvMagic) && bytes.HasPrefix(s[riscvMagicIdx:], []byte(riscvMagic)) {
+		log.Debugf("Found riscv64 Image Magic")
+		return src, nil
+	}
+
 	// Check if it is a bzImage
 	// See: https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/Documentation/x86/boot.txt
 	const bzMagicIdx = 0x1fe
@@ -567,7 +661,7 @@ func metadata(m Moby, md string) ([]byte, error) {
 	}
 }
 
-func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
+func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32, manifest *Manifest) error {
 	// TODO also include the files added in other parts of the build
 	var addedFiles = map[string]bool{}
 
@@ -626,7 +720,10 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 				return fmt.Errorf("Specified Source and Metadata for file: %s", f.Path)
 			}
 			if f.Source != "" {
-				source := f.Source
+				source, pinned, err := FileSourceDigest(f.Source)
+				if err != nil {
+					return err
+				}
 				if len(source) > 2 && source[:2] == "~/" {
 					source = util.HomeDir() + source[1:]
 				}
@@ -638,11 +735,13 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 						continue
 					}
 				}
-				var err error
 				contents, err = ioutil.ReadFile(source)
 				if err != nil {
 					return err
 				}
+				if pinned != "" && digest.FromBytes(contents) != pinned {
+					return fmt.Errorf("file %s is not the file %s is pinned to, its digest is %s", source, f.Path, digest.FromBytes(contents))
+				}
 			} else {
 				contents, err = metadata(m, f.Metadata)
 				if err != nil {
@@ -704,6 +803,7 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if err != nil {
 				return err
 			}
+			manifest.addFile(f, hdr, nil)
 		} else if f.Symlink != "" {
 			hdr.Typeflag = tar.TypeSymlink
 			hdr.Linkname = f.Symlink
@@ -711,6 +811,7 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if err != nil {
 				return err
 			}
+			manifest.addFile(f, hdr, nil)
 		} else {
 			hdr.Size = int64(len(contents))
 			err := tw.WriteHeader(hdr)
@@ -721,6 +822,7 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if err != nil {
 				return err
 			}
+			manifest.addFile(f, hdr, contents)
 		}
 	}
 	return nil
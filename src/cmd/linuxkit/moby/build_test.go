@@ -0,0 +1,42 @@
+package moby
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestDecompressKernel(t *testing.T) {
+	kernel := bytes.Repeat([]byte{0x13}, 0x100)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(kernel); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := decompressKernel(&gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), kernel) {
+		t.Error("Expected the gzip'ed kernel to be decompressed")
+	}
+
+	// a riscv64 Image is not compressed
+	image := append([]byte(nil), kernel...)
+	copy(image[0x38:], "RSC\x05")
+	out, err = decompressKernel(bytes.NewBuffer(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Error("Expected the riscv64 Image to be returned as is")
+	}
+
+	if _, err := decompressKernel(bytes.NewBuffer(kernel)); err == nil {
+		t.Error("Expected an unknown kernel format to fail")
+	}
+}
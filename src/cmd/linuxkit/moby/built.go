@@ -0,0 +1,85 @@
+package moby
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/docker"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// BuiltImagesFile is the file of the images which were built by
+// `linuxkit pkg build` and not pushed, so are only in docker
+var BuiltImagesFile = filepath.Join(util.HomeDir(), ".linuxkit", "built-images.json")
+
+// PreferBuiltImages makes builds take the images which were built by
+// `linuxkit pkg build` from docker instead of the cache or the registry
+var PreferBuiltImages = true
+
+// builtImages are the IDs in docker of the built images, by image and
+// architecture
+type builtImages map[string]map[string]string
+
+func readBuiltImages() (builtImages, error) {
+	built := builtImages{}
+	b, err := ioutil.ReadFile(BuiltImagesFile)
+	if os.IsNotExist(err) {
+		return built, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return built, json.Unmarshal(b, &built)
+}
+
+// RecordBuiltImage records that the image was built for the architecture,
+// as the image of the ID in docker, so builds prefer it to the registry
+func RecordBuiltImage(image, architecture, id string) error {
+	built, err := readBuiltImages()
+	if err != nil {
+		return err
+	}
+	image = ReferenceExpand(image)
+	if built[image] == nil {
+		built[image] = map[string]string{}
+	}
+	built[image][architecture] = id
+	b, err := json.MarshalIndent(built, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(BuiltImagesFile), 0755); err != nil {
+		return err
+	}
+	tmp := BuiltImagesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, BuiltImagesFile)
+}
+
+// builtImageID returns the ID of the image which was built for the
+// architecture, if builds prefer built images and it is still the image in
+// docker, such that it has not been pulled again since
+func builtImageID(ref *reference.Spec, architecture string) (string, bool) {
+	if !PreferBuiltImages {
+		return "", false
+	}
+	built, err := readBuiltImages()
+	if err != nil {
+		log.Warnf("Unable to read the built images %s: %v", BuiltImagesFile, err)
+		return "", false
+	}
+	id := built[ref.String()][architecture]
+	if id == "" {
+		return "", false
+	}
+	if current, err := docker.ImageID(ref); err != nil || current != id {
+		return "", false
+	}
+	return id, true
+}
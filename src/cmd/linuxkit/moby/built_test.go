@@ -0,0 +1,48 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestRecordBuiltImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "built")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { BuiltImagesFile = file }(BuiltImagesFile)
+	BuiltImagesFile = filepath.Join(dir, "linuxkit", "built-images.json")
+
+	for _, b := range []struct{ image, arch, id string }{
+		{"linuxkit/init:dev", "amd64", "sha256:1"},
+		{"linuxkit/init:dev", "arm64", "sha256:2"},
+		{"linuxkit/init:dev", "amd64", "sha256:3"},
+	} {
+		if err := RecordBuiltImage(b.image, b.arch, b.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	built, err := readBuiltImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := built["docker.io/linuxkit/init:dev"]
+	if len(built) != 1 || ids["amd64"] != "sha256:3" || ids["arm64"] != "sha256:2" {
+		t.Errorf("Unexpected built images %v", built)
+	}
+
+	defer func(prefer bool) { PreferBuiltImages = prefer }(PreferBuiltImages)
+	PreferBuiltImages = false
+	ref, err := reference.Parse("docker.io/linuxkit/init:dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := builtImageID(&ref, "amd64"); ok {
+		t.Error("Expected built images not to be preferred")
+	}
+}
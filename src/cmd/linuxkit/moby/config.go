@@ -16,14 +16,15 @@ import (
 
 // Moby is the type of a Moby config file
 type Moby struct {
-	Kernel       KernelConfig `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
-	Init         []string     `init:"cmdline" json:"init"`
-	Onboot       []*Image     `yaml:"onboot" json:"onboot"`
-	Onshutdown   []*Image     `yaml:"onshutdown" json:"onshutdown"`
-	Services     []*Image     `yaml:"services" json:"services"`
-	Trust        TrustConfig  `yaml:"trust,omitempty" json:"trust,omitempty"`
-	Files        []File       `yaml:"files" json:"files"`
-	Architecture string
+	Kernel       KernelConfig  `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
+	Init         []string      `init:"cmdline" json:"init"`
+	Onboot       []*Image      `yaml:"onboot" json:"onboot"`
+	Onshutdown   []*Image      `yaml:"onshutdown" json:"onshutdown"`
+	Services     []*Image      `yaml:"services" json:"services"`
+	Trust        TrustConfig   `yaml:"trust,omitempty" json:"trust,omitempty"`
+	Files        []File        `yaml:"files" json:"files"`
+	Runtime      RuntimeConfig `yaml:"runtime,omitempty" json:"runtime,omitempty"`
+	Architecture string        `yaml:"architecture,omitempty"`
 
 	initRefs []*reference.Spec
 }
@@ -45,6 +46,26 @@ type TrustConfig struct {
 	Org   []string `yaml:"org,omitempty" json:"org,omitempty"`
 }
 
+// RuntimeConfig is the type of the config of how the containers are run
+type RuntimeConfig struct {
+	// Default is the OCI runtime the containers which do not set one are
+	// run with, instead of runc, such as crun or runsc
+	Default string `yaml:"default,omitempty" json:"default,omitempty"`
+	// Containerd is TOML which is merged into the containerd config of the
+	// init images
+	Containerd string `yaml:"containerd,omitempty" json:"containerd,omitempty"`
+	// Patches are JSON patches of the OCI specs of the containers, by name
+	Patches map[string][]JSONPatch `yaml:"patches,omitempty" json:"patches,omitempty"`
+}
+
+// JSONPatch is an operation of a JSON patch, as in RFC 6902
+type JSONPatch struct {
+	Op    string      `yaml:"op" json:"op"`
+	Path  string      `yaml:"path" json:"path"`
+	From  string      `yaml:"from,omitempty" json:"from,omitempty"`
+	Value interface{} `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
 // File is the type of a file specification
 type File struct {
 	Path      string      `yaml:"path" json:"path"`
@@ -116,6 +137,7 @@ type Runtime struct {
 	Interfaces *[]Interface   `yaml:"interfaces,omitempty,omitempty" json:"interfaces,omitempty"`
 	BindNS     Namespaces     `yaml:"bindNS,omitempty" json:"bindNS,omitempty"`
 	Namespace  *string        `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	OCIRuntime *string        `yaml:"ociRuntime,omitempty" json:"ociRuntime,omitempty"`
 }
 
 // Namespaces is the type for configuring paths to bind namespaces
@@ -170,8 +192,15 @@ func uniqueServices(m Moby) error {
 	return nil
 }
 
-// referenceExpand expands "redis" to "docker.io/library/redis" so all images have a full domain
-func referenceExpand(ref string) string {
+// dockerPrefix marks images which are taken from the local docker daemon with
+// docker save, instead of from a registry, such as "docker:linuxkit/init:dev"
+const dockerPrefix = "docker:"
+
+// ReferenceExpand expands "redis" to "docker.io/library/redis" so all images have a full domain
+func ReferenceExpand(ref string) string {
+	if strings.HasPrefix(ref, dockerPrefix) {
+		return dockerPrefix + ReferenceExpand(strings.TrimPrefix(ref, dockerPrefix))
+	}
 	parts := strings.Split(ref, "/")
 	switch len(parts) {
 	case 1:
@@ -183,37 +212,72 @@ func referenceExpand(ref string) string {
 	}
 }
 
+// parseReference parses the expanded reference of an image, keeping the
+// docker prefix of images from the local docker daemon in its locator
+func parseReference(image string) (reference.Spec, error) {
+	local := strings.HasPrefix(image, dockerPrefix)
+	r, err := reference.Parse(ReferenceExpand(strings.TrimPrefix(image, dockerPrefix)))
+	if err != nil {
+		return r, err
+	}
+	// images may be pinned with @sha256:, which is checked when they are pulled
+	if d := r.Digest(); d != "" {
+		if err := d.Validate(); err != nil {
+			return r, fmt.Errorf("invalid digest of %s: %v", image, err)
+		}
+	}
+	if local {
+		r.Locator = dockerPrefix + r.Locator
+	}
+	return r, nil
+}
+
+// localReference returns the reference without the docker prefix, and
+// whether the image is taken from the local docker daemon
+func localReference(ref *reference.Spec) (*reference.Spec, bool) {
+	if !strings.HasPrefix(ref.Locator, dockerPrefix) {
+		return ref, false
+	}
+	local := *ref
+	local.Locator = strings.TrimPrefix(ref.Locator, dockerPrefix)
+	// docker save saves all the tags of an image without one
+	if local.Object == "" {
+		local.Object = "latest"
+	}
+	return &local, true
+}
+
 func extractReferences(m *Moby) error {
 	if m.Kernel.Image != "" {
-		r, err := reference.Parse(referenceExpand(m.Kernel.Image))
+		r, err := parseReference(m.Kernel.Image)
 		if err != nil {
 			return fmt.Errorf("extract kernel image reference: %v", err)
 		}
 		m.Kernel.ref = &r
 	}
 	for _, ii := range m.Init {
-		r, err := reference.Parse(referenceExpand(ii))
+		r, err := parseReference(ii)
 		if err != nil {
 			return fmt.Errorf("extract init image reference: %v", err)
 		}
 		m.initRefs = append(m.initRefs, &r)
 	}
 	for _, image := range m.Onboot {
-		r, err := reference.Parse(referenceExpand(image.Image))
+		r, err := parseReference(image.Image)
 		if err != nil {
 			return fmt.Errorf("extract on boot image reference: %v", err)
 		}
 		image.ref = &r
 	}
 	for _, image := range m.Onshutdown {
-		r, err := reference.Parse(referenceExpand(image.Image))
+		r, err := parseReference(image.Image)
 		if err != nil {
 			return fmt.Errorf("extract on shutdown image reference: %v", err)
 		}
 		image.ref = &r
 	}
 	for _, image := range m.Services {
-		r, err := reference.Parse(referenceExpand(image.Image))
+		r, err := parseReference(image.Image)
 		if err != nil {
 			return fmt.Errorf("extract service image reference: %v", err)
 		}
@@ -254,7 +318,7 @@ func NewConfig(config []byte) (Moby, error) {
 	var rawYaml interface{}
 	err := yaml.Unmarshal(config, &rawYaml)
 	if err != nil {
-		return m, err
+		return m, yamlError(err)
 	}
 
 	// Convert to raw JSON
@@ -268,11 +332,17 @@ func NewConfig(config []byte) (Moby, error) {
 		return m, err
 	}
 	if !result.Valid() {
-		fmt.Printf("The configuration file is invalid:\n")
+		lines := parseYAMLLines(config)
+		var errs ConfigErrors
 		for _, desc := range result.Errors() {
-			fmt.Printf("- %s\n", desc)
+			path := strings.Split(desc.Context().String(), ".")[1:]
+			if p, ok := desc.Details()["property"].(string); ok {
+				path = append(path, p)
+			}
+			line, column := locate(lines, path)
+			errs = append(errs, ConfigError{Line: line, Column: column, Message: desc.String()})
 		}
-		return m, fmt.Errorf("invalid configuration file")
+		return m, errs
 	}
 
 	// Parse yaml
@@ -322,6 +392,25 @@ func AppendConfig(m0, m1 Moby) (Moby, error) {
 	moby.Trust.Org = append(moby.Trust.Org, m1.Trust.Org...)
 	moby.initRefs = append(moby.initRefs, m1.initRefs...)
 	moby.Architecture = m1.Architecture
+	if m1.Runtime.Default != "" {
+		moby.Runtime.Default = m1.Runtime.Default
+	}
+	if m1.Runtime.Containerd != "" {
+		if moby.Runtime.Containerd != "" {
+			moby.Runtime.Containerd += "\n"
+		}
+		moby.Runtime.Containerd += m1.Runtime.Containerd
+	}
+	if len(m1.Runtime.Patches) > 0 {
+		patches := map[string][]JSONPatch{}
+		for name, p := range moby.Runtime.Patches {
+			patches[name] = p
+		}
+		for name, p := range m1.Runtime.Patches {
+			patches[name] = append(patches[name], p...)
+		}
+		moby.Runtime.Patches = patches
+	}
 
 	return moby, uniqueServices(moby)
 }
@@ -369,9 +458,8 @@ func NewImage(config []byte) (Image, error) {
 		return mi, err
 	}
 	if !result.Valid() {
-		fmt.Printf("The org.mobyproject.config label is invalid:\n")
 		for _, desc := range result.Errors() {
-			fmt.Printf("- %s\n", desc)
+			log.Errorf("The org.mobyproject.config label is invalid: %s", desc)
 		}
 		return mi, fmt.Errorf("invalid configuration label")
 	}
@@ -595,6 +683,7 @@ func assignRuntime(v1, v2 *Runtime) Runtime {
 	runtimeMkdir := assignStrings(v1.Mkdir, v2.Mkdir)
 	runtimeInterfaces := assignRuntimeInterfaceArray(v1.Interfaces, v2.Interfaces)
 	runtimeNamespace := assignString(v1.Namespace, v2.Namespace)
+	runtimeOCIRuntime := assignString(v1.OCIRuntime, v2.OCIRuntime)
 	runtime := Runtime{
 		Cgroups:    &runtimeCgroups,
 		Mounts:     &runtimeMounts,
@@ -609,7 +698,8 @@ func assignRuntime(v1, v2 *Runtime) Runtime {
 			User:   assignStringPtr(v1.BindNS.User, v2.BindNS.User),
 			Uts:    assignStringPtr(v1.BindNS.Uts, v2.BindNS.Uts),
 		},
-		Namespace: &runtimeNamespace,
+		Namespace:  &runtimeNamespace,
+		OCIRuntime: &runtimeOCIRuntime,
 	}
 	return runtime
 }
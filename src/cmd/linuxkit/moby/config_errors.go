@@ -0,0 +1,166 @@
+package moby
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConfigError is an error in a configuration file, at the line and column
+// of the setting it is about, or 0 if they are not known
+type ConfigError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ConfigErrors are the errors of an invalid configuration file
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid configuration file: " + strings.Join(messages, "; ")
+}
+
+// yamlErrorLine matches the line of the errors of the yaml parser
+var yamlErrorLine = regexp.MustCompile(`^yaml: line ([0-9]+): (.*)$`)
+
+// yamlError returns the error of the yaml parser as a ConfigError
+func yamlError(err error) ConfigErrors {
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return ConfigErrors{{Line: line, Message: m[2]}}
+	}
+	return ConfigErrors{{Message: strings.TrimPrefix(err.Error(), "yaml: ")}}
+}
+
+// yamlLine is a line of a YAML document, with the columns of the list
+// items and the key it starts
+type yamlLine struct {
+	// first is the column of the first item or key, or -1 if the line is
+	// blank or a comment
+	first  int
+	dashes []int
+	key    string
+	keyCol int
+}
+
+func parseYAMLLines(config []byte) []yamlLine {
+	var lines []yamlLine
+	for _, text := range strings.Split(string(config), "\n") {
+		l := yamlLine{first: -1, keyCol: -1}
+		col := len(text) - len(strings.TrimLeft(text, " "))
+		rest := text[col:]
+		if rest == "" || rest[0] == '#' {
+			lines = append(lines, l)
+			continue
+		}
+		l.first = col
+		for rest == "-" || strings.HasPrefix(rest, "- ") {
+			l.dashes = append(l.dashes, col)
+			trimmed := strings.TrimLeft(rest[1:], " ")
+			col += len(rest) - len(trimmed)
+			rest = trimmed
+		}
+		if i := strings.Index(rest, ":"); i > 0 && (i == len(rest)-1 || rest[i+1] == ' ') {
+			l.key = strings.Trim(rest[:i], `"'`)
+			l.keyCol = col
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// locate returns the line and column of the setting at path in a block
+// style YAML document, as far as it can be found
+func locate(lines []yamlLine, path []string) (int, int) {
+	line, column := 0, 0
+	start, end, parent := 0, len(lines), -1
+	for _, p := range path {
+		found := -1
+		if n, err := strconv.Atoi(p); err == nil {
+			// the n-th item of a list, whose items have the column of
+			// the first one
+			itemCol, count := -1, 0
+			for i := start; i < end && found < 0; i++ {
+				l := lines[i]
+				if len(l.dashes) == 0 || l.dashes[0] < parent {
+					continue
+				}
+				if itemCol < 0 {
+					itemCol = l.dashes[0]
+				}
+				if l.dashes[0] == itemCol {
+					if count == n {
+						found = i
+					}
+					count++
+				}
+			}
+			if found < 0 {
+				break
+			}
+			column = itemCol + 1
+			parent = itemCol
+			start, end = found, itemEnd(lines, found, itemCol, end)
+		} else {
+			// a key of a mapping, whose keys have the column of the first
+			keyCol := -1
+			for i := start; i < end && found < 0; i++ {
+				l := lines[i]
+				if l.keyCol <= parent {
+					continue
+				}
+				if keyCol < 0 {
+					keyCol = l.keyCol
+				}
+				if l.keyCol == keyCol && l.key == p {
+					found = i
+				}
+			}
+			if found < 0 {
+				break
+			}
+			column = keyCol + 1
+			parent = keyCol
+			start, end = found+1, keyEnd(lines, found, keyCol, end)
+		}
+		line = found + 1
+	}
+	return line, column
+}
+
+// itemEnd returns the end of the list item at line i with its dash at col,
+// which is the next line starting at col or before
+func itemEnd(lines []yamlLine, i, col, end int) int {
+	for j := i + 1; j < end; j++ {
+		if l := lines[j]; l.first >= 0 && l.first <= col {
+			return j
+		}
+	}
+	return end
+}
+
+// keyEnd returns the end of the value of the key at line i at col, which is
+// the next line starting before col or with a key at col. A list may be at
+// the column of its key.
+func keyEnd(lines []yamlLine, i, col, end int) int {
+	for j := i + 1; j < end; j++ {
+		l := lines[j]
+		if l.first >= 0 && (l.first < col || l.first == col && len(l.dashes) == 0) {
+			return j
+		}
+	}
+	return end
+}
@@ -0,0 +1,81 @@
+package moby
+
+import (
+	"testing"
+)
+
+func TestConfigErrorLines(t *testing.T) {
+	config := `kernel:
+  image: linuxkit/kernel:5.10.104
+  cmdline: "console=ttyS0"
+init:
+  - linuxkit/init:v0.8
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v0.8
+  - name: dhcpcd
+    imag: linuxkit/dhcpcd:v0.8
+services:
+- name: getty
+  image: linuxkit/getty:v0.8
+  capabilities: 7
+files:
+  - path: etc/foo
+    contents: "foo"
+typo: true
+`
+	_, err := NewConfig([]byte(config))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+	lines := map[int]bool{}
+	for _, e := range errs {
+		lines[e.Line] = true
+	}
+	// the misspelt image key, the capabilities of getty, and the unknown
+	// top level key
+	for _, line := range []int{10, 14, 18} {
+		if !lines[line] {
+			t.Errorf("Expected an error on line %d, got %v", line, errs)
+		}
+	}
+	for _, e := range errs {
+		if e.Line == 0 {
+			t.Errorf("Expected the line of %v", e)
+		}
+	}
+}
+
+func TestConfigSyntaxErrorLine(t *testing.T) {
+	_, err := NewConfig([]byte("kernel:\n  image: foo\n bad: [\n"))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line == 0 {
+		t.Fatalf("Expected an error with a line, got %v", err)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	lines := parseYAMLLines([]byte(`onboot:
+- name: a
+  binds:
+    - /a:/a
+    - /b:/b
+- name: b
+  image: b
+`))
+	for _, c := range []struct {
+		path         []string
+		line, column int
+	}{
+		{[]string{"onboot"}, 1, 1},
+		{[]string{"onboot", "1"}, 6, 1},
+		{[]string{"onboot", "1", "image"}, 7, 3},
+		{[]string{"onboot", "0", "binds", "1"}, 5, 5},
+		{[]string{"onboot", "0", "missing"}, 2, 1},
+	} {
+		if line, column := locate(lines, c.path); line != c.line || column != c.column {
+			t.Errorf("Expected %v at %d:%d, got %d:%d", c.path, c.line, c.column, line, column)
+		}
+	}
+}
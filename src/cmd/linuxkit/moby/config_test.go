@@ -107,3 +107,28 @@ func TestIdMap(t *testing.T) {
 		t.Error("Expected numerical gid to work")
 	}
 }
+
+func TestLocalImages(t *testing.T) {
+	m, err := NewConfig([]byte("kernel:\n  image: docker:linuxkit/kernel\ninit:\n  - docker:linuxkit/init:dev\n  - linuxkit/runc:v0.8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateImages(&m)
+	if m.Kernel.Image != "docker:docker.io/linuxkit/kernel" {
+		t.Errorf("Expected the docker prefix to be kept, got %s", m.Kernel.Image)
+	}
+	if m.Init[0] != "docker:docker.io/linuxkit/init:dev" || m.Init[1] != "docker.io/linuxkit/runc:v0.8" {
+		t.Errorf("Unexpected init images %v", m.Init)
+	}
+
+	local, ok := localReference(m.Kernel.ref)
+	if !ok || local.String() != "docker.io/linuxkit/kernel:latest" {
+		t.Errorf("Expected a local image with the latest tag, got %s %t", local, ok)
+	}
+	if _, ok := localReference(m.initRefs[1]); ok {
+		t.Error("Expected an image from a registry not to be local")
+	}
+	if ReferenceExpand("docker:redis") != "docker:docker.io/library/redis" {
+		t.Errorf("Unexpected expansion %s", ReferenceExpand("docker:redis"))
+	}
+}
@@ -31,7 +31,7 @@ func dockerRun(input io.Reader, output io.Writer, trust bool, img string, args .
 	// Pull first to avoid https://github.com/docker/cli/issues/631
 	pull := exec.Command(docker, "pull", img)
 	pull.Env = env
-	if err := pull.Run(); err != nil {
+	if err := pull.Run(); err != nil && !dockerHasImage(env, docker, img) {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			return fmt.Errorf("docker pull %s failed: %v output:\n%s", img, err, exitError.Stderr)
 		}
@@ -54,3 +54,16 @@ func dockerRun(input io.Reader, output io.Writer, trust bool, img string, args .
 	log.Debugf("docker run %s (input): %s...Done", img, strings.Join(args, " "))
 	return nil
 }
+
+// dockerHasImage returns whether docker has the image img, which is run
+// without pulling it when the registry cannot be reached, e.g. once it was
+// loaded by `linuxkit bundle import`
+func dockerHasImage(env []string, docker, img string) bool {
+	inspect := exec.Command(docker, "image", "inspect", img)
+	inspect.Env = env
+	if err := inspect.Run(); err != nil {
+		return false
+	}
+	log.Debugf("Unable to pull %s, using the image docker has", img)
+	return true
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	log "github.com/sirupsen/logrus"
@@ -29,6 +30,9 @@ type tarWriter interface {
 type ImageSource interface {
 	Config() (imagespec.ImageConfig, error)
 	TarReader() (io.ReadCloser, error)
+	// Descriptor returns the descriptor of the root index or manifest, or nil
+	// if the source is not content addressed.
+	Descriptor() *v1.Descriptor
 }
 
 // This uses Docker to convert a Docker image into a tarball. It would be an improvement if we
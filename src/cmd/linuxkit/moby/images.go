@@ -2,17 +2,45 @@ package moby
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/docker"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	log "github.com/sirupsen/logrus"
 )
 
 // imagePull pull an image from the OCI registry to the cache.
 // If the image root already is in the cache, use it, unless
 // the option pull is set to true.
 // if alwaysPull, then do not even bother reading locally
-func imagePull(ref *reference.Spec, alwaysPull bool, trust bool, cacheDir string, dockerCache bool, architecture string) (ImageSource, error) {
+func imagePull(ref *reference.Spec, alwaysPull bool, trust bool, cacheDir string, dockerCache bool, architecture string) (src ImageSource, err error) {
+	var source string
+	span := trace.Start("pull", "image", ref.String(), "arch", architecture)
+	defer func() {
+		span.SetAttribute("source", source)
+		span.SetError(err)
+		span.End()
+		if err == nil {
+			metrics.Pull(source)
+		}
+	}()
+
+	// images from the local docker daemon are only ever taken from it
+	if local, ok := localReference(ref); ok {
+		source = "docker"
+		src, err := docker.NewSaveSource(local, architecture)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDockerPinned(local); err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+
 	// several possibilities:
 	// - alwaysPull: try to pull it down from the registry to linuxkit cache, then fail
 	// - !alwaysPull && dockerCache: try to read it from docker, then try linuxkit cache, then try to pull from registry, then fail
@@ -20,7 +48,13 @@ func imagePull(ref *reference.Spec, alwaysPull bool, trust bool, cacheDir string
 	// first, try docker, if that is available
 	if !alwaysPull && dockerCache {
 		if err := docker.HasImage(ref); err == nil {
-			return docker.NewSource(ref), nil
+			// an image whose digest cannot be checked is taken from the
+			// cache or the registry instead
+			if err := checkDockerPinned(ref); err == nil {
+				source = "docker"
+				return docker.NewSource(ref), nil
+			}
+			log.Debugf("Not using %s from docker: %v", ref, err)
 		}
 		// docker is not required, so any error - image not available, no docker, whatever - just gets ignored
 	}
@@ -28,12 +62,71 @@ func imagePull(ref *reference.Spec, alwaysPull bool, trust bool, cacheDir string
 	// next try the local cache
 	if !alwaysPull {
 		if image, err := cache.ValidateImage(ref, cacheDir, architecture); err == nil {
-			return image, nil
+			// an image which is not the one it is pinned to is pulled again
+			if err := checkPinned(ref, image); err == nil {
+				source = "cache"
+				return image, nil
+			}
+			log.Warnf("The cached image %s is not the image it is pinned to, pulling it", ref)
 		}
 	}
 
 	// if we made it here, we either did not have the image, or it was incomplete
-	return imageLayoutWrite(cacheDir, ref, architecture, trust)
+	source = "registry"
+	image, err := imageLayoutWrite(cacheDir, ref, architecture, trust)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPinned(ref, image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// checkPinned checks that the image the source resolved to is the one the
+// reference is pinned to with a digest, if it is
+func checkPinned(ref *reference.Spec, src ImageSource) error {
+	pinned := ref.Digest()
+	if pinned == "" {
+		return nil
+	}
+	desc := src.Descriptor()
+	if desc == nil {
+		return fmt.Errorf("image %s is pinned to %s, but its digest is not known", ref, pinned)
+	}
+	if desc.Digest.String() != pinned.String() {
+		return fmt.Errorf("image %s resolved to %s, not the digest it is pinned to", ref, desc.Digest)
+	}
+	return nil
+}
+
+// checkDockerPinned checks that the image in docker is the one the reference
+// is pinned to with a digest, if it is, by the digests of the registry
+// manifests docker recorded for it
+func checkDockerPinned(ref *reference.Spec) error {
+	pinned := ref.Digest()
+	if pinned == "" {
+		return nil
+	}
+	repoDigests, err := docker.RepoDigests(ref)
+	if err != nil {
+		return err
+	}
+	if !hasRepoDigest(repoDigests, pinned.String()) {
+		return fmt.Errorf("image %s in docker is not known to be the digest it is pinned to", ref)
+	}
+	return nil
+}
+
+// hasRepoDigest returns whether one of the references by digest docker
+// recorded for an image has the digest
+func hasRepoDigest(repoDigests []string, digest string) bool {
+	for _, r := range repoDigests {
+		if i := strings.LastIndex(r, "@"); i != -1 && r[i+1:] == digest {
+			return true
+		}
+	}
+	return false
 }
 
 // imageLayoutWrite takes an image name and pulls it down, writing it locally
@@ -52,3 +145,44 @@ func imageLayoutWrite(cacheDir string, ref *reference.Spec, architecture string,
 	}
 	return cache.ImageWrite(cacheDir, ref, trustedName, architecture)
 }
+
+// Images returns the images of the configuration, with their names expanded
+func Images(m Moby) []string {
+	var images []string
+	if m.Kernel.Image != "" {
+		images = append(images, ReferenceExpand(m.Kernel.Image))
+	}
+	for _, ii := range m.Init {
+		images = append(images, ReferenceExpand(ii))
+	}
+	for _, section := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range section {
+			images = append(images, ReferenceExpand(image.Image))
+		}
+	}
+	return images
+}
+
+// PullImages puts the images of the configuration in the cache, pulling
+// those which are not in it, or all of them with pull
+func PullImages(m Moby, pull bool, cacheDir string) error {
+	for _, image := range Images(m) {
+		if err := PullImage(image, pull, enforceContentTrust(image, &m.Trust), cacheDir, m.Architecture); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PullImage puts the image in the cache for the architecture, pulling it if
+// it is not in it, or with pull
+func PullImage(image string, pull, trust bool, cacheDir, architecture string) error {
+	ref, err := parseReference(image)
+	if err != nil {
+		return fmt.Errorf("could not resolve references for image %s: %v", image, err)
+	}
+	if _, err := imagePull(&ref, pull, trust, cacheDir, false, architecture); err != nil {
+		return fmt.Errorf("Could not pull image %s: %v", image, err)
+	}
+	return nil
+}
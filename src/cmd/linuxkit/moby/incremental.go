@@ -0,0 +1,202 @@
+package moby
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/docker"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputFiles lists the suffixes of the files each output format writes
+// relative to the base name. They are used to check if an output is present.
+var outputFiles = map[string][]string{
+	"kernel+initrd":     {"-kernel", "-initrd.img", "-cmdline"},
+	"tar-kernel-initrd": {"-initrd.tar"},
+	"iso-bios":          {".iso"},
+	"iso-efi":           {"-efi.iso"},
+	"raw-bios":          {"-bios.img"},
+	"raw-efi":           {"-efi.img"},
+	"kernel+squashfs":   {"-kernel", "-cmdline", "-squashfs.img"},
+	"kernel+iso":        {"-kernel", "-cmdline", ".iso"},
+	"aws":               {".raw"},
+	"gcp":               {".img.tar.gz"},
+	"qcow2-efi":         {"-efi.qcow2"},
+	"qcow2-bios":        {".qcow2"},
+	"vhd":               {".vhd"},
+	"dynamic-vhd":       {".vhd"},
+	"vhdx":              {".vhdx"},
+	"vmdk":              {".vmdk"},
+	"rpi3":              {".tar"},
+}
+
+// hashesFile is where the input hashes of the outputs with a given base are recorded
+func hashesFile(base string) string {
+	return base + "-hashes.json"
+}
+
+// InputHash computes a hash over everything which goes into the image: the
+// configuration, the digests the images resolve to in the cache and the
+// contents of the files added from the host. An error is returned if any of the
+// inputs cannot be resolved to a content hash, in which case the image must be built.
+func InputHash(m Moby, cacheDir string, decompressKernel bool) (string, error) {
+	h := sha256.New()
+
+	// Make sure the Image strings are update to date with the refs
+	updateImages(&m)
+	config, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "version %s\n", version.Version)
+	fmt.Fprintf(h, "decompress %t\n", decompressKernel)
+	fmt.Fprintf(h, "config %x\n", sha256.Sum256(config))
+
+	for _, ref := range imageRefs(m) {
+		// images from the local docker daemon are hashed by their ID
+		if local, ok := localReference(ref); ok {
+			id, err := docker.ImageID(local)
+			if err != nil {
+				return "", fmt.Errorf("image %s is not in docker: %v", local, err)
+			}
+			fmt.Fprintf(h, "image %s %s\n", ref, id)
+			continue
+		}
+		if id, ok := builtImageID(ref, m.Architecture); ok {
+			fmt.Fprintf(h, "image %s %s\n", ref, id)
+			continue
+		}
+		desc, err := cache.FindDescriptor(cacheDir, ref.String())
+		if err != nil {
+			return "", fmt.Errorf("image %s is not in the cache: %v", ref, err)
+		}
+		fmt.Fprintf(h, "image %s %s\n", ref, desc.Digest)
+	}
+
+	for _, f := range m.Files {
+		if f.Source == "" {
+			continue
+		}
+		source, _, err := FileSourceDigest(f.Source)
+		if err != nil {
+			return "", err
+		}
+		if len(source) > 2 && source[:2] == "~/" {
+			source = util.HomeDir() + source[1:]
+		}
+		fh, err := fileHash(source)
+		if err != nil {
+			if f.Optional && os.IsNotExist(err) {
+				fmt.Fprintf(h, "file %s missing\n", f.Path)
+				continue
+			}
+			return "", err
+		}
+		fmt.Fprintf(h, "file %s %s\n", f.Path, fh)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// sparseFormats are the formats which are written differently with sparse
+var sparseFormats = map[string]bool{"raw-bios": true, "raw-efi": true, "aws": true}
+
+// outputHash returns the hash an output is keyed on, combining the input hash
+// with the output specific parameters.
+func outputHash(inputHash, format string, size int, sparse bool) string {
+	params := fmt.Sprintf("%s %s %d", inputHash, format, size)
+	if sparse && sparseFormats[format] {
+		params += " sparse"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(params)))
+}
+
+func readHashes(base string) map[string]string {
+	hashes := map[string]string{}
+	b, err := ioutil.ReadFile(hashesFile(base))
+	if err != nil {
+		return hashes
+	}
+	if err := json.Unmarshal(b, &hashes); err != nil {
+		log.Debugf("Ignoring invalid hashes file %s: %v", hashesFile(base), err)
+		return map[string]string{}
+	}
+	return hashes
+}
+
+// OutdatedFormats returns the formats which have to be regenerated, because
+// they were built from different inputs or their files are missing.
+func OutdatedFormats(base string, formats []string, inputHash string, size int, sparse bool) []string {
+	hashes := readHashes(base)
+	var outdated []string
+	for _, o := range formats {
+		if hashes[o] != outputHash(inputHash, o, size, sparse) || !outputExists(base, o) {
+			outdated = append(outdated, o)
+			continue
+		}
+		log.Debugf("Output %s for %s is up to date", o, base)
+	}
+	return outdated
+}
+
+func outputExists(base, format string) bool {
+	files, ok := outputFiles[format]
+	if !ok {
+		return false
+	}
+	for _, suffix := range files {
+		if _, err := os.Stat(base + suffix); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordFormats records the input hash the given formats were generated from
+func RecordFormats(base string, formats []string, inputHash string, size int, sparse bool) error {
+	hashes := readHashes(base)
+	for _, o := range formats {
+		hashes[o] = outputHash(inputHash, o, size, sparse)
+	}
+	b, err := json.MarshalIndent(hashes, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(hashesFile(base), b, 0644)
+}
+
+// OutputFiles returns the files the given formats write for base, without
+// duplicates, such as the kernel of kernel+initrd and kernel+iso
+func OutputFiles(base string, formats []string) []string {
+	seen := map[string]bool{}
+	var files []string
+	for _, o := range formats {
+		for _, suffix := range outputFiles[o] {
+			if !seen[suffix] {
+				seen[suffix] = true
+				files = append(files, base+suffix)
+			}
+		}
+	}
+	return files
+}
@@ -0,0 +1,69 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOutdatedFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "test")
+
+	formats := []string{"kernel+initrd", "iso-bios"}
+	if outdated := OutdatedFormats(base, formats, "abc", 1024, false); !reflect.DeepEqual(outdated, formats) {
+		t.Fatalf("Expected all formats to be outdated, got %v", outdated)
+	}
+
+	for _, suffix := range []string{"-kernel", "-initrd.img", "-cmdline", ".iso"} {
+		if err := ioutil.WriteFile(base+suffix, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecordFormats(base, formats, "abc", 1024, false); err != nil {
+		t.Fatal(err)
+	}
+	if outdated := OutdatedFormats(base, formats, "abc", 1024, false); len(outdated) != 0 {
+		t.Errorf("Expected no outdated formats, got %v", outdated)
+	}
+	if outdated := OutdatedFormats(base, formats, "def", 1024, false); !reflect.DeepEqual(outdated, formats) {
+		t.Errorf("Expected changed inputs to outdate all formats, got %v", outdated)
+	}
+	if outdated := OutdatedFormats(base, formats, "abc", 2048, false); !reflect.DeepEqual(outdated, formats) {
+		t.Errorf("Expected changed size to outdate all formats, got %v", outdated)
+	}
+
+	if outdated := OutdatedFormats(base, formats, "abc", 1024, true); len(outdated) != 0 {
+		t.Errorf("Expected sparse to only outdate the formats it changes, got %v", outdated)
+	}
+	if err := ioutil.WriteFile(base+"-bios.img", []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordFormats(base, []string{"raw-bios"}, "abc", 1024, false); err != nil {
+		t.Fatal(err)
+	}
+	if outdated := OutdatedFormats(base, []string{"raw-bios"}, "abc", 1024, true); !reflect.DeepEqual(outdated, []string{"raw-bios"}) {
+		t.Errorf("Expected sparse to outdate a raw output written without it, got %v", outdated)
+	}
+
+	if err := os.Remove(base + ".iso"); err != nil {
+		t.Fatal(err)
+	}
+	if outdated := OutdatedFormats(base, formats, "abc", 1024, false); !reflect.DeepEqual(outdated, []string{"iso-bios"}) {
+		t.Errorf("Expected missing output to be outdated, got %v", outdated)
+	}
+}
+
+func TestOutputFiles(t *testing.T) {
+	files := OutputFiles("out/test", []string{"kernel+initrd", "kernel+iso", "unknown"})
+	expected := []string{"out/test-kernel", "out/test-initrd.img", "out/test-cmdline", "out/test.iso"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+}
@@ -0,0 +1,193 @@
+package moby
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/iso"
+	log "github.com/sirupsen/logrus"
+)
+
+// The ISO outputs are written natively. Only the boot loaders are taken from
+// the mkimage images, which are read from the cache without running them.
+
+const isoVolumeID = "LinuxKit"
+
+// imageFiles reads the given files from the filesystem of an image in the cache
+func imageFiles(image string, trust bool, cache string, names ...string) (map[string][]byte, error) {
+	ref, err := parseReference(image)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve references for image %s: %v", image, err)
+	}
+	src, err := imagePull(&ref, false, trust, cache, false, runtime.GOARCH)
+	if err != nil {
+		return nil, fmt.Errorf("Could not pull image %s: %v", image, err)
+	}
+	r, err := src.TarReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[n] = true
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if !wanted[name] || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if files[name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range names {
+		if _, ok := files[n]; !ok {
+			return nil, fmt.Errorf("%s not found in image %s", n, image)
+		}
+	}
+	return files, nil
+}
+
+// newISO creates an image containing the root filesystem and returns the
+// kernel command line from boot/cmdline, which is removed
+func newISO(filesystem io.Reader) (*iso.Image, string, error) {
+	img, err := iso.New(isoVolumeID, defaultModTime)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := img.AddTar(filesystem); err != nil {
+		img.Close()
+		return nil, "", err
+	}
+	cmdline, err := img.ReadFile("boot/cmdline")
+	if err != nil {
+		img.Close()
+		return nil, "", err
+	}
+	img.Remove("boot/cmdline")
+	return img, strings.TrimSpace(string(cmdline)), nil
+}
+
+// withRoot adds root= to the command line if it is not set, as the root
+// filesystem is the ISO itself
+func withRoot(cmdline, dev string) string {
+	if strings.Contains(cmdline, "root=") {
+		return cmdline
+	}
+	return cmdline + " root=" + dev
+}
+
+func writeISO(img *iso.Image, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := img.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func outputISOBIOS(image, filename string, filesystem io.Reader, trust bool, cache string) error {
+	log.Debugf("output ISO BIOS: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	const syslinux = "usr/share/syslinux/"
+	boot, err := imageFiles(image, trust, cache, syslinux+"isolinux.bin", syslinux+"ldlinux.c32", syslinux+"isohdpfx.bin")
+	if err != nil {
+		return err
+	}
+
+	img, cmdline, err := newISO(filesystem)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	cfg := fmt.Sprintf("DEFAULT linux\nLABEL linux\n    KERNEL /boot/kernel\n    APPEND %s\n", withRoot(cmdline, "/dev/sr0"))
+	for name, contents := range map[string][]byte{
+		"isolinux/isolinux.bin": boot[syslinux+"isolinux.bin"],
+		"isolinux/ldlinux.c32":  boot[syslinux+"ldlinux.c32"],
+		"isolinux/isolinux.cfg": []byte(cfg),
+	} {
+		if err := img.AddFile(name, 0644, contents); err != nil {
+			return err
+		}
+	}
+	if err := img.SetBIOSBoot("isolinux/isolinux.bin", boot[syslinux+"isohdpfx.bin"]); err != nil {
+		return err
+	}
+	return writeISO(img, filename)
+}
+
+func outputISOEFI(image, filename string, filesystem io.Reader, trust bool, cache string) error {
+	log.Debugf("output ISO EFI: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	var bootfile, rootdev, linux string
+	switch runtime.GOARCH {
+	case "amd64":
+		bootfile, rootdev, linux = "BOOTX64.EFI", "/dev/sr0", "linuxefi"
+	case "arm64":
+		bootfile, rootdev, linux = "BOOTAA64.EFI", "/dev/vda", "linux"
+	default:
+		return fmt.Errorf("EFI ISO images are not supported on %s", runtime.GOARCH)
+	}
+	boot, err := imageFiles(image, trust, cache, "usr/local/share/"+bootfile)
+	if err != nil {
+		return err
+	}
+
+	img, cmdline, err := newISO(filesystem)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	cfg := fmt.Sprintf("set timeout=0\nset gfxpayload=text\nmenuentry 'LinuxKit ISO Image' {\n\t%s /boot/kernel %s text\n}\n", linux, withRoot(cmdline, rootdev))
+	if err := img.AddFile("EFI/BOOT/grub.cfg", 0644, []byte(cfg)); err != nil {
+		return err
+	}
+	if err := img.SetEFIBoot(bootfile, boot["usr/local/share/"+bootfile]); err != nil {
+		return err
+	}
+	return writeISO(img, filename)
+}
+
+func outputKernelISO(base string, filesystem io.Reader) error {
+	log.Debugf("output kernel/iso: %s", base)
+	log.Infof("  %s.iso", base)
+
+	img, err := iso.New(isoVolumeID, defaultModTime)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	// stream the root filesystem without boot/ into the image, as it may be large
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(splitKernelRootfs(base, filesystem, pw))
+	}()
+	defer pr.Close()
+	if err := img.AddTar(pr); err != nil {
+		return err
+	}
+	return writeISO(img, base+".iso")
+}
@@ -3,7 +3,6 @@ package moby
 import (
 	"crypto/sha256"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -61,12 +60,14 @@ func ensureLinuxkitImage(name, cache string) error {
 	// Might as well just use our local one.
 	m.Architecture = runtime.GOARCH
 	// TODO pass through --pull to here
+	// The images are resolved through the linuxkit cache only, so that
+	// building the output tooling does not need a docker daemon.
 	tf, err := ioutil.TempFile("", "")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(tf.Name())
-	if err := Build(m, tf, false, "", false, cache, true); err != nil {
+	if err := Build(m, tf, false, "", false, cache, false); err != nil {
 		return err
 	}
 	if err := tf.Close(); err != nil {
@@ -82,22 +83,30 @@ func ensureLinuxkitImage(name, cache string) error {
 	if err != nil {
 		return fmt.Errorf("Error converting to initrd: %v", err)
 	}
+	defer os.Remove(initrd)
 	return writeKernelInitrd(filename, kernel, initrd, cmdline)
 }
 
-func writeKernelInitrd(filename string, kernel []byte, initrd []byte, cmdline string) error {
+func writeKernelInitrd(filename string, kernel []byte, initrd string, cmdline string) error {
 	err := ioutil.WriteFile(filename+"-kernel", kernel, 0600)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename+"-initrd.img", initrd, 0600)
+	f, err := os.OpenFile(filename+"-initrd.img", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
+	if err := appendFile(f, initrd); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
 	return ioutil.WriteFile(filename+"-cmdline", []byte(cmdline), 0600)
 }
 
-func outputLinuxKit(format string, filename string, kernel []byte, initrd []byte, cmdline string, size int) error {
+func outputLinuxKit(format string, filename string, kernel []byte, initrd string, cmdline string, size int) error {
 	log.Debugf("output linuxkit generated img: %s %s size %d", format, filename, size)
 
 	tmp, err := ioutil.TempDir(filepath.Join(MobyDir, "tmp"), "moby")
@@ -106,18 +115,14 @@ func outputLinuxKit(format string, filename string, kernel []byte, initrd []byte
 	}
 	defer os.RemoveAll(tmp)
 
-	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
-	if err != nil {
-		return err
-	}
-
 	tardisk := filepath.Join(tmp, "tardisk")
 	f, err := os.Create(tardisk)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(f, buf)
+	err = tarInitrdKernel(f, kernel, initrd, cmdline)
 	if err != nil {
+		f.Close()
 		return err
 	}
 	err = f.Close()
@@ -0,0 +1,124 @@
+package moby
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v2"
+)
+
+// lockHeader is written at the top of lockfiles
+const lockHeader = "# Generated by linuxkit lock, do not edit.\n"
+
+// Lock is the type of a lockfile, of the digests the tagged images of
+// configurations resolved to when they were locked
+type Lock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+// imageRefs returns the references of the kernel, init and container images
+// of m
+func imageRefs(m Moby) []*reference.Spec {
+	var refs []*reference.Spec
+	if m.Kernel.ref != nil {
+		refs = append(refs, m.Kernel.ref)
+	}
+	refs = append(refs, m.initRefs...)
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			refs = append(refs, image.ref)
+		}
+	}
+	return refs
+}
+
+// lockable returns whether the image can be locked, which it cannot if it is
+// already pinned to a digest or is taken from docker
+func lockable(ref *reference.Spec) bool {
+	_, local := localReference(ref)
+	return ref.Digest() == "" && !local
+}
+
+// ResolveLock resolves the images of m which can be locked to the digests
+// they resolve to now, the digests signed with Docker Content Trust for the
+// images it is enforced for
+func ResolveLock(m Moby) (Lock, error) {
+	lock := Lock{Images: map[string]string{}}
+	for _, ref := range imageRefs(m) {
+		image := ref.String()
+		if _, ok := lock.Images[image]; ok || !lockable(ref) {
+			continue
+		}
+		var d string
+		if enforceContentTrust(image, &m.Trust) {
+			trusted, err := TrustedReference(image)
+			if err != nil {
+				return Lock{}, fmt.Errorf("Trusted lookup of %s failed: %v", image, err)
+			}
+			signed, ok := trusted.(interface{ Digest() digest.Digest })
+			if !ok {
+				return Lock{}, fmt.Errorf("image %s has no signed digest", image)
+			}
+			d = signed.Digest().String()
+		} else {
+			var err error
+			if d, err = cache.RemoteDigest(image); err != nil {
+				return Lock{}, fmt.Errorf("unable to resolve the digest of %s: %v", image, err)
+			}
+		}
+		lock.Images[image] = d
+	}
+	return lock, nil
+}
+
+// Apply pins the images of m which can be locked to their digests in the
+// lock, which must have all of them
+func (l Lock) Apply(m *Moby) error {
+	var missing []string
+	for _, ref := range imageRefs(*m) {
+		if !lockable(ref) {
+			continue
+		}
+		d, ok := l.Images[ref.String()]
+		if !ok {
+			missing = append(missing, ref.String())
+			continue
+		}
+		if err := digest.Digest(d).Validate(); err != nil {
+			return fmt.Errorf("invalid digest of %s in the lockfile: %v", ref, err)
+		}
+		ref.Object += "@" + d
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("the lockfile has no digest of %v, lock the configuration again", missing)
+	}
+	updateImages(m)
+	return nil
+}
+
+// ReadLock reads the lockfile
+func ReadLock(path string) (Lock, error) {
+	var l Lock
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return l, err
+	}
+	if err := yaml.Unmarshal(b, &l); err != nil {
+		return l, fmt.Errorf("invalid lockfile %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// Write writes the lockfile
+func (l Lock) Write(path string) error {
+	b, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(lockHeader), b...), 0644)
+}
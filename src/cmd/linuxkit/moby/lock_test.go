@@ -0,0 +1,64 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockfile := filepath.Join(dir, "linuxkit.lock")
+
+	config := []byte(`kernel:
+  image: linuxkit/kernel:5.10.104
+init:
+  - linuxkit/init:v0.8@` + pinnedDigest + `
+  - docker:linuxkit/runc:dev
+services:
+  - name: getty
+    image: linuxkit/getty:v0.8
+`)
+	l := Lock{Images: map[string]string{
+		"docker.io/linuxkit/kernel:5.10.104": pinnedDigest,
+		"docker.io/linuxkit/getty:v0.8":      pinnedDigest,
+	}}
+	if err := l.Write(lockfile); err != nil {
+		t.Fatal(err)
+	}
+	l, err = ReadLock(lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Apply(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.ref.Digest().String() != pinnedDigest || m.Services[0].Image != "docker.io/linuxkit/getty:v0.8@"+pinnedDigest {
+		t.Errorf("Expected the images to be locked, got %s %s", m.Kernel.ref, m.Services[0].Image)
+	}
+	if m.initRefs[0].String() != "docker.io/linuxkit/init:v0.8@"+pinnedDigest {
+		t.Errorf("Expected the pinned image not to change, got %s", m.initRefs[0])
+	}
+	if _, local := localReference(m.initRefs[1]); !local || m.initRefs[1].Digest() != "" {
+		t.Errorf("Expected the image from docker not to be locked, got %s", m.initRefs[1])
+	}
+
+	m, err = NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(l.Images, "docker.io/linuxkit/getty:v0.8")
+	if err := l.Apply(&m); err == nil {
+		t.Error("Expected an error for an image which is not in the lockfile")
+	}
+}
@@ -0,0 +1,231 @@
+package moby
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	"gopkg.in/yaml.v2"
+)
+
+// ManifestPath is where the manifest of an image is written in its filesystem
+const ManifestPath = "etc/linuxkit/manifest.json"
+
+// ConfigPath is where the resolved configuration of an image is written in
+// its filesystem, next to the manifest
+const ConfigPath = "etc/linuxkit/linuxkit.yml"
+
+// Manifest records what went into an image, so that built outputs can be
+// inspected without their configuration
+type Manifest struct {
+	Version      string          `json:"version"`
+	Architecture string          `json:"architecture,omitempty"`
+	Kernel       *ManifestImage  `json:"kernel,omitempty"`
+	Cmdline      string          `json:"cmdline,omitempty"`
+	Images       []ManifestImage `json:"images"`
+	Files        []ManifestFile  `json:"files"`
+
+	// config is the resolved configuration written to ConfigPath
+	config []byte
+}
+
+// ManifestImage is an image in a section of the configuration, with the
+// digest it resolved to in the cache if it was built from it
+type ManifestImage struct {
+	Section string `json:"section"`
+	Name    string `json:"name,omitempty"`
+	Image   string `json:"image"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// ManifestFile is an entry of the files section, as added to the image
+type ManifestFile struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Mode     string `json:"mode"`
+	UID      int    `json:"uid"`
+	GID      int    `json:"gid"`
+	Linkname string `json:"linkname,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Metadata string `json:"metadata,omitempty"`
+}
+
+// newManifest returns the manifest of the images of m. The files are added
+// as the files section is written.
+func newManifest(m Moby, cacheDir string) *Manifest {
+	manifest := &Manifest{Version: version.Version, Architecture: m.Architecture, Images: []ManifestImage{}, Files: []ManifestFile{}}
+	image := func(section, name string, ref *reference.Spec) ManifestImage {
+		i := ManifestImage{Section: section, Name: name, Image: ref.String()}
+		// images from the docker cache are not in the linuxkit cache
+		if _, ok := builtImageID(ref, m.Architecture); ok {
+			return i
+		}
+		if desc, err := cache.FindDescriptor(cacheDir, ref.String()); err == nil {
+			i.Digest = desc.Digest.String()
+		}
+		return i
+	}
+	if m.Kernel.ref != nil {
+		k := image("kernel", "", m.Kernel.ref)
+		manifest.Kernel = &k
+		manifest.Cmdline = m.Kernel.Cmdline
+	}
+	for _, ii := range m.initRefs {
+		manifest.Images = append(manifest.Images, image("init", "", ii))
+	}
+	for _, s := range []struct {
+		section string
+		images  []*Image
+	}{{"onboot", m.Onboot}, {"onshutdown", m.Onshutdown}, {"services", m.Services}} {
+		for _, i := range s.images {
+			manifest.Images = append(manifest.Images, image(s.section, i.Name, i.ref))
+		}
+	}
+	return manifest
+}
+
+// resolveConfig sets the configuration written with the manifest to the
+// configuration m, with its images pinned to the digests of the manifest, so
+// that the image can be built again from exactly the same images
+func (m *Manifest) resolveConfig(config Moby) error {
+	// the images are copied, as they are shared with the build
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var c Moby
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	c.Architecture = ""
+	// inline contents may be secrets, so only their digest is recorded,
+	// as for the files of the manifest
+	for i, f := range c.Files {
+		if f.Contents != nil {
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(*f.Contents)))
+			c.Files[i].Contents = &digest
+		}
+	}
+	pin := func(image *string, i ManifestImage) {
+		*image = i.Image
+		if i.Digest != "" && !strings.Contains(i.Image, "@") {
+			*image += "@" + i.Digest
+		}
+	}
+	if m.Kernel != nil {
+		pin(&c.Kernel.Image, *m.Kernel)
+	}
+	var images []*string
+	for i := range c.Init {
+		images = append(images, &c.Init[i])
+	}
+	for _, section := range [][]*Image{c.Onboot, c.Onshutdown, c.Services} {
+		for _, i := range section {
+			images = append(images, &i.Image)
+		}
+	}
+	if len(images) != len(m.Images) {
+		return fmt.Errorf("the configuration has %d images but the manifest %d", len(images), len(m.Images))
+	}
+	for i, image := range images {
+		pin(image, m.Images[i])
+	}
+	b, err = yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("# Built by linuxkit %s", m.Version)
+	if m.Architecture != "" {
+		header += " for " + m.Architecture
+	}
+	m.config = append([]byte(header+"\n"), b...)
+	return nil
+}
+
+// addFile records an entry of the files section written with hdr
+func (m *Manifest) addFile(f File, hdr *tar.Header, contents []byte) {
+	mf := ManifestFile{
+		Path:     "/" + hdr.Name,
+		Type:     "file",
+		Mode:     fmt.Sprintf("%04o", hdr.Mode),
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Source:   f.Source,
+		Metadata: f.Metadata,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mf.Type = "directory"
+	case tar.TypeSymlink:
+		mf.Type = "symlink"
+		mf.Linkname = hdr.Linkname
+	default:
+		mf.Size = int64(len(contents))
+		mf.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(contents))
+	}
+	m.Files = append(m.Files, mf)
+}
+
+// write adds the manifest to the image, with its directories unless the
+// files section added them
+func (m *Manifest) write(tw *tar.Writer) error {
+	b, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	added := map[string]bool{}
+	for _, f := range m.Files {
+		added[f.Path[1:]] = true
+	}
+	for _, dir := range []string{path.Dir(path.Dir(ManifestPath)), path.Dir(ManifestPath)} {
+		if added[dir] {
+			continue
+		}
+		hdr := &tar.Header{
+			Name:     dir,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  defaultModTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	hdr := &tar.Header{
+		Name:    ManifestPath,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: defaultModTime,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	if m.config == nil {
+		return nil
+	}
+	hdr = &tar.Header{
+		Name:    ConfigPath,
+		Mode:    0600,
+		Size:    int64(len(m.config)),
+		ModTime: defaultModTime,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(m.config)
+	return err
+}
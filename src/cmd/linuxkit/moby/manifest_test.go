@@ -0,0 +1,126 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	contents := "foo"
+	m := Moby{Files: []File{
+		{Path: "etc/linuxkit", Directory: true, Mode: "0700"},
+		{Path: "/etc/foo", Contents: &contents, Mode: "0644"},
+		{Path: "etc/bar", Symlink: "foo"},
+	}}
+	manifest := newManifest(m, "")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := filesystem(m, tw, map[string]uint32{}, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.write(tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var written Manifest
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == ManifestPath {
+			if err := json.NewDecoder(tr).Decode(&written); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// etc/linuxkit is added by the files section, so it is not added again
+	count := 0
+	for _, name := range names {
+		if name == "etc/linuxkit" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Expected etc/linuxkit once, got %v", names)
+	}
+	if len(written.Files) != 3 {
+		t.Fatalf("Expected 3 files in the manifest, got %v", written.Files)
+	}
+	if f := written.Files[1]; f.Path != "/etc/foo" || f.Type != "file" || f.Mode != "0644" || f.Size != 3 ||
+		f.Digest != "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+		t.Errorf("Unexpected file %v", f)
+	}
+	if f := written.Files[2]; f.Type != "symlink" || f.Linkname != "foo" {
+		t.Errorf("Unexpected symlink %v", f)
+	}
+}
+
+func TestManifestConfig(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: linuxkit/kernel:5.10.104
+  cmdline: "console=ttyS0"
+init:
+  - linuxkit/init:v0.8
+onboot:
+  - name: dhcpcd
+    image: linuxkit/dhcpcd:v0.8
+files:
+  - path: etc/secret
+    contents: "secret"
+    mode: "0600"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Architecture = "amd64"
+	manifest := newManifest(m, "")
+	manifest.Kernel.Digest = "sha256:" + strings.Repeat("1", 64)
+	manifest.Images[1].Digest = "sha256:" + strings.Repeat("2", 64)
+	if err := manifest.resolveConfig(m); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(manifest.config), "# Built by linuxkit ") {
+		t.Errorf("Expected the version of linuxkit in the config, got %s", manifest.config)
+	}
+
+	// the resolved config is a valid config with the images pinned
+	c, err := NewConfig(manifest.config)
+	if err != nil {
+		t.Fatalf("Invalid resolved config: %v\n%s", err, manifest.config)
+	}
+	if c.Kernel.Image != "docker.io/linuxkit/kernel:5.10.104@sha256:"+strings.Repeat("1", 64) {
+		t.Errorf("Unexpected kernel %s", c.Kernel.Image)
+	}
+	if c.Init[0] != "docker.io/linuxkit/init:v0.8" {
+		t.Errorf("Expected the init image without a digest to be unchanged, got %s", c.Init[0])
+	}
+	if c.Onboot[0].Image != "docker.io/linuxkit/dhcpcd:v0.8@sha256:"+strings.Repeat("2", 64) {
+		t.Errorf("Unexpected onboot image %s", c.Onboot[0].Image)
+	}
+	if c.Files[0].Contents == nil || *c.Files[0].Contents != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("secret"))) {
+		t.Errorf("Expected the inline contents to be replaced by their digest, got %v", c.Files[0].Contents)
+	}
+	if *m.Files[0].Contents != "secret" {
+		t.Errorf("The files of the build were changed to %s", *m.Files[0].Contents)
+	}
+	if m.Onboot[0].Image != "linuxkit/dhcpcd:v0.8" && m.Onboot[0].Image != "docker.io/linuxkit/dhcpcd:v0.8" {
+		t.Errorf("The images of the build were changed to %s", m.Onboot[0].Image)
+	}
+}
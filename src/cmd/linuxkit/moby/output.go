@@ -2,7 +2,6 @@ package moby
 
 import (
 	"archive/tar"
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,24 +9,32 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/initrd"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	outputImages = map[string]string{
-		"iso":         "linuxkit/mkimage-iso:4f1a2476ac515983ade72814cf08624c8968f65f",
-		"iso-bios":    "linuxkit/mkimage-iso-bios:ea9a22b705b8201a201609905f7636fba8d061b9",
-		"iso-efi":     "linuxkit/mkimage-iso-efi:c62420c8588a1d1440249c2c58f325700d72280f",
-		"raw-bios":    "linuxkit/mkimage-raw-bios:4f3041edd9de02ef8f15bd92cc2d1afecb90084b",
-		"raw-efi":     "linuxkit/mkimage-raw-efi:9ed69b7ac9e75aef6eebaed787223d9504dd967b",
-		"squashfs":    "linuxkit/mkimage-squashfs:a1e99651662cb5781f8485a588ce4c85a75d7c9c",
-		"gcp":         "linuxkit/mkimage-gcp:a7416d21d4ef642bb2ba560c8f7651250823546d",
-		"qcow2-efi":   "linuxkit/mkimage-qcow2-efi:9a623f72befcaadb560290c29b9fb28f3843545b",
-		"vhd":         "linuxkit/mkimage-vhd:4cc60c4f46b07e11c64ba618e46b81fa0096c91f",
-		"dynamic-vhd": "linuxkit/mkimage-dynamic-vhd:99b9009ed54a793020d3ce8322a42e0cc06da71a",
-		"vmdk":        "linuxkit/mkimage-vmdk:b55ea46297a16d8a4448ce7f5a2df987a9602b27",
-		"rpi3":        "linuxkit/mkimage-rpi3:19c5354d6f8f68781adbc9bb62095ebb424222dc",
+		"iso-bios": "linuxkit/mkimage-iso-bios:ea9a22b705b8201a201609905f7636fba8d061b9",
+		"iso-efi":  "linuxkit/mkimage-iso-efi:c62420c8588a1d1440249c2c58f325700d72280f",
+		"raw-bios": "linuxkit/mkimage-raw-bios:4f3041edd9de02ef8f15bd92cc2d1afecb90084b",
+		"raw-efi":  "linuxkit/mkimage-raw-efi:9ed69b7ac9e75aef6eebaed787223d9504dd967b",
+		"squashfs": "linuxkit/mkimage-squashfs:a1e99651662cb5781f8485a588ce4c85a75d7c9c",
+		"gcp":      "linuxkit/mkimage-gcp:a7416d21d4ef642bb2ba560c8f7651250823546d",
+		"rpi3":     "linuxkit/mkimage-rpi3:19c5354d6f8f68781adbc9bb62095ebb424222dc",
+	}
+
+	// convertedOutputs are the formats which are converted natively from
+	// the raw disk image of another format, and the disk format they are
+	// converted to
+	convertedOutputs = map[string]struct{ raw, format string }{
+		"qcow2-efi":   {raw: "raw-efi", format: "qcow2"},
+		"vhd":         {raw: "raw-bios", format: "vhd"},
+		"dynamic-vhd": {raw: "raw-bios", format: "dynamic-vhd"},
+		"vhdx":        {raw: "raw-bios", format: "vhdx"},
+		"vmdk":        {raw: "raw-bios", format: "vmdk"},
 	}
 )
 
@@ -43,121 +50,138 @@ func UpdateOutputImages(update map[string]string) error {
 	return nil
 }
 
-var outFuns = map[string]func(string, io.Reader, int, bool) error{
-	"kernel+initrd": func(base string, image io.Reader, size int, trust bool) error {
+var outFuns = map[string]func(string, io.Reader, int, bool, bool, string) error{
+	"kernel+initrd": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
+		defer os.Remove(initrd)
 		err = outputKernelInitrd(base, kernel, initrd, cmdline, ucode)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+initrd output: %v", err)
 		}
 		return nil
 	},
-	"tar-kernel-initrd": func(base string, image io.Reader, size int, trust bool) error {
+	"tar-kernel-initrd": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
+		defer os.Remove(initrd)
 		if err := outputKernelInitrdTarball(base, kernel, initrd, cmdline, ucode); err != nil {
 			return fmt.Errorf("Error writing kernel+initrd tarball output: %v", err)
 		}
 		return nil
 	},
-	"iso-bios": func(base string, image io.Reader, size int, trust bool) error {
-		err := outputIso(outputImages["iso-bios"], base+".iso", image, trust)
+	"iso-bios": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		err := outputISOBIOS(outputImages["iso-bios"], base+".iso", image, trust, cache)
 		if err != nil {
 			return fmt.Errorf("Error writing iso-bios output: %v", err)
 		}
 		return nil
 	},
-	"iso-efi": func(base string, image io.Reader, size int, trust bool) error {
-		err := outputIso(outputImages["iso-efi"], base+"-efi.iso", image, trust)
+	"iso-efi": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		err := outputISOEFI(outputImages["iso-efi"], base+"-efi.iso", image, trust, cache)
 		if err != nil {
 			return fmt.Errorf("Error writing iso-efi output: %v", err)
 		}
 		return nil
 	},
-	"raw-bios": func(base string, image io.Reader, size int, trust bool) error {
+	"raw-bios": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
+		defer os.Remove(initrd)
 		// TODO: Handle ucode
-		err = outputImg(outputImages["raw-bios"], base+"-bios.img", kernel, initrd, cmdline, trust)
+		err = outputImg(outputImages["raw-bios"], base+"-bios.img", kernel, initrd, cmdline, trust, sparse)
 		if err != nil {
 			return fmt.Errorf("Error writing raw-bios output: %v", err)
 		}
 		return nil
 	},
-	"raw-efi": func(base string, image io.Reader, size int, trust bool) error {
+	"raw-efi": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		// GRUB is not built for riscv64 in the image yet
+		if runtime.GOARCH == "riscv64" {
+			return fmt.Errorf("EFI disk images are not supported on %s", runtime.GOARCH)
+		}
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["raw-efi"], base+"-efi.img", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputImg(outputImages["raw-efi"], base+"-efi.img", kernel, initrd, cmdline, trust, sparse)
 		if err != nil {
 			return fmt.Errorf("Error writing raw-efi output: %v", err)
 		}
 		return nil
 	},
-	"kernel+squashfs": func(base string, image io.Reader, size int, trust bool) error {
+	"kernel+squashfs": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		err := outputKernelSquashFS(outputImages["squashfs"], base, image, trust)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+squashfs output: %v", err)
 		}
 		return nil
 	},
-	"kernel+iso": func(base string, image io.Reader, size int, trust bool) error {
-		err := outputKernelISO(outputImages["iso"], base, image, trust)
+	"kernel+iso": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		err := outputKernelISO(base, image)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+iso output: %v", err)
 		}
 		return nil
 	},
-	"aws": func(base string, image io.Reader, size int, trust bool) error {
+	"aws": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		filename := base + ".raw"
 		log.Infof("  %s", filename)
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
+		defer os.Remove(initrd)
 		err = outputLinuxKit("raw", filename, kernel, initrd, cmdline, size)
 		if err != nil {
 			return fmt.Errorf("Error writing raw output: %v", err)
 		}
+		if sparse {
+			if err := sparsify(filename); err != nil {
+				return fmt.Errorf("Error writing raw output sparsely: %v", err)
+			}
+		}
 		return nil
 	},
-	"gcp": func(base string, image io.Reader, size int, trust bool) error {
+	"gcp": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["gcp"], base+".img.tar.gz", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputImg(outputImages["gcp"], base+".img.tar.gz", kernel, initrd, cmdline, trust, false)
 		if err != nil {
 			return fmt.Errorf("Error writing gcp output: %v", err)
 		}
 		return nil
 	},
-	"qcow2-efi": func(base string, image io.Reader, size int, trust bool) error {
+	"qcow2-efi": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["qcow2-efi"], base+"-efi.qcow2", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputConverted(base+"-efi.qcow2", "qcow2-efi", kernel, initrd, cmdline, trust)
 		if err != nil {
 			return fmt.Errorf("Error writing qcow2 EFI output: %v", err)
 		}
 		return nil
 	},
-	"qcow2-bios": func(base string, image io.Reader, size int, trust bool) error {
+	"qcow2-bios": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		filename := base + ".qcow2"
 		log.Infof("  %s", filename)
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
+		defer os.Remove(initrd)
 		// TODO: Handle ucode
 		err = outputLinuxKit("qcow2", filename, kernel, initrd, cmdline, size)
 		if err != nil {
@@ -165,40 +189,55 @@ var outFuns = map[string]func(string, io.Reader, int, bool) error{
 		}
 		return nil
 	},
-	"vhd": func(base string, image io.Reader, size int, trust bool) error {
+	"vhd": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["vhd"], base+".vhd", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputConverted(base+".vhd", "vhd", kernel, initrd, cmdline, trust)
 		if err != nil {
 			return fmt.Errorf("Error writing vhd output: %v", err)
 		}
 		return nil
 	},
-	"dynamic-vhd": func(base string, image io.Reader, size int, trust bool) error {
+	"dynamic-vhd": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["dynamic-vhd"], base+".vhd", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputConverted(base+".vhd", "dynamic-vhd", kernel, initrd, cmdline, trust)
 		if err != nil {
 			return fmt.Errorf("Error writing vhd output: %v", err)
 		}
 		return nil
 	},
-	"vmdk": func(base string, image io.Reader, size int, trust bool) error {
+	"vhdx": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+		if err != nil {
+			return fmt.Errorf("Error converting to initrd: %v", err)
+		}
+		defer os.Remove(initrd)
+		err = outputConverted(base+".vhdx", "vhdx", kernel, initrd, cmdline, trust)
+		if err != nil {
+			return fmt.Errorf("Error writing vhdx output: %v", err)
+		}
+		return nil
+	},
+	"vmdk": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["vmdk"], base+".vmdk", kernel, initrd, cmdline, trust)
+		defer os.Remove(initrd)
+		err = outputConverted(base+".vmdk", "vmdk", kernel, initrd, cmdline, trust)
 		if err != nil {
 			return fmt.Errorf("Error writing vmdk output: %v", err)
 		}
 		return nil
 	},
-	"rpi3": func(base string, image io.Reader, size int, trust bool) error {
+	"rpi3": func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
 		if runtime.GOARCH != "arm64" {
 			return fmt.Errorf("Raspberry Pi output currently only supported on arm64")
 		}
@@ -224,13 +263,37 @@ func ensurePrereq(out, cache string) error {
 	return err
 }
 
+// FormatImages returns the images the formats are generated with, which
+// are run with docker, and the configurations of the LinuxKit images they
+// build from the linuxkit cache to generate them
+func FormatImages(formats []string) ([]string, []Moby, error) {
+	var images []string
+	var configs []Moby
+	for _, o := range formats {
+		if img, ok := outputImages[o]; ok {
+			images = append(images, img)
+		}
+		if c, ok := convertedOutputs[o]; ok {
+			images = append(images, outputImages[c.raw])
+		}
+		if p := prereq[o]; p != "" {
+			m, err := NewConfig([]byte(linuxkitYaml[p]))
+			if err != nil {
+				return nil, nil, err
+			}
+			m.Architecture = runtime.GOARCH
+			configs = append(configs, m)
+		}
+	}
+	return images, configs, nil
+}
+
 // ValidateFormats checks if the format type is known
 func ValidateFormats(formats []string, cache string) error {
 	log.Debugf("validating output: %v", formats)
 
 	for _, o := range formats {
-		f := outFuns[o]
-		if f == nil {
+		if outFuns[o] == nil && !lookupFormatPlugin(o) {
 			return fmt.Errorf("Unknown format type %s", o)
 		}
 		err := ensurePrereq(o, cache)
@@ -243,7 +306,7 @@ func ValidateFormats(formats []string, cache string) error {
 }
 
 // Formats generates all the specified output formats
-func Formats(base string, image string, formats []string, size int, trust bool, cache string) error {
+func Formats(base string, image string, formats []string, size int, trust, sparse bool, cache string) error {
 	log.Debugf("format: %v %s", formats, base)
 
 	err := ValidateFormats(formats, cache)
@@ -257,7 +320,11 @@ func Formats(base string, image string, formats []string, size int, trust bool,
 		}
 		defer ir.Close()
 		f := outFuns[o]
-		if err := f(base, ir, size, trust); err != nil {
+		span := trace.Start("format", "format", o)
+		err = f(base, ir, size, trust, sparse, cache)
+		span.SetError(err)
+		span.End()
+		if err != nil {
 			return err
 		}
 	}
@@ -265,21 +332,57 @@ func Formats(base string, image string, formats []string, size int, trust bool,
 	return nil
 }
 
-func tarToInitrd(r io.Reader) ([]byte, []byte, string, []byte, error) {
-	w := new(bytes.Buffer)
-	iw := initrd.NewWriter(w)
+// tarToInitrd converts the filesystem tarball into an initrd. The kernel, cmdline and
+// ucode are small and returned in memory, the initrd is streamed to a temporary
+// file, whose path is returned. The caller must remove it when done.
+func tarToInitrd(r io.Reader) ([]byte, string, string, []byte, error) {
+	f, err := ioutil.TempFile("", "initrd")
+	if err != nil {
+		return []byte{}, "", "", []byte{}, err
+	}
+	defer f.Close()
+	iw := initrd.NewWriter(f)
 	tr := tar.NewReader(r)
 	kernel, cmdline, ucode, err := initrd.CopySplitTar(iw, tr)
 	if err != nil {
-		return []byte{}, []byte{}, "", []byte{}, err
+		os.Remove(f.Name())
+		return []byte{}, "", "", []byte{}, err
+	}
+	if err := iw.Close(); err != nil {
+		os.Remove(f.Name())
+		return []byte{}, "", "", []byte{}, err
+	}
+	return kernel, f.Name(), cmdline, ucode, nil
+}
+
+// tarFile adds the contents of the file at path to a tar stream as name
+func tarFile(tw *tar.Writer, name string, mode int64, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
 	}
-	iw.Close()
-	return kernel, w.Bytes(), cmdline, ucode, nil
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    fi.Size(),
+		ModTime: defaultModTime,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
 }
 
-func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	tw := tar.NewWriter(buf)
+// tarInitrdKernel streams a tarball of the kernel, initrd and cmdline to w
+func tarInitrdKernel(w io.Writer, kernel []byte, initrd string, cmdline string) error {
+	tw := tar.NewWriter(w)
 	hdr := &tar.Header{
 		Name:    "kernel",
 		Mode:    0600,
@@ -289,26 +392,14 @@ func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, erro
 	}
 	err := tw.WriteHeader(hdr)
 	if err != nil {
-		return buf, err
+		return err
 	}
 	_, err = tw.Write(kernel)
 	if err != nil {
-		return buf, err
-	}
-	hdr = &tar.Header{
-		Name:    "initrd.img",
-		Mode:    0600,
-		Size:    int64(len(initrd)),
-		ModTime: defaultModTime,
-		Format:  tar.FormatPAX,
-	}
-	err = tw.WriteHeader(hdr)
-	if err != nil {
-		return buf, err
+		return err
 	}
-	_, err = tw.Write(initrd)
-	if err != nil {
-		return buf, err
+	if err := tarFile(tw, "initrd.img", 0600, initrd); err != nil {
+		return err
 	}
 	hdr = &tar.Header{
 		Name:    "cmdline",
@@ -319,39 +410,54 @@ func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, erro
 	}
 	err = tw.WriteHeader(hdr)
 	if err != nil {
-		return buf, err
+		return err
 	}
 	_, err = tw.Write([]byte(cmdline))
 	if err != nil {
-		return buf, err
+		return err
 	}
-	return buf, tw.Close()
+	return tw.Close()
 }
 
-func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline string, trust bool) error {
+func outputImg(image, filename string, kernel []byte, initrd string, cmdline string, trust, sparse bool) error {
 	log.Debugf("output img: %s %s", image, filename)
 	log.Infof("  %s", filename)
-	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
+	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	output, err := os.Create(filename)
-	if err != nil {
-		return err
+	var output io.WriteCloser = f
+	if sparse {
+		output = newSparseWriter(f)
 	}
-	defer output.Close()
-	return dockerRun(buf, output, trust, image, cmdline)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarInitrdKernel(pw, kernel, initrd, cmdline))
+	}()
+	defer pr.Close()
+	err = dockerRun(pr, output, trust, image, cmdline)
+	// closing a sparse output sets its final size, so the error matters
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func outputIso(image, filename string, filesystem io.Reader, trust bool) error {
-	log.Debugf("output ISO: %s %s", image, filename)
-	log.Infof("  %s", filename)
-	output, err := os.Create(filename)
+// outputConverted builds the raw disk image the output is converted from and
+// converts it to the disk format of the output without needing qemu-img
+func outputConverted(filename, output string, kernel []byte, initrd string, cmdline string, trust bool) error {
+	c := convertedOutputs[output]
+	raw, err := ioutil.TempFile("", "raw")
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-	return dockerRun(filesystem, output, trust, image)
+	raw.Close()
+	defer os.Remove(raw.Name())
+	if err := outputImg(outputImages[c.raw], raw.Name(), kernel, initrd, cmdline, trust, true); err != nil {
+		return err
+	}
+	log.Infof("  %s", filename)
+	return diskimage.Convert(raw.Name(), filename, c.format)
 }
 
 func outputRPi3(image, filename string, filesystem io.Reader, trust bool) error {
@@ -365,7 +471,18 @@ func outputRPi3(image, filename string, filesystem io.Reader, trust bool) error
 	return dockerRun(filesystem, output, trust, image)
 }
 
-func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
+// appendFile appends the contents of the file at src to w
+func appendFile(w io.Writer, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func outputKernelInitrd(base string, kernel []byte, initrd string, cmdline string, ucode []byte) error {
 	log.Debugf("output kernel/initrd: %s %s", base, cmdline)
 
 	if len(ucode) != 0 {
@@ -373,20 +490,25 @@ func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline strin
 		if err := ioutil.WriteFile(base+"-initrd.img", ucode, os.FileMode(0644)); err != nil {
 			return err
 		}
-		if len(initrd) != 0 {
+		if initrd != "" {
 			f, err := os.OpenFile(base+"-initrd.img", os.O_APPEND|os.O_WRONLY, 0644)
 			if err != nil {
 				return err
 			}
 			defer f.Close()
-			if _, err = f.Write(initrd); err != nil {
+			if err := appendFile(f, initrd); err != nil {
 				return err
 			}
 		}
 	} else {
-		if len(initrd) != 0 {
+		if initrd != "" {
 			log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-			if err := ioutil.WriteFile(base+"-initrd.img", initrd, os.FileMode(0644)); err != nil {
+			f, err := os.OpenFile(base+"-initrd.img", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := appendFile(f, initrd); err != nil {
 				return err
 			}
 		}
@@ -402,7 +524,7 @@ func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline strin
 	return nil
 }
 
-func outputKernelInitrdTarball(base string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
+func outputKernelInitrdTarball(base string, kernel []byte, initrd string, cmdline string, ucode []byte) error {
 	log.Debugf("output kernel/initrd tarball: %s %s", base, cmdline)
 	log.Infof("  %s", base+"-initrd.tar")
 	f, err := os.Create(base + "-initrd.tar")
@@ -426,18 +548,8 @@ func outputKernelInitrdTarball(base string, kernel []byte, initrd []byte, cmdlin
 			return err
 		}
 	}
-	if len(initrd) != 0 {
-		hdr := &tar.Header{
-			Name:    "initrd.img",
-			Mode:    0644,
-			Size:    int64(len(initrd)),
-			ModTime: defaultModTime,
-			Format:  tar.FormatPAX,
-		}
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
-		}
-		if _, err := tw.Write(initrd); err != nil {
+	if initrd != "" {
+		if err := tarFile(tw, "initrd.img", 0644, initrd); err != nil {
 			return err
 		}
 	}
@@ -478,64 +590,28 @@ func outputKernelSquashFS(image, base string, filesystem io.Reader, trust bool)
 	log.Debugf("output kernel/squashfs: %s %s", image, base)
 	log.Infof("  %s-squashfs.img", base)
 
-	tr := tar.NewReader(filesystem)
-	buf := new(bytes.Buffer)
-	rootfs := tar.NewWriter(buf)
-
-	for {
-		var thdr *tar.Header
-		thdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		thdr.Format = tar.FormatPAX
-		switch {
-		case thdr.Name == "boot/kernel":
-			kernel, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return err
-			}
-			if err := ioutil.WriteFile(base+"-kernel", kernel, os.FileMode(0644)); err != nil {
-				return err
-			}
-		case thdr.Name == "boot/cmdline":
-			cmdline, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return err
-			}
-			if err := ioutil.WriteFile(base+"-cmdline", cmdline, os.FileMode(0644)); err != nil {
-				return err
-			}
-		case strings.HasPrefix(thdr.Name, "boot/"):
-			// skip the rest of boot/
-		default:
-			rootfs.WriteHeader(thdr)
-			if _, err := io.Copy(rootfs, tr); err != nil {
-				return err
-			}
-		}
-	}
-	rootfs.Close()
-
 	output, err := os.Create(base + "-squashfs.img")
 	if err != nil {
 		return err
 	}
 	defer output.Close()
 
-	return dockerRun(buf, output, trust, image)
-}
+	// stream the root filesystem to the image builder, as it may be large
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(splitKernelRootfs(base, filesystem, pw))
+	}()
+	defer pr.Close()
 
-func outputKernelISO(image, base string, filesystem io.Reader, trust bool) error {
-	log.Debugf("output kernel/iso: %s %s", image, base)
-	log.Infof("  %s.iso", base)
+	return dockerRun(pr, output, trust, image)
+}
 
+// splitKernelRootfs writes the kernel and cmdline from the filesystem tarball to
+// base-kernel and base-cmdline and the rest of the root filesystem, except for
+// boot/, as a tarball to w.
+func splitKernelRootfs(base string, filesystem io.Reader, w io.Writer) error {
 	tr := tar.NewReader(filesystem)
-	buf := new(bytes.Buffer)
-	rootfs := tar.NewWriter(buf)
+	rootfs := tar.NewWriter(w)
 
 	for {
 		var thdr *tar.Header
@@ -567,19 +643,13 @@ func outputKernelISO(image, base string, filesystem io.Reader, trust bool) error
 		case strings.HasPrefix(thdr.Name, "boot/"):
 			// skip the rest of boot/
 		default:
-			rootfs.WriteHeader(thdr)
+			if err := rootfs.WriteHeader(thdr); err != nil {
+				return err
+			}
 			if _, err := io.Copy(rootfs, tr); err != nil {
 				return err
 			}
 		}
 	}
-	rootfs.Close()
-
-	output, err := os.Create(base + ".iso")
-	if err != nil {
-		return err
-	}
-	defer output.Close()
-
-	return dockerRun(buf, output, trust, image)
+	return rootfs.Close()
 }
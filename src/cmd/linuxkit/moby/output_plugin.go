@@ -0,0 +1,171 @@
+package moby
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// FormatPluginPrefix is the prefix of the executables on the PATH which
+// provide the output format named by the rest of their name, e.g.
+// linuxkit-format-appliance provides the format appliance
+const FormatPluginPrefix = "linuxkit-format-"
+
+// The inputs of format plugins
+const (
+	// FormatInputTar is the filesystem tarball of the image, on stdin
+	FormatInputTar = "tar"
+	// FormatInputKernelInitrd is a directory, in $LINUXKIT_INPUT_DIR, of
+	// the kernel, initrd.img, cmdline and ucode.img if there is one
+	FormatInputKernelInitrd = "kernel+initrd"
+)
+
+// FormatPlugin is an output format provided by an external command, which
+// is run with the base of the outputs as its last argument and writes its
+// files next to it. $LINUXKIT_FORMAT, $LINUXKIT_OUTPUT, $LINUXKIT_SIZE and
+// $LINUXKIT_INPUT are the format, the base, the size given to build in MB
+// and the input of the command.
+type FormatPlugin struct {
+	// Command is the command and its first arguments
+	Command []string `yaml:"command"`
+	// Input is FormatInputTar, the default, or FormatInputKernelInitrd
+	Input string `yaml:"input"`
+	// Outputs are the suffixes of the files the command writes to the
+	// base, e.g. -appliance.tar.gz, to check that they were written, to
+	// skip the format when they are up to date and for their checksums
+	Outputs []string `yaml:"outputs"`
+}
+
+// formatPlugins are the formats which are provided by plugins
+var formatPlugins = map[string]FormatPlugin{}
+
+// RegisterFormatPlugin adds the output format name, provided by p. It
+// replaces the plugin of a format, but not a format built into linuxkit.
+func RegisterFormatPlugin(name string, p FormatPlugin) error {
+	if _, ok := formatPlugins[name]; !ok && (outFuns[name] != nil || streamable[name]) {
+		return fmt.Errorf("Format %s is built in and cannot be provided by a plugin", name)
+	}
+	if name == "" || strings.ContainsAny(name, ",/\\ ") {
+		return fmt.Errorf("Invalid format name %q", name)
+	}
+	if len(p.Command) == 0 || p.Command[0] == "" {
+		return fmt.Errorf("The plugin of format %s has no command", name)
+	}
+	switch p.Input {
+	case "":
+		p.Input = FormatInputTar
+	case FormatInputTar, FormatInputKernelInitrd:
+	default:
+		return fmt.Errorf("The input of the plugin of format %s must be %s or %s, not %s", name, FormatInputTar, FormatInputKernelInitrd, p.Input)
+	}
+	for _, suffix := range p.Outputs {
+		if suffix == "" || strings.ContainsAny(suffix, "/\\") {
+			return fmt.Errorf("Invalid output %q of the plugin of format %s", suffix, name)
+		}
+	}
+	formatPlugins[name] = p
+	outFuns[name] = p.output(name)
+	if len(p.Outputs) > 0 {
+		outputFiles[name] = p.Outputs
+	} else {
+		delete(outputFiles, name)
+	}
+	return nil
+}
+
+// lookupFormatPlugin registers the plugin on the PATH providing the format
+// name, if there is one
+func lookupFormatPlugin(name string) bool {
+	if name == "" || strings.ContainsAny(name, ",/\\ ") {
+		return false
+	}
+	path, err := exec.LookPath(FormatPluginPrefix + name)
+	if err != nil {
+		return false
+	}
+	log.Debugf("Using %s for format %s", path, name)
+	return RegisterFormatPlugin(name, FormatPlugin{Command: []string{path}}) == nil
+}
+
+// pathFormatPlugins returns the formats provided by plugins on the PATH
+func pathFormatPlugins() []string {
+	var names []string
+	for name := range util.PathPlugins(FormatPluginPrefix) {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (p FormatPlugin) output(name string) func(string, io.Reader, int, bool, bool, string) error {
+	return func(base string, image io.Reader, size int, trust, sparse bool, cache string) error {
+		cmd := exec.Command(p.Command[0], append(p.Command[1:], base)...)
+		cmd.Env = append(os.Environ(),
+			"LINUXKIT_FORMAT="+name,
+			"LINUXKIT_OUTPUT="+base,
+			fmt.Sprintf("LINUXKIT_SIZE=%d", size),
+			"LINUXKIT_INPUT="+p.Input,
+		)
+		// the standard output may be the output of the build
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		switch p.Input {
+		case FormatInputTar:
+			cmd.Stdin = image
+		case FormatInputKernelInitrd:
+			dir, err := kernelInitrdDir(image)
+			if err != nil {
+				return fmt.Errorf("Error converting to initrd: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			cmd.Env = append(cmd.Env, "LINUXKIT_INPUT_DIR="+dir)
+		}
+		log.Debugf("Executing: %v", cmd.Args)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error writing %s output with %s: %v", name, p.Command[0], err)
+		}
+		for _, suffix := range p.Outputs {
+			if _, err := os.Stat(base + suffix); err != nil {
+				return fmt.Errorf("Error writing %s output: %s did not write %s", name, p.Command[0], base+suffix)
+			}
+			log.Infof("  %s", base+suffix)
+		}
+		return nil
+	}
+}
+
+// kernelInitrdDir writes the kernel, initrd, cmdline and ucode of image to a
+// temporary directory, which the caller must remove
+func kernelInitrdDir(image io.Reader) (string, error) {
+	kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(initrd)
+	dir, err := ioutil.TempDir("", "linuxkit-format")
+	if err != nil {
+		return "", err
+	}
+	files := map[string][]byte{"kernel": kernel, "cmdline": []byte(cmdline)}
+	if len(ucode) > 0 {
+		files["ucode.img"] = ucode
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	// the initrd is in the same temporary directory, so it can be moved
+	if err := os.Rename(initrd, filepath.Join(dir, "initrd.img")); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,81 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestFormatPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The plugin is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		for name := range formatPlugins {
+			delete(outFuns, name)
+			delete(outputFiles, name)
+			delete(formatPlugins, name)
+		}
+	}()
+
+	plugin := filepath.Join(dir, FormatPluginPrefix+"appliance")
+	script := "#!/bin/sh\n[ \"$LINUXKIT_FORMAT\" = appliance ] && [ \"$LINUXKIT_SIZE\" = 1024 ] || exit 1\ncat > \"$1-appliance.tar\"\n"
+	if err := ioutil.WriteFile(plugin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(image, []byte("rootfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "out")
+
+	if err := RegisterFormatPlugin("iso-efi", FormatPlugin{Command: []string{plugin}}); err == nil {
+		t.Error("Expected a built in format not to be replaced")
+	}
+	if err := RegisterFormatPlugin("appliance", FormatPlugin{Command: []string{plugin}, Input: "qcow2"}); err == nil {
+		t.Error("Expected an unknown input to be invalid")
+	}
+	if err := Formats(base, image, []string{"appliance"}, 1024, false, false, dir); err == nil {
+		t.Fatal("Expected the format to be unknown without the plugin on the PATH")
+	}
+
+	// the plugin on the PATH
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	found := false
+	for _, o := range OutputTypes() {
+		found = found || o == "appliance"
+	}
+	if !found {
+		t.Errorf("Expected the format of the plugin in %v", OutputTypes())
+	}
+	if err := Formats(base, image, []string{"appliance"}, 1024, false, false, dir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(base + "-appliance.tar"); err != nil || string(b) != "rootfs" {
+		t.Fatalf("Expected the plugin to be given the image, got %q %v", b, err)
+	}
+
+	// a plugin of the config, with the files it writes
+	if err := RegisterFormatPlugin("appliance", FormatPlugin{Command: []string{"sh", plugin}, Outputs: []string{"-appliance.tar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if files := OutputFiles(base, []string{"appliance"}); !reflect.DeepEqual(files, []string{base + "-appliance.tar"}) {
+		t.Errorf("Unexpected outputs %v", files)
+	}
+	if err := RegisterFormatPlugin("appliance", FormatPlugin{Command: []string{"true"}, Outputs: []string{"-missing.img"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Formats(base, image, []string{"appliance"}, 1024, false, false, dir); err == nil {
+		t.Error("Expected an error for an output which was not written")
+	}
+}
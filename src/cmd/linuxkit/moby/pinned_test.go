@@ -0,0 +1,129 @@
+package moby
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const pinnedDigest = "sha256:66b3d74aeb855f393ddb85e7371a00d5f7994cc26b425825df2ce910583d74dc"
+
+// descriptorSource is an ImageSource which only has a descriptor
+type descriptorSource struct {
+	desc *v1.Descriptor
+}
+
+func (d descriptorSource) Config() (imagespec.ImageConfig, error) {
+	return imagespec.ImageConfig{}, nil
+}
+
+func (d descriptorSource) TarReader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (d descriptorSource) Descriptor() *v1.Descriptor {
+	return d.desc
+}
+
+func TestPinnedReferences(t *testing.T) {
+	m, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:5.10.104@" + pinnedDigest + "\ninit:\n  - linuxkit/init@" + pinnedDigest + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.ref.Digest().String() != pinnedDigest || m.initRefs[0].Digest().String() != pinnedDigest {
+		t.Errorf("Expected the images to be pinned, got %s %s", m.Kernel.ref, m.initRefs[0])
+	}
+	if _, err := NewConfig([]byte("init:\n  - linuxkit/init@sha256:66b3d74a\n")); err == nil {
+		t.Error("Expected an error for an invalid digest")
+	}
+}
+
+func TestCheckPinned(t *testing.T) {
+	pinned, err := reference.Parse("docker.io/linuxkit/init:v0.8@" + pinnedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned, err := reference.Parse("docker.io/linuxkit/init:v0.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := v1.NewHash(pinnedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := v1.NewHash("sha256:" + strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPinned(&pinned, descriptorSource{&v1.Descriptor{Digest: hash}}); err != nil {
+		t.Error(err)
+	}
+	if err := checkPinned(&pinned, descriptorSource{&v1.Descriptor{Digest: other}}); err == nil {
+		t.Error("Expected an error for an image of another digest")
+	}
+	if err := checkPinned(&pinned, descriptorSource{}); err == nil {
+		t.Error("Expected an error for an image of no digest")
+	}
+	if err := checkPinned(&unpinned, descriptorSource{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPinnedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(source, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the sha256 of foo
+	sum := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	if s, d, err := FileSourceDigest(source + "@" + sum); err != nil || s != source || d.String() != sum {
+		t.Errorf("Unexpected source %s and digest %s: %v", s, d, err)
+	}
+	if _, _, err := FileSourceDigest(source + "@sha256:2c26"); err == nil {
+		t.Error("Expected an error for an invalid digest")
+	}
+
+	for _, tc := range []struct {
+		digest string
+		ok     bool
+	}{
+		{sum, true},
+		{pinnedDigest, false},
+	} {
+		m := Moby{Files: []File{{Path: "etc/config", Source: source + "@" + tc.digest}}}
+		err := filesystem(m, tar.NewWriter(ioutil.Discard), map[string]uint32{}, newManifest(m, ""))
+		if tc.ok && err != nil {
+			t.Error(err)
+		}
+		if !tc.ok && err == nil {
+			t.Error("Expected an error for a file of another digest")
+		}
+	}
+}
+
+func TestHasRepoDigest(t *testing.T) {
+	repoDigests := []string{"linuxkit/init@sha256:" + strings.Repeat("1", 64), "example.com/init@" + pinnedDigest}
+	if !hasRepoDigest(repoDigests, pinnedDigest) {
+		t.Errorf("Expected %s to be found in %v", pinnedDigest, repoDigests)
+	}
+	if hasRepoDigest(repoDigests[:1], pinnedDigest) {
+		t.Errorf("Expected %s not to be found in %v", pinnedDigest, repoDigests[:1])
+	}
+	if hasRepoDigest(nil, pinnedDigest) {
+		t.Errorf("Expected an image built locally not to have %s", pinnedDigest)
+	}
+}
@@ -0,0 +1,458 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// containerdConfig is the path of the containerd config in the init images
+const containerdConfig = "etc/containerd/config.toml"
+
+// patchSpec applies the JSON patches to the OCI spec
+func patchSpec(spec specs.Spec, patches []JSONPatch) (specs.Spec, error) {
+	if len(patches) == 0 {
+		return spec, nil
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return spec, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return spec, err
+	}
+	doc, err = applyJSONPatch(doc, patches)
+	if err != nil {
+		return spec, err
+	}
+	b, err = json.Marshal(doc)
+	if err != nil {
+		return spec, err
+	}
+	var patched specs.Spec
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return spec, fmt.Errorf("patched spec is not a valid OCI spec: %v", err)
+	}
+	return patched, nil
+}
+
+// applyJSONPatch applies the operations of a JSON patch, as in RFC 6902, to
+// a document decoded from JSON
+func applyJSONPatch(doc interface{}, patches []JSONPatch) (interface{}, error) {
+	for _, p := range patches {
+		path, err := jsonPointer(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		// values from yaml must have the types of values decoded from JSON
+		value, err := jsonValue(convert(p.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s %s: %v", p.Op, p.Path, err)
+		}
+		switch p.Op {
+		case "add":
+			doc, err = jsonAdd(doc, path, value, false)
+		case "replace":
+			doc, err = jsonAdd(doc, path, value, true)
+		case "remove":
+			doc, err = jsonRemove(doc, path)
+		case "move", "copy":
+			var from []string
+			from, err = jsonPointer(p.From)
+			if err != nil {
+				break
+			}
+			value, err = jsonGet(doc, from)
+			if err != nil {
+				break
+			}
+			if p.Op == "move" {
+				doc, err = jsonRemove(doc, from)
+			} else {
+				value, err = jsonValue(value)
+			}
+			if err != nil {
+				break
+			}
+			doc, err = jsonAdd(doc, path, value, false)
+		case "test":
+			var v interface{}
+			v, err = jsonGet(doc, path)
+			if err == nil && !reflect.DeepEqual(v, value) {
+				err = errors.New("value differs")
+			}
+		default:
+			err = fmt.Errorf("unknown operation")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", p.Op, p.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonValue returns a copy of v with the types of values decoded from JSON
+func jsonValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// jsonPointer splits a JSON pointer, as in RFC 6901, into its reference
+// tokens
+func jsonPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %s", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// jsonIndex returns the index of an array of length n which the token
+// refers to, which may be n if end is true
+func jsonIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %s", token)
+	}
+	return i, nil
+}
+
+func jsonChild(doc interface{}, token string) (interface{}, error) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		v, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("no member %s", token)
+		}
+		return v, nil
+	case []interface{}:
+		i, err := jsonIndex(token, len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		return d[i], nil
+	}
+	return nil, fmt.Errorf("cannot refer to %s in a value which is not an object or array", token)
+}
+
+func jsonGet(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		var err error
+		if doc, err = jsonChild(doc, t); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// jsonUpdate calls update with the object or array the path refers to a
+// member of, and the last token, and replaces it with what it returns
+func jsonUpdate(doc interface{}, path []string, update func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+	child, err := jsonChild(doc, path[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = jsonUpdate(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		d[path[0]] = child
+	case []interface{}:
+		i, _ := jsonIndex(path[0], len(d), false)
+		d[i] = child
+	}
+	return doc, nil
+}
+
+// jsonAdd adds the value at the path, or replaces the value which is there
+// if replace is true, in which case it must exist
+func jsonAdd(doc interface{}, path []string, value interface{}, replace bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch d := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := d[token]; replace && !ok {
+				return nil, fmt.Errorf("no member %s", token)
+			}
+			d[token] = value
+			return d, nil
+		case []interface{}:
+			i, err := jsonIndex(token, len(d), !replace)
+			if err != nil {
+				return nil, err
+			}
+			if replace {
+				d[i] = value
+				return d, nil
+			}
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+		return nil, fmt.Errorf("cannot add %s to a value which is not an object or array", token)
+	})
+}
+
+func jsonRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return jsonUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch d := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := d[token]; !ok {
+				return nil, fmt.Errorf("no member %s", token)
+			}
+			delete(d, token)
+			return d, nil
+		case []interface{}:
+			i, err := jsonIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(d[:i], d[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %s from a value which is not an object or array", token)
+	})
+}
+
+// tomlTable is a table of a TOML document, with the lines of its keys,
+// comments and blank lines, which have no key
+type tomlTable struct {
+	header string
+	keys   []tomlKey
+}
+
+type tomlKey struct {
+	key   string
+	lines []string
+}
+
+func (k tomlKey) blank() bool {
+	return k.key == "" && strings.TrimSpace(k.lines[0]) == ""
+}
+
+// parseTOML splits a TOML document into its tables and keys, keeping the
+// lines as they are, so they can be merged without a TOML parser
+func parseTOML(doc string) []*tomlTable {
+	tables := []*tomlTable{{}}
+	table := tables[0]
+	depth, multiline := 0, ""
+	for _, line := range strings.Split(strings.TrimRight(doc, "\n"), "\n") {
+		if depth > 0 || multiline != "" {
+			// continuation of a value which spans lines
+			k := &table.keys[len(table.keys)-1]
+			k.lines = append(k.lines, line)
+			depth, multiline = tomlOpen(line, depth, multiline)
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "["):
+			table = &tomlTable{header: trimmed}
+			tables = append(tables, table)
+		case trimmed == "" || strings.HasPrefix(trimmed, "#") || !strings.Contains(trimmed, "="):
+			table.keys = append(table.keys, tomlKey{lines: []string{line}})
+		default:
+			i := strings.Index(trimmed, "=")
+			table.keys = append(table.keys, tomlKey{key: strings.TrimSpace(trimmed[:i]), lines: []string{line}})
+			depth, multiline = tomlOpen(trimmed[i+1:], 0, "")
+		}
+	}
+	return tables
+}
+
+// tomlOpen returns the depth of the arrays and inline tables, and the
+// multi-line string, which are still open after s
+func tomlOpen(s string, depth int, multiline string) (int, string) {
+	for i := 0; i < len(s); i++ {
+		if multiline != "" {
+			if strings.HasPrefix(s[i:], multiline) {
+				i += len(multiline) - 1
+				multiline = ""
+			}
+			continue
+		}
+		switch c := s[i]; c {
+		case '#':
+			return depth, ""
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case '"', '\'':
+			q := string(c)
+			if strings.HasPrefix(s[i:], q+q+q) {
+				multiline = q + q + q
+				i += 2
+				continue
+			}
+			// skip a string on one line
+			for i++; i < len(s) && s[i] != c; i++ {
+				if c == '"' && s[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return depth, multiline
+}
+
+// mergeTOML merges the patch into the base TOML document: keys of the
+// patch replace the same keys of the same table of the base, and other keys
+// and tables are added. Arrays of tables of the patch are always added.
+func mergeTOML(base, patch string) string {
+	tables := parseTOML(base)
+	for _, pt := range parseTOML(patch) {
+		var table *tomlTable
+		if !strings.HasPrefix(pt.header, "[[") {
+			for _, t := range tables {
+				if t.header == pt.header {
+					table = t
+					break
+				}
+			}
+		}
+		if table == nil {
+			tables = append(tables, pt)
+			continue
+		}
+	keys:
+		for _, pk := range pt.keys {
+			if pk.key != "" {
+				for i, k := range table.keys {
+					if k.key == pk.key {
+						table.keys[i] = pk
+						continue keys
+					}
+				}
+			}
+			// before the blank lines at the end of the table
+			i := len(table.keys)
+			for i > 0 && table.keys[i-1].blank() {
+				i--
+			}
+			table.keys = append(table.keys[:i], append([]tomlKey{pk}, table.keys[i:]...)...)
+		}
+	}
+	var b strings.Builder
+	for _, t := range tables {
+		if t.header != "" {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(t.header + "\n")
+		}
+		// blank lines at the end of tables are put back between tables
+		keys := t.keys
+		for len(keys) > 0 && keys[len(keys)-1].blank() {
+			keys = keys[:len(keys)-1]
+		}
+		for _, k := range keys {
+			b.WriteString(strings.Join(k.lines, "\n") + "\n")
+		}
+	}
+	return b.String()
+}
+
+// containerdFilter is a tar.Writer that merges a patch into the containerd
+// config of the init images on the underlying tar writer
+type containerdFilter struct {
+	tw     *tar.Writer
+	patch  string
+	hdr    *tar.Header
+	buffer *bytes.Buffer
+	found  bool
+}
+
+func newContainerdFilter(tw *tar.Writer, patch string) *containerdFilter {
+	return &containerdFilter{tw: tw, patch: patch}
+}
+
+func (c *containerdFilter) finishConfig() error {
+	if c.hdr == nil {
+		return nil
+	}
+	config := mergeTOML(c.buffer.String(), c.patch)
+	c.hdr.Size = int64(len(config))
+	if err := c.tw.WriteHeader(c.hdr); err != nil {
+		return err
+	}
+	if _, err := c.tw.Write([]byte(config)); err != nil {
+		return err
+	}
+	c.hdr = nil
+	c.buffer = nil
+	return nil
+}
+
+// Close checks that the containerd config was found, it does not close
+// the underlying tar writer
+func (c *containerdFilter) Close() error {
+	if err := c.finishConfig(); err != nil {
+		return err
+	}
+	if !c.found {
+		return fmt.Errorf("did not find %s in the init images to merge the runtime containerd config into", containerdConfig)
+	}
+	return nil
+}
+
+func (c *containerdFilter) Flush() error {
+	if err := c.finishConfig(); err != nil {
+		return err
+	}
+	return c.tw.Flush()
+}
+
+func (c *containerdFilter) Write(b []byte) (n int, err error) {
+	if c.buffer != nil {
+		return c.buffer.Write(b)
+	}
+	return c.tw.Write(b)
+}
+
+func (c *containerdFilter) WriteHeader(hdr *tar.Header) error {
+	if err := c.finishConfig(); err != nil {
+		return err
+	}
+	if hdr.Name == containerdConfig && hdr.Typeflag == tar.TypeReg {
+		c.found = true
+		c.hdr = hdr
+		c.buffer = new(bytes.Buffer)
+		return nil
+	}
+	return c.tw.WriteHeader(hdr)
+}
@@ -0,0 +1,237 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestRuntimeConfig(t *testing.T) {
+	config := `init:
+  - linuxkit/init:v0.8
+  - linuxkit/containerd:v0.8
+services:
+  - name: getty
+    image: linuxkit/getty:v0.8
+runtime:
+  default: crun
+  containerd: |
+    [debug]
+      level = "debug"
+  patches:
+    getty:
+      - op: add
+        path: /linux/sysctl
+        value:
+          net.ipv4.ping_group_range: "0 0"
+`
+	m, err := NewConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Runtime.Default != "crun" {
+		t.Errorf("Expected default runtime crun, got %s", m.Runtime.Default)
+	}
+	spec, err := patchSpec(specs.Spec{Linux: &specs.Linux{}}, m.Runtime.Patches["getty"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Linux.Sysctl["net.ipv4.ping_group_range"] != "0 0" {
+		t.Errorf("Expected the sysctl to be added, got %v", spec.Linux.Sysctl)
+	}
+
+	_, err = NewConfig([]byte("runtime:\n  patches:\n    getty:\n      - op: append\n        path: /linux\n"))
+	if err == nil {
+		t.Error("Expected an error for an unknown patch operation")
+	}
+}
+
+func TestAppendRuntimeConfig(t *testing.T) {
+	m0 := Moby{Runtime: RuntimeConfig{
+		Default:    "crun",
+		Containerd: "[debug]\n  level = \"debug\"",
+		Patches:    map[string][]JSONPatch{"getty": {{Op: "remove", Path: "/hostname"}}},
+	}}
+	m1 := Moby{Runtime: RuntimeConfig{
+		Containerd: "[grpc]\n  uid = 100",
+		Patches:    map[string][]JSONPatch{"getty": {{Op: "add", Path: "/hostname", Value: "tty"}}},
+	}}
+	m, err := AppendConfig(m0, m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Runtime.Default != "crun" {
+		t.Errorf("Expected default runtime crun, got %s", m.Runtime.Default)
+	}
+	if m.Runtime.Containerd != "[debug]\n  level = \"debug\"\n[grpc]\n  uid = 100" {
+		t.Errorf("Unexpected containerd config %q", m.Runtime.Containerd)
+	}
+	if len(m.Runtime.Patches["getty"]) != 2 || len(m0.Runtime.Patches["getty"]) != 1 {
+		t.Errorf("Expected the patches to be appended, got %v", m.Runtime.Patches)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"a":   []interface{}{"x", "y"},
+		"b/c": map[string]interface{}{"d": 1.0},
+	}
+	patches := []JSONPatch{
+		{Op: "add", Path: "/a/1", Value: "z"},
+		{Op: "add", Path: "/a/-", Value: "w"},
+		{Op: "remove", Path: "/a/0"},
+		{Op: "replace", Path: "/b~1c/d", Value: 2},
+		{Op: "copy", From: "/b~1c", Path: "/e"},
+		{Op: "move", From: "/e/d", Path: "/f"},
+		{Op: "test", Path: "/f", Value: 2},
+		{Op: "add", Path: "/g", Value: map[interface{}]interface{}{"h": []interface{}{true}}},
+	}
+	patched, err := applyJSONPatch(doc, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a":   []interface{}{"z", "y", "w"},
+		"b/c": map[string]interface{}{"d": 2.0},
+		"e":   map[string]interface{}{},
+		"f":   2.0,
+		"g":   map[string]interface{}{"h": []interface{}{true}},
+	}
+	if !reflect.DeepEqual(patched, expected) {
+		t.Errorf("Expected %v, got %v", expected, patched)
+	}
+
+	for _, p := range []JSONPatch{
+		{Op: "replace", Path: "/missing", Value: 1},
+		{Op: "remove", Path: "/a/3"},
+		{Op: "add", Path: "/a/01", Value: 1},
+		{Op: "test", Path: "/f", Value: 3},
+		{Op: "add", Path: "a", Value: 1},
+		{Op: "remove", Path: ""},
+	} {
+		if _, err := applyJSONPatch(expected, []JSONPatch{p}); err == nil {
+			t.Errorf("Expected an error for %v", p)
+		}
+	}
+}
+
+func TestPatchSpecInvalid(t *testing.T) {
+	_, err := patchSpec(specs.Spec{}, []JSONPatch{{Op: "add", Path: "/nosuchfield", Value: 1}})
+	if err == nil {
+		t.Error("Expected an error for a patched spec which is not an OCI spec")
+	}
+}
+
+func TestMergeTOML(t *testing.T) {
+	base := `state = "/run/containerd"
+disabled_plugins = ["cri"]
+
+[grpc]
+  address = "/run/containerd/containerd.sock"
+  uid = 0
+
+[debug]
+  level = "info"
+`
+	patch := `disabled_plugins = [
+  "cri",
+  "aufs",
+]
+oom_score = -999
+
+[debug]
+  level = "debug" # more logs
+
+[plugins.linux]
+  runtime = "crun"
+`
+	expected := `state = "/run/containerd"
+disabled_plugins = [
+  "cri",
+  "aufs",
+]
+oom_score = -999
+
+[grpc]
+  address = "/run/containerd/containerd.sock"
+  uid = 0
+
+[debug]
+  level = "debug" # more logs
+
+[plugins.linux]
+  runtime = "crun"
+`
+	if merged := mergeTOML(base, patch); merged != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, merged)
+	}
+}
+
+func TestTOMLOpen(t *testing.T) {
+	for _, tc := range []struct {
+		s         string
+		depth     int
+		multiline string
+	}{
+		{s: `["a", "]", 'b]'] # [`},
+		{s: `[`, depth: 1},
+		{s: `{ a = [1, 2`, depth: 2},
+		{s: `"""a "" b`, multiline: `"""`},
+		{s: `'''a''' + [`, depth: 1},
+	} {
+		depth, multiline := tomlOpen(tc.s, 0, "")
+		if depth != tc.depth || multiline != tc.multiline {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.s, tc.depth, tc.multiline, depth, multiline)
+		}
+	}
+}
+
+func TestContainerdFilter(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	cf := newContainerdFilter(tw, "[debug]\n  level = \"debug\"\n")
+	config := "[debug]\n  level = \"info\"\n"
+	for _, f := range []struct {
+		name, contents string
+	}{
+		{"etc/containerd/config.toml", config},
+		{"etc/hostname", "moby"},
+	} {
+		if err := cf.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cf.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != containerdConfig || string(b) != "[debug]\n  level = \"debug\"\n" {
+		t.Errorf("Unexpected %s: %q", hdr.Name, b)
+	}
+	if hdr, err = tr.Next(); err != nil || hdr.Name != "etc/hostname" {
+		t.Errorf("Expected etc/hostname, got %v %v", hdr, err)
+	}
+
+	if err := newContainerdFilter(tar.NewWriter(ioutil.Discard), "[debug]").Close(); err == nil {
+		t.Error("Expected an error without a containerd config")
+	}
+}
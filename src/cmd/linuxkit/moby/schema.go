@@ -45,6 +45,32 @@ var schema = string(`
         "org": { "$ref": "#/definitions/strings" }
       }
     },
+    "jsonPatch": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["op", "path"],
+      "properties": {
+        "op": {"enum": ["add", "remove", "replace", "move", "copy", "test"]},
+        "path": {"type": "string"},
+        "from": {"type": "string"},
+        "value": {}
+      }
+    },
+    "runtimeConfig": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "default": {"type": "string"},
+        "containerd": {"type": "string"},
+        "patches": {
+          "type": "object",
+          "additionalProperties": {
+            "type": "array",
+            "items": { "$ref": "#/definitions/jsonPatch" }
+          }
+        }
+      }
+    },
     "strings": {
         "type": "array",
         "items": {"type": "string"}
@@ -249,7 +275,8 @@ var schema = string(`
         "mkdir": {"$ref": "#/definitions/strings"},
         "interfaces": {"$ref": "#/definitions/interfaces"},
         "bindNS": {"$ref": "#/definitions/namespaces"},
-        "namespace": {"type": "string"}
+        "namespace": {"type": "string"},
+        "ociRuntime": {"type": "string"}
       }
     },
     "image": {
@@ -309,7 +336,8 @@ var schema = string(`
     "onshutdown": { "$ref": "#/definitions/images" },
     "services": { "$ref": "#/definitions/images" },
     "trust": { "$ref": "#/definitions/trust" },
-    "files": { "$ref": "#/definitions/files" }
+    "files": { "$ref": "#/definitions/files" },
+    "runtime": { "$ref": "#/definitions/runtimeConfig" }
   }
 }
 `)
@@ -0,0 +1,95 @@
+package moby
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sparseBlockSize is the granularity at which zero regions are detected.
+// It matches the block size of most filesystems.
+const sparseBlockSize = 4096
+
+// sparseWriter is an io.WriteCloser which writes to a file, but seeks over blocks
+// which only contain zeros instead of writing them, leaving holes in the file.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func newSparseWriter(f *os.File) *sparseWriter {
+	return &sparseWriter{f: f}
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sparseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := sparseBlockSize
+		if len(b) < n {
+			n = len(b)
+		}
+		block := b[:n]
+		if isZero(block) {
+			if _, err := s.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else {
+			if _, err := s.f.Write(block); err != nil {
+				return written, err
+			}
+		}
+		s.offset += int64(n)
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close makes sure the file has the full size, even if it ends with a hole
+func (s *sparseWriter) Close() error {
+	if err := s.f.Truncate(s.offset); err != nil {
+		return err
+	}
+	return s.f.Close()
+}
+
+// sparsify rewrites the file at path sparsely, for disk images which are not
+// written through a sparseWriter
+func sparsify(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".sparse")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := newSparseWriter(f)
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
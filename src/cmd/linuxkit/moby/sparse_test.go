@@ -0,0 +1,70 @@
+package moby
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSparseWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	data := make([]byte, 5*sparseBlockSize+100)
+	copy(data[sparseBlockSize:], []byte("data"))
+	copy(data[3*sparseBlockSize+10:], []byte("more data"))
+
+	w := newSparseWriter(f)
+	// write in uneven chunks to exercise partial blocks
+	for b := data; len(b) > 0; {
+		n := 3000
+		if len(b) < n {
+			n = len(b)
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Sparse file contents differ: got %d bytes, expected %d", len(got), len(data))
+	}
+}
+
+func TestSparsify(t *testing.T) {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	data := make([]byte, 4*sparseBlockSize)
+	copy(data[2*sparseBlockSize:], []byte("data"))
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := sparsify(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Sparse file contents differ: got %d bytes, expected %d", len(got), len(data))
+	}
+}
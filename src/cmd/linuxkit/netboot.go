@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Boot states of a machine, in the order they are reached
+const (
+	netbootWaiting = "waiting"
+	netbootDHCP    = "dhcp"
+	netbootScript  = "script"
+	netbootKernel  = "kernel"
+	netbootInitrd  = "initrd"
+	netbootBooted  = "booted"
+)
+
+// netbootMachine is a machine of the netboot configuration file, with its
+// boot state
+type netbootMachine struct {
+	MAC string `yaml:"mac" json:"mac"`
+	// Name is only used in logs and the status
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Image is the prefix of the kernel, initrd and cmdline of the image
+	// in the served directory
+	Image string `yaml:"image" json:"image"`
+	// Cmdline is appended to the cmdline of the image
+	Cmdline string `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+	// Once stops booting the machine once it reported it booted, so it
+	// boots from its disk afterwards, as after an install
+	Once bool `yaml:"once,omitempty" json:"once,omitempty"`
+
+	State   string     `yaml:"-" json:"state"`
+	Updated *time.Time `yaml:"-" json:"updated,omitempty"`
+}
+
+// netbootConfig is the configuration file of 'linuxkit netboot'
+type netbootConfig struct {
+	// Default is the image booted by machines which are not listed, which
+	// are not booted without it
+	Default  *netbootMachine  `yaml:"default,omitempty"`
+	Machines []netbootMachine `yaml:"machines"`
+}
+
+type netbootServer struct {
+	dir string
+	mu  sync.Mutex
+	// machines are by MAC address, including the machines which booted
+	// the default image
+	machines map[string]*netbootMachine
+	def      *netbootMachine
+}
+
+func netbootUsage(flags *flag.FlagSet) {
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf("USAGE: %s netboot [options] config.yml\n\n", invoked)
+	fmt.Printf("Provision bare-metal machines on the local network with PXE. The\n")
+	fmt.Printf("configuration file maps the MAC address of each machine to the image it\n")
+	fmt.Printf("boots, which ProxyDHCP, TFTP and HTTP servers boot it into.\n\n")
+	fmt.Printf("Endpoints:\n")
+	fmt.Printf("  GET    /v1/machines         List the machines and their boot state\n")
+	fmt.Printf("  GET    /v1/machines/MAC     Get the boot state of a machine\n")
+	fmt.Printf("  POST   /boot/MAC/booted     Report that a machine booted, as given in its cmdline\n")
+	fmt.Printf("\n")
+	fmt.Printf("Options:\n\n")
+	flags.PrintDefaults()
+}
+
+// netboot runs the PXE servers for the machines of a configuration file
+func netboot(args []string) {
+	flags := newFlagSet("netboot")
+	flags.Usage = func() { netbootUsage(flags) }
+	portFlag := flags.String("port", ":8080", "Local port to serve HTTP on")
+	dirFlag := flags.String("directory", ".", "Directory with the images")
+	pxe := addPXEFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 1 {
+		fmt.Println("Please specify the configuration file")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	s, err := newNetbootServer(remArgs[0], *dirFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, baseURL, err := pxe.config(*dirFlag, *portFlag, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.scriptURL = func(mac net.HardwareAddr) (string, bool) {
+		m := s.machine(mac.String(), true)
+		if m == nil || s.done(m) {
+			return "", false
+		}
+		s.setState(m, netbootDHCP)
+		return fmt.Sprintf("%s/boot/%s/boot.ipxe", baseURL, m.MAC), true
+	}
+	if err := servePXE(config); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Serving %d machines on %s", len(s.machines), *portFlag)
+	log.Fatal(http.ListenAndServe(*portFlag, logRequest(s)))
+}
+
+// newNetbootServer reads the configuration file
+func newNetbootServer(path, dir string) (*netbootServer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the configuration: %v", err)
+	}
+	var config netbootConfig
+	if err := yaml.UnmarshalStrict(b, &config); err != nil {
+		return nil, fmt.Errorf("Invalid configuration %s: %v", path, err)
+	}
+	s := &netbootServer{dir: dir, machines: map[string]*netbootMachine{}, def: config.Default}
+	if s.def != nil {
+		s.def.MAC = "default"
+		if err := s.checkImage(s.def); err != nil {
+			return nil, err
+		}
+	}
+	for i := range config.Machines {
+		m := &config.Machines[i]
+		mac, err := net.ParseMAC(m.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MAC address of machine %d: %v", i, err)
+		}
+		m.MAC = mac.String()
+		if _, ok := s.machines[m.MAC]; ok {
+			return nil, fmt.Errorf("Machine %s is given more than once", m.MAC)
+		}
+		if err := s.checkImage(m); err != nil {
+			return nil, err
+		}
+		m.State = netbootWaiting
+		s.machines[m.MAC] = m
+	}
+	return s, nil
+}
+
+// checkImage checks the image of a machine is given, and warns if it is
+// not built yet
+func (s *netbootServer) checkImage(m *netbootMachine) error {
+	if m.Image == "" {
+		return fmt.Errorf("No image for machine %s", m.MAC)
+	}
+	m.Image = strings.Trim(filepath.ToSlash(m.Image), "/")
+	for _, suffix := range []string{"-kernel", "-initrd.img", "-cmdline"} {
+		if _, err := os.Stat(s.imagePath(m, suffix)); err != nil {
+			log.Warnf("Image %s is not built: %v", m.Image, err)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *netbootServer) imagePath(m *netbootMachine, suffix string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(m.Image)+suffix)
+}
+
+// machine returns the machine with a MAC address, or with add a machine
+// booting the default image
+func (s *netbootServer) machine(addr string, add bool) *netbootMachine {
+	hw, err := net.ParseMAC(addr)
+	if err != nil {
+		return nil
+	}
+	mac := hw.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.machines[mac]; ok {
+		return m
+	}
+	if !add || s.def == nil {
+		return nil
+	}
+	m := &netbootMachine{
+		MAC:     mac,
+		Image:   s.def.Image,
+		Cmdline: s.def.Cmdline,
+		Once:    s.def.Once,
+		State:   netbootWaiting,
+	}
+	s.machines[mac] = m
+	return m
+}
+
+// done returns whether a machine booted and is not booted again
+func (s *netbootServer) done(m *netbootMachine) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return m.Once && m.State == netbootBooted
+}
+
+func (s *netbootServer) setState(m *netbootMachine, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m.Updated = &now
+	if m.State == state {
+		return
+	}
+	m.State = state
+	name := m.MAC
+	if m.Name != "" {
+		name = fmt.Sprintf("%s (%s)", m.Name, m.MAC)
+	}
+	log.Infof("Machine %s: %s", name, state)
+}
+
+func (s *netbootServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "v1" && parts[1] == "machines" && r.Method == http.MethodGet:
+		s.listMachines(w)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "machines" && r.Method == http.MethodGet:
+		m := s.machine(parts[2], false)
+		if m == nil {
+			writeError(w, http.StatusNotFound, "machine %s not found", parts[2])
+			return
+		}
+		s.mu.Lock()
+		writeJSON(w, http.StatusOK, m)
+		s.mu.Unlock()
+	case len(parts) == 3 && parts[0] == "boot":
+		s.boot(w, r, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "%s %s not found", r.Method, r.URL.Path)
+	}
+}
+
+func (s *netbootServer) listMachines(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	machines := []*netbootMachine{}
+	for _, m := range s.machines {
+		machines = append(machines, m)
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].MAC < machines[j].MAC })
+	writeJSON(w, http.StatusOK, machines)
+}
+
+// boot serves the iPXE script, kernel and initrd of a machine, and takes
+// the reports of booted machines
+func (s *netbootServer) boot(w http.ResponseWriter, r *http.Request, mac, file string) {
+	m := s.machine(mac, false)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case file == "boot.ipxe" && r.Method == http.MethodGet:
+		if s.done(m) {
+			http.NotFound(w, r)
+			return
+		}
+		cmdline, err := ioutil.ReadFile(s.imagePath(m, "-cmdline"))
+		if err != nil {
+			log.Errorf("Unable to read the cmdline of %s: %v", m.Image, err)
+			http.NotFound(w, r)
+			return
+		}
+		base := fmt.Sprintf("http://%s/boot/%s", r.Host, m.MAC)
+		args := []string{strings.TrimSpace(string(cmdline))}
+		if m.Cmdline != "" {
+			args = append(args, m.Cmdline)
+		}
+		args = append(args, "linuxkit.netboot="+base+"/booted")
+		s.setState(m, netbootScript)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, s3IPXEScript(base+"/kernel", base+"/initrd.img", strings.Join(args, " ")))
+	case file == "kernel" && r.Method == http.MethodGet:
+		s.setState(m, netbootKernel)
+		http.ServeFile(w, r, s.imagePath(m, "-kernel"))
+	case file == "initrd.img" && r.Method == http.MethodGet:
+		s.setState(m, netbootInitrd)
+		http.ServeFile(w, r, s.imagePath(m, "-initrd.img"))
+	case file == "booted" && r.Method == http.MethodPost:
+		s.setState(m, netbootBooted)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
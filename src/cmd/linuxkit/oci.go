@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	ociProfileVar       = "OCI_CLI_PROFILE"
+	ociCompartmentVar   = "OCI_COMPARTMENT_ID"
+	ociRegionVar        = "OCI_REGION"
+	ociBucketVar        = "OCI_BUCKET"
+	ociSubnetVar        = "OCI_SUBNET_ID"
+	ociDefaultProfile   = "DEFAULT"
+	ociCoreAPIVersion   = "20160918"
+	ociLifecycleTimeout = 30 * time.Minute
+)
+
+// OCIClient is a client for the Oracle Cloud Infrastructure API, which signs
+// requests with the API key of a user, as configured for the oci CLI
+type OCIClient struct {
+	tenancy     string
+	user        string
+	fingerprint string
+	key         *rsa.PrivateKey
+	region      string
+	client      *http.Client
+}
+
+// readOCIConfig reads a profile from an oci CLI config file
+func readOCIConfig(path, profile string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var section string
+	config := map[string]string{}
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			found = found || section == profile
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		// values in DEFAULT are inherited by other profiles
+		if section == profile || section == ociDefaultProfile && config[strings.TrimSpace(kv[0])] == "" {
+			config[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("profile %s not found in %s", profile, path)
+	}
+	return config, nil
+}
+
+func parseOCIKey(path, passphrase string) (*rsa.PrivateKey, error) {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(util.HomeDir(), path[2:])
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if der, err = x509.DecryptPEMBlock(block, []byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("Cannot decrypt %s: %v", path, err)
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// NewOCIClient creates a client using a profile of the oci CLI config file
+// in ~/.oci/config. If region is not empty it overrides the region of the profile.
+func NewOCIClient(profile, region string) (*OCIClient, error) {
+	path := filepath.Join(util.HomeDir(), ".oci", "config")
+	config, err := readOCIConfig(path, profile)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"tenancy", "user", "fingerprint", "key_file"} {
+		if config[k] == "" {
+			return nil, fmt.Errorf("%s is not set in profile %s of %s", k, profile, path)
+		}
+	}
+	key, err := parseOCIKey(config["key_file"], config["pass_phrase"])
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = config["region"]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("No region is set")
+	}
+	return &OCIClient{
+		tenancy:     config["tenancy"],
+		user:        config["user"],
+		fingerprint: config["fingerprint"],
+		key:         key,
+		region:      region,
+		client:      &http.Client{},
+	}, nil
+}
+
+// Tenancy returns the OCID of the tenancy, which is also its root compartment
+func (c *OCIClient) Tenancy() string {
+	return c.tenancy
+}
+
+// sign adds the authorization header to a request, see
+// https://docs.oracle.com/en-us/iaas/Content/API/Concepts/signingrequests.htm
+func (c *OCIClient) sign(req *http.Request, body []byte, signBody bool) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if signBody {
+		sum := sha256.Sum256(body)
+		req.Header.Set("X-Content-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Length", fmt.Sprint(len(body)))
+		headers = append(headers, "x-content-sha256", "content-type", "content-length")
+	}
+	var lines []string
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("%s: %s %s", h, strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "host":
+			lines = append(lines, "host: "+req.URL.Host)
+		default:
+			lines = append(lines, h+": "+req.Header.Get(h))
+		}
+	}
+	digest := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature version="1",keyId="%s/%s/%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		c.tenancy, c.user, c.fingerprint, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+func (c *OCIClient) endpoint(service string) string {
+	return fmt.Sprintf("https://%s.%s.oraclecloud.com", service, c.region)
+}
+
+// do sends a JSON request and decodes the JSON response into out
+func (c *OCIClient) do(method, u string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := c.sign(req, body, method == http.MethodPost || method == http.MethodPut); err != nil {
+		return err
+	}
+	log.Debugf("OCI: %s %s", method, u)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s failed: %s: %s %s", method, req.URL.Path, resp.Status, e.Code, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *OCIClient) core(path string) string {
+	return c.endpoint("iaas") + "/" + ociCoreAPIVersion + path
+}
+
+// Namespace returns the Object Storage namespace of the tenancy
+func (c *OCIClient) Namespace() (string, error) {
+	var ns string
+	err := c.do(http.MethodGet, c.endpoint("objectstorage")+"/n/", nil, &ns)
+	return ns, err
+}
+
+// UploadObject uploads a file to a bucket. Objects have no tags, so the
+// tags are set as metadata.
+func (c *OCIClient) UploadObject(namespace, bucket, object, path string, tags Tags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/n/%s/b/%s/o/%s", c.endpoint("objectstorage"), namespace, bucket, url.PathEscape(object))
+	req, err := http.NewRequest(http.MethodPut, u, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for _, tag := range tags {
+		req.Header.Set("opc-meta-"+tag.Key, tag.Value)
+	}
+	// the body of object uploads is not signed
+	if err := c.sign(req, nil, false); err != nil {
+		return err
+	}
+	log.Debugf("OCI: PUT %s", u)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("upload of %s failed: %s: %s", object, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// waitState polls a resource until its lifecycleState is state
+func (c *OCIClient) waitState(u, state string) (map[string]interface{}, error) {
+	deadline := time.Now().Add(ociLifecycleTimeout)
+	for time.Now().Before(deadline) {
+		var r map[string]interface{}
+		if err := c.do(http.MethodGet, u, nil, &r); err != nil {
+			return nil, err
+		}
+		s, _ := r["lifecycleState"].(string)
+		log.Debugf("OCI: %s is %s", u, s)
+		switch {
+		case s == state:
+			return r, nil
+		case s == "FAILED" || s == "TERMINATED" || s == "DELETED":
+			return nil, fmt.Errorf("%s is %s", r["id"], s)
+		}
+		time.Sleep(10 * time.Second)
+	}
+	return nil, fmt.Errorf("timed out waiting for %s to be %s", u, state)
+}
+
+// ImportImage creates a custom image from an object and waits for it to be
+// available. The image is deleted if the run fails or is interrupted before
+// keepResources is called.
+func (c *OCIClient) ImportImage(compartment, name, namespace, bucket, object, format, launchMode string, tags Tags) (string, error) {
+	req := map[string]interface{}{
+		"compartmentId": compartment,
+		"displayName":   name,
+		"launchMode":    launchMode,
+		"freeformTags":  tags.Map(),
+		"imageSourceDetails": map[string]string{
+			"sourceType":      "objectStorageTuple",
+			"namespaceName":   namespace,
+			"bucketName":      bucket,
+			"objectName":      object,
+			"sourceImageType": format,
+		},
+	}
+	var image struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(http.MethodPost, c.core("/images"), req, &image); err != nil {
+		return "", err
+	}
+	onCleanup("image "+image.ID, func() error { return c.DeleteImage(image.ID) })
+	if _, err := c.waitState(c.core("/images/"+image.ID), "AVAILABLE"); err != nil {
+		return "", err
+	}
+	return image.ID, nil
+}
+
+// DeleteObject deletes an object from a bucket
+func (c *OCIClient) DeleteObject(namespace, bucket, object string) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("%s/n/%s/b/%s/o/%s", c.endpoint("objectstorage"), namespace, bucket, url.PathEscape(object)), nil, nil)
+}
+
+// AddImageShape makes an image compatible with a shape. Custom images are
+// only compatible with some of the x86 shapes by default.
+func (c *OCIClient) AddImageShape(imageID, shape string) error {
+	return c.do(http.MethodPut, c.core("/images/"+imageID+"/shapes/"+shape), map[string]string{}, nil)
+}
+
+// DeleteImage deletes a custom image
+func (c *OCIClient) DeleteImage(imageID string) error {
+	return c.do(http.MethodDelete, c.core("/images/"+imageID), nil, nil)
+}
+
+// AvailabilityDomains returns the names of the availability domains of the region
+func (c *OCIClient) AvailabilityDomains(compartment string) ([]string, error) {
+	var ads []struct {
+		Name string `json:"name"`
+	}
+	u := c.endpoint("identity") + "/" + ociCoreAPIVersion + "/availabilityDomains?compartmentId=" + url.QueryEscape(compartment)
+	if err := c.do(http.MethodGet, u, nil, &ads); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ad := range ads {
+		names = append(names, ad.Name)
+	}
+	return names, nil
+}
+
+// OCIInstanceConfig is the configuration of an instance to launch
+type OCIInstanceConfig struct {
+	Compartment        string
+	AvailabilityDomain string
+	Name               string
+	Shape              string
+	// OCPUs and MemoryGB are only used for flexible shapes
+	OCPUs    float64
+	MemoryGB float64
+	ImageID  string
+	SubnetID string
+	PublicIP bool
+	UserData []byte
+	// Tags are set as free-form tags of the instance and its VNIC
+	Tags Tags
+}
+
+// LaunchInstance launches an instance and waits for it to be running, it is
+// terminated if the run fails or is interrupted before keepResources is called
+func (c *OCIClient) LaunchInstance(config OCIInstanceConfig) (string, error) {
+	req := map[string]interface{}{
+		"compartmentId":      config.Compartment,
+		"availabilityDomain": config.AvailabilityDomain,
+		"displayName":        config.Name,
+		"shape":              config.Shape,
+		"freeformTags":       config.Tags.Map(),
+		"sourceDetails": map[string]string{
+			"sourceType": "image",
+			"imageId":    config.ImageID,
+		},
+		"createVnicDetails": map[string]interface{}{
+			"subnetId":       config.SubnetID,
+			"assignPublicIp": config.PublicIP,
+			"freeformTags":   config.Tags.Map(),
+		},
+	}
+	if strings.HasSuffix(config.Shape, ".Flex") {
+		req["shapeConfig"] = map[string]float64{
+			"ocpus":       config.OCPUs,
+			"memoryInGBs": config.MemoryGB,
+		}
+	}
+	if len(config.UserData) > 0 {
+		req["metadata"] = map[string]string{"user_data": base64.StdEncoding.EncodeToString(config.UserData)}
+	}
+	var instance struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(http.MethodPost, c.core("/instances"), req, &instance); err != nil {
+		return "", err
+	}
+	onCleanup("instance "+instance.ID, func() error { return c.TerminateInstance(instance.ID) })
+	if _, err := c.waitState(c.core("/instances/"+instance.ID), "RUNNING"); err != nil {
+		return instance.ID, err
+	}
+	return instance.ID, nil
+}
+
+// TerminateInstance terminates an instance and deletes its boot volume
+func (c *OCIClient) TerminateInstance(instanceID string) error {
+	return c.do(http.MethodDelete, c.core("/instances/"+instanceID+"?preserveBootVolume=false"), nil, nil)
+}
+
+// ConnectSerialConsole creates a console connection for the instance and
+// attaches stdin to the serial console and copies its output to out
+func (c *OCIClient) ConnectSerialConsole(instanceID string, out io.Writer) error {
+	// A key is generated for the connection, which is deleted afterwards
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	req := map[string]string{
+		"instanceId": instanceID,
+		"publicKey":  string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	}
+	var conn struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(http.MethodPost, c.core("/instanceConsoleConnections"), req, &conn); err != nil {
+		return err
+	}
+	deleteConnection := func() error {
+		return c.do(http.MethodDelete, c.core("/instanceConsoleConnections/"+conn.ID), nil, nil)
+	}
+	forgetConnection := onCleanup("console connection "+conn.ID, deleteConnection)
+	defer func() {
+		forgetConnection()
+		if err := deleteConnection(); err != nil {
+			log.Warnf("Cannot delete console connection: %v", err)
+		}
+	}()
+	r, err := c.waitState(c.core("/instanceConsoleConnections/"+conn.ID), "ACTIVE")
+	if err != nil {
+		return err
+	}
+	connection, _ := r["connectionString"].(string)
+	hostKeyFingerprint, _ := r["serviceHostKeyFingerprint"].(string)
+
+	// The connection string is an ssh command line of the form
+	// ssh -o ProxyCommand='ssh -W %h:%p -p 443 <connection>@<host>' <instance>
+	var proxyUser, proxyHost, target string
+	for _, f := range strings.Fields(strings.Replace(connection, "'", " ", -1)) {
+		if strings.Contains(f, "@") {
+			at := strings.Index(f, "@")
+			proxyUser, proxyHost = f[:at], f[at+1:]
+		}
+		target = f
+	}
+	if proxyHost == "" || target == "" {
+		return fmt.Errorf("Cannot parse console connection string %q", connection)
+	}
+
+	proxyConfig := &ssh.ClientConfig{
+		User: proxyUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if hostKeyFingerprint != "" && ssh.FingerprintLegacyMD5(key) != hostKeyFingerprint && ssh.FingerprintSHA256(key) != hostKeyFingerprint {
+				return fmt.Errorf("host key of %s does not match %s", hostname, hostKeyFingerprint)
+			}
+			return nil
+		},
+	}
+	log.Debugf("console: ssh %s@%s:443", proxyUser, proxyHost)
+	proxy, err := ssh.Dial("tcp", proxyHost+":443", proxyConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to dial: %v", err)
+	}
+	defer proxy.Close()
+	tunnel, err := proxy.Dial("tcp", target+":22")
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the console of %s: %v", target, err)
+	}
+	consoleConfig := &ssh.ClientConfig{
+		User: target,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// The console is reached through the verified proxy
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	cc, chans, reqs, err := ssh.NewClientConn(tunnel, target, consoleConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the console of %s: %v", target, err)
+	}
+	client := ssh.NewClient(cc, chans, reqs)
+	defer client.Close()
+
+	s, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("Failed to create session: %v", err)
+	}
+	defer s.Close()
+	s.Stdout = out
+	s.Stderr = os.Stderr
+	s.Stdin = os.Stdin
+
+	width, height, err := terminal.GetSize(0)
+	if err != nil {
+		log.Warningf("Error getting terminal size. Ignored. %v", err)
+		width = 80
+		height = 40
+	}
+	if err := s.RequestPty("vt100", height, width, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		return fmt.Errorf("Request for PTY failed: %v", err)
+	}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(0, oldState)
+	}
+	if err := s.Shell(); err != nil {
+		return fmt.Errorf("Failed to start shell: %v", err)
+	}
+	err = s.Wait()
+	if _, ok := err.(*ssh.ExitMissingError); ok || err == io.EOF {
+		return nil
+	}
+	return err
+}
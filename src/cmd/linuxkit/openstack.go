@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/utils/openstack/clientconfig"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	osCloudVar             = "OS_CLOUD"
+	osRegionVar            = "OS_REGION_NAME"
+	osAuthTypeVar          = "OS_AUTH_TYPE"
+	osAuthURLVar           = "OS_AUTH_URL"
+	osAppCredentialIDVar   = "OS_APPLICATION_CREDENTIAL_ID"
+	osAppCredentialNameVar = "OS_APPLICATION_CREDENTIAL_NAME"
+	osAppCredentialSecret  = "OS_APPLICATION_CREDENTIAL_SECRET"
+
+	osAppCredentialAuthType = "v3applicationcredential"
+)
+
+// openstackCloud is the part of a clouds.yaml entry used for application
+// credentials, which the vendored clientconfig does not know about
+type openstackCloud struct {
+	AuthType   string `yaml:"auth_type"`
+	RegionName string `yaml:"region_name"`
+	Auth       struct {
+		AuthURL                     string `yaml:"auth_url"`
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialName   string `yaml:"application_credential_name"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+		Username                    string `yaml:"username"`
+		UserID                      string `yaml:"user_id"`
+		UserDomainName              string `yaml:"user_domain_name"`
+		UserDomainID                string `yaml:"user_domain_id"`
+	} `yaml:"auth"`
+}
+
+// openstackCloudsYAML returns the clouds.yaml entry of a cloud, looking for
+// the file in the same places as the OpenStack client
+func openstackCloudsYAML(cloud string) (*openstackCloud, error) {
+	paths := []string{os.Getenv("OS_CLIENT_CONFIG_FILE"), "clouds.yaml"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	paths = append(paths, "/etc/openstack/clouds.yaml")
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var clouds struct {
+			Clouds map[string]openstackCloud `yaml:"clouds"`
+		}
+		if err := yaml.Unmarshal(b, &clouds); err != nil {
+			return nil, fmt.Errorf("Cannot parse %s: %v", p, err)
+		}
+		c, ok := clouds.Clouds[cloud]
+		if !ok {
+			return nil, fmt.Errorf("Cloud %s is not in %s", cloud, p)
+		}
+		return &c, nil
+	}
+	return nil, fmt.Errorf("No clouds.yaml found for cloud %s", cloud)
+}
+
+// openstackServiceClient returns a client for an OpenStack service. The
+// cloud is looked up in clouds.yaml and the OS_* environment variables are
+// used otherwise. Application credentials are used if they are set in
+// either, and password or token authentication otherwise.
+func openstackServiceClient(service, cloud, region string) (*gophercloud.ServiceClient, error) {
+	c := &openstackCloud{}
+	if cloud != "" {
+		var err error
+		if c, err = openstackCloudsYAML(cloud); err != nil {
+			return nil, err
+		}
+	} else {
+		c.AuthType = os.Getenv(osAuthTypeVar)
+		c.Auth.AuthURL = os.Getenv(osAuthURLVar)
+		c.Auth.ApplicationCredentialID = os.Getenv(osAppCredentialIDVar)
+		c.Auth.ApplicationCredentialName = os.Getenv(osAppCredentialNameVar)
+		c.Auth.ApplicationCredentialSecret = os.Getenv(osAppCredentialSecret)
+		c.Auth.Username = os.Getenv("OS_USERNAME")
+		c.Auth.UserID = os.Getenv("OS_USER_ID")
+		c.Auth.UserDomainName = os.Getenv("OS_USER_DOMAIN_NAME")
+		c.Auth.UserDomainID = os.Getenv("OS_USER_DOMAIN_ID")
+	}
+	if region == "" {
+		region = getStringValue(osRegionVar, "", c.RegionName)
+	}
+
+	if c.AuthType != osAppCredentialAuthType && c.Auth.ApplicationCredentialSecret == "" {
+		return clientconfig.NewServiceClient(service, &clientconfig.ClientOpts{Cloud: cloud, RegionName: region})
+	}
+
+	log.Debugf("Authenticating to OpenStack with application credential %s%s", c.Auth.ApplicationCredentialID, c.Auth.ApplicationCredentialName)
+	if c.Auth.ApplicationCredentialSecret == "" {
+		return nil, fmt.Errorf("An application credential secret must be set with %s or in clouds.yaml", osAppCredentialSecret)
+	}
+	ao := gophercloud.AuthOptions{
+		IdentityEndpoint:            c.Auth.AuthURL,
+		ApplicationCredentialID:     c.Auth.ApplicationCredentialID,
+		ApplicationCredentialName:   c.Auth.ApplicationCredentialName,
+		ApplicationCredentialSecret: c.Auth.ApplicationCredentialSecret,
+	}
+	// credentials given by name belong to a user, which has to be given too
+	if ao.ApplicationCredentialID == "" {
+		ao.Username = c.Auth.Username
+		ao.UserID = c.Auth.UserID
+		ao.DomainName = c.Auth.UserDomainName
+		ao.DomainID = c.Auth.UserDomainID
+	}
+	provider, err := openstack.AuthenticatedClient(ao)
+	if err != nil {
+		return nil, err
+	}
+	eo := gophercloud.EndpointOpts{Region: region}
+	switch service {
+	case "compute":
+		return openstack.NewComputeV2(provider, eo)
+	case "image":
+		return openstack.NewImageServiceV2(provider, eo)
+	}
+	return nil, fmt.Errorf("unable to create a service client for %s", service)
+}
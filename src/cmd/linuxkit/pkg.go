@@ -4,20 +4,25 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 )
 
-func pkgUsage() {
-	invoked := filepath.Base(os.Args[0])
-	fmt.Printf("USAGE: %s pkg [subcommand] [options] [prefix]\n\n", invoked)
-
-	fmt.Printf("'subcommand' is one of:\n")
-	fmt.Printf("  build\n")
-	fmt.Printf("  push\n")
-	fmt.Printf("  show-tag\n")
-	fmt.Printf("\n")
-	fmt.Printf("'options' are the command specific options.\n")
-	fmt.Printf("See '%s pkg [command] --help' for details.\n\n", invoked)
+// pkgCommand is 'linuxkit pkg'
+func pkgCommand() *command {
+	return &command{
+		name:  "pkg",
+		short: "Package building",
+		args:  "[subcommand] [options] [prefix]",
+		subcommands: []*command{
+			{name: "attach-signature", short: "Attach a signature made offline to a pushed image", run: pkgAttachSignature},
+			{name: "build", short: "Build a package", run: pkgBuild},
+			pkgManifestCommand(),
+			{name: "push", short: "Build and push a package", run: pkgPush},
+			{name: "show-tag", short: "Show the tag of a package", run: pkgShowTag},
+			{name: "sign", short: "Sign the manifests of pushed images", run: pkgSign},
+			pkgTrustCommand(),
+			{name: "verify", short: "Verify the signatures of the manifests of images", run: pkgVerify},
+		},
+	}
 }
 
 func setupContentTrustPassphrase() {
@@ -42,22 +47,3 @@ func setupContentTrustPassphrase() {
 	}
 	os.Setenv("DOCKER_CONTENT_TRUST_REPOSITORY_PASSPHRASE", string(v))
 }
-
-func pkg(args []string) {
-	if len(args) < 1 {
-		pkgUsage()
-		os.Exit(1)
-	}
-
-	switch args[0] {
-	case "build":
-		pkgBuild(args[1:])
-	case "push":
-		pkgPush(args[1:])
-	case "show-tag":
-		pkgShowTag(args[1:])
-	default:
-		fmt.Printf("Unknown subcommand %q\n\n", args[0])
-		pkgUsage()
-	}
-}
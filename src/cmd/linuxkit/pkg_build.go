@@ -1,16 +1,16 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	log "github.com/sirupsen/logrus"
 )
 
 func pkgBuild(args []string) {
-	flags := flag.NewFlagSet("pkg build", flag.ExitOnError)
+	flags := newFlagSet("pkg build")
 	flags.Usage = func() {
 		invoked := filepath.Base(os.Args[0])
 		fmt.Fprintf(os.Stderr, "USAGE: %s pkg build [options] path\n\n", invoked)
@@ -20,6 +20,7 @@ func pkgBuild(args []string) {
 	}
 
 	force := flags.Bool("force", false, "Force rebuild")
+	progress := flags.String("progress", pkglib.ProgressAuto, "Progress of the docker output, auto, tty, plain or quiet; plain prefixes its lines with the arch")
 
 	p, err := pkglib.NewFromCLI(flags, args...)
 	if err != nil {
@@ -27,9 +28,9 @@ func pkgBuild(args []string) {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Building %q\n", p.Tag())
+	log.Infof("Building %q", p.Tag())
 
-	opts := []pkglib.BuildOpt{pkglib.WithBuildImage()}
+	opts := []pkglib.BuildOpt{pkglib.WithBuildImage(), pkglib.WithBuildBuilders(Config.Builders), pkglib.WithBuildProgress(*progress)}
 	if *force {
 		opts = append(opts, pkglib.WithBuildForce())
 	}
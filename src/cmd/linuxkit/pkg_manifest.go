@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/estesp/manifest-tool/pkg/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// pkgManifestCommand is 'linuxkit pkg manifest'
+func pkgManifestCommand() *command {
+	return &command{
+		name:  "manifest",
+		short: "Manage the manifest lists of images which were already pushed",
+		args:  "command [options]",
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "annotate", short: "Set the platform of an image of a local manifest list", run: pkgManifestAnnotate},
+			{name: "create", short: "Create a local manifest list of images, or of a pushed manifest list", run: pkgManifestCreate},
+			{name: "inspect", short: "Show the images and platforms of a local or pushed manifest list", run: pkgManifestInspect},
+			{name: "push", short: "Push a local manifest list", run: pkgManifestPush},
+			{name: "rm", short: "Remove local manifest lists", run: pkgManifestRemove},
+		},
+	}
+}
+
+// manifestListDir is the directory of the local manifest lists, which are
+// the YAML input of manifest-tool
+func manifestListDir() string {
+	return filepath.Join(util.HomeDir(), ".linuxkit", "manifests")
+}
+
+// manifestListFile returns the file of the local manifest list list
+func manifestListFile(list string) (string, error) {
+	ref, err := name.ParseReference(list)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest list %s: %v", list, err)
+	}
+	file := strings.NewReplacer("/", "_", ":", "-", "@", "-").Replace(ref.Name())
+	return filepath.Join(manifestListDir(), file+".yml"), nil
+}
+
+func readManifestList(list string) (types.YAMLInput, error) {
+	var input types.YAMLInput
+	file, err := manifestListFile(list)
+	if err != nil {
+		return input, err
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return input, fmt.Errorf("there is no local manifest list %s, create it first", list)
+	}
+	if err != nil {
+		return input, err
+	}
+	if err := yaml.Unmarshal(b, &input); err != nil {
+		return input, fmt.Errorf("invalid local manifest list %s: %v", file, err)
+	}
+	return input, nil
+}
+
+func writeManifestList(input types.YAMLInput) error {
+	file, err := manifestListFile(input.Image)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(input)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// remoteManifestList returns the entries of a pushed manifest list, whose
+// images are the digests of its manifests
+func remoteManifestList(list string) ([]types.ManifestEntry, error) {
+	ref, err := name.ParseReference(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest list %s: %v", list, err)
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+	ii, err := desc.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a manifest list", list)
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var entries []types.ManifestEntry
+	for _, m := range index.Manifests {
+		entry := types.ManifestEntry{Image: ref.Context().Digest(m.Digest.String()).String()}
+		if m.Platform != nil {
+			entry.Platform = ocispec.Platform{
+				OS:           m.Platform.OS,
+				Architecture: m.Platform.Architecture,
+				Variant:      m.Platform.Variant,
+				OSVersion:    m.Platform.OSVersion,
+				OSFeatures:   m.Platform.OSFeatures,
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func platformString(p ocispec.Platform) string {
+	if p.OS == "" && p.Architecture == "" {
+		return "(from the image)"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+func pkgManifestCreate(args []string) {
+	flags := newFlagSet("create")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg manifest create [options] <list> [image...]\n\n", os.Args[0])
+		fmt.Printf("Create the local manifest list of the images, which must already be\n")
+		fmt.Printf("pushed to the registry of the list. Their platforms are those of the\n")
+		fmt.Printf("images unless they are set with 'annotate'. With -amend, the list starts\n")
+		fmt.Printf("with the images of the manifest list which was pushed, to repair or\n")
+		fmt.Printf("extend it.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	amend := flags.Bool("amend", false, "Start from the images of the pushed manifest list")
+	force := flags.Bool("force", false, "Replace the local manifest list if there is one")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() < 1 || flags.NArg() == 1 && !*amend {
+		fmt.Println("Please specify a manifest list and its images")
+		flags.Usage()
+		os.Exit(1)
+	}
+	list := flags.Arg(0)
+	if _, err := readManifestList(list); err == nil && !*force {
+		log.Fatalf("There is already a local manifest list %s, use -force to replace it", list)
+	}
+
+	input := types.YAMLInput{Image: list}
+	if *amend {
+		entries, err := remoteManifestList(list)
+		if err != nil {
+			log.Fatalf("Unable to get the manifest list %s: %v", list, err)
+		}
+		input.Manifests = entries
+	}
+	for _, image := range flags.Args()[1:] {
+		if _, err := name.ParseReference(image); err != nil {
+			log.Fatalf("Invalid image %s: %v", image, err)
+		}
+		input.Manifests = append(input.Manifests, types.ManifestEntry{Image: image})
+	}
+	if err := writeManifestList(input); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Created the manifest list %s of %d images", list, len(input.Manifests))
+}
+
+func pkgManifestAnnotate(args []string) {
+	flags := newFlagSet("annotate")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg manifest annotate [options] <list> <image>\n\n", os.Args[0])
+		fmt.Printf("Set the platform of an image of a local manifest list, e.g. the variant\n")
+		fmt.Printf("v7 of an arm image. The image is added to the list if it is not in it.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	goos := flags.String("os", "", "OS of the image, e.g. linux")
+	arch := flags.String("arch", "", "Architecture of the image, e.g. arm64")
+	variant := flags.String("variant", "", "Variant of the architecture, e.g. v8")
+	osVersion := flags.String("os-version", "", "Version of the OS")
+	osFeatures := flags.String("os-features", "", "Comma separated features of the OS")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 2 {
+		fmt.Println("Please specify a manifest list and an image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	list, image := flags.Arg(0), flags.Arg(1)
+	input, err := readManifestList(list)
+	if err != nil {
+		log.Fatal(err)
+	}
+	i := 0
+	for ; i < len(input.Manifests) && input.Manifests[i].Image != image; i++ {
+	}
+	if i == len(input.Manifests) {
+		if _, err := name.ParseReference(image); err != nil {
+			log.Fatalf("Invalid image %s: %v", image, err)
+		}
+		input.Manifests = append(input.Manifests, types.ManifestEntry{Image: image})
+	}
+	p := &input.Manifests[i].Platform
+	if *goos != "" {
+		p.OS = *goos
+	}
+	if *arch != "" {
+		p.Architecture = *arch
+	}
+	if *variant != "" {
+		p.Variant = *variant
+	}
+	if *osVersion != "" {
+		p.OSVersion = *osVersion
+	}
+	if *osFeatures != "" {
+		p.OSFeatures = strings.Split(*osFeatures, ",")
+	}
+	if (p.OS == "") != (p.Architecture == "") {
+		log.Fatal("The platform of an image needs both an OS and an architecture")
+	}
+	if err := writeManifestList(input); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("The platform of %s in %s is %s", image, list, platformString(*p))
+}
+
+func pkgManifestInspect(args []string) {
+	flags := newFlagSet("inspect")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg manifest inspect [options] <list>\n\n", os.Args[0])
+		fmt.Printf("Show the images and platforms of the local manifest list, or of the\n")
+		fmt.Printf("manifest list which was pushed if there is no local one.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	pushed := flags.Bool("remote", false, "Show the manifest list which was pushed, even if there is a local one")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Please specify a manifest list")
+		flags.Usage()
+		os.Exit(1)
+	}
+	list := flags.Arg(0)
+	var entries []types.ManifestEntry
+	input, err := readManifestList(list)
+	if err == nil && !*pushed {
+		entries = input.Manifests
+	} else {
+		if entries, err = remoteManifestList(list); err != nil {
+			log.Fatalf("Unable to get the manifest list %s: %v", list, err)
+		}
+	}
+	for _, e := range entries {
+		fmt.Printf("%-20s %s\n", platformString(e.Platform), e.Image)
+	}
+}
+
+func pkgManifestPush(args []string) {
+	flags := newFlagSet("push")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg manifest push [options] <list>\n\n", os.Args[0])
+		fmt.Printf("Push the local manifest list, or a manifest-tool YAML file with -f,\n")
+		fmt.Printf("replacing the tag of the list in the registry.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	file := flags.String("f", "", "Push the manifest-tool YAML `file` instead of a local manifest list")
+	sign := flags.Bool("sign", false, "Sign the manifest list with Docker content trust")
+	purge := flags.Bool("purge", false, "Remove the local manifest list once it is pushed")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	var input types.YAMLInput
+	switch {
+	case *file != "" && flags.NArg() == 0:
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := yaml.Unmarshal(b, &input); err != nil {
+			log.Fatalf("Invalid manifest list %s: %v", *file, err)
+		}
+	case *file == "" && flags.NArg() == 1:
+		var err error
+		if input, err = readManifestList(flags.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Println("Please specify a manifest list or a file")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if len(input.Manifests) == 0 {
+		log.Fatalf("The manifest list %s has no images", input.Image)
+	}
+	if *sign {
+		setupContentTrustPassphrase()
+	}
+
+	log.Infof("Pushing the manifest list %s of %d images", input.Image, len(input.Manifests))
+	digest, err := pkglib.PushManifestList(input.Image, input.Manifests, *sign)
+	if err != nil {
+		log.Fatalf("Unable to push the manifest list %s: %v", input.Image, err)
+	}
+	fmt.Printf("%s@%s\n", input.Image, digest)
+	if *purge && *file == "" {
+		if f, err := manifestListFile(input.Image); err == nil {
+			os.Remove(f)
+		}
+	}
+}
+
+func pkgManifestRemove(args []string) {
+	flags := newFlagSet("rm")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg manifest rm <list>...\n\n", os.Args[0])
+		fmt.Printf("Remove local manifest lists, leaving those which were pushed.\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify a manifest list")
+		flags.Usage()
+		os.Exit(1)
+	}
+	for _, list := range flags.Args() {
+		file, err := manifestListFile(list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Remove(file); err != nil {
+			if os.IsNotExist(err) {
+				log.Fatalf("There is no local manifest list %s", list)
+			}
+			log.Fatal(err)
+		}
+	}
+}
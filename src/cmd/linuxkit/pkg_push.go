@@ -1,16 +1,16 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	log "github.com/sirupsen/logrus"
 )
 
 func pkgPush(args []string) {
-	flags := flag.NewFlagSet("pkg push", flag.ExitOnError)
+	flags := newFlagSet("pkg push")
 	flags.Usage = func() {
 		invoked := filepath.Base(os.Args[0])
 		fmt.Fprintf(os.Stderr, "USAGE: %s pkg push [options] path\n\n", invoked)
@@ -20,11 +20,15 @@ func pkgPush(args []string) {
 	}
 
 	force := flags.Bool("force", false, "Force rebuild")
+	progress := flags.String("progress", pkglib.ProgressAuto, "Progress of the docker output, auto, tty, plain or quiet; plain prefixes its lines with the arch")
 	release := flags.String("release", "", "Release the given version")
 	nobuild := flags.Bool("nobuild", false, "Skip the build")
 	manifest := flags.Bool("manifest", true, "Create and push multi-arch manifest")
 	image := flags.Bool("image", true, "Build and push image for the current platform")
 	sign := flags.Bool("sign", true, "sign the manifest, if a manifest is created; ignored if --manifest=false")
+	signMethod := flags.String("sign-method", pkgSignMethod(), "Sign the manifest with notary, or with a referrer by cosign or notation")
+	signKey := flags.String("sign-key", Config.Pkg.SignKey, "cosign private key or KMS URI, or notation key, of -sign-method; default is keyless cosign or the default notation key")
+	signingPayload := flags.String("export-signing-payload", "", "Write the cosign signing payload of the manifest to this file instead of signing it, to sign it offline and attach the signature with 'pkg attach-signature'")
 
 	p, err := pkglib.NewFromCLI(flags, args...)
 	if err != nil {
@@ -32,12 +36,19 @@ func pkgPush(args []string) {
 		os.Exit(1)
 	}
 
-	if p.TrustEnabled() {
+	if *signingPayload != "" {
+		if !*manifest {
+			log.Fatal("The -export-signing-payload option requires -manifest")
+		}
+		// the manifest is signed offline
+		*sign = false
+	}
+	if p.TrustEnabled() && *sign && *signMethod == "notary" {
 		setupContentTrustPassphrase()
 	}
 
 	var opts []pkglib.BuildOpt
-	opts = append(opts, pkglib.WithBuildPush())
+	opts = append(opts, pkglib.WithBuildPush(), pkglib.WithBuildBuilders(Config.Builders), pkglib.WithBuildProgress(*progress))
 	if *force {
 		opts = append(opts, pkglib.WithBuildForce())
 	}
@@ -54,14 +65,22 @@ func pkgPush(args []string) {
 		opts = append(opts, pkglib.WithBuildImage())
 	}
 	// only sign manifests; ignore for image only
+	if *signingPayload != "" {
+		opts = append(opts, pkglib.WithBuildSigningPayload(*signingPayload))
+	}
 	if *sign && *manifest {
-		opts = append(opts, pkglib.WithBuildSign())
+		checkPkgSignMethod(*signMethod)
+		if *signMethod == "notary" {
+			opts = append(opts, pkglib.WithBuildSign())
+		} else {
+			opts = append(opts, pkglib.WithBuildImageSigner(pkglib.ImageSigner{Method: *signMethod, Key: *signKey}))
+		}
 	}
 
 	if *nobuild {
-		fmt.Printf("Pushing %q without building\n", p.Tag())
+		log.Infof("Pushing %q without building", p.Tag())
 	} else {
-		fmt.Printf("Building and pushing %q\n", p.Tag())
+		log.Infof("Building and pushing %q", p.Tag())
 	}
 
 	if err := p.Build(opts...); err != nil {
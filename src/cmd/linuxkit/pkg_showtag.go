@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,7 +9,7 @@ import (
 )
 
 func pkgShowTag(args []string) {
-	flags := flag.NewFlagSet("pkg show-tag", flag.ExitOnError)
+	flags := newFlagSet("pkg show-tag")
 	flags.Usage = func() {
 		invoked := filepath.Base(os.Args[0])
 		fmt.Fprintf(os.Stderr, "USAGE: %s pkg show-tag [options] path\n\n", invoked)
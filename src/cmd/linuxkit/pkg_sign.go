@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	log "github.com/sirupsen/logrus"
+)
+
+// pkgSignMethod returns the signing method of packages of the config, or
+// notary
+func pkgSignMethod() string {
+	if Config.Pkg.SignMethod != "" {
+		return Config.Pkg.SignMethod
+	}
+	return "notary"
+}
+
+// checkPkgSignMethod exits if method is not a signing method of packages
+func checkPkgSignMethod(method string) {
+	switch method {
+	case "notary", "cosign", "notation":
+	default:
+		log.Fatalf("Unknown signing method %s, must be notary, cosign or notation", method)
+	}
+}
+
+func pkgSign(args []string) {
+	flags := newFlagSet("pkg sign")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg sign [options] <image>...\n\n", os.Args[0])
+		fmt.Printf("Sign the manifests or indexes of images which were pushed, with notary, or\n")
+		fmt.Printf("with a signature which is attached to them with the OCI referrers API by\n")
+		fmt.Printf("cosign or notation, for registries which have no notary.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	method := flags.String("method", pkgSignMethod(), "Signing method, notary, cosign or notation")
+	key := flags.String("key", Config.Pkg.SignKey, "cosign private key or KMS URI, or notation key; default is keyless cosign or the default notation key")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify an image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	checkPkgSignMethod(*method)
+
+	if *method == "notary" {
+		setupContentTrustPassphrase()
+		for _, img := range flags.Args() {
+			log.Infof("Signing %s", img)
+			if err := pkglib.ResignTag(img); err != nil {
+				log.Fatalf("Unable to sign %s: %v", img, err)
+			}
+		}
+		return
+	}
+	s := pkglib.ImageSigner{Method: *method, Key: *key}
+	if err := s.Check(); err != nil {
+		log.Fatal(err)
+	}
+	for _, img := range flags.Args() {
+		log.Infof("Signing %s", img)
+		ref, err := s.Sign(img)
+		if err != nil {
+			log.Fatalf("Unable to sign %s: %v", img, err)
+		}
+		fmt.Println(ref)
+	}
+}
+
+func pkgVerify(args []string) {
+	flags := newFlagSet("pkg verify")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg verify [options] <image>...\n\n", os.Args[0])
+		fmt.Printf("Verify the signatures of the manifests or indexes of images, in notary, or\n")
+		fmt.Printf("attached to them with the OCI referrers API by cosign or notation. notation\n")
+		fmt.Printf("verifies with its trust policy.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	method := flags.String("method", pkgSignMethod(), "Signing method, notary, cosign or notation")
+	key := flags.String("key", Config.Pkg.VerifyKey, "cosign public key or KMS URI; default is keyless cosign")
+	identity := flags.String("certificate-identity", "", "Identity of keyless cosign signatures")
+	issuer := flags.String("certificate-oidc-issuer", "", "OIDC issuer of keyless cosign signatures")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify an image")
+		flags.Usage()
+		os.Exit(1)
+	}
+	checkPkgSignMethod(*method)
+
+	verify := func(img string) (string, error) {
+		signed, err := moby.TrustedReference(moby.ReferenceExpand(img))
+		if err != nil {
+			return "", err
+		}
+		if _, ok := signed.(reference.Canonical); !ok {
+			return "", fmt.Errorf("no signed digest")
+		}
+		return signed.String(), nil
+	}
+	if *method != "notary" {
+		s := pkglib.ImageSigner{Method: *method, Key: *key, Identity: *identity, Issuer: *issuer}
+		if err := s.CheckVerify(); err != nil {
+			log.Fatal(err)
+		}
+		verify = s.Verify
+	}
+
+	failed := false
+	for _, img := range flags.Args() {
+		ref, err := verify(img)
+		if err != nil {
+			failed = true
+			fmt.Printf("FAILED  %s: %v\n", img, err)
+			continue
+		}
+		fmt.Printf("OK      %s\n", ref)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func pkgAttachSignature(args []string) {
+	flags := newFlagSet("pkg attach-signature")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg attach-signature [options] <payload> <signature>\n\n", os.Args[0])
+		fmt.Printf("Attach a signature which was made offline to the image its payload is of,\n")
+		fmt.Printf("with cosign. 'payload' is written by 'pkg push -export-signing-payload' and\n")
+		fmt.Printf("'signature' is its base64 encoded signature, e.g. by 'cosign sign-blob'.\n")
+		fmt.Printf("The image is printed by digest.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	certificate := flags.String("certificate", "", "PEM encoded certificate of the signing key, optional")
+	chain := flags.String("certificate-chain", "", "PEM encoded chain of -certificate, optional")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() != 2 {
+		fmt.Println("Please specify the payload and the signature")
+		flags.Usage()
+		os.Exit(1)
+	}
+	s := pkglib.OfflineSignature{Payload: flags.Arg(0), Signature: flags.Arg(1), Certificate: *certificate, Chain: *chain}
+	ref, err := s.Attach()
+	if err != nil {
+		log.Fatalf("Unable to attach the signature: %v", err)
+	}
+	fmt.Println(ref)
+}
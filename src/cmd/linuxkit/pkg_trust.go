@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	log "github.com/sirupsen/logrus"
+)
+
+// pkgTrustCommand is 'linuxkit pkg trust'
+func pkgTrustCommand() *command {
+	return &command{
+		name:  "trust",
+		short: "Manage the delegation keys packages are signed with",
+		args:  "command [options]",
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "generate", short: "Generate a delegation key, and add it to repositories", run: pkgTrustGenerate},
+			{name: "ls", short: "List the delegation keys of repositories, or the local keys", run: pkgTrustList},
+			{name: "resign", short: "Sign tags again with the local delegation key", run: pkgTrustResign},
+			{name: "rotate", short: "Replace the delegation keys of repositories, signing their tags again", run: pkgTrustRotate},
+		},
+	}
+}
+
+func pkgTrustGenerate(args []string) {
+	flags := newFlagSet("generate")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg trust generate [options] [repo]...\n\n", os.Args[0])
+		fmt.Printf("Generate a delegation key and its certificate, as <name>.key and <name>.crt,\n")
+		fmt.Printf("import the key to sign with it, encrypted with the content trust passphrase,\n")
+		fmt.Printf("and add it to the targets/releases role of the repositories.\n")
+		flags.PrintDefaults()
+	}
+	keyName := flags.String("name", "releases", "Name of the key")
+	dir := flags.String("dir", ".", "Directory to write the key and certificate to")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	setupContentTrustPassphrase()
+
+	cert, err := pkglib.GenerateDelegationKey(*keyName, *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(cert)
+	for _, repo := range flags.Args() {
+		log.Infof("Adding the key %s to %s", cert, repo)
+		if err := pkglib.AddDelegationKey(repo, cert); err != nil {
+			log.Fatalf("Unable to add the key to %s: %v", repo, err)
+		}
+	}
+}
+
+func pkgTrustList(args []string) {
+	flags := newFlagSet("ls")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg trust ls [repo]...\n\n", os.Args[0])
+		fmt.Printf("List the delegation roles of the repositories and the IDs of their keys,\n")
+		fmt.Printf("or the keys which are imported if there are no repositories.\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if err := pkglib.ListDelegations(flags.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func pkgTrustResign(args []string) {
+	flags := newFlagSet("resign")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg trust resign <repo:tag>...\n\n", os.Args[0])
+		fmt.Printf("Sign the manifests or indexes the tags point to in the registry again,\n")
+		fmt.Printf("in the targets/releases role.\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify a tag")
+		flags.Usage()
+		os.Exit(1)
+	}
+	setupContentTrustPassphrase()
+
+	for _, img := range flags.Args() {
+		log.Infof("Signing %s", img)
+		if err := pkglib.ResignTag(img); err != nil {
+			log.Fatalf("Unable to sign %s: %v", img, err)
+		}
+	}
+}
+
+func pkgTrustRotate(args []string) {
+	flags := newFlagSet("rotate")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s pkg trust rotate [options] <repo>...\n\n", os.Args[0])
+		fmt.Printf("Add a new delegation key to the targets/releases role of the repositories,\n")
+		fmt.Printf("remove the old keys from it, and sign the role, and so all of its tags,\n")
+		fmt.Printf("again with the new key. The new key is either generated, or the imported\n")
+		fmt.Printf("key of a certificate. The IDs of the old keys are shown by 'pkg trust ls'.\n")
+		flags.PrintDefaults()
+	}
+	cert := flags.String("key", "", "Certificate of an imported key to rotate to")
+	generate := flags.String("generate", "", "Generate a key with the name to rotate to")
+	dir := flags.String("dir", ".", "Directory to write a generated key and certificate to")
+	var remove multipleFlag
+	flags.Var(&remove, "remove", "ID of an old key to remove, may be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify a repository")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if (*cert == "") == (*generate == "") {
+		fmt.Println("Please specify either a key or a key to generate")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if len(remove) == 0 {
+		log.Warnf("No old keys are removed, so they can still sign the tags")
+	}
+	setupContentTrustPassphrase()
+
+	if *generate != "" {
+		var err error
+		if *cert, err = pkglib.GenerateDelegationKey(*generate, *dir); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(*cert)
+	}
+	for _, repo := range flags.Args() {
+		rotateDelegationKey(repo, *cert, remove)
+	}
+}
+
+// rotateDelegationKey adds the key of the certificate to the repository,
+// removes the old keys, and signs the role with the new key; the new key
+// is added first so the tags are signed by a key at every step
+func rotateDelegationKey(repo, cert string, remove []string) {
+	log.Infof("Adding the key %s to %s", cert, repo)
+	if err := pkglib.AddDelegationKey(repo, cert); err != nil {
+		log.Fatalf("Unable to add the key to %s: %v", repo, err)
+	}
+	if len(remove) > 0 {
+		log.Infof("Removing the keys %v from %s", remove, repo)
+		if err := pkglib.RemoveDelegationKeys(repo, remove); err != nil {
+			log.Fatalf("Unable to remove the keys from %s: %v", repo, err)
+		}
+	}
+	log.Infof("Signing the tags of %s with the new key", repo)
+	if err := pkglib.ResignDelegation(repo); err != nil {
+		log.Fatalf("Unable to sign the tags of %s: %v", repo, err)
+	}
+}
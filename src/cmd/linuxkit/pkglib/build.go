@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
 	log "github.com/sirupsen/logrus"
 )
@@ -21,6 +26,13 @@ type buildOpts struct {
 	manifest  bool
 	sign      bool
 	image     bool
+	builders  map[string]string
+	// imageSigner signs the index with a referrer, instead of notary
+	imageSigner *ImageSigner
+	// signingPayload is where the signing payload of the index is written
+	// to be signed offline, instead of signing it
+	signingPayload string
+	progress       string
 }
 
 // BuildOpt allows callers to specify options to Build
@@ -50,6 +62,21 @@ func WithBuildPush() BuildOpt {
 	}
 }
 
+// WithBuildBuilders builds on the Docker host or with the buildx builder of
+// the arch in builders, if there is one and $DOCKER_HOST is not set
+func WithBuildBuilders(builders map[string]string) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.builders = builders
+		return nil
+	}
+}
+
+// IsDockerHost reports whether a builder is a Docker host, such as
+// ssh://builder-arm64, rather than the name of a buildx builder
+func IsDockerHost(builder string) bool {
+	return strings.Contains(builder, "://")
+}
+
 // WithBuildImage builds the image
 func WithBuildImage() BuildOpt {
 	return func(bo *buildOpts) error {
@@ -74,6 +101,24 @@ func WithBuildSign() BuildOpt {
 	}
 }
 
+// WithBuildImageSigner signs the index with a signature which refers to
+// it, with cosign or notation, once it is pushed
+func WithBuildImageSigner(s ImageSigner) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.imageSigner = &s
+		return nil
+	}
+}
+
+// WithBuildSigningPayload writes the signing payload of the index to path
+// once it is pushed, to sign it offline, instead of signing it
+func WithBuildSigningPayload(path string) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.signingPayload = path
+		return nil
+	}
+}
+
 // WithRelease releases as the given version after push
 func WithRelease(r string) BuildOpt {
 	return func(bo *buildOpts) error {
@@ -83,7 +128,13 @@ func WithRelease(r string) BuildOpt {
 }
 
 // Build builds the package
-func (p Pkg) Build(bos ...BuildOpt) error {
+func (p Pkg) Build(bos ...BuildOpt) (err error) {
+	span := trace.Start("pkg build", "pkg", p.Tag())
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	var bo buildOpts
 	for _, fn := range bos {
 		if err := fn(&bo); err != nil {
@@ -94,14 +145,20 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	if _, ok := os.LookupEnv("DOCKER_CONTENT_TRUST_REPOSITORY_PASSPHRASE"); !ok && bo.sign && p.trust && bo.push {
 		return fmt.Errorf("Pushing with trust enabled requires $DOCKER_CONTENT_TRUST_REPOSITORY_PASSPHRASE to be set")
 	}
+	if bo.imageSigner != nil && bo.push && bo.manifest {
+		if err := bo.imageSigner.Check(); err != nil {
+			return err
+		}
+	}
 
 	arch := runtime.GOARCH
 	if value, ok := os.LookupEnv("ZARCH"); ok {
 		arch = value
 	}
 
+	span.SetAttribute("arch", arch)
 	if !p.archSupported(arch) {
-		fmt.Printf("Arch %s not supported by this package, skipping build.\n", arch)
+		log.Infof("Arch %s not supported by this package, skipping build.", arch)
 		return nil
 	}
 	if err := p.cleanForBuild(); err != nil {
@@ -129,22 +186,38 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	}
 
 	d := newDockerRunner(p.trust, p.cache, bo.sign)
+	d.progress, d.prefix = bo.progress, "["+arch+"] "
+	if _, ok := os.LookupEnv("DOCKER_HOST"); !ok && bo.builders[arch] != "" {
+		if IsDockerHost(bo.builders[arch]) {
+			d.host = bo.builders[arch]
+			log.Debugf("Building on %s", d.host)
+		} else {
+			d.builder = bo.builders[arch]
+			log.Debugf("Building with the buildx builder %s", d.builder)
+		}
+	}
+	// the Docker host or builder may not be of the arch, or build for
+	// another arch by default, so the platform is given explicitly
+	if arch != runtime.GOARCH || d.host != "" || d.builder != "" {
+		d.platform = "linux/" + arch
+	}
 
 	if !bo.force {
 		tag := p.Tag()
-		fmt.Println("ZARCH: ", os.LookupEnv("ZARCH"))
 		if value, ok := os.LookupEnv("ZARCH"); ok {
 			tag = tag + "-" + value
-			fmt.Println("tag: ", tag)
 		}
+		pull := trace.Start("pull", "image", tag)
 		ok, err := d.pull(tag)
+		pull.SetError(err)
+		pull.End()
 		if err != nil {
 			return err
 		}
 		if ok {
 			return nil
 		}
-		fmt.Println("No image pulled, continuing with build")
+		log.Info("No image pulled, continuing with build")
 	}
 
 	if bo.image && !bo.skipBuild {
@@ -181,9 +254,35 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		args = append(args, "--label=org.mobyproject.linuxkit.version="+version.Version)
 		args = append(args, "--label=org.mobyproject.linuxkit.revision="+version.GitCommit)
 
-		d.ctx = &buildCtx{sources: p.sources}
+		ctx := &buildCtx{sources: p.sources}
+		if p.kernelModule != nil {
+			if ctx.dockerfile, err = p.kernelModule.dockerfile(arch); err != nil {
+				return err
+			}
+			log.Infof("Building the kernel modules against %s", p.kernelModule.kernel(arch))
+		}
+
+		// buildx builders pull through the mirrors of their buildkitd config
+		if d.builder == "" {
+			dockerfile := ctx.dockerfile
+			if dockerfile == nil {
+				dockerfile, err = ioutil.ReadFile(filepath.Join(p.path, "Dockerfile"))
+			}
+			if err == nil {
+				d.pullBaseImages(dockerfile)
+			}
+		}
+
+		d.ctx = ctx
 
-		if err := d.build(p.Tag()+suffix, p.path, args...); err != nil {
+		build := trace.Start("docker build", "image", p.Tag()+suffix)
+		err := d.build(p.Tag()+suffix, p.path, args...)
+		build.SetError(err)
+		build.End()
+		if err != nil {
+			return err
+		}
+		if err := d.checkArch(p.Tag()+suffix, arch); err != nil {
 			return err
 		}
 
@@ -191,8 +290,14 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 			if err := d.tag(p.Tag()+suffix, p.Tag()); err != nil {
 				return err
 			}
+			// images built on another Docker host are not in docker here
+			if d.host == "" {
+				if err := d.recordBuilt(p.Tag(), arch); err != nil {
+					log.Warnf("Unable to record %s as built, builds will not prefer it to the registry: %v", p.Tag(), err)
+				}
+			}
 
-			fmt.Printf("Build complete, not pushing, all done.\n")
+			log.Info("Build complete, not pushing, all done.")
 			return nil
 		}
 	}
@@ -207,12 +312,27 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	// matters given we do either pull or build above in the
 	// !force case.
 
-	if err := d.pushWithManifest(p.Tag(), suffix, bo.image, bo.manifest, bo.sign); err != nil {
+	if bo.skipBuild && bo.image {
+		if err := d.checkArch(p.Tag()+suffix, arch); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	push := trace.Start("upload", "image", p.Tag())
+	err = d.pushWithManifest(p.Tag(), suffix, bo.image, bo.manifest, bo.sign)
+	push.SetError(err)
+	push.End()
+	metrics.Upload("registry", start, err)
+	if err != nil {
+		return err
+	}
+	if err := bo.signIndex(p.Tag()); err != nil {
 		return err
 	}
 
 	if bo.release == "" {
-		fmt.Printf("Build and push complete, not releasing, all done.\n")
+		log.Info("Build and push complete, not releasing, all done.")
 		return nil
 	}
 
@@ -225,17 +345,52 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		return err
 	}
 
-	if err := d.pushWithManifest(relTag, suffix, bo.image, bo.manifest, bo.sign); err != nil {
+	start = time.Now()
+	push = trace.Start("upload", "image", relTag)
+	err = d.pushWithManifest(relTag, suffix, bo.image, bo.manifest, bo.sign)
+	push.SetError(err)
+	push.End()
+	metrics.Upload("registry", start, err)
+	if err != nil {
+		return err
+	}
+	if err := bo.signIndex(relTag); err != nil {
 		return err
 	}
 
-	fmt.Printf("Build, push and release of %q complete, all done.\n", bo.release)
+	log.Infof("Build, push and release of %q complete, all done.", bo.release)
+
+	return nil
+}
 
+// signIndex signs the index img which was pushed with the image signer, if
+// there are both, or writes its signing payload
+func (bo buildOpts) signIndex(img string) error {
+	if bo.signingPayload != "" && bo.manifest {
+		ref, err := WriteSigningPayload(img, bo.signingPayload)
+		if err != nil {
+			return fmt.Errorf("unable to write the signing payload of %s: %v", img, err)
+		}
+		log.Infof("Wrote the signing payload of %s to %s", ref, bo.signingPayload)
+		return nil
+	}
+	if bo.imageSigner == nil || !bo.manifest {
+		return nil
+	}
+	log.Infof("Signing %s with %s", img, bo.imageSigner.Method)
+	ref, err := bo.imageSigner.Sign(img)
+	if err != nil {
+		return fmt.Errorf("unable to sign %s: %v", img, err)
+	}
+	log.Infof("Signed %s", ref)
 	return nil
 }
 
 type buildCtx struct {
 	sources []pkgSource
+	// dockerfile is the Dockerfile of the build context, if it is not one
+	// of the sources
+	dockerfile []byte
 }
 
 // Copy iterates over the sources, tars up the content after rewriting the paths.
@@ -248,6 +403,16 @@ func (c *buildCtx) Copy(w io.WriteCloser) error {
 		w.Close()
 	}()
 
+	if c.dockerfile != nil {
+		h := &tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(c.dockerfile)), ModTime: time.Now()}
+		if err := tw.WriteHeader(h); err != nil {
+			return fmt.Errorf("ctx: Writing header for the Dockerfile: %v", err)
+		}
+		if _, err := tw.Write(c.dockerfile); err != nil {
+			return fmt.Errorf("ctx: Writing the Dockerfile: %v", err)
+		}
+	}
+
 	for _, s := range c.sources {
 		log.Debugf("Adding to build context: %s -> %s", s.src, s.dst)
 
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/containerd/containerd/reference"
+	log "github.com/sirupsen/logrus"
 )
 
 type dockerDepends struct {
@@ -116,7 +117,7 @@ func (dd dockerDepends) Do(d dockerRunner) error {
 		if dd.dir {
 			bn := filepath.Base(s.Locator) + "@" + s.Digest().String()
 			path := filepath.Join(dd.path, bn+".tar")
-			fmt.Printf("Adding %q as dependency\n", bn)
+			log.Infof("Adding %q as dependency", bn)
 			if err := d.save(path, s.String()); err != nil {
 				return err
 			}
@@ -5,13 +5,14 @@ package pkglib
 //go:generate ./gen
 
 import (
-	"encoding/base64"
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
 	"strconv"
 	"strings"
 
@@ -19,6 +20,8 @@ import (
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/estesp/manifest-tool/pkg/registry"
 	"github.com/estesp/manifest-tool/pkg/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
@@ -41,6 +44,18 @@ type dockerRunner struct {
 	dct   bool
 	cache bool
 	sign  bool
+	// host is the Docker host to use, or empty for the default
+	host string
+	// builder is the buildx builder images are built with, and loaded
+	// from into the Docker host, or empty to build with `docker build`
+	builder string
+	// progress is the progress mode of the output, and prefix the prefix
+	// of its lines
+	progress string
+	prefix   string
+	// platform is the platform images are built and pulled for, if it
+	// may not be the one of the Docker host
+	platform string
 
 	// Optional build context to use
 	ctx buildContext
@@ -55,6 +70,15 @@ func newDockerRunner(dct, cache, sign bool) dockerRunner {
 	return dockerRunner{dct: dct, cache: cache, sign: sign}
 }
 
+// commandOutput returns where the output of the commands which are run is
+// written, which is discarded if the log is quiet
+func commandOutput() io.Writer {
+	if !log.IsLevelEnabled(log.InfoLevel) {
+		return ioutil.Discard
+	}
+	return os.Stdout
+}
+
 func isExecErrNotFound(err error) bool {
 	eerr, ok := err.(*exec.Error)
 	if !ok {
@@ -82,9 +106,14 @@ const buildArgsEnv = "LK_BUILD_ARGS"
 
 func (dr dockerRunner) command(args ...string) error {
 	cmd := exec.Command("docker", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	stdout, stderr, flush := dr.output()
+	defer flush()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	cmd.Env = os.Environ()
+	if dr.host != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_HOST="+dr.host)
+	}
 
 	dct := ""
 
@@ -97,7 +126,16 @@ func (dr dockerRunner) command(args ...string) error {
 
 	var eg errgroup.Group
 
-	if args[0] == "build" {
+	// the arguments of a build are inserted after `docker build` or
+	// `docker buildx build`
+	build := 0
+	switch {
+	case args[0] == "build":
+		build = 2
+	case len(args) >= 2 && args[0] == "buildx" && args[1] == "build":
+		build = 3
+	}
+	if build > 0 {
 		buildArgs := []string{}
 		for _, proxyVarName := range proxyEnvVars {
 			if value, ok := os.LookupEnv(proxyVarName); ok {
@@ -116,9 +154,9 @@ func (dr dockerRunner) command(args ...string) error {
 		}
 		// cannot use usual append(append( because it overwrites part of it
 		newArgs := make([]string, len(cmd.Args)+len(buildArgs))
-		copy(newArgs[:2], cmd.Args[:2])
-		copy(newArgs[2:], buildArgs)
-		copy(newArgs[2+len(buildArgs):], cmd.Args[2:])
+		copy(newArgs[:build], cmd.Args[:build])
+		copy(newArgs[build:], buildArgs)
+		copy(newArgs[build+len(buildArgs):], cmd.Args[build:])
 		cmd.Args = newArgs
 
 		if dr.ctx != nil {
@@ -147,7 +185,10 @@ func (dr dockerRunner) command(args ...string) error {
 }
 
 func (dr dockerRunner) pull(img string) (bool, error) {
-	err := dr.command("image", "pull", img)
+	if dr.pullMirror(img) {
+		return true, nil
+	}
+	err := dr.command(dr.pullArgs(img)...)
 	if err == nil {
 		return true, nil
 	}
@@ -159,6 +200,74 @@ func (dr dockerRunner) pull(img string) (bool, error) {
 	}
 }
 
+// pullMirror pulls img from the first of the mirrors of its registry which
+// has it, and tags it as img. Mirrors are not used with content trust, as
+// the signatures are those of the repositories of the registry.
+func (dr dockerRunner) pullMirror(img string) bool {
+	if dr.dct {
+		return false
+	}
+	for _, m := range cache.MirrorReferences(img) {
+		if err := dr.command(dr.pullArgs(m)...); err != nil {
+			log.Debugf("Unable to pull %s from the mirror %s: %v", img, m, err)
+			continue
+		}
+		if err := dr.command("image", "tag", m, img); err != nil {
+			log.Debugf("Unable to tag %s as %s: %v", m, img, err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// pullArgs returns the arguments of docker to pull img for the platform
+func (dr dockerRunner) pullArgs(img string) []string {
+	if dr.platform != "" {
+		return []string{"image", "pull", "--platform", dr.platform, img}
+	}
+	return []string{"image", "pull", img}
+}
+
+// pullBaseImages pulls the images the Dockerfile is built from through the
+// mirrors of their registries, so that `docker build` finds them. The images
+// which no mirror has are left to `docker build` to pull.
+func (dr dockerRunner) pullBaseImages(dockerfile []byte) {
+	for _, img := range dockerfileBaseImages(dockerfile) {
+		dr.pullMirror(img)
+	}
+}
+
+// dockerfileBaseImages returns the images of the FROM instructions of a
+// Dockerfile, except scratch, the stages of the Dockerfile and the images
+// named by build arguments
+func dockerfileBaseImages(dockerfile []byte) []string {
+	var images []string
+	stages := map[string]bool{"scratch": true}
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		img := fields[0]
+		if !stages[strings.ToLower(img)] && !strings.Contains(img, "$") {
+			images = append(images, img)
+		}
+		if len(fields) == 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+	}
+	return images
+}
+
 func (dr dockerRunner) push(img string) error {
 	return dr.command("image", "push", img)
 }
@@ -170,12 +279,12 @@ func (dr dockerRunner) pushWithManifest(img, suffix string, pushImage, pushManif
 		err    error
 	)
 	if pushImage {
-		fmt.Printf("Pushing %s\n", img+suffix)
+		log.Infof("Pushing %s", img+suffix)
 		if err := dr.push(img + suffix); err != nil {
 			return err
 		}
 	} else {
-		fmt.Print("Image push disabled, skipping...\n")
+		log.Info("Image push disabled, skipping...")
 	}
 
 	auth, err := getDockerAuth()
@@ -184,42 +293,92 @@ func (dr dockerRunner) pushWithManifest(img, suffix string, pushImage, pushManif
 	}
 
 	if pushManifest {
-		fmt.Printf("Pushing %s to manifest %s\n", img+suffix, img)
+		log.Infof("Pushing %s to manifest %s", img+suffix, img)
 		digest, l, err = manifestPush(img, auth)
 		if err != nil {
 			return err
 		}
 	} else {
-		fmt.Print("Manifest push disabled, skipping...\n")
+		log.Info("Manifest push disabled, skipping...")
 	}
 	// if trust is not enabled, nothing more to do
 	if !dr.dct {
-		fmt.Println("trust disabled, not signing")
+		log.Info("trust disabled, not signing")
 		return nil
 	}
 	if !sign {
-		fmt.Println("signing disabled, not signing")
+		log.Info("signing disabled, not signing")
 		return nil
 	}
-	fmt.Printf("Signing manifest for %s\n", img)
+	log.Infof("Signing manifest for %s", img)
 	return signManifest(img, digest, l, auth)
 }
 
 func (dr dockerRunner) tag(ref, tag string) error {
-	fmt.Printf("Tagging %s as %s\n", ref, tag)
+	log.Infof("Tagging %s as %s", ref, tag)
 	return dr.command("image", "tag", ref, tag)
 }
 
 func (dr dockerRunner) build(tag, pkg string, opts ...string) error {
 	args := []string{"build"}
+	if dr.builder != "" {
+		args = []string{"buildx", "build", "--builder", dr.builder, "--load"}
+	}
 	if !dr.cache {
 		args = append(args, "--no-cache")
 	}
+	args = append(args, progressArgs(dr.progress)...)
+	if dr.platform != "" {
+		args = append(args, "--platform", dr.platform)
+	}
 	args = append(args, opts...)
 	args = append(args, "-t", tag, pkg)
 	return dr.command(args...)
 }
 
+// checkArch checks that the image img of the Docker host is one of the
+// arch, so that an image of another arch is not tagged and pushed as one
+// of it
+func (dr dockerRunner) checkArch(img, arch string) error {
+	cmd := exec.Command("docker", "image", "inspect", "--format", "{{.Architecture}}", img)
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if dr.host != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_HOST="+dr.host)
+	}
+	log.Debugf("Executing: %v", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("unable to inspect %s: %v", img, err)
+	}
+	if a := strings.TrimSpace(string(out)); a != arch {
+		return fmt.Errorf("the image %s which was built is for %s, not %s; building for another arch needs emulation, such as binfmt, or a builder of the arch", img, a, arch)
+	}
+	return nil
+}
+
+// imageID returns the ID of the image in docker
+func (dr dockerRunner) imageID(img string) (string, error) {
+	cmd := exec.Command("docker", "image", "inspect", "--format", "{{.Id}}", img)
+	cmd.Stderr = os.Stderr
+	log.Debugf("Executing: %v", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to inspect %s: %v", img, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// recordBuilt records the image as built for the arch, so that builds take
+// it from docker instead of the registry while it is not pushed
+func (dr dockerRunner) recordBuilt(img, arch string) error {
+	id, err := dr.imageID(img)
+	if err != nil {
+		return err
+	}
+	return moby.RecordBuiltImage(img, arch, id)
+}
+
 func (dr dockerRunner) save(tgt string, refs ...string) error {
 	args := append([]string{"image", "save", "-o", tgt}, refs...)
 	return dr.command(args...)
@@ -263,6 +422,33 @@ func manifestPush(img string, auth dockertypes.AuthConfig) (hash string, length
 	return registry.PushManifestList(auth.Username, auth.Password, yamlInput, true, false, false, "")
 }
 
+// PushManifestList pushes the manifest list img of the images of the
+// entries, which must already be pushed to the registry of img, and signs
+// it with content trust if sign is set. The platforms the entries do not
+// set are those of their images. It returns the digest of the list.
+func PushManifestList(img string, entries []types.ManifestEntry, sign bool) (string, error) {
+	auth, err := getDockerAuth()
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth: %v", err)
+	}
+	yamlInput := types.YAMLInput{
+		Image:     img,
+		Manifests: entries,
+	}
+	// push the manifest list with the auth as given, do not ignore missing, do not allow insecure
+	digest, length, err := registry.PushManifestList(auth.Username, auth.Password, yamlInput, false, false, false, "")
+	if err != nil {
+		return "", err
+	}
+	if sign {
+		log.Infof("Signing manifest for %s", img)
+		if err := signManifest(img, digest, length, auth); err != nil {
+			return digest, err
+		}
+	}
+	return digest, nil
+}
+
 func signManifest(img, digest string, length int, auth dockertypes.AuthConfig) error {
 	imgParts := strings.Split(img, ":")
 	if len(imgParts) < 2 {
@@ -280,35 +466,14 @@ func signManifest(img, digest string, length int, auth dockertypes.AuthConfig) e
 		return fmt.Errorf("notary works with sha256 hash, not the provided %s", algo)
 	}
 
-	notaryAuth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", auth.Username, auth.Password)))
 	// run the notary command to sign
-	args := []string{
-		"-s",
-		notaryServer,
-		"-d",
-		path.Join(os.Getenv("HOME"), ".docker/trust"),
-		"addhash",
-		"-p",
-		fmt.Sprintf("docker.io/%s", repo),
-		tag,
-		strconv.Itoa(length),
-		"--sha256",
-		hash,
-		"-r",
-		"targets/releases",
-	}
-	cmd := exec.Command("notary", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", notaryDelegationPassphraseEnvVar, os.Getenv(dctEnvVar)), fmt.Sprintf("%s=%s", notaryAuthEnvVar, notaryAuth))
-	log.Debugf("Executing: %v", cmd.Args)
-
+	cmd := notaryCommand(auth, "addhash", "-p", fmt.Sprintf("docker.io/%s", repo), tag, strconv.Itoa(length), "--sha256", hash, "-r", releasesRole)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to execute notary-tool: %v", err)
 	}
 
 	// report output
-	fmt.Printf("Signed manifest index: %s:%s\n", repo, tag)
+	log.WithFields(log.Fields{"repo": repo, "tag": tag}).Info("Signed manifest index")
 
 	return nil
 }
@@ -0,0 +1,23 @@
+package pkglib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerfileBaseImages(t *testing.T) {
+	images := dockerfileBaseImages([]byte(`ARG BASE=alpine
+FROM linuxkit/alpine:3fdc49366257e53276c6f363956a4353f95d9a81 AS mirror
+RUN apk add curl
+FROM --platform=$BUILDPLATFORM golang:1.16-alpine as build
+FROM ${BASE}
+from mirror AS copy
+FROM scratch
+COPY --from=build /go/bin/app /
+`))
+	assert.Equal(t, []string{
+		"linuxkit/alpine:3fdc49366257e53276c6f363956a4353f95d9a81",
+		"golang:1.16-alpine",
+	}, images)
+}
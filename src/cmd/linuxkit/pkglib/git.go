@@ -57,7 +57,7 @@ func (g git) commandStdout(stderr io.Writer, args ...string) (string, error) {
 
 func (g git) command(args ...string) error {
 	cmd := g.mkCmd(args...)
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = commandOutput()
 	cmd.Stderr = os.Stderr
 	log.Debugf("Executing: %v", cmd.Args)
 
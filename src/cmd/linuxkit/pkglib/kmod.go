@@ -0,0 +1,104 @@
+package pkglib
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// defaultKernelModuleBuilder is the image kernel modules are compiled in,
+// which is the one the kernel packages are compiled in
+const defaultKernelModuleBuilder = "linuxkit/alpine:e2391e0b164c57db9f6c4ae110ee84f766edc430"
+
+// kernelModule is the kernel-module section of a build.yml, which builds
+// the out-of-tree kernel modules in the package directory against the
+// kernel-dev.tar of a kernel package, instead of the Dockerfile of the
+// package
+type kernelModule struct {
+	// Kernel is the kernel package the modules are built against, and
+	// Kernels those of the architectures which have another one
+	Kernel  string            `yaml:"kernel"`
+	Kernels map[string]string `yaml:"kernels"`
+	// Builder is the image the modules are compiled in, and Packages the
+	// apk packages which are added to it
+	Builder  string   `yaml:"builder"`
+	Packages []string `yaml:"packages"`
+	// MakeArgs are passed to make, e.g. CONFIG_FOO=m
+	MakeArgs []string `yaml:"make-args"`
+}
+
+// kernel returns the kernel package of the arch
+func (k kernelModule) kernel(arch string) string {
+	if kernel, ok := k.Kernels[arch]; ok {
+		return kernel
+	}
+	return k.Kernel
+}
+
+// validate checks that there is a kernel for each of the arches
+func (k kernelModule) validate(arches []string) error {
+	for _, arch := range arches {
+		if k.kernel(arch) == "" {
+			return fmt.Errorf("kernel-module has no kernel for %s", arch)
+		}
+	}
+	for arch := range k.Kernels {
+		switch arch {
+		case "amd64", "arm64", "s390x", "riscv64":
+		default:
+			return fmt.Errorf("Unknown arch %q in kernel-module kernels", arch)
+		}
+	}
+	return nil
+}
+
+var kernelModuleDockerfile = template.Must(template.New("Dockerfile").Parse(`# generated by linuxkit pkg build from the kernel-module of build.yml
+FROM {{.Kernel}} AS kernel
+FROM {{.Builder}} AS build
+RUN apk add --no-cache build-base elfutils-dev kmod{{range .Packages}} {{.}}{{end}}
+COPY --from=kernel /kernel-dev.tar /kernel.tar /
+RUN tar xf /kernel-dev.tar -C / && \
+    mkdir -p /out && tar xf /kernel.tar -C /out lib/modules
+COPY . /src
+WORKDIR /src
+RUN KVER=$(basename /usr/src/linux-headers-*) && \
+    make -C /usr/src/linux-headers-$KVER M=/src{{.MakeArgs}} modules && \
+    make -C /usr/src/linux-headers-$KVER M=/src{{.MakeArgs}} INSTALL_MOD_PATH=/out modules_install && \
+    depmod -b /out $KVER && \
+    mkdir -p /kmod/lib/modules/$KVER && \
+    cp -a /out/lib/modules/$KVER/extra /out/lib/modules/$KVER/modules.* /kmod/lib/modules/$KVER/
+
+FROM scratch
+ENTRYPOINT []
+COPY --from=build /kmod/ /
+`))
+
+// dockerfile returns the Dockerfile which builds the modules for the arch,
+// into an image of /lib/modules with the modules in extra/ and the
+// modules.dep of the modules of the kernel and these
+func (k kernelModule) dockerfile(arch string) ([]byte, error) {
+	builder := k.Builder
+	if builder == "" {
+		builder = defaultKernelModuleBuilder
+	}
+	var makeArgs string
+	for _, a := range k.MakeArgs {
+		makeArgs += " " + shellQuote(a)
+	}
+	var b bytes.Buffer
+	err := kernelModuleDockerfile.Execute(&b, struct {
+		Kernel, Builder, MakeArgs string
+		Packages                  []string
+	}{k.kernel(arch), builder, makeArgs, k.Packages})
+	return b.Bytes(), err
+}
+
+// shellQuote quotes s for sh, unless it only has characters which need no
+// quoting
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-=./,:+") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
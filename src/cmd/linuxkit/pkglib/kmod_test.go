@@ -0,0 +1,30 @@
+package pkglib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelModuleDockerfile(t *testing.T) {
+	k := kernelModule{
+		Kernel:   "linuxkit/kernel:5.10.104",
+		Kernels:  map[string]string{"riscv64": "acme/kernel-riscv64:5.10.104"},
+		Packages: []string{"linux-headers"},
+		MakeArgs: []string{"CONFIG_HELLO=m", "EXTRA_CFLAGS=-DDEBUG -O2"},
+	}
+	require.NoError(t, k.validate([]string{"amd64", "riscv64"}))
+
+	dockerfile, err := k.dockerfile("amd64")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"linuxkit/kernel:5.10.104", defaultKernelModuleBuilder}, dockerfileBaseImages(dockerfile))
+	assert.Contains(t, string(dockerfile), "apk add --no-cache build-base elfutils-dev kmod linux-headers\n")
+	assert.Contains(t, string(dockerfile), "M=/src CONFIG_HELLO=m 'EXTRA_CFLAGS=-DDEBUG -O2' modules")
+
+	dockerfile, err = k.dockerfile("riscv64")
+	require.NoError(t, err)
+	assert.Equal(t, "acme/kernel-riscv64:5.10.104", dockerfileBaseImages(dockerfile)[0])
+
+	assert.Error(t, kernelModule{Kernel: "linuxkit/kernel:5.10.104", Kernels: map[string]string{"mips": "acme/kernel"}}.validate(nil))
+}
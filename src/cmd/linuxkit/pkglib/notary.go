@@ -0,0 +1,224 @@
+package pkglib
+
+// Thin wrappers around notary CLI invocations for the delegation keys
+// images are signed with
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// releasesRole is the delegation role images are signed in
+	releasesRole = "targets/releases"
+	// delegationKeyValidity is how long the certificate of a generated
+	// delegation key is valid for
+	delegationKeyValidity = 10 * 365 * 24 * time.Hour
+)
+
+// notaryCommand returns the notary command with the args for the notary
+// server and trust directory of Docker Hub, which is given the delegation
+// passphrase and the hub auth
+func notaryCommand(auth dockertypes.AuthConfig, args ...string) *exec.Cmd {
+	notaryAuth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", auth.Username, auth.Password)))
+	args = append([]string{"-s", notaryServer, "-d", path.Join(os.Getenv("HOME"), ".docker/trust")}, args...)
+	cmd := exec.Command("notary", args...)
+	cmd.Stdout = commandOutput()
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", notaryDelegationPassphraseEnvVar, os.Getenv(dctEnvVar)), fmt.Sprintf("%s=%s", notaryAuthEnvVar, notaryAuth))
+	log.Debugf("Executing: %v", cmd.Args)
+	return cmd
+}
+
+// runNotary runs notary with the args and the hub auth
+func runNotary(args ...string) error {
+	auth, err := getDockerAuth()
+	if err != nil {
+		return fmt.Errorf("failed to get auth: %v", err)
+	}
+	if err := notaryCommand(auth, args...).Run(); err != nil {
+		return fmt.Errorf("failed to execute notary-tool: %v", err)
+	}
+	return nil
+}
+
+// trustRepository returns the notary GUN of the image repository repo,
+// which may have a tag
+func trustRepository(repo string) (string, error) {
+	r, err := name.ParseReference(repo)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository %s: %v", repo, err)
+	}
+	if reg := r.Context().RegistryStr(); reg != name.DefaultRegistry {
+		return "", fmt.Errorf("images of %s are not signed, only those of Docker Hub", reg)
+	}
+	return "docker.io/" + r.Context().RepositoryStr(), nil
+}
+
+// generateDelegationKey returns a new ECDSA P-256 private key, and a self
+// signed certificate of it with the common name, both PEM encoded
+func generateDelegationKey(commonName string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now,
+		NotAfter:              now.Add(delegationKeyValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), nil
+}
+
+// GenerateDelegationKey writes a new delegation key, and the certificate
+// which is added to the repositories it signs, as keyName.key and keyName.crt in
+// dir, and imports the key into the trust directory for the releases role,
+// encrypted with the delegation passphrase. It returns the certificate.
+func GenerateDelegationKey(keyName, dir string) (string, error) {
+	keyPEM, certPEM, err := generateDelegationKey(keyName)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate the key: %v", err)
+	}
+	keyFile := filepath.Join(dir, keyName+".key")
+	certFile := filepath.Join(dir, keyName+".crt")
+	for _, f := range []string{keyFile, certFile} {
+		if _, err := os.Stat(f); err == nil {
+			return "", fmt.Errorf("%s already exists", f)
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return "", err
+	}
+	if err := runNotary("key", "import", keyFile, "--role", releasesRole); err != nil {
+		return certFile, fmt.Errorf("unable to import the key %s: %v", keyFile, err)
+	}
+	return certFile, nil
+}
+
+// AddDelegationKey adds the key of the certificate to the releases role of
+// the repository, creating the role if it does not exist, and publishes it
+func AddDelegationKey(repo, cert string) error {
+	gun, err := trustRepository(repo)
+	if err != nil {
+		return err
+	}
+	return runNotary("delegation", "add", "-p", gun, releasesRole, cert, "--all-paths")
+}
+
+// RemoveDelegationKeys removes the keys with the IDs from the releases role
+// of the repository, and publishes it
+func RemoveDelegationKeys(repo string, keyIDs []string) error {
+	gun, err := trustRepository(repo)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"delegation", "remove", "-p", gun, releasesRole}, keyIDs...)
+	return runNotary(args...)
+}
+
+// ResignDelegation signs the releases role of the repository again, with
+// the keys of the role which are in the trust directory, so its tags are
+// signed by a new key once the old one is removed, and publishes it
+func ResignDelegation(repo string) error {
+	gun, err := trustRepository(repo)
+	if err != nil {
+		return err
+	}
+	return runNotary("witness", "-p", gun, releasesRole)
+}
+
+// ResignTag signs the manifest or index the tag of the repository points
+// to in the registry again, in the releases role
+func ResignTag(img string) error {
+	ref, err := name.NewTag(img)
+	if err != nil {
+		return fmt.Errorf("invalid image %s: %v", img, err)
+	}
+	if _, err := trustRepository(img); err != nil {
+		return err
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return fmt.Errorf("unable to get the manifest of %s: %v", img, err)
+	}
+	auth, err := getDockerAuth()
+	if err != nil {
+		return fmt.Errorf("failed to get auth: %v", err)
+	}
+	return signManifest(ref.Context().RepositoryStr()+":"+ref.TagStr(), desc.Digest.String(), int(desc.Size), auth)
+}
+
+// ListDelegations prints the delegation roles of the repositories, and the
+// IDs of their keys, or the keys in the trust directory if there are none
+func ListDelegations(repos []string) error {
+	auth, err := getDockerAuth()
+	if err != nil {
+		return fmt.Errorf("failed to get auth: %v", err)
+	}
+	list := func(args ...string) error {
+		cmd := notaryCommand(auth, args...)
+		// the list is the output of the command, even if the log is quiet
+		cmd.Stdout = os.Stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to execute notary-tool: %v", err)
+		}
+		return nil
+	}
+	if len(repos) == 0 {
+		return list("key", "list")
+	}
+	for _, repo := range repos {
+		gun, err := trustRepository(repo)
+		if err != nil {
+			return err
+		}
+		if len(repos) > 1 {
+			fmt.Printf("%s:\n", strings.TrimPrefix(gun, "docker.io/"))
+		}
+		if err := list("delegation", "list", gun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package pkglib
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateDelegationKey(t *testing.T) {
+	keyPEM, certPEM, err := generateDelegationKey("releases")
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(keyPEM)
+	require.NotNil(t, block)
+	assert.Equal(t, "PRIVATE KEY", block.Type)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	block, _ = pem.Decode(certPEM)
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, "releases", cert.Subject.CommonName)
+	assert.Equal(t, &key.(*ecdsa.PrivateKey).PublicKey, cert.PublicKey)
+	assert.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+}
+
+func TestTrustRepository(t *testing.T) {
+	for _, tc := range []struct {
+		repo, gun string
+		err       bool
+	}{
+		{repo: "linuxkit/containerd", gun: "docker.io/linuxkit/containerd"},
+		{repo: "linuxkit/containerd:v0.8", gun: "docker.io/linuxkit/containerd"},
+		{repo: "docker.io/library/alpine", gun: "docker.io/library/alpine"},
+		{repo: "alpine", gun: "docker.io/library/alpine"},
+		{repo: "registry.example.com/linuxkit/containerd", err: true},
+	} {
+		gun, err := trustRepository(tc.repo)
+		if tc.err {
+			assert.Error(t, err, tc.repo)
+			continue
+		}
+		assert.NoError(t, err, tc.repo)
+		assert.Equal(t, tc.gun, gun, tc.repo)
+	}
+}
@@ -0,0 +1,127 @@
+package pkglib
+
+// Offline signing of the manifests or indexes of pushed images: the cosign
+// signing payload is written where they are pushed, signed on a machine
+// which has the key, e.g. in an HSM, and the signature is attached to the
+// image with cosign where they are pushed again
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	log "github.com/sirupsen/logrus"
+)
+
+// signingPayloadType is the type of cosign signing payloads
+const signingPayloadType = "cosign container image signature"
+
+// signingPayload is the simple signing payload cosign signs, which is what an
+// image signature is made of
+type signingPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// newSigningPayload returns the signing payload of an image by digest
+func newSigningPayload(ref string) ([]byte, error) {
+	d, err := name.NewDigest(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image %s: %v", ref, err)
+	}
+	var p signingPayload
+	p.Critical.Identity.DockerReference = d.Context().Name()
+	p.Critical.Image.DockerManifestDigest = d.DigestStr()
+	p.Critical.Type = signingPayloadType
+	return json.Marshal(p)
+}
+
+// ParseSigningPayload returns the image by digest a signing payload is of
+func ParseSigningPayload(b []byte) (string, error) {
+	var p signingPayload
+	if err := json.Unmarshal(b, &p); err != nil {
+		return "", fmt.Errorf("invalid signing payload: %v", err)
+	}
+	if p.Critical.Type != signingPayloadType {
+		return "", fmt.Errorf("invalid signing payload type %q", p.Critical.Type)
+	}
+	ref := p.Critical.Identity.DockerReference + "@" + p.Critical.Image.DockerManifestDigest
+	if _, err := name.NewDigest(ref); err != nil {
+		return "", fmt.Errorf("invalid image %s in the signing payload: %v", ref, err)
+	}
+	return ref, nil
+}
+
+// WriteSigningPayload writes the signing payload of the manifest or index the
+// image points to in the registry to path, and returns the image by digest
+func WriteSigningPayload(img, path string) (string, error) {
+	ref, err := imageDigest(img)
+	if err != nil {
+		return "", err
+	}
+	b, err := newSigningPayload(ref)
+	if err != nil {
+		return "", err
+	}
+	return ref, ioutil.WriteFile(path, b, 0644)
+}
+
+// OfflineSignature is a signature of a signing payload which was made
+// offline
+type OfflineSignature struct {
+	// Payload is the path of the signing payload
+	Payload string
+	// Signature is the path of the base64 encoded signature of the payload
+	Signature string
+	// Certificate and Chain are the paths of the PEM encoded certificate
+	// of the key and its chain, which are optional
+	Certificate string
+	Chain       string
+}
+
+func (s OfflineSignature) attachArgs(ref string) []string {
+	args := []string{"attach", "signature", "--payload", s.Payload, "--signature", s.Signature}
+	if s.Certificate != "" {
+		args = append(args, "--certificate", s.Certificate)
+	}
+	if s.Chain != "" {
+		args = append(args, "--certificate-chain", s.Chain)
+	}
+	return append(args, ref)
+}
+
+// Attach attaches the signature to the image its payload is of with cosign,
+// and returns the image by digest. The signature is not checked, as the
+// public key is not needed to attach it.
+func (s OfflineSignature) Attach() (string, error) {
+	b, err := ioutil.ReadFile(s.Payload)
+	if err != nil {
+		return "", err
+	}
+	ref, err := ParseSigningPayload(b)
+	if err != nil {
+		return "", err
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return "", fmt.Errorf("cosign is required: %v", err)
+	}
+	cmd := exec.Command("cosign", s.attachArgs(ref)...)
+	cmd.Stdout = commandOutput()
+	cmd.Stderr = os.Stderr
+	log.Debugf("Executing: %v", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("cosign failed: %v", err)
+	}
+	return ref, nil
+}
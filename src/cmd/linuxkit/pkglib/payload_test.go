@@ -0,0 +1,33 @@
+package pkglib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningPayload(t *testing.T) {
+	b, err := newSigningPayload(signedRef)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"critical":{"identity":{"docker-reference":"ghcr.io/linuxkit/containerd"},"image":{"docker-manifest-digest":"sha256:66b3d74aeb855f393ddb85e7371a00d5f7994cc26b425825df2ce910583d74dc"},"type":"cosign container image signature"},"optional":null}`, string(b))
+
+	ref, err := ParseSigningPayload(b)
+	assert.NoError(t, err)
+	assert.Equal(t, signedRef, ref)
+}
+
+func TestSigningPayloadInvalid(t *testing.T) {
+	_, err := newSigningPayload("ghcr.io/linuxkit/containerd:v1.0.0")
+	assert.Error(t, err)
+	_, err = ParseSigningPayload([]byte(`{"critical":{"type":"something else"}}`))
+	assert.Error(t, err)
+	_, err = ParseSigningPayload([]byte(`{"critical":{"identity":{"docker-reference":"ghcr.io/linuxkit/containerd"},"type":"cosign container image signature"}}`))
+	assert.Error(t, err)
+}
+
+func TestOfflineSignatureArgs(t *testing.T) {
+	s := OfflineSignature{Payload: "payload.json", Signature: "payload.sig"}
+	assert.Equal(t, []string{"attach", "signature", "--payload", "payload.json", "--signature", "payload.sig", signedRef}, s.attachArgs(signedRef))
+	s.Certificate, s.Chain = "cert.pem", "chain.pem"
+	assert.Equal(t, []string{"attach", "signature", "--payload", "payload.json", "--signature", "payload.sig", "--certificate", "cert.pem", "--certificate-chain", "chain.pem", signedRef}, s.attachArgs(signedRef))
+}
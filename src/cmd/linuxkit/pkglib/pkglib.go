@@ -25,6 +25,7 @@ type pkgInfo struct {
 	DisableContentTrust bool              `yaml:"disable-content-trust"`
 	DisableCache        bool              `yaml:"disable-cache"`
 	Config              *moby.ImageConfig `yaml:"config"`
+	KernelModule        *kernelModule     `yaml:"kernel-module"`
 	Depends             struct {
 		DockerImages struct {
 			TargetDir string   `yaml:"target-dir"`
@@ -53,6 +54,7 @@ type Pkg struct {
 	trust         bool
 	cache         bool
 	config        *moby.ImageConfig
+	kernelModule  *kernelModule
 	dockerDepends dockerDepends
 
 	// Internal state
@@ -63,11 +65,14 @@ type Pkg struct {
 	git        *git
 }
 
+// DefaultOrg is the hub org of packages whose build.yml does not set one
+var DefaultOrg = "linuxkit"
+
 // NewFromCLI creates a Pkg from a set of CLI arguments. Calls fs.Parse()
 func NewFromCLI(fs *flag.FlagSet, args ...string) (Pkg, error) {
 	// Defaults
 	pi := pkgInfo{
-		Org:                 "linuxkit",
+		Org:                 DefaultOrg,
 		Arches:              []string{"amd64", "arm64", "s390x", "riscv64"},
 		GitRepo:             "https://github.com/linuxkit/linuxkit",
 		Network:             false,
@@ -142,6 +147,15 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) (Pkg, error) {
 		return Pkg{}, fmt.Errorf("Image field is required")
 	}
 
+	if pi.KernelModule != nil {
+		if err := pi.KernelModule.validate(pi.Arches); err != nil {
+			return Pkg{}, err
+		}
+		if _, err := os.Stat(filepath.Join(pkgPath, "Dockerfile")); err == nil {
+			return Pkg{}, fmt.Errorf("A package with kernel-module must not have a Dockerfile")
+		}
+	}
+
 	dockerDepends, err := newDockerDepends(pkgPath, &pi)
 	if err != nil {
 		return Pkg{}, err
@@ -251,6 +265,7 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) (Pkg, error) {
 		trust:         !pi.DisableContentTrust,
 		cache:         !pi.DisableCache,
 		config:        pi.Config,
+		kernelModule:  pi.KernelModule,
 		dockerDepends: dockerDepends,
 		dirty:         dirty,
 		path:          pkgPath,
@@ -146,3 +146,13 @@ depends:
       - one
 `, `"depends.images.list" and "depends.images.from-file" are mutually exclusive`)
 }
+
+func TestKernelModuleNoKernel(t *testing.T) {
+	testBadBuildYML(t, `
+image: dummy
+arches: [amd64, riscv64]
+kernel-module:
+  kernels:
+    amd64: linuxkit/kernel:5.10.104
+`, `kernel-module has no kernel for riscv64`)
+}
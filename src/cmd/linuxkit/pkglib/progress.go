@@ -0,0 +1,104 @@
+package pkglib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Progress modes of the output of the docker commands of a build
+const (
+	// ProgressAuto leaves the progress to docker, and prefixes its lines
+	// with the arch if they are not written to a terminal
+	ProgressAuto = "auto"
+	// ProgressTTY renders the progress of BuildKit in place
+	ProgressTTY = "tty"
+	// ProgressPlain writes the progress as lines, prefixed with the arch,
+	// so the logs of builds of several arches can be told apart
+	ProgressPlain = "plain"
+	// ProgressQuiet only writes errors
+	ProgressQuiet = "quiet"
+)
+
+// WithBuildProgress sets the progress mode of the output of the build,
+// which is one of auto, tty, plain or quiet
+func WithBuildProgress(mode string) BuildOpt {
+	return func(bo *buildOpts) error {
+		switch mode {
+		case ProgressAuto, ProgressTTY, ProgressPlain, ProgressQuiet:
+		default:
+			return fmt.Errorf("Unknown progress mode %s, must be auto, tty, plain or quiet", mode)
+		}
+		bo.progress = mode
+		return nil
+	}
+}
+
+// progressArgs returns the arguments of docker build or docker buildx build
+// for the progress mode
+func progressArgs(mode string) []string {
+	switch mode {
+	case ProgressTTY, ProgressPlain:
+		return []string{"--progress=" + mode}
+	case ProgressQuiet:
+		return []string{"--quiet"}
+	}
+	return nil
+}
+
+// output returns the writers of the stdout and stderr of docker commands,
+// and a func which writes what remains of their last lines
+func (dr dockerRunner) output() (io.Writer, io.Writer, func()) {
+	stdout := commandOutput()
+	if dr.progress == ProgressQuiet {
+		stdout = ioutil.Discard
+	}
+	prefix := dr.progress == ProgressPlain || (dr.progress == ProgressAuto && !terminal.IsTerminal(int(os.Stderr.Fd())))
+	if !prefix || dr.prefix == "" {
+		return stdout, os.Stderr, func() {}
+	}
+	o := &prefixWriter{w: stdout, prefix: []byte(dr.prefix)}
+	e := &prefixWriter{w: os.Stderr, prefix: []byte(dr.prefix)}
+	return o, e, func() {
+		o.Flush()
+		e.Flush()
+	}
+}
+
+// prefixWriter writes each line written to it to w with the prefix, as a
+// single write so the lines of several builds do not mix
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := append(append([]byte{}, p.prefix...), p.buf[:i+1]...)
+		p.buf = p.buf[i+1:]
+		if _, err := p.w.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes the last line, if it does not end with a newline
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(append(append([]byte{}, p.prefix...), p.buf...), '\n')
+	p.buf = nil
+	_, err := p.w.Write(line)
+	return err
+}
@@ -0,0 +1,44 @@
+package pkglib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writes records each write, to check that lines are written whole
+type writes [][]byte
+
+func (w *writes) Write(b []byte) (int, error) {
+	*w = append(*w, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var w writes
+	p := &prefixWriter{w: &w, prefix: []byte("[arm64] ")}
+	for _, s := range []string{"#1 [internal] load", " build definition\n#1 DONE 0.0s\n", "\n#2 FROM alpine"} {
+		n, err := p.Write([]byte(s))
+		assert.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	assert.NoError(t, p.Flush())
+	assert.Equal(t, [][]byte{
+		[]byte("[arm64] #1 [internal] load build definition\n"),
+		[]byte("[arm64] #1 DONE 0.0s\n"),
+		[]byte("[arm64] \n"),
+		[]byte("[arm64] #2 FROM alpine\n"),
+	}, [][]byte(w))
+	assert.NoError(t, p.Flush())
+	assert.Len(t, w, 4)
+}
+
+func TestWithBuildProgress(t *testing.T) {
+	var bo buildOpts
+	assert.NoError(t, WithBuildProgress(ProgressPlain)(&bo))
+	assert.Equal(t, ProgressPlain, bo.progress)
+	assert.Error(t, WithBuildProgress("fancy")(&bo))
+	assert.Equal(t, []string{"--quiet"}, progressArgs(ProgressQuiet))
+	assert.Nil(t, progressArgs(ProgressAuto))
+	assert.Equal(t, []string{"--progress=tty"}, progressArgs(ProgressTTY))
+}
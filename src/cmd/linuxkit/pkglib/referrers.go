@@ -0,0 +1,139 @@
+package pkglib
+
+// Thin wrappers around cosign and notation invocations, which attach the
+// signatures of images to them with the OCI referrers API, for registries
+// which have no notary
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// ImageSigner signs and verifies the manifests or indexes of pushed images
+// with cosign or notation, by digest, with signatures which are referrers
+// of them
+type ImageSigner struct {
+	// Method is cosign or notation
+	Method string
+	// Key is the cosign private or public key or KMS URI, or the notation
+	// key to sign with, or empty for keyless cosign or the default key of
+	// notation
+	Key string
+	// Identity and Issuer are the expected certificate of keyless cosign
+	// signatures
+	Identity string
+	Issuer   string
+}
+
+// Check checks that the signer can be run
+func (s ImageSigner) Check() error {
+	switch s.Method {
+	case "cosign", "notation":
+	default:
+		return fmt.Errorf("Unknown image signing method %s, must be cosign or notation", s.Method)
+	}
+	if _, err := exec.LookPath(s.Method); err != nil {
+		return fmt.Errorf("%s is required: %v", s.Method, err)
+	}
+	return nil
+}
+
+// CheckVerify checks that the signer can be run, and that it is given what
+// is needed to verify
+func (s ImageSigner) CheckVerify() error {
+	if err := s.Check(); err != nil {
+		return err
+	}
+	switch {
+	case s.Method == "cosign" && s.Key == "" && (s.Identity == "" || s.Issuer == ""):
+		return fmt.Errorf("Keyless cosign signatures need a certificate identity and OIDC issuer")
+	case s.Method == "notation" && s.Key != "":
+		return fmt.Errorf("notation verifies with its trust policy, not a key")
+	}
+	return nil
+}
+
+func (s ImageSigner) signArgs(ref string) []string {
+	if s.Method == "notation" {
+		args := []string{"sign"}
+		if s.Key != "" {
+			args = append(args, "--key", s.Key)
+		}
+		return append(args, ref)
+	}
+	args := []string{"sign", "--yes", "--registry-referrers-mode=oci-1-1"}
+	if s.Key != "" {
+		args = append(args, "--key", s.Key)
+	}
+	return append(args, ref)
+}
+
+func (s ImageSigner) verifyArgs(ref string) []string {
+	if s.Method == "notation" {
+		return []string{"verify", ref}
+	}
+	args := []string{"verify", "--experimental-oci11"}
+	if s.Key != "" {
+		args = append(args, "--key", s.Key)
+	} else {
+		args = append(args, "--certificate-identity", s.Identity, "--certificate-oidc-issuer", s.Issuer)
+	}
+	return append(args, ref)
+}
+
+// Sign signs the manifest or index the image points to in the registry,
+// and returns it by digest
+func (s ImageSigner) Sign(img string) (string, error) {
+	ref, err := imageDigest(img)
+	if err != nil {
+		return "", err
+	}
+	return ref, s.run(s.signArgs(ref)...)
+}
+
+// Verify verifies the signatures of the manifest or index the image points
+// to in the registry, and returns it by digest
+func (s ImageSigner) Verify(img string) (string, error) {
+	ref, err := imageDigest(img)
+	if err != nil {
+		return "", err
+	}
+	return ref, s.run(s.verifyArgs(ref)...)
+}
+
+func (s ImageSigner) run(args ...string) error {
+	cmd := exec.Command(s.Method, args...)
+	cmd.Stdout = commandOutput()
+	cmd.Stderr = os.Stderr
+	// the referrers mode of cosign is experimental
+	cmd.Env = append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+	log.Debugf("Executing: %v", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", s.Method, err)
+	}
+	return nil
+}
+
+// imageDigest returns the image by the digest of the manifest or index it
+// points to in the registry, so what is signed or verified is what was
+// pushed, even if the tag is pushed again
+func imageDigest(img string) (string, error) {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %v", img, err)
+	}
+	if d, ok := ref.(name.Digest); ok {
+		return d.Name(), nil
+	}
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", fmt.Errorf("unable to get the manifest of %s: %v", img, err)
+	}
+	return ref.Context().Name() + "@" + desc.Digest.String(), nil
+}
@@ -0,0 +1,46 @@
+package pkglib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const signedRef = "ghcr.io/linuxkit/containerd@sha256:66b3d74aeb855f393ddb85e7371a00d5f7994cc26b425825df2ce910583d74dc"
+
+func TestImageSignerArgs(t *testing.T) {
+	for _, tc := range []struct {
+		signer         ImageSigner
+		sign, verified []string
+	}{
+		{
+			signer:   ImageSigner{Method: "cosign", Key: "cosign.key"},
+			sign:     []string{"sign", "--yes", "--registry-referrers-mode=oci-1-1", "--key", "cosign.key", signedRef},
+			verified: []string{"verify", "--experimental-oci11", "--key", "cosign.key", signedRef},
+		},
+		{
+			signer:   ImageSigner{Method: "cosign", Identity: "me@example.com", Issuer: "https://accounts.example.com"},
+			sign:     []string{"sign", "--yes", "--registry-referrers-mode=oci-1-1", signedRef},
+			verified: []string{"verify", "--experimental-oci11", "--certificate-identity", "me@example.com", "--certificate-oidc-issuer", "https://accounts.example.com", signedRef},
+		},
+		{
+			signer:   ImageSigner{Method: "notation", Key: "releases"},
+			sign:     []string{"sign", "--key", "releases", signedRef},
+			verified: []string{"verify", signedRef},
+		},
+	} {
+		assert.Equal(t, tc.sign, tc.signer.signArgs(signedRef))
+		assert.Equal(t, tc.verified, tc.signer.verifyArgs(signedRef))
+	}
+}
+
+func TestImageSignerUnknownMethod(t *testing.T) {
+	assert.Error(t, ImageSigner{Method: "notary"}.Check())
+	assert.Error(t, ImageSigner{Method: "gpg"}.CheckVerify())
+}
+
+func TestImageDigestOfDigest(t *testing.T) {
+	ref, err := imageDigest(signedRef)
+	assert.NoError(t, err)
+	assert.Equal(t, signedRef, ref)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// pluginProtocol is the version of the protocol of run and push plugins,
+// which is incremented if it changes incompatibly
+const pluginProtocol = 1
+
+// pluginRequest is the request given to a run or push plugin, as JSON in
+// the file in $LINUXKIT_PLUGIN_REQUEST
+type pluginRequest struct {
+	Protocol int `json:"protocol"`
+	// Command is run or push, and Backend the name of the plugin
+	Command string   `json:"command"`
+	Backend string   `json:"backend"`
+	Args    []string `json:"args"`
+	// Version and Executable are those of linuxkit, which a plugin may
+	// run, e.g. to build an image
+	Version    string `json:"version"`
+	Executable string `json:"executable"`
+	Cache      string `json:"cache"`
+	LogFormat  string `json:"logFormat"`
+	Verbose    bool   `json:"verbose"`
+	Quiet      bool   `json:"quiet"`
+	// Result is the file the plugin may write its pluginResult to
+	Result string `json:"result"`
+}
+
+// pluginResult is the result a plugin may write to the file of the request
+type pluginResult struct {
+	// Message is logged with the fields, such as the instance and IP of a
+	// VM or the ID of an image
+	Message string            `json:"message,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	// Output is printed to stdout, such as the reference of a pushed image
+	Output string `json:"output,omitempty"`
+	// ExitStatus is the exit status of the guest of a run
+	ExitStatus *int `json:"exitStatus,omitempty"`
+	// Error is the error the plugin failed with
+	Error string `json:"error,omitempty"`
+}
+
+// pluginCommands adds the backends of the plugins of c on the PATH, e.g.
+// linuxkit-run-mycloud, which do not replace its built in backends
+func pluginCommands(c *command, verb string) {
+	plugins := util.PathPlugins("linuxkit-" + c.name + "-")
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		if c.lookup(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name, path := name, plugins[name]
+		c.subcommands = append(c.subcommands, &command{
+			name:  name,
+			short: fmt.Sprintf("%s with the plugin %s", verb, filepath.Base(path)),
+			run:   func(args []string) { runPlugin(c.name, name, path, args) },
+		})
+	}
+}
+
+// runPlugin runs the plugin at path as the backend of command. It is given
+// the arguments, the standard streams and the request, and linuxkit exits
+// with its exit status.
+func runPlugin(command, backend, path string, args []string) {
+	dir, err := ioutil.TempDir("", "linuxkit-plugin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	request := pluginRequest{
+		Protocol:  pluginProtocol,
+		Command:   command,
+		Backend:   backend,
+		Args:      args,
+		Version:   version.Version,
+		Cache:     defaultLinuxkitCache(),
+		LogFormat: logFormatFlag.value,
+		Verbose:   verboseFlag.value,
+		Quiet:     quietFlag.value,
+		Result:    filepath.Join(dir, "result.json"),
+	}
+	request.Executable, _ = os.Executable()
+	b, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	requestPath := filepath.Join(dir, "request.json")
+	if err := ioutil.WriteFile(requestPath, b, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("LINUXKIT_PLUGIN_PROTOCOL=%d", pluginProtocol),
+		"LINUXKIT_PLUGIN_REQUEST="+requestPath,
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if command == "run" {
+		// the console of the VM, with the exit status of the guest
+		cmd.Stdout, _ = consoleWriter(os.Stdout, "")
+	}
+	log.Debugf("Executing: %v", cmd.Args)
+	runErr := cmd.Run()
+	result, err := readPluginResult(request.Result)
+	os.RemoveAll(dir)
+	if err != nil {
+		log.Fatalf("Invalid result of %s: %v", path, err)
+	}
+
+	fields := log.Fields{}
+	for k, v := range result.Fields {
+		fields[k] = v
+	}
+	if result.Error != "" {
+		log.WithFields(fields).Fatal(result.Error)
+	}
+	if runErr != nil {
+		if exitErr, ok := runErr.(*exec.ExitError); ok {
+			log.Debugf("%s exited with status %d", path, exitErr.ExitCode())
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatalf("Unable to run %s: %v", path, runErr)
+	}
+	if result.Message != "" {
+		log.WithFields(fields).Info(result.Message)
+	}
+	if result.Output != "" {
+		fmt.Println(result.Output)
+	}
+	if result.ExitStatus != nil {
+		os.Exit(*result.ExitStatus)
+	}
+	exitGuestStatus()
+}
+
+// readPluginResult reads the result of a plugin, which is empty if it did not
+// write one
+func readPluginResult(path string) (pluginResult, error) {
+	var result pluginResult
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(b, &result)
+	return result, err
+}
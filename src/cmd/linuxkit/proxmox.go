@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	proxmoxURLVar         = "PROXMOX_URL"
+	proxmoxTokenIDVar     = "PROXMOX_TOKEN_ID"
+	proxmoxTokenSecretVar = "PROXMOX_TOKEN_SECRET"
+	proxmoxNodeVar        = "PROXMOX_NODE"
+	proxmoxStorageVar     = "PROXMOX_STORAGE"
+
+	proxmoxTaskTimeout = 30 * time.Minute
+)
+
+// ProxmoxClient is a client for the Proxmox VE API, authenticated with an API token
+type ProxmoxClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewProxmoxClient creates a client for the API of the Proxmox VE host at
+// baseURL, for example https://pve.example.com:8006. The token ID has the
+// form user@realm!name.
+func NewProxmoxClient(baseURL, tokenID, tokenSecret string, insecure bool) (*ProxmoxClient, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("Proxmox URL must be set")
+	}
+	if tokenID == "" || tokenSecret == "" {
+		return nil, fmt.Errorf("Proxmox API token ID and secret must be set")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		// Proxmox hosts use a self signed certificate by default
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &ProxmoxClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   fmt.Sprintf("PVEAPIToken=%s=%s", tokenID, tokenSecret),
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// do sends a request to the API and decodes the data in the response into v
+func (p *ProxmoxClient) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Authorization", p.token)
+	log.Debugf("Proxmox: %s %s", req.Method, req.URL.Path)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Data   json.RawMessage   `json:"data"`
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("Cannot decode response to %s: %v", req.URL.Path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var details []string
+		for k, e := range body.Errors {
+			details = append(details, k+": "+strings.TrimSpace(e))
+		}
+		return fmt.Errorf("%s %s failed: %s %s", req.Method, req.URL.Path, resp.Status, strings.Join(details, ", "))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Data, v)
+}
+
+func (p *ProxmoxClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, p.baseURL+"/api2/json"+path, nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req, v)
+}
+
+func (p *ProxmoxClient) post(path string, params url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/api2/json"+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return p.do(req, v)
+}
+
+// waitTask waits for the task with the given UPID to finish
+func (p *ProxmoxClient) waitTask(node, upid string) error {
+	deadline := time.Now().Add(proxmoxTaskTimeout)
+	for time.Now().Before(deadline) {
+		var status struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := p.get(fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid)), &status); err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus != "OK" {
+				return fmt.Errorf("task %s failed: %s", upid, status.ExitStatus)
+			}
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for task %s", upid)
+}
+
+// proxmoxImportName returns the name a disk image is uploaded as, as import
+// content must be named after its format. Raw images such as those of
+// raw-bios and raw-efi, named .img, are uploaded as .raw.
+func proxmoxImportName(filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	switch strings.ToLower(ext) {
+	case ".raw", ".qcow2", ".vmdk":
+		return filename, nil
+	case ".img":
+		return strings.TrimSuffix(filename, ext) + ".raw", nil
+	}
+	return "", fmt.Errorf("Disk images with extension %q cannot be imported, only raw, qcow2 and vmdk images", ext)
+}
+
+// UploadImage uploads a disk image or ISO to a storage on the node. ISOs are
+// uploaded as iso content, other images as import content, which
+// requires Proxmox VE 8.2 or later. It returns the volume ID of the upload.
+func (p *ProxmoxClient) UploadImage(node, storage, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	content := "import"
+	filename := filepath.Base(path)
+	if strings.HasSuffix(path, ".iso") {
+		content = "iso"
+	} else if filename, err = proxmoxImportName(filename); err != nil {
+		return "", err
+	}
+
+	// The multipart body is assembled around the file so that it is
+	// streamed with a known length
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	if err := mw.WriteField("content", content); err != nil {
+		return "", err
+	}
+	if _, err := mw.CreateFormFile("filename", filename); err != nil {
+		return "", err
+	}
+	tail := fmt.Sprintf("\r\n--%s--\r\n", mw.Boundary())
+	progress := newUploadProgress(filename, fi.Size())
+	body := io.MultiReader(&head, progress.Reader(f), strings.NewReader(tail))
+	length := int64(head.Len()) + fi.Size() + int64(len(tail))
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api2/json/nodes/%s/storage/%s/upload", p.baseURL, node, storage), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var upid string
+	err = p.do(req, &upid)
+	progress.Finish()
+	if err != nil {
+		return "", err
+	}
+	if err := p.waitTask(node, upid); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s/%s", storage, content, filename), nil
+}
+
+// NextVMID returns a free VM ID in the cluster
+func (p *ProxmoxClient) NextVMID() (int, error) {
+	// the ID is returned as a string
+	var id json.Number
+	if err := p.get("/cluster/nextid", &id); err != nil {
+		return 0, err
+	}
+	n, err := id.Int64()
+	return int(n), err
+}
+
+// CreateVM creates a VM with the given configuration, see qm.conf(5)
+func (p *ProxmoxClient) CreateVM(node string, vmid int, config url.Values) error {
+	config.Set("vmid", strconv.Itoa(vmid))
+	var upid string
+	if err := p.post(fmt.Sprintf("/nodes/%s/qemu", node), config, &upid); err != nil {
+		return err
+	}
+	return p.waitTask(node, upid)
+}
+
+// ConvertToTemplate turns a VM into a template, which VMs can be cloned
+// from but which cannot be started itself
+func (p *ProxmoxClient) ConvertToTemplate(node string, vmid int) error {
+	// older versions convert the VM right away and return no task
+	var upid string
+	if err := p.post(fmt.Sprintf("/nodes/%s/qemu/%d/template", node, vmid), url.Values{}, &upid); err != nil {
+		return err
+	}
+	if upid == "" {
+		return nil
+	}
+	return p.waitTask(node, upid)
+}
+
+// StartVM boots a VM
+func (p *ProxmoxClient) StartVM(node string, vmid int) error {
+	var upid string
+	if err := p.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, vmid), url.Values{}, &upid); err != nil {
+		return err
+	}
+	return p.waitTask(node, upid)
+}
+
+// ConsoleURL returns the URL of the serial console of a VM in the web interface
+func (p *ProxmoxClient) ConsoleURL(node string, vmid int) string {
+	return fmt.Sprintf("%s/?console=kvm&xtermjs=1&vmid=%d&node=%s", p.baseURL, vmid, url.QueryEscape(node))
+}
+
+// proxmoxVMConfig is the configuration of a VM booting from an uploaded
+// image
+type proxmoxVMConfig struct {
+	Name        string
+	CPUs        int
+	Memory      int
+	Bridge      string
+	DiskStorage string
+	UEFI        bool
+}
+
+// values returns the configuration of a VM which boots from the uploaded
+// volume, see qm.conf(5). ISOs are attached as a CDROM, disk images are
+// copied to a new disk of the VM.
+func (c proxmoxVMConfig) values(volume string) url.Values {
+	config := url.Values{}
+	config.Set("name", c.Name)
+	config.Set("cores", strconv.Itoa(c.CPUs))
+	config.Set("memory", strconv.Itoa(c.Memory))
+	config.Set("ostype", "l26")
+	config.Set("scsihw", "virtio-scsi-single")
+	config.Set("serial0", "socket")
+	config.Set("vga", "serial0")
+	if c.Bridge != "none" {
+		config.Set("net0", "virtio,bridge="+c.Bridge)
+	}
+	if c.UEFI {
+		config.Set("bios", "ovmf")
+		config.Set("machine", "q35")
+		config.Set("efidisk0", c.DiskStorage+":1,efitype=4m,pre-enrolled-keys=0")
+	}
+	if strings.HasSuffix(volume, ".iso") {
+		config.Set("ide2", volume+",media=cdrom")
+		config.Set("boot", "order=ide2")
+	} else {
+		config.Set("scsi0", c.DiskStorage+":0,import-from="+volume)
+		config.Set("boot", "order=scsi0")
+	}
+	return config
+}
@@ -1,58 +1,33 @@
 package main
 
-import (
-	"fmt"
-	"os"
-	"path/filepath"
-
-	log "github.com/sirupsen/logrus"
-)
-
-func pushUsage() {
-	invoked := filepath.Base(os.Args[0])
-	fmt.Printf("USAGE: %s push [backend] [options] [prefix]\n\n", invoked)
-	fmt.Printf("'backend' specifies the push backend.\n")
-	fmt.Printf("Supported backends are\n")
-	// Please keep these in alphabetical order
-	fmt.Printf("  aws\n")
-	fmt.Printf("  azure\n")
-	fmt.Printf("  gcp\n")
-	fmt.Printf("  openstack\n")
-	fmt.Printf("  packet\n")
-	fmt.Printf("  scaleway\n")
-	fmt.Printf("  vcenter\n")
-	fmt.Printf("\n")
-	fmt.Printf("'options' are the backend specific options.\n")
-	fmt.Printf("See '%s push [backend] --help' for details.\n\n", invoked)
-	fmt.Printf("'prefix' specifies the path to the VM image.\n")
-}
-
-func push(args []string) {
-	if len(args) < 1 {
-		pushUsage()
-		os.Exit(1)
-	}
-
-	switch args[0] {
-	// Please keep cases in alphabetical order
-	case "aws":
-		pushAWS(args[1:])
-	case "azure":
-		pushAzure(args[1:])
-	case "gcp":
-		pushGcp(args[1:])
-	case "openstack":
-		pushOpenstack(args[1:])
-	case "packet":
-		pushPacket(args[1:])
-	case "scaleway":
-		pushScaleway(args[1:])
-	case "vcenter":
-		pushVCenter(args[1:])
-	case "help", "-h", "-help", "--help":
-		pushUsage()
-		os.Exit(0)
-	default:
-		log.Errorf("No 'push' backend specified.")
+// pushCommand is 'linuxkit push', with a subcommand for each backend,
+// including the plugins on the PATH
+func pushCommand() *command {
+	c := &command{
+		name:  "push",
+		short: "Push a VM image to a cloud or image store",
+		args:  "[backend] [options] [prefix]",
+		long: `
+'options' are the backend specific options.
+'prefix' specifies the path to the VM image.`,
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "alibaba", short: "Upload an image to OSS and import it as an ECS image", run: pushAlibaba},
+			{name: "aws", short: "Upload an image to S3 and create an AMI from it", run: pushAWS},
+			{name: "azure", short: "Upload a fixed VHD to an Azure managed disk and image", run: pushAzure},
+			{name: "digitalocean", short: "Upload an image to a Space and create a custom image", run: pushDigitalOcean},
+			{name: "gcp", short: "Upload an image to GCS and create a VM image", run: pushGcp},
+			{name: "hetzner", short: "Write a raw image to a Hetzner Cloud server and snapshot it", run: pushHetzner},
+			{name: "ibmcloud", short: "Upload a qcow2 image to Cloud Object Storage and create a VPC image", run: pushIBMCloud},
+			{name: "openstack", short: "Upload an image to OpenStack Glance", run: pushOpenstack},
+			{name: "packet", short: "Upload a kernel+initrd for iPXE booting on Equinix Metal", run: pushPacket},
+			{name: "proxmox", short: "Upload a disk image or ISO to Proxmox VE storage", run: pushProxmox},
+			{name: "registry", short: "Push a kernel+initrd to a container registry as an OCI artifact", run: pushRegistry},
+			{name: "s3", short: "Upload an image or kernel+initrd to S3-compatible storage", run: pushS3},
+			{name: "scaleway", short: "Create a Scaleway image from an EFI ISO", run: pushScaleway},
+			{name: "vcenter", short: "Push an ISO, vmdk or OVA image to a vCenter cluster", run: pushVCenter},
+		},
 	}
+	pluginCommands(c, "Push an image")
+	return c
 }
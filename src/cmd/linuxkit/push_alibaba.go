@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func pushAlibaba(args []string) {
+	flags := newFlagSet("alibaba")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push alibaba [options] path\n\n", invoked)
+		fmt.Printf("'path' is the full path to a qcow2, raw or vhd image. It will be uploaded to OSS and an ECS image will be imported from it.\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	regionFlag := flags.String("region", alibabaDefaultRegion, "Alibaba Cloud region (or "+alibabaRegionVar+")")
+	bucketFlag := flags.String("bucket", "", "OSS bucket to upload to, in the same region (or "+alibabaBucketVar+"). *Required*")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64")
+	uefiFlag := flags.Bool("uefi", false, "The image boots with UEFI")
+	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in OSS and the ECS image. Defaults to the base of 'path' with the file extension removed")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	var format string
+	switch filepath.Ext(path) {
+	case ".qcow2":
+		format = "QCOW2"
+	case ".vhd":
+		format = "VHD"
+	case ".raw", ".img":
+		format = "RAW"
+	default:
+		log.Fatalf("Alibaba Cloud can only import qcow2, raw and vhd images")
+	}
+	bootMode := "BIOS"
+	if *uefiFlag {
+		bootMode = "UEFI"
+	}
+
+	region := getStringValue(alibabaRegionVar, *regionFlag, alibabaDefaultRegion)
+	bucket := getStringValue(alibabaBucketVar, *bucketFlag, "")
+	name := getStringValue("", *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if bucket == "" {
+		log.Fatalf("Please specify the bucket to use")
+	}
+
+	client, err := NewAlibabaClient(os.Getenv(alibabaAccessKeyIDVar), os.Getenv(alibabaAccessKeySecretVar), region)
+	if err != nil {
+		log.Fatalf("Unable to connect to Alibaba Cloud: %v", err)
+	}
+
+	object := name + filepath.Ext(path)
+	log.Infof("Uploading %s to %s/%s", path, bucket, object)
+	if err := client.UploadFile(path, bucket, object, *tags, *uploadOpts); err != nil {
+		log.Fatalf("Error copying to OSS: %v", err)
+	}
+	log.Infof("Importing image %s", name)
+	id, err := client.ImportImage(name, bucket, object, format, *archFlag, bootMode, *tags)
+	if err != nil {
+		log.Fatalf("Error importing image: %v", err)
+	}
+	log.Infof("Created image %s", id)
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -19,7 +21,7 @@ import (
 const timeoutVar = "LINUXKIT_UPLOAD_TIMEOUT"
 
 func pushAWS(args []string) {
-	flags := flag.NewFlagSet("aws", flag.ExitOnError)
+	flags := newFlagSet("aws")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push aws [options] path\n\n", invoked)
@@ -28,10 +30,17 @@ func pushAWS(args []string) {
 		flags.PrintDefaults()
 	}
 	timeoutFlag := flags.Int("timeout", 0, "Upload timeout in seconds")
-	bucketFlag := flags.String("bucket", "", "S3 Bucket to upload to. *Required*")
+	bucketFlag := flags.String("bucket", "", "S3 Bucket to upload to, in the region of the image. Defaults to the staging bucket "+awsStagingBucketPrefix+"<account>-<region>, which is created for the upload if there is none")
+	keepObject := flags.Bool("keep-object", false, "Keep the uploaded image in the staging bucket, and the staging bucket if it was created, once the snapshot has been imported")
+	deleteObject := flags.Bool("delete-object", false, "Delete the uploaded image from the -bucket once the snapshot has been imported. It is always deleted from the staging bucket unless -keep-object is given")
 	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in Amazon S3 and the VM image. Defaults to the base of 'path' with the file extension removed.")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64. arm64 images always have ENA networking enabled")
 	enaFlag := flags.Bool("ena", false, "Enable ENA networking")
 	sriovNetFlag := flags.String("sriov", "", "SRIOV network support, set to 'simple' to enable 82599 VF networking")
+	uefiFlag := flags.Bool("uefi", false, "Register the image to boot with UEFI, for images built with an EFI format. arm64 images always boot with UEFI")
+	deltaFlag := flags.Bool("delta", false, "Write the image to an EBS snapshot directly, uploading only the blocks changed since the last -delta push of the same -img-name. No bucket is used")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -51,6 +60,19 @@ func pushAWS(args []string) {
 	if *sriovNetFlag == "" {
 		sriovNetFlag = nil
 	}
+	arch, err := awsArch(*archFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if arch == ec2.ArchitectureValuesArm64 && !*enaFlag {
+		// Graviton instances are all Nitro based and only have ENA networking
+		log.Infof("Enabling ENA networking for arm64 image")
+		*enaFlag = true
+	}
+	bootMode := "legacy-bios"
+	if *uefiFlag || arch == ec2.ArchitectureValuesArm64 {
+		bootMode = "uefi"
+	}
 
 	sess := session.Must(session.NewSession())
 	storage := s3.New(sess)
@@ -58,42 +80,182 @@ func pushAWS(args []string) {
 	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancelFn()
 
-	if bucket == "" {
-		log.Fatalf("Please provide the bucket to use")
+	if name == "" {
+		name = strings.TrimSuffix(path, filepath.Ext(path))
+		name = filepath.Base(name)
 	}
 
-	f, err := os.Open(path)
-	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
+	compute := ec2.New(sess)
+
+	// the snapshot and the AMI are tagged alike, and named after the image
+	// unless a Name tag is given
+	imageTags := *tags
+	if _, ok := imageTags.Map()["Name"]; !ok {
+		imageTags = append(Tags{{Key: "Name", Value: name}}, imageTags...)
 	}
-	defer f.Close()
 
-	if name == "" {
-		name = strings.TrimSuffix(path, filepath.Ext(path))
-		name = filepath.Base(name)
+	var snapshotID *string
+	if *deltaFlag {
+		snapshotID, err = pushAWSDelta(ctx, sess, compute, path, name, imageTags, *uploadOpts)
+		if err != nil {
+			log.Fatalf("Error writing the snapshot: %v", err)
+		}
+	} else {
+		region := aws.StringValue(sess.Config.Region)
+		if region == "" {
+			log.Fatalf("The region must be set, e.g. with AWS_REGION")
+		}
+		var created bool
+		// images are only deleted from the buckets of the user when asked to
+		keep := !*deleteObject
+		if bucket == "" {
+			if bucket, created, err = awsStagingBucket(sess, storage, region); err != nil {
+				log.Fatal(err)
+			}
+			keep = *keepObject
+		} else if err := awsCheckBucketRegion(storage, bucket, region); err != nil {
+			log.Fatal(err)
+		}
+		deleteBucket := func() error {
+			_, err := storage.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+			return err
+		}
+		removeBucket := func() {}
+		if created && !keep {
+			removeBucket = onCleanup("bucket "+bucket, deleteBucket)
+		}
+		snapshotID = importAWSSnapshot(ctx, storage, compute, path, name, bucket, *tags, imageTags, *uploadOpts, keep)
+		if created && !keep {
+			removeBucket()
+			if err := deleteBucket(); err != nil {
+				log.Warnf("Unable to delete staging bucket %s, it has to be deleted manually: %v", bucket, err)
+			}
+		}
 	}
 
-	fi, err := f.Stat()
-	if err != nil {
-		log.Fatalf("Error reading file information: %v", err)
+	if snapshotID == nil {
+		log.Fatalf("SnapshotID unavailable after import completed")
+	} else {
+		log.Debugf("SnapshotID: %s", *snapshotID)
 	}
 
-	dst := name + filepath.Ext(path)
-	putParams := &s3.PutObjectInput{
-		Bucket:        aws.String(bucket),
-		Key:           aws.String(dst),
-		Body:          f,
-		ContentLength: aws.Int64(fi.Size()),
-		ContentType:   aws.String("application/octet-stream"),
+	regParams := &ec2.RegisterImageInput{
+		Name:         aws.String(name), // Required
+		Architecture: aws.String(arch),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{
+				DeviceName: aws.String("/dev/sda1"),
+				Ebs: &ec2.EbsBlockDevice{
+					DeleteOnTermination: aws.Bool(true),
+					SnapshotId:          snapshotID,
+					VolumeType:          aws.String("standard"),
+				},
+			},
+		},
+		Description:        aws.String(fmt.Sprintf("LinuxKit: %s image", name)),
+		RootDeviceName:     aws.String("/dev/sda1"),
+		VirtualizationType: aws.String("hvm"),
+		EnaSupport:         enaFlag,
+		SriovNetSupport:    sriovNetFlag,
+	}
+	log.Debugf("RegisterImage:\n%v", regParams)
+	regReq, regResp := compute.RegisterImageRequest(regParams)
+	// the boot mode is newer than the vendored SDK
+	awsExtraParams(regReq, url.Values{"BootMode": {bootMode}})
+	if err := regReq.Send(); err != nil {
+		log.Fatalf("Error registering the image: %s; %v", name, err)
 	}
-	log.Debugf("PutObject:\n%v", putParams)
+	log.Infof("Created AMI: %s", *regResp.ImageId)
 
-	_, err = storage.PutObjectWithContext(ctx, putParams)
-	if err != nil {
-		log.Fatalf("Error uploading to S3: %v", err)
+	// the snapshot created by the import task is not tagged, so both are
+	// tagged once the image is registered
+	if _, err := compute.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{regResp.ImageId, snapshotID},
+		Tags:      awsTags(imageTags),
+	}); err != nil {
+		log.Fatalf("Error tagging the image: %v", err)
 	}
+}
 
-	compute := ec2.New(sess)
+// awsExtraParams adds parameters to an EC2 request which the vendored SDK
+// does not know about, once its body is built and before it is signed
+func awsExtraParams(r *request.Request, params url.Values) {
+	if len(params) == 0 {
+		return
+	}
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(r.GetBody())
+		if err != nil {
+			r.Error = err
+			return
+		}
+		r.SetBufferBody([]byte(string(body) + "&" + params.Encode()))
+	})
+}
+
+// awsTagSpecification returns the parameters tagging the resource of the
+// given type created by an EC2 request
+func awsTagSpecification(resourceType string, tags Tags) url.Values {
+	params := url.Values{}
+	if len(tags) == 0 {
+		return params
+	}
+	params.Set("TagSpecification.1.ResourceType", resourceType)
+	for i, tag := range tags {
+		params.Set(fmt.Sprintf("TagSpecification.1.Tag.%d.Key", i+1), tag.Key)
+		params.Set(fmt.Sprintf("TagSpecification.1.Tag.%d.Value", i+1), tag.Value)
+	}
+	return params
+}
+
+// awsTags returns tags in the form the EC2 API takes them
+func awsTags(tags Tags) []*ec2.Tag {
+	var t []*ec2.Tag
+	for _, tag := range tags {
+		t = append(t, &ec2.Tag{Key: aws.String(tag.Key), Value: aws.String(tag.Value)})
+	}
+	return t
+}
+
+// awsArch returns the EC2 name of an architecture
+func awsArch(arch string) (string, error) {
+	switch arch {
+	case "x86_64", "amd64":
+		return ec2.ArchitectureValuesX8664, nil
+	case "arm64", "aarch64":
+		return ec2.ArchitectureValuesArm64, nil
+	}
+	return "", fmt.Errorf("Unsupported architecture %s, must be x86_64 or arm64", arch)
+}
+
+// importAWSSnapshot uploads the image at path to the bucket and imports it as
+// a snapshot, whose ID it returns. The uploaded image is deleted once it has
+// been imported, unless it is kept.
+func importAWSSnapshot(ctx context.Context, storage *s3.S3, compute *ec2.EC2, path, name, bucket string, tags, imageTags Tags, opts uploadOptions, keep bool) *string {
+	dst := name + filepath.Ext(path)
+	object := s3Object{bucket: bucket, key: dst}
+	if len(tags) > 0 {
+		tagging := url.Values{}
+		for _, tag := range tags {
+			tagging.Set(tag.Key, tag.Value)
+		}
+		object.tagging = tagging.Encode()
+	}
+	// images larger than 5GB can only be uploaded in parts
+	if err := s3Upload(ctx, storage, path, object, opts); err != nil {
+		log.Fatalf("Error uploading to S3: %v", err)
+	}
+	deleteObject := func() error {
+		_, err := storage.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(object.bucket), Key: aws.String(object.key)})
+		return err
+	}
+	removeObject := func() {}
+	if !keep {
+		removeObject = onCleanup("object "+object.key, deleteObject)
+	}
 
 	importParams := &ec2.ImportSnapshotInput{
 		Description: aws.String(fmt.Sprintf("LinuxKit: %s", name)),
@@ -108,12 +270,12 @@ func pushAWS(args []string) {
 	}
 	log.Debugf("ImportSnapshot:\n%v", importParams)
 
-	resp, err := compute.ImportSnapshot(importParams)
-	if err != nil {
+	importReq, resp := compute.ImportSnapshotRequest(importParams)
+	awsExtraParams(importReq, awsTagSpecification("import-snapshot-task", imageTags))
+	if err := importReq.Send(); err != nil {
 		log.Fatalf("Error importing snapshot: %v", err)
 	}
 
-	var snapshotID *string
 	for {
 		describeParams := &ec2.DescribeImportSnapshotTasksInput{
 			ImportTaskIds: []*string{
@@ -137,39 +299,12 @@ func pushAWS(args []string) {
 			time.Sleep(60 * time.Second)
 			continue
 		}
-		snapshotID = status.ImportSnapshotTasks[0].SnapshotTaskDetail.SnapshotId
-		break
-	}
-
-	if snapshotID == nil {
-		log.Fatalf("SnapshotID unavailable after import completed")
-	} else {
-		log.Debugf("SnapshotID: %s", *snapshotID)
-	}
-
-	regParams := &ec2.RegisterImageInput{
-		Name:         aws.String(name), // Required
-		Architecture: aws.String("x86_64"),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/sda1"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					SnapshotId:          snapshotID,
-					VolumeType:          aws.String("standard"),
-				},
-			},
-		},
-		Description:        aws.String(fmt.Sprintf("LinuxKit: %s image", name)),
-		RootDeviceName:     aws.String("/dev/sda1"),
-		VirtualizationType: aws.String("hvm"),
-		EnaSupport:         enaFlag,
-		SriovNetSupport:    sriovNetFlag,
-	}
-	log.Debugf("RegisterImage:\n%v", regParams)
-	regResp, err := compute.RegisterImage(regParams)
-	if err != nil {
-		log.Fatalf("Error registering the image: %s; %v", name, err)
+		if !keep {
+			removeObject()
+			if err := deleteObject(); err != nil {
+				log.Warnf("Unable to delete %s from bucket %s, it has to be deleted manually: %v", object.key, bucket, err)
+			}
+		}
+		return status.ImportSnapshotTasks[0].SnapshotTaskDetail.SnapshotId
 	}
-	log.Infof("Created AMI: %s", *regResp.ImageId)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// awsStagingBucketPrefix is the prefix of the buckets images are uploaded
+// to for the import when no bucket is given. They are named after the
+// account and the region, as buckets must be in the region of the import.
+const awsStagingBucketPrefix = "linuxkit-staging-"
+
+// awsBucketRegion returns the region of the bucket
+func awsBucketRegion(storage *s3.S3, bucket string) (string, error) {
+	loc, err := storage.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", err
+	}
+	return s3.NormalizeBucketLocation(aws.StringValue(loc.LocationConstraint)), nil
+}
+
+// awsCheckBucketRegion checks that the bucket is in the region the snapshot
+// is imported in, which the import requires
+func awsCheckBucketRegion(storage *s3.S3, bucket, region string) error {
+	bucketRegion, err := awsBucketRegion(storage, bucket)
+	if err != nil {
+		return fmt.Errorf("Unable to find the region of bucket %s: %v", bucket, err)
+	}
+	if bucketRegion != region {
+		return fmt.Errorf("Bucket %s is in %s, but the image is imported in %s. Use a bucket in %s, or no -bucket to upload to a staging bucket", bucket, bucketRegion, region, region)
+	}
+	return nil
+}
+
+// awsStagingBucket returns the staging bucket of the account in the region,
+// and whether it was created for this import as there was none
+func awsStagingBucket(sess *session.Session, storage *s3.S3, region string) (string, bool, error) {
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to find the account: %v", err)
+	}
+	bucket := awsStagingBucketPrefix + aws.StringValue(identity.Account) + "-" + region
+
+	_, err = storage.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		log.Infof("Using staging bucket %s", bucket)
+		return bucket, false, awsCheckBucketRegion(storage, bucket, region)
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusNotFound {
+		return "", false, fmt.Errorf("Unable to use staging bucket %s: %v", bucket, err)
+	}
+
+	log.Infof("Creating staging bucket %s", bucket)
+	input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	// buckets in us-east-1 are created without a location
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+	if _, err := storage.CreateBucket(input); err != nil {
+		return "", false, fmt.Errorf("Unable to create staging bucket %s: %v", bucket, err)
+	}
+	if err := storage.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		return "", false, fmt.Errorf("Staging bucket %s was not created: %v", bucket, err)
+	}
+	return bucket, true, nil
+}
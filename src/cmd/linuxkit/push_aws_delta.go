@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ebsBlockSize is the size of the blocks of EBS snapshots
+	ebsBlockSize = 512 * 1024
+	// ebsEndpointVar overrides the endpoint of the EBS direct APIs
+	ebsEndpointVar = "LINUXKIT_EBS_ENDPOINT"
+)
+
+// ebsClient sends requests to the EBS direct APIs, which write the blocks
+// of snapshots and are not in the vendored SDK
+type ebsClient struct {
+	endpoint string
+	region   string
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+func newEBSClient(sess *session.Session) (*ebsClient, error) {
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return nil, fmt.Errorf("the region must be set, e.g. with AWS_REGION")
+	}
+	endpoint := getStringValue(ebsEndpointVar, "", "https://ebs."+region+".amazonaws.com")
+	return &ebsClient{
+		endpoint: endpoint,
+		region:   region,
+		signer:   v4.NewSigner(sess.Config.Credentials),
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (c *ebsClient) do(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) error {
+	// the signer sets the body, but not its length
+	req, err := http.NewRequest(method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if _, err := c.signer.Sign(req, bytes.NewReader(body), "ebs", c.region, time.Now()); err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message      string
+			LowerMessage string `json:"message"`
+		}
+		_ = json.Unmarshal(b, &e)
+		if e.Message == "" {
+			e.Message = e.LowerMessage
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Message)
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+// startSnapshot starts a snapshot of size GiB, with the blocks of parent
+// if it is set
+func (c *ebsClient) startSnapshot(ctx context.Context, size int64, parent, description string, tags Tags) (string, error) {
+	type tag struct {
+		Key   string
+		Value string
+	}
+	input := struct {
+		VolumeSize       int64
+		ParentSnapshotId string `json:",omitempty"`
+		Description      string
+		Tags             []tag `json:",omitempty"`
+		ClientToken      string
+	}{VolumeSize: size, ParentSnapshotId: parent, Description: description, ClientToken: uuid.New().String()}
+	for _, t := range tags {
+		input.Tags = append(input.Tags, tag{Key: t.Key, Value: t.Value})
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		SnapshotId string
+		BlockSize  int
+	}
+	if err := c.do(ctx, http.MethodPost, "/snapshots", http.Header{"Content-Type": {"application/json"}}, body, &out); err != nil {
+		return "", err
+	}
+	if out.BlockSize != 0 && out.BlockSize != ebsBlockSize {
+		return "", fmt.Errorf("unexpected block size %d of snapshot %s", out.BlockSize, out.SnapshotId)
+	}
+	return out.SnapshotId, nil
+}
+
+// putBlock writes the block at index of a snapshot
+func (c *ebsClient) putBlock(ctx context.Context, snapshot string, index int64, data []byte) error {
+	sum := sha256.Sum256(data)
+	header := http.Header{
+		"Content-Type":             {"application/octet-stream"},
+		"X-Amz-Data-Length":        {strconv.Itoa(len(data))},
+		"X-Amz-Checksum":           {base64.StdEncoding.EncodeToString(sum[:])},
+		"X-Amz-Checksum-Algorithm": {"SHA256"},
+	}
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/snapshots/%s/blocks/%d", snapshot, index), header, data, nil)
+}
+
+// completeSnapshot seals a snapshot to which changed blocks were written
+func (c *ebsClient) completeSnapshot(ctx context.Context, snapshot string, changed int) error {
+	header := http.Header{"X-Amz-Changedblockscount": {strconv.Itoa(changed)}}
+	return c.do(ctx, http.MethodPost, "/snapshots/completion/"+snapshot, header, nil, nil)
+}
+
+// ebsDeltaState is the state of the last delta push of an image, whose
+// snapshot is the parent of the next one
+type ebsDeltaState struct {
+	Target     string `json:"target"`
+	SnapshotID string `json:"snapshot_id"`
+	Size       int64  `json:"size"`
+	// Blocks are the SHA256 of each block, or empty if it is zeroes
+	Blocks []string `json:"blocks"`
+
+	file string
+}
+
+func loadDeltaState(target string) *ebsDeltaState {
+	h := sha256.Sum256([]byte(target))
+	s := &ebsDeltaState{Target: target, file: filepath.Join(defaultUploadStateDir(), "delta-"+hex.EncodeToString(h[:])+".json")}
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return s
+	}
+	var saved ebsDeltaState
+	if err := json.Unmarshal(b, &saved); err != nil || saved.Target != target {
+		log.Warnf("Ignoring invalid delta state %s", s.file)
+		return s
+	}
+	saved.file = s.file
+	return &saved
+}
+
+func (s *ebsDeltaState) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// blockHashes returns the hashes of the blocks of f, which are empty for
+// the blocks of zeroes
+func blockHashes(f io.Reader) ([]string, error) {
+	var hashes []string
+	block := make([]byte, ebsBlockSize)
+	zero := make([]byte, ebsBlockSize)
+	for {
+		n, err := io.ReadFull(f, block)
+		if n > 0 {
+			// the last block is padded with zeroes
+			for i := n; i < ebsBlockSize; i++ {
+				block[i] = 0
+			}
+			if bytes.Equal(block, zero) {
+				hashes = append(hashes, "")
+			} else {
+				sum := sha256.Sum256(block)
+				hashes = append(hashes, hex.EncodeToString(sum[:]))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pushAWSDelta writes the raw image at path to an EBS snapshot with the EBS
+// direct APIs and returns its ID. The snapshot of the last delta push of
+// the image to the region is its parent, so only the blocks which changed
+// since are uploaded.
+func pushAWSDelta(ctx context.Context, sess *session.Session, compute *ec2.EC2, path, name string, tags Tags, opts uploadOptions) (_ *string, err error) {
+	client, err := newEBSClient(sess)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	gib := (size + 1<<30 - 1) >> 30
+	hashes, err := blockHashes(f)
+	if err != nil {
+		return nil, err
+	}
+
+	state := loadDeltaState(fmt.Sprintf("ebs://%s/%s", client.region, name))
+	description := fmt.Sprintf("LinuxKit: %s disk", name)
+	var snapshot string
+	parent := state.SnapshotID
+	if parent != "" {
+		snapshot, err = client.startSnapshot(ctx, gib, parent, description, tags)
+		if err != nil {
+			log.Warnf("Unable to base the snapshot on %s of the last push, uploading all the image: %v", parent, err)
+			parent = ""
+		}
+	}
+	if parent == "" {
+		if snapshot, err = client.startSnapshot(ctx, gib, "", description, tags); err != nil {
+			return nil, fmt.Errorf("Error starting the snapshot: %v", err)
+		}
+		state.Blocks = nil
+	}
+
+	// the blocks of a new snapshot are zeroes, while the blocks of the
+	// parent which are now zeroes, or beyond the end of the image, are
+	// overwritten
+	var changed []int64
+	for i := int64(0); i < gib<<30/ebsBlockSize; i++ {
+		h, old := "", ""
+		if i < int64(len(hashes)) {
+			h = hashes[i]
+		}
+		if i < int64(len(state.Blocks)) {
+			old = state.Blocks[i]
+		}
+		if h != old {
+			changed = append(changed, i)
+		}
+	}
+	if parent != "" {
+		log.Infof("Uploading %d of the %d blocks of %s to %s, based on %s", len(changed), len(hashes), path, snapshot, parent)
+	} else {
+		log.Infof("Uploading %d of the %d blocks of %s to %s", len(changed), len(hashes), path, snapshot)
+	}
+
+	start := time.Now()
+	span := trace.Start("upload", "file", path, "destination", "ebs://"+client.region+"/"+snapshot)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		metrics.Upload("ebs", start, err)
+	}()
+	progress := newUploadProgress(filepath.Base(path), int64(len(changed))*ebsBlockSize)
+	err = uploadParts(int64(len(changed)), 1, opts.Parallel, nil, func(n int, _, _ int64) error {
+		index := changed[n-1]
+		block := make([]byte, ebsBlockSize)
+		if _, err := f.ReadAt(block, index*ebsBlockSize); err != nil && err != io.EOF {
+			return err
+		}
+		if err := client.putBlock(ctx, snapshot, index, block); err != nil {
+			return fmt.Errorf("Error uploading block %d: %v", index, err)
+		}
+		progress.Add(ebsBlockSize)
+		return nil
+	})
+	progress.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.completeSnapshot(ctx, snapshot, len(changed)); err != nil {
+		return nil, fmt.Errorf("Error completing the snapshot: %v", err)
+	}
+
+	for {
+		out, err := compute.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(snapshot)}})
+		if err != nil {
+			return nil, fmt.Errorf("Error getting the status of the snapshot: %v", err)
+		}
+		if len(out.Snapshots) == 0 {
+			return nil, fmt.Errorf("Snapshot %s not found", snapshot)
+		}
+		status := aws.StringValue(out.Snapshots[0].State)
+		if status == ec2.SnapshotStateCompleted {
+			break
+		}
+		if status == ec2.SnapshotStateError {
+			return nil, fmt.Errorf("Snapshot %s failed: %s", snapshot, aws.StringValue(out.Snapshots[0].StateMessage))
+		}
+		log.Debugf("Snapshot %s is %s, %s. Waiting 10 seconds...", snapshot, status, aws.StringValue(out.Snapshots[0].Progress))
+		time.Sleep(10 * time.Second)
+	}
+
+	state.SnapshotID = snapshot
+	state.Size = size
+	state.Blocks = hashes
+	if err := state.save(); err != nil {
+		log.Warnf("Unable to save the state of the delta push, the next push uploads all the image: %v", err)
+	}
+	return aws.String(snapshot), nil
+}
@@ -1,27 +1,41 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Process the run arguments and execute run
 func pushAzure(args []string) {
-	flags := flag.NewFlagSet("azure", flag.ExitOnError)
+	flags := newFlagSet("azure")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push azure [options] path\n\n", invoked)
 		fmt.Printf("Push a disk image to Azure\n")
-		fmt.Printf("'path' specifies the path to a VHD. It will be uploaded to an Azure Storage Account.\n")
+		fmt.Printf("'path' specifies the path to a fixed VHD. It is uploaded to a managed disk\n")
+		fmt.Printf("and turned into a managed image, which can be published in a Shared Image\n")
+		fmt.Printf("Gallery with -gallery. With -storage-account it is only uploaded as a\n")
+		fmt.Printf("page blob to the storage account instead.\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
 
 	resourceGroup := flags.String("resource-group", "", "Name of resource group to be used for VM")
-	accountName := flags.String("storage-account", "", "Name of the storage account")
+	accountName := flags.String("storage-account", "", "Name of the storage account to upload the VHD to as a page blob, instead of creating a managed image")
+	location := flags.String("location", "westus", "Location of the managed image")
+	nameFlag := flags.String("img-name", "", "Name of the managed image. Defaults to the base of 'path' with the file extension removed")
+	generation := flags.Int("generation", 1, "Hyper-V generation of the image, 1 or 2. Generation 2 images boot with UEFI")
+	gallery := flags.String("gallery", "", "Shared Image Gallery to publish the image in, which is created if it does not exist")
+	definition := flags.String("gallery-image", "", "Image definition in the gallery, which is created if it does not exist. Defaults to the name of the image")
+	version := flags.String("gallery-version", "", "Version of the image in the gallery, as major.minor.patch. *Required* with -gallery")
+	regions := flags.String("replicate", "", "Comma separated list of regions to replicate the gallery image to, besides -location")
+	replicas := flags.Int("replicas", 1, "Number of replicas of the gallery image in each region")
+	parallel := parallelFlag(flags)
+	tags := tagFlag(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -35,6 +49,16 @@ func pushAzure(args []string) {
 	}
 	path := remArgs[0]
 
+	if *generation != 1 && *generation != 2 {
+		log.Fatalf("Invalid generation %d, must be 1 or 2", *generation)
+	}
+	if *gallery != "" && *version == "" {
+		log.Fatalf("Please provide the version of the image in the gallery with -gallery-version")
+	}
+	if *gallery != "" && *accountName != "" {
+		log.Fatalf("-gallery cannot be used with -storage-account")
+	}
+
 	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
 	tenantID := getEnvVarOrExit("AZURE_TENANT_ID")
 
@@ -42,6 +66,56 @@ func pushAzure(args []string) {
 	clientSecret := getEnvVarOrExit("AZURE_CLIENT_SECRET")
 
 	initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret)
+	setAzureTags(*tags)
 
-	uploadVMImage(*resourceGroup, *accountName, path)
+	if *accountName != "" {
+		uploadVMImage(*resourceGroup, *accountName, path)
+		return
+	}
+
+	if *resourceGroup == "" {
+		log.Fatalf("Please provide the resource group of the image with -resource-group")
+	}
+	name := *nameFlag
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	ensureVHDSanity(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Fatalf("Unable to read VHD: %v", err)
+	}
+
+	group := createResourceGroup(*resourceGroup, *location)
+	// the disk is only needed until the image is created from it
+	diskName := name + "-upload"
+	diskID := createUploadDisk(*group, diskName, *location, fi.Size(), *generation)
+	removeDisk := onCleanup("disk "+diskName, func() error {
+		return deleteDisk(*group, diskName)
+	})
+	uploadToDisk(*group, diskName, path, *parallel)
+	imageID := createManagedImageFromDisk(*group, diskID, name, *location, *generation)
+	removeDisk()
+	if err := deleteDisk(*group, diskName); err != nil {
+		log.Warnf("Unable to delete disk %s, it has to be deleted manually: %v", diskName, err)
+	}
+	fmt.Printf("Created managed image %s\n", imageID)
+
+	if *gallery == "" {
+		return
+	}
+	g := galleryImage{
+		Gallery:    *gallery,
+		Definition: *definition,
+		Version:    *version,
+		Replicas:   *replicas,
+	}
+	if g.Definition == "" {
+		g.Definition = name
+	}
+	if *regions != "" {
+		g.Regions = strings.Split(*regions, ",")
+	}
+	versionID := publishGalleryImage(*group, imageID, *location, *generation, g)
+	fmt.Printf("Published gallery image %s\n", versionID)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	digitalOceanSpacesKeyVar    = "SPACES_ACCESS_KEY_ID"
+	digitalOceanSpacesSecretVar = "SPACES_SECRET_ACCESS_KEY"
+	digitalOceanSpaceVar        = "DIGITALOCEAN_SPACE"
+
+	defaultDigitalOceanDistribution = "Unknown OS"
+)
+
+// digitalOceanImageExts are the extensions of the disk images DigitalOcean
+// can import, which may also be compressed with gzip or bzip2
+var digitalOceanImageExts = []string{".img", ".raw", ".qcow2", ".vhdx", ".vdi", ".vmdk"}
+
+func pushDigitalOcean(args []string) {
+	flags := newFlagSet("digitalocean")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push digitalocean [options] path\n\n", invoked)
+		fmt.Printf("'path' is the full path to a raw, qcow2, vhdx, vdi or vmdk image, which\n")
+		fmt.Printf("may be compressed with gzip or bzip2. It is uploaded to a Space and a\n")
+		fmt.Printf("custom image is created from it. The ID of the image is printed once it is\n")
+		fmt.Printf("available.\n\n")
+		fmt.Printf("Spaces credentials are read from %s and %s.\n\n", digitalOceanSpacesKeyVar, digitalOceanSpacesSecretVar)
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	tokenFlag := flags.String("token", "", "DigitalOcean API token (or "+digitalOceanTokenVar+")")
+	regionFlag := flags.String("region", defaultDigitalOceanRegion, "Region of the image (or "+digitalOceanRegionVar+")")
+	spaceFlag := flags.String("space", "", "Space to upload the image to (or "+digitalOceanSpaceVar+"). *Required*")
+	spaceRegionFlag := flags.String("space-region", "", "Region of the Space. Defaults to the region of the image")
+	prefixFlag := flags.String("prefix", "", "Prefix of the object key in the Space, for example images/")
+	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in the Space and the image. Defaults to the base of 'path' with the file extension removed")
+	distributionFlag := flags.String("distribution", defaultDigitalOceanDistribution, "Distribution of the image, as shown in the control panel")
+	descriptionFlag := flags.String("description", "", "Description of the image")
+	keepObject := flags.Bool("keep-object", false, "Keep the uploaded file in the Space once the image has been created")
+	timeoutFlag := flags.Int("timeout", 0, "Upload timeout in seconds")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	// the extension of the object keeps the compression, if any
+	base := filepath.Base(path)
+	var compression string
+	if c := filepath.Ext(base); c == ".gz" || c == ".bz2" {
+		compression = c
+		base = strings.TrimSuffix(base, c)
+	}
+	format := filepath.Ext(base)
+	base = strings.TrimSuffix(base, format)
+	supported := false
+	for _, e := range digitalOceanImageExts {
+		if format == e {
+			supported = true
+		}
+	}
+	if !supported {
+		log.Fatalf("DigitalOcean cannot import %s images", format)
+	}
+	ext := format + compression
+
+	token := getStringValue(digitalOceanTokenVar, *tokenFlag, "")
+	region := getStringValue(digitalOceanRegionVar, *regionFlag, defaultDigitalOceanRegion)
+	space := getStringValue(digitalOceanSpaceVar, *spaceFlag, "")
+	spaceRegion := getStringValue("", *spaceRegionFlag, region)
+	name := getStringValue(nameVar, *nameFlag, base)
+	timeout := getIntValue(timeoutVar, *timeoutFlag, 600)
+	if space == "" {
+		log.Fatalf("Please specify the Space to use")
+	}
+
+	client, err := NewDigitalOceanClient(token)
+	if err != nil {
+		log.Fatalf("Unable to connect to DigitalOcean: %v", err)
+	}
+
+	// Spaces are S3-compatible, the region only matters for the signature
+	cfg := aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(fmt.Sprintf("https://%s.digitaloceanspaces.com", spaceRegion))
+	if key := os.Getenv(digitalOceanSpacesKeyVar); key != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(key, os.Getenv(digitalOceanSpacesSecretVar), ""))
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		log.Fatalf("Unable to create a session: %v", err)
+	}
+	storage := s3.New(sess)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancelFn()
+
+	object := s3Object{bucket: space, key: *prefixFlag + name + ext}
+	deleteObject := func() error {
+		_, err := storage.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(object.bucket), Key: aws.String(object.key)})
+		return err
+	}
+	log.Infof("Uploading %s to %s/%s", path, space, object.key)
+	if err := s3Upload(ctx, storage, path, object, *uploadOpts); err != nil {
+		log.Fatalf("Error uploading %s: %v", path, err)
+	}
+	removeObject := func() {}
+	if !*keepObject {
+		removeObject = onCleanup("object "+object.key, deleteObject)
+	}
+
+	// the object stays private, DigitalOcean downloads it from a presigned URL
+	imageURL, err := s3URL(storage, object, time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Creating image %s in %s", name, region)
+	image, err := client.CreateCustomImage(name, imageURL, region, *distributionFlag, *descriptionFlag, digitalOceanTags(*tags))
+	if err != nil {
+		log.Fatalf("Error creating image: %v", err)
+	}
+	if !*keepObject {
+		removeObject()
+		if err := deleteObject(); err != nil {
+			log.Warnf("Unable to delete %s from the Space, it has to be deleted manually: %v", object.key, err)
+		}
+	}
+	fmt.Println(image.ID)
+}
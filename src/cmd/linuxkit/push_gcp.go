@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,7 +10,7 @@ import (
 )
 
 func pushGcp(args []string) {
-	flags := flag.NewFlagSet("gcp", flag.ExitOnError)
+	flags := newFlagSet("gcp")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push gcp [options] path\n\n", invoked)
@@ -25,7 +24,13 @@ func pushGcp(args []string) {
 	publicFlag := flags.Bool("public", false, "Select if file on GCS should be public. *Optional*")
 	familyFlag := flags.String("family", "", "GCP Image Family. A group of images where the family name points to the most recent image. *Optional*")
 	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in Google Storage and the VM image. Defaults to the base of 'path' with the '.img.tar.gz' suffix removed")
-	nestedVirt := flags.Bool("nested-virt", false, "Enabled nested virtualization for the image")
+	nestedVirt := flags.Bool("nested-virt", false, "Enable nested virtualization for the image with the enable-vmx license, which run gcp -nested-virt does not need")
+	uefi := flags.Bool("uefi", false, "Mark the image as UEFI compatible, required for Shielded VMs")
+	featuresFlag := flags.String("guest-os-features", "", "Comma separated guest OS features of the image, e.g. UEFI_COMPATIBLE,SEV_CAPABLE,GVNIC. SEV_CAPABLE is required for Confidential VMs")
+	gvnic := flags.Bool("gvnic", false, "Mark the image as supporting the gVNIC network interface, which is needed for higher network bandwidth and on some machine types")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64. arm64 images are always UEFI_COMPATIBLE and GVNIC, as required by Arm machine types like T2A")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -52,6 +57,30 @@ func pushGcp(args []string) {
 		name = filepath.Base(name)
 	}
 
+	arch, err := gcpArch(*archFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var features []string
+	if *featuresFlag != "" {
+		features = strings.Split(*featuresFlag, ",")
+	}
+	addFeature := func(feature string) {
+		for _, f := range features {
+			if f == feature {
+				return
+			}
+		}
+		features = append(features, feature)
+	}
+	// Arm machine types only boot with UEFI and only have gVNIC networking
+	if *uefi || arch == "ARM64" {
+		addFeature("UEFI_COMPATIBLE")
+	}
+	if *gvnic || arch == "ARM64" {
+		addFeature("GVNIC")
+	}
+
 	client, err := NewGCPClient(keys, project)
 	if err != nil {
 		log.Fatalf("Unable to connect to GCP: %v", err)
@@ -61,12 +90,24 @@ func pushGcp(args []string) {
 		log.Fatalf("Please specify the bucket to use")
 	}
 
-	err = client.UploadFile(path, name+suffix, bucket, public)
+	err = client.UploadFile(path, name+suffix, bucket, public, tags.Map(), *uploadOpts)
 	if err != nil {
 		log.Fatalf("Error copying to Google Storage: %v", err)
 	}
-	err = client.CreateImage(name, "https://storage.googleapis.com/"+bucket+"/"+name+suffix, family, *nestedVirt, true)
+	err = client.CreateImage(name, "https://storage.googleapis.com/"+bucket+"/"+name+suffix, family, arch, features, tags.Map(), *nestedVirt, true)
 	if err != nil {
 		log.Fatalf("Error creating Google Compute Image: %v", err)
 	}
 }
+
+// gcpArch returns the architecture of an image in the compute API, or an
+// empty string for x86_64, which is the default
+func gcpArch(arch string) (string, error) {
+	switch arch {
+	case "x86_64", "amd64":
+		return "", nil
+	case "arm64", "aarch64":
+		return "ARM64", nil
+	}
+	return "", fmt.Errorf("Unsupported architecture %s, must be x86_64 or arm64", arch)
+}
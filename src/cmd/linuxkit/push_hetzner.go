@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHetznerServerType      = "cx22"
+	defaultHetznerServerTypeARM64 = "cax11"
+)
+
+func pushHetzner(args []string) {
+	flags := newFlagSet("hetzner")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push hetzner [options] path\n\n", invoked)
+		fmt.Printf("'path' is the full path to a raw disk image. Hetzner Cloud cannot import\n")
+		fmt.Printf("images, so a helper server is booted into the rescue system, the image is\n")
+		fmt.Printf("written to its disk over ssh and a snapshot is taken of it. The helper\n")
+		fmt.Printf("server is deleted afterwards and the ID of the snapshot is printed.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	tokenFlag := flags.String("token", "", "Hetzner Cloud API token (or "+hetznerTokenVar+")")
+	locationFlag := flags.String("location", defaultHetznerLocation, "Location of the helper server (or "+hetznerLocationVar+")")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64")
+	serverTypeFlag := flags.String("server-type", "", "Type of the helper server. Defaults to "+defaultHetznerServerType+", or "+defaultHetznerServerTypeARM64+" for arm64. Its disk must be at least as large as the image, servers created from the snapshot need a disk at least as large")
+	nameFlag := flags.String("img-name", "", "Description of the snapshot. Defaults to the base of 'path' with the file extension removed")
+	tags := tagFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+	if ext := filepath.Ext(path); ext != ".img" && ext != ".raw" {
+		log.Fatalf("Hetzner Cloud snapshots can only be created from raw images")
+	}
+
+	token := getStringValue(hetznerTokenVar, *tokenFlag, "")
+	location := getStringValue(hetznerLocationVar, *locationFlag, defaultHetznerLocation)
+	name := getStringValue(nameVar, *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	serverType := *serverTypeFlag
+	switch *archFlag {
+	case "x86_64", "amd64":
+		serverType = getStringValue("", serverType, defaultHetznerServerType)
+	case "arm64", "aarch64":
+		serverType = getStringValue("", serverType, defaultHetznerServerTypeARM64)
+	default:
+		log.Fatalf("Invalid architecture %s, must be x86_64 or arm64", *archFlag)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Unable to open image: %v", err)
+	}
+	defer f.Close()
+
+	client, err := NewHetznerClient(token)
+	if err != nil {
+		log.Fatalf("Unable to connect to Hetzner Cloud: %v", err)
+	}
+
+	// an ssh key only for this upload is added to the rescue system
+	signer, publicKey, err := newHetznerSSHKey()
+	if err != nil {
+		log.Fatalf("Unable to create an ssh key: %v", err)
+	}
+	helper := name + "-upload"
+	keyID, err := client.CreateSSHKey(helper, publicKey)
+	if err != nil {
+		log.Fatalf("Unable to add the ssh key: %v", err)
+	}
+	removeKey := onCleanup("ssh key "+helper, func() error {
+		return client.DeleteSSHKey(keyID)
+	})
+
+	log.Infof("Creating helper server %s", helper)
+	serverID, ip, err := client.CreateStoppedServer(helper, serverType, hetznerHelperImage, location, tags.Map())
+	removeServer := func() {}
+	if serverID != 0 {
+		removeServer = onCleanup("server "+helper, func() error {
+			return client.DeleteServer(serverID)
+		})
+	}
+	if err != nil {
+		log.Fatalf("Unable to create the helper server: %v", err)
+	}
+	log.Infof("Booting %s into the rescue system", helper)
+	if err := client.BootRescue(serverID, keyID); err != nil {
+		log.Fatalf("Unable to boot the rescue system: %v", err)
+	}
+	log.Infof("Writing %s to the disk of %s", path, helper)
+	if err := writeRescueDisk(ip, signer, f); err != nil {
+		log.Fatalf("Unable to write the image: %v", err)
+	}
+	if err := client.PowerOff(serverID); err != nil {
+		log.Fatalf("Unable to power off %s: %v", helper, err)
+	}
+	log.Infof("Creating snapshot %s", name)
+	snapshotID, err := client.CreateSnapshot(serverID, name, tags.Map())
+	if err != nil {
+		log.Fatalf("Unable to create the snapshot: %v", err)
+	}
+
+	removeServer()
+	if err := client.DeleteServer(serverID); err != nil {
+		log.Warnf("Unable to delete the helper server %s, it has to be deleted manually: %v", helper, err)
+	}
+	removeKey()
+	if err := client.DeleteSSHKey(keyID); err != nil {
+		log.Warnf("Unable to delete the ssh key %s, it has to be deleted manually: %v", helper, err)
+	}
+	fmt.Println(snapshotID)
+}
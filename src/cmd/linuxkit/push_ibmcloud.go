@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultIBMCloudOS = "debian-12-amd64"
+)
+
+func pushIBMCloud(args []string) {
+	flags := newFlagSet("ibmcloud")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push ibmcloud [options] path\n\n", invoked)
+		fmt.Printf("'path' is the full path to a qcow2 image. It will be uploaded to Cloud Object Storage and a VPC custom image will be created from it.\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	apiKeyFlag := flags.String("api-key", "", "IBM Cloud API key (or "+ibmcloudAPIKeyVar+")")
+	regionFlag := flags.String("region", ibmcloudDefaultRegion, "IBM Cloud region (or "+ibmcloudRegionVar+")")
+	bucketFlag := flags.String("bucket", "", "Cloud Object Storage bucket to upload to, in the same region (or "+ibmcloudBucketVar+"). *Required*")
+	resourceGroupFlag := flags.String("resource-group", "", "ID of the resource group of the image (or "+ibmcloudResourceGroupVar+", default the account default)")
+	osFlag := flags.String("os", defaultIBMCloudOS, "Operating system name to register the image as, which determines the compatible profiles")
+	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in Cloud Object Storage and the VM image. Defaults to the base of 'path' with the file extension removed")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+	if filepath.Ext(path) != ".qcow2" {
+		log.Fatalf("IBM Cloud can only import qcow2 images")
+	}
+
+	apiKey := getStringValue(ibmcloudAPIKeyVar, *apiKeyFlag, "")
+	region := getStringValue(ibmcloudRegionVar, *regionFlag, ibmcloudDefaultRegion)
+	bucket := getStringValue(ibmcloudBucketVar, *bucketFlag, "")
+	resourceGroup := getStringValue(ibmcloudResourceGroupVar, *resourceGroupFlag, "")
+	name := getStringValue("", *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	if bucket == "" {
+		log.Fatalf("Please specify the bucket to use")
+	}
+
+	client, err := NewIBMCloudClient(apiKey, region)
+	if err != nil {
+		log.Fatalf("Unable to connect to IBM Cloud: %v", err)
+	}
+
+	object := name + ".qcow2"
+	log.Infof("Uploading %s to %s/%s", path, bucket, object)
+	if err := client.UploadFile(path, bucket, object, *tags, *uploadOpts); err != nil {
+		log.Fatalf("Error copying to Cloud Object Storage: %v", err)
+	}
+	log.Infof("Creating image %s", name)
+	id, err := client.CreateImage(name, bucket, object, *osFlag, resourceGroup, *tags)
+	if err != nil {
+		log.Fatalf("Error creating image: %v", err)
+	}
+	log.Infof("Created image %s", id)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path"
@@ -11,14 +10,13 @@ import (
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
-	"github.com/gophercloud/utils/openstack/clientconfig"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // Process the run arguments and execute run
 func pushOpenstack(args []string) {
-	flags := flag.NewFlagSet("openstack", flag.ExitOnError)
+	flags := newFlagSet("openstack")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push openstack [options] path\n\n", invoked)
@@ -27,6 +25,15 @@ func pushOpenstack(args []string) {
 		flags.PrintDefaults()
 	}
 	imageName := flags.String("img-name", "", "A unique name for the image, if blank the filename will be used")
+	cloudFlag := flags.String("cloud", "", "Name of the cloud in clouds.yaml (or "+osCloudVar+", default to authenticate with the OS_* environment variables)")
+	regionFlag := flags.String("region", "", "Region (or "+osRegionVar+", default the region of the cloud)")
+	tags := tagFlag(flags)
+	visibility := flags.String("visibility", "private", "Who can see and boot the image: private, shared, community or public. Public images can usually only be created by administrators")
+	uefi := flags.Bool("uefi", false, "Boot the image with UEFI, setting hw_firmware_type=uefi")
+	diskBus := flags.String("disk-bus", "", "Bus of the disk the image is attached to, e.g. virtio, scsi or ide, setting hw_disk_bus")
+	osType := flags.String("os-type", "linux", "Operating system of the image, setting os_type. Empty to leave it unset")
+	var propertyFlags multipleFlag
+	flags.Var(&propertyFlags, "property", "Image property to set as key=value, e.g. hw_qemu_guest_agent=yes, may be repeated")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -42,15 +49,39 @@ func pushOpenstack(args []string) {
 	// Check that the file both exists, and can be read
 	checkFile(filePath)
 
-	client, err := clientconfig.NewServiceClient("image", nil)
+	switch images.ImageVisibility(*visibility) {
+	case images.ImageVisibilityPrivate, images.ImageVisibilityShared, images.ImageVisibilityCommunity, images.ImageVisibilityPublic:
+	default:
+		log.Fatalf("Invalid visibility %s, must be private, shared, community or public", *visibility)
+	}
+	properties := map[string]string{}
+	if *uefi {
+		properties["hw_firmware_type"] = "uefi"
+	}
+	if *diskBus != "" {
+		properties["hw_disk_bus"] = *diskBus
+	}
+	if *osType != "" {
+		properties["os_type"] = *osType
+	}
+	for _, p := range propertyFlags {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Fatalf("Invalid property %q, must be key=value", p)
+		}
+		properties[kv[0]] = kv[1]
+	}
+
+	cloud := getStringValue(osCloudVar, *cloudFlag, "")
+	client, err := openstackServiceClient("image", cloud, *regionFlag)
 	if err != nil {
 		log.Fatalf("Error connecting to your OpenStack cloud: %s", err)
 	}
 
-	createOpenStackImage(filePath, *imageName, client)
+	createOpenStackImage(filePath, *imageName, *tags, properties, images.ImageVisibility(*visibility), client)
 }
 
-func createOpenStackImage(filePath string, imageName string, client *gophercloud.ServiceClient) {
+func createOpenStackImage(filePath string, imageName string, tags Tags, properties map[string]string, visibility images.ImageVisibility, client *gophercloud.ServiceClient) {
 	// Image formats that are supported by both LinuxKit and OpenStack Glance V2
 	formats := []string{"ami", "vhd", "vhdx", "vmdk", "raw", "qcow2", "iso"}
 
@@ -78,6 +109,9 @@ func createOpenStackImage(filePath string, imageName string, client *gophercloud
 		Name:            imageName,
 		ContainerFormat: "bare",
 		DiskFormat:      fileExtension,
+		Tags:            tags.Strings(),
+		Visibility:      &visibility,
+		Properties:      properties,
 	}
 	image, err := images.Create(client, imageOpts).Extract()
 	if err != nil {
@@ -90,8 +124,18 @@ func createOpenStackImage(filePath string, imageName string, client *gophercloud
 	}
 	defer f.Close()
 
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Can't read image file: %s", err)
+	}
+
 	log.Infof("Uploading file %s with Image ID %s", filePath, image.ID)
-	imagedata.Upload(client, image.ID, f)
+	progress := newUploadProgress(filepath.Base(filePath), fi.Size())
+	err = imagedata.Upload(client, image.ID, progress.Reader(f)).ExtractErr()
+	progress.Finish()
+	if err != nil {
+		log.Fatalf("Error uploading image: %s", err)
+	}
 
 	// Validate the uploaded image.  If it's anything other than 'active'
 	// then there's been a problem
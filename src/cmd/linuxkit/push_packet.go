@@ -2,7 +2,6 @@ package main
 
 import (
 	"compress/gzip"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -30,7 +29,7 @@ func init() {
 
 // Process the run arguments and execute run
 func pushPacket(args []string) {
-	flags := flag.NewFlagSet("packet", flag.ExitOnError)
+	flags := newFlagSet("packet")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push packet [options] [name]\n\n", invoked)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Process the push arguments and execute push
+func pushProxmox(args []string) {
+	flags := newFlagSet("proxmox")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push proxmox [options] path\n\n", invoked)
+		fmt.Printf("'path' is the disk image or ISO to upload to a storage of a Proxmox VE\n")
+		fmt.Printf("node. The volume ID of the upload is printed. With -template a VM\n")
+		fmt.Printf("template is created from it as well, and its ID is printed.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	urlFlag := flags.String("url", "", "URL of the Proxmox VE API, for example https://pve.example.com:8006 (or "+proxmoxURLVar+")")
+	tokenIDFlag := flags.String("token-id", "", "API token ID, as user@realm!name (or "+proxmoxTokenIDVar+")")
+	tokenSecretFlag := flags.String("token-secret", "", "API token secret (or "+proxmoxTokenSecretVar+")")
+	insecureFlag := flags.Bool("insecure", false, "Do not verify the TLS certificate of the host")
+	nodeFlag := flags.String("node", "", "Node to upload the image to (or "+proxmoxNodeVar+")")
+	storageFlag := flags.String("storage", defaultProxmoxStorage, "Storage to upload the image to (or "+proxmoxStorageVar+")")
+	template := flags.Bool("template", false, "Create a VM template booting from the image")
+	diskStorageFlag := flags.String("disk-storage", defaultProxmoxDiskStorage, "Storage for the disks of the template")
+	nameFlag := flags.String("name", "", "Name of the template (default the image name)")
+	vmidFlag := flags.Int("vmid", 0, "ID of the template (default the next free ID)")
+	cpus := flags.Int("cpus", 1, "Number of CPUs of the template")
+	mem := flags.Int("mem", 1024, "Amount of memory of the template in MB")
+	bridgeFlag := flags.String("bridge", defaultProxmoxBridge, "Bridge to connect the network interface of the template to, or 'none'")
+	uefiFlag := flags.Bool("uefi", false, "Use UEFI boot for the template")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	baseURL := getStringValue(proxmoxURLVar, *urlFlag, "")
+	tokenID := getStringValue(proxmoxTokenIDVar, *tokenIDFlag, "")
+	tokenSecret := getStringValue(proxmoxTokenSecretVar, *tokenSecretFlag, "")
+	node := getStringValue(proxmoxNodeVar, *nodeFlag, "")
+	storage := getStringValue(proxmoxStorageVar, *storageFlag, defaultProxmoxStorage)
+	name := getStringValue("", *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	if node == "" {
+		log.Fatalf("Please specify the node with -node or %s", proxmoxNodeVar)
+	}
+
+	client, err := NewProxmoxClient(baseURL, tokenID, tokenSecret, *insecureFlag)
+	if err != nil {
+		log.Fatalf("Unable to connect to Proxmox: %v", err)
+	}
+
+	log.Infof("Uploading %s to %s on %s", path, storage, node)
+	volume, err := client.UploadImage(node, storage, path)
+	if err != nil {
+		log.Fatalf("Unable to upload image: %v", err)
+	}
+	fmt.Printf("Volume: %s\n", volume)
+	if !*template {
+		return
+	}
+
+	vmid := *vmidFlag
+	if vmid == 0 {
+		if vmid, err = client.NextVMID(); err != nil {
+			log.Fatalf("Unable to get a VM ID: %v", err)
+		}
+	}
+	config := proxmoxVMConfig{
+		Name:        name,
+		CPUs:        *cpus,
+		Memory:      *mem,
+		Bridge:      *bridgeFlag,
+		DiskStorage: *diskStorageFlag,
+		UEFI:        *uefiFlag,
+	}
+	log.Infof("Creating template %d (%s)", vmid, name)
+	if err := client.CreateVM(node, vmid, config.values(volume)); err != nil {
+		log.Fatalf("Unable to create VM: %v", err)
+	}
+	if err := client.ConvertToTemplate(node, vmid); err != nil {
+		log.Fatalf("Unable to convert VM %d to a template: %v", vmid, err)
+	}
+	fmt.Printf("VMID: %d\n", vmid)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// The media types of the artifacts pushed with 'push registry'. The files
+// are stored as they are, so each blob is one file of the build.
+const (
+	artifactConfigMediaType  = "application/vnd.linuxkit.image.config.v1+json"
+	artifactKernelMediaType  = "application/vnd.linuxkit.image.kernel"
+	artifactInitrdMediaType  = "application/vnd.linuxkit.image.initrd"
+	artifactCmdlineMediaType = "text/plain"
+	artifactDiskMediaType    = "application/vnd.linuxkit.image.disk"
+	artifactYAMLMediaType    = "application/vnd.linuxkit.config.v1+yaml"
+)
+
+// artifactConfig is the config blob of an artifact, describing the image
+type artifactConfig struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Cmdline      string `json:"cmdline,omitempty"`
+}
+
+// artifactFile is a file of the build which is a blob of the artifact
+type artifactFile struct {
+	path      string
+	mediaType types.MediaType
+	digest    v1.Hash
+	size      int64
+}
+
+func (f *artifactFile) Digest() (v1.Hash, error) {
+	return f.digest, nil
+}
+
+func (f *artifactFile) Compressed() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *artifactFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+func (f *artifactFile) MediaType() (types.MediaType, error) {
+	return f.mediaType, nil
+}
+
+// artifact is an OCI artifact holding the files of a build, implementing
+// partial.CompressedImageCore
+type artifact struct {
+	config   []byte
+	manifest []byte
+	files    map[v1.Hash]*artifactFile
+}
+
+func (a *artifact) RawConfigFile() ([]byte, error) {
+	return a.config, nil
+}
+
+func (a *artifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *artifact) RawManifest() ([]byte, error) {
+	return a.manifest, nil
+}
+
+func (a *artifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if f, ok := a.files[h]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("The artifact has no blob %s", h)
+}
+
+// newArtifact creates an artifact from files, which are named in it after
+// their base name
+func newArtifact(config artifactConfig, files []*artifactFile, annotations map[string]string) (*artifact, error) {
+	a := &artifact{files: map[v1.Hash]*artifactFile{}}
+	var err error
+	if a.config, err = json.Marshal(config); err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(a.config))
+	if err != nil {
+		return nil, err
+	}
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: artifactConfigMediaType,
+			Size:      configSize,
+			Digest:    configDigest,
+		},
+		Layers:      []v1.Descriptor{},
+		Annotations: annotations,
+	}
+	for _, f := range files {
+		r, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.digest, f.size, err = v1.SHA256(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		a.files[f.digest] = f
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{
+			MediaType: f.mediaType,
+			Size:      f.size,
+			Digest:    f.digest,
+			// the title is the name of the file when the artifact is pulled
+			Annotations: map[string]string{imagespec.AnnotationTitle: filepath.Base(f.path)},
+		})
+	}
+	if a.manifest, err = json.Marshal(manifest); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func pushRegistry(args []string) {
+	flags := newFlagSet("registry")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push registry [options] prefix|file.yml reference\n\n", invoked)
+		fmt.Printf("Push the kernel, initrd and cmdline of a kernel+initrd build with the\n")
+		fmt.Printf("given prefix to a container registry as an OCI artifact. 'reference' is\n")
+		fmt.Printf("the repository and tag to push to, e.g. ghcr.io/org/appliance:v1. The\n")
+		fmt.Printf("files are pushed with their names, so they can be pulled with OCI\n")
+		fmt.Printf("artifact tools like oras. Credentials are read from the Docker config.\n\n")
+		fmt.Printf("If a YAML configuration is given instead of a prefix, only it is pushed,\n")
+		fmt.Printf("and '%s build reference' builds it. It should pin the images to their\n", invoked)
+		fmt.Printf("digests, like /etc/linuxkit/linuxkit.yml in a built image.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	archFlag := flags.String("arch", "amd64", "Architecture of the image, amd64, arm64 or s390x")
+	insecure := flags.Bool("insecure", false, "Allow pushing to a registry without TLS")
+	var diskFlags multipleFlag
+	flags.Var(&diskFlags, "disk", "Disk image of the build to add to the artifact, e.g. prefix-efi.iso, may be repeated")
+	var annotationFlags multipleFlag
+	flags.Var(&annotationFlags, "annotation", "Annotation of the artifact as key=value, may be repeated")
+	configFlag := flags.String("config", "", "YAML configuration of the image to add to the artifact, so it can be built from the reference")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 2 {
+		fmt.Printf("Please specify the prefix of the image and the reference to push it to\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	prefix := remArgs[0]
+
+	var opts []name.Option
+	if *insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.ParseReference(registryReference(remArgs[1]), opts...)
+	if err != nil {
+		log.Fatalf("Invalid reference %s: %v", remArgs[1], err)
+	}
+
+	arch := *archFlag
+	switch arch {
+	case "x86_64":
+		arch = "amd64"
+	case "aarch64":
+		arch = "arm64"
+	}
+
+	var files []*artifactFile
+	var cmdline []byte
+	if isYAMLFile(prefix) {
+		// only the configuration is pushed
+		*configFlag = prefix
+		prefix = strings.TrimSuffix(prefix, filepath.Ext(prefix))
+		if len(diskFlags) != 0 {
+			log.Fatal("Disk images cannot be added to a configuration")
+		}
+	} else {
+		cmdline, err = ioutil.ReadFile(prefix + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot read the kernel command line, the image must be built with -format kernel+initrd: %v", err)
+		}
+		files = []*artifactFile{
+			{path: prefix + "-kernel", mediaType: artifactKernelMediaType},
+			{path: prefix + "-initrd.img", mediaType: artifactInitrdMediaType},
+			{path: prefix + "-cmdline", mediaType: artifactCmdlineMediaType},
+		}
+	}
+	for _, d := range diskFlags {
+		files = append(files, &artifactFile{path: d, mediaType: artifactDiskMediaType})
+	}
+	if *configFlag != "" {
+		files = append(files, &artifactFile{path: *configFlag, mediaType: artifactYAMLMediaType})
+	}
+	annotations := map[string]string{imagespec.AnnotationTitle: filepath.Base(prefix)}
+	for _, a := range annotationFlags {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Fatalf("Invalid annotation %q, must be key=value", a)
+		}
+		annotations[kv[0]] = kv[1]
+	}
+
+	config := artifactConfig{
+		Name:         filepath.Base(prefix),
+		Architecture: arch,
+		OS:           "linux",
+		Cmdline:      strings.TrimSpace(string(cmdline)),
+	}
+	core, err := newArtifact(config, files, annotations)
+	if err != nil {
+		log.Fatalf("Unable to create the artifact: %v", err)
+	}
+	img, err := partial.CompressedToImage(core)
+	if err != nil {
+		log.Fatalf("Unable to create the artifact: %v", err)
+	}
+
+	log.Infof("Pushing %s to %s", prefix, ref)
+	start := time.Now()
+	span := trace.Start("upload", "destination", ref.String())
+	err = remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	span.SetError(err)
+	span.End()
+	metrics.Upload("registry", start, err)
+	if err != nil {
+		log.Fatalf("Unable to push %s: %v", ref, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s@%s\n", ref.Context(), digest)
+}
+
+// pullArtifact pulls the kernel, initrd and cmdline of an image pushed with
+// 'push registry' to dir, and returns their prefix
+func pullArtifact(arg, dir string, insecure bool) (string, error) {
+	var opts []name.Option
+	if insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.ParseReference(registryReference(arg), opts...)
+	if err != nil {
+		return "", fmt.Errorf("not a built output or an image reference: %v", err)
+	}
+	log.Infof("Pulling %s", ref)
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return "", err
+	}
+	if manifest.Config.MediaType != artifactConfigMediaType {
+		return "", fmt.Errorf("%s was not pushed with 'push registry'", ref)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	prefix := filepath.Join(dir, "image")
+	for _, l := range manifest.Layers {
+		var suffix string
+		switch l.MediaType {
+		case artifactKernelMediaType:
+			suffix = "-kernel"
+		case artifactInitrdMediaType:
+			suffix = "-initrd.img"
+		case artifactCmdlineMediaType:
+			suffix = "-cmdline"
+		default:
+			continue
+		}
+		layer, err := img.LayerByDigest(l.Digest)
+		if err != nil {
+			return "", err
+		}
+		if err := pullBlob(layer.Compressed, prefix+suffix); err != nil {
+			return "", fmt.Errorf("Unable to pull %s: %v", l.Digest, err)
+		}
+	}
+	if _, err := os.Stat(prefix + "-initrd.img"); err != nil {
+		return "", fmt.Errorf("%s has no initrd", ref)
+	}
+	return prefix, nil
+}
+
+// isYAMLFile returns whether path is a YAML configuration
+func isYAMLFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// pullConfig returns the YAML configuration of an image pushed with 'push
+// registry' to the reference arg
+func pullConfig(arg string, insecure bool) ([]byte, error) {
+	var opts []name.Option
+	if insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.ParseReference(registryReference(arg), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("not a file, URL or image reference: %v", err)
+	}
+	log.Infof("Pulling the configuration of %s", ref)
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Config.MediaType != artifactConfigMediaType {
+		return nil, fmt.Errorf("%s was not pushed with 'push registry'", ref)
+	}
+	for _, l := range manifest.Layers {
+		if l.MediaType != artifactYAMLMediaType {
+			continue
+		}
+		layer, err := img.LayerByDigest(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		r, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%s has no configuration, it must be pushed with -config", ref)
+}
+
+func pullBlob(open func() (io.ReadCloser, error), dest string) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	s3EndpointVar = "LINUXKIT_S3_ENDPOINT"
+	s3BucketVar   = "LINUXKIT_S3_BUCKET"
+)
+
+// s3Object is an object uploaded to a bucket
+type s3Object struct {
+	bucket  string
+	key     string
+	public  bool
+	tagging string
+}
+
+func pushS3(args []string) {
+	flags := newFlagSet("s3")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s push s3 [options] path\n\n", invoked)
+		fmt.Printf("'path' is the full path of an image, or the prefix of the kernel,\n")
+		fmt.Printf("initrd and cmdline files of a kernel+initrd build. It is uploaded to a\n")
+		fmt.Printf("bucket of Amazon S3 or of any S3-compatible object storage, like MinIO,\n")
+		fmt.Printf("Ceph RGW or Wasabi, and its URL is printed. For a kernel+initrd build an\n")
+		fmt.Printf("iPXE script booting it is uploaded as well, and its URL is printed.\n\n")
+		fmt.Printf("Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY,\n")
+		fmt.Printf("or from the AWS shared credentials file.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	endpointFlag := flags.String("endpoint", "", "URL of the S3-compatible service, for example https://minio.example.com:9000. Defaults to Amazon S3")
+	regionFlag := flags.String("region", "", "Region of the bucket. Defaults to AWS_REGION, or us-east-1")
+	pathStyleFlag := flags.Bool("path-style", false, "Address the bucket in the path of the URL instead of in the host name, as most S3-compatible services require")
+	bucketFlag := flags.String("bucket", "", "Bucket to upload to. *Required*")
+	prefixFlag := flags.String("prefix", "", "Prefix of the object keys in the bucket, for example images/")
+	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the files in the bucket. Defaults to the base of 'path' with the file extension removed.")
+	publicFlag := flags.Bool("public", false, "Make the uploaded objects readable by anyone")
+	presignFlag := flags.Duration("presign", 0, "Print presigned URLs valid for this long, for example 24h, instead of the plain URLs of the objects. The iPXE script uses presigned URLs too")
+	timeoutFlag := flags.Int("timeout", 0, "Upload timeout in seconds")
+	uploadOpts := uploadFlags(flags)
+	tags := tagFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to push\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	timeout := getIntValue(timeoutVar, *timeoutFlag, 600)
+	endpoint := getStringValue(s3EndpointVar, *endpointFlag, "")
+	region := getStringValue("AWS_REGION", *regionFlag, "us-east-1")
+	bucket := getStringValue(s3BucketVar, *bucketFlag, "")
+	name := getStringValue(nameVar, *nameFlag, "")
+	if bucket == "" {
+		log.Fatalf("Please provide the bucket to use")
+	}
+	if *presignFlag < 0 || *presignFlag > 7*24*time.Hour {
+		log.Fatalf("-presign must be at most 7 days")
+	}
+
+	cfg := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(*pathStyleFlag)
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		log.Fatalf("Unable to create a session: %v", err)
+	}
+	storage := s3.New(sess)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancelFn()
+
+	var tagging string
+	if len(*tags) > 0 {
+		values := url.Values{}
+		for _, tag := range *tags {
+			values.Set(tag.Key, tag.Value)
+		}
+		tagging = values.Encode()
+	}
+	object := func(key string) s3Object {
+		return s3Object{bucket: bucket, key: *prefixFlag + key, public: *publicFlag, tagging: tagging}
+	}
+
+	// a kernel+initrd build is uploaded with an iPXE script booting it
+	if _, err := os.Stat(path + "-kernel"); err == nil {
+		if name == "" {
+			name = filepath.Base(path)
+		}
+		cmdline, err := ioutil.ReadFile(path + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot read the kernel command line: %v", err)
+		}
+		kernel, initrd := object(name+"-kernel"), object(name+"-initrd.img")
+		for src, o := range map[string]s3Object{path + "-kernel": kernel, path + "-initrd.img": initrd} {
+			if err := s3Upload(ctx, storage, src, o, *uploadOpts); err != nil {
+				log.Fatalf("Error uploading %s: %v", src, err)
+			}
+		}
+		kernelURL, err := s3URL(storage, kernel, *presignFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		initrdURL, err := s3URL(storage, initrd, *presignFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		script := s3IPXEScript(kernelURL, initrdURL, strings.TrimSpace(string(cmdline)))
+		ipxe := object(name + ".ipxe")
+		if err := s3Put(ctx, storage, strings.NewReader(script), int64(len(script)), "text/plain", ipxe); err != nil {
+			log.Fatalf("Error uploading the iPXE script: %v", err)
+		}
+		ipxeURL, err := s3URL(storage, ipxe, *presignFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Kernel: %s", kernelURL)
+		log.Infof("Initrd: %s", initrdURL)
+		fmt.Println(ipxeURL)
+		return
+	}
+
+	if name == "" {
+		name = strings.TrimSuffix(path, filepath.Ext(path))
+		name = filepath.Base(name)
+	}
+	image := object(name + filepath.Ext(path))
+	if err := s3Upload(ctx, storage, path, image, *uploadOpts); err != nil {
+		log.Fatalf("Error uploading %s: %v", path, err)
+	}
+	imageURL, err := s3URL(storage, image, *presignFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(imageURL)
+}
+
+// s3Upload uploads a file, in parts uploaded in parallel if it is large.
+// Failed uploads are kept and resumed as in multipartUpload.
+func s3Upload(ctx context.Context, storage *s3.S3, path string, o s3Object, opts uploadOptions) (err error) {
+	start := time.Now()
+	span := trace.Start("upload", "file", path, "destination", "s3://"+o.bucket+"/"+o.key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		metrics.Upload("s3", start, err)
+	}()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size <= multipartPartSize {
+		return s3Put(ctx, storage, f, size, "application/octet-stream", o)
+	}
+
+	state, err := loadUploadState(fmt.Sprintf("%s/%s/%s", storage.Endpoint, o.bucket, o.key), path)
+	if err != nil {
+		return err
+	}
+	abort := func(uploadID *string) {
+		if _, err := storage.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(o.bucket),
+			Key:      aws.String(o.key),
+			UploadId: uploadID,
+		}); err != nil {
+			log.Warnf("Unable to abort the upload of %s: %v", o.key, err)
+		}
+	}
+	uploaded := map[int64]*s3.Part{}
+	if state.UploadID != "" {
+		if !opts.Resume {
+			abort(aws.String(state.UploadID))
+			state.remove()
+			state.UploadID = ""
+		} else if err := storage.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+			Bucket:   aws.String(o.bucket),
+			Key:      aws.String(o.key),
+			UploadId: aws.String(state.UploadID),
+		}, func(page *s3.ListPartsOutput, _ bool) bool {
+			for _, p := range page.Parts {
+				uploaded[aws.Int64Value(p.PartNumber)] = p
+			}
+			return true
+		}); err != nil {
+			log.Infof("Unable to resume the previous upload of %s, it is restarted: %v", o.key, err)
+			state.UploadID = ""
+			uploaded = map[int64]*s3.Part{}
+		} else {
+			log.Infof("Resuming the previous upload of %s, %d parts are already uploaded", o.key, len(uploaded))
+		}
+	}
+
+	if state.UploadID == "" {
+		create := &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(o.bucket),
+			Key:         aws.String(o.key),
+			ContentType: aws.String("application/octet-stream"),
+		}
+		if o.public {
+			create.ACL = aws.String(s3.ObjectCannedACLPublicRead)
+		}
+		if o.tagging != "" {
+			create.Tagging = aws.String(o.tagging)
+		}
+		log.Debugf("CreateMultipartUpload:\n%v", create)
+		upload, err := storage.CreateMultipartUploadWithContext(ctx, create)
+		if err != nil {
+			return err
+		}
+		state.UploadID = aws.StringValue(upload.UploadId)
+		if opts.Resume {
+			if err := state.save(); err != nil {
+				log.Warnf("Unable to save the upload state, it cannot be resumed: %v", err)
+			}
+		}
+	}
+	uploadID := aws.String(state.UploadID)
+
+	partSize := multipartSize(size)
+	parts := make([]*s3.CompletedPart, (size+partSize-1)/partSize)
+	progress := newUploadProgress(o.key, size)
+	err = uploadParts(size, partSize, opts.Parallel, progress, func(n int, offset, length int64) error {
+		if p, ok := uploaded[int64(n)]; ok && aws.Int64Value(p.Size) == length {
+			parts[n-1] = &s3.CompletedPart{ETag: p.ETag, PartNumber: aws.Int64(int64(n))}
+			return nil
+		}
+		part, err := storage.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(o.bucket),
+			Key:           aws.String(o.key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(int64(n)),
+			Body:          io.NewSectionReader(f, offset, length),
+			ContentLength: aws.Int64(length),
+		})
+		if err != nil {
+			return fmt.Errorf("part %d: %v", n, err)
+		}
+		parts[n-1] = &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(int64(n))}
+		return nil
+	})
+	progress.Finish()
+	if err != nil {
+		if opts.Resume {
+			log.Warnf("The upload of %s failed, push the same image again to resume it", o.key)
+		} else {
+			// the parts which were uploaded are stored until the upload is aborted
+			abort(uploadID)
+			state.remove()
+		}
+		return err
+	}
+
+	_, err = storage.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(o.bucket),
+		Key:             aws.String(o.key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abort(uploadID)
+	}
+	state.remove()
+	return err
+}
+
+// s3Put uploads an object in a single request
+func s3Put(ctx context.Context, storage *s3.S3, body io.ReadSeeker, size int64, contentType string, o s3Object) error {
+	putParams := &s3.PutObjectInput{
+		Bucket:        aws.String(o.bucket),
+		Key:           aws.String(o.key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	}
+	if o.public {
+		putParams.ACL = aws.String(s3.ObjectCannedACLPublicRead)
+	}
+	if o.tagging != "" {
+		putParams.Tagging = aws.String(o.tagging)
+	}
+	log.Debugf("PutObject:\n%v", putParams)
+	_, err := storage.PutObjectWithContext(ctx, putParams)
+	return err
+}
+
+// s3URL returns the URL of an object, presigned if expires is set. The
+// URL is built by the SDK so that it follows the endpoint and addressing
+// style of the client.
+func s3URL(storage *s3.S3, o s3Object, expires time.Duration) (string, error) {
+	req, _ := storage.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key),
+	})
+	if expires > 0 {
+		u, err := req.Presign(expires)
+		if err != nil {
+			return "", fmt.Errorf("Unable to presign the URL of %s: %v", o.key, err)
+		}
+		return u, nil
+	}
+	if err := req.Build(); err != nil {
+		return "", fmt.Errorf("Unable to build the URL of %s: %v", o.key, err)
+	}
+	return req.HTTPRequest.URL.String(), nil
+}
+
+// s3IPXEScript returns an iPXE script booting the kernel and initrd at the
+// given URLs
+func s3IPXEScript(kernelURL, initrdURL, cmdline string) string {
+	script := "#!ipxe\n\n"
+	script += "dhcp\n"
+	script += fmt.Sprintf("initrd --name initrd %s\n", initrdURL)
+	script += fmt.Sprintf("kernel %s initrd=initrd ip=dhcp %s\n", kernelURL, cmdline)
+	script += "boot"
+	return script
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"math"
 	"os"
@@ -14,7 +13,7 @@ import (
 const defaultScalewayVolumeSize = 10 // GB
 
 func pushScaleway(args []string) {
-	flags := flag.NewFlagSet("scaleway", flag.ExitOnError)
+	flags := newFlagSet("scaleway")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push scaleway [options] path\n\n", invoked)
@@ -31,7 +30,10 @@ func pushScaleway(args []string) {
 	volumeSizeFlag := flags.Int("volume-size", 0, "Size of the volume to use (in GB). Defaults to size of the ISO file rounded up to GB")
 	zoneFlag := flags.String("zone", defaultScalewayZone, "Select Scaleway zone")
 	organizationIDFlag := flags.String("organization-id", "", "Select Scaleway's organization ID")
+	projectIDFlag := flags.String("project-id", "", "Select Scaleway's project ID (default the default project of the organization)")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64. arm64 images are built on an "+defaultScalewayCommercialTypeARM64+" instance")
 	noCleanFlag := flags.Bool("no-clean", false, "Do not remove temporary instance and volumes")
+	tags := tagFlag(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -54,6 +56,7 @@ func pushScaleway(args []string) {
 	volumeSize := getIntValue(volumeSizeVar, *volumeSizeFlag, 0)
 	zone := getStringValue(zoneVar, *zoneFlag, defaultScalewayZone)
 	organizationID := getStringValue(organizationIDVar, *organizationIDFlag, "")
+	projectID := getStringValue(projectIDVar, *projectIDFlag, "")
 
 	const suffix = ".iso"
 	if name == "" {
@@ -61,7 +64,7 @@ func pushScaleway(args []string) {
 		name = filepath.Base(name)
 	}
 
-	client, err := NewScalewayClient(accessKey, secretKey, zone, organizationID)
+	client, err := NewScalewayClient(accessKey, secretKey, zone, organizationID, projectID)
 	if err != nil {
 		log.Fatalf("Unable to connect to Scaleway: %v", err)
 	}
@@ -79,7 +82,7 @@ func pushScaleway(args []string) {
 
 	// if no instanceID is provided, we create the instance
 	if instanceID == "" {
-		instanceID, err = client.CreateInstance(volumeSize)
+		instanceID, err = client.CreateInstance(volumeSize, *archFlag)
 		if err != nil {
 			log.Fatalf("Error creating a Scaleway instance: %v", err)
 		}
@@ -110,7 +113,7 @@ func pushScaleway(args []string) {
 		log.Fatalf("Error terminating Scaleway's instance: %v", err)
 	}
 
-	err = client.CreateScalewayImage(instanceID, volumeID, name)
+	err = client.CreateScalewayImage(instanceID, volumeID, name, *archFlag, tags.Strings())
 	if err != nil {
 		log.Fatalf("Error creating Scaleway image: %v", err)
 	}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -22,11 +22,12 @@ func pushVCenter(args []string) {
 
 	var newVM vmConfig
 
-	flags := flag.NewFlagSet("vCenter", flag.ExitOnError)
+	flags := newFlagSet("vCenter")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push vcenter [options] path \n\n", invoked)
-		fmt.Printf("'path' specifies the full path of an ISO image. It will be pushed to a vCenter cluster.\n")
+		fmt.Printf("'path' specifies the full path of an ISO, vmdk or OVA image. It will be pushed to a vCenter cluster.\n")
+		fmt.Printf("vmdk images are converted to thin provisioned disks and OVA images are imported as templates.\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
@@ -37,7 +38,10 @@ func pushVCenter(args []string) {
 	newVM.vSphereHost = flags.String("hostname", os.Getenv("VCHOST"), "The server that will host the image")
 	newVM.path = flags.String("path", "", "Path to a specific image")
 
-	newVM.vmFolder = flags.String("folder", "", "A folder on the datastore to push the image too")
+	newVM.vmFolder = flags.String("folder", "", "A folder on the datastore to push the image too, and the name of the template imported from an OVA")
+	asTemplate := flags.Bool("template", true, "Mark the VM imported from an OVA as a template")
+	library := flags.String("library", "", "Upload the image to an item of this Content Library instead of a datastore. OVAs become OVF templates")
+	libraryItem := flags.String("library-item", "", "Name of the Content Library item, which is created if it does not exist and updated otherwise. Defaults to the name of the image")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatalln("Unable to parse args")
@@ -51,24 +55,49 @@ func pushVCenter(args []string) {
 	}
 	*newVM.path = remArgs[0]
 
-	// Ensure an iso has been passed to the vCenter push Command
-	if !strings.HasSuffix(*newVM.path, ".iso") {
-		log.Fatalln("Please specify an '.iso' file")
+	// Ensure an iso, vmdk or ova has been passed to the vCenter push Command
+	ext := path.Ext(*newVM.path)
+	if ext != ".iso" && ext != ".vmdk" && ext != ".ova" {
+		log.Fatalln("Please specify an '.iso', '.vmdk' or '.ova' file")
 	}
 
 	// Test any passed in files before uploading image
 	checkFile(*newVM.path)
 
+	if *library != "" {
+		u, err := url.Parse(*newVM.vCenterURL)
+		if err != nil {
+			log.Fatalf("URL can't be parsed, ensure it is https://username:password/<address>/sdk %v", err)
+		}
+		item := *libraryItem
+		if item == "" {
+			item = strings.TrimSuffix(path.Base(*newVM.path), ext)
+		}
+		id, err := pushContentLibrary(ctx, u, *library, item, *newVM.path)
+		if err != nil {
+			log.Fatalf("Unable to push to Content Library %s: %v", *library, err)
+		}
+		log.Infof("Pushed %s to item %s (%s) of Content Library %s", *newVM.path, item, id, *library)
+		return
+	}
+
 	// Connect to VMware vCenter and return the values needed to upload image
-	c, dss, _, _, _, _ := vCenterConnect(ctx, newVM)
+	c, _, dc, dss, folders, hs, _, rp := vCenterConnect(ctx, newVM)
 
 	// Create a folder from the uploaded image name if needed
 	if *newVM.vmFolder == "" {
-		*newVM.vmFolder = strings.TrimSuffix(path.Base(*newVM.path), ".iso")
+		*newVM.vmFolder = strings.TrimSuffix(path.Base(*newVM.path), ext)
 	}
 
-	// The CreateFolder method isn't necessary as the *newVM.vmname will be created automatically
-	uploadFile(c, newVM, dss)
+	switch ext {
+	case ".vmdk":
+		uploadVMDK(ctx, c, newVM, dc, dss)
+	case ".ova":
+		importOVA(ctx, c, newVM, folders, dss, hs, rp, *asTemplate)
+	default:
+		// The CreateFolder method isn't necessary as the *newVM.vmname will be created automatically
+		uploadFile(c, newVM, dss)
+	}
 }
 
 func checkFile(file string) {
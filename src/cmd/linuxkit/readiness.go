@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWaitTimeout = 5 * time.Minute
+	probeInterval      = 2 * time.Second
+	probeTimeout       = 5 * time.Second
+)
+
+// probe is a check that a VM is ready, given with -wait-for
+type probe struct {
+	// kind is ssh, tcp, http or console
+	kind   string
+	target string
+}
+
+func (p probe) String() string {
+	if p.kind == "ssh" {
+		return "ssh"
+	}
+	if p.kind == "http" {
+		return p.target
+	}
+	return p.kind + ":" + p.target
+}
+
+// probes are the probes given with -wait-for
+type probes []probe
+
+func (p *probes) String() string {
+	var s []string
+	for _, pr := range *p {
+		s = append(s, pr.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// Set adds a probe, which is ssh, tcp:[host:]port, an http or https URL, or
+// console:marker
+func (p *probes) Set(value string) error {
+	switch {
+	case value == "ssh":
+		*p = append(*p, probe{kind: "ssh"})
+	case strings.HasPrefix(value, "tcp:"):
+		target := strings.TrimPrefix(value, "tcp:")
+		port := target
+		if _, pt, err := net.SplitHostPort(target); err == nil {
+			port = pt
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("Invalid port in %s, must be tcp:[host:]port", value)
+		}
+		*p = append(*p, probe{kind: "tcp", target: target})
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		if _, err := url.Parse(value); err != nil {
+			return fmt.Errorf("Invalid URL %s: %v", value, err)
+		}
+		*p = append(*p, probe{kind: "http", target: value})
+	case strings.HasPrefix(value, "console:") && value != "console:":
+		*p = append(*p, probe{kind: "console", target: strings.TrimPrefix(value, "console:")})
+	default:
+		return fmt.Errorf("Invalid probe %q, must be ssh, tcp:[host:]port, an http(s) URL or console:marker", value)
+	}
+	return nil
+}
+
+// readiness are the probes a run backend waits for once the VM is started
+type readiness struct {
+	probes  probes
+	timeout *time.Duration
+}
+
+// readinessFlags adds the -wait-for and -wait-timeout flags to the flags of
+// a run backend
+func readinessFlags(flags *flag.FlagSet) *readiness {
+	r := &readiness{}
+	flags.Var(&r.probes, "wait-for", "Wait until the VM is ready: ssh, tcp:[host:]port, an http(s) URL or console:marker, may be repeated. The host defaults to the address of the VM")
+	r.timeout = flags.Duration("wait-timeout", defaultWaitTimeout, "How long to wait for -wait-for before failing")
+	return r
+}
+
+// enabled returns whether any probes were given
+func (r *readiness) enabled() bool {
+	return len(r.probes) > 0
+}
+
+// wait polls the probes until they all succeed, or the timeout expires
+func (r *readiness) wait(info RunInfo) error {
+	if !r.enabled() {
+		return nil
+	}
+	deadline := time.Now().Add(*r.timeout)
+	for _, p := range r.probes {
+		log.Infof("Waiting for %s", p)
+		for {
+			err := p.check(info)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("The VM was not ready after %v, %s failed: %v", *r.timeout, p, err)
+			}
+			log.Debugf("%s: %v", p, err)
+			time.Sleep(probeInterval)
+		}
+	}
+	log.Infof("The VM is ready")
+	return nil
+}
+
+// vmAddress returns the host of the VM and its ssh port, if it is known
+func vmAddress(info RunInfo) (string, int, error) {
+	_, host, port, err := sshAddress(info)
+	if err != nil {
+		return "", 0, fmt.Errorf("The address of the VM is not known, give the host in the probe")
+	}
+	// the ssh endpoint of packet VMs is the serial console
+	if info.Backend == "packet" {
+		port = 0
+	}
+	return host, port, nil
+}
+
+// check runs the probe once
+func (p probe) check(info RunInfo) error {
+	switch p.kind {
+	case "ssh":
+		host, port, err := vmAddress(info)
+		if err != nil {
+			return err
+		}
+		if port == 0 {
+			port = 22
+		}
+		return checkSSH(net.JoinHostPort(host, strconv.Itoa(port)))
+	case "tcp":
+		address := p.target
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			host, _, err := vmAddress(info)
+			if err != nil {
+				return err
+			}
+			address = net.JoinHostPort(host, p.target)
+		}
+		conn, err := net.DialTimeout("tcp", address, probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		return checkHTTP(p.target, info)
+	case "console":
+		// only detached qemu VMs log their console while it is not attached
+		b, err := ioutil.ReadFile(filepath.Join(info.StatePath, consoleLogFile))
+		if info.StatePath == "" || os.IsNotExist(err) {
+			return fmt.Errorf("The console of the %s VM is not logged, console probes need 'run qemu -detached'", info.Backend)
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(b, []byte(p.target)) {
+			return fmt.Errorf("%q is not in the console output yet", p.target)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown probe %s", p.kind)
+}
+
+// checkSSH checks that an ssh server answers on address. Published ports
+// accept connections before the VM listens on them, so the server must send
+// its version.
+func checkSSH(address string) error {
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("No ssh server on %s: %v", address, err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("No ssh server on %s", address)
+	}
+	return nil
+}
+
+// checkHTTP checks that an endpoint returns a 2xx status. URLs without a
+// host, like http://:8080/health, are sent to the VM.
+func checkHTTP(endpoint string, info RunInfo) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		host, _, err := vmAddress(info)
+		if err != nil {
+			return err
+		}
+		if port := u.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u.Host = host
+	}
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return nil
+}
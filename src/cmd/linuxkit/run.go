@@ -1,86 +1,84 @@
 package main
 
 import (
-	"fmt"
-	"os"
-	"path/filepath"
 	"runtime"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func runUsage() {
-	invoked := filepath.Base(os.Args[0])
-	fmt.Printf("USAGE: %s run [backend] [options] [prefix]\n\n", invoked)
+// runCommand is 'linuxkit run', with a subcommand for each backend, including
+// the plugins on the PATH. Images given without a backend are run with the
+// default of the platform.
+func runCommand() *command {
+	c := &command{
+		name:  "run",
+		short: "Run a VM image on a local hypervisor or remote cloud",
+		args:  "[options] [backend] [backend options] [prefix]",
+		long: `
+If the backend is not specified the backend of the config file is used, or
+the platform specific default.
+'options' are the options below, which are given before the backend.
+'backend options' are the backend specific options.
+'prefix' specifies the path to the VM image. It defaults to './image'.
 
-	fmt.Printf("'backend' specifies the run backend.\n")
-	fmt.Printf("If not specified the platform specific default will be used\n")
-	fmt.Printf("Supported backends are (default platform in brackets):\n")
-	// Please keep these in alphabetical order
-	fmt.Printf("  aws\n")
-	fmt.Printf("  azure\n")
-	fmt.Printf("  gcp\n")
-	fmt.Printf("  hyperkit [macOS]\n")
-	fmt.Printf("  hyperv [Windows]\n")
-	fmt.Printf("  openstack\n")
-	fmt.Printf("  packet\n")
-	fmt.Printf("  qemu [linux]\n")
-	fmt.Printf("  scaleway\n")
-	fmt.Printf("  vbox\n")
-	fmt.Printf("  vcenter\n")
-	fmt.Printf("  vmware\n")
-	fmt.Printf("\n")
-	fmt.Printf("'options' are the backend specific options.\n")
-	fmt.Printf("See '%s run [backend] --help' for details.\n\n", invoked)
-	fmt.Printf("'prefix' specifies the path to the VM image.\n")
-	fmt.Printf("It defaults to './image'.\n")
-}
+With -report the console of the VM is written to console.log in the report
+directory, and report.json records how long it ran, why it stopped
+(poweroff, reboot, panic, timeout, or exit of the backend) and a verdict.
+The run passes if the console shows the -report-marker, or without a marker
+if the backend exits cleanly, and fails on a kernel panic, a timeout or the
+-report-fail-marker. The exit code is 1 if the run fails.
 
-func run(args []string) {
-	if len(args) < 1 {
-		runUsage()
-		os.Exit(1)
+A guest can report an exit status by writing linuxkit-exit-status=N to its
+console before it powers off, and the local backends then exit with N.`,
+		// Please keep these in alphabetical order
+		subcommands: []*command{
+			{name: "alibaba", short: "Run an ECS image on Alibaba Cloud", run: runAlibaba},
+			{name: "aws", short: "Run an AMI on AWS", run: runAWS},
+			{name: "azure", short: "Run a VHD image on Azure", run: runAzure},
+			{name: "cloud-hypervisor", short: "Run an image with Cloud Hypervisor", run: runCloudHypervisor},
+			{name: "gcp", short: "Run an image on Google Cloud", run: runGcp},
+			{name: "hyperkit", short: "Run an image with HyperKit on macOS", run: runHyperKit},
+			{name: "hyperv", short: "Run an ISO with Hyper-V on Windows", run: runHyperV},
+			{name: "ibmcloud", short: "Run a VPC image on IBM Cloud", run: runIBMCloud},
+			{name: "libvirt", short: "Run an image with libvirt", run: runLibvirt},
+			{name: "oci", short: "Import and run a qcow2 or vmdk image on Oracle Cloud", run: runOCI},
+			{name: "openstack", short: "Run an image on OpenStack", run: runOpenStack},
+			{name: "packet", short: "Boot a kernel+initrd with iPXE on Equinix Metal", run: runPacket},
+			{name: "proxmox", short: "Upload and run an image on Proxmox VE", run: runProxmox},
+			{name: "qemu", short: "Run an image with QEMU", run: runQemu},
+			{name: "scaleway", short: "Run an image on Scaleway", run: runScaleway},
+			{name: "vbox", short: "Run an image with VirtualBox", run: runVbox},
+			{name: "vcenter", short: "Run an ISO or vmdk image on vCenter", run: runVcenter},
+			{name: "vfkit", short: "Run an image with vfkit on macOS", run: runVfkit},
+			{name: "vmware", short: "Run an image with VMware Workstation or Fusion", run: runVMware},
+			{name: "vultr", short: "Run a raw image on Vultr", run: runVultr},
+		},
+		fallback: defaultRunBackend,
+		flags:    runReportFlags,
+		before:   runReportBefore,
 	}
+	pluginCommands(c, "Run an image")
+	return c
+}
 
-	switch args[0] {
-	// Please keep cases in alphabetical order
-	case "aws":
-		runAWS(args[1:])
-	case "azure":
-		runAzure(args[1:])
-	case "gcp":
-		runGcp(args[1:])
-	case "help", "-h", "-help", "--help":
-		runUsage()
-		os.Exit(0)
-	case "hyperkit":
-		runHyperKit(args[1:])
-	case "hyperv":
-		runHyperV(args[1:])
-	case "openstack":
-		runOpenStack(args[1:])
-	case "packet":
-		runPacket(args[1:])
-	case "qemu":
-		runQemu(args[1:])
-	case "scaleway":
-		runScaleway(args[1:])
-	case "vmware":
-		runVMware(args[1:])
-	case "vbox":
-		runVbox(args[1:])
-	case "vcenter":
-		runVcenter(args[1:])
-	default:
-		switch runtime.GOOS {
-		case "darwin":
-			runHyperKit(args)
-		case "linux":
-			runQemu(args)
-		case "windows":
-			runHyperV(args)
-		default:
-			log.Errorf("There currently is no default 'run' backend for your platform.")
+// defaultRunBackend returns the backend images are run with if none is
+// given, which is the backend of the config or of the platform, or nil if
+// there is none
+func defaultRunBackend() *command {
+	name := Config.Run.Backend
+	switch {
+	case name != "":
+	case runtime.GOOS == "darwin":
+		// hyperkit does not support Apple Silicon
+		if runtime.GOARCH == "arm64" {
+			name = "vfkit"
+		} else {
+			name = "hyperkit"
 		}
+	case runtime.GOOS == "linux":
+		name = "qemu"
+	case runtime.GOOS == "windows":
+		name = "hyperv"
+	default:
+		return nil
 	}
+	return runCommand().lookup(name)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAlibabaInstanceType = "ecs.t6-c1m1.large"
+	defaultAlibabaBandwidth    = 1
+	// Environment variables. Some are non-standard
+	alibabaInstanceTypeVar  = "ALIBABA_CLOUD_INSTANCE_TYPE"     // non-standard
+	alibabaSecurityGroupVar = "ALIBABA_CLOUD_SECURITY_GROUP_ID" // non-standard
+	alibabaVSwitchVar       = "ALIBABA_CLOUD_VSWITCH_ID"        // non-standard
+)
+
+// Process the run arguments and execute run
+func runAlibaba(args []string) {
+	flags := newFlagSet("alibaba")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run alibaba [options] [name]\n\n", invoked)
+		fmt.Printf("'name' is the name of an ECS image that has already been\n")
+		fmt.Printf(" uploaded using 'linuxkit push'\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	regionFlag := flags.String("region", alibabaDefaultRegion, "Alibaba Cloud region (or "+alibabaRegionVar+")")
+	instanceTypeFlag := flags.String("instance-type", defaultAlibabaInstanceType, "ECS instance type (or "+alibabaInstanceTypeVar+")")
+	sgFlag := flags.String("security-group", "", "Security group ID (or "+alibabaSecurityGroupVar+"). *Required*")
+	vswitchFlag := flags.String("vswitch", "", "VSwitch ID, which determines the zone (or "+alibabaVSwitchVar+"). *Required*")
+	instanceNameFlag := flags.String("instance-name", "", "Name of the instance (default the image name)")
+	bandwidthFlag := flags.Int("bandwidth", defaultAlibabaBandwidth, "Maximum outbound public bandwidth in Mbit/s, 0 for no public IP address")
+	consoleFlag := flags.Duration("console", 0, "Print the serial console output after waiting this long, e.g. 60s")
+	cleanFlag := flags.Bool("clean", false, "Delete the instance after printing the console output")
+	tags := tagFlag(flags)
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
+
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the name of the image to boot\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	name := remArgs[0]
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+	if *dataPath != "" {
+		dataB, err := ioutil.ReadFile(*dataPath)
+		if err != nil {
+			log.Fatalf("Unable to read metadata file: %v", err)
+		}
+		*data = string(dataB)
+	}
+
+	region := getStringValue(alibabaRegionVar, *regionFlag, alibabaDefaultRegion)
+	instanceType := getStringValue(alibabaInstanceTypeVar, *instanceTypeFlag, defaultAlibabaInstanceType)
+	securityGroup := getStringValue(alibabaSecurityGroupVar, *sgFlag, "")
+	vswitch := getStringValue(alibabaVSwitchVar, *vswitchFlag, "")
+	instanceName := getStringValue("", *instanceNameFlag, name)
+	if securityGroup == "" || vswitch == "" {
+		log.Fatalf("Please specify the security group and vswitch to use")
+	}
+
+	client, err := NewAlibabaClient(os.Getenv(alibabaAccessKeyIDVar), os.Getenv(alibabaAccessKeySecretVar), region)
+	if err != nil {
+		log.Fatalf("Unable to connect to Alibaba Cloud: %v", err)
+	}
+
+	imageID, err := client.FindImage(name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Infof("Launching %s instance %s", instanceType, instanceName)
+	instanceID, ip, err := client.RunInstance(AlibabaInstanceConfig{
+		Name:            instanceName,
+		InstanceType:    instanceType,
+		ImageID:         imageID,
+		SecurityGroupID: securityGroup,
+		VSwitchID:       vswitch,
+		Bandwidth:       *bandwidthFlag,
+		UserData:        *data,
+		Tags:            *tags,
+	})
+	if err != nil {
+		log.Fatalf("Unable to launch instance: %v", err)
+	}
+	fields := log.Fields{"instance": instanceID}
+	if ip != "" {
+		fields["ip"] = ip
+	}
+	log.WithFields(fields).Infof("Instance %s is running", instanceID)
+	runInfo := RunInfo{Backend: "alibaba", ID: instanceID, Name: instanceName, ConsoleLog: *consoleLog}
+	if ip != "" {
+		runInfo.IPs = []string{ip}
+	}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if !*cleanFlag {
+		keepResources()
+	}
+
+	if *consoleFlag > 0 {
+		log.Warnf("Alibaba Cloud doesn't stream serial console output.\n Waiting %v to display the console output", *consoleFlag)
+		time.Sleep(*consoleFlag)
+		out, err := client.ConsoleOutput(instanceID)
+		if err != nil {
+			log.Errorf("Error getting console output from instance %s: %v", instanceID, err)
+		} else {
+			stdout, err := consoleWriter(os.Stdout, *consoleLog)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(stdout, out)
+		}
+	}
+
+	if *cleanFlag {
+		keepResources()
+		log.Infof("Deleting instance %s", instanceID)
+		if err := client.DeleteInstance(instanceID); err != nil {
+			log.Fatalf("Error deleting instance %s: %v", instanceID, err)
+		}
+	}
+}
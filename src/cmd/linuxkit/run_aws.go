@@ -2,11 +2,11 @@ package main
 
 import (
 	"encoding/base64"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -15,20 +15,22 @@ import (
 )
 
 const (
-	defaultAWSMachine  = "t2.micro"
-	defaultAWSDiskSize = 0
-	defaultAWSDiskType = "gp2"
-	defaultAWSZone     = "a"
+	defaultAWSMachine      = "t2.micro"
+	defaultAWSMachineARM64 = "t4g.micro"
+	defaultAWSDiskSize     = 0
+	defaultAWSDiskType     = "gp2"
+	defaultAWSZone         = "a"
 	// Environment variables. Some are non-standard
-	awsMachineVar  = "AWS_MACHINE"   // non-standard
-	awsDiskSizeVar = "AWS_DISK_SIZE" // non-standard
-	awsDiskTypeVar = "AWS_DISK_TYPE" // non-standard
-	awsZoneVar     = "AWS_ZONE"      // non-standard
+	awsMachineVar  = "AWS_MACHINE"              // non-standard
+	awsDiskSizeVar = "AWS_DISK_SIZE"            // non-standard
+	awsDiskTypeVar = "AWS_DISK_TYPE"            // non-standard
+	awsZoneVar     = "AWS_ZONE"                 // non-standard
+	awsProfileVar  = "AWS_IAM_INSTANCE_PROFILE" // non-standard
 )
 
 // Process the run arguments and execute run
 func runAWS(args []string) {
-	flags := flag.NewFlagSet("aws", flag.ExitOnError)
+	flags := newFlagSet("aws")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run aws [options] [name]\n\n", invoked)
@@ -37,11 +39,19 @@ func runAWS(args []string) {
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
-	machineFlag := flags.String("machine", defaultAWSMachine, "AWS Machine Type")
+	machineFlag := flags.String("machine", "", "AWS Machine Type (default "+defaultAWSMachine+", or "+defaultAWSMachineARM64+" for arm64 images)")
 	diskSizeFlag := flags.Int("disk-size", 0, "Size of system disk in GB")
 	diskTypeFlag := flags.String("disk-type", defaultAWSDiskType, "AWS Disk Type")
 	zoneFlag := flags.String("zone", defaultAWSZone, "AWS Availability Zone")
 	sgFlag := flags.String("security-group", "", "Security Group ID")
+	profileFlag := flags.String("iam-instance-profile", "", "Name or ARN of an IAM instance profile to attach to the instance")
+	tags := tagFlag(flags)
+	spotFlag := flags.Bool("spot", false, "Run a Spot instance, which is cheaper but can be interrupted at any time")
+	spotMaxPriceFlag := flags.String("spot-max-price", "", "Maximum price per hour of a Spot instance in US dollars (default the on-demand price)")
+	metadataTokensFlag := flags.String("metadata-tokens", "", "Whether IMDSv2 session tokens are 'optional' or 'required' by the instance metadata service (default the account default)")
+	hopLimitFlag := flags.Int("metadata-hop-limit", 0, "Hop limit of the responses of the instance metadata service with session tokens, 1 to 64 (default the account default)")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
 
 	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
 	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
@@ -61,6 +71,12 @@ func runAWS(args []string) {
 	if *data != "" && *dataPath != "" {
 		log.Fatal("Cannot specify both -data and -data-file")
 	}
+	if *metadataTokensFlag != "" && *metadataTokensFlag != ec2.HttpTokensStateOptional && *metadataTokensFlag != ec2.HttpTokensStateRequired {
+		log.Fatalf("Invalid -metadata-tokens %s, must be optional or required", *metadataTokensFlag)
+	}
+	if *hopLimitFlag < 0 || *hopLimitFlag > 64 {
+		log.Fatalf("Invalid -metadata-hop-limit %d, must be between 1 and 64", *hopLimitFlag)
+	}
 
 	if *dataPath != "" {
 		dataB, err := ioutil.ReadFile(*dataPath)
@@ -72,7 +88,6 @@ func runAWS(args []string) {
 	// data must be base64 encoded
 	*data = base64.StdEncoding.EncodeToString([]byte(*data))
 
-	machine := getStringValue(awsMachineVar, *machineFlag, defaultAWSMachine)
 	diskSize := getIntValue(awsDiskSizeVar, *diskSizeFlag, defaultAWSDiskSize)
 	diskType := getStringValue(awsDiskTypeVar, *diskTypeFlag, defaultAWSDiskType)
 	zone := os.Getenv("AWS_REGION") + getStringValue(awsZoneVar, *zoneFlag, defaultAWSZone)
@@ -99,7 +114,17 @@ func runAWS(args []string) {
 	if len(results.Images) > 1 {
 		log.Warnf("Found multiple images with the same name, using the first one")
 	}
-	imageID := results.Images[0].ImageId
+	image := results.Images[0]
+	imageID := image.ImageId
+
+	defaultMachine := defaultAWSMachine
+	if aws.StringValue(image.Architecture) == ec2.ArchitectureValuesArm64 {
+		defaultMachine = defaultAWSMachineARM64
+	}
+	machine := getStringValue(awsMachineVar, *machineFlag, defaultMachine)
+	if err := awsCheckInstanceType(compute, image, machine); err != nil {
+		log.Fatal(err)
+	}
 
 	// 2. Create Instance
 	params := &ec2.RunInstancesInput{
@@ -113,6 +138,41 @@ func runAWS(args []string) {
 		SecurityGroupIds: []*string{sgFlag},
 		UserData:         data,
 	}
+	if profile := getStringValue(awsProfileVar, *profileFlag, ""); profile != "" {
+		params.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: aws.String(profile)}
+		if strings.HasPrefix(profile, "arn:") {
+			params.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(profile)}
+		}
+	}
+	if *metadataTokensFlag != "" || *hopLimitFlag != 0 {
+		params.MetadataOptions = &ec2.InstanceMetadataOptionsRequest{}
+		if *metadataTokensFlag != "" {
+			params.MetadataOptions.HttpTokens = metadataTokensFlag
+		}
+		if *hopLimitFlag != 0 {
+			params.MetadataOptions.HttpPutResponseHopLimit = aws.Int64(int64(*hopLimitFlag))
+		}
+	}
+	if len(*tags) > 0 {
+		params.TagSpecifications = []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: awsTags(*tags)},
+			{ResourceType: aws.String(ec2.ResourceTypeVolume), Tags: awsTags(*tags)},
+		}
+	}
+	if *spotFlag {
+		// one-time Spot requests can only be terminated on interruption
+		spotOptions := &ec2.SpotMarketOptions{
+			SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+			InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+		}
+		if *spotMaxPriceFlag != "" {
+			spotOptions.MaxPrice = spotMaxPriceFlag
+		}
+		params.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType:  aws.String(ec2.MarketTypeSpot),
+			SpotOptions: spotOptions,
+		}
+	}
 	runResult, err := compute.RunInstances(params)
 	if err != nil {
 		log.Fatalf("Unable to run instance: %s", err)
@@ -129,12 +189,48 @@ func runAWS(args []string) {
 			},
 		},
 	}
+	var volumeID *string
+	forgetInstance := onCleanup("instance "+*instanceID, func() error {
+		if _, err := compute.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{instanceID}}); err != nil {
+			return err
+		}
+		if volumeID == nil {
+			return nil
+		}
+		// the volume can only be deleted once it has been detached
+		if err := compute.WaitUntilInstanceTerminated(instanceFilter); err != nil {
+			return err
+		}
+		_, err := compute.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: volumeID})
+		return err
+	})
 
 	if err = compute.WaitUntilInstanceRunning(instanceFilter); err != nil {
 		log.Fatalf("Error waiting for instance to start: %s", err)
 	}
 	log.Infof("Instance %s is running", *instanceID)
 
+	if *info != "" {
+		runInfo := RunInfo{Backend: "aws", ID: *instanceID, ConsoleLog: *consoleLog}
+		instances, err := compute.DescribeInstances(instanceFilter)
+		if err != nil {
+			log.Fatalf("Error describing instance %s: %s", *instanceID, err)
+		}
+		for _, r := range instances.Reservations {
+			for _, i := range r.Instances {
+				if i.PublicIpAddress != nil {
+					runInfo.IPs = append(runInfo.IPs, *i.PublicIpAddress)
+				}
+				if i.PrivateIpAddress != nil {
+					runInfo.IPs = append(runInfo.IPs, *i.PrivateIpAddress)
+				}
+			}
+		}
+		if err := writeRunInfo(*info, runInfo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if diskSize > 0 {
 		// 3. Create EBS Volume
 		diskParams := &ec2.CreateVolumeInput{
@@ -148,6 +244,7 @@ func runAWS(args []string) {
 		if err != nil {
 			log.Fatalf("Error creating volume: %s", err)
 		}
+		volumeID = volume.VolumeId
 
 		waitVol := &ec2.DescribeVolumesInput{
 			Filters: []*ec2.Filter{
@@ -180,7 +277,10 @@ func runAWS(args []string) {
 	log.Warn("Waiting for instance to stop...")
 
 	if err = compute.WaitUntilInstanceStopped(instanceFilter); err != nil {
-		log.Fatalf("Error waiting for instance to stop: %s", err)
+		if !*spotFlag || !awsSpotInterrupted(compute, instanceFilter) {
+			log.Fatalf("Error waiting for instance to stop: %s", err)
+		}
+		log.Warnf("Spot instance %s was interrupted", *instanceID)
 	}
 
 	consoleParams := &ec2.GetConsoleOutputInput{
@@ -198,8 +298,13 @@ func runAWS(args []string) {
 		if err != nil {
 			log.Fatalf("Error decoding output: %s", err)
 		}
-		fmt.Printf(string(out) + "\n")
+		stdout, err := consoleWriter(os.Stdout, *consoleLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(stdout, "%s\n", out)
 	}
+	forgetInstance()
 	log.Infof("Terminating instance %s", *instanceID)
 	terminateParams := &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{instanceID},
@@ -211,3 +316,54 @@ func runAWS(args []string) {
 		log.Fatalf("Error waiting for instance to terminate: %s", err)
 	}
 }
+
+// awsSpotInterrupted checks if a Spot instance was terminated because it was
+// interrupted
+func awsSpotInterrupted(compute *ec2.EC2, instanceFilter *ec2.DescribeInstancesInput) bool {
+	instances, err := compute.DescribeInstances(instanceFilter)
+	if err != nil {
+		return false
+	}
+	for _, r := range instances.Reservations {
+		for _, i := range r.Instances {
+			if i.StateReason != nil && aws.StringValue(i.StateReason.Code) == "Server.SpotInstanceTermination" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// awsCheckInstanceType checks that an image can boot on an instance type
+func awsCheckInstanceType(compute *ec2.EC2, image *ec2.Image, machine string) error {
+	types, err := compute.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{aws.String(machine)},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe instance type %s: %v", machine, err)
+	}
+	if len(types.InstanceTypes) == 0 {
+		return fmt.Errorf("Unknown instance type %s", machine)
+	}
+	t := types.InstanceTypes[0]
+
+	arch := aws.StringValue(image.Architecture)
+	supported := false
+	if t.ProcessorInfo != nil {
+		for _, a := range t.ProcessorInfo.SupportedArchitectures {
+			if aws.StringValue(a) == arch {
+				supported = true
+			}
+		}
+	}
+	if !supported {
+		return fmt.Errorf("Instance type %s does not support %s images", machine, arch)
+	}
+	if t.NetworkInfo != nil && aws.StringValue(t.NetworkInfo.EnaSupport) == ec2.EnaSupportRequired && !aws.BoolValue(image.EnaSupport) {
+		return fmt.Errorf("Instance type %s requires ENA networking, push the image with -ena", machine)
+	}
+	if aws.StringValue(t.Hypervisor) == ec2.InstanceTypeHypervisorNitro {
+		log.Infof("%s is a Nitro instance, EBS volumes are NVMe devices so the kernel needs the ENA and NVMe drivers", machine)
+	}
+	return nil
+}
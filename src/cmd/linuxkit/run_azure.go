@@ -1,13 +1,14 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // This program requires that the following environment vars are set:
@@ -20,12 +21,14 @@ import (
 const defaultStorageAccountName = "linuxkit"
 
 func runAzure(args []string) {
-	flags := flag.NewFlagSet("azure", flag.ExitOnError)
+	flags := newFlagSet("azure")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
-		fmt.Printf("USAGE: %s run azure [options] imagePath\n\n", invoked)
+		fmt.Printf("USAGE: %s run azure [options] [imagePath]\n\n", invoked)
 		fmt.Printf("'imagePath' specifies the path (absolute or relative) of a\n")
-		fmt.Printf("VHD image be used as the OS image for the VM\n")
+		fmt.Printf("VHD image be used as the OS image for the VM. It is not\n")
+		fmt.Printf("given with -gallery, which boots from an image which was\n")
+		fmt.Printf("published in a Shared Image Gallery with 'push azure'\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
@@ -33,6 +36,19 @@ func runAzure(args []string) {
 	resourceGroupName := flags.String("resourceGroupName", "", "Name of resource group to be used for VM")
 	location := flags.String("location", "westus", "Location of the VM")
 	accountName := flags.String("accountName", defaultStorageAccountName, "Name of the storage account")
+	size := flags.String("size", defaultVMSize, "Size of the VM")
+	zone := flags.String("zone", "", "Availability zone of the VM, e.g. 1. The default is no zone")
+	generation := flags.Int("generation", 1, "Hyper-V generation of the VM, 1 or 2. Generation 2 VMs boot with UEFI")
+	gallery := flags.String("gallery", "", "Shared Image Gallery to boot the VM from, instead of uploading a VHD")
+	galleryGroup := flags.String("gallery-resource-group", "", "Resource group of the gallery. Defaults to -resourceGroupName")
+	definition := flags.String("gallery-image", "", "Image definition in the gallery. *Required* with -gallery")
+	version := flags.String("gallery-version", "", "Version of the image in the gallery. Defaults to the latest version")
+	spot := flags.Bool("spot", false, "Create a Spot VM, which is cheaper but can be evicted at any time")
+	spotMaxPrice := flags.Float64("spot-max-price", -1, "Maximum price per hour of a Spot VM in US dollars, -1 to pay up to the on-demand price and not be evicted for price reasons")
+	spotEvictionPolicy := flags.String("spot-eviction-policy", "Deallocate", "What happens to a Spot VM when it is evicted, Deallocate or Delete")
+	tags := tagFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
 
 	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
 	tenantID := getEnvVarOrExit("AZURE_TENANT_ID")
@@ -45,35 +61,104 @@ func runAzure(args []string) {
 	}
 
 	remArgs := flags.Args()
-	if len(remArgs) == 0 {
+	var imagePath string
+	switch {
+	case *gallery != "":
+		if len(remArgs) != 0 {
+			log.Fatalf("An image path cannot be given with -gallery")
+		}
+		if *definition == "" {
+			log.Fatalf("Please provide the image definition in the gallery with -gallery-image")
+		}
+	case len(remArgs) == 0:
 		fmt.Printf("Please specify the image to run\n")
 		flags.Usage()
 		os.Exit(1)
+	default:
+		imagePath = remArgs[0]
+	}
+
+	if *generation != 1 && *generation != 2 {
+		log.Fatalf("Invalid generation %d, must be 1 or 2", *generation)
+	}
+
+	var spotConfig *azureSpotConfig
+	if *spot {
+		if *spotEvictionPolicy != "Deallocate" && *spotEvictionPolicy != "Delete" {
+			log.Fatalf("Invalid -spot-eviction-policy %s, must be Deallocate or Delete", *spotEvictionPolicy)
+		}
+		spotConfig = &azureSpotConfig{MaxPrice: *spotMaxPrice, EvictionPolicy: *spotEvictionPolicy}
 	}
-	imagePath := remArgs[0]
 
 	rand.Seed(time.Now().UTC().UnixNano())
 	virtualNetworkName := fmt.Sprintf("linuxkitvirtualnetwork%d", rand.Intn(1000))
 	subnetName := fmt.Sprintf("linuxkitsubnet%d", rand.Intn(1000))
 	publicIPAddressName := fmt.Sprintf("publicip%d", rand.Intn(1000))
 	networkInterfaceName := fmt.Sprintf("networkinterface%d", rand.Intn(1000))
+	imageName := fmt.Sprintf("linuxkitimage%d", rand.Intn(1000))
 	virtualMachineName := fmt.Sprintf("linuxkitvm%d", rand.Intn(1000))
 
 	initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret)
+	setAzureTags(*tags)
 
 	group := createResourceGroup(*resourceGroupName, *location)
 	createStorageAccount(*accountName, *location, *group)
-	uploadVMImage(*group.Name, *accountName, imagePath)
+	// the resource group and storage account may be shared with other runs,
+	// so only the resources created below are deleted if the run fails
+	var imageID string
+	if *gallery != "" {
+		// the Hyper-V generation of the VM is the one of the image definition
+		if *galleryGroup == "" {
+			*galleryGroup = *group.Name
+		}
+		imageID = galleryImageID(*galleryGroup, galleryImage{Gallery: *gallery, Definition: *definition, Version: *version})
+		fmt.Printf("Using gallery image %s\n", imageID)
+	} else {
+		uploadVMImage(*group.Name, *accountName, imagePath)
+		onCleanup("blob "+defaultStorageBlobName, func() error {
+			_, err := simpleStorageClient.GetBlobService().DeleteBlobIfExists(defaultStorageContainerName, defaultStorageBlobName, nil)
+			return err
+		})
+		imageID = createManagedImage(*group, *accountName, imageName, *location, *generation)
+		onCleanup("image "+imageName, func() error {
+			future, err := imagesClient.Delete(context.Background(), *group.Name, imageName)
+			return waitForDeletion(future.FutureAPI, err, imagesClient.Client)
+		})
+	}
 	createVirtualNetwork(*group, virtualNetworkName, *location)
+	onCleanup("virtual network "+virtualNetworkName, func() error {
+		future, err := virtualNetworksClient.Delete(context.Background(), *group.Name, virtualNetworkName)
+		return waitForDeletion(future.FutureAPI, err, virtualNetworksClient.Client)
+	})
 	subnet := createSubnet(*group, virtualNetworkName, subnetName)
-	publicIPAddress := createPublicIPAddress(*group, publicIPAddressName, *location)
+	publicIPAddress := createPublicIPAddress(*group, publicIPAddressName, *location, *zone)
+	onCleanup("public IP address "+publicIPAddressName, func() error {
+		future, err := publicIPAddressesClient.Delete(context.Background(), *group.Name, publicIPAddressName)
+		return waitForDeletion(future.FutureAPI, err, publicIPAddressesClient.Client)
+	})
 	networkInterface := createNetworkInterface(*group, networkInterfaceName, *publicIPAddress, *subnet, *location)
-	go createVirtualMachine(*group, *accountName, virtualMachineName, *networkInterface, *publicIPAddress, *location)
-
-	fmt.Printf("\nStarted deployment of virtual machine %s in resource group %s", virtualMachineName, *group.Name)
+	onCleanup("network interface "+networkInterfaceName, func() error {
+		future, err := interfacesClient.Delete(context.Background(), *group.Name, networkInterfaceName)
+		return waitForDeletion(future.FutureAPI, err, interfacesClient.Client)
+	})
+	onCleanup("virtual machine "+virtualMachineName, func() error {
+		future, err := virtualMachinesClient.Delete(context.Background(), *group.Name, virtualMachineName)
+		return waitForDeletion(future.FutureAPI, err, virtualMachinesClient.Client)
+	})
+	go createVirtualMachine(*group, *accountName, imageID, virtualMachineName, *networkInterface, *location, *size, *zone, spotConfig)
+
+	log.WithFields(log.Fields{"vm": virtualMachineName, "group": *group.Name}).Infof("Started deployment of virtual machine %s in resource group %s", virtualMachineName, *group.Name)
 
 	time.Sleep(time.Second * 5)
 
-	fmt.Printf("\nNOTE: Since you created a minimal VM without the Azure Linux Agent, the portal will notify you that the deployment failed. After around 50 seconds try connecting to the VM")
-	fmt.Printf("\nssh -i path-to-key root@%s\n", *publicIPAddress.DNSSettings.Fqdn)
+	log.Warn("Since you created a minimal VM without the Azure Linux Agent, the portal will notify you that the deployment failed. After around 50 seconds try connecting to the VM")
+	log.WithField("ssh", "root@"+*publicIPAddress.DNSSettings.Fqdn).Infof("ssh -i path-to-key root@%s", *publicIPAddress.DNSSettings.Fqdn)
+	runInfo := RunInfo{Backend: "azure", Name: virtualMachineName, SSH: "root@" + *publicIPAddress.DNSSettings.Fqdn}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	keepResources()
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cloudHypervisorNetworkingNone    string = "none"
+	cloudHypervisorNetworkingTap            = "tap"
+	cloudHypervisorNetworkingDefault        = cloudHypervisorNetworkingTap
+
+	cloudHypervisorAPISocket = "cloud-hypervisor.sock"
+)
+
+// cloudHypervisorActions are the API requests which can be sent to a running VM
+var cloudHypervisorActions = map[string]string{
+	"info":     http.MethodGet,
+	"pause":    http.MethodPut,
+	"resume":   http.MethodPut,
+	"reboot":   http.MethodPut,
+	"shutdown": http.MethodPut,
+}
+
+// VirtioFS is the config for a directory shared with virtio-fs
+type VirtioFS struct {
+	Tag  string
+	Path string
+}
+
+// VirtioFSs is the type for a list of VirtioFS
+type VirtioFSs []VirtioFS
+
+func (l *VirtioFSs) String() string {
+	return fmt.Sprint(*l)
+}
+
+// Set is used by flag to configure value from CLI
+func (l *VirtioFSs) Set(value string) error {
+	c := strings.SplitN(value, "=", 2)
+	if len(c) != 2 || c[0] == "" || c[1] == "" {
+		return fmt.Errorf("Shared directory must be tag=path: %s", value)
+	}
+	*l = append(*l, VirtioFS{Tag: c[0], Path: c[1]})
+	return nil
+}
+
+func cloudHypervisorUsage(flags *flag.FlagSet) {
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf("USAGE: %s run cloud-hypervisor [options] prefix\n", invoked)
+	fmt.Printf("       %s run cloud-hypervisor [info|pause|resume|reboot|shutdown] [-state path] prefix\n\n", invoked)
+	fmt.Printf("'prefix' specifies the path to the VM image.\n")
+	fmt.Printf("The second form sends a request to a running VM using the cloud-hypervisor\n")
+	fmt.Printf("API socket in the state directory.\n")
+	fmt.Printf("\n")
+	fmt.Printf("Options:\n")
+	flags.PrintDefaults()
+	fmt.Printf("\n")
+	fmt.Printf("If not running as root note that '-networking tap' requires CAP_NET_ADMIN\n")
+	fmt.Printf("and '-fs' requires virtiofsd in the $PATH.\n")
+}
+
+func runCloudHypervisor(args []string) {
+	if len(args) > 0 && cloudHypervisorActions[args[0]] != "" {
+		cloudHypervisorAction(args[0], args[1:])
+		return
+	}
+
+	flags := newFlagSet("cloud-hypervisor")
+	flags.Usage = func() { cloudHypervisorUsage(flags) }
+
+	// Boot type; we try to determine automatically
+	squashFSBoot := flags.Bool("squashfs", false, "Boot image is a kernel+squashfs+cmdline")
+	kernelBoot := flags.Bool("kernel", false, "Boot image is kernel+initrd+cmdline 'path'-kernel/-initrd/-cmdline")
+	fw := flags.String("fw", "", "Path to the firmware used to boot a disk image, such as rust-hypervisor-firmware or CLOUDHV.fd")
+
+	// State flags
+	state := flags.String("state", "", "Path to directory to keep VM state in")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+
+	// Paths and settings for disks
+	var disks Disks
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=raw]")
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+
+	var shares VirtioFSs
+	flags.Var(&shares, "fs", "Share a host directory with virtio-fs, may be repeated. tag=path")
+
+	// VM configuration
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+
+	// Backend configuration
+	chPath := flags.String("cloud-hypervisor", "cloud-hypervisor", "Path to the cloud-hypervisor binary")
+	virtiofsdPath := flags.String("virtiofsd", "virtiofsd", "Path to the virtiofsd binary")
+
+	// Networking
+	networking := flags.String("networking", cloudHypervisorNetworkingDefault, "Networking mode. Valid options are 'default', 'tap[,name]' and 'none'. 'tap' uses a preexisting tap device, or without a name cloud-hypervisor creates one. 'none' disables networking.")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify the path to the image to boot")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	// if the path does not exist, must be trying to do a kernel+initrd or kernel+squashfs boot
+	if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path + "-kernel"); err == nil {
+			if _, err := os.Stat(path + "-squashfs.img"); err == nil {
+				*squashFSBoot = true
+			} else {
+				*kernelBoot = true
+			}
+		}
+	}
+	if !*kernelBoot && !*squashFSBoot {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatalf("Boot disk image %s does not exist", path)
+		}
+		if *fw == "" {
+			log.Fatalf("Booting a disk image requires firmware, use -fw")
+		}
+	}
+
+	if *state == "" {
+		*state = path + "-state"
+	}
+	if err := os.MkdirAll(*state, 0755); err != nil {
+		log.Fatalf("Could not create state directory: %v", err)
+	}
+
+	var chArgs []string
+	chArgs = append(chArgs, "--cpus", fmt.Sprintf("boot=%d", *cpus))
+	memory := fmt.Sprintf("size=%dM", *mem)
+	if len(shares) > 0 {
+		// vhost-user devices need the guest memory to be shared
+		memory += ",shared=on"
+	}
+	chArgs = append(chArgs, "--memory", memory)
+	chArgs = append(chArgs, "--rng", "src=/dev/urandom")
+	chArgs = append(chArgs, "--serial", "tty", "--console", "off")
+
+	apiSocket := filepath.Join(*state, cloudHypervisorAPISocket)
+	// remove a stale socket from a previous run
+	if err := os.Remove(apiSocket); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Cannot remove API socket: %v", err)
+	}
+	chArgs = append(chArgs, "--api-socket", "path="+apiSocket)
+
+	var cmdline string
+	if *kernelBoot || *squashFSBoot {
+		cmdlineBytes, err := ioutil.ReadFile(path + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot open cmdline file: %v", err)
+		}
+		cmdline = strings.TrimSpace(string(cmdlineBytes))
+		// the serial port is the console
+		if !strings.Contains(cmdline, "console=") {
+			cmdline += " console=ttyS0"
+		}
+	}
+
+	var diskArgs []string
+	switch {
+	case *kernelBoot:
+		chArgs = append(chArgs, "--kernel", path+"-kernel", "--initramfs", path+"-initrd.img")
+		chArgs = append(chArgs, "--cmdline", cmdline)
+	case *squashFSBoot:
+		chArgs = append(chArgs, "--kernel", path+"-kernel")
+		chArgs = append(chArgs, "--cmdline", cmdline+" root=/dev/vda")
+		diskArgs = append(diskArgs, "path="+path+"-squashfs.img,readonly=on")
+	default:
+		chArgs = append(chArgs, "--firmware", *fw)
+		diskArgs = append(diskArgs, "path="+path)
+	}
+
+	if err := checkHostResources(*cpus, *mem, disks, *state); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, d := range disks {
+		id := ""
+		if i != 0 {
+			id = strconv.Itoa(i)
+		}
+		if d.Size != 0 && d.Format == "" {
+			d.Format = "raw"
+		}
+		if d.Size != 0 && d.Path == "" {
+			d.Path = filepath.Join(*state, "disk"+id+".img")
+		}
+		if d.Path == "" {
+			log.Fatalf("disk specified with no size or name")
+		}
+		if _, err := os.Stat(d.Path); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			if !diskimage.Supported(d.Format) {
+				log.Fatalf("Cannot create a disk in format %s", d.Format)
+			}
+			log.Debugf("Creating new disk [%s] format %s", d.Path, d.Format)
+			if err := diskimage.Create(d.Path, d.Format, int64(d.Size)*1024*1024); err != nil {
+				log.Fatalf("Error creating disk [%s] format %s: %v", d.Path, d.Format, err)
+			}
+		} else {
+			log.Infof("Using existing disk [%s] format %s", d.Path, d.Format)
+		}
+		diskArgs = append(diskArgs, "path="+d.Path)
+	}
+
+	// The metadata is attached as a read only disk, which the metadata
+	// package finds by its label
+	metadataPaths, err := CreateMetadataISO(*state, *data, *dataPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, p := range metadataPaths {
+		diskArgs = append(diskArgs, "path="+p+",readonly=on")
+	}
+	if len(diskArgs) > 0 {
+		chArgs = append(chArgs, "--disk")
+		chArgs = append(chArgs, diskArgs...)
+	}
+
+	if *networking == "" || *networking == "default" {
+		*networking = cloudHypervisorNetworkingDefault
+	}
+	netMode := strings.SplitN(*networking, ",", 2)
+	switch netMode[0] {
+	case cloudHypervisorNetworkingTap:
+		net := "mac=" + retrieveMAC(*state).String()
+		if len(netMode) == 2 {
+			net = "tap=" + netMode[1] + "," + net
+		}
+		chArgs = append(chArgs, "--net", net)
+	case cloudHypervisorNetworkingNone:
+	default:
+		log.Fatalf("Invalid networking mode: %s", netMode[0])
+	}
+
+	var virtiofsds []*exec.Cmd
+	if len(shares) > 0 {
+		var fsArgs []string
+		for i, s := range shares {
+			socket := filepath.Join(*state, fmt.Sprintf("virtiofs%d.sock", i))
+			virtiofsd, err := startVirtiofsd(*virtiofsdPath, socket, s.Path)
+			if err != nil {
+				log.Fatalf("Cannot share %s: %v", s.Path, err)
+			}
+			virtiofsds = append(virtiofsds, virtiofsd)
+			fsArgs = append(fsArgs, fmt.Sprintf("tag=%s,socket=%s", s.Tag, socket))
+		}
+		chArgs = append(chArgs, "--fs")
+		chArgs = append(chArgs, fsArgs...)
+	}
+
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeRunInfo(*info, RunInfo{Backend: "cloud-hypervisor", StatePath: *state, ConsoleLog: *consoleLog}); err != nil {
+		log.Fatal(err)
+	}
+
+	chCmd := exec.Command(*chPath, chArgs...)
+	log.Debugf("%v\n", chCmd.Args)
+	chCmd.Stdin = os.Stdin
+	chCmd.Stdout = stdout
+	chCmd.Stderr = os.Stderr
+	err = chCmd.Run()
+	for _, v := range virtiofsds {
+		v.Process.Kill()
+		v.Wait()
+	}
+	exitGuestStatus()
+	if err != nil {
+		log.Fatalf("cloud-hypervisor failed: %v", err)
+	}
+}
+
+// startVirtiofsd starts a virtiofsd to share dir and waits for its socket
+func startVirtiofsd(virtiofsd, socket, dir string) (*exec.Cmd, error) {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	cmd := exec.Command(virtiofsd, "--socket-path="+socket, "--shared-dir="+dir, "--cache=never")
+	cmd.Stderr = os.Stderr
+	log.Debugf("%v\n", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return cmd, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	return nil, fmt.Errorf("virtiofsd did not create %s", socket)
+}
+
+// cloudHypervisorAction sends an API request to a running VM
+func cloudHypervisorAction(action string, args []string) {
+	flags := newFlagSet("cloud-hypervisor " + action)
+	flags.Usage = func() { cloudHypervisorUsage(flags) }
+	state := flags.String("state", "", "Path to directory the VM keeps its state in")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if *state == "" {
+		if flags.NArg() == 0 {
+			fmt.Println("Please specify the path to the image or the state directory")
+			flags.Usage()
+			os.Exit(1)
+		}
+		*state = flags.Arg(0) + "-state"
+	}
+	socket := filepath.Join(*state, cloudHypervisorAPISocket)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	req, err := http.NewRequest(cloudHypervisorActions[action], "http://localhost/api/v1/vm."+action, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Cannot connect to cloud-hypervisor: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Cannot read response: %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Fatalf("%s failed: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if len(body) > 0 {
+		fmt.Println(strings.TrimSpace(string(body)))
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -22,11 +22,13 @@ const (
 	familyVar  = "CLOUDSDK_IMAGE_FAMILY" // non-standard
 	publicVar  = "CLOUDSDK_IMAGE_PUBLIC" // non-standard
 	nameVar    = "CLOUDSDK_IMAGE_NAME"   // non-standard
+
+	serviceAccountVar = "CLOUDSDK_COMPUTE_SERVICE_ACCOUNT" // non-standard
 )
 
 // Process the run arguments and execute run
 func runGcp(args []string) {
-	flags := flag.NewFlagSet("gcp", flag.ExitOnError)
+	flags := newFlagSet("gcp")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run gcp [options] [image]\n\n", invoked)
@@ -45,7 +47,19 @@ func runGcp(args []string) {
 	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]diskName[,size=1G]")
 
 	skipCleanup := flags.Bool("skip-cleanup", false, "Don't remove images or VMs")
-	nestedVirt := flags.Bool("nested-virt", false, "Enabled nested virtualization")
+	nestedVirt := flags.Bool("nested-virt", false, "Enable nested virtualization, so the instance can run VMs with KVM")
+	minCPUPlatform := flags.String("min-cpu-platform", "", "Minimum CPU platform of the instance, e.g. 'Intel Cascade Lake' or 'AMD Milan' (default 'Intel Haswell' with -nested-virt on Intel machine types)")
+	secureBoot := flags.Bool("secure-boot", false, "Enable Shielded VM secure boot, the image must support UEFI")
+	vtpm := flags.Bool("vtpm", false, "Enable the Shielded VM virtual TPM, the image must support UEFI")
+	integrityMonitoring := flags.Bool("integrity-monitoring", false, "Enable Shielded VM integrity monitoring, requires -vtpm")
+	confidential := flags.Bool("confidential", false, "Create a Confidential VM with AMD SEV memory encryption, the image must be pushed with SEV_CAPABLE and the machine type must be an N2D or C2D type")
+	spot := flags.Bool("spot", false, "Create a Spot VM, which is cheaper but can be preempted at any time")
+	spotAction := flags.String("spot-termination-action", "STOP", "What happens to a Spot VM when it is preempted, STOP or DELETE")
+	serviceAccount := flags.String("service-account", "", "Email of the service account the instance runs as, or 'default' for the Compute Engine default service account (default no service account, unless -scopes is given)")
+	scopes := flags.String("scopes", "", "Comma separated OAuth scopes of the service account, either URLs or short names like cloud-platform (default cloud-platform)")
+	tags := tagFlag(flags)
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
 
 	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
 	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
@@ -82,20 +96,84 @@ func runGcp(args []string) {
 	keys := getStringValue(keysVar, *keysFlag, "")
 	project := getStringValue(projectVar, *projectFlag, "")
 
+	if *integrityMonitoring && !*vtpm {
+		log.Fatal("-integrity-monitoring requires -vtpm")
+	}
+	if *confidential {
+		if *nestedVirt {
+			log.Fatal("Confidential VMs do not support nested virtualization")
+		}
+		if !strings.HasPrefix(machine, "n2d-") && !strings.HasPrefix(machine, "c2d-") {
+			log.Warnf("Machine type %s may not support Confidential VMs, use an N2D or C2D machine type", machine)
+		}
+	}
+	if *nestedVirt && strings.HasPrefix(machine, "t2a-") {
+		log.Fatal("Arm machine types do not support nested virtualization")
+	}
+	if *nestedVirt && *minCPUPlatform == "" && !gcpAMDMachine(machine) {
+		// nested virtualization requires Haswell or newer Intel CPUs
+		*minCPUPlatform = "Intel Haswell"
+	}
+	var spotTerminationAction string
+	if *spot {
+		spotTerminationAction = strings.ToUpper(*spotAction)
+		if spotTerminationAction != "STOP" && spotTerminationAction != "DELETE" {
+			log.Fatalf("Invalid -spot-termination-action %s, must be STOP or DELETE", *spotAction)
+		}
+	}
+	security := GCPSecurityConfig{
+		SecureBoot:          *secureBoot,
+		VTPM:                *vtpm,
+		IntegrityMonitoring: *integrityMonitoring,
+		Confidential:        *confidential,
+	}
+	identity := GCPIdentityConfig{
+		ServiceAccount: getStringValue(serviceAccountVar, *serviceAccount, ""),
+		Scopes:         gcpScopes(*scopes),
+	}
+	if identity.ServiceAccount == "" && len(identity.Scopes) > 0 {
+		identity.ServiceAccount = "default"
+	}
+	// access is controlled by the IAM roles of the service account then
+	if identity.ServiceAccount != "" && len(identity.Scopes) == 0 {
+		identity.Scopes = gcpScopes("cloud-platform")
+	}
+
 	client, err := NewGCPClient(keys, project)
 	if err != nil {
 		log.Fatalf("Unable to connect to GCP: %v", err)
 	}
 
-	if err = client.CreateInstance(*name, image, zone, machine, disks, data, *nestedVirt, true); err != nil {
+	forgetInstance := func() {}
+	if !*skipCleanup {
+		forgetInstance = onCleanup("instance "+*name, func() error {
+			return client.DeleteInstance(*name, zone, true)
+		})
+	}
+	if err = client.CreateInstance(*name, image, zone, machine, disks, data, security, identity, spotTerminationAction, tags.Map(), *nestedVirt, *minCPUPlatform, true); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeRunInfo(*info, RunInfo{Backend: "gcp", Name: *name, ConsoleLog: *consoleLog}); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = client.ConnectToInstanceSerialPort(*name, zone); err != nil {
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = client.ConnectToInstanceSerialPort(*name, zone, stdout); err != nil {
 		log.Fatal(err)
 	}
+	if *spot {
+		if preempted, err := client.WasPreempted(*name, zone); err != nil {
+			log.Warnf("Unable to check if Spot VM %s was preempted: %v", *name, err)
+		} else if preempted {
+			log.Warnf("Spot VM %s was preempted", *name)
+		}
+	}
 
 	if !*skipCleanup {
+		forgetInstance()
 		if err = client.DeleteInstance(*name, zone, true); err != nil {
 			log.Fatal(err)
 		}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/moby/hyperkit/go"
@@ -33,7 +34,7 @@ func init() {
 
 // Process the run arguments and execute run
 func runHyperKit(args []string) {
-	flags := flag.NewFlagSet("hyperkit", flag.ExitOnError)
+	flags := newFlagSet("hyperkit")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run hyperkit [options] prefix\n\n", invoked)
@@ -72,6 +73,10 @@ func runHyperKit(args []string) {
 
 	// Hyperkit settings
 	consoleToFile := flags.Bool("console-file", false, "Output the console to a tty file")
+	detached := flags.Bool("detached", false, "Run hyperkit in the background, the console is connected to a tty in the state directory which 'linuxkit attach' connects to")
+	consoleLog := consoleLogFlag(flags)
+	ready := readinessFlags(flags)
+	info := runInfoFlag(flags)
 
 	// Paths and settings for UEFI firmware
 	// Note, the default uses the firmware shipped with Docker for Mac
@@ -202,9 +207,34 @@ func runHyperKit(args []string) {
 		log.Fatalln("Error creating hyperkit: ", err)
 	}
 
-	if *consoleToFile {
+	if *consoleToFile || *detached {
 		h.Console = hyperkit.ConsoleFile
 	}
+	if *detached {
+		if *consoleLog != "" {
+			log.Fatalf("Cannot specify both -detached and -console-log, use 'linuxkit attach -console-log' instead")
+		}
+		// hyperkit links the tty when it starts, not to attach to an old one
+		os.Remove(filepath.Join(*state, consoleTTY))
+	}
+	if ready.enabled() && !*detached {
+		log.Fatal("-wait-for requires -detached")
+	}
+	if *consoleLog != "" && *consoleToFile {
+		log.Fatalf("Cannot specify both -console-file and -console-log")
+	}
+	if consoleCaptured(*consoleLog) && !*consoleToFile && !*detached {
+		// hyperkit attaches a terminal on stdio directly to the VM, so
+		// use the tty in the state directory to copy the output
+		stdout, err := consoleWriter(os.Stdout, *consoleLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h.Console = hyperkit.ConsoleFile
+		tty := filepath.Join(*state, consoleTTY)
+		os.Remove(tty)
+		go hyperkitAttachTTY(tty, stdout)
+	}
 
 	h.UUID = vmUUID
 	h.ISOImages = isoPaths
@@ -228,6 +258,10 @@ func runHyperKit(args []string) {
 		h.Bootrom = *fw
 	}
 
+	if err := checkHostResources(*cpus, *mem, disks, *state); err != nil {
+		log.Fatal(err)
+	}
+
 	for i, d := range disks {
 		id := ""
 		if i != 0 {
@@ -296,7 +330,10 @@ func runHyperKit(args []string) {
 			if err != nil {
 				log.Fatalln("Unable to start vpnkit: ", err)
 			}
-			defer shutdownVPNKit(vpnkitProcess)
+			// a detached VM keeps using the VPNKit instance
+			if !*detached {
+				defer shutdownVPNKit(vpnkitProcess)
+			}
 			log.RegisterExitHandler(func() {
 				shutdownVPNKit(vpnkitProcess)
 			})
@@ -334,19 +371,61 @@ func runHyperKit(args []string) {
 			if err != nil {
 				log.Fatalf("Publish ports failed with: %v", err)
 			}
-			defer f()
+			if !*detached {
+				defer f()
+			}
 			log.RegisterExitHandler(f)
 		default:
 			log.Fatalf("Port publishing requires %q or %q networking mode", hyperkitNetworkingDockerForMac, hyperkitNetworkingVPNKit)
 		}
 	}
 
+	runInfo := RunInfo{Backend: "hyperkit", ID: vmUUID, StatePath: *state, ConsoleLog: *consoleLog}
+	if *detached {
+		runInfo.Console = filepath.Join(*state, consoleTTY)
+	}
+	if h.VPNKitPreferredIPv4 != "" {
+		runInfo.IPs = []string{h.VPNKitPreferredIPv4}
+	}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+
+	if *detached {
+		if _, err := h.Start(cmdline); err != nil {
+			log.Fatalf("Cannot run hyperkit: %v", err)
+		}
+		log.Infof("hyperkit is running in the background, use 'linuxkit attach %s' to connect to its console", *state)
+		if err := ready.wait(runInfo); err != nil {
+			// the VM loses its network once VPNKit is shut down on exit
+			h.Stop()
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err = h.Run(cmdline)
+	exitGuestStatus()
 	if err != nil {
 		log.Fatalf("Cannot run hyperkit: %v", err)
 	}
 }
 
+// hyperkitAttachTTY waits for the console tty of the VM and connects it to
+// stdin and out
+func hyperkitAttachTTY(path string, out io.Writer) {
+	for {
+		tty, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			go io.Copy(tty, os.Stdin)
+			io.Copy(out, tty)
+			tty.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func shutdownVPNKit(process *os.Process) {
 	if process == nil {
 		return
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
-	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -15,23 +16,34 @@ import (
 
 // Process the run arguments and execute run
 func runHyperV(args []string) {
-	flags := flag.NewFlagSet("hyperv", flag.ExitOnError)
+	flags := newFlagSet("hyperv")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run hyperv [options] path\n\n", invoked)
-		fmt.Printf("'path' specifies the path to a EFI ISO file.\n")
+		fmt.Printf("'path' specifies the path to a EFI ISO file, or a BIOS ISO file\n")
+		fmt.Printf("with -generation 1.\n")
 		fmt.Printf("\n")
 		fmt.Printf("Options:\n")
 		flags.PrintDefaults()
 	}
 	keep := flags.Bool("keep", false, "Keep the VM after finishing")
+	detached := flags.Bool("detached", false, "Start the VM and return without connecting to its console, which 'linuxkit attach' connects to given the name of the VM. The VM is kept")
+	agent := flags.Bool("agent", false, "Register the Hyper-V socket service of the linuxkit/agent package, which 'linuxkit exec', 'cp' and 'logs' connect to given the name of the VM")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
 	vmName := flags.String("name", "", "Name of the Hyper-V VM")
 	cpus := flags.Int("cpus", 1, "Number of CPUs")
 	mem := flags.Int("mem", 1024, "Amount of memory in MB")
 	var disks Disks
 	flags.Var(&disks, "disk", "Disk config. [file=]path[,size=1G]")
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
 
 	switchName := flags.String("switch", "", "Which Hyper-V switch to attache the VM to. If left empty, either 'Default Switch' or the first external switch found is used.")
+	nat := flags.Bool("nat", false, "Attach the VM to an internal switch with NAT, which is created if it does not exist. The switch is named with -switch, or '"+hypervNATSwitchName+"'")
+	natSubnet := flags.String("nat-subnet", hypervNATSubnet, "Subnet of a NAT switch created with -nat, the host has its first address")
+	generation := flags.Int("generation", 2, "Generation of the VM, 2 boots EFI ISOs and 1 BIOS ISOs")
+	secureBoot := flags.String("secure-boot", "", "Enable Secure Boot with the given template, one of "+strings.Join(hypervSecureBootTemplates, ", ")+". Generation 2 only, Secure Boot is disabled if empty")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -42,12 +54,52 @@ func runHyperV(args []string) {
 		flags.Usage()
 		os.Exit(1)
 	}
-	isoPath := remArgs[0]
+	// Hyper-V resolves relative paths against its own working directory
+	isoPath, err := filepath.Abs(remArgs[0])
+	if err != nil {
+		log.Fatalf("Invalid path %s: %v", remArgs[0], err)
+	}
+
+	if *detached && *consoleLog != "" {
+		log.Fatal("Cannot specify both -detached and -console-log")
+	}
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+	// the metadata is served over a Hyper-V socket while the console is
+	// attached, as there is no metadata ISO
+	var metadata []byte
+	if *dataPath != "" {
+		if metadata, err = ioutil.ReadFile(*dataPath); err != nil {
+			log.Fatalf("Cannot read user data from path %s: %v", *dataPath, err)
+		}
+	} else if *data != "" {
+		metadata = []byte(*data)
+	}
+	if metadata != nil && *detached {
+		log.Fatal("Cannot specify both -detached and -data or -data-file")
+	}
+	if *generation != 1 && *generation != 2 {
+		log.Fatalf("Invalid generation %d, must be 1 or 2", *generation)
+	}
+	if *secureBoot != "" {
+		if *generation != 2 {
+			log.Fatal("Secure Boot requires -generation 2")
+		}
+		if !hypervSecureBootTemplate(*secureBoot) {
+			log.Fatalf("Invalid Secure Boot template %s, must be one of %s", *secureBoot, strings.Join(hypervSecureBootTemplates, ", "))
+		}
+	}
 
 	// Sanity checks. Errors out on failure
 	hypervChecks()
 
-	vmSwitch, err := hypervGetSwitch(*switchName)
+	var vmSwitch string
+	if *nat {
+		vmSwitch, err = hypervNATSwitch(getStringValue("", *switchName, hypervNATSwitchName), *natSubnet)
+	} else {
+		vmSwitch, err = hypervGetSwitch(*switchName)
+	}
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -61,15 +113,15 @@ func runHyperV(args []string) {
 	}
 
 	log.Infof("Creating VM: %s", *vmName)
-	_, out, err := poshCmd("New-VM", "-Name", fmt.Sprintf("'%s'", *vmName),
-		"-Generation", "2",
+	_, out, err := poshCmd("New-VM", "-Name", poshString(*vmName),
+		"-Generation", strconv.Itoa(*generation),
 		"-NoVHD",
-		"-SwitchName", fmt.Sprintf("'%s'", vmSwitch))
+		"-SwitchName", poshString(vmSwitch))
 	if err != nil {
 		log.Fatalf("Failed to create new VM: %v\n%s", err, out)
 	}
 	log.Infof("Configure VM: %s", *vmName)
-	_, out, err = poshCmd("Set-VM", "-Name", fmt.Sprintf("'%s'", *vmName),
+	_, out, err = poshCmd("Set-VM", "-Name", poshString(*vmName),
 		"-AutomaticStartAction", "Nothing",
 		"-AutomaticStopAction", "ShutDown",
 		"-CheckpointType", "Disabled",
@@ -91,12 +143,15 @@ func runHyperV(args []string) {
 		if d.Path == "" {
 			log.Fatalf("disk specified with no size or name")
 		}
+		if d.Path, err = filepath.Abs(d.Path); err != nil {
+			log.Fatalf("Invalid disk path %s: %v", d.Path, err)
+		}
 
 		if _, err := os.Stat(d.Path); err != nil {
 			if os.IsNotExist(err) {
 				log.Infof("Creating new disk %s %dMB", d.Path, d.Size)
 				_, out, err = poshCmd("New-VHD",
-					"-Path", fmt.Sprintf("'%s'", d.Path),
+					"-Path", poshString(d.Path),
 					"-SizeBytes", fmt.Sprintf("%dMB", d.Size),
 					"-Dynamic")
 				if err != nil {
@@ -110,45 +165,112 @@ func runHyperV(args []string) {
 		}
 
 		_, out, err = poshCmd("Add-VMHardDiskDrive",
-			"-VMName", fmt.Sprintf("'%s'", *vmName),
-			"-Path", fmt.Sprintf("'%s'", d.Path))
+			"-VMName", poshString(*vmName),
+			"-Path", poshString(d.Path))
 		if err != nil {
 			log.Fatalf("Failed to add VHD %s: %v\n%s", d.Path, err, out)
 		}
 	}
 
 	log.Info("Setting up boot from ISO")
-	_, out, err = poshCmd("Add-VMDvdDrive",
-		"-VMName", fmt.Sprintf("'%s'", *vmName),
-		"-Path", fmt.Sprintf("'%s'", isoPath))
-	if err != nil {
-		log.Fatalf("Failed add DVD: %v\n%s", err, out)
-	}
-	_, out, err = poshCmd(
-		fmt.Sprintf("$cdrom = Get-VMDvdDrive -vmname '%s';", *vmName),
-		"Set-VMFirmware", "-VMName", fmt.Sprintf("'%s'", *vmName),
-		"-EnableSecureBoot", "Off",
-		"-FirstBootDevice", "$cdrom")
-	if err != nil {
-		log.Fatalf("Failed set DVD as boot device: %v\n%s", err, out)
+	if *generation == 1 {
+		// generation 1 VMs are created with a DVD drive
+		_, out, err = poshCmd("Set-VMDvdDrive",
+			"-VMName", poshString(*vmName),
+			"-ControllerNumber", "1",
+			"-ControllerLocation", "0",
+			"-Path", poshString(isoPath))
+		if err != nil {
+			log.Fatalf("Failed set DVD: %v\n%s", err, out)
+		}
+		_, out, err = poshCmd("Set-VMBios",
+			"-VMName", poshString(*vmName),
+			"-StartupOrder", `@("CD", "IDE", "LegacyNetworkAdapter", "Floppy")`)
+		if err != nil {
+			log.Fatalf("Failed set DVD as boot device: %v\n%s", err, out)
+		}
+	} else {
+		_, out, err = poshCmd("Add-VMDvdDrive",
+			"-VMName", poshString(*vmName),
+			"-Path", poshString(isoPath))
+		if err != nil {
+			log.Fatalf("Failed add DVD: %v\n%s", err, out)
+		}
+		firmware := []string{
+			"$cdrom = Get-VMDvdDrive -vmname " + poshString(*vmName) + ";",
+			"Set-VMFirmware", "-VMName", poshString(*vmName),
+			"-FirstBootDevice", "$cdrom",
+		}
+		if *secureBoot != "" {
+			firmware = append(firmware, "-EnableSecureBoot", "On", "-SecureBootTemplate", *secureBoot)
+		} else {
+			firmware = append(firmware, "-EnableSecureBoot", "Off")
+		}
+		_, out, err = poshCmd(firmware...)
+		if err != nil {
+			log.Fatalf("Failed set DVD as boot device: %v\n%s", err, out)
+		}
 	}
 
 	log.Info("Set up COM port")
 	_, out, err = poshCmd("Set-VMComPort",
-		"-VMName", fmt.Sprintf("'%s'", *vmName),
+		"-VMName", poshString(*vmName),
 		"-number", "1",
-		"-Path", fmt.Sprintf(`\\.\pipe\%s-com1`, *vmName))
+		"-Path", hypervConsolePipe(*vmName))
 	if err != nil {
 		log.Fatalf("Failed set up COM port: %v\n%s", err, out)
 	}
 
+	if *agent {
+		log.Info("Register the Hyper-V socket service of the agent")
+		if err := hypervRegisterVsockService(agentPort, "LinuxKit agent"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if metadata != nil {
+		log.Info("Serve the metadata over a Hyper-V socket")
+		if err := hypervRegisterVsockService(metadataChannelPort, "LinuxKit metadata"); err != nil {
+			log.Fatal(err)
+		}
+		l, err := hypervListenVsock(*vmName, metadataChannelPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		frame := metadataChannelFrame(metadata)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if _, err := c.Write(frame); err != nil {
+					log.Warnf("Unable to serve the metadata: %v", err)
+				}
+				c.Close()
+			}
+		}()
+	}
+
 	log.Info("Start the VM")
-	_, out, err = poshCmd("Start-VM", "-Name", fmt.Sprintf("'%s'", *vmName))
+	_, out, err = poshCmd("Start-VM", "-Name", poshString(*vmName))
 	if err != nil {
 		log.Fatalf("Failed start the VM: %v\n%s", err, out)
 	}
+	if err := writeRunInfo(*info, RunInfo{Backend: "hyperv", Name: *vmName, Console: hypervConsolePipe(*vmName), ConsoleLog: *consoleLog}); err != nil {
+		log.Fatal(err)
+	}
+	if *detached {
+		log.Infof("The VM is running in the background, use 'linuxkit attach %s' to connect to its console", *vmName)
+		return
+	}
 
-	err = hypervStartConsole(*vmName)
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = hypervStartConsole(*vmName, stdout)
 	if err != nil {
 		log.Infof("Console returned: %v\n", err)
 	}
@@ -160,7 +282,7 @@ func runHyperV(args []string) {
 
 	log.Info("Stop the VM")
 	_, out, err = poshCmd("Stop-VM",
-		"-Name", fmt.Sprintf("'%s'", *vmName), "-Force")
+		"-Name", poshString(*vmName), "-Force")
 	if err != nil {
 		// Don't error out, could get an error if VM is already stopped
 		log.Infof("Stop-VM error: %v\n%s", err, out)
@@ -168,7 +290,7 @@ func runHyperV(args []string) {
 
 	log.Info("Remove the VM")
 	_, out, err = poshCmd("Remove-VM",
-		"-Name", fmt.Sprintf("'%s'", *vmName), "-Force")
+		"-Name", poshString(*vmName), "-Force")
 	if err != nil {
 		log.Infof("Remove-VM error: %v\n%s", err, out)
 	}
@@ -176,6 +298,12 @@ func runHyperV(args []string) {
 
 var powershell string
 
+// poshString quotes s as a Powershell string, e.g. a path with spaces or
+// quotes
+func poshString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
 // Execute a powershell command
 func poshCmd(args ...string) (string, string, error) {
 	args = append([]string{"-NoProfile", "-NonInteractive"}, args...)
@@ -267,3 +395,76 @@ func hypervGetSwitch(name string) (string, error) {
 	}
 	return "", fmt.Errorf("Could not find an external switch")
 }
+
+const (
+	hypervNATSwitchName = "LinuxKit NAT"
+	hypervNATSubnet     = "192.168.78.0/24"
+)
+
+// hypervSecureBootTemplates are the Secure Boot templates of Hyper-V
+var hypervSecureBootTemplates = []string{"MicrosoftWindows", "MicrosoftUEFICertificateAuthority", "OpenSourceShieldedVM"}
+
+func hypervSecureBootTemplate(name string) bool {
+	for _, t := range hypervSecureBootTemplates {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hypervNATSwitch returns the name of an internal switch with NAT, creating
+// the switch, the address of the host on it and the NAT if the switch does
+// not exist yet. An existing switch is used as it is.
+func hypervNATSwitch(name, subnet string) (string, error) {
+	if _, _, err := poshCmd("Get-VMSwitch", "-Name", poshString(name)); err == nil {
+		return name, nil
+	}
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil || ipnet.IP.To4() == nil {
+		return "", fmt.Errorf("Invalid NAT subnet %s, must be an IPv4 CIDR", subnet)
+	}
+	host := make(net.IP, 4)
+	copy(host, ipnet.IP.To4())
+	host[3]++
+	ones, _ := ipnet.Mask.Size()
+
+	log.Infof("Creating NAT switch %s for %s", name, ipnet)
+	if _, out, err := poshCmd("New-VMSwitch", "-Name", poshString(name), "-SwitchType", "Internal"); err != nil {
+		return "", fmt.Errorf("Failed to create switch %s: %v\n%s", name, err, out)
+	}
+	if _, out, err := poshCmd("New-NetIPAddress",
+		"-IPAddress", host.String(),
+		"-PrefixLength", strconv.Itoa(ones),
+		"-InterfaceAlias", poshString("vEthernet ("+name+")")); err != nil {
+		return "", fmt.Errorf("Failed to set the address of switch %s: %v\n%s", name, err, out)
+	}
+	if _, out, err := poshCmd("New-NetNat",
+		"-Name", poshString(name),
+		"-InternalIPInterfaceAddressPrefix", ipnet.String()); err != nil {
+		return "", fmt.Errorf("Failed to create the NAT of switch %s: %v\n%s", name, err, out)
+	}
+	return name, nil
+}
+
+// hypervConsolePipe is the named pipe the serial port of a VM is redirected to
+func hypervConsolePipe(vmName string) string {
+	return fmt.Sprintf(`\\.\pipe\%s-com1`, vmName)
+}
+
+// hypervVsockService is the Hyper-V socket service ID of a vsock port of a
+// Linux VM
+func hypervVsockService(port uint32) string {
+	return fmt.Sprintf("%08x-facb-11e6-bd58-64006a7986d3", port)
+}
+
+// hypervRegisterVsockService registers the Hyper-V socket service of a vsock
+// port with the host, which Hyper-V requires before sockets connect to it
+func hypervRegisterVsockService(port uint32, name string) error {
+	key := poshString(`HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\GuestCommunicationServices\` + hypervVsockService(port))
+	_, out, err := poshCmd(fmt.Sprintf("if (!(Test-Path %s)) { New-Item -Path %s | Out-Null; New-ItemProperty -Path %s -Name ElementName -Value %s | Out-Null }", key, key, key, poshString(name)))
+	if err != nil {
+		return fmt.Errorf("Failed to register the Hyper-V socket service of port %d: %v\n%s", port, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultIBMCloudProfile = "bx2-2x8"
+	// Environment variables. Some are non-standard
+	ibmcloudProfileVar = "IBMCLOUD_PROFILE"   // non-standard
+	ibmcloudZoneVar    = "IBMCLOUD_ZONE"      // non-standard
+	ibmcloudSubnetVar  = "IBMCLOUD_SUBNET_ID" // non-standard
+)
+
+// Process the run arguments and execute run
+func runIBMCloud(args []string) {
+	flags := newFlagSet("ibmcloud")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run ibmcloud [options] [name]\n\n", invoked)
+		fmt.Printf("'name' is the name of an IBM Cloud VPC image that has already been\n")
+		fmt.Printf(" uploaded using 'linuxkit push'\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	apiKeyFlag := flags.String("api-key", "", "IBM Cloud API key (or "+ibmcloudAPIKeyVar+")")
+	regionFlag := flags.String("region", ibmcloudDefaultRegion, "IBM Cloud region (or "+ibmcloudRegionVar+")")
+	zoneFlag := flags.String("zone", "", "Zone of the instance (or "+ibmcloudZoneVar+", default the first zone of the region)")
+	profileFlag := flags.String("profile", defaultIBMCloudProfile, "Instance profile (or "+ibmcloudProfileVar+")")
+	subnetFlag := flags.String("subnet-id", "", "ID of the subnet of the instance, in the zone (or "+ibmcloudSubnetVar+"). *Required*")
+	resourceGroupFlag := flags.String("resource-group", "", "ID of the resource group of the instance (or "+ibmcloudResourceGroupVar+", default the account default)")
+	instanceNameFlag := flags.String("instance-name", "", "Name of the instance (default the image name)")
+	keysFlag := flags.String("keys", "", "Comma separated IDs of SSH keys to add to the instance")
+	tags := tagFlag(flags)
+
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the name of the image to boot\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	name := remArgs[0]
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+	if *dataPath != "" {
+		dataB, err := ioutil.ReadFile(*dataPath)
+		if err != nil {
+			log.Fatalf("Unable to read metadata file: %v", err)
+		}
+		*data = string(dataB)
+	}
+
+	apiKey := getStringValue(ibmcloudAPIKeyVar, *apiKeyFlag, "")
+	region := getStringValue(ibmcloudRegionVar, *regionFlag, ibmcloudDefaultRegion)
+	zone := getStringValue(ibmcloudZoneVar, *zoneFlag, region+"-1")
+	profile := getStringValue(ibmcloudProfileVar, *profileFlag, defaultIBMCloudProfile)
+	subnet := getStringValue(ibmcloudSubnetVar, *subnetFlag, "")
+	resourceGroup := getStringValue(ibmcloudResourceGroupVar, *resourceGroupFlag, "")
+	instanceName := getStringValue("", *instanceNameFlag, name)
+	var keys []string
+	if *keysFlag != "" {
+		keys = strings.Split(*keysFlag, ",")
+	}
+
+	if subnet == "" {
+		log.Fatalf("Please specify the subnet to use")
+	}
+
+	client, err := NewIBMCloudClient(apiKey, region)
+	if err != nil {
+		log.Fatalf("Unable to connect to IBM Cloud: %v", err)
+	}
+
+	imageID, err := client.FindImage(name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Infof("Creating %s instance %s in %s", profile, instanceName, zone)
+	instanceID, ip, err := client.CreateInstance(IBMCloudInstanceConfig{
+		Name:          instanceName,
+		Profile:       profile,
+		Zone:          zone,
+		ImageID:       imageID,
+		SubnetID:      subnet,
+		ResourceGroup: resourceGroup,
+		Keys:          keys,
+		UserData:      *data,
+		Tags:          *tags,
+	})
+	if err != nil {
+		log.Fatalf("Unable to create instance: %v", err)
+	}
+	log.WithFields(log.Fields{"instance": instanceID, "ip": ip}).Infof("Instance %s is running", instanceID)
+	log.Warnf("IBM Cloud doesn't stream serial console output.\n Please use the IBM Cloud console or 'ibmcloud is instance-console %s' to access it", instanceID)
+
+	runInfo := RunInfo{Backend: "ibmcloud", ID: instanceID, Name: instanceName, IPs: []string{ip}}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	keepResources()
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	libvirtNetworkingNone    string = "none"
+	libvirtNetworkingUser           = "user"
+	libvirtNetworkingNetwork        = "network"
+	libvirtNetworkingBridge         = "bridge"
+	libvirtNetworkingDefault        = libvirtNetworkingNetwork
+)
+
+// The subset of the libvirt domain XML used for LinuxKit VMs,
+// see https://libvirt.org/formatdomain.html
+type libvirtDomain struct {
+	XMLName  xml.Name        `xml:"domain"`
+	Type     string          `xml:"type,attr"`
+	Name     string          `xml:"name"`
+	UUID     string          `xml:"uuid"`
+	Memory   libvirtMemory   `xml:"memory"`
+	VCPU     int             `xml:"vcpu"`
+	OS       libvirtOS       `xml:"os"`
+	Features libvirtFeatures `xml:"features"`
+	CPU      *libvirtCPU     `xml:"cpu,omitempty"`
+	Devices  libvirtDevices  `xml:"devices"`
+	OnOff    string          `xml:"on_poweroff"`
+	OnCrash  string          `xml:"on_crash"`
+}
+
+type libvirtMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type libvirtOS struct {
+	Type    libvirtOSType  `xml:"type"`
+	Loader  *libvirtLoader `xml:"loader,omitempty"`
+	Kernel  string         `xml:"kernel,omitempty"`
+	Initrd  string         `xml:"initrd,omitempty"`
+	Cmdline string         `xml:"cmdline,omitempty"`
+	Boot    []libvirtBoot  `xml:"boot,omitempty"`
+}
+
+type libvirtOSType struct {
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type libvirtLoader struct {
+	ReadOnly string `xml:"readonly,attr"`
+	Type     string `xml:"type,attr"`
+	Path     string `xml:",chardata"`
+}
+
+type libvirtBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type libvirtFeatures struct {
+	ACPI *struct{} `xml:"acpi"`
+}
+
+type libvirtCPU struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type libvirtDevices struct {
+	Disks      []libvirtDisk      `xml:"disk"`
+	Interfaces []libvirtInterface `xml:"interface"`
+	Serial     libvirtSerial      `xml:"serial"`
+	Console    libvirtConsole     `xml:"console"`
+	RNG        libvirtRNG         `xml:"rng"`
+}
+
+type libvirtDisk struct {
+	Type     string            `xml:"type,attr"`
+	Device   string            `xml:"device,attr"`
+	Driver   libvirtDiskDriver `xml:"driver"`
+	Source   libvirtDiskSource `xml:"source"`
+	Target   libvirtDiskTarget `xml:"target"`
+	ReadOnly *struct{}         `xml:"readonly"`
+}
+
+type libvirtDiskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type libvirtDiskSource struct {
+	File string `xml:"file,attr"`
+}
+
+type libvirtDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type libvirtInterface struct {
+	Type   string              `xml:"type,attr"`
+	Source *libvirtIfaceSource `xml:"source,omitempty"`
+	MAC    libvirtIfaceMAC     `xml:"mac"`
+	Model  libvirtIfaceModel   `xml:"model"`
+}
+
+type libvirtIfaceSource struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+}
+
+type libvirtIfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type libvirtIfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type libvirtSerial struct {
+	Type   string              `xml:"type,attr"`
+	Target libvirtSerialTarget `xml:"target"`
+}
+
+type libvirtSerialTarget struct {
+	Port int `xml:"port,attr"`
+}
+
+type libvirtConsole struct {
+	Type   string               `xml:"type,attr"`
+	Target libvirtConsoleTarget `xml:"target"`
+}
+
+type libvirtConsoleTarget struct {
+	Type string `xml:"type,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type libvirtRNG struct {
+	Model   string            `xml:"model,attr"`
+	Backend libvirtRNGBackend `xml:"backend"`
+}
+
+type libvirtRNGBackend struct {
+	Model string `xml:"model,attr"`
+	Path  string `xml:",chardata"`
+}
+
+// libvirtDiskFormat guesses the format of a disk image from its extension
+func libvirtDiskFormat(path, format string) string {
+	if format != "" {
+		return format
+	}
+	switch filepath.Ext(path) {
+	case ".qcow2":
+		return "qcow2"
+	case ".vhd":
+		return "vpc"
+	case ".vhdx":
+		return "vhdx"
+	case ".vmdk":
+		return "vmdk"
+	}
+	return "raw"
+}
+
+func runLibvirt(args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := newFlagSet("libvirt")
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run libvirt [options] prefix\n\n", invoked)
+		fmt.Printf("'prefix' specifies the path to the VM image.\n")
+		fmt.Printf("\n")
+		fmt.Printf("A transient libvirt domain is created for the image and its console\n")
+		fmt.Printf("is attached. The domain is destroyed when the console is closed,\n")
+		fmt.Printf("unless -detached is set.\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+
+	// libvirt options
+	connect := flags.String("connect", "", "libvirt connection URI, for example qemu:///system (otherwise the virsh default)")
+	virshPath := flags.String("virsh", "virsh", "Path to the virsh binary")
+	vmName := flags.String("name", "", "Name of the domain (default the image name)")
+	domainType := flags.String("type", "", "Domain type, 'kvm' or 'qemu' (default 'kvm' if available)")
+	detached := flags.Bool("detached", false, "Leave the domain running without attaching to its console")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+	xmlOnly := flags.Bool("xml", false, "Print the domain XML instead of creating the domain")
+
+	// Boot type; we try to determine automatically
+	uefiBoot := flags.Bool("uefi", false, "Use UEFI boot")
+	fw := flags.String("fw", defaultFWPath, "Path to OVMF firmware for UEFI boot")
+	isoBoot := flags.Bool("iso", false, "Boot image is an ISO")
+	squashFSBoot := flags.Bool("squashfs", false, "Boot image is a kernel+squashfs+cmdline")
+	kernelBoot := flags.Bool("kernel", false, "Boot image is kernel+initrd+cmdline 'path'-kernel/-initrd/-cmdline")
+
+	// State flags
+	state := flags.String("state", "", "Path to directory to keep VM state in")
+
+	// Paths and settings for disks
+	var disks Disks
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=qcow2]")
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+
+	// VM configuration
+	arch := flags.String("arch", defaultArch, "Type of architecture to use, e.g. x86_64, aarch64, s390x")
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+
+	// Networking
+	networking := flags.String("networking", libvirtNetworkingDefault, "Networking mode. Valid options are 'default', 'network[,name]', 'bridge,name', 'user' and 'none'. 'network' connects to a libvirt virtual network, by default the 'default' network. 'bridge' connects to a preexisting bridge. 'user' uses userspace networking. 'none' disables networking.")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify the path to the image to boot")
+		flags.Usage()
+		os.Exit(1)
+	}
+	// libvirt needs absolute paths, as the domain is run by the daemon
+	path, err := filepath.Abs(remArgs[0])
+	if err != nil {
+		log.Fatalf("Bad path: %v", err)
+	}
+	prefix := path
+
+	if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path + "-kernel"); err == nil {
+			if _, err := os.Stat(path + "-squashfs.img"); err == nil {
+				*squashFSBoot = true
+			} else {
+				*kernelBoot = true
+			}
+		}
+	} else if strings.HasSuffix(path, ".iso") {
+		*isoBoot = true
+		prefix = strings.TrimSuffix(path, ".iso")
+	}
+	if !*kernelBoot && !*squashFSBoot {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatalf("Boot disk image %s does not exist", path)
+		}
+	}
+
+	name := *vmName
+	if name == "" {
+		name = filepath.Base(prefix)
+	}
+	if *state == "" {
+		*state = prefix + "-state"
+	}
+	if err := os.MkdirAll(*state, 0755); err != nil {
+		log.Fatalf("Could not create state directory: %v", err)
+	}
+	if *domainType == "" {
+		*domainType = "qemu"
+		if haveKVM() {
+			*domainType = "kvm"
+		}
+	}
+
+	domain := libvirtDomain{
+		Type:     *domainType,
+		Name:     name,
+		UUID:     uuid.New().String(),
+		Memory:   libvirtMemory{Unit: "MiB", Value: *mem},
+		VCPU:     *cpus,
+		OS:       libvirtOS{Type: libvirtOSType{Arch: *arch, Value: "hvm"}},
+		Features: libvirtFeatures{ACPI: &struct{}{}},
+		OnOff:    "destroy",
+		OnCrash:  "destroy",
+	}
+	switch *arch {
+	case "x86_64":
+		domain.OS.Type.Machine = "q35"
+	case "aarch64":
+		domain.OS.Type.Machine = "virt"
+	}
+	if *domainType == "kvm" {
+		domain.CPU = &libvirtCPU{Mode: "host-passthrough"}
+	}
+	domain.Devices.Serial = libvirtSerial{Type: "pty"}
+	domain.Devices.Console = libvirtConsole{Type: "pty", Target: libvirtConsoleTarget{Type: "serial"}}
+	domain.Devices.RNG = libvirtRNG{Model: "virtio", Backend: libvirtRNGBackend{Model: "random", Path: "/dev/urandom"}}
+
+	var cmdline string
+	if *kernelBoot || *squashFSBoot {
+		cmdlineBytes, err := ioutil.ReadFile(path + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot open cmdline file: %v", err)
+		}
+		cmdline = strings.TrimSpace(string(cmdlineBytes))
+	}
+
+	var nextDisk, nextCDROM byte
+	addDisk := func(device, file, format string, readonly bool) {
+		d := libvirtDisk{
+			Type:   "file",
+			Device: device,
+			Driver: libvirtDiskDriver{Name: "qemu", Type: format},
+			Source: libvirtDiskSource{File: file},
+		}
+		if device == "cdrom" {
+			d.Target = libvirtDiskTarget{Dev: fmt.Sprintf("sd%c", 'a'+nextCDROM), Bus: "sata"}
+			nextCDROM++
+			readonly = true
+		} else {
+			d.Target = libvirtDiskTarget{Dev: fmt.Sprintf("vd%c", 'a'+nextDisk), Bus: "virtio"}
+			nextDisk++
+		}
+		if readonly {
+			d.ReadOnly = &struct{}{}
+		}
+		domain.Devices.Disks = append(domain.Devices.Disks, d)
+	}
+
+	switch {
+	case *kernelBoot:
+		domain.OS.Kernel = path + "-kernel"
+		domain.OS.Initrd = path + "-initrd.img"
+		domain.OS.Cmdline = cmdline
+	case *squashFSBoot:
+		domain.OS.Kernel = path + "-kernel"
+		domain.OS.Cmdline = cmdline + " root=/dev/vda"
+		addDisk("disk", path+"-squashfs.img", "raw", true)
+	case *isoBoot:
+		addDisk("cdrom", path, "raw", true)
+		domain.OS.Boot = []libvirtBoot{{Dev: "cdrom"}}
+	default:
+		addDisk("disk", path, libvirtDiskFormat(path, ""), false)
+		domain.OS.Boot = []libvirtBoot{{Dev: "hd"}}
+	}
+	if *uefiBoot {
+		if _, err := os.Stat(*fw); err != nil {
+			log.Fatalf("Cannot find OVMF firmware %s: %v", *fw, err)
+		}
+		domain.OS.Loader = &libvirtLoader{ReadOnly: "yes", Type: "pflash", Path: *fw}
+	}
+
+	for i, d := range disks {
+		id := ""
+		if i != 0 {
+			id = fmt.Sprint(i)
+		}
+		if d.Size != 0 && d.Format == "" {
+			d.Format = "qcow2"
+		}
+		if d.Size != 0 && d.Path == "" {
+			d.Path = filepath.Join(*state, "disk"+id+".img")
+		}
+		if d.Path == "" {
+			log.Fatalf("disk specified with no size or name")
+		}
+		if d.Path, err = filepath.Abs(d.Path); err != nil {
+			log.Fatalf("Bad path: %v", err)
+		}
+		if _, err := os.Stat(d.Path); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			if !diskimage.Supported(d.Format) {
+				log.Fatalf("Cannot create a disk in format %s", d.Format)
+			}
+			log.Debugf("Creating new disk [%s] format %s", d.Path, d.Format)
+			if err := diskimage.Create(d.Path, d.Format, int64(d.Size)*1024*1024); err != nil {
+				log.Fatalf("Error creating disk [%s] format %s: %v", d.Path, d.Format, err)
+			}
+		} else {
+			log.Infof("Using existing disk [%s] format %s", d.Path, d.Format)
+		}
+		addDisk("disk", d.Path, libvirtDiskFormat(d.Path, d.Format), false)
+	}
+
+	absState, err := filepath.Abs(*state)
+	if err != nil {
+		log.Fatalf("Bad path: %v", err)
+	}
+	metadataPaths, err := CreateMetadataISO(absState, *data, *dataPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, p := range metadataPaths {
+		addDisk("cdrom", p, "raw", true)
+	}
+
+	if *networking == "" || *networking == "default" {
+		*networking = libvirtNetworkingDefault
+	}
+	netMode := strings.SplitN(*networking, ",", 2)
+	iface := libvirtInterface{
+		MAC:   libvirtIfaceMAC{Address: retrieveMAC(*state).String()},
+		Model: libvirtIfaceModel{Type: "virtio"},
+	}
+	switch netMode[0] {
+	case libvirtNetworkingNetwork:
+		network := "default"
+		if len(netMode) == 2 {
+			network = netMode[1]
+		}
+		iface.Type = "network"
+		iface.Source = &libvirtIfaceSource{Network: network}
+		domain.Devices.Interfaces = append(domain.Devices.Interfaces, iface)
+	case libvirtNetworkingBridge:
+		if len(netMode) != 2 {
+			log.Fatalf("Not enough arguments for %q networking mode", libvirtNetworkingBridge)
+		}
+		iface.Type = "bridge"
+		iface.Source = &libvirtIfaceSource{Bridge: netMode[1]}
+		domain.Devices.Interfaces = append(domain.Devices.Interfaces, iface)
+	case libvirtNetworkingUser:
+		iface.Type = "user"
+		domain.Devices.Interfaces = append(domain.Devices.Interfaces, iface)
+	case libvirtNetworkingNone:
+	default:
+		log.Fatalf("Invalid networking mode: %s", netMode[0])
+	}
+
+	domainXML, err := xml.MarshalIndent(domain, "", "  ")
+	if err != nil {
+		log.Fatalf("Cannot generate domain XML: %v", err)
+	}
+	if *xmlOnly {
+		fmt.Println(string(domainXML))
+		return
+	}
+	xmlPath := filepath.Join(*state, "domain.xml")
+	if err := ioutil.WriteFile(xmlPath, append(domainXML, '\n'), 0644); err != nil {
+		log.Fatalf("Cannot write domain XML: %v", err)
+	}
+
+	virsh, err := exec.LookPath(*virshPath)
+	if err != nil {
+		log.Fatalf("Cannot find %s: %v", *virshPath, err)
+	}
+	virshArgs := func(args ...string) []string {
+		if *connect != "" {
+			return append([]string{"--connect", *connect}, args...)
+		}
+		return args
+	}
+
+	runInfo := RunInfo{Backend: "libvirt", ID: domain.UUID, Name: name, StatePath: *state}
+	if !*detached {
+		runInfo.ConsoleLog = *consoleLog
+	}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+
+	if *detached {
+		cmd := exec.Command(virsh, virshArgs("create", xmlPath)...)
+		log.Debugf("%v\n", cmd.Args)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Fatalf("Cannot create domain: %v\n%s", err, out)
+		}
+		log.Infof("Created domain %s", name)
+		return
+	}
+
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(virsh, virshArgs("create", xmlPath, "--console")...)
+	log.Debugf("%v\n", cmd.Args)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+
+	// the domain is transient, so destroying it removes it
+	destroy := exec.Command(virsh, virshArgs("destroy", name)...)
+	log.Debugf("%v\n", destroy.Args)
+	_ = destroy.Run()
+
+	exitGuestStatus()
+	if err != nil {
+		log.Fatalf("virsh failed: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultOCIShapeAMD64  = "VM.Standard.E2.1.Micro"
+	defaultOCIShapeARM64  = "VM.Standard.A1.Flex"
+	defaultOCILaunchMode  = "PARAVIRTUALIZED"
+	defaultOCIOCPUs       = 1
+	defaultOCIMemoryGB    = 6
+	ociAvailabilityDomVar = "OCI_AVAILABILITY_DOMAIN"
+)
+
+// Process the run arguments and execute run
+func runOCI(args []string) {
+	defaultShape := defaultOCIShapeAMD64
+	if runtime.GOARCH == "arm64" {
+		defaultShape = defaultOCIShapeARM64
+	}
+
+	flags := newFlagSet("oci")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run oci [options] path\n\n", invoked)
+		fmt.Printf("'path' is the qcow2 or vmdk image to import and boot, for example\n")
+		fmt.Printf("the output of 'linuxkit build -format qcow2-efi'.\n")
+		fmt.Printf("The credentials and region are read from the oci CLI config\n")
+		fmt.Printf("file in ~/.oci/config.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	profileFlag := flags.String("profile", ociDefaultProfile, "Profile in the oci CLI config file (or "+ociProfileVar+")")
+	regionFlag := flags.String("region", "", "Region (or "+ociRegionVar+", default the region of the profile)")
+	compartmentFlag := flags.String("compartment-id", "", "OCID of the compartment (or "+ociCompartmentVar+", default the root compartment)")
+	bucketFlag := flags.String("bucket", "", "Object Storage bucket to upload the image to (or "+ociBucketVar+")")
+	subnetFlag := flags.String("subnet-id", "", "OCID of the subnet of the instance (or "+ociSubnetVar+")")
+	adFlag := flags.String("availability-domain", "", "Availability domain (or "+ociAvailabilityDomVar+", default the first one in the region)")
+	nameFlag := flags.String("name", "", "Name of the image and instance (default the image name)")
+	shapeFlag := flags.String("shape", defaultShape, "Shape of the instance, VM.Standard.E2.1.Micro and VM.Standard.A1.Flex are in the free tier")
+	ocpusFlag := flags.Float64("ocpus", defaultOCIOCPUs, "Number of OCPUs, for flexible shapes")
+	memoryFlag := flags.Float64("memory", defaultOCIMemoryGB, "Amount of memory in GB, for flexible shapes")
+	launchModeFlag := flags.String("launch-mode", defaultOCILaunchMode, "Launch mode of the image, PARAVIRTUALIZED, NATIVE or EMULATED")
+	publicIPFlag := flags.Bool("public-ip", true, "Assign a public IP address to the instance")
+	data := flags.String("data", "", "String of metadata to pass to the instance as user data; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing user data to pass to the instance; error to specify both -data and -data-file")
+	noAttachFlag := flags.Bool("no-attach", false, "Don't attach to the serial console")
+	tags := tagFlag(flags)
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
+	cleanFlag := flags.Bool("clean", false, "Terminate the instance and delete the image after detaching from the console")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to boot\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	var format string
+	switch filepath.Ext(path) {
+	case ".qcow2":
+		format = "QCOW2"
+	case ".vmdk":
+		format = "VMDK"
+	default:
+		log.Fatalf("Oracle Cloud can only import qcow2 and vmdk images")
+	}
+
+	var userData []byte
+	switch {
+	case *data != "" && *dataPath != "":
+		log.Fatal("Cannot specify both -data and -data-file")
+	case *data != "":
+		userData = []byte(*data)
+	case *dataPath != "":
+		var err error
+		if userData, err = ioutil.ReadFile(*dataPath); err != nil {
+			log.Fatalf("Cannot read user data: %v", err)
+		}
+	}
+
+	profile := getStringValue(ociProfileVar, *profileFlag, ociDefaultProfile)
+	region := getStringValue(ociRegionVar, *regionFlag, "")
+	bucket := getStringValue(ociBucketVar, *bucketFlag, "")
+	subnet := getStringValue(ociSubnetVar, *subnetFlag, "")
+	name := getStringValue("", *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if bucket == "" {
+		log.Fatalf("Please specify the bucket with -bucket or %s", ociBucketVar)
+	}
+	if subnet == "" {
+		log.Fatalf("Please specify the subnet with -subnet-id or %s", ociSubnetVar)
+	}
+
+	client, err := NewOCIClient(profile, region)
+	if err != nil {
+		log.Fatalf("Unable to connect to Oracle Cloud: %v", err)
+	}
+	compartment := getStringValue(ociCompartmentVar, *compartmentFlag, client.Tenancy())
+	ad := getStringValue(ociAvailabilityDomVar, *adFlag, "")
+	if ad == "" {
+		ads, err := client.AvailabilityDomains(compartment)
+		if err != nil || len(ads) == 0 {
+			log.Fatalf("Unable to find an availability domain: %v", err)
+		}
+		ad = ads[0]
+	}
+
+	namespace, err := client.Namespace()
+	if err != nil {
+		log.Fatalf("Unable to get the Object Storage namespace: %v", err)
+	}
+	object := filepath.Base(path)
+	log.Infof("Uploading %s to bucket %s", path, bucket)
+	if err := client.UploadObject(namespace, bucket, object, path, *tags); err != nil {
+		log.Fatalf("Unable to upload image: %v", err)
+	}
+	onCleanup("object "+object, func() error { return client.DeleteObject(namespace, bucket, object) })
+
+	log.Infof("Importing image %s", name)
+	imageID, err := client.ImportImage(compartment, name, namespace, bucket, object, format, *launchModeFlag, *tags)
+	if err != nil {
+		log.Fatalf("Unable to import image: %v", err)
+	}
+	if err := client.AddImageShape(imageID, *shapeFlag); err != nil {
+		log.Fatalf("Unable to make image %s compatible with %s: %v", imageID, *shapeFlag, err)
+	}
+
+	log.Infof("Launching %s instance %s", *shapeFlag, name)
+	instanceID, err := client.LaunchInstance(OCIInstanceConfig{
+		Compartment:        compartment,
+		AvailabilityDomain: ad,
+		Name:               name,
+		Shape:              *shapeFlag,
+		OCPUs:              *ocpusFlag,
+		MemoryGB:           *memoryFlag,
+		ImageID:            imageID,
+		SubnetID:           subnet,
+		PublicIP:           *publicIPFlag,
+		UserData:           userData,
+		Tags:               *tags,
+	})
+	if err != nil {
+		log.Fatalf("Unable to launch instance: %v", err)
+	}
+	log.WithField("instance", instanceID).Infof("Instance %s is running", instanceID)
+	runInfo := RunInfo{Backend: "oci", ID: instanceID, Name: name, ConsoleLog: *consoleLog}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if !*cleanFlag {
+		keepResources()
+	}
+
+	if !*noAttachFlag {
+		stdout, err := consoleWriter(os.Stdout, *consoleLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := client.ConnectSerialConsole(instanceID, stdout); err != nil {
+			log.Errorf("Unable to connect to the serial console: %v", err)
+		}
+	}
+
+	if *cleanFlag {
+		keepResources()
+		if err := client.TerminateInstance(instanceID); err != nil {
+			log.Fatalf("Unable to terminate instance: %v", err)
+		}
+		if err := client.DeleteImage(imageID); err != nil {
+			log.Fatalf("Unable to delete image: %v", err)
+		}
+	}
+}
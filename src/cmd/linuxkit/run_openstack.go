@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,7 +8,6 @@ import (
 
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
-	"github.com/gophercloud/utils/openstack/clientconfig"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,7 +17,7 @@ const (
 )
 
 func runOpenStack(args []string) {
-	flags := flag.NewFlagSet("openstack", flag.ExitOnError)
+	flags := newFlagSet("openstack")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run openstack [options] [name]\n\n", invoked)
@@ -33,6 +31,11 @@ func runOpenStack(args []string) {
 	networkID := flags.String("network", "", "The ID of the network to attach the instance to")
 	secGroups := flags.String("sec-groups", "default", "Security Group names separated by comma")
 	keyName := flags.String("keyname", "", "The name of the SSH keypair to associate with the instance")
+	cloudFlag := flags.String("cloud", "", "Name of the cloud in clouds.yaml (or "+osCloudVar+", default to authenticate with the OS_* environment variables)")
+	regionFlag := flags.String("region", "", "Region (or "+osRegionVar+", default the region of the cloud)")
+	tags := tagFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -50,7 +53,8 @@ func runOpenStack(args []string) {
 		*instanceName = name
 	}
 
-	client, err := clientconfig.NewServiceClient("compute", nil)
+	cloud := getStringValue(osCloudVar, *cloudFlag, "")
+	client, err := openstackServiceClient("compute", cloud, *regionFlag)
 	if err != nil {
 		log.Fatalf("Unable to create Compute client, %s", err)
 	}
@@ -68,6 +72,8 @@ func runOpenStack(args []string) {
 		Networks:       []servers.Network{network},
 		ServiceClient:  client,
 		SecurityGroups: strings.Split(*secGroups, ","),
+		// server tags need a newer compute API, so the tags are set as metadata
+		Metadata: tags.Map(),
 	}
 
 	if *keyName != "" {
@@ -81,9 +87,19 @@ func runOpenStack(args []string) {
 	if err != nil {
 		log.Fatalf("Unable to create server: %s", err)
 	}
+	onCleanup("server "+server.ID, func() error { return servers.Delete(client, server.ID).ExtractErr() })
 
-	servers.WaitForStatus(client, server.ID, "ACTIVE", 600)
+	if err := servers.WaitForStatus(client, server.ID, "ACTIVE", 600); err != nil {
+		log.Fatalf("Server %s did not become active: %s", server.ID, err)
+	}
 	log.Infof("Server created, UUID is %s", server.ID)
 	fmt.Println(server.ID)
-
+	runInfo := RunInfo{Backend: "openstack", ID: server.ID, Name: *instanceName}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	keepResources()
 }
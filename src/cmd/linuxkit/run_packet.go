@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,7 +16,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/packethost/packngo"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -25,15 +23,19 @@ import (
 )
 
 const (
-	packetDefaultZone    = "ams1"
-	packetDefaultMachine = "baremetal_0"
+	packetDefaultMetro   = "am"
+	packetDefaultMachine = "c3.small.x86"
 	packetBaseURL        = "PACKET_BASE_URL"
 	packetZoneVar        = "PACKET_ZONE"
+	packetMetroVar       = "PACKET_METRO"
 	packetMachineVar     = "PACKET_MACHINE"
 	packetAPIKeyVar      = "PACKET_API_KEY"
 	packetProjectIDVar   = "PACKET_PROJECT_ID"
 	packetHostnameVar    = "PACKET_HOSTNAME"
 	packetNameVar        = "PACKET_NAME"
+	// The variables used by the Equinix Metal CLI and SDKs
+	metalAPIKeyVar    = "METAL_AUTH_TOKEN"
+	metalProjectIDVar = "METAL_PROJECT_ID"
 )
 
 var (
@@ -49,7 +51,7 @@ func init() {
 
 // Process the run arguments and execute run
 func runPacket(args []string) {
-	flags := flag.NewFlagSet("packet", flag.ExitOnError)
+	flags := newFlagSet("packet")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run packet [options] [name]\n\n", invoked)
@@ -57,17 +59,27 @@ func runPacket(args []string) {
 		flags.PrintDefaults()
 	}
 	baseURLFlag := flags.String("base-url", "", "Base URL that the kernel, initrd and iPXE script are served from (or "+packetBaseURL+")")
-	zoneFlag := flags.String("zone", packetDefaultZone, "Packet Zone (or "+packetZoneVar+")")
-	machineFlag := flags.String("machine", packetDefaultMachine, "Packet Machine Type (or "+packetMachineVar+")")
-	apiKeyFlag := flags.String("api-key", "", "Packet API key (or "+packetAPIKeyVar+")")
-	projectFlag := flags.String("project-id", "", "Packet Project ID (or "+packetProjectIDVar+")")
+	zoneFlag := flags.String("zone", "", "Facility, instead of a metro (or "+packetZoneVar+")")
+	metroFlag := flags.String("metro", packetDefaultMetro, "Metro (or "+packetMetroVar+")")
+	machineFlag := flags.String("machine", packetDefaultMachine, "Equinix Metal plan (or "+packetMachineVar+")")
+	apiKeyFlag := flags.String("api-key", "", "Equinix Metal API key (or "+packetAPIKeyVar+" or "+metalAPIKeyVar+")")
+	projectFlag := flags.String("project-id", "", "Equinix Metal Project ID (or "+packetProjectIDVar+" or "+metalProjectIDVar+")")
+	reservationFlag := flags.String("hardware-reservation", "", "ID of a hardware reservation to provision, or 'next-available'")
+	spotPriceFlag := flags.Float64("spot-price-max", 0, "Provision a spot market instance with this maximum bid price per hour in USD")
+	var vlans multipleFlag
+	flags.Var(&vlans, "vlan", "VLAN (VXLAN ID or UUID) to attach to the bond0 port of the device once it is active, may be repeated")
+	ipxeURLFlag := flags.String("ipxe-url", "", "URL of a custom iPXE script to boot instead of <base-url>/<name>-packet.ipxe, e.g. to chain load another script")
 	deviceFlag := flags.String("device", "", "The ID of an existing device")
 	hostNameFlag := flags.String("hostname", packetDefaultHostname, "Hostname of new instance (or "+packetHostnameVar+")")
 	nameFlag := flags.String("img-name", "", "Overrides the prefix used to identify the files. Defaults to [name] (or "+packetNameVar+")")
 	alwaysPXE := flags.Bool("always-pxe", true, "Reboot from PXE every time.")
 	serveFlag := flags.String("serve", "", "Serve local files via the http port specified, e.g. ':8080'.")
 	consoleFlag := flags.Bool("console", true, "Provide interactive access on the console.")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
 	keepFlag := flags.Bool("keep", false, "Keep the machine after exiting/poweroff.")
+	tags := tagFlag(flags)
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
@@ -79,18 +91,19 @@ func runPacket(args []string) {
 	}
 
 	url := getStringValue(packetBaseURL, *baseURLFlag, "")
-	if url == "" {
+	if url == "" && *ipxeURLFlag == "" {
 		log.Fatalf("Need to specify a value for --base-url where the images are hosted. This URL should contain <url>/%s-kernel, <url>/%s-initrd.img and <url>/%s-packet.ipxe", prefix, prefix, prefix)
 	}
 	facility := getStringValue(packetZoneVar, *zoneFlag, "")
-	plan := getStringValue(packetMachineVar, *machineFlag, defaultMachine)
-	apiKey := getStringValue(packetAPIKeyVar, *apiKeyFlag, "")
+	metro := getStringValue(packetMetroVar, *metroFlag, packetDefaultMetro)
+	plan := getStringValue(packetMachineVar, *machineFlag, packetDefaultMachine)
+	apiKey := getStringValue(packetAPIKeyVar, *apiKeyFlag, os.Getenv(metalAPIKeyVar))
 	if apiKey == "" {
-		log.Fatal("Must specify a Packet.net API key with --api-key")
+		log.Fatal("Must specify an Equinix Metal API key with --api-key")
 	}
-	projectID := getStringValue(packetProjectIDVar, *projectFlag, "")
+	projectID := getStringValue(packetProjectIDVar, *projectFlag, os.Getenv(metalProjectIDVar))
 	if projectID == "" {
-		log.Fatal("Must specify a Packet.net Project ID with --project-id")
+		log.Fatal("Must specify an Equinix Metal Project ID with --project-id")
 	}
 	hostname := getStringValue(packetHostnameVar, *hostNameFlag, "")
 	name := getStringValue(packetNameVar, *nameFlag, prefix)
@@ -135,29 +148,32 @@ func runPacket(args []string) {
 	}
 
 	// Make sure the URLs work
-	ipxeURL := fmt.Sprintf("%s/%s", url, ipxeScriptName)
-	initrdURL := fmt.Sprintf("%s/%s-initrd.img", url, name)
-	kernelURL := fmt.Sprintf("%s/%s-kernel", url, name)
+	ipxeURL := *ipxeURLFlag
+	if ipxeURL == "" {
+		ipxeURL = fmt.Sprintf("%s/%s", url, ipxeScriptName)
+		initrdURL := fmt.Sprintf("%s/%s-initrd.img", url, name)
+		kernelURL := fmt.Sprintf("%s/%s-kernel", url, name)
+		log.Infof("Validating URL: %s", kernelURL)
+		if err := validateHTTPURL(kernelURL); err != nil {
+			log.Fatalf("Invalid kernel URL %s: %v", kernelURL, err)
+		}
+		log.Infof("Validating URL: %s", initrdURL)
+		if err := validateHTTPURL(initrdURL); err != nil {
+			log.Fatalf("Invalid initrd URL %s: %v", initrdURL, err)
+		}
+	}
 	log.Infof("Validating URL: %s", ipxeURL)
 	if err := validateHTTPURL(ipxeURL); err != nil {
 		log.Fatalf("Invalid iPXE URL %s: %v", ipxeURL, err)
 	}
-	log.Infof("Validating URL: %s", kernelURL)
-	if err := validateHTTPURL(kernelURL); err != nil {
-		log.Fatalf("Invalid kernel URL %s: %v", kernelURL, err)
-	}
-	log.Infof("Validating URL: %s", initrdURL)
-	if err := validateHTTPURL(initrdURL); err != nil {
-		log.Fatalf("Invalid initrd URL %s: %v", initrdURL, err)
-	}
 
-	client := packngo.NewClient("", apiKey, nil)
-	tags := []string{}
+	client := NewMetalClient(apiKey)
 
-	var dev *packngo.Device
+	var dev *MetalDevice
 	var err error
+	forgetDevice := func() {}
 	if *deviceFlag != "" {
-		dev, _, err = client.Devices.Get(*deviceFlag)
+		dev, err = client.GetDevice(*deviceFlag)
 		if err != nil {
 			log.Fatalf("Getting info for device %s failed: %v", *deviceFlag, err)
 		}
@@ -167,37 +183,47 @@ func runPacket(args []string) {
 		}
 		log.Debugf("%s\n", string(b))
 
-		req := packngo.DeviceUpdateRequest{
+		req := MetalDeviceUpdateRequest{
 			Hostname:      hostname,
-			Locked:        dev.Locked,
-			Tags:          dev.Tags,
 			IPXEScriptURL: ipxeURL,
 			AlwaysPXE:     *alwaysPXE,
 		}
-		dev, _, err = client.Devices.Update(*deviceFlag, &req)
+		dev, err = client.UpdateDevice(*deviceFlag, req)
 		if err != nil {
 			log.Fatalf("Update device %s failed: %v", *deviceFlag, err)
 		}
-		if _, err := client.Devices.Reboot(*deviceFlag); err != nil {
+		if err := client.RebootDevice(*deviceFlag); err != nil {
 			log.Fatalf("Rebooting device %s failed: %v", *deviceFlag, err)
 		}
 	} else {
 		// Create a new device
-		req := packngo.DeviceCreateRequest{
-			Hostname:      hostname,
-			Plan:          plan,
-			Facility:      facility,
-			OS:            osType,
-			BillingCycle:  billing,
-			ProjectID:     projectID,
-			Tags:          tags,
-			IPXEScriptURL: ipxeURL,
-			AlwaysPXE:     *alwaysPXE,
+		req := MetalDeviceCreateRequest{
+			Hostname:              hostname,
+			Plan:                  plan,
+			OS:                    osType,
+			BillingCycle:          billing,
+			IPXEScriptURL:         ipxeURL,
+			AlwaysPXE:             *alwaysPXE,
+			HardwareReservationID: *reservationFlag,
+			Tags:                  tags.Strings(),
 		}
-		dev, _, err = client.Devices.Create(&req)
+		if facility != "" {
+			req.Facility = []string{facility}
+		} else {
+			req.Metro = metro
+		}
+		if *spotPriceFlag > 0 {
+			req.SpotInstance = true
+			req.SpotPriceMax = *spotPriceFlag
+		}
+		dev, err = client.CreateDevice(projectID, req)
 		if err != nil {
 			log.Fatalf("Creating device failed: %v", err)
 		}
+		if !*keepFlag {
+			id := dev.ID
+			forgetDevice = onCleanup("device "+id, func() error { return client.DeleteDevice(id) })
+		}
 	}
 	b, err := json.MarshalIndent(dev, "", "    ")
 	if err != nil {
@@ -207,10 +233,41 @@ func runPacket(args []string) {
 
 	log.Printf("Booting %s...", dev.ID)
 
-	sshHost := "sos." + dev.Facility.Code + ".packet.net"
+	if len(vlans) > 0 {
+		// ports can only be changed once the device is provisioned
+		log.Printf("Waiting for %s to be active to attach VLANs...", dev.ID)
+		if dev, err = client.WaitForDevice(dev.ID); err != nil {
+			log.Fatal(err)
+		}
+		for _, vlan := range vlans {
+			log.Infof("Attaching VLAN %s", vlan)
+			if err := client.AssignVLAN(dev, vlan); err != nil {
+				log.Fatalf("Unable to attach VLAN %s: %v", vlan, err)
+			}
+		}
+	}
+
+	sshHost := "sos." + dev.Facility.Code + ".platformequinix.com"
+	runInfo := RunInfo{Backend: "packet", ID: dev.ID, Name: dev.Hostname, SSH: dev.ID + "@" + sshHost}
+	if *consoleFlag {
+		runInfo.ConsoleLog = *consoleLog
+	}
+	for _, ip := range dev.IPAddresses {
+		runInfo.IPs = append(runInfo.IPs, ip.Address)
+	}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
 	if *consoleFlag {
 		// Connect to the serial console
-		if err := packetSOS(dev.ID, sshHost); err != nil {
+		stdout, err := consoleWriter(os.Stdout, *consoleLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := packetSOS(dev.ID, sshHost, stdout); err != nil {
 			log.Fatal(err)
 		}
 	} else {
@@ -219,6 +276,8 @@ func runPacket(args []string) {
 		// if the serve option is present, wait till 'ctrl-c' is hit.
 		// Otherwise we wouldn't serve the files
 		if *serveFlag != "" {
+			// the device is deleted below once ctrl-c is hit
+			forgetDevice()
 			stop := make(chan os.Signal, 1)
 			signal.Notify(stop, os.Interrupt)
 			log.Printf("Hit ctrl-c to stop http server")
@@ -239,7 +298,8 @@ func runPacket(args []string) {
 		log.Printf("Device ID: %s", dev.ID)
 		log.Printf("Serial:    ssh %s@%s", dev.ID, sshHost)
 	} else {
-		if _, err := client.Devices.Delete(dev.ID); err != nil {
+		forgetDevice()
+		if err := client.DeleteDevice(dev.ID); err != nil {
 			log.Fatalf("Unable to delete device: %v", err)
 		}
 	}
@@ -250,6 +310,8 @@ func packetMachineToArch(machine string) string {
 	switch machine {
 	case "baremetal_2a", "baremetal_2a2":
 		return "aarch64"
+	case "c2.large.arm", "c3.large.arm64":
+		return "aarch64"
 	default:
 		return "x86_64"
 	}
@@ -296,7 +358,7 @@ func validateHTTPURL(url string) error {
 	return nil
 }
 
-func packetSOS(user, host string) error {
+func packetSOS(user, host string, out io.Writer) error {
 	log.Debugf("console: ssh %s@%s", user, host)
 
 	hostKey, err := sshHostKey(host)
@@ -323,7 +385,7 @@ func packetSOS(user, host string) error {
 	}
 	defer s.Close()
 
-	s.Stdout = os.Stdout
+	s.Stdout = out
 	s.Stderr = os.Stderr
 	s.Stdin = os.Stdin
 
@@ -383,7 +445,7 @@ func sshHostKey(host string) (ssh.PublicKey, error) {
 		}
 		if marker != "" {
 			//ignore CA or revoked key
-			fmt.Printf("ignoring marker: %s\n", marker)
+			log.Debugf("ignoring marker: %s", marker)
 			continue
 		}
 		for _, h := range hosts {
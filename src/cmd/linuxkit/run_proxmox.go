@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProxmoxStorage     = "local"
+	defaultProxmoxDiskStorage = "local-lvm"
+	defaultProxmoxBridge      = "vmbr0"
+)
+
+// Process the run arguments and execute run
+func runProxmox(args []string) {
+	flags := newFlagSet("proxmox")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run proxmox [options] path\n\n", invoked)
+		fmt.Printf("'path' is the disk image or ISO to upload and boot, for example\n")
+		fmt.Printf("the output of 'linuxkit build -format qcow2-bios'.\n")
+		fmt.Printf("The VM ID and the URL of its console are printed.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	urlFlag := flags.String("url", "", "URL of the Proxmox VE API, for example https://pve.example.com:8006 (or "+proxmoxURLVar+")")
+	tokenIDFlag := flags.String("token-id", "", "API token ID, as user@realm!name (or "+proxmoxTokenIDVar+")")
+	tokenSecretFlag := flags.String("token-secret", "", "API token secret (or "+proxmoxTokenSecretVar+")")
+	insecureFlag := flags.Bool("insecure", false, "Do not verify the TLS certificate of the host")
+	nodeFlag := flags.String("node", "", "Node to create the VM on (or "+proxmoxNodeVar+")")
+	storageFlag := flags.String("storage", defaultProxmoxStorage, "Storage to upload the image to (or "+proxmoxStorageVar+")")
+	diskStorageFlag := flags.String("disk-storage", defaultProxmoxDiskStorage, "Storage for the disks of the VM")
+	nameFlag := flags.String("name", "", "Name of the VM (default the image name)")
+	vmidFlag := flags.Int("vmid", 0, "ID of the VM (default the next free ID)")
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+	bridgeFlag := flags.String("bridge", defaultProxmoxBridge, "Bridge to connect the network interface to, or 'none'")
+	uefiFlag := flags.Bool("uefi", false, "Use UEFI boot")
+	noStartFlag := flags.Bool("no-start", false, "Create the VM without booting it")
+	info := runInfoFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Printf("Please specify the path to the image to boot\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	baseURL := getStringValue(proxmoxURLVar, *urlFlag, "")
+	tokenID := getStringValue(proxmoxTokenIDVar, *tokenIDFlag, "")
+	tokenSecret := getStringValue(proxmoxTokenSecretVar, *tokenSecretFlag, "")
+	node := getStringValue(proxmoxNodeVar, *nodeFlag, "")
+	storage := getStringValue(proxmoxStorageVar, *storageFlag, defaultProxmoxStorage)
+	name := getStringValue("", *nameFlag, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	if node == "" {
+		log.Fatalf("Please specify the node with -node or %s", proxmoxNodeVar)
+	}
+
+	client, err := NewProxmoxClient(baseURL, tokenID, tokenSecret, *insecureFlag)
+	if err != nil {
+		log.Fatalf("Unable to connect to Proxmox: %v", err)
+	}
+
+	log.Infof("Uploading %s to %s on %s", path, storage, node)
+	volume, err := client.UploadImage(node, storage, path)
+	if err != nil {
+		log.Fatalf("Unable to upload image: %v", err)
+	}
+
+	vmid := *vmidFlag
+	if vmid == 0 {
+		if vmid, err = client.NextVMID(); err != nil {
+			log.Fatalf("Unable to get a VM ID: %v", err)
+		}
+	}
+
+	config := proxmoxVMConfig{
+		Name:        name,
+		CPUs:        *cpus,
+		Memory:      *mem,
+		Bridge:      *bridgeFlag,
+		DiskStorage: *diskStorageFlag,
+		UEFI:        *uefiFlag,
+	}
+
+	log.Infof("Creating VM %d (%s)", vmid, name)
+	if err := client.CreateVM(node, vmid, config.values(volume)); err != nil {
+		log.Fatalf("Unable to create VM: %v", err)
+	}
+
+	if !*noStartFlag {
+		log.Infof("Starting VM %d", vmid)
+		if err := client.StartVM(node, vmid); err != nil {
+			log.Fatalf("Unable to start VM: %v", err)
+		}
+	}
+
+	log.WithFields(log.Fields{"vmid": vmid, "console": client.ConsoleURL(node, vmid)}).Infof("VM %d is running", vmid)
+	if err := writeRunInfo(*info, RunInfo{Backend: "proxmox", ID: strconv.Itoa(vmid), Name: name, Console: client.ConsoleURL(node, vmid)}); err != nil {
+		log.Fatal(err)
+	}
+}
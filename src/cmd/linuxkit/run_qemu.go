@@ -9,11 +9,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -28,6 +31,7 @@ type QemuConfig struct {
 	UEFI           bool
 	SquashFS       bool
 	Kernel         bool
+	Netboot        bool
 	GUI            bool
 	Disks          Disks
 	ISOImages      []string
@@ -38,13 +42,46 @@ type QemuConfig struct {
 	Memory         string
 	Accel          string
 	Detached       bool
+	Name           string
 	QemuBinPath    string
-	QemuImgPath    string
 	PublishedPorts []string
-	NetdevConfig   string
+	Netdevs        []QemuNetdev
 	UUID           uuid.UUID
 	USB            bool
 	Devices        []string
+	Mounts         VirtioFSs
+	VirtiofsdPath  string
+	VsockCID       int
+	Agent          bool
+	DataChannel    string
+	MetadataEmu    string
+	TPM            bool
+	SwtpmPath      string
+	SecureBoot     bool
+	FWVarsPath     string
+	SecureBootPK   string
+	SecureBootKEK  []string
+	SecureBootDB   []string
+	Restore        string
+	Shares9P       []Qemu9PShare
+	ConsoleLog     string
+	Info           string
+}
+
+// Qemu9PShare is the config for a host directory shared with 9p
+type Qemu9PShare struct {
+	Tag           string
+	Path          string
+	SecurityModel string
+	ReadOnly      bool
+}
+
+// QemuNetdev is the config of a network interface of the VM
+type QemuNetdev struct {
+	// Config is the -netdev config without the id
+	Config string
+	// MAC is the MAC address of the interface, if empty one is kept in the state directory
+	MAC string
 }
 
 const (
@@ -52,6 +89,8 @@ const (
 	qemuNetworkingUser           = "user"
 	qemuNetworkingTap            = "tap"
 	qemuNetworkingBridge         = "bridge"
+	qemuNetworkingSocket         = "socket"
+	qemuNetworkingNetdev         = "netdev"
 	qemuNetworkingDefault        = qemuNetworkingUser
 )
 
@@ -68,6 +107,8 @@ func init() {
 		defaultArch = "x86_64"
 	case "s390x":
 		defaultArch = "s390x"
+	case "riscv64":
+		defaultArch = "riscv64"
 	}
 	switch {
 	case runtime.GOARCH == "s390x":
@@ -76,6 +117,8 @@ func init() {
 		defaultAccel = "kvm:tcg"
 	case runtime.GOOS == "darwin":
 		defaultAccel = "hvf:tcg"
+	case runtime.GOOS == "windows":
+		defaultAccel = "whpx:tcg"
 	}
 }
 
@@ -84,9 +127,94 @@ func haveKVM() bool {
 	return !os.IsNotExist(err)
 }
 
+// kvmAvailable checks that KVM can be used
+func kvmAvailable() error {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("KVM is not available, there is no /dev/kvm, enable virtualization in the firmware and load the kvm module")
+	case os.IsPermission(err):
+		return fmt.Errorf("KVM is not accessible, /dev/kvm cannot be opened, add the user to the kvm group")
+	case err != nil:
+		return fmt.Errorf("KVM is not accessible: %v", err)
+	}
+	return f.Close()
+}
+
+// qemuGoArch returns the GOARCH equivalent of the qemu architecture, or ""
+// if it is not supported
+func qemuGoArch(arch string) string {
+	switch arch {
+	case "s390x":
+		return "s390x"
+	case "aarch64":
+		return "arm64"
+	case "x86_64":
+		return "amd64"
+	case "riscv64":
+		return "riscv64"
+	}
+	return ""
+}
+
+// qemuCheckAccel checks that the acceleration qemu is run with can be used,
+// as qemu otherwise fails with errors which are hard to act on, or silently
+// falls back to emulation. A VM of the architecture of the host is only
+// emulated with TCG if that was asked for, as it is very slow.
+func qemuCheckAccel(config QemuConfig, explicit bool) error {
+	if qemuGoArch(config.Arch) != runtime.GOARCH {
+		return nil
+	}
+	var tcg bool
+	var reasons []string
+	for _, accel := range strings.Split(config.Accel, ":") {
+		var err error
+		switch accel {
+		case "":
+			continue
+		case "tcg":
+			tcg = true
+			continue
+		case "kvm":
+			err = kvmAvailable()
+		case "hvf":
+			err = hvfAvailable()
+		}
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if len(reasons) == 0 {
+		// without KVM the default is to emulate
+		if explicit || runtime.GOOS != "linux" {
+			return nil
+		}
+		if err := kvmAvailable(); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if explicit && tcg {
+		log.Warnf("%s, falling back to TCG, which is very slow", strings.Join(reasons, "; "))
+		return nil
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s, emulating the VM with TCG would be very slow, use -accel tcg to accept that", strings.Join(reasons, "; "))
+}
+
 func retrieveMAC(statePath string) net.HardwareAddr {
+	return retrieveNICMAC(statePath, 0)
+}
+
+// retrieveNICMAC retrieves the MAC address of the i'th network interface
+func retrieveNICMAC(statePath string, i int) net.HardwareAddr {
 	var mac net.HardwareAddr
 	fileName := filepath.Join(statePath, "mac-addr")
+	if i != 0 {
+		fileName += strconv.Itoa(i)
+	}
 
 	if macString, err := ioutil.ReadFile(fileName); err == nil {
 		if mac, err = net.ParseMAC(string(macString)); err != nil {
@@ -118,10 +246,23 @@ func generateMAC() net.HardwareAddr {
 }
 
 func runQemu(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "snapshot":
+			runQemuSnapshot(args[1:])
+			return
+		case "publish", "unpublish":
+			runQemuPublish(args[0], args[1:])
+			return
+		}
+	}
+
 	invoked := filepath.Base(os.Args[0])
-	flags := flag.NewFlagSet("qemu", flag.ExitOnError)
+	flags := newFlagSet("qemu")
 	flags.Usage = func() {
-		fmt.Printf("USAGE: %s run qemu [options] path\n\n", invoked)
+		fmt.Printf("USAGE: %s run qemu [options] path\n", invoked)
+		fmt.Printf("       %s run qemu snapshot [save|ls|rm] [options] [name] path\n", invoked)
+		fmt.Printf("       %s run qemu [publish|unpublish] [options] port path\n\n", invoked)
 		fmt.Printf("'path' specifies the path to the VM image.\n")
 		fmt.Printf("\n")
 		fmt.Printf("Options:\n")
@@ -134,12 +275,16 @@ func runQemu(args []string) {
 
 	// Display flags
 	enableGUI := flags.Bool("gui", false, "Set qemu to use video output instead of stdio")
+	consoleLog := consoleLogFlag(flags)
+	ready := readinessFlags(flags)
+	info := runInfoFlag(flags)
 
 	// Boot type; we try to determine automatically
 	uefiBoot := flags.Bool("uefi", false, "Use UEFI boot")
 	isoBoot := flags.Bool("iso", false, "Boot image is an ISO")
 	squashFSBoot := flags.Bool("squashfs", false, "Boot image is a kernel+squashfs+cmdline")
 	kernelBoot := flags.Bool("kernel", false, "Boot image is kernel+initrd+cmdline 'path'-kernel/-initrd/-cmdline")
+	netboot := flags.Bool("netboot", false, "Boot the kernel+initrd from the network with the firmware of the machine, served over TFTP by user mode networking. Only supported on s390x")
 
 	// State flags
 	state := flags.String("state", "", "Path to directory to keep VM state in")
@@ -149,6 +294,9 @@ func runQemu(args []string) {
 	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=qcow2]")
 	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
 	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	dataChannel := flags.Bool("data-channel", false, "Pass the metadata to the VM on a virtio-serial port instead of an ISO")
+	metadataEmulator := flags.Bool("metadata-emulator", false, "Serve the metadata and AWS and GCP style instance metadata to the VM on "+metadataEmulatorAddress+" over user mode networking, instead of an ISO")
+	metadataSSHKey := flags.String("metadata-ssh-key", "", "Path to a SSH public key the metadata emulator serves")
 
 	if *data != "" && *dataPath != "" {
 		log.Fatal("Cannot specify both -data and -data-file")
@@ -157,30 +305,61 @@ func runQemu(args []string) {
 	// Paths and settings for UEFI firware
 	// Note, we do not use defaultFWPath here as we have a special case for containerised execution
 	fw := flags.String("fw", "", "Path to OVMF firmware for UEFI boot")
+	secureBoot := flags.Bool("secure-boot", false, "Enable Secure Boot, requires -uefi. The OVMF variable store is kept in the state directory")
+	fwVars := flags.String("fw-vars", "", "Path to the OVMF variable store template used with -secure-boot, or with -uefi on riscv64, -fw must then be the matching OVMF code")
+	secureBootPK := flags.String("secure-boot-pk", "", "Path to a PEM certificate to enroll as the Secure Boot platform key, instead of using the keys of the template")
+	secureBootKEK := multipleFlag{}
+	flags.Var(&secureBootKEK, "secure-boot-kek", "Path to a PEM certificate to enroll as a Secure Boot key exchange key, may be repeated")
+	secureBootDB := multipleFlag{}
+	flags.Var(&secureBootDB, "secure-boot-db", "Path to a PEM certificate to enroll in the Secure Boot signature database, may be repeated")
 
 	// VM configuration
 	accel := flags.String("accel", defaultAccel, "Choose acceleration mode. Use 'tcg' to disable it.")
-	arch := flags.String("arch", defaultArch, "Type of architecture to use, e.g. x86_64, aarch64, s390x")
+	arch := flags.String("arch", defaultArch, "Type of architecture to use, e.g. x86_64, aarch64, s390x, riscv64")
 	cpus := flags.String("cpus", "1", "Number of CPUs")
 	mem := flags.String("mem", "1024", "Amount of memory in MB")
 
 	// Backend configuration
 	qemuCmd := flags.String("qemu", "", "Path to the qemu binary (otherwise look in $PATH)")
-	qemuDetached := flags.Bool("detached", false, "Set qemu container to run in the background")
+	qemuDetached := flags.Bool("detached", false, "Run qemu in the background, the console is served on a socket in the state directory which 'linuxkit attach' connects to")
+	flags.BoolVar(qemuDetached, "detach", false, "Same as -detached")
+	vmName := flags.String("name", "", "Name of the VM, which keeps its state in "+filepath.Join("~", ".linuxkit", "vms", "<name>")+" unless -state is given, and is managed with 'ps', 'stop' and 'rm'")
+	restore := flags.String("restore", "", "Start from a snapshot saved with 'snapshot save', the other options must match the ones the snapshot was saved with")
 
 	// Generate UUID, so that /sys/class/dmi/id/product_uuid is populated
 	vmUUID := uuid.New()
 
 	// Networking
-	networking := flags.String("networking", qemuNetworkingDefault, "Networking mode. Valid options are 'default', 'user', 'bridge[,name]', tap[,name] and 'none'. 'user' uses QEMUs userspace networking. 'bridge' connects to a preexisting bridge. 'tap' uses a prexisting tap device. 'none' disables networking.`")
+	networking := multipleFlag{}
+	flags.Var(&networking, "networking", "Networking mode, may be repeated to add several network interfaces. Valid options are 'default', 'user', 'bridge[,name]', tap[,name], 'socket,listen=[host]:port|connect=host:port|mcast=addr:port', 'netdev,options' and 'none'. 'user' uses QEMUs userspace networking. 'bridge' connects to a preexisting bridge. 'tap' uses a prexisting tap device. 'socket' connects VMs with a socket. 'netdev' passes the options to -netdev on the qemu command line. 'none' disables networking. Append ',mac=address' to set the MAC address of an interface. (default user)")
 
 	publishFlags := multipleFlag{}
-	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host (default [])")
+	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host, [host ip:]host[-end]:guest[-end][/tcp|udp] (default [])")
 
 	// USB devices
 	usbEnabled := flags.Bool("usb", false, "Enable USB controller")
 	deviceFlags := multipleFlag{}
-	flags.Var(&deviceFlags, "device", "Add USB host device(s). Format driver[,prop=value][,...] -- add device, like -device on the qemu command line.")
+	flags.Var(&deviceFlags, "device", "Add USB host device(s). Format driver[,prop=value][,...] -- add device, like -device on the qemu command line. Use vfio:[domain:]bus:slot.function to pass through a host PCI device bound to vfio-pci")
+
+	// vsock
+	vsockCID := flags.Int("vsock-cid", 0, "Add a vhost-vsock device with the given guest context ID, which must be 3 or more and unique on the host. 0 disables vsock.")
+	agent := flags.Bool("agent", false, "Add a virtio-serial port for the linuxkit/agent package, served on "+agentSocket+" in the state directory for 'linuxkit exec', 'cp' and 'logs'")
+
+	// TPM
+	tpm := flags.Bool("tpm", false, "Add a TPM 2.0 device emulated by swtpm. The TPM state is kept in the state directory")
+	swtpmPath := flags.String("swtpm", "swtpm", "Path to the swtpm binary")
+
+	// Shared directories
+	mountFlags := multipleFlag{}
+	flags.Var(&mountFlags, "mount", "Share a host directory with the VM using virtio-fs, may be repeated. Format host:guest, the directory is shared with the guest path as the tag")
+	share9PFlags := multipleFlag{}
+	flags.Var(&share9PFlags, "9p", "Share a host directory with the VM using 9p, may be repeated. Format host:guest[,security=none|mapped-xattr|mapped-file|passthrough][,readonly], the directory is shared with the guest path as the tag. The default security model is none")
+	virtiofsdPath := flags.String("virtiofsd", "", "Path to the virtiofsd binary (otherwise look in $PATH and /usr/libexec)")
+
+	// Clusters
+	nodes := flags.Int("nodes", 1, "Number of VMs to boot on a shared network, each with a state directory node<N> in the state directory and its address and the addresses of its peers in the metadata. Requires -detached")
+	nodesNetwork := flags.String("nodes-network", "", "Networking mode of the network shared by the nodes, as for -networking (default a socket multicast group unique to the state directory)")
+	nodesSubnet := flags.String("nodes-subnet", qemuNodesSubnet, "Subnet the addresses of the nodes are taken from")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -190,6 +369,12 @@ func runQemu(args []string) {
 	// These envvars override the corresponding command line
 	// options. So this must remain after the `flags.Parse` above.
 	*accel = getStringValue("LINUXKIT_QEMU_ACCEL", *accel, "")
+	_, accelSet := os.LookupEnv("LINUXKIT_QEMU_ACCEL")
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "accel" {
+			accelSet = true
+		}
+	})
 
 	if len(remArgs) == 0 {
 		fmt.Println("Please specify the path to the image to boot")
@@ -224,6 +409,18 @@ func runQemu(args []string) {
 		}
 	}
 
+	if *vmName != "" {
+		named, err := namedVMStateDir(*vmName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *state == "" {
+			*state = named
+		}
+		if vmRunning(*state) {
+			log.Fatalf("VM %s is already running, stop it with 'linuxkit stop %s'", *vmName, *vmName)
+		}
+	}
 	if *state == "" {
 		*state = prefix + "-state"
 	}
@@ -238,11 +435,69 @@ func runQemu(args []string) {
 		isoPaths = append(isoPaths, path)
 	}
 
-	metadataPaths, err := CreateMetadataISO(*state, *data, *dataPath)
-	if err != nil {
-		log.Fatalf("%v", err)
+	if *nodes < 1 {
+		log.Fatalf("Invalid number of nodes %d", *nodes)
+	}
+	// the metadata of each node is written to its own state directory
+	var nodesData []byte
+	var dataChannelPath string
+	if *dataChannel && *nodes != 1 {
+		log.Fatalf("-data-channel cannot be used with -nodes")
+	}
+	var metadataEmulatorPath string
+	if *metadataEmulator && (*nodes != 1 || *dataChannel) {
+		log.Fatalf("-metadata-emulator cannot be used with -nodes or -data-channel")
+	}
+	if *metadataEmulator {
+		emulator := metadataEmulatorConfig{Hostname: "linuxkit", InstanceID: filepath.Base(*state), LocalIPv4: qemuMetadataEmulatorGuest}
+		if *vmName != "" {
+			emulator.Hostname = *vmName
+			emulator.InstanceID = *vmName
+		}
+		if *data != "" {
+			emulator.UserData = []byte(*data)
+		}
+		if *dataPath != "" {
+			if emulator.UserData, err = ioutil.ReadFile(*dataPath); err != nil {
+				log.Fatalf("Cannot read user data from path %s: %v", *dataPath, err)
+			}
+		}
+		if *metadataSSHKey != "" {
+			key, err := ioutil.ReadFile(*metadataSSHKey)
+			if err != nil {
+				log.Fatalf("Cannot read the SSH key: %v", err)
+			}
+			emulator.SSHKeys = []string{strings.TrimSpace(string(key))}
+		}
+		if metadataEmulatorPath, err = writeMetadataEmulatorConfig(*state, emulator); err != nil {
+			log.Fatal(err)
+		}
+	} else if *dataChannel {
+		content := []byte(*data)
+		if *dataPath != "" {
+			if content, err = ioutil.ReadFile(*dataPath); err != nil {
+				log.Fatalf("Cannot read user data from path %s: %v", *dataPath, err)
+			}
+		}
+		// qemu reads the port from a file, which is written to the
+		// output file next to it
+		dataChannelPath = filepath.Join(*state, "data.channel")
+		if err := ioutil.WriteFile(dataChannelPath, metadataChannelFrame(content), 0600); err != nil {
+			log.Fatalf("Cannot write user data: %v", err)
+		}
+	} else if *nodes == 1 {
+		metadataPaths, err := CreateMetadataISO(*state, *data, *dataPath)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		isoPaths = append(isoPaths, metadataPaths...)
+	} else if *dataPath != "" {
+		if nodesData, err = ioutil.ReadFile(*dataPath); err != nil {
+			log.Fatalf("Cannot read user data from path %s: %v", *dataPath, err)
+		}
+	} else {
+		nodesData = []byte(*data)
 	}
-	isoPaths = append(isoPaths, metadataPaths...)
 
 	for i, d := range disks {
 		id := ""
@@ -277,39 +532,80 @@ func runQemu(args []string) {
 		disks = append(d, disks...)
 	}
 
-	if *networking == "" || *networking == "default" {
-		dflt := qemuNetworkingDefault
-		networking = &dflt
+	for i, d := range deviceFlags {
+		if !strings.HasPrefix(d, "vfio:") {
+			continue
+		}
+		device, err := qemuVFIODevice(strings.TrimPrefix(d, "vfio:"))
+		if err != nil {
+			log.Fatalf("Cannot pass through %s: %v", d, err)
+		}
+		deviceFlags[i] = device
+	}
+
+	if *secureBoot && !*uefiBoot {
+		log.Fatalf("Secure Boot requires -uefi")
+	}
+	if *secureBootPK == "" && (len(secureBootKEK) > 0 || len(secureBootDB) > 0) {
+		log.Fatalf("Enrolling Secure Boot keys requires a platform key, use -secure-boot-pk")
+	}
+
+	if *vsockCID != 0 && *vsockCID < 3 {
+		log.Fatalf("Invalid vsock context ID %d, CIDs 0 to 2 are reserved", *vsockCID)
 	}
-	netMode := strings.SplitN(*networking, ",", 2)
 
-	var netdevConfig string
-	switch netMode[0] {
-	case qemuNetworkingUser:
-		netdevConfig = "user,id=t0"
-	case qemuNetworkingTap:
-		if len(netMode) != 2 {
-			log.Fatalf("Not enough arguments for %q networking mode", qemuNetworkingTap)
+	var mounts VirtioFSs
+	for _, m := range mountFlags {
+		c := strings.SplitN(m, ":", 2)
+		if len(c) != 2 || c[0] == "" || c[1] == "" {
+			log.Fatalf("Mount must be host:guest: %s", m)
 		}
-		if len(publishFlags) != 0 {
-			log.Fatalf("Port publishing requires %q networking mode", qemuNetworkingUser)
+		// the tag of a virtio-fs device can be at most 36 bytes
+		if len(c[1]) > 36 {
+			log.Fatalf("Guest path %s is too long to be used as a virtio-fs tag", c[1])
 		}
-		netdevConfig = fmt.Sprintf("tap,id=t0,ifname=%s,script=no,downscript=no", netMode[1])
-	case qemuNetworkingBridge:
-		if len(netMode) != 2 {
-			log.Fatalf("Not enough arguments for %q networking mode", qemuNetworkingBridge)
+		host, err := filepath.Abs(c[0])
+		if err != nil {
+			log.Fatalf("Cannot share %s: %v", c[0], err)
 		}
-		if len(publishFlags) != 0 {
-			log.Fatalf("Port publishing requires %q networking mode", qemuNetworkingUser)
+		if fi, err := os.Stat(host); err != nil || !fi.IsDir() {
+			log.Fatalf("Cannot share %s: not a directory", c[0])
 		}
-		netdevConfig = fmt.Sprintf("bridge,id=t0,br=%s", netMode[1])
-	case qemuNetworkingNone:
-		if len(publishFlags) != 0 {
-			log.Fatalf("Port publishing requires %q networking mode", qemuNetworkingUser)
+		mounts = append(mounts, VirtioFS{Tag: c[1], Path: host})
+	}
+
+	var shares9P []Qemu9PShare
+	for _, f := range share9PFlags {
+		share, err := parseQemu9PShare(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shares9P = append(shares9P, share)
+	}
+
+	netdevs, err := parseQemuNetworking(networking, len(publishFlags) != 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *netboot {
+		if *arch != "s390x" {
+			log.Fatalf("-netboot is only supported on s390x")
+		}
+		if !*kernelBoot {
+			log.Fatalf("-netboot requires a kernel+initrd image")
+		}
+		if len(netdevs) == 0 || !strings.HasPrefix(netdevs[0].Config, qemuNetworkingUser) {
+			log.Fatalf("-netboot requires the first network interface to use user mode networking")
+		}
+	}
+	if *metadataEmulator {
+		if len(netdevs) == 0 || !strings.HasPrefix(netdevs[0].Config, qemuNetworkingUser) {
+			log.Fatalf("-metadata-emulator requires the first network interface to use user mode networking")
+		}
+		if strings.Contains(netdevs[0].Config, ",net=") {
+			log.Fatalf("-metadata-emulator cannot be used with the network of user mode networking set with 'netdev,user,net=...'")
 		}
-		netdevConfig = ""
-	default:
-		log.Fatalf("Invalid networking mode: %s", netMode[0])
 	}
 
 	config := QemuConfig{
@@ -318,6 +614,7 @@ func runQemu(args []string) {
 		UEFI:           *uefiBoot,
 		SquashFS:       *squashFSBoot,
 		Kernel:         *kernelBoot,
+		Netboot:        *netboot,
 		GUI:            *enableGUI,
 		Disks:          disks,
 		ISOImages:      isoPaths,
@@ -328,25 +625,121 @@ func runQemu(args []string) {
 		Memory:         *mem,
 		Accel:          *accel,
 		Detached:       *qemuDetached,
+		Name:           *vmName,
 		QemuBinPath:    *qemuCmd,
 		PublishedPorts: publishFlags,
-		NetdevConfig:   netdevConfig,
+		Netdevs:        netdevs,
 		UUID:           vmUUID,
 		USB:            *usbEnabled,
 		Devices:        deviceFlags,
+		Mounts:         mounts,
+		VirtiofsdPath:  *virtiofsdPath,
+		VsockCID:       *vsockCID,
+		Agent:          *agent,
+		DataChannel:    dataChannelPath,
+		MetadataEmu:    metadataEmulatorPath,
+		TPM:            *tpm,
+		SwtpmPath:      *swtpmPath,
+		SecureBoot:     *secureBoot,
+		FWVarsPath:     *fwVars,
+		SecureBootPK:   *secureBootPK,
+		SecureBootKEK:  secureBootKEK,
+		SecureBootDB:   secureBootDB,
+		Restore:        *restore,
+		Shares9P:       shares9P,
+		ConsoleLog:     *consoleLog,
+		Info:           *info,
 	}
 
 	config, err = discoverBinaries(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := qemuCheckAccel(config, accelSet); err != nil {
+		log.Fatal(err)
+	}
+	// qemu also accepts a topology in -cpus and a unit in -mem, which are
+	// not checked
+	qemuCPUs, _ := strconv.Atoi(*cpus)
+	qemuMem, _ := strconv.Atoi(*mem)
+	// the nodes each have the memory
+	qemuMem *= *nodes
+	if err := checkHostResources(qemuCPUs, qemuMem, config.Disks, config.StatePath); err != nil {
+		log.Fatal(err)
+	}
 
-	if err = runQemuLocal(config); err != nil {
+	if ready.enabled() && !config.Detached {
+		log.Fatal("-wait-for requires -detached")
+	}
+	if *nodes > 1 {
+		runQemuNodes(config, *nodes, *nodesNetwork, *nodesSubnet, nodesData, ready)
+		return
+	}
+	err = runQemuLocal(config)
+	if !config.Detached {
+		exitGuestStatus()
+	}
+	if err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := ready.wait(qemuRunInfo(config)); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func runQemuLocal(config QemuConfig) error {
+	// Check for OVMF firmware before running
+	if config.UEFI {
+		if config.SecureBoot {
+			var err error
+			if config, err = setupSecureBoot(config); err != nil {
+				return err
+			}
+		} else if config.Arch == "riscv64" {
+			var err error
+			if config, err = setupRiscvUEFI(config); err != nil {
+				return err
+			}
+		}
+		if config.FWPath == "" {
+			// there is no default on mac
+			if runtime.GOOS == "darwin" {
+				return fmt.Errorf("To run qemu with UEFI firmware on macOS, you must specify the path to locally installed OVMF firmware as `--fw <path>`. You can download OVMF from https://sourceforge.net/projects/edk2/files/OVMF/ ")
+			}
+			config.FWPath = defaultFWPath
+		}
+		if _, err := os.Stat(config.FWPath); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("File [%s] does not exist, please ensure OVMF is installed", config.FWPath)
+			}
+			return err
+		}
+	}
+
+	if config.Restore != "" {
+		if err := checkQemuSnapshotName(config.Restore); err != nil {
+			return err
+		}
+		if _, err := os.Stat(qemuSnapshotPath(config.StatePath, config.Restore)); err != nil {
+			return fmt.Errorf("Cannot find snapshot %s: %v", config.Restore, err)
+		}
+	}
+
+	// a daemonized qemu changes to the root directory
+	if config.Detached {
+		statePath, err := filepath.Abs(config.StatePath)
+		if err != nil {
+			return err
+		}
+		config.StatePath = statePath
+	}
+
+	if config.Netboot {
+		if err := setupQemuNetboot(config); err != nil {
+			return err
+		}
+	}
+
 	var args []string
 	config, args = buildQemuCmdline(config)
 
@@ -355,9 +748,7 @@ func runQemuLocal(config QemuConfig) error {
 		if _, err := os.Stat(d.Path); err != nil {
 			if os.IsNotExist(err) {
 				log.Debugf("Creating new qemu disk [%s] format %s", d.Path, d.Format)
-				qemuImgCmd := exec.Command(config.QemuImgPath, "create", "-f", d.Format, d.Path, fmt.Sprintf("%dM", d.Size))
-				log.Debugf("%v\n", qemuImgCmd.Args)
-				if err := qemuImgCmd.Run(); err != nil {
+				if err := createQemuDisk(d); err != nil {
 					return fmt.Errorf("Error creating disk [%s] format %s:  %s", d.Path, d.Format, err.Error())
 				}
 			} else {
@@ -368,49 +759,331 @@ func runQemuLocal(config QemuConfig) error {
 		}
 	}
 
-	// Check for OVMF firmware before running
-	if config.UEFI {
-		if config.FWPath == "" {
-			// there is no default on mac
-			if runtime.GOOS == "darwin" {
-				return fmt.Errorf("To run qemu with UEFI firmware on macOS, you must specify the path to locally installed OVMF firmware as `--fw <path>`. You can download OVMF from https://sourceforge.net/projects/edk2/files/OVMF/ ")
-			}
-			config.FWPath = defaultFWPath
+	if config.Detached && runtime.GOOS == "windows" {
+		return fmt.Errorf("Detached mode is not supported on Windows")
+	}
+	if config.Detached && config.ConsoleLog != "" {
+		return fmt.Errorf("Cannot specify both -detached and -console-log, the console of a detached VM is logged to %s in the state directory", consoleLogFile)
+	}
+
+	// swtpm and virtiofsd exit by themselves when a detached qemu exits
+	if config.TPM {
+		swtpm, err := startSwtpm(config.SwtpmPath, config.StatePath)
+		if err != nil {
+			return fmt.Errorf("Cannot start swtpm: %v", err)
 		}
-		if _, err := os.Stat(config.FWPath); err != nil {
-			if os.IsNotExist(err) {
-				return fmt.Errorf("File [%s] does not exist, please ensure OVMF is installed", config.FWPath)
-			}
-			return err
+		if !config.Detached {
+			defer func() {
+				swtpm.Process.Kill()
+				swtpm.Wait()
+			}()
+		}
+	}
+
+	for i, m := range config.Mounts {
+		virtiofsd, err := startVirtiofsd(config.VirtiofsdPath, qemuVirtiofsSocket(config, i), m.Path)
+		if err != nil {
+			return fmt.Errorf("Cannot share %s: %v", m.Path, err)
+		}
+		if !config.Detached {
+			defer func() {
+				virtiofsd.Process.Kill()
+				virtiofsd.Wait()
+			}()
 		}
 	}
 
-	// Detached mode is only supported in a container.
-	if config.Detached == true {
-		return fmt.Errorf("Detached mode is only supported when running in a container, not locally")
+	if err := writeRunInfo(config.Info, qemuRunInfo(config)); err != nil {
+		return err
+	}
+	// the information is kept for 'linuxkit ps'
+	if err := writeRunInfo(filepath.Join(config.StatePath, vmInfoFile), qemuRunInfo(config)); err != nil {
+		return err
 	}
 
 	qemuCmd := exec.Command(config.QemuBinPath, args...)
 	// If verbosity is enabled print out the full path/arguments
 	log.Debugf("%v\n", qemuCmd.Args)
 
+	// qemu daemonizes itself once it started, reporting errors before then
+	if config.Detached {
+		qemuCmd.Stderr = os.Stderr
+		if err := qemuCmd.Run(); err != nil {
+			return err
+		}
+		if config.GUI != true {
+			log.Infof("qemu is running in the background, use 'linuxkit attach %s' to connect to its console", config.StatePath)
+		}
+		return nil
+	}
+
 	// If we're not using a separate window then link the execution to stdin/out
 	if config.GUI != true {
+		stdout, err := consoleWriter(os.Stdout, config.ConsoleLog)
+		if err != nil {
+			return err
+		}
 		qemuCmd.Stdin = os.Stdin
-		qemuCmd.Stdout = os.Stdout
+		qemuCmd.Stdout = stdout
 		qemuCmd.Stderr = os.Stderr
 	}
 
 	return qemuCmd.Run()
 }
 
+// pciAddress matches a PCI address, optionally with the domain
+var pciAddress = regexp.MustCompile(`^([0-9a-fA-F]{4}:)?[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// qemuVFIODevice checks that the host PCI device at addr can be passed
+// through with VFIO and returns the qemu device for it
+func qemuVFIODevice(addr string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("PCI passthrough is only supported on Linux")
+	}
+	if !pciAddress.MatchString(addr) {
+		return "", fmt.Errorf("Invalid PCI address %s, must be [domain:]bus:slot.function", addr)
+	}
+	if strings.Count(addr, ":") == 1 {
+		addr = "0000:" + addr
+	}
+	addr = strings.ToLower(addr)
+	sysfs := filepath.Join("/sys/bus/pci/devices", addr)
+	if _, err := os.Stat(sysfs); err != nil {
+		return "", fmt.Errorf("There is no PCI device %s", addr)
+	}
+	groups, err := ioutil.ReadDir("/sys/kernel/iommu_groups")
+	if err != nil || len(groups) == 0 {
+		return "", fmt.Errorf("The IOMMU is not enabled, enable it in the firmware and with intel_iommu=on or amd_iommu=on on the kernel command line")
+	}
+	group, err := os.Readlink(filepath.Join(sysfs, "iommu_group"))
+	if err != nil {
+		return "", fmt.Errorf("Device %s is not in an IOMMU group", addr)
+	}
+	driver, err := os.Readlink(filepath.Join(sysfs, "driver"))
+	if err != nil || filepath.Base(driver) != "vfio-pci" {
+		current := "no driver"
+		if err == nil {
+			current = filepath.Base(driver)
+		}
+		return "", fmt.Errorf("Device %s is bound to %s, it must be bound to vfio-pci, for example with 'driverctl set-override %s vfio-pci'", addr, current, addr)
+	}
+	// the devices of a group can only be passed through together
+	members, err := ioutil.ReadDir(filepath.Join(sysfs, "iommu_group", "devices"))
+	if err == nil && len(members) > 1 {
+		log.Warnf("IOMMU group %s of %s contains %d devices, all of them must be bound to vfio-pci", filepath.Base(group), addr, len(members))
+	}
+	vfio := filepath.Join("/dev/vfio", filepath.Base(group))
+	f, err := os.OpenFile(vfio, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("Cannot open %s, you may need to run as root or change its permissions: %v", vfio, err)
+	}
+	f.Close()
+	return "vfio-pci,host=" + addr, nil
+}
+
+// ovmfSecureBoot are the locations distributions install the OVMF firmware
+// with Secure Boot support to, with a variable store template with the
+// Microsoft keys enrolled and an empty one
+var ovmfSecureBoot = []struct {
+	code, vars, blankVars string
+}{
+	{"/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+	{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+	{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+}
+
+// edk2RiscvVirt are the locations distributions install the edk2 firmware
+// for the qemu riscv64 virt machine to, with its variable store template
+var edk2RiscvVirt = []struct {
+	code, vars string
+}{
+	{"/usr/share/qemu-efi-riscv64/RISCV_VIRT_CODE.fd", "/usr/share/qemu-efi-riscv64/RISCV_VIRT_VARS.fd"},
+	{"/usr/share/edk2/riscv/RISCV_VIRT_CODE.fd", "/usr/share/edk2/riscv/RISCV_VIRT_VARS.fd"},
+}
+
+// setupRiscvUEFI finds the edk2 firmware for riscv64 and creates the
+// variable store in the state directory, as the virt machine boots the
+// firmware from two pflash drives, the code and the variables
+func setupRiscvUEFI(config QemuConfig) (QemuConfig, error) {
+	if config.FWPath == "" || config.FWVarsPath == "" {
+		if config.FWPath != "" || config.FWVarsPath != "" {
+			return config, fmt.Errorf("UEFI on riscv64 requires both -fw and -fw-vars to be set, or neither")
+		}
+		for _, f := range edk2RiscvVirt {
+			_, errCode := os.Stat(f.code)
+			_, errVars := os.Stat(f.vars)
+			if errCode == nil && errVars == nil {
+				config.FWPath, config.FWVarsPath = f.code, f.vars
+				break
+			}
+		}
+		if config.FWPath == "" {
+			return config, fmt.Errorf("Unable to find the edk2 firmware for riscv64, please ensure it is installed or use -fw and -fw-vars")
+		}
+	}
+
+	vars := filepath.Join(config.StatePath, "RISCV_VIRT_VARS.fd")
+	if _, err := os.Stat(vars); err == nil {
+		log.Infof("Using existing UEFI variable store [%s]", vars)
+		config.FWVarsPath = vars
+		return config, nil
+	}
+	b, err := ioutil.ReadFile(config.FWVarsPath)
+	if err != nil {
+		return config, err
+	}
+	if err := ioutil.WriteFile(vars, b, 0644); err != nil {
+		return config, err
+	}
+	config.FWVarsPath = vars
+	return config, nil
+}
+
+// setupSecureBoot finds the OVMF firmware and creates the variable store in
+// the state directory. If a platform key is given, the keys are enrolled
+// with virt-fw-vars, otherwise the template is copied.
+func setupSecureBoot(config QemuConfig) (QemuConfig, error) {
+	if config.FWPath == "" || config.FWVarsPath == "" {
+		if config.FWPath != "" || config.FWVarsPath != "" {
+			return config, fmt.Errorf("Secure Boot requires both -fw and -fw-vars to be set, or neither")
+		}
+		if config.Arch != "x86_64" {
+			return config, fmt.Errorf("Secure Boot on %s requires the firmware to be set with -fw and -fw-vars", config.Arch)
+		}
+		for _, f := range ovmfSecureBoot {
+			vars := f.vars
+			if config.SecureBootPK != "" {
+				vars = f.blankVars
+			}
+			_, errCode := os.Stat(f.code)
+			_, errVars := os.Stat(vars)
+			if errCode == nil && errVars == nil {
+				config.FWPath, config.FWVarsPath = f.code, vars
+				break
+			}
+		}
+		if config.FWPath == "" {
+			return config, fmt.Errorf("Unable to find OVMF firmware with Secure Boot support, please ensure OVMF is installed or use -fw and -fw-vars")
+		}
+	}
+
+	vars := filepath.Join(config.StatePath, "OVMF_VARS.fd")
+	if _, err := os.Stat(vars); err == nil {
+		log.Infof("Using existing OVMF variable store [%s]", vars)
+		config.FWVarsPath = vars
+		return config, nil
+	}
+
+	if config.SecureBootPK == "" {
+		b, err := ioutil.ReadFile(config.FWVarsPath)
+		if err != nil {
+			return config, err
+		}
+		if err := ioutil.WriteFile(vars, b, 0644); err != nil {
+			return config, err
+		}
+		config.FWVarsPath = vars
+		return config, nil
+	}
+
+	virtFwVars, err := exec.LookPath("virt-fw-vars")
+	if err != nil {
+		return config, fmt.Errorf("Unable to find virt-fw-vars within the $PATH to enroll Secure Boot keys, it is part of virt-firmware")
+	}
+	owner := config.UUID.String()
+	fwArgs := []string{"--input", config.FWVarsPath, "--output", vars, "--secure-boot", "--set-pk", owner, config.SecureBootPK}
+	for _, k := range config.SecureBootKEK {
+		fwArgs = append(fwArgs, "--add-kek", owner, k)
+	}
+	for _, k := range config.SecureBootDB {
+		fwArgs = append(fwArgs, "--add-db", owner, k)
+	}
+	cmd := exec.Command(virtFwVars, fwArgs...)
+	log.Debugf("%v\n", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return config, fmt.Errorf("Unable to enroll Secure Boot keys: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	config.FWVarsPath = vars
+	return config, nil
+}
+
+// startSwtpm starts a swtpm emulating a TPM 2.0 with its state in the state
+// directory and waits for its control socket
+func startSwtpm(swtpm, statePath string) (*exec.Cmd, error) {
+	tpmState := filepath.Join(statePath, "tpm")
+	if err := os.MkdirAll(tpmState, 0700); err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(statePath, "swtpm.sock")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// --terminate makes swtpm exit when qemu disconnects
+	cmd := exec.Command(swtpm, "socket", "--tpm2", "--terminate",
+		"--tpmstate", "dir="+tpmState,
+		"--ctrl", "type=unixio,path="+socket,
+		"--log", "file="+filepath.Join(statePath, "swtpm.log"))
+	cmd.Stderr = os.Stderr
+	log.Debugf("%v\n", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return cmd, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	return nil, fmt.Errorf("swtpm did not create %s", socket)
+}
+
+// qemuRunInfo returns the information about the VM written with -info
+func qemuRunInfo(config QemuConfig) RunInfo {
+	info := RunInfo{
+		Backend:    "qemu",
+		ID:         config.UUID.String(),
+		Name:       config.Name,
+		Image:      config.Path,
+		StatePath:  config.StatePath,
+		ConsoleLog: config.ConsoleLog,
+	}
+	if config.Detached && config.GUI != true {
+		info.Console = filepath.Join(config.StatePath, consoleSocket)
+		info.ConsoleLog = filepath.Join(config.StatePath, consoleLogFile)
+	}
+	// the guest is only reachable with ssh if its port is published
+	for _, publish := range config.PublishedPorts {
+		ports, _ := NewPublishedPorts(publish)
+		for _, p := range ports {
+			if p.Guest == 22 && p.Protocol == "tcp" {
+				host := p.HostIP
+				if host == "" {
+					host = "localhost"
+				}
+				info.SSH = net.JoinHostPort(host, strconv.Itoa(int(p.Host)))
+			}
+		}
+	}
+	return info
+}
+
+// qemuVirtiofsSocket is the path of the socket of the virtiofsd for a mount
+func qemuVirtiofsSocket(config QemuConfig, i int) string {
+	return filepath.Join(config.StatePath, fmt.Sprintf("virtiofs%d.sock", i))
+}
+
 func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	// Iterate through the flags and build arguments
 	var qemuArgs []string
 	qemuArgs = append(qemuArgs, "-smp", config.CPUs)
 	qemuArgs = append(qemuArgs, "-m", config.Memory)
 	qemuArgs = append(qemuArgs, "-uuid", config.UUID.String())
-	qemuArgs = append(qemuArgs, "-pidfile", filepath.Join(config.StatePath, "qemu.pid"))
+	qemuArgs = append(qemuArgs, "-pidfile", filepath.Join(config.StatePath, qemuPidFile))
+	qemuArgs = append(qemuArgs, "-qmp", "unix:"+filepath.Join(config.StatePath, qemuQMPSocket)+",server=on,wait=off")
+	if config.Restore != "" {
+		qemuArgs = append(qemuArgs, "-incoming", "exec:cat "+shellQuote(qemuSnapshotPath(config.StatePath, config.Restore)))
+	}
 
 	// Need to specify the vcpu type when running qemu on arm64 platform, for security reason,
 	// the vcpu should be "host" instead of other names such as "cortex-a53"...
@@ -422,16 +1095,8 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		}
 	}
 
-	// goArch is the GOARCH equivalent of config.Arch
-	var goArch string
-	switch config.Arch {
-	case "s390x":
-		goArch = "s390x"
-	case "aarch64":
-		goArch = "arm64"
-	case "x86_64":
-		goArch = "amd64"
-	default:
+	goArch := qemuGoArch(config.Arch)
+	if goArch == "" {
 		log.Fatalf("%s is an unsupported architecture.", config.Arch)
 	}
 
@@ -440,29 +1105,45 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		config.Accel = ""
 	}
 
+	// The default CPU model of the emulated s390x lacks facilities the
+	// kernel requires
+	if config.Arch == "s390x" && (config.Accel == "" || config.Accel == "tcg") {
+		qemuArgs = append(qemuArgs, "-cpu", "max")
+	}
+
+	// Secure Boot OVMF on x86_64 requires SMM to protect the variable store
+	var smm string
+	if config.SecureBoot && config.Arch == "x86_64" {
+		smm = ",smm=on"
+		qemuArgs = append(qemuArgs, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+
 	if config.Accel != "" {
 		switch config.Arch {
 		case "s390x":
 			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("s390-ccw-virtio,accel=%s", config.Accel))
 		case "aarch64":
 			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("virt,gic_version=host,accel=%s", config.Accel))
+		case "riscv64":
+			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("virt,accel=%s", config.Accel))
 		default:
-			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("q35,accel=%s", config.Accel))
+			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("q35%s,accel=%s", smm, config.Accel))
 		}
 	} else {
 		switch config.Arch {
 		case "s390x":
 			qemuArgs = append(qemuArgs, "-machine", "s390-ccw-virtio")
-		case "aarch64":
+		case "aarch64", "riscv64":
 			qemuArgs = append(qemuArgs, "-machine", "virt")
 		default:
-			qemuArgs = append(qemuArgs, "-machine", "q35")
+			qemuArgs = append(qemuArgs, "-machine", "q35"+smm)
 		}
 	}
 
 	// rng-random does not work on macOS
 	// Temporarily disable it until fixed upstream.
-	if runtime.GOOS != "darwin" {
+	// There is no /dev/random on Windows.
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
 		rng := "rng-random,id=rng0"
 		if runtime.GOOS == "linux" {
 			rng = rng + ",filename=/dev/urandom"
@@ -481,11 +1162,15 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		if i >= 2 && config.ISOBoot {
 			index++
 		}
+		drive := "file=" + d.Path
 		if d.Format != "" {
-			qemuArgs = append(qemuArgs, "-drive", "file="+d.Path+",format="+d.Format+",index="+strconv.Itoa(index)+",media=disk")
-		} else {
-			qemuArgs = append(qemuArgs, "-drive", "file="+d.Path+",index="+strconv.Itoa(index)+",media=disk")
+			drive += ",format=" + d.Format
+		}
+		drive += ",index=" + strconv.Itoa(index) + ",media=disk"
+		if d.Snapshot {
+			drive += ",snapshot=on"
 		}
+		qemuArgs = append(qemuArgs, "-drive", drive)
 		lastDisk = index
 	}
 
@@ -500,11 +1185,17 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	for i, p := range config.ISOImages {
 		if i == 0 {
 			// This is hdc/CDROM which is skipped by the disk loop above
-			if runtime.GOARCH == "s390x" {
+			switch {
+			case config.Arch == "s390x":
 				qemuArgs = append(qemuArgs, "-device", "virtio-scsi-ccw")
 				qemuArgs = append(qemuArgs, "-device", "scsi-cd,drive=cd1")
 				qemuArgs = append(qemuArgs, "-drive", "file="+p+",format=raw,if=none,id=cd1")
-			} else {
+			case config.Arch == "riscv64":
+				// the riscv64 virt machine has no IDE controller
+				qemuArgs = append(qemuArgs, "-device", "virtio-scsi-pci")
+				qemuArgs = append(qemuArgs, "-device", "scsi-cd,drive=cd1")
+				qemuArgs = append(qemuArgs, "-drive", "file="+p+",format=raw,if=none,id=cd1")
+			default:
 				qemuArgs = append(qemuArgs, "-cdrom", p)
 			}
 		} else {
@@ -514,11 +1205,18 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	}
 
 	if config.UEFI {
-		qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,file="+config.FWPath)
+		if config.SecureBoot || config.Arch == "riscv64" {
+			qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,unit=0,readonly=on,file="+config.FWPath)
+			qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,unit=1,file="+config.FWVarsPath)
+		} else {
+			qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,file="+config.FWPath)
+		}
 	}
 
 	// build kernel boot config from kernel/initrd/cmdline
 	switch {
+	case config.Kernel && config.Netboot:
+		// the firmware loads the kernel+initrd served by setupQemuNetboot
 	case config.Kernel:
 		qemuKernelPath := config.Path + "-kernel"
 		qemuInitrdPath := config.Path + "-initrd.img"
@@ -528,7 +1226,7 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		if err != nil {
 			log.Errorf("Cannot open cmdline file: %v", err)
 		} else {
-			qemuArgs = append(qemuArgs, "-append", string(cmdlineBytes))
+			qemuArgs = append(qemuArgs, "-append", qemuKernelCmdline(config, string(cmdlineBytes)))
 		}
 	case config.SquashFS:
 		qemuKernelPath := config.Path + "-kernel"
@@ -538,30 +1236,76 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 			log.Errorf("Cannot open cmdline file: %v", err)
 		} else {
 			cmdline := string(cmdlineBytes)
-			cmdline += " root=/dev/sda"
-			qemuArgs = append(qemuArgs, "-append", cmdline)
+			// the disks of s390x are virtio-blk devices
+			if config.Arch == "s390x" {
+				cmdline += " root=/dev/vda"
+			} else {
+				cmdline += " root=/dev/sda"
+			}
+			qemuArgs = append(qemuArgs, "-append", qemuKernelCmdline(config, cmdline))
 		}
 	}
 
-	if config.NetdevConfig == "" {
+	if len(config.Netdevs) == 0 {
 		qemuArgs = append(qemuArgs, "-net", "none")
-	} else {
-		mac := retrieveMAC(config.StatePath)
+	}
+	published := false
+	for i, n := range config.Netdevs {
+		id := fmt.Sprintf("t%d", i)
+		mac := n.MAC
+		if mac == "" {
+			mac = retrieveNICMAC(config.StatePath, i).String()
+		}
 		if config.Arch == "s390x" {
-			qemuArgs = append(qemuArgs, "-device", "virtio-net-ccw,netdev=t0,mac="+mac.String())
+			device := "virtio-net-ccw,netdev=" + id + ",mac=" + mac
+			if i == 0 && config.Netboot {
+				device += ",bootindex=1"
+			}
+			qemuArgs = append(qemuArgs, "-device", device)
 		} else {
-			qemuArgs = append(qemuArgs, "-device", "virtio-net-pci,netdev=t0,mac="+mac.String())
+			qemuArgs = append(qemuArgs, "-device", "virtio-net-pci,netdev="+id+",mac="+mac)
 		}
-		forwardings, err := buildQemuForwardings(config.PublishedPorts)
-		if err != nil {
-			log.Error(err)
+		netdev := strings.Replace(n.Config, ",", ",id="+id+",", 1)
+		if !strings.Contains(n.Config, ",") {
+			netdev = n.Config + ",id=" + id
 		}
-		qemuArgs = append(qemuArgs, "-netdev", config.NetdevConfig+forwardings)
+		if i == 0 && config.Netboot {
+			netdev += ",tftp=" + qemuNetbootPath(config) + ",bootfile=" + qemuNetbootConfig
+		}
+		if i == 0 && config.MetadataEmu != "" {
+			emulator, err := qemuMetadataEmulatorNetdev(config.MetadataEmu)
+			if err != nil {
+				log.Fatal(err)
+			}
+			netdev += emulator
+		}
+		// ports are published on the first user mode interface
+		if !published && strings.HasPrefix(n.Config, qemuNetworkingUser) {
+			forwardings, err := buildQemuForwardings(config.PublishedPorts)
+			if err != nil {
+				log.Error(err)
+			}
+			netdev += forwardings
+			published = true
+		}
+		qemuArgs = append(qemuArgs, "-netdev", netdev)
 	}
 
-	if config.GUI != true {
+	switch {
+	case config.Detached && config.GUI != true:
+		// the console is served on a socket for 'linuxkit attach' and
+		// logged, so its output is kept while nothing is attached
+		os.Remove(filepath.Join(config.StatePath, consoleSocket))
+		os.Remove(filepath.Join(config.StatePath, consoleLogFile))
+		qemuArgs = append(qemuArgs, "-display", "none", "-monitor", "none")
+		qemuArgs = append(qemuArgs, "-chardev", fmt.Sprintf("socket,id=console,path=%s,server=on,wait=off,logfile=%s", filepath.Join(config.StatePath, consoleSocket), filepath.Join(config.StatePath, consoleLogFile)))
+		qemuArgs = append(qemuArgs, "-serial", "chardev:console")
+	case config.GUI != true:
 		qemuArgs = append(qemuArgs, "-nographic")
 	}
+	if config.Detached {
+		qemuArgs = append(qemuArgs, "-daemonize")
+	}
 
 	if config.USB == true {
 		qemuArgs = append(qemuArgs, "-usb")
@@ -570,59 +1314,350 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		qemuArgs = append(qemuArgs, "-device", d)
 	}
 
+	if config.TPM {
+		var tpmDevice string
+		switch config.Arch {
+		case "x86_64":
+			tpmDevice = "tpm-tis"
+		case "aarch64":
+			tpmDevice = "tpm-tis-device"
+		default:
+			log.Fatalf("TPM emulation is not supported on %s", config.Arch)
+		}
+		qemuArgs = append(qemuArgs, "-chardev", "socket,id=chrtpm,path="+filepath.Join(config.StatePath, "swtpm.sock"))
+		qemuArgs = append(qemuArgs, "-tpmdev", "emulator,id=tpm0,chardev=chrtpm")
+		qemuArgs = append(qemuArgs, "-device", tpmDevice+",tpmdev=tpm0")
+	}
+
+	if config.VsockCID != 0 {
+		vsockDevice := "vhost-vsock-pci"
+		if config.Arch == "s390x" {
+			vsockDevice = "vhost-vsock-ccw"
+		}
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("%s,id=vsock0,guest-cid=%d", vsockDevice, config.VsockCID))
+	}
+
+	if config.DataChannel != "" {
+		serialDevice := "virtio-serial-pci"
+		if config.Arch == "s390x" {
+			serialDevice = "virtio-serial-ccw"
+		}
+		qemuArgs = append(qemuArgs, "-device", serialDevice+",id=metadata0")
+		qemuArgs = append(qemuArgs, "-chardev", fmt.Sprintf("file,id=metadata,path=%s.out,input-path=%s", config.DataChannel, config.DataChannel))
+		qemuArgs = append(qemuArgs, "-device", "virtserialport,bus=metadata0.0,chardev=metadata,name=org.linuxkit.metadata")
+	}
+
+	if config.Agent {
+		serialDevice := "virtio-serial-pci"
+		if config.Arch == "s390x" {
+			serialDevice = "virtio-serial-ccw"
+		}
+		os.Remove(filepath.Join(config.StatePath, agentSocket))
+		qemuArgs = append(qemuArgs, "-device", serialDevice+",id=agent0")
+		qemuArgs = append(qemuArgs, "-chardev", fmt.Sprintf("socket,id=agent,path=%s,server=on,wait=off", filepath.Join(config.StatePath, agentSocket)))
+		qemuArgs = append(qemuArgs, "-device", "virtserialport,bus=agent0.0,chardev=agent,name=org.linuxkit.agent")
+	}
+
+	for i, share := range config.Shares9P {
+		fsdev := fmt.Sprintf("local,id=fsdev%d,path=%s,security_model=%s", i, share.Path, share.SecurityModel)
+		if share.ReadOnly {
+			fsdev += ",readonly=on"
+		}
+		device := "virtio-9p-pci"
+		if config.Arch == "s390x" {
+			device = "virtio-9p-ccw"
+		}
+		qemuArgs = append(qemuArgs, "-fsdev", fsdev)
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("%s,fsdev=fsdev%d,mount_tag=%s", device, i, share.Tag))
+	}
+
+	if len(config.Mounts) > 0 {
+		// vhost-user devices need the guest memory to be shared
+		qemuArgs = append(qemuArgs, "-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%sM,share=on", config.Memory))
+		qemuArgs = append(qemuArgs, "-numa", "node,memdev=mem")
+		fsDevice := "vhost-user-fs-pci"
+		if config.Arch == "s390x" {
+			fsDevice = "vhost-user-fs-ccw"
+		}
+		for i, m := range config.Mounts {
+			qemuArgs = append(qemuArgs, "-chardev", fmt.Sprintf("socket,id=fs%d,path=%s", i, qemuVirtiofsSocket(config, i)))
+			qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("%s,chardev=fs%d,tag=%s", fsDevice, i, m.Tag))
+		}
+	}
+
 	return config, qemuArgs
 }
 
-func discoverBinaries(config QemuConfig) (QemuConfig, error) {
-	if config.QemuImgPath != "" {
-		return config, nil
+// qemuKernelCmdline returns the command line of a kernel booted directly,
+// adding the console of the machine if the image does not set it
+func qemuKernelCmdline(config QemuConfig, cmdline string) string {
+	// the console of s390x is the SCLP, not a serial port
+	if config.Arch == "s390x" && !strings.Contains(cmdline, "console=ttysclp") {
+		cmdline = strings.TrimSpace(cmdline) + " console=ttysclp0"
+	}
+	return cmdline
+}
+
+// qemuMetadataEmulatorNetwork is the network of the user mode networking of
+// a VM with -metadata-emulator. Connections are only forwarded to addresses
+// in the network, so it contains the address of the metadata service, and
+// qemuMetadataEmulatorGuest is the address its DHCP server hands out first.
+const (
+	qemuMetadataEmulatorNetwork = "169.254.0.0/16"
+	qemuMetadataEmulatorGuest   = "169.254.0.15"
+)
+
+// qemuMetadataEmulatorNetdev returns the options of the user mode networking
+// which run 'linuxkit metadata emulate' for each connection of the guest to
+// the metadata service on port 80
+func qemuMetadataEmulatorNetdev(config string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("Cannot find the linuxkit executable for the metadata emulator: %v", err)
 	}
+	cmd := fmt.Sprintf("%s metadata emulate %s", shellQuote(exe), shellQuote(config))
+	// commas in the options of -netdev are escaped by doubling them
+	return fmt.Sprintf(",net=%s,guestfwd=tcp:%s:80-cmd:%s", qemuMetadataEmulatorNetwork, metadataEmulatorAddress, strings.Replace(cmd, ",", ",,", -1)), nil
+}
+
+// qemuNetbootConfig is the pxelinux config the firmware boots from
+const qemuNetbootConfig = "pxelinux.cfg/default"
 
+// qemuNetbootPath is the directory served over TFTP with -netboot
+func qemuNetbootPath(config QemuConfig) string {
+	return filepath.Join(config.StatePath, "tftp")
+}
+
+// setupQemuNetboot populates the directory served over TFTP with the
+// kernel+initrd and a pxelinux config booting them, which the s390x network
+// boot firmware loads
+func setupQemuNetboot(config QemuConfig) error {
+	dir := qemuNetbootPath(config)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(qemuNetbootConfig)), 0755); err != nil {
+		return err
+	}
+	for src, dst := range map[string]string{"-kernel": "kernel", "-initrd.img": "initrd.img"} {
+		b, err := ioutil.ReadFile(config.Path + src)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, dst), b, 0644); err != nil {
+			return err
+		}
+	}
+	cmdline, err := ioutil.ReadFile(config.Path + "-cmdline")
+	if err != nil {
+		return err
+	}
+	cfg := fmt.Sprintf("default linuxkit\nlabel linuxkit\n  kernel kernel\n  initrd initrd.img\n  append %s\n", qemuKernelCmdline(config, strings.TrimSpace(string(cmdline))))
+	return ioutil.WriteFile(filepath.Join(dir, qemuNetbootConfig), []byte(cfg), 0644)
+}
+
+// createQemuDisk creates the disk natively if the format is supported, and
+// falls back to qemu-img for any other format qemu knows about
+func createQemuDisk(d DiskConfig) error {
+	if diskimage.Supported(d.Format) {
+		return diskimage.Create(d.Path, d.Format, int64(d.Size)*1024*1024)
+	}
+	qemuImgPath, err := qemuLookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("Unable to find qemu-img within the $PATH to create a %s disk", d.Format)
+	}
+	qemuImgCmd := exec.Command(qemuImgPath, "create", "-f", d.Format, d.Path, fmt.Sprintf("%dM", d.Size))
+	log.Debugf("%v\n", qemuImgCmd.Args)
+	return qemuImgCmd.Run()
+}
+
+// qemuLookPath finds a qemu binary in the $PATH, or where the qemu installer
+// puts it on Windows, which does not add it to the $PATH
+func qemuLookPath(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil && runtime.GOOS == "windows" {
+		return exec.LookPath(filepath.Join(os.Getenv("ProgramFiles"), "qemu", name+".exe"))
+	}
+	return path, err
+}
+
+func discoverBinaries(config QemuConfig) (QemuConfig, error) {
 	qemuBinPath := "qemu-system-" + config.Arch
-	qemuImgPath := "qemu-img"
 
 	var err error
-	config.QemuBinPath, err = exec.LookPath(qemuBinPath)
+	config.QemuBinPath, err = qemuLookPath(qemuBinPath)
 	if err != nil {
 		return config, fmt.Errorf("Unable to find %s within the $PATH", qemuBinPath)
 	}
 
-	config.QemuImgPath, err = exec.LookPath(qemuImgPath)
-	if err != nil {
-		return config, fmt.Errorf("Unable to find %s within the $PATH", qemuImgPath)
+	if config.TPM {
+		if config.SwtpmPath, err = exec.LookPath(config.SwtpmPath); err != nil {
+			return config, fmt.Errorf("Unable to find swtpm within the $PATH")
+		}
+	}
+
+	if config.VsockCID != 0 {
+		if runtime.GOOS != "linux" {
+			return config, fmt.Errorf("vsock is only supported on Linux")
+		}
+		if _, err := os.Stat("/dev/vhost-vsock"); err != nil {
+			return config, fmt.Errorf("Cannot find /dev/vhost-vsock, load the vhost_vsock kernel module")
+		}
+	}
+
+	if len(config.Mounts) > 0 && config.VirtiofsdPath == "" {
+		if runtime.GOOS != "linux" {
+			return config, fmt.Errorf("Sharing directories with virtio-fs is only supported on Linux")
+		}
+		// distributions often install virtiofsd outside of the $PATH
+		for _, p := range []string{"virtiofsd", "/usr/libexec/virtiofsd", "/usr/lib/qemu/virtiofsd"} {
+			if config.VirtiofsdPath, err = exec.LookPath(p); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return config, fmt.Errorf("Unable to find virtiofsd within the $PATH")
+		}
 	}
 
 	return config, nil
 }
 
+// parseQemu9PShare parses a -9p flag
+func parseQemu9PShare(f string) (Qemu9PShare, error) {
+	opts := strings.Split(f, ",")
+	c := strings.SplitN(opts[0], ":", 2)
+	if len(c) != 2 || c[0] == "" || c[1] == "" {
+		return Qemu9PShare{}, fmt.Errorf("9p share must be host:guest: %s", f)
+	}
+	host, err := filepath.Abs(c[0])
+	if err != nil {
+		return Qemu9PShare{}, fmt.Errorf("Cannot share %s: %v", c[0], err)
+	}
+	if fi, err := os.Stat(host); err != nil || !fi.IsDir() {
+		return Qemu9PShare{}, fmt.Errorf("Cannot share %s: not a directory", c[0])
+	}
+	share := Qemu9PShare{Tag: c[1], Path: host, SecurityModel: "none"}
+	for _, o := range opts[1:] {
+		switch {
+		case o == "readonly":
+			share.ReadOnly = true
+		case strings.HasPrefix(o, "security="):
+			share.SecurityModel = strings.TrimPrefix(o, "security=")
+			switch share.SecurityModel {
+			case "none", "mapped-xattr", "mapped-file", "passthrough":
+			default:
+				return Qemu9PShare{}, fmt.Errorf("Invalid 9p security model: %s", share.SecurityModel)
+			}
+		default:
+			return Qemu9PShare{}, fmt.Errorf("Unknown 9p share option: %s", o)
+		}
+	}
+	return share, nil
+}
+
+// parseQemuNetworking parses the -networking flags into the network
+// interfaces of the VM
+func parseQemuNetworking(networking []string, publish bool) ([]QemuNetdev, error) {
+	if len(networking) == 0 {
+		networking = []string{qemuNetworkingDefault}
+	}
+	var netdevs []QemuNetdev
+	haveUser := false
+	for _, n := range networking {
+		if n == "" || n == "default" {
+			n = qemuNetworkingDefault
+		}
+		var netdev QemuNetdev
+		var opts []string
+		for _, o := range strings.Split(n, ",") {
+			if strings.HasPrefix(o, "mac=") {
+				mac, err := net.ParseMAC(strings.TrimPrefix(o, "mac="))
+				if err != nil {
+					return nil, fmt.Errorf("Invalid MAC address in %q: %v", n, err)
+				}
+				netdev.MAC = mac.String()
+				continue
+			}
+			opts = append(opts, o)
+		}
+		switch opts[0] {
+		case qemuNetworkingUser:
+			netdev.Config = strings.Join(opts, ",")
+			haveUser = true
+		case qemuNetworkingTap:
+			if len(opts) != 2 {
+				return nil, fmt.Errorf("Not enough arguments for %q networking mode", qemuNetworkingTap)
+			}
+			netdev.Config = fmt.Sprintf("tap,ifname=%s,script=no,downscript=no", opts[1])
+		case qemuNetworkingBridge:
+			if len(opts) != 2 {
+				return nil, fmt.Errorf("Not enough arguments for %q networking mode", qemuNetworkingBridge)
+			}
+			netdev.Config = fmt.Sprintf("bridge,br=%s", opts[1])
+		case qemuNetworkingSocket:
+			if len(opts) < 2 {
+				return nil, fmt.Errorf("Not enough arguments for %q networking mode", qemuNetworkingSocket)
+			}
+			netdev.Config = strings.Join(opts, ",")
+		case qemuNetworkingNetdev:
+			if len(opts) < 2 {
+				return nil, fmt.Errorf("Not enough arguments for %q networking mode", qemuNetworkingNetdev)
+			}
+			netdev.Config = strings.Join(opts[1:], ",")
+		case qemuNetworkingNone:
+			if len(networking) != 1 {
+				return nil, fmt.Errorf("%q networking mode cannot be combined with other modes", qemuNetworkingNone)
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("Invalid networking mode: %s", opts[0])
+		}
+		netdevs = append(netdevs, netdev)
+	}
+	if publish && !haveUser {
+		return nil, fmt.Errorf("Port publishing requires %q networking mode", qemuNetworkingUser)
+	}
+	return netdevs, nil
+}
+
 func buildQemuForwardings(publishFlags multipleFlag) (string, error) {
 	if len(publishFlags) == 0 {
 		return "", nil
 	}
 	var forwardings string
 	for _, publish := range publishFlags {
-		p, err := NewPublishedPort(publish)
+		ports, err := NewPublishedPorts(publish)
 		if err != nil {
 			return "", err
 		}
-
-		hostPort := p.Host
-		guestPort := p.Guest
-
-		forwardings = fmt.Sprintf("%s,hostfwd=%s::%d-:%d", forwardings, p.Protocol, hostPort, guestPort)
+		for _, p := range ports {
+			forwardings = fmt.Sprintf("%s,hostfwd=%s", forwardings, qemuHostfwd(p))
+		}
 	}
 
 	return forwardings, nil
 }
 
+// qemuHostfwd returns the hostfwd rule for a published port
+func qemuHostfwd(p PublishedPort) string {
+	return fmt.Sprintf("%s:%s:%d-:%d", p.Protocol, p.HostIP, p.Host, p.Guest)
+}
+
 func buildDockerForwardings(publishedPorts []string) ([]string, error) {
 	pmap := []string{}
 	for _, port := range publishedPorts {
-		s, err := NewPublishedPort(port)
+		ports, err := NewPublishedPorts(port)
 		if err != nil {
 			return nil, err
 		}
-		pmap = append(pmap, "-p", fmt.Sprintf("%d:%d/%s", s.Host, s.Guest, s.Protocol))
+		for _, s := range ports {
+			if s.HostIP != "" {
+				pmap = append(pmap, "-p", fmt.Sprintf("%s:%d:%d/%s", s.HostIP, s.Host, s.Guest, s.Protocol))
+			} else {
+				pmap = append(pmap, "-p", fmt.Sprintf("%d:%d/%s", s.Host, s.Guest, s.Protocol))
+			}
+		}
 	}
 	return pmap, nil
 }
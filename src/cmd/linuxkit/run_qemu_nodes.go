@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// qemuNodesSubnet is the default subnet the addresses of the nodes are
+	// taken from
+	qemuNodesSubnet = "192.168.76.0/24"
+	// qemuNodesMcast is the multicast group of the default node network
+	qemuNodesMcast = "230.0.0.1"
+)
+
+// qemuNodeName is the hostname of a node, and the name of its state
+// directory
+func qemuNodeName(i int) string {
+	return fmt.Sprintf("node%d", i)
+}
+
+// qemuNodesNetwork returns the default network of the nodes, a socket
+// multicast group with a port derived from the state directory, so that
+// clusters started from different state directories are kept apart
+func qemuNodesNetwork(statePath string) string {
+	abs, err := filepath.Abs(statePath)
+	if err != nil {
+		abs = statePath
+	}
+	h := fnv.New32a()
+	h.Write([]byte(abs))
+	return fmt.Sprintf("%s,mcast=%s:%d", qemuNetworkingSocket, qemuNodesMcast, 20000+h.Sum32()%40000)
+}
+
+// qemuNodeAddresses returns the address of each node in the subnet
+func qemuNodeAddresses(subnet string, n int) ([]net.IP, *net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("Invalid subnet %s, must be an IPv4 CIDR", subnet)
+	}
+	ones, bits := ipnet.Mask.Size()
+	// the network and broadcast addresses are not used
+	if size := 1 << uint(bits-ones); n > size-2 {
+		return nil, nil, fmt.Errorf("Subnet %s is too small for %d nodes", subnet, n)
+	}
+	var addrs []net.IP
+	for i := 0; i < n; i++ {
+		ip := make(net.IP, 4)
+		copy(ip, ipnet.IP.To4())
+		carry := i + 1
+		for b := 3; b >= 0 && carry > 0; b-- {
+			sum := int(ip[b]) + carry
+			ip[b] = byte(sum)
+			carry = sum >> 8
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs, ipnet, nil
+}
+
+// qemuNodePorts offsets the host ports published by a node by the number
+// of ports published for each of the nodes before it
+func qemuNodePorts(publishFlags []string, i int) ([]string, error) {
+	var published []string
+	for _, publish := range publishFlags {
+		ports, err := NewPublishedPorts(publish)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ports {
+			host := int(p.Host) + i*len(ports)
+			if host > 65535 {
+				return nil, fmt.Errorf("Cannot publish %s for %d nodes, host port %d is out of range", publish, i+1, host)
+			}
+			port := fmt.Sprintf("%d:%d/%s", host, p.Guest, p.Protocol)
+			if p.HostIP != "" {
+				port = p.HostIP + ":" + port
+			}
+			published = append(published, port)
+		}
+	}
+	return published, nil
+}
+
+// qemuNodeMetadata adds the cluster configuration of a node to the user
+// data, which must be a JSON object if it is given. A hostname in the user
+// data is kept.
+func qemuNodeMetadata(data []byte, i int, addrs []net.IP, ipnet *net.IPNet, mac string) ([]byte, error) {
+	userdata := map[string]interface{}{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &userdata); err != nil {
+			return nil, fmt.Errorf("The metadata must be a JSON object to add the configuration of the nodes to it: %v", err)
+		}
+	}
+	file := func(content string) map[string]string {
+		return map[string]string{"content": content}
+	}
+	ones, _ := ipnet.Mask.Size()
+	var peers, hosts strings.Builder
+	for j, addr := range addrs {
+		if j != i {
+			fmt.Fprintf(&peers, "%s\n", addr)
+		}
+		fmt.Fprintf(&hosts, "%s %s\n", addr, qemuNodeName(j))
+	}
+	if _, ok := userdata["hostname"]; !ok {
+		userdata["hostname"] = file(qemuNodeName(i))
+	}
+	userdata["cluster"] = map[string]interface{}{
+		"entries": map[string]interface{}{
+			"index":   file(strconv.Itoa(i)),
+			"nodes":   file(strconv.Itoa(len(addrs))),
+			"address": file(fmt.Sprintf("%s/%d", addrs[i], ones)),
+			"mac":     file(mac),
+			"peers":   file(peers.String()),
+			"hosts":   file(hosts.String()),
+		},
+	}
+	return json.Marshal(userdata)
+}
+
+// runQemuNodes boots n detached VMs from the configuration, each with its
+// own state directory in the state directory of the configuration, and
+// connects them with an additional network interface. The address of each
+// node and of its peers is passed in the metadata.
+func runQemuNodes(config QemuConfig, n int, network, subnet string, data []byte, ready *readiness) {
+	if !config.Detached {
+		log.Fatal("-nodes requires -detached")
+	}
+	if config.Info != "" {
+		log.Fatal("-info cannot be used with -nodes, the information about each node is written to info.json in its state directory")
+	}
+	if config.UEFI && !config.SecureBoot {
+		log.Fatal("-uefi can only be used with -nodes together with -secure-boot, so that each node has its own variable store")
+	}
+	bootDisk := !config.Kernel && !config.ISOBoot
+	for i, d := range config.Disks {
+		if (i != 0 || !bootDisk) && filepath.Dir(d.Path) != filepath.Clean(config.StatePath) {
+			log.Fatalf("Disk %s would be shared by the nodes, only disks created in the state directory can be used with -nodes", d.Path)
+		}
+	}
+	addrs, ipnet, err := qemuNodeAddresses(subnet, n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if network == "" {
+		network = qemuNodesNetwork(config.StatePath)
+	}
+	shared, err := parseQemuNetworking([]string{network}, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(shared) != 1 {
+		log.Fatalf("The nodes need a network to be shared, not %q", network)
+	}
+	if shared[0].MAC != "" {
+		log.Fatal("The MAC address of the node network cannot be set, each node needs its own")
+	}
+
+	var started []QemuConfig
+	for i := 0; i < n; i++ {
+		node := config
+		node.StatePath = filepath.Join(config.StatePath, qemuNodeName(i))
+		if err := os.MkdirAll(node.StatePath, 0755); err != nil {
+			log.Fatalf("Could not create state directory: %v", err)
+		}
+		node.UUID = uuid.New()
+		node.Info = filepath.Join(node.StatePath, "info.json")
+		if node.VsockCID != 0 {
+			node.VsockCID += i
+		}
+
+		// the image the nodes boot from is shared, writes to it are discarded
+		node.Disks = nil
+		for j, d := range config.Disks {
+			if j == 0 && bootDisk {
+				d.Snapshot = true
+			} else {
+				d.Path = filepath.Join(node.StatePath, filepath.Base(d.Path))
+			}
+			node.Disks = append(node.Disks, d)
+		}
+
+		netdev := shared[0]
+		netdev.MAC = retrieveNICMAC(node.StatePath, len(config.Netdevs)).String()
+		node.Netdevs = append(append([]QemuNetdev{}, config.Netdevs...), netdev)
+
+		if node.PublishedPorts, err = qemuNodePorts(config.PublishedPorts, i); err != nil {
+			log.Fatal(err)
+		}
+
+		metadata, err := qemuNodeMetadata(data, i, addrs, ipnet, netdev.MAC)
+		if err != nil {
+			log.Fatal(err)
+		}
+		isoPath := filepath.Join(node.StatePath, "data.iso")
+		if err := WriteMetadataISO(isoPath, metadata); err != nil {
+			log.Fatalf("Cannot write user data ISO: %v", err)
+		}
+		node.ISOImages = append(append([]string{}, config.ISOImages...), isoPath)
+
+		log.Infof("Starting %s with address %s", qemuNodeName(i), addrs[i])
+		if err := runQemuLocal(node); err != nil {
+			stopQemuNodes(started)
+			log.Fatalf("Cannot start %s: %v", qemuNodeName(i), err)
+		}
+		started = append(started, node)
+	}
+	for _, node := range started {
+		if err := ready.wait(qemuRunInfo(node)); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// stopQemuNodes kills the detached qemu of each node which was started
+func stopQemuNodes(nodes []QemuConfig) {
+	for _, node := range nodes {
+		b, err := ioutil.ReadFile(filepath.Join(node.StatePath, qemuPidFile))
+		if err != nil {
+			log.Warnf("Cannot stop the VM in %s: %v", node.StatePath, err)
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			continue
+		}
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runQemuPublish handles 'linuxkit run qemu publish' and 'unpublish', which
+// add and remove port forwardings of a running VM using user mode networking
+func runQemuPublish(action string, args []string) {
+	flags := newFlagSet("qemu " + action)
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run qemu %s [options] port path\n\n", invoked, action)
+		fmt.Printf("'port' is in the same format as for -publish,\n")
+		fmt.Printf("[host ip:]host[-end]:guest[-end][/tcp|udp].\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	state := flags.String("state", "", "Path to directory the VM keeps its state in")
+	netdev := flags.String("netdev", "t0", "ID of the user mode interface, t<N> for the interface added by the N'th -networking, starting from 0")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 2 && !(len(remArgs) == 1 && *state != "") {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *state == "" {
+		*state = strings.TrimSuffix(remArgs[1], ".iso") + "-state"
+	}
+
+	ports, err := NewPublishedPorts(remArgs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := newQMPClient(filepath.Join(*state, qemuQMPSocket))
+	if err != nil {
+		log.Fatalf("Cannot connect to qemu: %v", err)
+	}
+	defer c.Close()
+
+	for _, p := range ports {
+		var command string
+		if action == "publish" {
+			command = fmt.Sprintf("hostfwd_add %s %s", *netdev, qemuHostfwd(p))
+		} else {
+			command = fmt.Sprintf("hostfwd_remove %s %s:%s:%d", *netdev, p.Protocol, p.HostIP, p.Host)
+		}
+		res, err := c.execute("human-monitor-command", map[string]string{"command-line": command})
+		if err != nil {
+			log.Fatalf("Unable to %s port %d: %v", action, p.Host, err)
+		}
+		// monitor commands report errors in their output, hostfwd_remove
+		// also reports success
+		var out string
+		if err := json.Unmarshal(res, &out); err != nil {
+			log.Fatalf("Unable to %s port %d: %v", action, p.Host, err)
+		}
+		if out = strings.TrimSpace(out); out != "" && !strings.HasSuffix(out, " removed") {
+			log.Fatalf("Unable to %s port %d: %s", action, p.Host, out)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const qemuQMPSocket = "qmp.sock"
+
+// qemuSnapshotPath is the path of a saved snapshot in the state directory
+func qemuSnapshotPath(statePath, name string) string {
+	return filepath.Join(statePath, "snapshots", name)
+}
+
+// checkQemuSnapshotName checks that the name of a snapshot is a file name in
+// the snapshots directory
+func checkQemuSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// qmpClient is a minimal client for the QEMU Machine Protocol
+type qmpClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func newQMPClient(socket string) (*qmpClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	c := &qmpClient{conn: conn, scanner: bufio.NewScanner(conn)}
+	// the greeting is sent on connect
+	if !c.scanner.Scan() {
+		conn.Close()
+		return nil, fmt.Errorf("no QMP greeting: %v", c.scanner.Err())
+	}
+	if _, err := c.execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// execute runs a QMP command and returns its result
+func (c *qmpClient) execute(command string, arguments interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return nil, err
+	}
+	for c.scanner.Scan() {
+		var resp struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Desc string `json:"desc"`
+			} `json:"error"`
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(c.scanner.Bytes(), &resp); err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.Event != "":
+			log.Debugf("QMP event: %s", resp.Event)
+		case resp.Error != nil:
+			return nil, fmt.Errorf("%s failed: %s", command, resp.Error.Desc)
+		default:
+			return resp.Return, nil
+		}
+	}
+	return nil, fmt.Errorf("%s failed: connection closed: %v", command, c.scanner.Err())
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+// shellQuote quotes s for /bin/sh, which qemu runs exec: migration URIs with
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runQemuSnapshot handles 'linuxkit run qemu snapshot'
+func runQemuSnapshot(args []string) {
+	flags := newFlagSet("qemu snapshot")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run qemu snapshot save [options] name prefix\n", invoked)
+		fmt.Printf("       %s run qemu snapshot ls [options] prefix\n", invoked)
+		fmt.Printf("       %s run qemu snapshot rm [options] name prefix\n\n", invoked)
+		fmt.Printf("'save' saves the state of the running VM 'prefix' as the snapshot 'name'\n")
+		fmt.Printf("in the state directory. Start the VM with the same options and\n")
+		fmt.Printf("'-restore name' to continue from the snapshot.\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	state := flags.String("state", "", "Path to directory the VM keeps its state in")
+	quit := flags.Bool("quit", false, "Stop the VM after saving the snapshot")
+
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	action := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+
+	nArgs := 2
+	if action == "ls" {
+		nArgs = 1
+	}
+	if len(remArgs) != nArgs && !(len(remArgs) == nArgs-1 && *state != "") {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *state == "" {
+		*state = strings.TrimSuffix(remArgs[len(remArgs)-1], ".iso") + "-state"
+	}
+
+	switch action {
+	case "save":
+		name := remArgs[0]
+		if err := qemuSnapshotSave(*state, name, *quit); err != nil {
+			log.Fatalf("Unable to save snapshot %s: %v", name, err)
+		}
+	case "ls":
+		files, err := ioutil.ReadDir(filepath.Join(*state, "snapshots"))
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Unable to list snapshots: %v", err)
+		}
+		for _, f := range files {
+			fmt.Println(f.Name())
+		}
+	case "rm":
+		if err := checkQemuSnapshotName(remArgs[0]); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Remove(qemuSnapshotPath(*state, remArgs[0])); err != nil {
+			log.Fatalf("Unable to remove snapshot: %v", err)
+		}
+	default:
+		fmt.Printf("Unknown snapshot command %s\n\n", action)
+		flags.Usage()
+		os.Exit(1)
+	}
+}
+
+// qemuSnapshotSave pauses the VM and migrates its state to a file
+func qemuSnapshotSave(statePath, name string, quit bool) error {
+	if err := checkQemuSnapshotName(name); err != nil {
+		return err
+	}
+	path := qemuSnapshotPath(statePath, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	c, err := newQMPClient(filepath.Join(statePath, qemuQMPSocket))
+	if err != nil {
+		return fmt.Errorf("cannot connect to qemu: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.execute("stop", nil); err != nil {
+		return err
+	}
+	log.Infof("Saving snapshot to %s", path)
+	if _, err := c.execute("migrate", map[string]string{"uri": "exec:cat > " + shellQuote(path)}); err != nil {
+		return err
+	}
+	for {
+		res, err := c.execute("query-migrate", nil)
+		if err != nil {
+			return err
+		}
+		var status struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		}
+		if err := json.Unmarshal(res, &status); err != nil {
+			return err
+		}
+		if status.Status == "completed" {
+			break
+		}
+		if status.Status == "failed" || status.Status == "cancelled" {
+			return fmt.Errorf("migration %s: %s", status.Status, status.ErrorDesc)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if quit {
+		_, err = c.execute("quit", nil)
+		return err
+	}
+	_, err = c.execute("cont", nil)
+	return err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The options of 'linuxkit run' to write a report of the run
+var (
+	runReportDir    string
+	runReportMarker string
+	runReportFail   string
+	runReportLimit  time.Duration
+)
+
+func runReportFlags(flags *flag.FlagSet) {
+	flags.StringVar(&runReportDir, "report", "", "Write the console log and a report.json of the run to `dir`, for CI")
+	flags.StringVar(&runReportMarker, "report-marker", "", "Console marker of a passing run, default is a clean exit")
+	flags.StringVar(&runReportFail, "report-fail-marker", "", "Console marker of a failing run")
+	flags.DurationVar(&runReportLimit, "report-timeout", 0, "Stop the VM and fail the run after this long, default is no timeout")
+}
+
+// runReport is the report of a run written with -report
+type runReport struct {
+	Backend  string    `json:"backend"`
+	Args     []string  `json:"args"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+	ExitCode int       `json:"exit_code"`
+	// Reason is why the VM stopped: poweroff, reboot, panic, timeout, or
+	// exit if the backend exited without a message from the kernel
+	Reason string `json:"reason"`
+	// Panic is the panic message of the kernel
+	Panic string `json:"panic,omitempty"`
+	// GuestExitStatus is the exit status the guest reported on the console
+	GuestExitStatus *int   `json:"guest_exit_status,omitempty"`
+	Marker          string `json:"marker,omitempty"`
+	Verdict         string `json:"verdict"`
+	Message         string `json:"message,omitempty"`
+	Console         string `json:"console"`
+}
+
+// The messages of the kernel on the console as it stops
+var runStopMessages = []struct {
+	message string
+	reason  string
+}{
+	{"Kernel panic - not syncing", "panic"},
+	{"reboot: Power down", "poweroff"},
+	{"reboot: System halted", "poweroff"},
+	{"System halted", "poweroff"},
+	{"reboot: Restarting system", "reboot"},
+}
+
+// runReportBefore runs the backend sub with args in a new process, if a
+// report is to be written, and writes the report of the run as it exits.
+// The console of the run is copied to the console log of the report.
+func runReportBefore(sub *command, args []string) {
+	if runReportDir == "" {
+		return
+	}
+	if err := os.MkdirAll(runReportDir, 0755); err != nil {
+		log.Fatalf("Unable to create the report directory: %v", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	consolePath := filepath.Join(runReportDir, "console.log")
+	console, err := os.Create(consolePath)
+	if err != nil {
+		log.Fatalf("Unable to create the console log: %v", err)
+	}
+	report := runReport{
+		Backend: sub.name,
+		Args:    args,
+		Marker:  runReportMarker,
+		Console: "console.log",
+		Start:   time.Now().UTC(),
+	}
+
+	// the global flags are passed on, as they may be given before the backend
+	runArgs := append(append(globalArgs(), "run", sub.name), args...)
+	cmd := exec.Command(self, runArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, console)
+	cmd.Stderr = io.MultiWriter(os.Stderr, console)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Unable to run %s: %v", sub.name, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if runReportLimit > 0 {
+		timeout = time.After(runReportLimit)
+	}
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timeout:
+		// the hypervisor the backend started is in its process group
+		killProcessGroup(cmd)
+		err = <-done
+		timedOut = true
+	}
+	report.End = time.Now().UTC()
+	report.Duration = report.End.Sub(report.Start).Seconds()
+	if err != nil {
+		report.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			report.ExitCode = exitErr.ExitCode()
+		}
+	}
+	if err := console.Close(); err != nil {
+		log.Fatalf("Unable to write the console log: %v", err)
+	}
+
+	found, err := scanConsole(consolePath, &report)
+	if err != nil {
+		log.Fatalf("Unable to read the console log: %v", err)
+	}
+	// a panicked kernel hangs until the timeout
+	if timedOut && report.Reason != "panic" {
+		report.Reason = "timeout"
+	}
+	switch {
+	case report.Reason == "timeout":
+		report.Verdict, report.Message = "fail", "timed out after "+runReportLimit.String()
+	case report.Reason == "panic":
+		report.Verdict, report.Message = "fail", "the kernel panicked"
+	case found[runReportFail]:
+		report.Verdict, report.Message = "fail", "the console shows "+runReportFail
+	case runReportMarker != "" && !found[runReportMarker]:
+		report.Verdict, report.Message = "fail", "the console does not show "+runReportMarker
+	case report.GuestExitStatus != nil && *report.GuestExitStatus != 0:
+		report.Verdict, report.Message = "fail", fmt.Sprintf("the guest exited with status %d", *report.GuestExitStatus)
+	case runReportMarker == "" && report.ExitCode != 0:
+		report.Verdict, report.Message = "fail", "the backend exited with an error"
+	default:
+		report.Verdict = "pass"
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	reportPath := filepath.Join(runReportDir, "report.json")
+	if err := ioutil.WriteFile(reportPath, append(b, '\n'), 0644); err != nil {
+		log.Fatalf("Unable to write the report: %v", err)
+	}
+	log.WithFields(log.Fields{"verdict": report.Verdict, "reason": report.Reason}).Infof("Wrote the report of the run to %s", reportPath)
+	if report.Verdict != "pass" {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// scanConsole sets the reason the VM stopped in report from the console
+// log, and returns which of the markers are on the console
+func scanConsole(path string, report *runReport) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	found := map[string]bool{}
+	report.Reason = "exit"
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if status, ok := parseGuestExit([]byte(line)); ok {
+			report.GuestExitStatus = &status
+		}
+		for _, m := range []string{runReportMarker, runReportFail} {
+			if m != "" && strings.Contains(line, m) {
+				found[m] = true
+			}
+		}
+		for _, s := range runStopMessages {
+			i := strings.Index(line, s.message)
+			if i < 0 {
+				continue
+			}
+			// a panic is not overwritten by the reboot after it
+			if report.Reason != "panic" {
+				report.Reason = s.reason
+			}
+			if s.reason == "panic" && report.Panic == "" {
+				report.Panic = strings.TrimSpace(line[i:])
+			}
+			break
+		}
+	}
+	return found, scanner.Err()
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	defaultScalewayInstanceType = "DEV1-S"
-	defaultScalewayZone         = "par1"
+	defaultScalewayZone = "par1"
 
 	scalewayNameVar   = "SCW_IMAGE_NAME" // non-standard
 	accessKeyVar      = "SCW_ACCESS_KEY"
@@ -22,12 +22,13 @@ const (
 	volumeSizeVar     = "SCW_VOLUME_SIZE"  // non-standard
 	scwZoneVar        = "SCW_DEFAULT_ZONE"
 	organizationIDVar = "SCW_DEFAULT_ORGANIZATION_ID"
+	projectIDVar      = "SCW_DEFAULT_PROJECT_ID"
 
 	instanceTypeVar = "SCW_RUN_TYPE" // non-standard
 )
 
 func runScaleway(args []string) {
-	flags := flag.NewFlagSet("scaleway", flag.ExitOnError)
+	flags := newFlagSet("scaleway")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run scaleway [options] [name]\n\n", invoked)
@@ -36,14 +37,22 @@ func runScaleway(args []string) {
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
-	instanceTypeFlag := flags.String("instance-type", defaultScalewayInstanceType, "Scaleway instance type")
+	instanceTypeFlag := flags.String("instance-type", "", "Scaleway instance type (default "+defaultScalewayCommercialType+", or "+defaultScalewayCommercialTypeARM64+" for arm64 images)")
 	instanceNameFlag := flags.String("instance-name", "linuxkit", "Name of the create instance, default to the image name")
 	accessKeyFlag := flags.String("access-key", "", "Access Key to connect to Scaleway API")
 	secretKeyFlag := flags.String("secret-key", "", "Secret Key to connect to Scaleway API")
 	zoneFlag := flags.String("zone", defaultScalewayZone, "Select Scaleway zone")
 	organizationIDFlag := flags.String("organization-id", "", "Select Scaleway's organization ID")
+	projectIDFlag := flags.String("project-id", "", "Select Scaleway's project ID (default the default project of the organization)")
+	ipv6Flag := flags.Bool("ipv6", false, "Attach a routed IPv6 address to the instance")
+	ipv6OnlyFlag := flags.Bool("ipv6-only", false, "Create the instance with an IPv6 address and no public IPv4 address")
+	var volumeFlags multipleFlag
+	flags.Var(&volumeFlags, "volume", "ID of a block storage volume to attach, or size=NG to create a new one of N GB. Can be given multiple times")
 	cleanFlag := flags.Bool("clean", false, "Remove instance")
 	noAttachFlag := flags.Bool("no-attach", false, "Don't attach to serial port, you will have to connect to instance manually")
+	tags := tagFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -57,19 +66,46 @@ func runScaleway(args []string) {
 	}
 	name := remArgs[0]
 
-	instanceType := getStringValue(instanceTypeVar, *instanceTypeFlag, defaultScalewayInstanceType)
+	instanceType := getStringValue(instanceTypeVar, *instanceTypeFlag, "")
 	instanceName := getStringValue("", *instanceNameFlag, name)
 	accessKey := getStringValue(accessKeyVar, *accessKeyFlag, "")
 	secretKey := getStringValue(secretKeyVar, *secretKeyFlag, "")
 	zone := getStringValue(scwZoneVar, *zoneFlag, defaultScalewayZone)
 	organizationID := getStringValue(organizationIDVar, *organizationIDFlag, "")
+	projectID := getStringValue(projectIDVar, *projectIDFlag, "")
 
-	client, err := NewScalewayClient(accessKey, secretKey, zone, organizationID)
+	client, err := NewScalewayClient(accessKey, secretKey, zone, organizationID, projectID)
 	if err != nil {
 		log.Fatalf("Unable to connect to Scaleway: %v", err)
 	}
 
-	instanceID, err := client.CreateLinuxkitInstance(instanceName, name, instanceType)
+	var volumes, createdVolumes []string
+	for i, v := range volumeFlags {
+		if !strings.HasPrefix(v, "size=") {
+			volumes = append(volumes, v)
+			continue
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(v, "size="), "G"))
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid volume size %q, expected size=NG", v)
+		}
+		volumeID, err := client.CreateBlockVolume(fmt.Sprintf("%s-%d", instanceName, i), size, tags.Strings())
+		if err != nil {
+			log.Fatalf("Unable to create block volume: %v", err)
+		}
+		volumes = append(volumes, volumeID)
+		createdVolumes = append(createdVolumes, volumeID)
+	}
+
+	instanceID, err := client.CreateLinuxkitInstance(ScalewayInstanceConfig{
+		Name:         instanceName,
+		ImageName:    name,
+		InstanceType: instanceType,
+		IPv6:         *ipv6Flag,
+		IPv6Only:     *ipv6OnlyFlag,
+		Volumes:      volumes,
+		Tags:         tags.Strings(),
+	})
 	if err != nil {
 		log.Fatalf("Unable to create Scaleway instance: %v", err)
 	}
@@ -78,6 +114,16 @@ func runScaleway(args []string) {
 	if err != nil {
 		log.Fatalf("Unable to boot Scaleway instance: %v", err)
 	}
+	runInfo := RunInfo{Backend: "scaleway", ID: instanceID, Name: instanceName}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if !*cleanFlag {
+		keepResources()
+	}
 
 	if !*noAttachFlag {
 		err = client.ConnectSerialPort(instanceID)
@@ -87,6 +133,7 @@ func runScaleway(args []string) {
 	}
 
 	if *cleanFlag {
+		keepResources()
 		err = client.TerminateInstance(instanceID)
 		if err != nil {
 			log.Fatalf("Unable to stop instance: %v", err)
@@ -96,6 +143,12 @@ func runScaleway(args []string) {
 		if err != nil {
 			log.Fatalf("Unable to delete instance: %v", err)
 		}
+
+		for _, volumeID := range createdVolumes {
+			if err := client.DeleteBlockVolume(volumeID); err != nil {
+				log.Fatalf("Unable to delete block volume %s: %v", volumeID, err)
+			}
+		}
 	}
 
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -54,9 +53,57 @@ func (l *VBNetworks) Set(value string) error {
 	return nil
 }
 
+// VBSharedFolder is the config for a Virtual Box shared folder
+type VBSharedFolder struct {
+	Path     string
+	Name     string
+	ReadOnly bool
+}
+
+// VBSharedFolders is the type for a list of VBSharedFolder
+type VBSharedFolders []VBSharedFolder
+
+func (l *VBSharedFolders) String() string {
+	return fmt.Sprint(*l)
+}
+
+// Set is used by flag to configure value from CLI
+func (l *VBSharedFolders) Set(value string) error {
+	d := VBSharedFolder{}
+	s := strings.Split(value, ",")
+	for _, p := range s {
+		c := strings.SplitN(p, "=", 2)
+		switch len(c) {
+		case 1:
+			if c[0] == "readonly" {
+				d.ReadOnly = true
+			} else {
+				d.Path = c[0]
+			}
+		case 2:
+			switch c[0] {
+			case "path":
+				d.Path = c[1]
+			case "name":
+				d.Name = c[1]
+			default:
+				return fmt.Errorf("Unknown shared folder config: %s", c[0])
+			}
+		}
+	}
+	if d.Path == "" {
+		return fmt.Errorf("No path given for shared folder")
+	}
+	if d.Name == "" {
+		d.Name = filepath.Base(d.Path)
+	}
+	*l = append(*l, d)
+	return nil
+}
+
 func runVbox(args []string) {
 	invoked := filepath.Base(os.Args[0])
-	flags := flag.NewFlagSet("vbox", flag.ExitOnError)
+	flags := newFlagSet("vbox")
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run vbox [options] path\n\n", invoked)
 		fmt.Printf("'path' specifies the path to the VM image.\n")
@@ -72,6 +119,8 @@ func runVbox(args []string) {
 	// vbox options
 	vboxmanageFlag := flags.String("vboxmanage", "VBoxManage", "VBoxManage binary to use")
 	keep := flags.Bool("keep", false, "Keep the VM after finishing")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
 	vmName := flags.String("name", "", "Name of the Virtualbox VM")
 	state := flags.String("state", "", "Path to directory to keep VM state in")
 
@@ -90,6 +139,14 @@ func runVbox(args []string) {
 	// networking
 	var networks VBNetworks
 	flags.Var(&networks, "networking", "Network config, may be repeated. [type=](null|nat|bridged|intnet|hostonly|generic|natnetwork[<devicename>])[,[bridge|host]adapter=<interface>]")
+	publishFlags := multipleFlag{}
+	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host through the first nat adapter, [host ip:]host[-end]:guest[-end][/tcp|udp] (default [])")
+
+	// shared folders
+	var shares VBSharedFolders
+	flags.Var(&shares, "share", "Shared folder config, may be repeated. [path=]path[,name=name][,readonly]. The name defaults to the base name of the path")
+
+	interactive := flags.Bool("interactive", true, "Connect stdin to the serial console. Otherwise the console output is only captured and the VM runs until it powers off")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -267,6 +324,51 @@ func runVbox(args []string) {
 		}
 	}
 
+	if len(publishFlags) != 0 {
+		// the first adapter of a new VM is nat if no networking is configured
+		natNIC := 0
+		if len(networks) == 0 {
+			natNIC = 1
+		}
+		for i, d := range networks {
+			if d.Type == "nat" {
+				natNIC = i + 1
+				break
+			}
+		}
+		if natNIC == 0 {
+			log.Fatal("Publishing ports requires a nat network adapter")
+		}
+		for _, publish := range publishFlags {
+			ports, err := NewPublishedPorts(publish)
+			if err != nil {
+				log.Fatalf("Cannot parse publish %s: %v", publish, err)
+			}
+			for _, p := range ports {
+				rule := fmt.Sprintf("%s%d,%s,%s,%d,,%d", p.Protocol, p.Host, p.Protocol, p.HostIP, p.Host, p.Guest)
+				_, out, err = manage(vboxmanage, "modifyvm", name, fmt.Sprintf("--natpf%d", natNIC), rule)
+				if err != nil {
+					log.Fatalf("modifyvm --natpf error: %v\n%s", err, out)
+				}
+			}
+		}
+	}
+
+	for _, s := range shares {
+		hostPath, err := filepath.Abs(s.Path)
+		if err != nil {
+			log.Fatalf("Bad path: %v", err)
+		}
+		args := []string{"sharedfolder", "add", name, "--name", s.Name, "--hostpath", hostPath, "--automount"}
+		if s.ReadOnly {
+			args = append(args, "--readonly")
+		}
+		_, out, err = manage(vboxmanage, args...)
+		if err != nil {
+			log.Fatalf("sharedfolder error: %v\n%s", err, out)
+		}
+	}
+
 	// create socket
 	_ = os.Remove(consolePath)
 	ln, err := net.Listen("unix", consolePath)
@@ -285,6 +387,9 @@ func runVbox(args []string) {
 	if err != nil {
 		log.Fatalf("startvm error: %v\n%s", err, out)
 	}
+	if err := writeRunInfo(*info, RunInfo{Backend: "vbox", Name: name, StatePath: *state, ConsoleLog: *consoleLog}); err != nil {
+		log.Fatal(err)
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -294,25 +399,33 @@ func runVbox(args []string) {
 		os.Exit(1)
 	}()
 
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	socket, err := ln.Accept()
 	if err != nil {
 		log.Fatalf("Accept error: %v", err)
 	}
 
-	go func() {
-		if _, err := io.Copy(socket, os.Stdin); err != nil {
+	if *interactive {
+		go func() {
+			if _, err := io.Copy(socket, os.Stdin); err != nil {
+				cleanup(vboxmanage, name, *keep)
+				log.Fatalf("Copy error: %v", err)
+			}
 			cleanup(vboxmanage, name, *keep)
-			log.Fatalf("Copy error: %v", err)
-		}
-		cleanup(vboxmanage, name, *keep)
-		os.Exit(0)
-	}()
+			os.Exit(0)
+		}()
+	}
 	go func() {
-		if _, err := io.Copy(os.Stdout, socket); err != nil {
+		if _, err := io.Copy(stdout, socket); err != nil {
 			cleanup(vboxmanage, name, *keep)
 			log.Fatalf("Copy error: %v", err)
 		}
 		cleanup(vboxmanage, name, *keep)
+		exitGuestStatus()
 		os.Exit(0)
 	}()
 	// wait forever
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vfkitNetworkingNone    string = "none"
+	vfkitNetworkingNAT            = "nat"
+	vfkitNetworkingDefault        = vfkitNetworkingNAT
+)
+
+// Process the run arguments and execute run
+func runVfkit(args []string) {
+	flags := newFlagSet("vfkit")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run vfkit [options] prefix\n\n", invoked)
+		fmt.Printf("'prefix' specifies the path to the VM image.\n")
+		fmt.Printf("The VM is run with Apple's Virtualization.framework using vfkit,\n")
+		fmt.Printf("which supports both Intel and Apple Silicon Macs. On arm64 the\n")
+		fmt.Printf("kernel must be an uncompressed Image.\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	vfkitPath := flags.String("vfkit", "vfkit", "Path to the vfkit binary")
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+	var disks Disks
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G]")
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	state := flags.String("state", "", "Path to directory to keep VM state in")
+	vsockports := flags.String("vsock-ports", "", "List of vsock ports to forward from the guest on startup (comma separated). A unix domain socket for each port will be created in the state directory")
+	var shares VirtioFSs
+	flags.Var(&shares, "fs", "Share a host directory with virtio-fs, may be repeated. tag=path")
+	networking := flags.String("networking", vfkitNetworkingDefault, "Networking mode. Valid options are 'default', 'nat' and 'none'. 'nat' uses the NAT network of Virtualization.framework. 'none' disables networking.")
+
+	// Boot type; we try to determine automatically
+	uefiBoot := flags.Bool("uefi", false, "Use UEFI boot, requires macOS 13 or later")
+	isoBoot := flags.Bool("iso", false, "Boot image is an ISO")
+	squashFSBoot := flags.Bool("squashfs", false, "Boot image is a kernel+squashfs+cmdline")
+	kernelBoot := flags.Bool("kernel", false, "Boot image is kernel+initrd+cmdline 'path'-kernel/-initrd/-cmdline")
+
+	consoleToFile := flags.Bool("console-file", false, "Output the console to a file in the state directory")
+	consoleLog := consoleLogFlag(flags)
+	info := runInfoFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify the prefix to the image to boot")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+	prefix := path
+
+	_, err := os.Stat(path + "-kernel")
+	statKernel := err == nil
+
+	var bootDisk string
+	switch {
+	case *squashFSBoot:
+		if *kernelBoot || *isoBoot || *uefiBoot {
+			log.Fatalf("Please specify only one boot method")
+		}
+		if !statKernel {
+			log.Fatalf("Booting a SquashFS root filesystem requires a kernel at %s", path+"-kernel")
+		}
+		if _, err := os.Stat(path + "-squashfs.img"); err != nil {
+			log.Fatalf("Cannot find SquashFS image (%s): %v", path+"-squashfs.img", err)
+		}
+	case *isoBoot || *uefiBoot:
+		if *kernelBoot {
+			log.Fatalf("Please specify only one boot method")
+		}
+		*uefiBoot = true
+		bootDisk = path
+		if *isoBoot && !strings.HasSuffix(bootDisk, ".iso") {
+			bootDisk += ".iso"
+		}
+		if _, err := os.Stat(bootDisk); err != nil {
+			log.Fatalf("Cannot find boot image (%s): %v", bootDisk, err)
+		}
+		prefix = strings.TrimSuffix(bootDisk, filepath.Ext(bootDisk))
+	default:
+		// Default to kernel+initrd
+		if !statKernel {
+			log.Fatalf("Cannot find kernel file: %s", path+"-kernel")
+		}
+		if _, err := os.Stat(path + "-initrd.img"); err != nil {
+			log.Fatalf("Cannot find initrd file (%s): %v", path+"-initrd.img", err)
+		}
+		*kernelBoot = true
+	}
+
+	if *state == "" {
+		*state = prefix + "-state"
+	}
+	if err := os.MkdirAll(*state, 0755); err != nil {
+		log.Fatalf("Could not create state directory: %v", err)
+	}
+
+	vfArgs := []string{"--cpus", strconv.Itoa(*cpus), "--memory", strconv.Itoa(*mem)}
+
+	var cmdline string
+	if *kernelBoot || *squashFSBoot {
+		cmdlineBytes, err := ioutil.ReadFile(prefix + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot open cmdline file: %v", err)
+		}
+		cmdline = strings.TrimSpace(string(cmdlineBytes))
+		// the virtio console is the console
+		if !strings.Contains(cmdline, "console=") {
+			cmdline += " console=hvc0"
+		}
+	}
+
+	var devices []string
+	switch {
+	case *kernelBoot:
+		vfArgs = append(vfArgs, "--bootloader", fmt.Sprintf("linux,kernel=%s,initrd=%s,cmdline=%q", prefix+"-kernel", prefix+"-initrd.img", cmdline))
+	case *squashFSBoot:
+		vfArgs = append(vfArgs, "--bootloader", fmt.Sprintf("linux,kernel=%s,cmdline=%q", prefix+"-kernel", cmdline+" root=/dev/vda"))
+		devices = append(devices, "virtio-blk,path="+prefix+"-squashfs.img")
+	default:
+		// the EFI variables are kept in the state directory
+		vfArgs = append(vfArgs, "--bootloader", "efi,variable-store="+filepath.Join(*state, "efi-variable-store")+",create")
+		devices = append(devices, "virtio-blk,path="+bootDisk)
+	}
+
+	if err := checkHostResources(*cpus, *mem, disks, *state); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, d := range disks {
+		id := ""
+		if i != 0 {
+			id = strconv.Itoa(i)
+		}
+		if d.Format != "" && d.Format != "raw" {
+			log.Fatalf("Virtualization.framework only supports raw disks")
+		}
+		if d.Size != 0 && d.Path == "" {
+			d.Path = filepath.Join(*state, "disk"+id+".raw")
+		}
+		if d.Path == "" {
+			log.Fatalf("disk specified with no size or name")
+		}
+		if _, err := os.Stat(d.Path); err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			log.Debugf("Creating new disk [%s]", d.Path)
+			if err := diskimage.Create(d.Path, "raw", int64(d.Size)*1024*1024); err != nil {
+				log.Fatalf("Error creating disk [%s]: %v", d.Path, err)
+			}
+		}
+		devices = append(devices, "virtio-blk,path="+d.Path)
+	}
+
+	// The metadata is attached as a disk, which the metadata package finds
+	// by its label
+	metadataPaths, err := CreateMetadataISO(*state, *data, *dataPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, p := range metadataPaths {
+		devices = append(devices, "virtio-blk,path="+p)
+	}
+
+	if *networking == "" || *networking == "default" {
+		*networking = vfkitNetworkingDefault
+	}
+	switch *networking {
+	case vfkitNetworkingNAT:
+		devices = append(devices, "virtio-net,nat,mac="+retrieveMAC(*state).String())
+	case vfkitNetworkingNone:
+	default:
+		log.Fatalf("Invalid networking mode: %s", *networking)
+	}
+
+	for _, s := range shares {
+		devices = append(devices, fmt.Sprintf("virtio-fs,sharedDir=%s,mountTag=%s", s.Path, s.Tag))
+	}
+
+	ports, err := stringToIntArray(*vsockports, ",")
+	if err != nil {
+		log.Fatalln("Unable to parse vsock-ports: ", err)
+	}
+	for _, p := range ports {
+		// vfkit listens on the socket and forwards connections to the guest
+		socket := filepath.Join(*state, fmt.Sprintf("vsock-%d.sock", p))
+		devices = append(devices, fmt.Sprintf("virtio-vsock,port=%d,socketURL=%s,listen", p, socket))
+	}
+
+	devices = append(devices, "virtio-rng")
+	if *consoleToFile {
+		devices = append(devices, "virtio-serial,logFilePath="+filepath.Join(*state, "console-ring"))
+	} else {
+		devices = append(devices, "virtio-serial,stdio")
+	}
+
+	for _, d := range devices {
+		vfArgs = append(vfArgs, "--device", d)
+	}
+
+	stdout, err := consoleWriter(os.Stdout, *consoleLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeRunInfo(*info, RunInfo{Backend: "vfkit", StatePath: *state, ConsoleLog: *consoleLog}); err != nil {
+		log.Fatal(err)
+	}
+
+	vfCmd := exec.Command(*vfkitPath, vfArgs...)
+	log.Debugf("%v\n", vfCmd.Args)
+	vfCmd.Stdin = os.Stdin
+	vfCmd.Stdout = stdout
+	vfCmd.Stderr = os.Stderr
+	err = vfCmd.Run()
+	exitGuestStatus()
+	if err != nil {
+		log.Fatalf("vfkit failed: %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -67,7 +66,7 @@ guestOS = "other3xlinux-64"
 
 func runVMware(args []string) {
 	invoked := filepath.Base(os.Args[0])
-	flags := flag.NewFlagSet("vmware", flag.ExitOnError)
+	flags := newFlagSet("vmware")
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s run vmware [options] prefix\n\n", invoked)
 		fmt.Printf("'prefix' specifies the path to the VM image.\n")
@@ -80,6 +79,7 @@ func runVMware(args []string) {
 	var disks Disks
 	flags.Var(&disks, "disk", "Disk config. [file=]path[,size=1G]")
 	state := flags.String("state", "", "Path to directory to keep VM state in")
+	info := runInfoFlag(flags)
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -198,6 +198,9 @@ func runVMware(args []string) {
 	if err != nil {
 		log.Fatalf("Error starting vmrun: %v", err)
 	}
+	if err := writeRunInfo(*info, RunInfo{Backend: "vmware", StatePath: *state}); err != nil {
+		log.Fatal(err)
+	}
 
 	// check there is output to push to logging
 	if len(out) > 0 {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultVultrRegion = "ams"
+	defaultVultrPlan   = "vc2-1c-1gb"
+	// Environment variables. Some are non-standard
+	vultrRegionVar  = "VULTR_REGION"   // non-standard
+	vultrPlanVar    = "VULTR_PLAN"     // non-standard
+	vultrBaseURLVar = "VULTR_BASE_URL" // non-standard
+)
+
+// Process the run arguments and execute run
+func runVultr(args []string) {
+	flags := newFlagSet("vultr")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run vultr [options] path\n\n", invoked)
+		fmt.Printf("'path' is a raw disk image, for example the output of\n")
+		fmt.Printf("'linuxkit build -format raw-bios', or the URL of one. A snapshot is\n")
+		fmt.Printf("created from it, which Vultr downloads from a URL, so a local image\n")
+		fmt.Printf("must be reachable at -base-url, for example by serving it with -serve.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	apiKeyFlag := flags.String("api-key", "", "Vultr API key (or "+vultrAPIKeyVar+")")
+	regionFlag := flags.String("region", defaultVultrRegion, "Region of the instance (or "+vultrRegionVar+")")
+	planFlag := flags.String("plan", defaultVultrPlan, "Plan of the instance (or "+vultrPlanVar+")")
+	labelFlag := flags.String("label", "", "Label and hostname of the instance (default the image name)")
+	baseURLFlag := flags.String("base-url", "", "Base URL that the image is served from (or "+vultrBaseURLVar+")")
+	serveFlag := flags.String("serve", "", "Serve the local image via the http port specified, e.g. ':8080', until the snapshot is created")
+	snapshotFlag := flags.String("snapshot-id", "", "Boot an existing snapshot instead of creating one from 'path'")
+	keepSnapshotFlag := flags.Bool("keep-snapshot", true, "Keep the created snapshot, so that it can be used with -snapshot-id")
+	cleanFlag := flags.Bool("clean", false, "Delete the instance after hitting ctrl-c")
+
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	tags := tagFlag(flags)
+	info := runInfoFlag(flags)
+	ready := readinessFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	remArgs := flags.Args()
+	if len(remArgs) == 0 && *snapshotFlag == "" {
+		fmt.Printf("Please specify the path to the image to boot\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+	if *dataPath != "" {
+		dataB, err := ioutil.ReadFile(*dataPath)
+		if err != nil {
+			log.Fatalf("Unable to read metadata file: %v", err)
+		}
+		*data = string(dataB)
+	}
+	// data must be base64 encoded
+	if *data != "" {
+		*data = base64.StdEncoding.EncodeToString([]byte(*data))
+	}
+
+	apiKey := getStringValue(vultrAPIKeyVar, *apiKeyFlag, "")
+	region := getStringValue(vultrRegionVar, *regionFlag, defaultVultrRegion)
+	plan := getStringValue(vultrPlanVar, *planFlag, defaultVultrPlan)
+	baseURL := getStringValue(vultrBaseURLVar, *baseURLFlag, "")
+
+	client, err := NewVultrClient(apiKey)
+	if err != nil {
+		log.Fatalf("Unable to connect to Vultr: %v", err)
+	}
+
+	snapshot := *snapshotFlag
+	label := *labelFlag
+	if snapshot == "" {
+		path := remArgs[0]
+		name := filepath.Base(path)
+		if label == "" {
+			label = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		imageURL := path
+		if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+			if baseURL == "" {
+				log.Fatalf("Need to specify a value for --base-url where the image is hosted. This URL should contain <url>/%s", name)
+			}
+			imageURL = strings.TrimSuffix(baseURL, "/") + "/" + name
+
+			if *serveFlag != "" {
+				mux := http.NewServeMux()
+				mux.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+					http.ServeFile(w, r, path)
+				})
+				httpServer := &http.Server{Addr: *serveFlag, Handler: logRequest(mux)}
+				go func() {
+					log.Debugf("Listening on http://%s\n", *serveFlag)
+					if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						log.Fatalf("http server exited with: %v", err)
+					}
+				}()
+				defer func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					httpServer.Shutdown(ctx)
+				}()
+			}
+		}
+		log.Infof("Validating URL: %s", imageURL)
+		if err := validateHTTPURL(imageURL); err != nil {
+			log.Fatalf("Invalid image URL %s: %v", imageURL, err)
+		}
+
+		log.Infof("Creating snapshot from %s", imageURL)
+		snapshot, err = client.CreateSnapshotFromURL(imageURL, label)
+		if snapshot != "" && !*keepSnapshotFlag {
+			id := snapshot
+			onCleanup("snapshot "+id, func() error { return client.DeleteSnapshot(id) })
+		}
+		if err != nil {
+			log.Fatalf("Unable to create snapshot: %v", err)
+		}
+		log.Infof("Created snapshot %s", snapshot)
+		if !*keepSnapshotFlag {
+			defer func() {
+				if err := client.DeleteSnapshot(snapshot); err != nil {
+					log.Errorf("Unable to delete snapshot: %v", err)
+				}
+			}()
+		}
+	}
+	if label == "" {
+		label = "linuxkit"
+	}
+
+	log.Infof("Creating %s instance %s in %s", plan, label, region)
+	instance, err := client.CreateInstance(region, plan, snapshot, label, *data, tags.Strings())
+	if err != nil {
+		log.Fatalf("Unable to create instance: %v", err)
+	}
+	log.WithFields(log.Fields{"instance": instance.ID, "ip": instance.MainIP, "console": instance.KVM}).Infof("Instance %s is running", instance.ID)
+	runInfo := RunInfo{Backend: "vultr", ID: instance.ID, Name: label, IPs: []string{instance.MainIP}, Console: instance.KVM}
+	if err := writeRunInfo(*info, runInfo); err != nil {
+		log.Fatal(err)
+	}
+	if err := ready.wait(runInfo); err != nil {
+		log.Fatal(err)
+	}
+	// from here on -clean and -keep-snapshot decide what is deleted
+	keepResources()
+
+	if *cleanFlag {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt)
+		log.Printf("Hit ctrl-c to delete the instance")
+		<-stop
+		if err := client.DeleteInstance(instance.ID); err != nil {
+			log.Fatalf("Unable to delete instance: %v", err)
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// The annotations of the SBOM attestations of images built with buildx
+const (
+	attestationTypeAnnotation      = "vnd.docker.reference.type"
+	attestationDigestAnnotation    = "vnd.docker.reference.digest"
+	attestationPredicateAnnotation = "in-toto.io/predicate-type"
+	attestationManifestType        = "attestation-manifest"
+	spdxPredicateType              = "https://spdx.dev/Document"
+)
+
+// The databases of installed packages, by the package manager which writes them
+var sbomPackageDatabases = map[string]string{
+	"lib/apk/db/installed": "apk",
+	"var/lib/dpkg/status":  "deb",
+}
+
+var spdxLicenseToken = regexp.MustCompile(`^[A-Za-z0-9.+-]+$`)
+
+// spdxDocument is an SPDX 2.3 document, with the fields which are written
+// and read from attestations
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes,omitempty"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	Supplier         string            `json:"supplier,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded,omitempty"`
+	LicenseDeclared  string            `json:"licenseDeclared,omitempty"`
+	CopyrightText    string            `json:"copyrightText,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// sbomBuilder adds the packages of a build to an SPDX document
+type sbomBuilder struct {
+	doc *spdxDocument
+	n   int
+}
+
+func sbom(args []string) {
+	flags := newFlagSet("sbom")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s sbom [options] [path|reference]\n\n", invoked)
+		fmt.Printf("Write an SPDX SBOM of a build, which is a built output, as for 'inspect',\n")
+		fmt.Printf("or the reference of an image pushed with 'push registry'. The packages of\n")
+		fmt.Printf("each image are taken from its SBOM attestation in its registry if it has\n")
+		fmt.Printf("one, and otherwise from the package databases in the build.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	outputFlag := flags.String("o", "", "File to write the SBOM to, default is stdout")
+	attestations := flags.Bool("attestations", true, "Pull the SBOM attestations of the images from their registries")
+	archFlag := flags.String("arch", runtime.GOARCH, "Architecture of the attestations of builds which do not record theirs")
+	insecure := flags.Bool("insecure", false, "Allow pulling images from a registry without TLS")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) != 1 {
+		fmt.Println("Please specify a built output or an image reference")
+		flags.Usage()
+		os.Exit(1)
+	}
+	arg := remArgs[0]
+
+	output, ok := outputPath(arg)
+	if !ok {
+		dir, err := ioutil.TempDir("", "linuxkit-sbom")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		prefix, err := pullArtifact(arg, dir, *insecure)
+		if err != nil {
+			os.RemoveAll(dir)
+			log.Fatalf("Unable to pull %s: %v", arg, err)
+		}
+		output = prefix + "-initrd.img"
+	}
+	doc, err := buildSBOM(arg, output, *attestations, *archFlag)
+	if err != nil {
+		log.Fatalf("Unable to create the SBOM of %s: %v", arg, err)
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b = append(b, '\n')
+	if *outputFlag == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*outputFlag, b, 0644); err != nil {
+		log.Fatalf("Unable to write the SBOM: %v", err)
+	}
+}
+
+// buildSBOM returns the SBOM of the built output at output, which is named
+// by arg
+func buildSBOM(arg, output string, attestations bool, arch string) (*spdxDocument, error) {
+	report, err := inspectOutput(output, false)
+	if err != nil {
+		return nil, err
+	}
+	if report.Architecture != "" {
+		arch = report.Architecture
+	}
+	databases, err := packageDatabases(output)
+	if err != nil {
+		return nil, err
+	}
+
+	docName := filepath.Base(arg)
+	b := &sbomBuilder{doc: &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              docName,
+		DocumentNamespace: fmt.Sprintf("https://linuxkit.org/spdx/%s-%s", url.PathEscape(docName), uuid.New().String()),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: linuxkit-" + version.Version},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}}
+	top := b.add("SPDXRef-DOCUMENT", "DESCRIBES", spdxPackage{
+		Name:    docName,
+		Comment: fmt.Sprintf("linuxkit %s output", report.Format),
+	})
+	b.doc.DocumentDescribes = []string{top}
+	if !report.Manifest {
+		log.Warnf("%s has no manifest, so the images have no references or digests", arg)
+	}
+
+	kernel := top
+	initAttested := false
+	for _, i := range report.Images {
+		id := b.add(top, "CONTAINS", imagePackage(i))
+		if i.Section == "kernel" {
+			kernel = id
+		}
+		var attested *spdxDocument
+		if attestations && i.Digest != "" && i.Image != "" {
+			attested, err = pullAttestation(i.Image, i.Digest, arch)
+			if err != nil {
+				log.Warnf("Unable to pull the SBOM attestation of %s: %v", i.Image, err)
+			}
+		}
+		if attested != nil {
+			b.addAttested(id, attested)
+			if i.Section == "init" {
+				initAttested = true
+			}
+			continue
+		}
+		// the kernel and init images are in the root filesystem
+		if db, ok := databases[i.Section+"/"+i.Name]; ok && i.Section != "kernel" && i.Section != "init" {
+			for _, p := range db {
+				b.add(id, "CONTAINS", p)
+			}
+		}
+	}
+	if report.KernelVersion != "" {
+		b.add(kernel, "CONTAINS", spdxPackage{
+			Name:        "linux",
+			VersionInfo: report.KernelVersion,
+			ExternalRefs: []spdxExternalRef{
+				purl(fmt.Sprintf("pkg:generic/linux@%s", url.PathEscape(report.KernelVersion))),
+			},
+		})
+	}
+	// the root filesystem has the packages of the init images, which are
+	// already added if they have attestations
+	if !initAttested {
+		for _, p := range databases[""] {
+			b.add(top, "CONTAINS", p)
+		}
+	}
+	return b.doc, nil
+}
+
+// add adds a package with a relationship to another element and returns its ID
+func (b *sbomBuilder) add(from, relationship string, p spdxPackage) string {
+	b.n++
+	p.SPDXID = fmt.Sprintf("SPDXRef-Package-%d", b.n)
+	if p.DownloadLocation == "" {
+		p.DownloadLocation = "NOASSERTION"
+	}
+	if p.Supplier == "" {
+		p.Supplier = "NOASSERTION"
+	}
+	if p.LicenseConcluded == "" {
+		p.LicenseConcluded = "NOASSERTION"
+	}
+	if p.LicenseDeclared == "" {
+		p.LicenseDeclared = "NOASSERTION"
+	}
+	if p.CopyrightText == "" {
+		p.CopyrightText = "NOASSERTION"
+	}
+	b.doc.Packages = append(b.doc.Packages, p)
+	b.doc.Relationships = append(b.doc.Relationships, spdxRelationship{
+		SPDXElementID:      from,
+		RelationshipType:   relationship,
+		RelatedSPDXElement: p.SPDXID,
+	})
+	return p.SPDXID
+}
+
+// addAttested adds the packages of an attestation to the package of its
+// image, without the package of the image the attestation describes
+func (b *sbomBuilder) addAttested(id string, attested *spdxDocument) {
+	described := map[string]bool{}
+	for _, d := range attested.DocumentDescribes {
+		described[d] = true
+	}
+	for _, r := range attested.Relationships {
+		if r.SPDXElementID == attested.SPDXID && r.RelationshipType == "DESCRIBES" {
+			described[r.RelatedSPDXElement] = true
+		}
+	}
+	for _, p := range attested.Packages {
+		if described[p.SPDXID] {
+			continue
+		}
+		p.Comment = strings.TrimSpace("From the SBOM attestation of the image. " + p.Comment)
+		b.add(id, "CONTAINS", p)
+	}
+}
+
+// imagePackage returns the package of an image of a build
+func imagePackage(i moby.ManifestImage) spdxPackage {
+	p := spdxPackage{
+		Name:    i.Name,
+		Comment: fmt.Sprintf("linuxkit %s image", i.Section),
+	}
+	if i.Image == "" {
+		// images of builds without a manifest are only known by their name
+		return p
+	}
+	repo := imageRepository(i.Image)
+	p.Name = repo
+	if tag := strings.TrimPrefix(strings.SplitN(i.Image, "@", 2)[0], repo); tag != "" {
+		p.VersionInfo = strings.TrimPrefix(tag, ":")
+	}
+	if i.Digest == "" {
+		return p
+	}
+	if algo, value := splitDigest(i.Digest); algo == "sha256" {
+		p.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: value}}
+	}
+	locator := fmt.Sprintf("pkg:oci/%s@%s?repository_url=%s", path.Base(repo), url.QueryEscape(i.Digest), url.QueryEscape(imageRepository(moby.ReferenceExpand(i.Image))))
+	if p.VersionInfo != "" {
+		locator += "&tag=" + url.QueryEscape(p.VersionInfo)
+	}
+	p.ExternalRefs = []spdxExternalRef{purl(locator)}
+	return p
+}
+
+func splitDigest(digest string) (string, string) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", digest
+	}
+	return parts[0], parts[1]
+}
+
+func purl(locator string) spdxExternalRef {
+	return spdxExternalRef{
+		ReferenceCategory: "PACKAGE-MANAGER",
+		ReferenceType:     "purl",
+		ReferenceLocator:  locator,
+	}
+}
+
+// pullAttestation pulls the SPDX SBOM attestation of the image with digest
+// for arch, which is nil if the image has none
+func pullAttestation(image, digest, arch string) (*spdxDocument, error) {
+	ref, err := name.ParseReference(imageRepository(image) + "@" + digest)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		// attestations are only found in an index
+		return nil, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var target string
+	for _, m := range im.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == arch {
+			target = m.Digest.String()
+			break
+		}
+	}
+	for _, m := range im.Manifests {
+		if target == "" || m.Annotations[attestationTypeAnnotation] != attestationManifestType || m.Annotations[attestationDigestAnnotation] != target {
+			continue
+		}
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range manifest.Layers {
+			if l.Annotations[attestationPredicateAnnotation] != spdxPredicateType {
+				continue
+			}
+			layer, err := img.LayerByDigest(l.Digest)
+			if err != nil {
+				return nil, err
+			}
+			r, err := layer.Compressed()
+			if err != nil {
+				return nil, err
+			}
+			var statement struct {
+				Predicate spdxDocument `json:"predicate"`
+			}
+			err = json.NewDecoder(r).Decode(&statement)
+			r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid attestation %s: %v", l.Digest, err)
+			}
+			return &statement.Predicate, nil
+		}
+	}
+	return nil, nil
+}
+
+// packageDatabases returns the packages in the package databases of a built
+// output, by the section and name of their bundle, or "" for the root
+// filesystem
+func packageDatabases(output string) (map[string][]spdxPackage, error) {
+	a, err := openArtifact(output)
+	if err != nil {
+		return nil, err
+	}
+	databases := map[string][]spdxPackage{}
+	err = a.walk(func(name string, dir bool, r io.Reader) error {
+		if dir {
+			return nil
+		}
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		key := ""
+		if parts := strings.SplitN(name, "/", 5); len(parts) == 5 && parts[0] == "containers" && parts[3] == "rootfs" {
+			key = parts[1] + "/" + bundleName(parts[1], parts[2])
+			name = parts[4]
+		}
+		manager, ok := sbomPackageDatabases[name]
+		if !ok {
+			return nil
+		}
+		packages, err := parsePackageDatabase(manager, r)
+		if err != nil {
+			return fmt.Errorf("Invalid package database %s: %v", name, err)
+		}
+		databases[key] = append(databases[key], packages...)
+		return nil
+	})
+	return databases, err
+}
+
+// parsePackageDatabase parses an apk installed database or a dpkg status
+// file, which both have a paragraph of fields for each package
+func parsePackageDatabase(manager string, r io.Reader) ([]spdxPackage, error) {
+	var packages []spdxPackage
+	fields := map[string]string{}
+	add := func() {
+		defer func() { fields = map[string]string{} }()
+		var name, version, arch, license string
+		if manager == "apk" {
+			name, version, arch, license = fields["P"], fields["V"], fields["A"], fields["L"]
+		} else {
+			if !strings.HasSuffix(fields["Status"], " installed") {
+				return
+			}
+			name, version, arch = fields["Package"], fields["Version"], fields["Architecture"]
+		}
+		if name == "" {
+			return
+		}
+		distro := "alpine"
+		if manager == "deb" {
+			distro = "debian"
+		}
+		locator := fmt.Sprintf("pkg:%s/%s/%s@%s", manager, distro, url.PathEscape(name), url.PathEscape(version))
+		if arch != "" {
+			locator += "?arch=" + url.QueryEscape(arch)
+		}
+		packages = append(packages, spdxPackage{
+			Name:            name,
+			VersionInfo:     version,
+			LicenseDeclared: spdxLicense(license),
+			ExternalRefs:    []spdxExternalRef{purl(locator)},
+		})
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			add()
+			continue
+		}
+		sep := ":"
+		if manager == "deb" {
+			if line[0] == ' ' || line[0] == '\t' {
+				// continuation of a multi-line field
+				continue
+			}
+			sep = ": "
+		}
+		kv := strings.SplitN(line, sep, 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	add()
+	return packages, nil
+}
+
+// spdxLicense returns a license of a package database as an SPDX license
+// expression, or NOASSERTION if it is not one. apk separates licenses with
+// spaces.
+func spdxLicense(license string) string {
+	fields := strings.Fields(license)
+	if len(fields) == 0 {
+		return "NOASSERTION"
+	}
+	operators := false
+	for _, f := range fields {
+		switch strings.Trim(f, "()") {
+		case "AND", "OR", "WITH":
+			operators = true
+		case "custom":
+			// apk has custom for licenses without an identifier
+			return "NOASSERTION"
+		default:
+			if !spdxLicenseToken.MatchString(strings.Trim(f, "()")) {
+				return "NOASSERTION"
+			}
+		}
+	}
+	if operators {
+		return strings.Join(fields, " ")
+	}
+	return strings.Join(fields, " AND ")
+}
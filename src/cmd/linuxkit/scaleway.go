@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,26 +25,30 @@ import (
 )
 
 var (
-	defaultScalewayCommercialType          = "DEV1-S"
-	defaultScalewayImageName               = "Ubuntu Bionic"
-	defaultScalewayImageArch               = "x86_64"
-	scalewayDynamicIPRequired              = true
-	scalewayBootType                       = instance.BootTypeLocal
-	scalewayInstanceVolumeSize    scw.Size = 20
+	defaultScalewayCommercialType               = "DEV1-S"
+	defaultScalewayCommercialTypeARM64          = "AMP2-C1"
+	defaultScalewayImageName                    = "Ubuntu 22.04 Jammy Jellyfish"
+	scalewayBootType                            = instance.BootTypeLocal
+	scalewayInstanceVolumeSize         scw.Size = 20
+	scalewayBlockVolumeIOPS                     = 5000
+	scalewayTimeout                             = 10 * time.Minute
 )
 
 // ScalewayClient contains state required for communication with Scaleway as well as the instance
 type ScalewayClient struct {
+	client         *scw.Client
 	instanceAPI    *instance.API
 	marketplaceAPI *marketplace.API
 	fileName       string
 	zone           scw.Zone
+	projectID      string
 	sshConfig      *ssh.ClientConfig
 	secretKey      string
 }
 
-// NewScalewayClient creates a new scaleway client
-func NewScalewayClient(accessKey, secretKey, zone, organizationID string) (*ScalewayClient, error) {
+// NewScalewayClient creates a new scaleway client. The project defaults to
+// the default project of the organization, which shares its ID.
+func NewScalewayClient(accessKey, secretKey, zone, organizationID, projectID string) (*ScalewayClient, error) {
 	log.Debugf("Connecting to Scaleway")
 
 	scwOptions := []scw.ClientOption{}
@@ -83,10 +88,16 @@ func NewScalewayClient(accessKey, secretKey, zone, organizationID string) (*Scal
 	instanceAPI := instance.NewAPI(scwClient)
 	marketplaceAPI := marketplace.NewAPI(scwClient)
 
+	if projectID == "" {
+		projectID, _ = scwClient.GetDefaultOrganizationID()
+	}
+
 	client := &ScalewayClient{
+		client:         scwClient,
 		instanceAPI:    instanceAPI,
 		marketplaceAPI: marketplaceAPI,
 		zone:           scwZone,
+		projectID:      projectID,
 		fileName:       "",
 		secretKey:      secretKey,
 	}
@@ -94,6 +105,135 @@ func NewScalewayClient(accessKey, secretKey, zone, organizationID string) (*Scal
 	return client, nil
 }
 
+// scalewayArch returns the name Scaleway uses for an architecture
+func scalewayArch(arch string) string {
+	switch arch {
+	case "arm64", "aarch64":
+		return "arm64"
+	default:
+		return "x86_64"
+	}
+}
+
+// scalewayCommercialType returns the default instance type for an architecture
+func scalewayCommercialType(arch string) string {
+	if scalewayArch(arch) == "arm64" {
+		return defaultScalewayCommercialTypeARM64
+	}
+	return defaultScalewayCommercialType
+}
+
+// do sends a request to the Scaleway API and decodes the response into out.
+// It is used for the endpoints and fields which the vendored SDK predates,
+// such as projects, routed IPs and block volumes.
+func (s *ScalewayClient) do(method, path string, in, out interface{}) error {
+	req := &scw.ScalewayRequest{Method: method, Path: path}
+	if in != nil {
+		if err := req.SetBody(in); err != nil {
+			return err
+		}
+	}
+	log.Debugf("Scaleway: %s %s", method, path)
+	return s.client.Do(req, out)
+}
+
+func (s *ScalewayClient) zonePath(api, path string) string {
+	return fmt.Sprintf("/%s/zones/%s%s", api, s.zone, path)
+}
+
+// scalewayServerRequest is a server creation request of the current
+// instance API
+type scalewayServerRequest struct {
+	Name              string                              `json:"name"`
+	CommercialType    string                              `json:"commercial_type"`
+	Image             string                              `json:"image"`
+	BootType          instance.BootType                   `json:"boot_type"`
+	DynamicIPRequired bool                                `json:"dynamic_ip_required"`
+	RoutedIPEnabled   bool                                `json:"routed_ip_enabled"`
+	Project           string                              `json:"project,omitempty"`
+	Volumes           map[string]*instance.VolumeTemplate `json:"volumes,omitempty"`
+	Tags              []string                            `json:"tags,omitempty"`
+}
+
+// createServer creates a server and returns its ID
+func (s *ScalewayClient) createServer(req scalewayServerRequest) (string, error) {
+	req.BootType = scalewayBootType
+	req.RoutedIPEnabled = true
+	req.Project = s.projectID
+	var resp struct {
+		Server struct {
+			ID string `json:"id"`
+		} `json:"server"`
+	}
+	if err := s.do(http.MethodPost, s.zonePath("instance/v1", "/servers"), req, &resp); err != nil {
+		return "", err
+	}
+	return resp.Server.ID, nil
+}
+
+// attachBlockVolume attaches a block storage volume to a server
+func (s *ScalewayClient) attachBlockVolume(serverID, volumeID string) error {
+	req := map[string]string{"volume_id": volumeID, "volume_type": "sbs_volume"}
+	return s.do(http.MethodPost, s.zonePath("instance/v1", "/servers/"+serverID+"/attach-volume"), req, nil)
+}
+
+// addIPv6 attaches a new routed IPv6 address to a server
+func (s *ScalewayClient) addIPv6(serverID string) error {
+	req := map[string]string{"project": s.projectID, "type": "routed_ipv6", "server": serverID}
+	return s.do(http.MethodPost, s.zonePath("instance/v1", "/ips"), req, nil)
+}
+
+// waitBlockVolume waits for a block storage volume to be available
+func (s *ScalewayClient) waitBlockVolume(volumeID string) error {
+	deadline := time.Now().Add(scalewayTimeout)
+	for time.Now().Before(deadline) {
+		var volume struct {
+			Status string `json:"status"`
+		}
+		if err := s.do(http.MethodGet, s.zonePath("block/v1alpha1", "/volumes/"+volumeID), nil, &volume); err != nil {
+			return err
+		}
+		log.Debugf("Scaleway: volume %s is %s", volumeID, volume.Status)
+		switch volume.Status {
+		case "available":
+			return nil
+		case "error":
+			return fmt.Errorf("volume %s is in error", volumeID)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for volume %s", volumeID)
+}
+
+// CreateBlockVolume creates an empty block storage volume of the given size
+// in GB and waits for it to be available. The volume is deleted if the run
+// fails or is interrupted before keepResources is called.
+func (s *ScalewayClient) CreateBlockVolume(name string, size int, tags []string) (string, error) {
+	req := map[string]interface{}{
+		"name":       name,
+		"project_id": s.projectID,
+		"perf_iops":  scalewayBlockVolumeIOPS,
+		"from_empty": map[string]scw.Size{"size": scw.Size(size) * scw.GB},
+		"tags":       tags,
+	}
+	var volume struct {
+		ID string `json:"id"`
+	}
+	if err := s.do(http.MethodPost, s.zonePath("block/v1alpha1", "/volumes"), req, &volume); err != nil {
+		return "", err
+	}
+	onCleanup("block volume "+volume.ID, func() error { return s.DeleteBlockVolume(volume.ID) })
+	return volume.ID, s.waitBlockVolume(volume.ID)
+}
+
+// DeleteBlockVolume deletes a block storage volume once it is detached
+func (s *ScalewayClient) DeleteBlockVolume(volumeID string) error {
+	if err := s.waitBlockVolume(volumeID); err != nil {
+		return err
+	}
+	return s.do(http.MethodDelete, s.zonePath("block/v1alpha1", "/volumes/"+volumeID), nil, nil)
+}
+
 func (s *ScalewayClient) getImageID(imageName, commercialType, arch string) (string, error) {
 	imagesResp, err := s.marketplaceAPI.ListImages(&marketplace.ListImagesRequest{})
 	if err != nil {
@@ -118,9 +258,10 @@ func (s *ScalewayClient) getImageID(imageName, commercialType, arch string) (str
 }
 
 // CreateInstance create an instance with one additional volume
-func (s *ScalewayClient) CreateInstance(volumeSize int) (string, error) {
-	// get the Ubuntu Bionic image id
-	imageID, err := s.getImageID(defaultScalewayImageName, defaultScalewayCommercialType, defaultScalewayImageArch)
+func (s *ScalewayClient) CreateInstance(volumeSize int, arch string) (string, error) {
+	commercialType := scalewayCommercialType(arch)
+	// get the Ubuntu image id
+	imageID, err := s.getImageID(defaultScalewayImageName, commercialType, scalewayArch(arch))
 	if err != nil {
 		return "", err
 	}
@@ -144,24 +285,20 @@ func (s *ScalewayClient) CreateInstance(volumeSize int) (string, error) {
 		"0": {Size: (scalewayInstanceVolumeSize - scwVolumeSize) * scw.GB},
 	}
 
-	createServerRequest := &instance.CreateServerRequest{
+	log.Debug("Creating server on Scaleway")
+	serverID, err := s.createServer(scalewayServerRequest{
 		Name:              "linuxkit-builder",
-		CommercialType:    defaultScalewayCommercialType,
-		DynamicIPRequired: &scalewayDynamicIPRequired,
+		CommercialType:    commercialType,
+		DynamicIPRequired: true,
 		Image:             imageID,
-		EnableIPv6:        false,
-		BootType:          &scalewayBootType,
 		Volumes:           volumeMap,
-	}
-
-	log.Debug("Creating server on Scaleway")
-	serverResp, err := s.instanceAPI.CreateServer(createServerRequest)
+	})
 	if err != nil {
 		return "", err
 	}
 
 	attachVolumeRequest := &instance.AttachVolumeRequest{
-		ServerID: serverResp.Server.ID,
+		ServerID: serverID,
 		VolumeID: volumeResp.Volume.ID,
 	}
 
@@ -170,8 +307,8 @@ func (s *ScalewayClient) CreateInstance(volumeSize int) (string, error) {
 		return "", nil
 	}
 
-	log.Debugf("Created server %s on Scaleway", serverResp.Server.ID)
-	return serverResp.Server.ID, nil
+	log.Debugf("Created server %s on Scaleway", serverID)
+	return serverID, nil
 }
 
 // GetSecondVolumeID returns the ID of the second volume of the server
@@ -459,9 +596,18 @@ func (s *ScalewayClient) TerminateInstance(instanceID string) error {
 	return nil
 }
 
+// setTags sets the tags of an instance API resource, for the requests of the
+// vendored SDK which have no tags
+func (s *ScalewayClient) setTags(path string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	return s.do(http.MethodPatch, s.zonePath("instance/v1", path), map[string][]string{"tags": tags}, nil)
+}
+
 // CreateScalewayImage creates the image and delete old image and snapshot if same name
-func (s *ScalewayClient) CreateScalewayImage(instanceID, volumeID, name string) error {
-	oldImageID, err := s.getImageID(name, defaultScalewayCommercialType, defaultArch)
+func (s *ScalewayClient) CreateScalewayImage(instanceID, volumeID, name, arch string, tags []string) error {
+	oldImageID, err := s.getImageID(name, scalewayCommercialType(arch), scalewayArch(arch))
 	if err == nil {
 		log.Debugf("deleting image %s", oldImageID)
 		err = s.instanceAPI.DeleteImage(&instance.DeleteImageRequest{
@@ -495,23 +641,30 @@ func (s *ScalewayClient) CreateScalewayImage(instanceID, volumeID, name string)
 	if err != nil {
 		return err
 	}
+	if err := s.setTags("/snapshots/"+snapshotResp.Snapshot.ID, tags); err != nil {
+		return err
+	}
 
 	log.Debugf("creating image %s with snapshot %s", name, snapshotResp.Snapshot.ID)
 	imageResp, err := s.instanceAPI.CreateImage(&instance.CreateImageRequest{
 		Name:       name,
-		Arch:       instance.Arch(defaultArch),
+		Arch:       instance.Arch(scalewayArch(arch)),
 		RootVolume: snapshotResp.Snapshot.ID,
 	})
 	if err != nil {
 		return err
 	}
+	if err := s.setTags("/images/"+imageResp.Image.ID, tags); err != nil {
+		return err
+	}
 
 	log.Infof("Image %s with ID %s created", name, imageResp.Image.ID)
 
 	return nil
 }
 
-// DeleteInstanceAndVolumes deletes the instance and the volumes attached
+// DeleteInstanceAndVolumes deletes the instance and the local volumes
+// attached, block storage volumes are only detached
 func (s *ScalewayClient) DeleteInstanceAndVolumes(instanceID string) error {
 	serverResp, err := s.instanceAPI.GetServer(&instance.GetServerRequest{
 		ServerID: instanceID,
@@ -528,6 +681,9 @@ func (s *ScalewayClient) DeleteInstanceAndVolumes(instanceID string) error {
 	}
 
 	for _, volume := range serverResp.Server.Volumes {
+		if volume.VolumeType == "sbs_volume" {
+			continue
+		}
 		err = s.instanceAPI.DeleteVolume(&instance.DeleteVolumeRequest{
 			VolumeID: volume.ID,
 		})
@@ -541,33 +697,85 @@ func (s *ScalewayClient) DeleteInstanceAndVolumes(instanceID string) error {
 	return nil
 }
 
-// CreateLinuxkitInstance creates an instance with the given linuxkit image
-func (s *ScalewayClient) CreateLinuxkitInstance(instanceName, imageName, instanceType string) (string, error) {
+// deleteServer deletes a server and its local volumes, powering it off
+// first if it has been booted
+func (s *ScalewayClient) deleteServer(serverID string) error {
+	serverResp, err := s.instanceAPI.GetServer(&instance.GetServerRequest{
+		ServerID: serverID,
+	})
+	if err != nil {
+		return err
+	}
+	if serverResp.Server.State != instance.ServerStateStopped {
+		if err := s.TerminateInstance(serverID); err != nil {
+			return err
+		}
+	}
+	return s.DeleteInstanceAndVolumes(serverID)
+}
+
+// ScalewayInstanceConfig is the configuration of an instance to create
+type ScalewayInstanceConfig struct {
+	Name      string
+	ImageName string
+	// InstanceType defaults to a type matching the architecture of the image
+	InstanceType string
+	// IPv6 attaches a routed IPv6 address to the instance
+	IPv6 bool
+	// IPv6Only creates the instance without a public IPv4 address
+	IPv6Only bool
+	// Volumes are the IDs of block storage volumes to attach
+	Volumes []string
+	Tags    []string
+}
+
+// CreateLinuxkitInstance creates an instance with the given linuxkit image,
+// which is deleted if the run fails or is interrupted before keepResources
+// is called
+func (s *ScalewayClient) CreateLinuxkitInstance(config ScalewayInstanceConfig) (string, error) {
 	// get the image ID
 	imageResp, err := s.instanceAPI.ListImages(&instance.ListImagesRequest{
-		Name: &imageName,
+		Name: &config.ImageName,
 	})
 	if err != nil {
 		return "", err
 	}
 	if len(imageResp.Images) != 1 {
-		return "", fmt.Errorf("Image %s not found or found multiple times", imageName)
+		return "", fmt.Errorf("Image %s not found or found multiple times", config.ImageName)
+	}
+	image := imageResp.Images[0]
+
+	instanceType := config.InstanceType
+	if instanceType == "" {
+		instanceType = scalewayCommercialType(image.Arch.String())
 	}
-	imageID := imageResp.Images[0].ID
 
-	log.Debugf("Creating server %s on Scaleway", instanceName)
-	serverResp, err := s.instanceAPI.CreateServer(&instance.CreateServerRequest{
-		Name:              instanceName,
-		DynamicIPRequired: &scalewayDynamicIPRequired,
+	log.Debugf("Creating %s server %s on Scaleway", instanceType, config.Name)
+	serverID, err := s.createServer(scalewayServerRequest{
+		Name:              config.Name,
+		DynamicIPRequired: !config.IPv6Only,
 		CommercialType:    instanceType,
-		Image:             imageID,
-		BootType:          &scalewayBootType,
+		Image:             image.ID,
+		Tags:              config.Tags,
 	})
 	if err != nil {
 		return "", err
 	}
+	onCleanup("instance "+serverID, func() error { return s.deleteServer(serverID) })
+
+	if config.IPv6 || config.IPv6Only {
+		if err := s.addIPv6(serverID); err != nil {
+			return serverID, fmt.Errorf("Unable to add an IPv6 address: %v", err)
+		}
+	}
+	for _, volumeID := range config.Volumes {
+		log.Debugf("Attaching volume %s to server %s", volumeID, serverID)
+		if err := s.attachBlockVolume(serverID, volumeID); err != nil {
+			return serverID, fmt.Errorf("Unable to attach volume %s: %v", volumeID, err)
+		}
+	}
 
-	return serverResp.Server.ID, nil
+	return serverID, nil
 }
 
 // BootInstance boots the specified instance, and don't wait
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// releasesURL is the GitHub API endpoint of the releases
+	releasesURL = "https://api.github.com/repos/linuxkit/linuxkit/releases"
+	// releasesURLVar overrides the endpoint of the releases, e.g. for a
+	// mirror
+	releasesURLVar = "LINUXKIT_RELEASES_URL"
+)
+
+// release is a GitHub release
+type release struct {
+	TagName string         `json:"tag_name"`
+	HTMLURL string         `json:"html_url"`
+	Body    string         `json:"body"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// checksumLine matches a line of sha256sum output, in a checksum file or the
+// notes of a release
+var checksumLine = regexp.MustCompile("^`?([0-9a-f]{64})[ \t]+\\*?([^ \t`]+)`?$")
+
+var releaseClient = &http.Client{Timeout: 5 * time.Minute}
+
+// getRelease returns the release with tag, or the latest release
+func getRelease(tag string) (*release, error) {
+	url := strings.TrimSuffix(getStringValue(releasesURLVar, "", releasesURL), "/") + "/latest"
+	if tag != "" {
+		url = strings.TrimSuffix(url, "/latest") + "/tags/" + tag
+	}
+	log.Debugf("Querying %s", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := releaseClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var r release
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid release from %s: %v", url, err)
+	}
+	if r.TagName == "" {
+		return nil, fmt.Errorf("the release from %s has no tag", url)
+	}
+	return &r, nil
+}
+
+// asset returns the asset of r with the binary for the platform
+func (r *release) asset() (releaseAsset, error) {
+	name := fmt.Sprintf("linuxkit-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return releaseAsset{}, fmt.Errorf("release %s has no %s binary", r.TagName, name)
+}
+
+// checksum returns the published sha256 of the asset name of r, from a
+// checksum file of the release or otherwise from its notes
+func (r *release) checksum(name string) (string, error) {
+	for _, a := range r.Assets {
+		if !strings.Contains(strings.ToLower(a.Name), "sha256") {
+			continue
+		}
+		resp, err := releaseClient.Get(a.URL)
+		if err != nil {
+			return "", err
+		}
+		sums, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s returned %s", a.URL, resp.Status)
+		}
+		if sum := findChecksum(string(sums), name); sum != "" {
+			return sum, nil
+		}
+	}
+	if sum := findChecksum(r.Body, name); sum != "" {
+		return sum, nil
+	}
+	return "", fmt.Errorf("release %s has no sha256 of %s", r.TagName, name)
+}
+
+func findChecksum(sums, name string) string {
+	scanner := bufio.NewScanner(strings.NewReader(sums))
+	for scanner.Scan() {
+		m := checksumLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m != nil && filepath.Base(m[2]) == name {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// parseVersion parses versions like v0.8, v1.0.0-rc1 and v0.8+, which is a
+// build after v0.8
+func parseVersion(v string) (nums []int, pre string, dev bool, ok bool) {
+	v = strings.TrimPrefix(v, "v")
+	if strings.HasSuffix(v, "+") {
+		v, dev = strings.TrimSuffix(v, "+"), true
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, "", false, false
+		}
+		nums = append(nums, n)
+	}
+	return nums, pre, dev, true
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b, and false if they cannot be compared
+func compareVersions(a, b string) (int, bool) {
+	an, apre, adev, aok := parseVersion(a)
+	bn, bpre, bdev, bok := parseVersion(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	// a pre-release is before its release
+	if apre != bpre {
+		switch {
+		case apre == "":
+			return 1, true
+		case bpre == "":
+			return -1, true
+		case apre < bpre:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	if adev != bdev {
+		if adev {
+			return 1, true
+		}
+		return -1, true
+	}
+	return 0, true
+}
+
+func versionCmd(args []string) {
+	flags := newFlagSet("version")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s version [options]\n\n", invoked)
+		fmt.Printf("Print the version of %s, and with -check whether there is a newer\n", invoked)
+		fmt.Printf("release, which can be installed with '%s self-update'.\n\n", invoked)
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	check := flags.Bool("check", false, "Check for a newer release")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if !*check {
+		printVersion()
+	}
+
+	fmt.Printf("%s version %s\n", invoked, version.Version)
+	r, err := getRelease("")
+	if err != nil {
+		log.Fatalf("Unable to check for a newer release: %v", err)
+	}
+	c, ok := compareVersions(version.Version, r.TagName)
+	switch {
+	case !ok:
+		fmt.Printf("The latest release is %s, which cannot be compared with this version: %s\n", r.TagName, r.HTMLURL)
+	case c < 0:
+		fmt.Printf("A newer release %s is available: %s\n", r.TagName, r.HTMLURL)
+		fmt.Printf("Run '%s self-update' to install it\n", invoked)
+	default:
+		fmt.Printf("%s is up to date\n", invoked)
+	}
+}
+
+func selfUpdate(args []string) {
+	flags := newFlagSet("self-update")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s self-update [options]\n\n", invoked)
+		fmt.Printf("Replace this binary with the binary of the latest release for the\n")
+		fmt.Printf("platform, if it is newer, after checking the sha256 published with the\n")
+		fmt.Printf("release. This is for binaries which were downloaded from the releases,\n")
+		fmt.Printf("binaries installed by a package manager should be updated with it.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	tag := flags.String("version", "", "Release to install, e.g. v1.0.0, default is the latest")
+	force := flags.Bool("force", false, "Install the release even if it is not newer, or this version is unknown")
+	dryRun := flags.Bool("dry-run", false, "Report the release which would be installed, without installing it")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) != 0 {
+		fmt.Printf("Unknown arguments %s\n", strings.Join(flags.Args(), " "))
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	r, err := getRelease(*tag)
+	if err != nil {
+		log.Fatalf("Unable to get the release: %v", err)
+	}
+	if !*force {
+		c, ok := compareVersions(version.Version, r.TagName)
+		if !ok {
+			log.Fatalf("This version %s cannot be compared with the release %s, use -force to install it", version.Version, r.TagName)
+		}
+		if c >= 0 && *tag == "" {
+			log.Infof("%s %s is up to date", invoked, version.Version)
+			return
+		}
+		if c > 0 {
+			log.Fatalf("The release %s is older than this version %s, use -force to install it", r.TagName, version.Version)
+		}
+	}
+	asset, err := r.asset()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sum, err := r.checksum(asset.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find this binary: %v", err)
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		log.Fatalf("Unable to find this binary: %v", err)
+	}
+	if *dryRun {
+		log.Infof("Would replace %s %s with %s from %s", self, version.Version, r.TagName, asset.URL)
+		return
+	}
+	log.Infof("Downloading %s %s", asset.Name, r.TagName)
+	if err := replaceBinary(self, asset.URL, sum); err != nil {
+		log.Fatalf("Unable to update %s: %v", self, err)
+	}
+	log.Infof("Updated %s to %s", self, r.TagName)
+}
+
+// replaceBinary replaces the binary self with the download from url, if its
+// sha256 is sum
+func replaceBinary(self, url, sum string) error {
+	resp, err := releaseClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	// the download is written next to the binary, so it can be renamed
+	tmp, err := ioutil.TempFile(filepath.Dir(self), ".linuxkit-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("the sha256 of the download is %s, not the published %s", got, sum)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+
+	// a running binary cannot be replaced on Windows, but it can be renamed
+	old := self + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(self, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), self); err != nil {
+		_ = os.Rename(old, self)
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		log.Debugf("Unable to remove %s: %v", old, err)
+	}
+	return nil
+}
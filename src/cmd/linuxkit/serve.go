@@ -1,11 +1,15 @@
 package main
 
 import (
-	"flag"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -19,17 +23,79 @@ func logRequest(handler http.Handler) http.Handler {
 
 // serve starts a local web server
 func serve(args []string) {
-	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags := newFlagSet("serve")
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s serve [options]\n\n", invoked)
+		fmt.Printf("Serve a directory over HTTP, or over HTTPS with -tls-cert and -tls-key.\n")
+		fmt.Printf("With -ipxe it also serves an iPXE script booting an image in the directory,\n")
+		fmt.Printf("and with -pxe it boots PXE clients on the local network into the script.\n\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
 	portFlag := flags.String("port", ":8080", "Local port to serve on")
 	dirFlag := flags.String("directory", ".", "Directory to serve")
+	certFlag := flags.String("tls-cert", "", "Path to the PEM certificate to serve HTTPS with, followed by any intermediate certificates")
+	keyFlag := flags.String("tls-key", "", "Path to the PEM private key of -tls-cert")
+	clientCAFlag := flags.String("tls-client-ca", "", "Path to PEM CA certificates, clients must present a certificate signed by one of them")
+	ipxeFlag := flags.String("ipxe", "", "Prefix of the kernel, initrd and cmdline in -directory to serve an iPXE script for, as /<prefix>.ipxe and /boot.ipxe")
+	pxeFlag := flags.Bool("pxe", false, "Run ProxyDHCP and TFTP servers booting PXE clients into the -ipxe script, next to the DHCP server of the network")
+	metricsFlag := flags.String("metrics-listen", "", "Serve the Prometheus metrics of the requests and bytes served on <host>:<port>")
+	pxe := addPXEFlags(flags)
 	flags.Parse(args)
 
+	if (*certFlag == "") != (*keyFlag == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if *clientCAFlag != "" && *certFlag == "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if *pxeFlag && *ipxeFlag == "" {
+		log.Fatal("-pxe requires -ipxe")
+	}
+
 	http.Handle("/", http.FileServer(http.Dir(*dirFlag)))
-	log.Fatal(http.ListenAndServe(*portFlag, logRequest(http.DefaultServeMux)))
+	if *ipxeFlag != "" {
+		prefix := strings.Trim(filepath.ToSlash(*ipxeFlag), "/")
+		http.Handle("/"+prefix+".ipxe", serveIPXEScript(*dirFlag, prefix))
+		http.Handle("/boot.ipxe", serveIPXEScript(*dirFlag, prefix))
+	}
+	if *pxeFlag {
+		config, baseURL, err := pxe.config(*dirFlag, *portFlag, *certFlag != "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.scriptURL = func(net.HardwareAddr) (string, bool) {
+			return baseURL + "/boot.ipxe", true
+		}
+		if err := servePXE(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *metricsFlag != "" {
+		serveMetrics(*metricsFlag, newMetricsHandler(serveRequests, serveBytes))
+	}
+	server := &http.Server{
+		Addr:    *portFlag,
+		Handler: logRequest(countResponses(http.DefaultServeMux)),
+	}
+	if *certFlag == "" {
+		log.Fatal(server.ListenAndServe())
+	}
+
+	// iPXE supports at most TLS 1.2, so it is the minimum rather than 1.3
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if *clientCAFlag != "" {
+		pem, err := ioutil.ReadFile(*clientCAFlag)
+		if err != nil {
+			log.Fatalf("Unable to read the client CA certificates: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", *clientCAFlag)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Fatal(server.ListenAndServeTLS(*certFlag, *keyFlag))
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 'linuxkit serve -pxe' runs a ProxyDHCP server next to the DHCP server of
+// the network, which only tells PXE clients what to boot, and a read only
+// TFTP server. PXE firmware boots iPXE over TFTP, and iPXE then boots the
+// iPXE script served over HTTP.
+
+const (
+	dhcpMagic = 0x63825363
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+
+	dhcpOptVendorOptions = 43
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptVendorClass   = 60
+	dhcpOptUserClass     = 77
+	dhcpOptClientArch    = 93
+	dhcpOptClientGUID    = 97
+	dhcpOptEnd           = 255
+
+	tftpRRQ   = 1
+	tftpData  = 3
+	tftpAck   = 4
+	tftpError = 5
+	tftpOACK  = 6
+
+	tftpDefaultBlockSize = 512
+	tftpMaxBlockSize     = 65464
+	tftpTimeout          = 2 * time.Second
+	tftpRetries          = 5
+)
+
+// pxeConfig is the configuration of the ProxyDHCP and TFTP servers
+type pxeConfig struct {
+	// ip is the address of the TFTP and HTTP servers given to clients
+	ip net.IP
+	// scriptURL returns the URL of the iPXE script booted by the iPXE
+	// client with a MAC address, or false for clients which are not booted
+	scriptURL func(mac net.HardwareAddr) (string, bool)
+	// bootFiles are the iPXE binaries in tftpDir by client architecture,
+	// as in RFC 4578
+	bootFiles map[uint16]string
+	tftpDir   string
+}
+
+// pxeFlags are the options of the PXE servers of 'serve' and 'netboot'
+type pxeFlags struct {
+	ip, tftpDir, bios, efi, arm64 *string
+}
+
+func addPXEFlags(flags *flag.FlagSet) *pxeFlags {
+	return &pxeFlags{
+		ip:      flags.String("pxe-ip", "", "IP address of this host given to PXE clients, defaults to the first non-loopback IPv4 address"),
+		tftpDir: flags.String("tftp-directory", "", "Directory with the iPXE binaries to serve over TFTP, defaults to -directory"),
+		bios:    flags.String("ipxe-bios", "undionly.kpxe", "iPXE binary for BIOS clients"),
+		efi:     flags.String("ipxe-efi", "ipxe.efi", "iPXE binary for x86_64 UEFI clients"),
+		arm64:   flags.String("ipxe-arm64", "ipxe-arm64.efi", "iPXE binary for arm64 UEFI clients, as built in bin-arm64-efi/snp.efi"),
+	}
+}
+
+// config returns the configuration of the PXE servers for the HTTP server
+// serving dir on port, and the base URL of the HTTP server for clients
+func (f *pxeFlags) config(dir, port string, tls bool) (*pxeConfig, string, error) {
+	ip := net.ParseIP(*f.ip).To4()
+	if *f.ip == "" {
+		var err error
+		if ip, err = pxeServerIP(); err != nil {
+			return nil, "", err
+		}
+	} else if ip == nil {
+		return nil, "", fmt.Errorf("Invalid IPv4 address %s", *f.ip)
+	}
+	_, port, err := net.SplitHostPort(port)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid port: %v", err)
+	}
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	tftpDir := *f.tftpDir
+	if tftpDir == "" {
+		tftpDir = dir
+	}
+	config := &pxeConfig{
+		ip: ip,
+		bootFiles: map[uint16]string{
+			0:  *f.bios,
+			7:  *f.efi,
+			9:  *f.efi,
+			11: *f.arm64,
+		},
+		tftpDir: tftpDir,
+	}
+	return config, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip.String(), port)), nil
+}
+
+// pxeServerIP returns the first non-loopback IPv4 address of the host
+func pxeServerIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.IP.IsGlobalUnicast() {
+			return n.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("No IPv4 address found, use -pxe-ip")
+}
+
+// servePXE starts the ProxyDHCP servers on ports 67 and 4011 and the TFTP
+// server on port 69
+func servePXE(config *pxeConfig) error {
+	lc := net.ListenConfig{Control: setBroadcast}
+	dhcp, err := lc.ListenPacket(context.Background(), "udp4", ":67")
+	if err != nil {
+		return fmt.Errorf("Unable to listen for DHCP: %v", err)
+	}
+	pxe, err := net.ListenPacket("udp4", ":4011")
+	if err != nil {
+		return fmt.Errorf("Unable to listen for PXE: %v", err)
+	}
+	tftp, err := net.ListenPacket("udp4", ":69")
+	if err != nil {
+		return fmt.Errorf("Unable to listen for TFTP: %v", err)
+	}
+	go serveProxyDHCP(dhcp, config, true)
+	go serveProxyDHCP(pxe, config, false)
+	go serveTFTP(tftp, config.tftpDir)
+	log.Infof("Serving PXE clients from %s", config.ip)
+	return nil
+}
+
+// serveProxyDHCP answers the DHCP requests of PXE clients on conn. The
+// offers on port 67 are broadcast, as the client has no address yet.
+func serveProxyDHCP(conn net.PacketConn, config *pxeConfig, broadcast bool) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Errorf("DHCP: %v", err)
+			return
+		}
+		reply, err := config.dhcpReply(buf[:n], broadcast)
+		if err != nil {
+			log.Debugf("DHCP: Ignoring request from %s: %v", addr, err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		to := addr
+		if broadcast {
+			to = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+			if giaddr := net.IP(buf[24:28]); !giaddr.Equal(net.IPv4zero) {
+				to = &net.UDPAddr{IP: giaddr, Port: 67}
+			}
+		}
+		if _, err := conn.WriteTo(reply, to); err != nil {
+			log.Errorf("DHCP: Unable to reply to %s: %v", to, err)
+		}
+	}
+}
+
+// parseDHCPOptions returns the options of a DHCP packet, with the values
+// of options given more than once concatenated as in RFC 3396
+func parseDHCPOptions(packet []byte) (map[byte][]byte, error) {
+	if len(packet) < 240 || binary.BigEndian.Uint32(packet[236:240]) != dhcpMagic {
+		return nil, fmt.Errorf("Not a DHCP packet")
+	}
+	options := map[byte][]byte{}
+	b := packet[240:]
+	for len(b) > 0 && b[0] != dhcpOptEnd {
+		if b[0] == 0 {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("Truncated option %d", b[0])
+		}
+		options[b[0]] = append(options[b[0]], b[2:2+int(b[1])]...)
+		b = b[2+int(b[1]):]
+	}
+	return options, nil
+}
+
+// dhcpReply returns the reply to a DHCP request, or nil for requests which
+// are not answered: discovers are answered with an offer on port 67 and
+// requests with an ack on port 4011. iPXE clients are given the URL of
+// the iPXE script, other clients the iPXE binary for their architecture.
+func (c *pxeConfig) dhcpReply(request []byte, discover bool) ([]byte, error) {
+	options, err := parseDHCPOptions(request)
+	if err != nil {
+		return nil, err
+	}
+	if request[0] != 1 || !bytes.HasPrefix(options[dhcpOptVendorClass], []byte("PXEClient")) {
+		return nil, nil
+	}
+	var msgType byte
+	switch t := options[dhcpOptMessageType]; {
+	case discover && bytes.Equal(t, []byte{dhcpDiscover}):
+		msgType = dhcpOffer
+	case !discover && bytes.Equal(t, []byte{dhcpRequest}):
+		msgType = dhcpAck
+	default:
+		return nil, nil
+	}
+	mac := net.HardwareAddr(request[28:34])
+	file, ok := c.scriptURL(mac)
+	if !ok {
+		return nil, fmt.Errorf("No image for %s", mac)
+	}
+	if !bytes.Equal(options[dhcpOptUserClass], []byte("iPXE")) {
+		if len(options[dhcpOptClientArch]) < 2 {
+			return nil, fmt.Errorf("No client architecture")
+		}
+		arch := binary.BigEndian.Uint16(options[dhcpOptClientArch])
+		if file, ok = c.bootFiles[arch]; !ok {
+			return nil, fmt.Errorf("Unsupported client architecture %d", arch)
+		}
+	}
+	if len(file) > 127 {
+		return nil, fmt.Errorf("Boot file name %s is too long", file)
+	}
+	log.Infof("DHCP: Booting %s with %s", mac, file)
+
+	reply := make([]byte, 240, 300)
+	reply[0] = 2
+	copy(reply[1:3], request[1:3])     // htype, hlen
+	copy(reply[4:8], request[4:8])     // xid
+	copy(reply[10:12], request[10:12]) // flags
+	copy(reply[20:24], c.ip.To4())     // siaddr
+	copy(reply[24:44], request[24:44]) // giaddr, chaddr
+	copy(reply[108:236], file)
+	binary.BigEndian.PutUint32(reply[236:240], dhcpMagic)
+	reply = append(reply, dhcpOptMessageType, 1, msgType)
+	reply = append(reply, dhcpOptServerID, 4)
+	reply = append(reply, c.ip.To4()...)
+	reply = append(reply, dhcpOptVendorClass, 9)
+	reply = append(reply, "PXEClient"...)
+	if guid := options[dhcpOptClientGUID]; len(guid) > 0 && len(guid) < 256 {
+		reply = append(reply, dhcpOptClientGUID, byte(len(guid)))
+		reply = append(reply, guid...)
+	}
+	// PXE discovery control 8: boot the file in the offer without boot
+	// server discovery
+	reply = append(reply, dhcpOptVendorOptions, 4, 6, 1, 8, 255)
+	reply = append(reply, dhcpOptEnd)
+	return reply, nil
+}
+
+// serveTFTP serves the read requests on conn from the files in root. Each
+// transfer uses a new port, as in RFC 1350.
+func serveTFTP(conn net.PacketConn, root string) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Errorf("TFTP: %v", err)
+			return
+		}
+		request := make([]byte, n)
+		copy(request, buf[:n])
+		go tftpTransfer(root, addr, request)
+	}
+}
+
+// tftpTransfer sends the file of a read request, with the blksize and
+// tsize options of RFC 2348 and RFC 2349
+func tftpTransfer(root string, addr net.Addr, request []byte) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		log.Errorf("TFTP: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if len(request) < 4 || binary.BigEndian.Uint16(request) != tftpRRQ {
+		tftpSendError(conn, addr, 4, "Only read requests are supported")
+		return
+	}
+	fields := strings.Split(string(request[2:]), "\x00")
+	if len(fields) < 2 {
+		tftpSendError(conn, addr, 4, "Invalid read request")
+		return
+	}
+	name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+fields[0])))
+	f, err := os.Open(name)
+	if err != nil {
+		log.Infof("TFTP: %s requested missing %s", addr, fields[0])
+		tftpSendError(conn, addr, 1, "File not found")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		tftpSendError(conn, addr, 1, "File not found")
+		return
+	}
+	log.Infof("TFTP: Sending %s to %s", fields[0], addr)
+
+	blockSize := tftpDefaultBlockSize
+	var oack []byte
+	for i := 2; i+1 < len(fields); i += 2 {
+		switch strings.ToLower(fields[i]) {
+		case "blksize":
+			size, err := strconv.Atoi(fields[i+1])
+			if err != nil || size < 8 {
+				continue
+			}
+			if size > tftpMaxBlockSize {
+				size = tftpMaxBlockSize
+			}
+			blockSize = size
+			oack = append(oack, fmt.Sprintf("blksize\x00%d\x00", size)...)
+		case "tsize":
+			oack = append(oack, fmt.Sprintf("tsize\x00%d\x00", fi.Size())...)
+		}
+	}
+	if oack != nil {
+		if err := tftpSend(conn, addr, append([]byte{0, tftpOACK}, oack...), 0); err != nil {
+			log.Errorf("TFTP: Sending %s to %s: %v", fields[0], addr, err)
+			return
+		}
+	}
+
+	data := make([]byte, 4+blockSize)
+	binary.BigEndian.PutUint16(data, tftpData)
+	// the block number wraps for files over 65535 blocks, as most clients expect
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, data[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			tftpSendError(conn, addr, 0, err.Error())
+			return
+		}
+		binary.BigEndian.PutUint16(data[2:], block)
+		if err := tftpSend(conn, addr, data[:4+n], block); err != nil {
+			log.Errorf("TFTP: Sending %s to %s: %v", fields[0], addr, err)
+			return
+		}
+		if n < blockSize {
+			return
+		}
+	}
+}
+
+// tftpSend sends packet to addr until it is acknowledged with block
+func tftpSend(conn net.PacketConn, addr net.Addr, packet []byte, block uint16) error {
+	buf := make([]byte, 1500)
+	for retry := 0; retry < tftpRetries; retry++ {
+		if _, err := conn.WriteTo(packet, addr); err != nil {
+			return err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(tftpTimeout)); err != nil {
+			return err
+		}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if from.String() != addr.String() || n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case tftpAck:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case tftpError:
+				return fmt.Errorf("Client error: %s", strings.TrimRight(string(buf[4:n]), "\x00"))
+			}
+		}
+	}
+	return fmt.Errorf("No acknowledgement of block %d", block)
+}
+
+// tftpSendError sends an error packet to addr
+func tftpSendError(conn net.PacketConn, addr net.Addr, code uint16, message string) {
+	packet := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(packet, tftpError)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, message...)
+	packet = append(packet, 0)
+	conn.WriteTo(packet, addr)
+}
+
+// serveIPXEScript serves an iPXE script booting the kernel and initrd with
+// prefix in dir from this server. The cmdline is read on each request, so
+// a rebuilt image is booted without a restart.
+func serveIPXEScript(dir, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cmdline, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(prefix)+"-cmdline"))
+		if err != nil {
+			log.Errorf("Unable to read the cmdline: %v", err)
+			http.NotFound(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base := fmt.Sprintf("%s://%s/%s", scheme, r.Host, prefix)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, s3IPXEScript(base+"-kernel", base+"-initrd.img", strings.TrimSpace(string(cmdline))))
+	}
+}
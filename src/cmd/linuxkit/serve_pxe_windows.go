@@ -0,0 +1,14 @@
+package main
+
+import "syscall"
+
+// setBroadcast allows the ProxyDHCP server to broadcast its offers
+func setBroadcast(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
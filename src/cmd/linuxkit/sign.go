@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// signer signs and verifies the files of build outputs with an external
+// tool, writing a detached signature next to each file
+type signer struct {
+	method string
+	// key is the private or public key of cosign, the key ID to sign with
+	// or the keyring to verify with for gpg, or empty for keyless cosign
+	key string
+	// identity and issuer are the expected certificate of keyless cosign
+	// signatures
+	identity string
+	issuer   string
+}
+
+func (s *signer) check() error {
+	switch s.method {
+	case "cosign", "gpg":
+	default:
+		return fmt.Errorf("Unknown signing method %s, must be cosign or gpg", s.method)
+	}
+	if _, err := exec.LookPath(s.method); err != nil {
+		return fmt.Errorf("%s is required: %v", s.method, err)
+	}
+	return nil
+}
+
+func (s *signer) signature(file string) string {
+	if s.method == "gpg" {
+		return file + ".asc"
+	}
+	return file + ".sig"
+}
+
+func (s *signer) certificate(file string) string {
+	return file + ".pem"
+}
+
+func (s *signer) sign(file string) error {
+	if s.method == "gpg" {
+		args := []string{"--batch", "--yes", "--detach-sign", "--armor", "--output", s.signature(file)}
+		if s.key != "" {
+			args = append(args, "--local-user", s.key)
+		}
+		return runSigner("gpg", append(args, file)...)
+	}
+	args := []string{"sign-blob", "--yes", "--output-signature", s.signature(file)}
+	if s.key != "" {
+		args = append(args, "--key", s.key)
+	} else {
+		args = append(args, "--output-certificate", s.certificate(file))
+	}
+	return runSigner("cosign", append(args, file)...)
+}
+
+func (s *signer) verify(file string) error {
+	if _, err := os.Stat(s.signature(file)); err != nil {
+		return fmt.Errorf("no signature: %v", err)
+	}
+	if s.method == "gpg" {
+		args := []string{"--batch"}
+		if s.key != "" {
+			args = append(args, "--no-default-keyring", "--keyring", s.key)
+		}
+		return runSigner("gpg", append(args, "--verify", s.signature(file), file)...)
+	}
+	args := []string{"verify-blob", "--signature", s.signature(file)}
+	args = append(args, cosignKeyArgs(s.key, s.identity, s.issuer, s.certificate(file))...)
+	return runSigner("cosign", append(args, file)...)
+}
+
+// cosignKeyArgs returns the arguments of cosign to verify with a public key,
+// or with a keyless certificate, which is not given for images
+func cosignKeyArgs(key, identity, issuer, certificate string) []string {
+	if key != "" {
+		return []string{"--key", key}
+	}
+	var args []string
+	if certificate != "" {
+		args = append(args, "--certificate", certificate)
+	}
+	return append(args, "--certificate-identity", identity, "--certificate-oidc-issuer", issuer)
+}
+
+func runSigner(name string, args ...string) error {
+	log.Debugf("Executing: %s %s", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if len(out) > 0 {
+		log.Debug(string(out))
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
+
+// signedFiles returns the files of the outputs, which are the files of the
+// kernel+initrd outputs given by their base name, and otherwise the files
+// given
+func signedFiles(outputs []string) ([]string, error) {
+	var files []string
+	for _, o := range outputs {
+		name, ok := outputPath(o)
+		if !ok {
+			return nil, fmt.Errorf("%s not found", o)
+		}
+		// formats which cannot be inspected, like qcow2, are signed as they are
+		a, err := openArtifact(name)
+		if err != nil {
+			files = append(files, name)
+			continue
+		}
+		files = append(files, a.files...)
+	}
+	return files, nil
+}
+
+// checksumsFile is the name of the sha256sum file written by 'build -checksums'
+const checksumsFile = "SHA256SUMS"
+
+// writeChecksums writes the sha256 of files, which are in the directory of
+// path, to path in the format of sha256sum, so it can be checked with
+// 'sha256sum -c'
+func writeChecksums(path string, files []string) error {
+	var sums bytes.Buffer
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%x  %s\n", h.Sum(nil), filepath.Base(file))
+	}
+	return ioutil.WriteFile(path, sums.Bytes(), 0644)
+}
+
+// signMethod returns the signing method of the config, or cosign
+func signMethod() string {
+	if Config.Sign.Method != "" {
+		return Config.Sign.Method
+	}
+	return "cosign"
+}
+
+func signUsage(flags *flag.FlagSet, verify bool) {
+	invoked := filepath.Base(os.Args[0])
+	if verify {
+		fmt.Printf("USAGE: %s verify [options] output...\n\n", invoked)
+		fmt.Printf("Verify the signatures of build outputs written by 'sign', and that the\n")
+		fmt.Printf("digests of the images in their manifests are the signed digests of the\n")
+		fmt.Printf("images upstream.\n\n")
+	} else {
+		fmt.Printf("USAGE: %s sign [options] output...\n\n", invoked)
+		fmt.Printf("Sign build outputs, such as ISO and raw images, or kernel+initrd outputs\n")
+		fmt.Printf("given by their base name, with cosign or gpg. A detached signature is\n")
+		fmt.Printf("written next to each file, as file.sig for cosign, with its certificate\n")
+		fmt.Printf("as file.pem if it is keyless, or file.asc for gpg.\n\n")
+	}
+	fmt.Printf("Options:\n\n")
+	flags.PrintDefaults()
+}
+
+func sign(args []string) {
+	flags := newFlagSet("sign")
+	flags.Usage = func() { signUsage(flags, false) }
+	method := flags.String("method", signMethod(), "Signing method, cosign or gpg")
+	key := flags.String("key", Config.Sign.Key, "cosign private key or KMS URI, or gpg key ID, default is keyless cosign or the default gpg key")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) == 0 {
+		fmt.Println("Please specify the outputs to sign")
+		flags.Usage()
+		os.Exit(1)
+	}
+	s := &signer{method: *method, key: *key}
+	if err := s.check(); err != nil {
+		log.Fatal(err)
+	}
+	files, err := signedFiles(flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range files {
+		log.Infof("Signing %s", f)
+		if err := s.sign(f); err != nil {
+			log.Fatalf("Unable to sign %s: %v", f, err)
+		}
+		fmt.Println(s.signature(f))
+	}
+}
+
+func verify(args []string) {
+	flags := newFlagSet("verify")
+	flags.Usage = func() { signUsage(flags, true) }
+	method := flags.String("method", signMethod(), "Signing method, cosign or gpg")
+	key := flags.String("key", Config.Sign.VerifyKey, "cosign public key, or gpg keyring, default is keyless cosign or the default gpg keyring")
+	identity := flags.String("certificate-identity", Config.Sign.CertificateIdentity, "Identity of keyless cosign signatures")
+	issuer := flags.String("certificate-oidc-issuer", Config.Sign.CertificateOIDCIssuer, "OIDC issuer of keyless cosign signatures")
+	images := flags.String("images", "notary", "Verify the digests of the images with notary or cosign, or none")
+	imageKey := flags.String("image-key", "", "cosign public key of the images, default is keyless")
+	imageIdentity := flags.String("image-certificate-identity", "", "Identity of keyless cosign signatures of the images")
+	imageIssuer := flags.String("image-certificate-oidc-issuer", "", "OIDC issuer of keyless cosign signatures of the images")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) == 0 {
+		fmt.Println("Please specify the outputs to verify")
+		flags.Usage()
+		os.Exit(1)
+	}
+	s := &signer{method: *method, key: *key, identity: *identity, issuer: *issuer}
+	if err := s.check(); err != nil {
+		log.Fatal(err)
+	}
+	if s.method == "cosign" && s.key == "" && (s.identity == "" || s.issuer == "") {
+		log.Fatal("Keyless cosign signatures need -certificate-identity and -certificate-oidc-issuer")
+	}
+	imageSigner := &signer{method: "cosign", key: *imageKey, identity: *imageIdentity, issuer: *imageIssuer}
+	switch *images {
+	case "notary", "none":
+	case "cosign":
+		if err := imageSigner.check(); err != nil {
+			log.Fatal(err)
+		}
+		if imageSigner.key == "" && (imageSigner.identity == "" || imageSigner.issuer == "") {
+			log.Fatal("Keyless cosign signatures of images need -image-certificate-identity and -image-certificate-oidc-issuer")
+		}
+	default:
+		log.Fatalf("Unknown image verification %s, must be notary, cosign or none", *images)
+	}
+
+	failed := false
+	check := func(what string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAILED  %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("OK      %s\n", what)
+	}
+	verified := map[string]bool{}
+	for _, o := range flags.Args() {
+		files, err := signedFiles([]string{o})
+		if err != nil {
+			check(o, err)
+			continue
+		}
+		for _, f := range files {
+			if !verified[f] {
+				verified[f] = true
+				check(f, s.verify(f))
+			}
+		}
+		if *images == "none" {
+			continue
+		}
+		name, _ := outputPath(o)
+		if _, err := openArtifact(name); err != nil {
+			log.Warnf("The images of %s cannot be verified: %v", o, err)
+			continue
+		}
+		report, err := inspectOutput(name, false)
+		if err != nil {
+			check(o, err)
+			continue
+		}
+		if !report.Manifest {
+			check(o+" images", fmt.Errorf("the output has no manifest with the digests of its images"))
+			continue
+		}
+		for _, i := range report.Images {
+			what := fmt.Sprintf("%s %s", o, i.Image)
+			if i.Digest == "" {
+				check(what, fmt.Errorf("no digest, the image was not in the linuxkit cache when built"))
+				continue
+			}
+			if *images == "notary" {
+				check(what, verifyNotaryDigest(i.Image, i.Digest))
+			} else {
+				args := append([]string{"verify"}, cosignKeyArgs(imageSigner.key, imageSigner.identity, imageSigner.issuer, "")...)
+				check(what, runSigner("cosign", append(args, imageRepository(i.Image)+"@"+i.Digest)...))
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyNotaryDigest checks that digest is the digest image is signed with
+// in notary
+func verifyNotaryDigest(image, digest string) error {
+	signed, err := moby.TrustedReference(moby.ReferenceExpand(image))
+	if err != nil {
+		return err
+	}
+	c, ok := signed.(reference.Canonical)
+	if !ok {
+		return fmt.Errorf("no signed digest")
+	}
+	if c.Digest().String() != digest {
+		return fmt.Errorf("the digest %s is not the signed digest %s", digest, c.Digest())
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readRunInfo reads the information written by a run backend with -info,
+// from stdin if path is "-"
+func readRunInfo(path string) (RunInfo, error) {
+	var info RunInfo
+	var b []byte
+	var err error
+	if path == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return info, fmt.Errorf("Cannot read VM info: %v", err)
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return info, fmt.Errorf("Cannot parse VM info in %s: %v", path, err)
+	}
+	return info, nil
+}
+
+// sshAddress returns the user, host and port to ssh to from the information
+// about a VM. The ssh endpoint is used if there is one, except for packet
+// where it is the serial console, and the first IP address otherwise.
+func sshAddress(info RunInfo) (string, string, int, error) {
+	if info.SSH != "" && info.Backend != "packet" {
+		user, host := "", info.SSH
+		if i := strings.LastIndex(host, "@"); i != -1 {
+			user, host = host[:i], host[i+1:]
+		}
+		h, p, err := net.SplitHostPort(host)
+		if err != nil {
+			return user, host, 0, nil
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("Invalid ssh endpoint %s", info.SSH)
+		}
+		return user, h, port, nil
+	}
+	if len(info.IPs) > 0 {
+		return "", info.IPs[0], 0, nil
+	}
+	return "", "", 0, fmt.Errorf("The %s VM has no ssh endpoint or IP address", info.Backend)
+}
+
+// localBackends are the run backends which start VMs on this host, whose
+// host keys are not checked as they change with every run
+var localBackends = map[string]bool{
+	"cloud-hypervisor": true,
+	"hyperkit":         true,
+	"hyperv":           true,
+	"libvirt":          true,
+	"qemu":             true,
+	"vbox":             true,
+	"vfkit":            true,
+	"vmware":           true,
+}
+
+// sshCmd opens an ssh session to a VM started by a run backend, or runs a
+// command on it
+func sshCmd(args []string) {
+	flags := newFlagSet("ssh")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s ssh [options] [command [args...]]\n\n", invoked)
+		fmt.Printf("Connect to a VM using the information written by 'run -info'.\n")
+		fmt.Printf("If a command is given it is run on the VM and its exit status\n")
+		fmt.Printf("is returned, otherwise an interactive session is opened.\n")
+		fmt.Printf("The system ssh client is used.\n\n")
+		fmt.Printf("Options:\n\n")
+		flags.PrintDefaults()
+	}
+	infoFlag := flags.String("info", "", "Path to the file written by 'run -info', or - for stdin")
+	hostFlag := flags.String("host", "", "Host to connect to instead of the one in the VM info")
+	userFlag := flags.String("user", "", "User to log in as (default the user of the ssh endpoint, or root)")
+	portFlag := flags.Int("port", 0, "Port to connect to (default the port of the ssh endpoint, or 22)")
+	keyFlag := flags.String("i", "", "Path to the private key to authenticate with")
+	sshFlag := flags.String("ssh", "ssh", "Path to the ssh client")
+	noHostKeyCheck := flags.Bool("no-host-key-check", false, "Do not check the host key of VMs which do not run on this host")
+	var sshOptions multipleFlag
+	flags.Var(&sshOptions, "o", "Option to pass to the ssh client, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	var user, host string
+	var port int
+	checkHostKey := !*noHostKeyCheck
+	if *hostFlag != "" {
+		host = *hostFlag
+	} else {
+		if *infoFlag == "" {
+			fmt.Printf("Please specify the VM info with -info or the host with -host\n")
+			flags.Usage()
+			os.Exit(1)
+		}
+		info, err := readRunInfo(*infoFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if user, host, port, err = sshAddress(info); err != nil {
+			log.Fatal(err)
+		}
+		if localBackends[info.Backend] {
+			checkHostKey = false
+		}
+	}
+	user = getStringValue("", *userFlag, user)
+	if user == "" {
+		user = "root"
+	}
+	if *portFlag != 0 {
+		port = *portFlag
+	}
+
+	// ssh uses the first value of each option, so the options given
+	// come before the defaults
+	var sshArgs []string
+	for _, o := range sshOptions {
+		sshArgs = append(sshArgs, "-o", o)
+	}
+	if !checkHostKey {
+		sshArgs = append(sshArgs, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile="+os.DevNull, "-o", "LogLevel=ERROR")
+	}
+	if port != 0 {
+		sshArgs = append(sshArgs, "-p", strconv.Itoa(port))
+	}
+	if *keyFlag != "" {
+		sshArgs = append(sshArgs, "-i", *keyFlag)
+	}
+	// options after the host would be parsed by ssh rather than passed on
+	sshArgs = append(sshArgs, "--", user+"@"+host)
+	sshArgs = append(sshArgs, flags.Args()...)
+
+	log.Debugf("%s %v", *sshFlag, sshArgs)
+	cmd := exec.Command(*sshFlag, sshArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatalf("Unable to run %s: %v", *sshFlag, err)
+	}
+}
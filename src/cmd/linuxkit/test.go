@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The tests in test/cases are written for rtf: each directory is a group,
+// which may have a group.sh run with init and deinit around its tests, and
+// each directory with a test.sh is a test, which passes if it exits with 0
+// and is cancelled if it exits with rtCancel. Directories with only a
+// test.yml are tests which are built and booted, and pass if the console
+// shows the pass marker.
+
+// rtCancel is the exit status of a cancelled test
+const rtCancel = 253
+
+// rtLib is the library of rtf functions for the tests, which is sourced from
+// $RT_LIB
+const rtLib = `# rtf functions provided by linuxkit test
+rt_label_set() {
+	case ",${RT_LABELS}," in
+	*",$1,"*) return 0 ;;
+	esac
+	return 1
+}
+RT_CANCEL=253
+`
+
+var testOrderPrefix = regexp.MustCompile(`^[0-9]+_`)
+
+type testGroup struct {
+	name string
+	dir  string
+	// script is whether the group has a group.sh
+	script bool
+}
+
+type testCase struct {
+	name    string
+	dir     string
+	summary string
+	// labels are the labels of the test and its groups
+	labels []string
+	// script is whether the test is a test.sh, or otherwise a test.yml
+	script bool
+	// groups are the groups of the test, the outermost first
+	groups []*testGroup
+}
+
+type testResult struct {
+	test     *testCase
+	result   string
+	message  string
+	duration time.Duration
+	log      string
+}
+
+const (
+	testPass   = "PASS"
+	testFail   = "FAIL"
+	testSkip   = "SKIP"
+	testCancel = "CANCEL"
+)
+
+// testHeader returns the comments of a test.sh or group.sh, like SUMMARY
+// and LABELS, by their names
+func testHeader(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			if line == "" {
+				continue
+			}
+			break
+		}
+		kv := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), ":", 2)
+		if len(kv) == 2 && kv[0] == strings.ToUpper(kv[0]) && !strings.Contains(kv[0], " ") {
+			if _, ok := header[kv[0]]; !ok {
+				header[kv[0]] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return header, scanner.Err()
+}
+
+func testLabels(header map[string]string) []string {
+	return strings.FieldsFunc(header["LABELS"], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+}
+
+func testExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// discoverTests returns the tests in the group dir, in the order they run
+func discoverTests(dir, name string, labels []string, groups []*testGroup) ([]*testCase, error) {
+	group := &testGroup{name: name, dir: dir}
+	if testExists(filepath.Join(dir, "group.sh")) {
+		header, err := testHeader(filepath.Join(dir, "group.sh"))
+		if err != nil {
+			return nil, err
+		}
+		group.script = true
+		labels = append(append([]string{}, labels...), testLabels(header)...)
+	}
+	groups = append(append([]*testGroup{}, groups...), group)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tests []*testCase
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), "_") || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		subdir := filepath.Join(dir, e.Name())
+		subname := name + "." + testOrderPrefix.ReplaceAllString(e.Name(), "")
+		if testExists(filepath.Join(subdir, "test.sh")) {
+			header, err := testHeader(filepath.Join(subdir, "test.sh"))
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, &testCase{
+				name:    subname,
+				dir:     subdir,
+				summary: header["SUMMARY"],
+				labels:  append(append([]string{}, labels...), testLabels(header)...),
+				script:  true,
+				groups:  groups,
+			})
+			continue
+		}
+		sub, err := discoverTests(subdir, subname, labels, groups)
+		if err != nil {
+			return nil, err
+		}
+		if len(sub) == 0 && testExists(filepath.Join(subdir, "test.yml")) {
+			sub = []*testCase{{name: subname, dir: subdir, labels: labels, groups: groups}}
+		}
+		tests = append(tests, sub...)
+	}
+	return tests, nil
+}
+
+// runnable returns whether the labels of t are set, or why it is skipped
+func (t *testCase) runnable(set map[string]bool) (bool, string) {
+	for _, l := range t.labels {
+		if strings.HasPrefix(l, "!") {
+			if set[l[1:]] {
+				return false, fmt.Sprintf("label %s is set", l[1:])
+			}
+		} else if !set[l] {
+			return false, fmt.Sprintf("label %s is not set", l)
+		}
+	}
+	return true, ""
+}
+
+func testUsage(flags *flag.FlagSet) {
+	invoked := filepath.Base(os.Args[0])
+	fmt.Printf("USAGE: %s test [options] [pattern...]\n\n", invoked)
+	fmt.Printf("Run the rtf test cases of the cases directory, or those whose names start\n")
+	fmt.Printf("with one of the patterns, e.g. linuxkit.packages. Tests are test.sh\n")
+	fmt.Printf("scripts, which run with this binary as 'linuxkit', or test.yml files,\n")
+	fmt.Printf("which are built as kernel+initrd and booted, and pass if the console\n")
+	fmt.Printf("shows the pass marker. Tests whose labels are not set are skipped. The\n")
+	fmt.Printf("log of each test and a JUnit XML report are written to the results\n")
+	fmt.Printf("directory.\n\n")
+	fmt.Printf("Options:\n\n")
+	flags.PrintDefaults()
+}
+
+func testCmd(args []string) {
+	flags := newFlagSet("test")
+	flags.Usage = func() { testUsage(flags) }
+	casesDir := flags.String("cases", "", "Directory of the test cases, default is cases or test/cases")
+	var labelFlags multipleFlag
+	flags.Var(&labelFlags, "l", "Labels to set, comma separated, may be repeated. The OS and arch are always set")
+	list := flags.Bool("list", false, "List the tests, and whether they would run, without running them")
+	backend := flags.String("backend", "", "Backend to run the tests with, default is the default of 'run'")
+	resultsDir := flags.String("results", "", "Directory for the logs and report, default is _results/<time>")
+	junit := flags.String("junit", "", "File to write the JUnit XML report to, default is junit.xml in the results directory")
+	timeout := flags.Duration("timeout", 30*time.Minute, "Timeout of each test")
+	passMarker := flags.String("pass", "suite PASSED", "Console marker of a passing test.yml test")
+	failMarker := flags.String("fail", "suite FAILED", "Console marker of a failing test.yml test")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	patterns := flags.Args()
+
+	if *casesDir == "" {
+		*casesDir = "cases"
+		if !testExists(*casesDir) {
+			*casesDir = filepath.Join("test", "cases")
+		}
+	}
+	root, err := filepath.Abs(*casesDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rootName := "linuxkit"
+	if header, err := testHeader(filepath.Join(root, "group.sh")); err == nil && header["NAME"] != "" {
+		rootName = header["NAME"]
+	}
+	tests, err := discoverTests(root, rootName, nil, nil)
+	if err != nil {
+		log.Fatalf("Unable to find the tests in %s: %v", root, err)
+	}
+	var selected []*testCase
+	for _, t := range tests {
+		match := len(patterns) == 0
+		for _, p := range patterns {
+			if strings.HasPrefix(t.name, p) {
+				match = true
+			}
+		}
+		if match {
+			selected = append(selected, t)
+		}
+	}
+	if len(selected) == 0 {
+		log.Fatalf("No tests in %s match %s", root, strings.Join(patterns, " "))
+	}
+
+	set := map[string]bool{runtime.GOOS: true, runtime.GOARCH: true}
+	for _, l := range labelFlags {
+		for _, label := range strings.Split(l, ",") {
+			if label != "" {
+				set[label] = true
+			}
+		}
+	}
+
+	if *list {
+		for _, t := range selected {
+			state := "RUN"
+			if ok, _ := t.runnable(set); !ok {
+				state = testSkip
+			}
+			fmt.Printf("%-6s %-60s %-20s %s\n", state, t.name, strings.Join(t.labels, ","), t.summary)
+		}
+		return
+	}
+
+	if *backend != "" && runCommand().lookup(*backend) == nil {
+		log.Fatalf("Unknown backend %s", *backend)
+	}
+	if *resultsDir == "" {
+		*resultsDir = filepath.Join("_results", time.Now().Format("20060102-150405"))
+	}
+	if err := os.MkdirAll(*resultsDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	results, err := filepath.Abs(*resultsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := &testRunner{
+		root:       root,
+		results:    results,
+		backend:    *backend,
+		timeout:    *timeout,
+		passMarker: *passMarker,
+		failMarker: *failMarker,
+	}
+	for l := range set {
+		r.labels = append(r.labels, l)
+	}
+	sort.Strings(r.labels)
+	if err := r.setup(); err != nil {
+		log.Fatalf("Unable to set up the tests: %v", err)
+	}
+	defer r.cleanup()
+
+	start := time.Now()
+	var reports []*testResult
+	for _, t := range selected {
+		var res *testResult
+		if ok, why := t.runnable(set); !ok {
+			res = &testResult{test: t, result: testSkip, message: why}
+		} else {
+			res = r.run(t)
+		}
+		reports = append(reports, res)
+		fmt.Println(strings.TrimSpace(fmt.Sprintf("[%-6s] %s %.1fs %s", res.result, t.name, res.duration.Seconds(), res.message)))
+	}
+	r.leaveGroups(nil)
+
+	if *junit == "" {
+		*junit = filepath.Join(results, "junit.xml")
+	}
+	if err := writeJUnit(*junit, rootName, start, reports); err != nil {
+		log.Fatalf("Unable to write the JUnit report: %v", err)
+	}
+	counts := map[string]int{}
+	for _, res := range reports {
+		counts[res.result]++
+	}
+	fmt.Printf("Passed: %d Failed: %d Cancelled: %d Skipped: %d\n", counts[testPass], counts[testFail], counts[testCancel], counts[testSkip])
+	fmt.Printf("Logs and reports are in %s\n", results)
+	if counts[testFail] > 0 {
+		os.Exit(1)
+	}
+}
+
+// testRunner runs the tests, and the init and deinit of their groups
+type testRunner struct {
+	root       string
+	results    string
+	backend    string
+	labels     []string
+	timeout    time.Duration
+	passMarker string
+	failMarker string
+
+	// bin is the directory with this binary as linuxkit, for the scripts
+	bin string
+	env []string
+	// groups are the groups which have been initialised, the outermost
+	// first, and failed the groups whose init failed
+	groups []*testGroup
+	failed map[*testGroup]bool
+}
+
+func (r *testRunner) setup() error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if r.bin, err = ioutil.TempDir("", "linuxkit-test-"); err != nil {
+		return err
+	}
+	lib := filepath.Join(r.bin, "lib.sh")
+	if err := ioutil.WriteFile(lib, []byte(rtLib), 0644); err != nil {
+		return err
+	}
+	path := filepath.Dir(self)
+	name := "linuxkit"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if err := os.Symlink(self, filepath.Join(r.bin, name)); err == nil {
+		path = r.bin
+	}
+	r.env = append(os.Environ(),
+		"PATH="+path+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"RT_PROJECT_ROOT="+r.root,
+		"RT_LIB="+lib,
+		"RT_LABELS="+strings.Join(r.labels, ","),
+		"RT_RESULTS="+r.results,
+	)
+	if r.backend != "" {
+		r.env = append(r.env, "LINUXKIT_RUN_BACKEND="+r.backend)
+	}
+	r.failed = map[*testGroup]bool{}
+	return nil
+}
+
+func (r *testRunner) cleanup() {
+	_ = os.RemoveAll(r.bin)
+}
+
+// command runs name with args in dir, writing its output to out, and
+// returns its exit status
+func (r *testRunner) command(out io.Writer, dir, name string, args ...string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = r.env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+	log.Debugf("Executing: %s %s in %s", name, strings.Join(args, " "), dir)
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// the VMs the test started are in its process group
+		killProcessGroup(cmd)
+		<-done
+		return -1, fmt.Errorf("timed out after %s", r.timeout)
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+// enterGroups runs the init of the groups of t which are not initialised,
+// after the deinit of the groups which t is not in
+func (r *testRunner) enterGroups(t *testCase) {
+	r.leaveGroups(t.groups)
+	for _, g := range t.groups[len(r.groups):] {
+		r.groups = append(r.groups, g)
+		if len(r.groups) > 1 && r.failed[r.groups[len(r.groups)-2]] {
+			// the groups in a failed group fail with it
+			r.failed[g] = true
+			continue
+		}
+		if !g.script {
+			continue
+		}
+		f, err := os.Create(filepath.Join(r.results, g.name+".init.log"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		status, err := r.command(f, g.dir, "sh", "group.sh", "init")
+		f.Close()
+		if err != nil || status != 0 {
+			log.Errorf("The init of group %s failed, see %s", g.name, f.Name())
+			r.failed[g] = true
+		}
+	}
+}
+
+// leaveGroups runs the deinit of the initialised groups which are not in
+// groups, the innermost first
+func (r *testRunner) leaveGroups(groups []*testGroup) {
+	keep := 0
+	for keep < len(r.groups) && keep < len(groups) && r.groups[keep] == groups[keep] {
+		keep++
+	}
+	for i := len(r.groups) - 1; i >= keep; i-- {
+		g := r.groups[i]
+		if g.script && !r.failed[g] {
+			f, err := os.Create(filepath.Join(r.results, g.name+".deinit.log"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			status, err := r.command(f, g.dir, "sh", "group.sh", "deinit")
+			f.Close()
+			if err != nil || status != 0 {
+				log.Errorf("The deinit of group %s failed, see %s", g.name, f.Name())
+			}
+		}
+	}
+	r.groups = r.groups[:keep]
+}
+
+func (r *testRunner) run(t *testCase) *testResult {
+	r.enterGroups(t)
+	res := &testResult{test: t, log: filepath.Join(r.results, t.name+".log")}
+	for _, g := range t.groups {
+		if r.failed[g] {
+			res.result, res.message = testFail, fmt.Sprintf("the init of group %s failed", g.name)
+			return res
+		}
+	}
+	f, err := os.Create(res.log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var out io.Writer = f
+	if log.IsLevelEnabled(log.DebugLevel) {
+		out = io.MultiWriter(f, os.Stdout)
+	}
+
+	start := time.Now()
+	if t.script {
+		r.runScript(t, out, res)
+	} else {
+		r.runImage(t, out, res)
+	}
+	res.duration = time.Since(start)
+	return res
+}
+
+func (r *testRunner) runScript(t *testCase, out io.Writer, res *testResult) {
+	status, err := r.command(out, t.dir, "sh", "test.sh")
+	switch {
+	case err != nil:
+		res.result, res.message = testFail, err.Error()
+	case status == 0:
+		res.result = testPass
+	case status == rtCancel:
+		res.result, res.message = testCancel, "cancelled by the test"
+	default:
+		res.result, res.message = testFail, fmt.Sprintf("exit status %d", status)
+	}
+}
+
+// runImage builds the test.yml of t, boots it and checks the markers on its
+// console
+func (r *testRunner) runImage(t *testCase, out io.Writer, res *testResult) {
+	tmp, err := ioutil.TempDir("", "linuxkit-test-")
+	if err != nil {
+		res.result, res.message = testFail, err.Error()
+		return
+	}
+	defer os.RemoveAll(tmp)
+	self, err := os.Executable()
+	if err != nil {
+		res.result, res.message = testFail, err.Error()
+		return
+	}
+	name := filepath.Base(t.dir)
+	status, err := r.command(out, t.dir, self, "build", "-format", "kernel+initrd", "-dir", tmp, "-name", name, "test.yml")
+	if err != nil || status != 0 {
+		res.result, res.message = testFail, "the build failed"
+		return
+	}
+	var console strings.Builder
+	runArgs := []string{"run"}
+	if r.backend != "" {
+		runArgs = append(runArgs, r.backend)
+	}
+	status, err = r.command(io.MultiWriter(out, &console), t.dir, self, append(runArgs, filepath.Join(tmp, name))...)
+	switch {
+	case err != nil:
+		res.result, res.message = testFail, err.Error()
+	case strings.Contains(console.String(), r.failMarker):
+		res.result, res.message = testFail, fmt.Sprintf("the console shows %q", r.failMarker)
+	case !strings.Contains(console.String(), r.passMarker):
+		res.result, res.message = testFail, fmt.Sprintf("the console does not show %q, exit status %d", r.passMarker, status)
+	default:
+		res.result = testPass
+	}
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitLogLines is the number of lines at the end of the log of a failed
+// test in the report
+const junitLogLines = 100
+
+// logTail returns the last lines of the file path
+func logTail(path string, lines int) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	l := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(l) > lines {
+		l = l[len(l)-lines:]
+	}
+	return strings.Join(l, "\n")
+}
+
+func writeJUnit(path, name string, start time.Time, reports []*testResult) error {
+	suite := junitTestSuite{
+		Name:      name,
+		Timestamp: start.UTC().Format("2006-01-02T15:04:05"),
+		Time:      fmt.Sprintf("%.3f", time.Since(start).Seconds()),
+	}
+	for _, res := range reports {
+		classname, testName := name, res.test.name
+		if i := strings.LastIndex(res.test.name, "."); i >= 0 {
+			classname, testName = res.test.name[:i], res.test.name[i+1:]
+		}
+		c := junitTestCase{
+			Name:      testName,
+			Classname: classname,
+			Time:      fmt.Sprintf("%.3f", res.duration.Seconds()),
+		}
+		switch res.result {
+		case testFail:
+			suite.Failures++
+			c.Failure = &junitMessage{Message: res.message, Text: logTail(res.log, junitLogLines)}
+		case testSkip, testCancel:
+			suite.Skipped++
+			c.Skipped = &junitMessage{Message: res.message}
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, c)
+	}
+	b, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
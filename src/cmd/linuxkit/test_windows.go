@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing, as the processes cmd starts cannot be killed
+// with it
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills cmd
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,306 @@
+// Package trace records the spans of the work of linuxkit, such as pulling
+// the images of a build and writing its outputs, and exports them with the
+// OTLP/HTTP JSON protocol of OpenTelemetry to find where builds spend their
+// time. Tracing is enabled by the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables, and otherwise recording a
+// span does nothing.
+//
+// A span started while another is open is its child, and the first span is
+// the child of the span in TRACEPARENT if it is set, so the spans of the
+// linuxkit processes started by a build script or another linuxkit are in
+// the same trace.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span is a timed operation of a trace. The methods of a nil Span do
+// nothing, so they can be called when tracing is not enabled.
+type Span struct {
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// tracer is the state of the tracing of the process
+var tracer struct {
+	mu       sync.Mutex
+	endpoint string
+	headers  map[string]string
+	service  string
+	// traceID and parentID are those of TRACEPARENT
+	traceID  [16]byte
+	parentID [8]byte
+	open     []*Span
+	ended    []*Span
+}
+
+// Setup enables tracing if an OTLP endpoint is set in the environment, and
+// sets TRACEPARENT for the processes started by this one. It returns
+// whether tracing is enabled.
+func Setup(service string) bool {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if e := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); e != "" {
+			endpoint = strings.TrimSuffix(e, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return false
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.endpoint = endpoint
+	tracer.service = service
+	if s := os.Getenv("OTEL_SERVICE_NAME"); s != "" {
+		tracer.service = s
+	}
+	tracer.headers = map[string]string{}
+	for _, h := range []string{os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")} {
+		for _, kv := range strings.Split(h, ",") {
+			if kv := strings.SplitN(kv, "=", 2); len(kv) == 2 {
+				tracer.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	tracer.traceID, tracer.parentID = parseTraceparent(os.Getenv("TRACEPARENT"))
+	if tracer.traceID == [16]byte{} {
+		_, _ = rand.Read(tracer.traceID[:])
+	}
+	return true
+}
+
+// parseTraceparent returns the trace and span of a W3C traceparent header
+func parseTraceparent(tp string) (traceID [16]byte, spanID [8]byte) {
+	parts := strings.Split(tp, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return
+	}
+	t, err1 := hex.DecodeString(parts[1])
+	s, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return
+	}
+	copy(traceID[:], t)
+	copy(spanID[:], s)
+	return
+}
+
+// Start starts a span with the attributes given as key and value pairs, as
+// the child of the innermost open span. It returns nil if tracing is not
+// enabled.
+func Start(name string, attrs ...string) *Span {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if tracer.endpoint == "" {
+		return nil
+	}
+	s := &Span{name: name, traceID: tracer.traceID, parentID: tracer.parentID, start: time.Now(), attrs: map[string]string{}}
+	_, _ = rand.Read(s.spanID[:])
+	if n := len(tracer.open); n > 0 {
+		s.parentID = tracer.open[n-1].spanID
+	} else {
+		// the processes started in the first span are its children
+		os.Setenv("TRACEPARENT", s.Traceparent())
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	tracer.open = append(tracer.open, s)
+	return s
+}
+
+// SetAttribute sets an attribute of s
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError records that the operation of s failed with err, if it is set
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	s.err = err
+}
+
+// End ends s
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	s.endLocked(time.Now())
+}
+
+func (s *Span) endLocked(t time.Time) {
+	if !s.end.IsZero() {
+		return
+	}
+	s.end = t
+	for i, o := range tracer.open {
+		if o == s {
+			tracer.open = append(tracer.open[:i], tracer.open[i+1:]...)
+			break
+		}
+	}
+	tracer.ended = append(tracer.ended, s)
+}
+
+// Traceparent returns the W3C traceparent of s
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// Flush ends the open spans, which were interrupted by an error, and exports
+// the spans. Errors of the export are written to stderr, as the log may be
+// what is being ended.
+func Flush() {
+	tracer.mu.Lock()
+	now := time.Now()
+	for len(tracer.open) > 0 {
+		s := tracer.open[len(tracer.open)-1]
+		if s.err == nil {
+			s.err = fmt.Errorf("exited before the end of the span")
+		}
+		s.endLocked(now)
+	}
+	spans := tracer.ended
+	tracer.ended = nil
+	endpoint, headers, service := tracer.endpoint, tracer.headers, tracer.service
+	tracer.mu.Unlock()
+	if endpoint == "" || len(spans) == 0 {
+		return
+	}
+	if err := export(endpoint, headers, service, spans); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to export the trace to %s: %v\n", endpoint, err)
+	}
+}
+
+// The OTLP JSON encoding of spans
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// the kind of the spans, internal, and the status of their errors
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+func encode(service string, spans []*Span) otlpRequest {
+	var encoded []otlpSpan
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		encoded = append(encoded, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: service}}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "linuxkit"}, Spans: encoded}},
+	}}}
+}
+
+func export(endpoint string, headers map[string]string, service string, spans []*Span) error {
+	b, err := json.Marshal(encode(service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
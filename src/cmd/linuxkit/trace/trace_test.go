@@ -0,0 +1,84 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	var got otlpRequest
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		header = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	if Start("disabled") != nil {
+		t.Fatal("Expected no span without an endpoint")
+	}
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", srv.URL)
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer token")
+	os.Setenv("TRACEPARENT", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+	defer os.Unsetenv("TRACEPARENT")
+	if !Setup("linuxkit") {
+		t.Fatal("Expected tracing to be enabled")
+	}
+
+	root := Start("build", "formats", "iso-efi")
+	pull := Start("pull")
+	pull.SetError(errors.New("not found"))
+	pull.End()
+	// interrupted, and ended by Flush
+	Start("format")
+	Flush()
+
+	if header != "Bearer token" {
+		t.Errorf("Expected the headers of the environment, got %q", header)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected request %+v", got)
+	}
+	spans := map[string]otlpSpan{}
+	for _, s := range got.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[s.Name] = s
+		if s.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("Expected the trace of TRACEPARENT, got %s", s.TraceID)
+		}
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %+v", spans)
+	}
+	if spans["build"].ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("Expected the first span to be a child of TRACEPARENT, got %s", spans["build"].ParentSpanID)
+	}
+	if spans["pull"].ParentSpanID != spans["build"].SpanID || spans["format"].ParentSpanID != spans["build"].SpanID {
+		t.Errorf("Expected the spans to be children of build, got %+v", spans)
+	}
+	if spans["pull"].Status.Code != otlpStatusError || spans["pull"].Status.Message != "not found" {
+		t.Errorf("Expected the error of pull, got %+v", spans["pull"].Status)
+	}
+	if spans["format"].Status.Code != otlpStatusError {
+		t.Errorf("Expected the interrupted span to be an error, got %+v", spans["format"].Status)
+	}
+	if spans["build"].Status.Code != otlpStatusError {
+		t.Errorf("Expected the open root span to be an error, got %+v", spans["build"].Status)
+	}
+	if len(spans["build"].Attributes) != 1 || spans["build"].Attributes[0].Value.StringValue != "iso-efi" {
+		t.Errorf("Unexpected attributes %+v", spans["build"].Attributes)
+	}
+	if os.Getenv("TRACEPARENT") != root.Traceparent() {
+		t.Errorf("Expected TRACEPARENT of the first span, got %s", os.Getenv("TRACEPARENT"))
+	}
+}
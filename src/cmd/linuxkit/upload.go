@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/metrics"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/trace"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	defaultUploadParallel = 8
+	// multipartPartSize is the size of the parts of multipart uploads to
+	// object storages. Smaller files are uploaded in a single request.
+	multipartPartSize = 64 * 1024 * 1024
+	// multipartMaxParts is the largest number of parts of a multipart upload
+	multipartMaxParts = 10000
+	// uploadLogInterval is how often the progress is logged when stderr
+	// is not a terminal
+	uploadLogInterval = 30 * time.Second
+)
+
+const parallelUsage = "Number of parts of the image to upload at the same time"
+
+// parallelFlag adds the flag setting how many parts of a file push
+// backends which cannot resume uploads upload at the same time
+func parallelFlag(flags *flag.FlagSet) *int {
+	return flags.Int("parallel", defaultUploadParallel, parallelUsage)
+}
+
+// uploadOptions are the options of push backends uploading files in parts
+type uploadOptions struct {
+	// Parallel is the number of parts uploaded at the same time
+	Parallel int
+	// Resume keeps the parts of a failed upload, so that pushing the same
+	// file again resumes the upload
+	Resume bool
+}
+
+// uploadFlags adds the flags of the options of uploads in parts
+func uploadFlags(flags *flag.FlagSet) *uploadOptions {
+	var opts uploadOptions
+	flags.IntVar(&opts.Parallel, "parallel", defaultUploadParallel, parallelUsage)
+	flags.BoolVar(&opts.Resume, "resume", true, "Keep the parts of a failed upload and resume it when the same image is pushed again. Otherwise failed uploads are aborted, and so are the uploads of a previous push")
+	return &opts
+}
+
+// uploadProgress shows the progress and throughput of an upload, on a line
+// of stderr which is updated if it is a terminal, and in the log otherwise
+type uploadProgress struct {
+	// done is first to be aligned for atomic access on 32-bit platforms
+	done  int64
+	name  string
+	size  int64
+	start time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newUploadProgress starts showing the progress of the upload of size
+// bytes of name
+func newUploadProgress(name string, size int64) *uploadProgress {
+	p := &uploadProgress{name: name, size: size, start: time.Now(), stop: make(chan struct{})}
+	tty := terminal.IsTerminal(int(os.Stderr.Fd()))
+	interval := uploadLogInterval
+	if tty {
+		interval = time.Second
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s\n", p.line())
+				}
+				return
+			case <-ticker.C:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s", p.line())
+				} else {
+					log.Info(p.line())
+				}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *uploadProgress) line() string {
+	done := atomic.LoadInt64(&p.done)
+	percent := 100.0
+	if p.size > 0 {
+		percent = float64(done) * 100 / float64(p.size)
+	}
+	rate := float64(done) / time.Since(p.start).Seconds()
+	// the padding clears what is left of a longer previous line
+	return fmt.Sprintf("%s: %5.1f%% %s of %s, %s/s      ", p.name, percent,
+		units.HumanSize(float64(done)), units.HumanSize(float64(p.size)), units.HumanSize(rate))
+}
+
+// Add counts n more bytes as uploaded
+func (p *uploadProgress) Add(n int64) {
+	atomic.AddInt64(&p.done, n)
+}
+
+// Reader counts the bytes read from r as uploaded
+func (p *uploadProgress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+// Finish stops showing the progress
+func (p *uploadProgress) Finish() {
+	close(p.stop)
+	p.wg.Wait()
+	log.Debugf("Uploaded %s of %s in %s", units.HumanSize(float64(atomic.LoadInt64(&p.done))), p.name, time.Since(p.start).Round(time.Second))
+}
+
+type progressReader struct {
+	r io.Reader
+	p *uploadProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+// uploadParts calls upload for each part of partSize bytes of a file of
+// size bytes, with up to parallel parts at the same time. Parts are
+// numbered from 1. The progress is updated as parts complete, and the
+// first error stops the upload.
+func uploadParts(size, partSize int64, parallel int, progress *uploadProgress, upload func(n int, offset, length int64) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	type part struct {
+		n              int
+		offset, length int64
+	}
+	parts := make(chan part)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				if err := upload(p.n, p.offset, p.length); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				if progress != nil {
+					progress.Add(p.length)
+				}
+			}
+		}()
+	}
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+partSize, n+1 {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		select {
+		case err := <-errs:
+			close(parts)
+			wg.Wait()
+			return err
+		case parts <- part{n: n, offset: offset, length: length}:
+		}
+	}
+	close(parts)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// multipartSize returns the size of the parts of a multipart upload of
+// size bytes, which is larger than multipartPartSize for very large files
+func multipartSize(size int64) int64 {
+	partSize := int64(multipartPartSize)
+	if size/partSize >= multipartMaxParts {
+		partSize = size/(multipartMaxParts-1) + 1
+	}
+	return partSize
+}
+
+// uploadState is the state of an upload in parts which can be resumed. It
+// is saved in the linuxkit directory when the upload starts, and removed
+// once it is completed or aborted.
+type uploadState struct {
+	Target   string    `json:"target"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	UploadID string    `json:"upload_id"`
+
+	file string
+}
+
+func defaultUploadStateDir() string {
+	return filepath.Join(util.HomeDir(), ".linuxkit", "uploads")
+}
+
+// loadUploadState returns the state of the upload of path to target,
+// which can be resumed if its UploadID is set. The state of an upload of a
+// file which has changed since cannot be resumed.
+func loadUploadState(target, path string) (*uploadState, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(target + "\n" + abs))
+	s := &uploadState{
+		Target:  target,
+		Path:    abs,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC(),
+		file:    filepath.Join(defaultUploadStateDir(), hex.EncodeToString(h[:])+".json"),
+	}
+	b, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved uploadState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Warnf("Ignoring invalid upload state %s: %v", s.file, err)
+		return s, nil
+	}
+	if saved.Target == s.Target && saved.Path == s.Path && saved.Size == s.Size && saved.ModTime.Equal(s.ModTime) {
+		s.UploadID = saved.UploadID
+	} else if saved.UploadID != "" {
+		log.Infof("%s has changed since it was last uploaded to %s, the upload is restarted", path, target)
+	}
+	return s, nil
+}
+
+func (s *uploadState) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// the state is replaced atomically, so that it is never truncated
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (s *uploadState) remove() {
+	if err := os.Remove(s.file); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Unable to remove the upload state %s: %v", s.file, err)
+	}
+}
+
+// uploadedPart is a part of a multipart upload which has been uploaded
+type uploadedPart struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// objectRequest signs and sends a request for an object in an
+// S3-compatible object storage, with the sub-resource in query, and
+// returns the response if it succeeded
+type objectRequest func(method, query string, body io.Reader, length int64) (*http.Response, error)
+
+// multipartUpload uploads a file to target with the multipart upload API
+// of S3, which S3-compatible object storages implement as well, with up to
+// opts.Parallel parts at the same time. If opts.Resume is set, a failed
+// upload is kept and resumed by the next upload of the same file to the
+// same target, otherwise it is aborted, so that its parts are not kept.
+func multipartUpload(f *os.File, target string, size int64, opts uploadOptions, progress *uploadProgress, send objectRequest) (err error) {
+	start := time.Now()
+	span := trace.Start("upload", "file", f.Name(), "destination", target)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		metrics.Upload("object-storage", start, err)
+	}()
+
+	state, err := loadUploadState(target, f.Name())
+	if err != nil {
+		return err
+	}
+	uploaded := map[int]uploadedPart{}
+	if state.UploadID != "" {
+		query := "uploadId=" + url.QueryEscape(state.UploadID)
+		if !opts.Resume {
+			abortMultipartUpload(send, query)
+			state.remove()
+			state.UploadID = ""
+		} else if uploaded, err = listMultipartParts(send, query); err != nil {
+			log.Infof("Unable to resume the previous upload, it is restarted: %v", err)
+			state.UploadID = ""
+			uploaded = map[int]uploadedPart{}
+		} else {
+			log.Infof("Resuming the previous upload, %d parts are already uploaded", len(uploaded))
+		}
+	}
+
+	if state.UploadID == "" {
+		resp, err := send(http.MethodPost, "uploads", nil, 0)
+		if err != nil {
+			return err
+		}
+		var initiate struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&initiate)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to decode the multipart upload: %v", err)
+		}
+		state.UploadID = initiate.UploadID
+		if opts.Resume {
+			if err := state.save(); err != nil {
+				log.Warnf("Unable to save the upload state, it cannot be resumed: %v", err)
+			}
+		}
+	}
+	uploadID := "uploadId=" + url.QueryEscape(state.UploadID)
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	partSize := multipartSize(size)
+	parts := make([]completedPart, (size+partSize-1)/partSize)
+	err = uploadParts(size, partSize, opts.Parallel, progress, func(n int, offset, length int64) error {
+		if p, ok := uploaded[n]; ok && p.Size == length {
+			parts[n-1] = completedPart{PartNumber: n, ETag: p.ETag}
+			return nil
+		}
+		resp, err := send(http.MethodPut, fmt.Sprintf("partNumber=%d&%s", n, uploadID), io.NewSectionReader(f, offset, length), length)
+		if err != nil {
+			return fmt.Errorf("part %d: %v", n, err)
+		}
+		resp.Body.Close()
+		parts[n-1] = completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")}
+		return nil
+	})
+	if err != nil {
+		if opts.Resume {
+			log.Warnf("The upload failed, push the same image again to resume it")
+		} else {
+			abortMultipartUpload(send, uploadID)
+			state.remove()
+		}
+		return err
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := send(http.MethodPost, uploadID, bytes.NewReader(body), int64(len(body)))
+	if err == nil {
+		// errors completing an upload may be reported in a successful response
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if bytes.Contains(b, []byte("<Error>")) {
+			err = fmt.Errorf("Unable to complete the upload: %s", b)
+		}
+	}
+	if err != nil {
+		// the parts are uploaded, but it cannot be told whether they are
+		// what prevents the upload from completing
+		abortMultipartUpload(send, uploadID)
+	}
+	state.remove()
+	return err
+}
+
+// listMultipartParts returns the parts of a multipart upload which have
+// been uploaded
+func listMultipartParts(send objectRequest, uploadID string) (map[int]uploadedPart, error) {
+	parts := map[int]uploadedPart{}
+	marker := 0
+	for {
+		query := uploadID
+		if marker > 0 {
+			query += fmt.Sprintf("&part-number-marker=%d", marker)
+		}
+		resp, err := send(http.MethodGet, query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Parts                []uploadedPart `xml:"Part"`
+			IsTruncated          bool           `xml:"IsTruncated"`
+			NextPartNumberMarker int            `xml:"NextPartNumberMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode the parts of the upload: %v", err)
+		}
+		for _, p := range list.Parts {
+			parts[p.PartNumber] = p
+		}
+		if !list.IsTruncated || list.NextPartNumberMarker <= marker {
+			return parts, nil
+		}
+		marker = list.NextPartNumberMarker
+	}
+}
+
+func abortMultipartUpload(send objectRequest, uploadID string) {
+	resp, err := send(http.MethodDelete, uploadID, nil, 0)
+	if err != nil {
+		log.Warnf("Unable to abort the upload: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
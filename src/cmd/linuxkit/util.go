@@ -2,12 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Handle flags with multiple occurrences
@@ -166,6 +175,9 @@ type DiskConfig struct {
 	Path   string
 	Size   int
 	Format string
+	// Snapshot discards the writes to the disk, so that several qemu VMs
+	// can boot from it
+	Snapshot bool
 }
 
 // Disks is the type for a list of DiskConfig
@@ -210,6 +222,7 @@ func (l *Disks) Set(value string) error {
 type PublishedPort struct {
 	Guest    uint16
 	Host     uint16
+	HostIP   string
 	Protocol string
 }
 
@@ -255,6 +268,73 @@ func NewPublishedPort(publish string) (PublishedPort, error) {
 	return p, nil
 }
 
+// NewPublishedPorts parses a string of the form
+// [<host ip>:]<host>[-<host end>]:<guest>[-<guest end>][/<tcp|udp>] and returns
+// a PublishedPort structure for each port of the range
+func NewPublishedPorts(publish string) ([]PublishedPort, error) {
+	protocol := "tcp"
+	if i := strings.LastIndex(publish, "/"); i != -1 {
+		protocol = strings.TrimSpace(strings.ToLower(publish[i+1:]))
+		publish = publish[:i]
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("Provided protocol is not valid, valid options are: udp and tcp")
+	}
+
+	slice := strings.Split(publish, ":")
+	var hostIP string
+	switch len(slice) {
+	case 2:
+	case 3:
+		hostIP = slice[0]
+		if net.ParseIP(hostIP).To4() == nil {
+			return nil, fmt.Errorf("Invalid host IP address: %s", hostIP)
+		}
+		slice = slice[1:]
+	default:
+		return nil, fmt.Errorf("Unable to parse the ports to be published, should be in format [<host ip>:]<host>[-<host end>]:<guest>[-<guest end>][/<tcp|udp>]")
+	}
+
+	hostStart, hostEnd, err := parsePortRange(slice[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid host port: %v", err)
+	}
+	guestStart, guestEnd, err := parsePortRange(slice[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid guest port: %v", err)
+	}
+	if hostEnd-hostStart != guestEnd-guestStart {
+		return nil, fmt.Errorf("The host and guest port ranges must have the same length")
+	}
+
+	var ports []PublishedPort
+	for i := uint16(0); i <= hostEnd-hostStart; i++ {
+		ports = append(ports, PublishedPort{
+			Guest:    guestStart + i,
+			Host:     hostStart + i,
+			HostIP:   hostIP,
+			Protocol: protocol,
+		})
+	}
+	return ports, nil
+}
+
+// parsePortRange parses a port or a range of ports of the form <start>-<end>
+func parsePortRange(r string) (uint16, uint16, error) {
+	bounds := strings.SplitN(r, "-", 2)
+	start, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil || start < 1 {
+		return 0, 0, fmt.Errorf("%s is not a valid port", bounds[0])
+	}
+	end := start
+	if len(bounds) == 2 {
+		if end, err = strconv.ParseUint(bounds[1], 10, 16); err != nil || end < start {
+			return 0, 0, fmt.Errorf("%s is not a valid port range", r)
+		}
+	}
+	return uint16(start), uint16(end), nil
+}
+
 // CreateMetadataISO writes the provided meta data to an iso file in the given state directory
 func CreateMetadataISO(state, data string, dataPath string) ([]string, error) {
 	var d []byte
@@ -281,3 +361,168 @@ func CreateMetadataISO(state, data string, dataPath string) ([]string, error) {
 	}
 	return []string{isoPath}, nil
 }
+
+// consoleLogFlag adds the -console-log flag to the flags of a run backend
+func consoleLogFlag(flags *flag.FlagSet) *string {
+	return flags.String("console-log", "", "Path to a file to append the console output of the VM to, with timestamps")
+}
+
+// consoleCaptured returns whether the console output of a VM is copied, to
+// record the exit status the guest reports: when it is logged to path, or
+// when the standard output is not a terminal, as in CI. Otherwise the
+// hypervisor is given the terminal directly.
+func consoleCaptured(path string) bool {
+	return path != "" || !terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// consoleWriter returns a writer for the console output of a VM, which writes
+// to w and, if path is set, with timestamps to the end of the file at path.
+// If the console is captured the exit status the guest reports on it is
+// recorded, otherwise w is returned as is.
+func consoleWriter(w io.Writer, path string) (io.Writer, error) {
+	if !consoleCaptured(path) {
+		return w, nil
+	}
+	if path == "" {
+		return &guestExitWriter{w: w}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open console log: %v", err)
+	}
+	return &guestExitWriter{w: io.MultiWriter(w, &timestampWriter{w: f, bol: true})}, nil
+}
+
+// timestampWriter prefixes each line written to w with a timestamp
+type timestampWriter struct {
+	w   io.Writer
+	mu  sync.Mutex
+	bol bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buf bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		if t.bol {
+			buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano) + " ")
+			t.bol = false
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i == -1 {
+			buf.Write(rest)
+			break
+		}
+		buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+		t.bol = true
+	}
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RunInfo is the machine readable information about a VM started by a run
+// backend, which is written with -info
+type RunInfo struct {
+	Backend    string   `json:"backend"`
+	ID         string   `json:"id,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Image      string   `json:"image,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+	StatePath  string   `json:"state,omitempty"`
+	Console    string   `json:"console,omitempty"`
+	ConsoleLog string   `json:"console_log,omitempty"`
+	SSH        string   `json:"ssh,omitempty"`
+}
+
+// runInfoFlag adds the -info flag to the flags of a run backend
+func runInfoFlag(flags *flag.FlagSet) *string {
+	return flags.String("info", "", "Path to a file to write information about the VM to as JSON once it is started, or fd:N to write it to file descriptor N")
+}
+
+// writeRunInfo writes info as JSON to path, if it is set
+func writeRunInfo(path string, info RunInfo) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if strings.HasPrefix(path, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(path, "fd:"))
+		if err != nil {
+			return fmt.Errorf("Invalid file descriptor %s", path)
+		}
+		if _, err := os.NewFile(uintptr(fd), path).Write(b); err != nil {
+			return fmt.Errorf("Cannot write VM info to %s: %v", path, err)
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("Cannot write VM info: %v", err)
+	}
+	return nil
+}
+
+// Tag is a key=value tag of a cloud resource
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Tags are the tags given with -tag, which push and run backends apply to
+// the cloud resources they create
+type Tags []Tag
+
+func (t *Tags) String() string {
+	return strings.Join(t.Strings(), ",")
+}
+
+// Set adds a tag given as key=value, the value may be empty
+func (t *Tags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if kv[0] == "" {
+		return fmt.Errorf("Invalid tag %q, must be key=value", value)
+	}
+	tag := Tag{Key: kv[0]}
+	if len(kv) == 2 {
+		tag.Value = kv[1]
+	}
+	*t = append(*t, tag)
+	return nil
+}
+
+// Map returns the tags as a map, for APIs with key/value tags
+func (t Tags) Map() map[string]string {
+	m := map[string]string{}
+	for _, tag := range t {
+		m[tag.Key] = tag.Value
+	}
+	return m
+}
+
+// Strings returns the tags as key=value strings, or just the key if the
+// value is empty, for APIs whose tags are plain strings
+func (t Tags) Strings() []string {
+	var s []string
+	for _, tag := range t {
+		if tag.Value == "" {
+			s = append(s, tag.Key)
+		} else {
+			s = append(s, tag.Key+"="+tag.Value)
+		}
+	}
+	return s
+}
+
+// tagFlag adds the -tag flag to the flags of a push or run backend
+func tagFlag(flags *flag.FlagSet) *Tags {
+	var tags Tags
+	flags.Var(&tags, "tag", "Tag to apply to the created cloud resources as key=value, may be repeated")
+	return &tags
+}
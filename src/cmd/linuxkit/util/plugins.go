@@ -0,0 +1,39 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// PathPlugins returns the executables on the PATH whose name starts with
+// prefix, by the rest of their name, e.g. mycloud for linuxkit-run-mycloud.
+// The first on the PATH is used, as by exec.LookPath.
+func PathPlugins(prefix string) map[string]string {
+	plugins := map[string]string{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(dir, prefix+"*"))
+		sort.Strings(matches)
+		for _, m := range matches {
+			name := strings.TrimPrefix(filepath.Base(m), prefix)
+			if runtime.GOOS == "windows" {
+				ext := strings.ToLower(filepath.Ext(name))
+				if ext != ".exe" && ext != ".bat" && ext != ".cmd" {
+					continue
+				}
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			if _, ok := plugins[name]; ok || name == "" {
+				continue
+			}
+			fi, err := os.Stat(m)
+			if err != nil || fi.IsDir() || runtime.GOOS != "windows" && fi.Mode()&0111 == 0 {
+				continue
+			}
+			plugins[name] = m
+		}
+	}
+	return plugins
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vCenterConsoleLog is the file on the datastore the serial console of a VM
+// is written to
+const vCenterConsoleLog = "console.log"
+
+// vCenterDiskName returns the datastore path of the disk pushed from a vmdk
+func vCenterDiskName(newVM vmConfig) string {
+	return fmt.Sprintf("%s/%s.vmdk", *newVM.vmFolder, strings.TrimSuffix(path.Base(*newVM.path), ".vmdk"))
+}
+
+// uploadVMDK uploads a stream optimized vmdk and converts it to a thin
+// provisioned disk which VMs can use
+func uploadVMDK(ctx context.Context, c *govmomi.Client, newVM vmConfig, dc *object.Datacenter, dss *object.Datastore) {
+	disk := vCenterDiskName(newVM)
+	upload := strings.TrimSuffix(disk, ".vmdk") + "-upload.vmdk"
+
+	log.Infof("Uploading LinuxKit file [%s]", *newVM.path)
+	p := soap.DefaultUpload
+	if err := c.Client.UploadFile(ctx, *newVM.path, dss.NewURL(upload), &p); err != nil {
+		log.Fatalf("Unable to upload file to vCenter Datastore\n%v", err)
+	}
+
+	log.Infof("Converting [%s] to a thin provisioned disk", upload)
+	m := object.NewVirtualDiskManager(c.Client)
+	spec := &types.VirtualDiskSpec{
+		DiskType:    string(types.VirtualDiskTypeThin),
+		AdapterType: string(types.VirtualDiskAdapterTypeLsiLogic),
+	}
+	task, err := m.CopyVirtualDisk(ctx, dss.Path(upload), dc, dss.Path(disk), dc, spec, true)
+	if err != nil {
+		log.Fatalf("Unable to convert disk\n%v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		log.Fatalf("Converting disk failed\n%v", err)
+	}
+	task, err = m.DeleteVirtualDisk(ctx, dss.Path(upload), dc)
+	if err != nil {
+		log.Fatalf("Unable to delete uploaded disk\n%v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		log.Warnf("Deleting uploaded disk failed: %v", err)
+	}
+}
+
+// ovaFile opens the file with the given name in an OVA archive
+func ovaFile(ova, name string) (io.Reader, int64, func(), error) {
+	f, err := os.Open(ova)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+		if h.Name == name || (name == "" && strings.HasSuffix(h.Name, ".ovf")) {
+			return tr, h.Size, func() { f.Close() }, nil
+		}
+	}
+	f.Close()
+	return nil, 0, nil, fmt.Errorf("%s is not in %s", name, ova)
+}
+
+// importOVA imports an OVA as a VM named after the folder, which is marked
+// as a template unless asTemplate is false
+func importOVA(ctx context.Context, c *govmomi.Client, newVM vmConfig, folders *object.DatacenterFolders, dss *object.Datastore, hs *object.HostSystem, rp *object.ResourcePool, asTemplate bool) {
+	r, _, done, err := ovaFile(*newVM.path, "")
+	if err != nil {
+		log.Fatalf("Unable to find the OVF descriptor\n%v", err)
+	}
+	descriptor, err := ioutil.ReadAll(r)
+	done()
+	if err != nil {
+		log.Fatalf("Unable to read the OVF descriptor\n%v", err)
+	}
+
+	req := types.CreateImportSpec{
+		This:          *c.Client.ServiceContent.OvfManager,
+		OvfDescriptor: string(descriptor),
+		ResourcePool:  rp.Reference(),
+		Datastore:     dss.Reference(),
+		Cisp: types.OvfCreateImportSpecParams{
+			EntityName:       *newVM.vmFolder,
+			DiskProvisioning: string(types.VirtualDiskTypeThin),
+		},
+	}
+	res, err := methods.CreateImportSpec(ctx, c.Client, &req)
+	if err != nil {
+		log.Fatalf("Unable to create import spec\n%v", err)
+	}
+	spec := res.Returnval
+	if len(spec.Error) > 0 {
+		log.Fatalf("Unable to import OVA\n%s", spec.Error[0].LocalizedMessage)
+	}
+	for _, w := range spec.Warning {
+		log.Warnf("%s", w.LocalizedMessage)
+	}
+
+	log.Infof("Importing LinuxKit OVA [%s]", *newVM.path)
+	lease, err := rp.ImportVApp(ctx, spec.ImportSpec, folders.VmFolder, hs)
+	if err != nil {
+		log.Fatalf("Unable to import OVA\n%v", err)
+	}
+	info, err := lease.Wait(ctx, spec.FileItem)
+	if err != nil {
+		log.Fatalf("Importing OVA failed\n%v", err)
+	}
+	updater := lease.StartUpdater(ctx, info)
+	for _, item := range info.Items {
+		r, size, done, err := ovaFile(*newVM.path, item.Path)
+		if err != nil {
+			lease.Abort(ctx, nil)
+			log.Fatalf("Unable to read %s\n%v", item.Path, err)
+		}
+		opts := soap.Upload{ContentLength: size}
+		err = lease.Upload(ctx, item, r, opts)
+		done()
+		if err != nil {
+			lease.Abort(ctx, nil)
+			log.Fatalf("Unable to upload %s\n%v", item.Path, err)
+		}
+	}
+	updater.Done()
+	if err := lease.Complete(ctx); err != nil {
+		log.Fatalf("Importing OVA failed\n%v", err)
+	}
+
+	if asTemplate {
+		vm := object.NewVirtualMachine(c.Client, info.Entity)
+		if err := vm.MarkAsTemplate(ctx); err != nil {
+			log.Fatalf("Unable to mark %s as a template\n%v", *newVM.vmFolder, err)
+		}
+		log.Infof("Template [%s] created", *newVM.vmFolder)
+	}
+}
+
+// cloneTemplate creates a VM from a template, with the CPUs and memory of
+// the configuration and, if a network is given, the first network adapter
+// connected to it
+func cloneTemplate(ctx context.Context, template *object.VirtualMachine, newVM vmConfig, folders *object.DatacenterFolders, dss *object.Datastore, hs *object.HostSystem, net object.NetworkReference, rp *object.ResourcePool) *object.VirtualMachine {
+	pool, host, ds := rp.Reference(), hs.Reference(), dss.Reference()
+	spec := types.VirtualMachineCloneSpec{
+		Location: types.VirtualMachineRelocateSpec{Pool: &pool, Host: &host, Datastore: &ds},
+		Config: &types.VirtualMachineConfigSpec{
+			NumCPUs:  int32(*newVM.vCpus),
+			MemoryMB: *newVM.mem,
+		},
+	}
+
+	if net != nil {
+		devices, err := template.Device(ctx)
+		if err != nil {
+			log.Fatalf("Unable to read devices from template configuration\n%v", err)
+		}
+		backing, err := net.EthernetCardBackingInfo(ctx)
+		if err != nil {
+			log.Fatalf("Unable to determine vCenter network backend\n%v", err)
+		}
+		nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+		if len(nics) == 0 {
+			log.Fatalf("The template has no network adapter to connect to the network")
+		}
+		nics[0].GetVirtualDevice().Backing = backing
+		spec.Config.DeviceChange = append(spec.Config.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    nics[0],
+		})
+	}
+
+	log.Infof("Cloning template [%s] to [%s]", template.Name(), *newVM.vmFolder)
+	task, err := template.Clone(ctx, folders.VmFolder, *newVM.vmFolder, spec)
+	if err != nil {
+		log.Fatalf("Cloning template failed, more detail can be found in vCenter tasks\n%v", err)
+	}
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		log.Fatalf("Cloning template failed\n%v", err)
+	}
+	return object.NewVirtualMachine(template.Client(), info.Result.(types.ManagedObjectReference))
+}
+
+// addDisk attaches the disk pushed from a vmdk, the VM boots from it
+func addDisk(ctx context.Context, vm *object.VirtualMachine, dss *object.Datastore, newVM vmConfig) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		log.Fatalf("Unable to read devices from VM configuration\n%v", err)
+	}
+
+	controller, err := devices.FindDiskController("scsi")
+	if err != nil {
+		log.Fatalf("Unable to find SCSI device from VM configuration\n%v", err)
+	}
+	disk := devices.CreateDisk(controller, dss.Reference(), dss.Path(vCenterDiskName(newVM)))
+
+	log.Infof("Adding the LinuxKit disk to the Virtual Machine")
+	if err := vm.AddDevice(ctx, disk); err != nil {
+		log.Fatalf("Unable to add disk to VM configuration\n%v", err)
+	}
+}
+
+// addSerialLog adds a serial port which writes to the console log file in
+// the folder of the VM
+func addSerialLog(ctx context.Context, vm *object.VirtualMachine, dss *object.Datastore, newVM vmConfig) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		log.Fatalf("Unable to read devices from VM configuration\n%v", err)
+	}
+	serial, err := devices.CreateSerialPort()
+	if err != nil {
+		log.Fatalf("Unable to create serial port\n%v", err)
+	}
+	serial.Backing = &types.VirtualSerialPortFileBackingInfo{
+		VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+			FileName: dss.Path(fmt.Sprintf("%s/%s", *newVM.vmFolder, vCenterConsoleLog)),
+		},
+	}
+
+	log.Infof("Adding a serial console log to the Virtual Machine")
+	if err := vm.AddDevice(ctx, serial); err != nil {
+		log.Fatalf("Unable to add serial port to VM configuration\n%v", err)
+	}
+}
+
+// followConsoleLog writes the console log of a VM to w as it grows, until
+// the VM is powered off
+func followConsoleLog(ctx context.Context, vm *object.VirtualMachine, dss *object.Datastore, newVM vmConfig, w io.Writer) error {
+	name := fmt.Sprintf("%s/%s", *newVM.vmFolder, vCenterConsoleLog)
+	var offset int
+	for {
+		state, err := vm.PowerState(ctx)
+		if err != nil {
+			return err
+		}
+		// the log only exists once the VM has written to the serial port
+		if r, _, err := dss.Download(ctx, name, &soap.DefaultDownload); err == nil {
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if len(b) > offset {
+				if _, err := w.Write(b[offset:]); err != nil {
+					return err
+				}
+				offset = len(b)
+			}
+		}
+		if state == types.VirtualMachinePowerStatePoweredOff {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// vCenterREST is a client of the vSphere Automation REST API, which the
+// Content Library is only available through. govmomi only supports it
+// in later versions than the vendored one.
+type vCenterREST struct {
+	base    string
+	client  *http.Client
+	session string
+}
+
+// vCenterRESTError is the body of a failed request
+type vCenterRESTError struct {
+	Type  string `json:"type"`
+	Value struct {
+		Messages []struct {
+			DefaultMessage string `json:"default_message"`
+		} `json:"messages"`
+	} `json:"value"`
+}
+
+// newVCenterREST logs in to the REST API of the vCenter at u, with the user
+// and password in u
+func newVCenterREST(ctx context.Context, u *url.URL) (*vCenterREST, error) {
+	r := &vCenterREST{
+		base: fmt.Sprintf("%s://%s/rest", u.Scheme, u.Host),
+		// as with the SOAP API, the certificate of vCenter is not verified
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}},
+	}
+	password, _ := u.User.Password()
+	req, err := http.NewRequest(http.MethodPost, r.base+"/com/vmware/cis/session", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(u.User.Username(), password)
+	var session string
+	if err := r.send(ctx, req, &session); err != nil {
+		return nil, fmt.Errorf("Unable to log in to vCenter: %v", err)
+	}
+	r.session = session
+	return r, nil
+}
+
+// logout ends the session
+func (r *vCenterREST) logout(ctx context.Context) {
+	if err := r.do(ctx, http.MethodDelete, "/com/vmware/cis/session", nil, nil); err != nil {
+		log.Debugf("Unable to log out of vCenter: %v", err)
+	}
+}
+
+// do sends a request with a JSON body, if it is not nil, and decodes the
+// value of the response into result, if it is not nil
+func (r *vCenterREST) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var b io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		b = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, r.base+path, b)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return r.send(ctx, req, result)
+}
+
+func (r *vCenterREST) send(ctx context.Context, req *http.Request, result interface{}) error {
+	if r.session != "" {
+		req.Header.Set("vmware-api-session-id", r.session)
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e vCenterRESTError
+		if json.Unmarshal(b, &e) == nil && len(e.Value.Messages) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, e.Value.Messages[0].DefaultMessage)
+		}
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	value := struct {
+		Value interface{} `json:"value"`
+	}{Value: result}
+	return json.Unmarshal(b, &value)
+}
+
+// upload sends a file to the upload endpoint of an update session
+func (r *vCenterREST) upload(ctx context.Context, uri string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, uri, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return r.send(ctx, req, nil)
+}
+
+// libraryFile is a file of a Content Library item
+type libraryFile struct {
+	name string
+	size int64
+	open func() (io.Reader, func(), error)
+}
+
+// libraryFiles returns the files of the item an image is uploaded as, and
+// the type of the item. OVAs are uploaded as the files they contain, which
+// makes the item an OVF template.
+func libraryFiles(image string) ([]libraryFile, string, error) {
+	fi, err := os.Stat(image)
+	if err != nil {
+		return nil, "", err
+	}
+	switch path.Ext(image) {
+	case ".iso":
+		return []libraryFile{openLibraryFile(image, fi.Size())}, "iso", nil
+	case ".vmdk":
+		return []libraryFile{openLibraryFile(image, fi.Size())}, "", nil
+	}
+
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	var files []libraryFile
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := h.Name
+		files = append(files, libraryFile{
+			name: path.Base(name),
+			size: h.Size,
+			open: func() (io.Reader, func(), error) {
+				r, _, done, err := ovaFile(image, name)
+				return r, done, err
+			},
+		})
+	}
+	return files, "ovf", nil
+}
+
+func openLibraryFile(image string, size int64) libraryFile {
+	return libraryFile{
+		name: path.Base(image),
+		size: size,
+		open: func() (io.Reader, func(), error) {
+			f, err := os.Open(image)
+			if err != nil {
+				return nil, nil, err
+			}
+			return f, func() { f.Close() }, nil
+		},
+	}
+}
+
+// pushContentLibrary uploads an OVA, vmdk or ISO to an item of a Content
+// Library, creating the item if it does not exist yet and replacing the
+// files of the same name otherwise, and returns the ID of the item
+func pushContentLibrary(ctx context.Context, u *url.URL, library, item, image string) (string, error) {
+	files, itemType, err := libraryFiles(image)
+	if err != nil {
+		return "", err
+	}
+	r, err := newVCenterREST(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	defer r.logout(ctx)
+
+	var libraries []string
+	if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library?~action=find",
+		map[string]interface{}{"spec": map[string]string{"name": library}}, &libraries); err != nil {
+		return "", fmt.Errorf("Unable to find Content Library %s: %v", library, err)
+	}
+	if len(libraries) == 0 {
+		return "", fmt.Errorf("There is no Content Library named %s", library)
+	}
+	libraryID := libraries[0]
+
+	var items []string
+	if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item?~action=find",
+		map[string]interface{}{"spec": map[string]string{"library_id": libraryID, "name": item}}, &items); err != nil {
+		return "", fmt.Errorf("Unable to find item %s: %v", item, err)
+	}
+	var itemID string
+	if len(items) > 0 {
+		itemID = items[0]
+		log.Infof("Updating item %s of Content Library %s", item, library)
+	} else {
+		log.Infof("Creating item %s in Content Library %s", item, library)
+		createSpec := map[string]string{"library_id": libraryID, "name": item}
+		if itemType != "" {
+			createSpec["type"] = itemType
+		}
+		spec := map[string]interface{}{
+			"create_spec":  createSpec,
+			"client_token": uuid.New().String(),
+		}
+		if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item", spec, &itemID); err != nil {
+			return "", fmt.Errorf("Unable to create item %s: %v", item, err)
+		}
+	}
+
+	var sessionID string
+	spec := map[string]interface{}{
+		"create_spec":  map[string]string{"library_item_id": itemID},
+		"client_token": uuid.New().String(),
+	}
+	if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item/update-session", spec, &sessionID); err != nil {
+		return "", fmt.Errorf("Unable to start the upload: %v", err)
+	}
+	if err := uploadLibraryFiles(ctx, r, sessionID, files); err != nil {
+		if cancelErr := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item/update-session/id:"+sessionID+"?~action=cancel", nil, nil); cancelErr != nil {
+			log.Warnf("Unable to cancel the upload: %v", cancelErr)
+		}
+		return "", err
+	}
+	return itemID, nil
+}
+
+// uploadLibraryFiles uploads files in an update session, and waits for it
+// to be done
+func uploadLibraryFiles(ctx context.Context, r *vCenterREST, sessionID string, files []libraryFile) error {
+	for _, f := range files {
+		log.Infof("Uploading %s", f.name)
+		var info struct {
+			UploadEndpoint struct {
+				URI string `json:"uri"`
+			} `json:"upload_endpoint"`
+		}
+		spec := map[string]interface{}{
+			"file_spec": map[string]interface{}{"name": f.name, "source_type": "PUSH", "size": f.size},
+		}
+		if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item/updatesession/file/id:"+sessionID+"?~action=add", spec, &info); err != nil {
+			return fmt.Errorf("Unable to add %s: %v", f.name, err)
+		}
+		body, done, err := f.open()
+		if err != nil {
+			return err
+		}
+		err = r.upload(ctx, info.UploadEndpoint.URI, body, f.size)
+		done()
+		if err != nil {
+			return fmt.Errorf("Unable to upload %s: %v", f.name, err)
+		}
+	}
+
+	var validation struct {
+		HasErrors    bool     `json:"has_errors"`
+		MissingFiles []string `json:"missing_files"`
+		InvalidFiles []struct {
+			Name         string `json:"name"`
+			ErrorMessage struct {
+				DefaultMessage string `json:"default_message"`
+			} `json:"error_message"`
+		} `json:"invalid_files"`
+	}
+	if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item/updatesession/file/id:"+sessionID+"?~action=validate", nil, &validation); err != nil {
+		return fmt.Errorf("Unable to validate the upload: %v", err)
+	}
+	if len(validation.MissingFiles) > 0 {
+		return fmt.Errorf("The upload is missing %s", strings.Join(validation.MissingFiles, ", "))
+	}
+	if len(validation.InvalidFiles) > 0 {
+		return fmt.Errorf("%s is invalid: %s", validation.InvalidFiles[0].Name, validation.InvalidFiles[0].ErrorMessage.DefaultMessage)
+	}
+
+	if err := r.do(ctx, http.MethodPost, "/com/vmware/content/library/item/update-session/id:"+sessionID+"?~action=complete", nil, nil); err != nil {
+		return fmt.Errorf("Unable to complete the upload: %v", err)
+	}
+	for {
+		var session struct {
+			State        string `json:"state"`
+			ErrorMessage struct {
+				DefaultMessage string `json:"default_message"`
+			} `json:"error_message"`
+		}
+		if err := r.do(ctx, http.MethodGet, "/com/vmware/content/library/item/update-session/id:"+sessionID, nil, &session); err != nil {
+			return fmt.Errorf("Unable to get the state of the upload: %v", err)
+		}
+		switch session.State {
+		case "DONE":
+			return nil
+		case "ERROR", "CANCELED":
+			return fmt.Errorf("The upload failed: %s", session.ErrorMessage.DefaultMessage)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
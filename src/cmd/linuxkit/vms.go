@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// qemuPidFile is the file in the state directory qemu writes its pid to
+	qemuPidFile = "qemu.pid"
+	// vmInfoFile is the file in the state directory the information about
+	// the VM is written to when it is started
+	vmInfoFile = "vm.json"
+)
+
+// vmName matches the names VMs can be run with
+var vmName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// vmsDir is the directory of the state directories of the VMs started
+// with -name
+func vmsDir() string {
+	return filepath.Join(util.HomeDir(), ".linuxkit", "vms")
+}
+
+// namedVMStateDir returns the state directory of the VM of the name, if
+// it is a valid name
+func namedVMStateDir(name string) (string, error) {
+	if !vmName.MatchString(name) {
+		return "", fmt.Errorf("Invalid VM name %s, it must only have letters, digits, '_', '.' and '-'", name)
+	}
+	return filepath.Join(vmsDir(), name), nil
+}
+
+// vmProcess is a qemu process of a VM, of which there is one for each node
+type vmProcess struct {
+	statePath string
+	pid       int
+	running   bool
+}
+
+// vmProcesses returns the qemu processes of the VM in the state directory
+// and in the state directories of its nodes
+func vmProcesses(state string) []vmProcess {
+	paths := []string{state}
+	nodes, _ := filepath.Glob(filepath.Join(state, "node*"))
+	sort.Strings(nodes)
+	paths = append(paths, nodes...)
+	var procs []vmProcess
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(filepath.Join(p, qemuPidFile))
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			continue
+		}
+		procs = append(procs, vmProcess{statePath: p, pid: pid, running: processRunning(pid)})
+	}
+	return procs
+}
+
+// processRunning returns whether the process of the pid is running
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// vmRunning returns whether any qemu of the VM in the state directory is
+// running
+func vmRunning(state string) bool {
+	for _, p := range vmProcesses(state) {
+		if p.running {
+			return true
+		}
+	}
+	return false
+}
+
+// isVMStateDir returns whether the directory is the state directory of a
+// VM, so that it can be removed
+func isVMStateDir(state string) bool {
+	if _, err := os.Stat(filepath.Join(state, vmInfoFile)); err == nil {
+		return true
+	}
+	// the state directory of a VM which failed to start may be empty
+	if files, err := ioutil.ReadDir(state); err == nil && len(files) == 0 {
+		return true
+	}
+	return len(vmProcesses(state)) > 0
+}
+
+// stopVM shuts the guest of each running qemu of the VM in the state
+// directory down, and kills the qemu which did not exit by the timeout
+func stopVM(state string, timeout time.Duration) error {
+	var running []vmProcess
+	for _, p := range vmProcesses(state) {
+		if p.running {
+			running = append(running, p)
+		}
+	}
+	if len(running) == 0 {
+		return fmt.Errorf("VM %s is not running", state)
+	}
+	if timeout > 0 {
+		for _, p := range running {
+			c, err := newQMPClient(filepath.Join(p.statePath, qemuQMPSocket))
+			if err != nil {
+				log.Debugf("Cannot connect to the QMP socket of %s: %v", p.statePath, err)
+				continue
+			}
+			if _, err := c.execute("system_powerdown", nil); err != nil {
+				log.Debugf("Cannot shut %s down: %v", p.statePath, err)
+			}
+			c.Close()
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for _, p := range running {
+		for processRunning(p.pid) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !processRunning(p.pid) {
+			continue
+		}
+		if timeout > 0 {
+			log.Warnf("The VM in %s did not shut down in %v, killing it", p.statePath, timeout)
+		}
+		proc, err := os.FindProcess(p.pid)
+		if err != nil {
+			return err
+		}
+		if err := proc.Kill(); err != nil {
+			return fmt.Errorf("Cannot kill the VM in %s: %v", p.statePath, err)
+		}
+		// the disks may still be written to until qemu has exited
+		for i := 0; processRunning(p.pid) && i < 50; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// ps lists the VMs started with -name
+func ps(args []string) {
+	flags := newFlagSet("ps")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s ps [options]\n\n", invoked)
+		fmt.Printf("List the local VMs started with 'run qemu -name', which keep their state\n")
+		fmt.Printf("in %s.\n\n", vmsDir())
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	names := flags.Bool("names", false, "Only print the names of the VMs")
+	running := flags.Bool("running", false, "Only list the running VMs")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	dirs, err := ioutil.ReadDir(vmsDir())
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Cannot list the VMs: %v", err)
+	}
+	if !*names {
+		fmt.Printf("%-20s %-8s %-8s %-20s %s\n", "NAME", "STATUS", "PID", "CREATED", "IMAGE")
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		state := filepath.Join(vmsDir(), dir.Name())
+		status, pid := "stopped", "-"
+		for _, p := range vmProcesses(state) {
+			if p.running {
+				status, pid = "running", strconv.Itoa(p.pid)
+				break
+			}
+		}
+		if *running && status != "running" {
+			continue
+		}
+		if *names {
+			fmt.Println(dir.Name())
+			continue
+		}
+		var info RunInfo
+		created := "-"
+		if fi, err := os.Stat(filepath.Join(state, vmInfoFile)); err == nil {
+			created = fi.ModTime().Format("2006-01-02 15:04:05")
+			if b, err := ioutil.ReadFile(filepath.Join(state, vmInfoFile)); err == nil {
+				if err := json.Unmarshal(b, &info); err != nil {
+					log.Debugf("Cannot read %s: %v", filepath.Join(state, vmInfoFile), err)
+				}
+			}
+		}
+		fmt.Printf("%-20s %-8s %-8s %-20s %s\n", dir.Name(), status, pid, created, info.Image)
+	}
+}
+
+// stop shuts down detached VMs
+func stop(args []string) {
+	flags := newFlagSet("stop")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s stop [options] name...\n\n", invoked)
+		fmt.Printf("'name' is the name of a VM started with 'run qemu -detached -name',\n")
+		fmt.Printf("or the state directory of a detached qemu VM, or the name of the image\n")
+		fmt.Printf("it was started from if the default state directory was used.\n")
+		fmt.Printf("The guest is asked to shut down, and qemu is killed if it did not by\n")
+		fmt.Printf("the timeout.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	timeout := flags.Duration("timeout", 30*time.Second, "Time the guest has to shut down before qemu is killed")
+	kill := flags.Bool("kill", false, "Kill qemu without shutting the guest down")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify the VM to stop")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *kill {
+		*timeout = 0
+	}
+	for _, name := range flags.Args() {
+		if err := stopVM(vmStateDir(name), *timeout); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(name)
+	}
+}
+
+// rm removes the state directories of VMs
+func rm(args []string) {
+	flags := newFlagSet("rm")
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s rm [options] name...\n\n", invoked)
+		fmt.Printf("Remove the state directory of a VM, with its disks, given the name it\n")
+		fmt.Printf("was started with, its state directory or the name of the image it was\n")
+		fmt.Printf("started from if the default state directory was used.\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	force := flags.Bool("f", false, "Kill the VM if it is running")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Please specify the VM to remove")
+		flags.Usage()
+		os.Exit(1)
+	}
+	for _, name := range flags.Args() {
+		state := vmStateDir(name)
+		if !isVMStateDir(state) {
+			log.Fatalf("%s is not the state directory of a VM", state)
+		}
+		if vmRunning(state) {
+			if !*force {
+				log.Fatalf("VM %s is running, stop it first or use -f", name)
+			}
+			if err := stopVM(state, 0); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := os.RemoveAll(state); err != nil {
+			log.Fatalf("Cannot remove the VM %s: %v", name, err)
+		}
+		fmt.Println(name)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vultrAPIKeyVar = "VULTR_API_KEY"
+	vultrAPIURL    = "https://api.vultr.com/v2"
+	vultrTimeout   = 60 * time.Minute
+)
+
+// VultrClient is a client for the Vultr API v2
+type VultrClient struct {
+	apiKey string
+	client *http.Client
+}
+
+// NewVultrClient creates a client using an API key
+func NewVultrClient(apiKey string) (*VultrClient, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("An API key must be set with -api-key or %s", vultrAPIKeyVar)
+	}
+	return &VultrClient{apiKey: apiKey, client: &http.Client{}}, nil
+}
+
+func (c *VultrClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, vultrAPIURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	log.Debugf("Vultr: %s %s", method, path)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			msg = e.Error
+		}
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// CreateSnapshotFromURL creates a snapshot from a raw disk image which Vultr
+// downloads from url, and waits for it to complete
+func (c *VultrClient) CreateSnapshotFromURL(url, description string) (string, error) {
+	var resp struct {
+		Snapshot struct {
+			ID string `json:"id"`
+		} `json:"snapshot"`
+	}
+	if err := c.do(http.MethodPost, "/snapshots/create-from-url", map[string]string{"url": url, "description": description}, &resp); err != nil {
+		return "", err
+	}
+	id := resp.Snapshot.ID
+	deadline := time.Now().Add(vultrTimeout)
+	for time.Now().Before(deadline) {
+		var s struct {
+			Snapshot struct {
+				Status string `json:"status"`
+			} `json:"snapshot"`
+		}
+		if err := c.do(http.MethodGet, "/snapshots/"+id, nil, &s); err != nil {
+			return id, err
+		}
+		log.Debugf("Vultr: snapshot %s is %s", id, s.Snapshot.Status)
+		if s.Snapshot.Status == "complete" {
+			return id, nil
+		}
+		time.Sleep(15 * time.Second)
+	}
+	return id, fmt.Errorf("timed out waiting for snapshot %s", id)
+}
+
+// DeleteSnapshot deletes a snapshot
+func (c *VultrClient) DeleteSnapshot(id string) error {
+	return c.do(http.MethodDelete, "/snapshots/"+id, nil, nil)
+}
+
+// VultrInstance is the state of an instance
+type VultrInstance struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	PowerStatus string `json:"power_status"`
+	MainIP      string `json:"main_ip"`
+	KVM         string `json:"kvm"`
+}
+
+// CreateInstance creates an instance from a snapshot and waits for it to be
+// running. The instance is deleted if the run fails or is interrupted before
+// keepResources is called.
+func (c *VultrClient) CreateInstance(region, plan, snapshot, label, userData string, tags []string) (*VultrInstance, error) {
+	req := map[string]interface{}{
+		"region":      region,
+		"plan":        plan,
+		"snapshot_id": snapshot,
+		"label":       label,
+		"hostname":    label,
+	}
+	if userData != "" {
+		req["user_data"] = userData
+	}
+	if len(tags) > 0 {
+		req["tags"] = tags
+	}
+	var resp struct {
+		Instance VultrInstance `json:"instance"`
+	}
+	if err := c.do(http.MethodPost, "/instances", req, &resp); err != nil {
+		return nil, err
+	}
+	id := resp.Instance.ID
+	onCleanup("instance "+id, func() error { return c.DeleteInstance(id) })
+	deadline := time.Now().Add(vultrTimeout)
+	for time.Now().Before(deadline) {
+		if err := c.do(http.MethodGet, "/instances/"+id, nil, &resp); err != nil {
+			return nil, err
+		}
+		log.Debugf("Vultr: instance %s is %s, %s", id, resp.Instance.Status, resp.Instance.PowerStatus)
+		if resp.Instance.Status == "active" && resp.Instance.PowerStatus == "running" {
+			return &resp.Instance, nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return nil, fmt.Errorf("timed out waiting for instance %s", id)
+}
+
+// DeleteInstance deletes an instance
+func (c *VultrClient) DeleteInstance(id string) error {
+	return c.do(http.MethodDelete, "/instances/"+id, nil, nil)
+}